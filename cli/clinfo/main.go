@@ -45,6 +45,7 @@ func StatInfo() {
 		data := make([]byte, DataSize)
 		size := uint64(0)
 		// Platform Info
+		log.Printf("Platform %d\n", i)
 		for propName, propVal := range platformProperties {
 			cl.GetPlatformInfo(ids[i], propVal, DataSize, unsafe.Pointer(&data[0]), &size)
 			str := string(data[0:size])
@@ -57,7 +58,8 @@ func StatInfo() {
 		log.Printf("---\n")
 		log.Println("Devices: ")
 		for y := 0; y < int(numDevices); y++ {
-			log.Printf("DeviceIdAddr:%v\n", &devices[y])
+			// Selected in cl backings as [platform]:[device]
+			log.Printf("Device %d:%d (DeviceIdAddr:%v)\n", i, y, &devices[y])
 			for propName, propVal := range deviceProperties {
 				cl.GetDeviceInfo(devices[y], propVal, DataSize, unsafe.Pointer(&data[0]), &size)
 				if size == 4 {
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/coreos/etcd/pkg/flags"
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/securemem"
 	"github.com/spf13/pflag"
 )
 
@@ -19,14 +22,20 @@ const readTimeoutMultiple = 5
 // The CLI client will read or write a single item for talek
 func main() {
 	configPath := pflag.String("config", "talek.conf", "Client configuration for talek")
+	bundlePath := pflag.String("bundle", "", "Signed config bundle, verified against the trust domains of the client configuration")
 	create := pflag.Bool("create", false, "Create a new talek handle")
+	deniable := pflag.Bool("deniable", false, "With --create, make a topic whose items can't be read or attributed once written or read")
 	share := pflag.String("share", "", "Create a read-only version of the topic for sharing")
 	handlePath := pflag.String("topic", "talek.handle", "The talek handle to use")
 	write := pflag.String("write", "", "A message to append to the log (If not specified, the next item will be read.)")
+	ttl := pflag.Uint64("ttl", 0, "Ask servers to drop written messages after this many write epochs (overrides config)")
+	bulk := pflag.Bool("bulk", false, "Mark writes as bulk traffic, which the frontend schedules behind interactive writes")
 	read := pflag.Bool("read", false, "Read from the provided topic")
 	follow := pflag.Bool("follow", false, "Keep reading until interrupt")
 	randSeed := pflag.Int("randSeed", 0, "Use a deterministic random seed. [Dangerous!]")
 	verbose := pflag.Bool("verbose", false, "Print diagnostic information")
+	passphrase := pflag.String("passphrase", "", "Encrypt stored topics with a passphrase (env TALEK_PASSPHRASE)")
+	secureMemory := pflag.Bool("secure-memory", false, "Keep topic keys and seeds in locked memory, out of swap and core dumps (env TALEK_SECURE_MEMORY)")
 	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if err != nil {
 		fmt.Printf("Error reading environment variables, %v\n", err)
@@ -34,31 +43,64 @@ func main() {
 	}
 	pflag.Parse()
 
+	if *secureMemory {
+		if err = securemem.Enable(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not lock memory for keys: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Config
 	config := libtalek.ClientConfigFromFile(*configPath)
+	if len(*bundlePath) > 0 {
+		if config, err = libtalek.ClientConfigFromBundle(*configPath, *bundlePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Config bundle could not be verified: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	if config == nil {
 		fmt.Fprintln(os.Stderr, "Talek Client must be run with --config specifying where the server is.")
 		os.Exit(1)
 	}
+	if *ttl > 0 {
+		config.MessageTTL = *ttl
+	}
+	if *bulk {
+		config.WritePriority = common.WriteBulk
+	}
 	if config.Config == nil && *verbose {
 		fmt.Fprintln(os.Stderr, "Common configuration will be fetched from frontend.")
 	}
 
-	topicdata, err := ioutil.ReadFile(*handlePath)
-	if err != nil && !*create {
+	fs, err := libtalek.NewFileStore(filepath.Dir(*handlePath))
+	if err != nil {
 		panic(err)
 	}
+	store := libtalek.Store(fs)
+	if len(*passphrase) > 0 {
+		if store, err = libtalek.NewPassphraseStore(fs, []byte(*passphrase)); err != nil {
+			panic(err)
+		}
+	}
+	storeName := filepath.Base(*handlePath)
 	topic := libtalek.Topic{}
 	if *create {
-		nt, newerr := libtalek.NewTopic()
+		newTopic := libtalek.NewTopic
+		if *deniable {
+			newTopic = libtalek.NewDeniableTopic
+		}
+		nt, newerr := newTopic()
 		if newerr != nil {
-			panic(err)
+			panic(newerr)
 		}
 		topic = *nt
 	} else {
-		if err = topic.UnmarshalText(topicdata); err != nil {
-			panic(err)
+		stored, loaderr := loadTopic(fs, store, storeName)
+		if loaderr != nil {
+			fmt.Fprintf(os.Stderr, "Could not load topic %s: %v\n", *handlePath, loaderr)
+			os.Exit(1)
 		}
+		topic = *stored
 	}
 
 	if len(*share) > 0 {
@@ -137,11 +179,32 @@ func main() {
 		client.Done(&topic.Handle)
 	}
 
-	updatedTopic, err := topic.MarshalText()
-	if err != nil {
+	if err = libtalek.SaveTopic(store, storeName, &topic); err != nil {
 		panic(err)
 	}
-	if err = ioutil.WriteFile(*handlePath, updatedTopic, 0600); err != nil {
-		panic(err)
+}
+
+// loadTopic reads the topic stored under name. A plaintext topic read with a
+// passphrase is accepted, and will be encrypted when it is saved.
+func loadTopic(fs *libtalek.FileStore, store libtalek.Store, name string) (*libtalek.Topic, error) {
+	raw, err := fs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := libtalek.IsEncrypted(raw)
+	if store == libtalek.Store(fs) {
+		if encrypted {
+			return nil, errors.New("topic is encrypted, provide --passphrase")
+		}
+		return libtalek.LoadTopic(fs, name)
+	}
+	if !encrypted {
+		fmt.Fprintf(os.Stderr, "Topic %s is not encrypted, it will be encrypted with the passphrase.\n", name)
+		return libtalek.LoadTopic(fs, name)
+	}
+	topic, err := libtalek.LoadTopic(store, name)
+	if err == libtalek.ErrWrongKey {
+		return nil, errors.New("wrong passphrase, or topic was modified")
 	}
+	return topic, err
 }
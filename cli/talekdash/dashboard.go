@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// dashboard polls the components of a deployment.
+type dashboard struct {
+	frontendAddrs []string
+	frontends     []*common.FrontendRPC
+	trustDomains  []*common.TrustDomainConfig
+	replicas      []*common.ReplicaRPC // nil where a trust domain has no address
+
+	// The previous poll, against which rates are measured.
+	last *snapshot
+}
+
+// snapshot is the statistics of every component at one time.
+type snapshot struct {
+	at        time.Time
+	frontends []common.FrontendStats
+	statuses  []common.ClusterStatus // By frontend
+	replicas  []common.ShardStats
+}
+
+func newDashboard(frontendAddrs []string, trustDomains []*common.TrustDomainConfig) *dashboard {
+	d := &dashboard{frontendAddrs: frontendAddrs, trustDomains: trustDomains}
+	for i, addr := range frontendAddrs {
+		d.frontends = append(d.frontends, common.NewFrontendRPC(fmt.Sprintf("dash-frontend%d", i), addr))
+	}
+	for _, td := range trustDomains {
+		d.replicas = append(d.replicas, common.NewReplicaRPC("dash-"+td.Name, td))
+	}
+	return d
+}
+
+// Close releases the connections of the dashboard.
+func (d *dashboard) Close() {
+	for _, f := range d.frontends {
+		f.Close()
+	}
+	for _, r := range d.replicas {
+		if r != nil {
+			r.Close()
+		}
+	}
+}
+
+// Poll collects the statistics of all components at once.
+func (d *dashboard) Poll() *snapshot {
+	s := &snapshot{
+		at:        time.Now(),
+		frontends: make([]common.FrontendStats, len(d.frontends)),
+		statuses:  make([]common.ClusterStatus, len(d.frontends)),
+		replicas:  make([]common.ShardStats, len(d.replicas)),
+	}
+	var wg sync.WaitGroup
+	for i, f := range d.frontends {
+		wg.Add(2)
+		go func(i int, f *common.FrontendRPC) {
+			defer wg.Done()
+			if err := f.GetStats(nil, &s.frontends[i]); err != nil {
+				s.frontends[i].Err = err.Error()
+			}
+		}(i, f)
+		go func(i int, f *common.FrontendRPC) {
+			defer wg.Done()
+			if err := f.GetStatus(nil, &s.statuses[i]); err != nil {
+				s.statuses[i].Err = err.Error()
+			}
+		}(i, f)
+	}
+	for i, r := range d.replicas {
+		if r == nil {
+			s.replicas[i].Err = "no address"
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r *common.ReplicaRPC) {
+			defer wg.Done()
+			if err := r.GetStats(nil, &s.replicas[i]); err != nil {
+				s.replicas[i].Err = err.Error()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	return s
+}
+
+// Render draws a snapshot, with rates since the last one rendered.
+func (d *dashboard) Render(out io.Writer, s *snapshot, clear bool) {
+	last := d.last
+	d.last = s
+	if clear {
+		fmt.Fprint(out, clearScreen)
+	}
+	fmt.Fprintf(out, "talek  %s\n\n", s.at.Format("2006-01-02 15:04:05"))
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FRONTEND\tHEALTH\tVERSION\tROLE\tEPOCH\tSEQNO\tWRITES/S\tPENDING WRITES\tPENDING READS")
+	for i, f := range s.frontends {
+		if f.Err != "" {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\t\t\n", d.frontendAddrs[i], health(f.Err))
+			continue
+		}
+		status, version := "ok", "-"
+		if st := s.statuses[i]; st.Err == "" {
+			version = st.Version
+			if !st.Healthy {
+				status = degraded(st.Problems)
+			}
+		}
+		role := "leader"
+		if f.Standby {
+			role = "standby"
+		}
+		writes := "-"
+		if last != nil && last.frontends[i].Err == "" && f.SeqNo >= last.frontends[i].SeqNo {
+			writes = fmt.Sprintf("%.1f", float64(f.SeqNo-last.frontends[i].SeqNo)/s.at.Sub(last.at).Seconds())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%d\t%d\n", d.frontendAddrs[i], status, version, role, f.Epoch, f.SeqNo, writes, f.PendingWrites, f.PendingReads)
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TRUST DOMAIN\tHEALTH\tVERSION\tEPOCH/WRITE LAG\tITEMS\tLOAD\tREAD QUEUE\tBATCHES/S\tPIR P50/P99\tWAIT P50/P99\tSTALLS\tABANDONED\tBACKING\tHEAP")
+	for i, r := range s.replicas {
+		name := d.trustDomains[i].Name
+		if r.Err != "" {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\t\t\t\t\t\t\t\n", name, health(r.Err))
+			continue
+		}
+		version, lag := "-", "-"
+		if st := s.replicaStatus(i); st != nil && st.Version != "" {
+			version = st.Version
+			lag = fmt.Sprintf("%d/%d", st.EpochLag, st.WriteLag)
+		}
+		load := 0.0
+		if r.Capacity > 0 {
+			load = 100 * float64(r.Items) / float64(r.Capacity)
+		}
+		batches, pir, wait := "-", "-", "-"
+		if last != nil && last.replicas[i].Err == "" && r.Reads.Completed >= last.replicas[i].Reads.Completed {
+			prev := last.replicas[i].Reads
+			n := r.Reads.Completed - prev.Completed
+			batches = fmt.Sprintf("%.1f", float64(n)/s.at.Sub(last.at).Seconds())
+			if n > 0 {
+				pir = quantiles(r.Reads.ReadLatency.Since(&prev.ReadLatency))
+				wait = quantiles(r.Reads.QueueLatency.Since(&prev.QueueLatency))
+			}
+		}
+		fmt.Fprintf(w, "%s\tok\t%s\t%s\t%d/%d\t%.0f%%\t%d/%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			name, version, lag, r.Items, r.Capacity, load, r.Reads.Queued, r.Reads.Capacity, batches, pir, wait,
+			r.Reads.Stalls, r.Reads.Abandoned, r.PIR.Backing, bytes(r.HeapBytes))
+	}
+	w.Flush()
+}
+
+// replicaStatus is the status of the replica of a trust domain, as reported
+// by the leading frontend, or nil if no frontend reported it.
+func (s *snapshot) replicaStatus(i int) *common.ReplicaStatus {
+	var found *common.ReplicaStatus
+	for j := range s.statuses {
+		st := &s.statuses[j]
+		if st.Err != "" || i >= len(st.Replicas) || st.Replicas[i].Err != "" {
+			continue
+		}
+		if found == nil || !st.Standby {
+			found = &st.Replicas[i]
+		}
+	}
+	return found
+}
+
+// quantiles formats the median and 99th percentile latencies of a histogram.
+func quantiles(h common.Histogram) string {
+	return h.Quantile(0.5).Round(time.Microsecond).String() + "/" + h.Quantile(0.99).Round(time.Microsecond).String()
+}
+
+// health shortens an error for a column.
+func health(err string) string {
+	const max = 40
+	if len(err) > max {
+		err = err[:max-3] + "..."
+	}
+	return "DOWN: " + err
+}
+
+// degraded summarizes the problems of an unhealthy deployment for a column.
+func degraded(problems []string) string {
+	const max = 40
+	summary := "DEGRADED"
+	if len(problems) > 0 {
+		summary += ": " + problems[0]
+		if len(problems) > 1 {
+			summary += fmt.Sprintf(" (+%d)", len(problems)-1)
+		}
+	}
+	if len(summary) > max {
+		summary = summary[:max-3] + "..."
+	}
+	return summary
+}
+
+// bytes formats a size in binary units.
+func bytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
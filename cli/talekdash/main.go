@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/spf13/pflag"
+)
+
+// Talekdash is a terminal dashboard for operators, polling the statistics of
+// the frontends and replicas of a deployment and showing them on one screen.
+func main() {
+	configPath := pflag.String("config", "talek.conf", "Client configuration, naming the frontend and trust domains")
+	frontends := pflag.String("frontends", "", "Comma separated frontend addresses, if replicated (default the frontend of the configuration)")
+	interval := pflag.Duration("interval", 2*time.Second, "How often to refresh")
+	once := pflag.Bool("once", false, "Print the statistics once, rather than refreshing the screen")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		fmt.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	config := libtalek.ClientConfigFromFile(*configPath)
+	if config == nil {
+		fmt.Fprintln(os.Stderr, "Talekdash must be run with --config specifying the deployment.")
+		os.Exit(1)
+	}
+	addresses := []string{config.FrontendAddr}
+	if *frontends != "" {
+		addresses = strings.Split(*frontends, ",")
+	}
+
+	d := newDashboard(addresses, config.TrustDomains)
+	defer d.Close()
+	if *once {
+		d.Render(os.Stdout, d.Poll(), false)
+		return
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+	for {
+		d.Render(os.Stdout, d.Poll(), true)
+		select {
+		case <-tick.C:
+		case <-c:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	// Register the PIR backings the engine can read with
+	_ "github.com/privacylab/talek/pir"
+	"github.com/privacylab/talek/pir/pirext"
+	"github.com/privacylab/talek/pir/pirinterface"
+	"github.com/spf13/pflag"
+)
+
+// Starts a reference external PIR engine, which replicas read from with the
+// "ext" backing
+func main() {
+	log.Println("------------------------")
+	log.Println("--- Talek PIR Engine ---")
+	log.Println("------------------------")
+
+	// Support setting flags from either command-line arguments or environment variables
+	// command-line arguments take priority
+	socket := pflag.StringP("socket", "s", "/tmp/talek-engine.sock", "Control socket path")
+	backing := pflag.StringP("backing", "b", "cpu.0", "PIR method to read with (env TALEK_BACKING)")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		log.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	log.Printf("Arguments:\n")
+	log.Printf("socket=%v\n", *socket)
+	log.Printf("backing=%v\n", *backing)
+
+	engine, err := pirext.NewEngine("Engine", *backing)
+	if err != nil {
+		log.Printf("Could not create engine: %v (available: %v)\n", err, pirinterface.Backings())
+		return
+	}
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Printf("Couldn't listen on %s: %v\n", *socket, err)
+		return
+	}
+	go engine.Serve(listener)
+
+	log.Println("Running.")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	listener.Close()
+}
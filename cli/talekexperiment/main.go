@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/experiments"
+	"github.com/spf13/pflag"
+)
+
+// Talekexperiment runs an experiment spec, and archives the configuration it
+// ran with alongside what it measured.
+func main() {
+	specPath := pflag.String("spec", "experiment.json", "Experiment spec to run")
+	outPath := pflag.String("out", "experiment.tar.gz", "Where to write the archive of the experiment")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		fmt.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	spec, err := experiments.SpecFromFile(*specPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load spec %s: %v\n", *specPath, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Running %s.\n", spec.Name)
+	// Runs completed before a failure are still archived.
+	result, runErr := experiments.Run(*spec)
+	if runErr != nil {
+		fmt.Fprintf(os.Stderr, "Experiment failed: %v\n", runErr)
+		if result == nil || len(result.Runs) == 0 {
+			os.Exit(1)
+		}
+	}
+
+	out, err := os.Create(*outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create %s: %v\n", *outPath, err)
+		os.Exit(1)
+	}
+	err = experiments.WriteArchive(out, spec, result)
+	out.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write archive: %v\n", err)
+		os.Exit(1)
+	}
+	for i, run := range result.Runs {
+		fmt.Printf("Run %d (seed %d): reads %v\n", i, run.Seed, &run.Frontend.ReadLatency)
+		for _, c := range run.Report.Cohorts {
+			fmt.Printf("  %s: %d published, %d delivered, %d lost, p50 %v, p99 %v\n", c.Label, c.Published, c.Delivered, c.Lost, c.LatencyP50, c.LatencyP99)
+		}
+	}
+	fmt.Printf("Archived to %s.\n", *outPath)
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/coreos/etcd/pkg/flags"
 	"github.com/privacylab/talek/common"
@@ -22,6 +25,12 @@ func main() {
 	commonPath := pflag.String("common", "common.conf", "Talek Common Configuration")
 	listen := pflag.StringP("listen", "l", ":8080", "Listening Address")
 	verbose := pflag.Bool("verbose", false, "Verbose output")
+	metrics := pflag.String("metrics", "", "Address to serve Prometheus metrics at /metrics, and health at /health, on, or none")
+	logLevel := pflag.String("log-level", "", "Level of all loggers: trace, info, warn, error or off, changeable at runtime with SetLogLevel (env TALEK_LOG_LEVEL)")
+	logFile := pflag.String("log-file", "", "File to log to rather than standard output, rotated by size and age (env TALEK_LOG_FILE)")
+	logMaxSize := pflag.Int64("log-max-size", 100, "Megabytes the log file grows to before it is rotated, or 0 for no limit")
+	logMaxAge := pflag.Duration("log-max-age", 24*time.Hour, "How long the log file is written to before it is rotated, or 0 for no limit")
+	logKeep := pflag.Int("log-keep", 7, "Rotated log files kept, or 0 to keep all")
 	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if err != nil {
 		log.Printf("Error reading environment variables, %v\n", err)
@@ -29,6 +38,15 @@ func main() {
 	}
 	pflag.Parse()
 
+	logs, err := common.ConfigureLogging(*logLevel, *logFile, *logMaxSize<<20, *logMaxAge, *logKeep)
+	if err != nil {
+		log.Printf("Could not configure logging: %v\n", err)
+		return
+	}
+	if logs != nil {
+		defer logs.Close()
+	}
+
 	config := libtalek.ClientConfigFromFile(*configPath)
 	if config == nil {
 		pflag.Usage()
@@ -38,16 +56,34 @@ func main() {
 
 	f := server.NewFrontendServer("Talek Frontend", serverConfig, config.TrustDomains)
 	f.Frontend.Verbose = *verbose
-	listener, err := f.Run(*listen)
+	var listeners []net.Listener
+	if len(serverConfig.Listeners) > 0 {
+		listeners, err = f.Listen(serverConfig.Listeners)
+	} else {
+		var listener net.Listener
+		listener, err = f.Run(*listen)
+		listeners = []net.Listener{listener}
+	}
 	if err != nil {
 		log.Printf("Couldn't listen to frontend address: %v\n", err)
 		return
 	}
 
+	if *metrics != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", f.Frontend.ServeMetrics)
+		mux.HandleFunc("/health", f.Frontend.ServeHealth)
+		go func() {
+			log.Printf("Metrics stopped: %v\n", http.ListenAndServe(*metrics, mux))
+		}()
+	}
+
 	log.Println("Running.")
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
-	listener.Close()
+	for _, l := range listeners {
+		l.Close()
+	}
 }
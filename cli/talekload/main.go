@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/talektest"
+	"github.com/spf13/pflag"
+)
+
+// Talekload replays a workload profile against a talek deployment, and
+// prints the metrics of each cohort of clients as JSON.
+func main() {
+	configPath := pflag.String("config", "talek.conf", "Client configuration for talek")
+	profileName := pflag.String("profile", "groupchat", "A built in workload profile, or a JSON file of one")
+	duration := pflag.Duration("duration", 0, "Publish for this long, rather than for the duration of the profile")
+	seed := pflag.Int64("seed", 0, "Seed the schedule of publishes, rather than using the seed of the profile")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		fmt.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	config := libtalek.ClientConfigFromFile(*configPath)
+	if config == nil {
+		fmt.Fprintln(os.Stderr, "Talekload must be run with --config specifying where the server is.")
+		os.Exit(1)
+	}
+	profile, ok := talektest.Profiles[*profileName]
+	if !ok {
+		loaded, loaderr := talektest.ProfileFromFile(*profileName)
+		if loaderr != nil {
+			names := make([]string, 0, len(talektest.Profiles))
+			for name := range talektest.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(os.Stderr, "Profile %s is not one of %s, nor a profile file: %v\n", *profileName, strings.Join(names, ", "), loaderr)
+			os.Exit(1)
+		}
+		profile = *loaded
+	}
+	if *duration > 0 {
+		profile.Duration = *duration
+	}
+	if *seed != 0 {
+		profile.Seed = *seed
+	}
+
+	var clients []*libtalek.Client
+	var rpcs []*common.FrontendRPC
+	newClient := func(name string) *libtalek.Client {
+		rpc := common.NewFrontendRPC(name, config.FrontendAddr)
+		c := libtalek.NewClient(name, *config, rpc)
+		if c == nil {
+			rpc.Close()
+			return nil
+		}
+		rpcs = append(rpcs, rpc)
+		clients = append(clients, c)
+		return c
+	}
+	fmt.Fprintf(os.Stderr, "Replaying %s for %v.\n", profile.Name, profile.Duration+profile.Drain)
+	report, err := talektest.RunWorkload(profile, newClient)
+	for _, c := range clients {
+		c.Kill()
+	}
+	for _, rpc := range rpcs {
+		rpc.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Workload failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	dat, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export report: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(dat))
+}
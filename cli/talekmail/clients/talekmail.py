@@ -0,0 +1,75 @@
+# Code generated by talekmail --openapi. DO NOT EDIT.
+"""Client of the Talek mail gateway, version 1."""
+
+from __future__ import annotations
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+from typing import Any, Dict, List, TypedDict
+
+
+class _GatewayStatusOptional(TypedDict, total=False):
+    Reason: str
+
+
+class GatewayStatus(_GatewayStatusOptional):
+    State: str
+    Time: str  # RFC 3339 time
+
+
+class _MailboxStubOptional(TypedDict, total=False):
+    Topic: str
+
+
+class MailboxStub(_MailboxStubOptional):
+    Name: str
+
+
+class _SubmissionOptional(TypedDict, total=False):
+    Bounce: MailboxStub
+
+
+class Submission(_SubmissionOptional):
+    Body: str  # base64
+    From: str
+    To: str
+
+
+class Submitted(TypedDict):
+    ID: str
+
+
+class ApiError(Exception):
+    def __init__(self, status: int, message: str):
+        super().__init__(f"{status}: {message}")
+        self.status = status
+        self.message = message
+
+
+class Client:
+    def __init__(self, base_url: str, timeout: float = 30.0):
+        self.base_url = base_url.rstrip("/")
+        self.timeout = timeout
+
+    def _call(self, method: str, path: str, body: Any = None) -> Any:
+        data = None
+        headers = {}
+        if body is not None:
+            data = json.dumps(body).encode()
+            headers["Content-Type"] = "application/json"
+        req = urllib.request.Request(self.base_url + path, data=data, headers=headers, method=method)
+        try:
+            with urllib.request.urlopen(req, timeout=self.timeout) as resp:
+                return json.load(resp)
+        except urllib.error.HTTPError as e:
+            raise ApiError(e.code, e.read().decode(errors="replace").strip()) from None
+
+    def submit_letter(self, body: Submission) -> Submitted:
+        """Queue a letter for a recipient."""
+        return self._call("POST", "/letters", body)
+
+    def get_letter_status(self, id: str) -> GatewayStatus:
+        """Read the status of a submitted letter."""
+        return self._call("GET", "/letters/" + urllib.parse.quote(id, safe=""))
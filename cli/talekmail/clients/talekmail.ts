@@ -0,0 +1,57 @@
+// Code generated by talekmail --openapi. DO NOT EDIT.
+// Client of the Talek mail gateway, version 1.
+
+export interface GatewayStatus {
+  Reason?: string;
+  State: string;
+  Time: string; // RFC 3339 time
+}
+
+export interface MailboxStub {
+  Name: string;
+  Topic?: string;
+}
+
+export interface Submission {
+  Body: string; // base64
+  Bounce?: MailboxStub;
+  From: string;
+  To: string;
+}
+
+export interface Submitted {
+  ID: string;
+}
+
+export class ApiError extends Error {
+  constructor(public status: number, message: string) {
+    super(message);
+  }
+}
+
+export class Client {
+  constructor(private baseUrl: string, private fetchImpl: typeof fetch = fetch) {}
+
+  private async call<T>(method: string, path: string, body?: unknown): Promise<T> {
+    const init: RequestInit = { method };
+    if (body !== undefined) {
+      init.headers = { "Content-Type": "application/json" };
+      init.body = JSON.stringify(body);
+    }
+    const resp = await this.fetchImpl(this.baseUrl.replace(/\/$/, "") + path, init);
+    if (!resp.ok) {
+      throw new ApiError(resp.status, (await resp.text()).trim());
+    }
+    return (await resp.json()) as T;
+  }
+
+  /** Queue a letter for a recipient */
+  submitLetter(body: Submission): Promise<Submitted> {
+    return this.call<Submitted>("POST", `/letters`, body);
+  }
+
+  /** Read the status of a submitted letter */
+  getLetterStatus(id: string): Promise<GatewayStatus> {
+    return this.call<GatewayStatus>("GET", `/letters/${encodeURIComponent(id)}`);
+  }
+}
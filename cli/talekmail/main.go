@@ -0,0 +1,209 @@
+//go:generate go run . --openapi clients
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/securemem"
+	"github.com/spf13/pflag"
+)
+
+// Config is the configuration of the gateway.
+type Config struct {
+	// MaxQueue is how many letters may wait for each recipient.
+	MaxQueue int
+	// MaxAge is how long a letter may wait before it bounces.
+	MaxAge time.Duration `json:",string"`
+	// Window letters are forwarded to a recipient within each Lifetime, the
+	// time letters are kept by the servers.
+	Window   int
+	Lifetime time.Duration `json:",string"`
+	// Recipients are the mailboxes letters are accepted for.
+	Recipients []RecipientConfig
+}
+
+// RecipientConfig is a mailbox the gateway forwards letters to, through a
+// stub its owner issued the gateway.
+type RecipientConfig struct {
+	Name    string // Name senders address the recipient by
+	Stub    string // Stored topic of the stub
+	Contact string // Contact the stub was issued to, "gateway" if empty
+}
+
+// Validate checks the configuration is complete.
+func (c *Config) Validate() error {
+	if c.MaxQueue < 0 || c.Window < 0 || c.MaxAge < 0 || c.Lifetime < 0 {
+		return &common.ValidationError{Field: "Config", Reason: "limits can't be negative"}
+	}
+	if c.Window > 0 && c.Lifetime == 0 {
+		return &common.ValidationError{Field: "Lifetime", Reason: "must be set with a Window"}
+	}
+	seen := make(map[string]bool)
+	for _, r := range c.Recipients {
+		if len(r.Name) == 0 || len(r.Stub) == 0 {
+			return &common.ValidationError{Field: "Recipients", Reason: "recipients need a name and a stub"}
+		}
+		if seen[r.Name] {
+			return &common.ValidationError{Field: "Recipients", Reason: fmt.Sprintf("%s is configured twice", r.Name)}
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// Accepts letters for the mailboxes of recipients who may be offline, and
+// forwards them as their mailboxes have room.
+func main() {
+	log.Println("--------------------------")
+	log.Println("--- Talek Mail Gateway ---")
+	log.Println("--------------------------")
+
+	configPath := pflag.String("config", "talek.conf", "Client configuration for talek")
+	gatewayPath := pflag.String("gateway", "mail.conf", "Gateway configuration")
+	storeDir := pflag.String("store", ".", "Directory of the stubs of recipients, and the queues of the gateway")
+	listen := pflag.StringP("listen", "l", ":9000", "Address letters are submitted to")
+	passphrase := pflag.String("passphrase", "", "Passphrase stored topics and queues are encrypted with (env TALEK_PASSPHRASE)")
+	secureMemory := pflag.Bool("secure-memory", false, "Keep topic keys and seeds in locked memory, out of swap and core dumps (env TALEK_SECURE_MEMORY)")
+	verbose := pflag.Bool("verbose", false, "Print diagnostic information")
+	openAPIDir := pflag.String("openapi", "", "Write the OpenAPI specification of the submission protocol, and clients generated from it, to a directory and exit")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		log.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	if *secureMemory {
+		if err = securemem.Enable(); err != nil {
+			log.Fatalf("Could not lock memory for keys: %v\n", err)
+		}
+	}
+
+	if len(*openAPIDir) > 0 {
+		if err = writeOpenAPI(*openAPIDir, routes); err != nil {
+			log.Fatalf("Could not write the OpenAPI specification: %v\n", err)
+		}
+		return
+	}
+
+	gatewayConfig, err := gatewayConfigFromFile(*gatewayPath)
+	if err != nil {
+		log.Fatalf("Could not load gateway configuration %s: %v\n", *gatewayPath, err)
+	}
+	config := libtalek.ClientConfigFromFile(*configPath)
+	if config == nil {
+		pflag.Usage()
+		return
+	}
+	fs, err := libtalek.NewFileStore(*storeDir)
+	if err != nil {
+		log.Fatalf("Could not open store %s: %v\n", *storeDir, err)
+	}
+	store := libtalek.Store(fs)
+	if len(*passphrase) > 0 {
+		if store, err = libtalek.NewPassphraseStore(fs, []byte(*passphrase)); err != nil {
+			log.Fatalf("Could not open store %s: %v\n", *storeDir, err)
+		}
+	}
+
+	client := libtalek.NewClient("Gateway", *config, common.NewFrontendRPC("RPC", config.FrontendAddr))
+	if client == nil {
+		log.Fatalln("Could not create talek client.")
+	}
+	client.Verbose = *verbose
+
+	g, err := newGateway(gatewayConfig, client, store)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Couldn't listen to %s: %v\n", *listen, err)
+	}
+	go http.Serve(listener, &submissions{g, client.MaxLength()})
+	go g.Run()
+
+	log.Printf("Accepting letters for %d recipients.\n", len(g.Recipients()))
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	listener.Close()
+	g.Stop()
+	client.Flush()
+	client.Kill()
+}
+
+func gatewayConfigFromFile(file string) (*Config, error) {
+	dat, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err = json.Unmarshal(dat, config); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// newGateway restores the gateway from its store, and brings its recipients
+// in line with the configuration. Letters for recipients no longer configured
+// bounce.
+func newGateway(config *Config, client *libtalek.Client, store libtalek.Store) (*libtalek.Gateway, error) {
+	g, err := libtalek.NewGateway(client, store, "gateway")
+	if err != nil {
+		return nil, err
+	}
+	g.MaxQueue = config.MaxQueue
+	g.MaxAge = config.MaxAge
+	g.Window = config.Window
+	g.Lifetime = config.Lifetime
+
+	configured := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, name := range g.Recipients() {
+		known[name] = true
+	}
+	for _, r := range config.Recipients {
+		configured[r.Name] = true
+		if known[r.Name] {
+			// The saved stub is positioned after the letters forwarded so far.
+			continue
+		}
+		topic, err := libtalek.LoadTopic(store, r.Stub)
+		if err != nil {
+			return nil, fmt.Errorf("could not load stub of %s: %v", r.Name, err)
+		}
+		contact := r.Contact
+		if contact == "" {
+			contact = "gateway"
+		}
+		if err = g.AddRecipient(r.Name, &libtalek.MailboxStub{Name: contact, Topic: topic}); err != nil {
+			return nil, err
+		}
+	}
+	for name := range known {
+		if !configured[name] {
+			if err = g.RemoveRecipient(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// generatedHeader marks the files written by --openapi.
+const generatedHeader = "Code generated by talekmail --openapi. DO NOT EDIT."
+
+// openAPIDoc is an OpenAPI 3 specification, of as much of the format as the
+// gateway needs.
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// openAPI describes routes, with schemas of the Go types of their bodies.
+func openAPI(routes []route) *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI:    "3.0.3",
+		Info:       openAPIInfo{"Talek mail gateway", "1"},
+		Paths:      make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{make(map[string]*openAPISchema)},
+	}
+	schemas := schemaSet(doc.Components.Schemas)
+	for _, rt := range routes {
+		op := &openAPIOperation{
+			OperationID: rt.ID,
+			Summary:     rt.Summary,
+			Responses:   make(map[string]*openAPIResponse),
+		}
+		for _, name := range pathParameters(rt.Path) {
+			op.Parameters = append(op.Parameters, &openAPIParameter{name, "path", true, &openAPISchema{Type: "string"}})
+		}
+		if rt.Request != nil {
+			op.RequestBody = &openAPIBody{true, jsonContent(schemas.of(reflect.TypeOf(rt.Request)))}
+		}
+		for _, resp := range rt.Responses {
+			r := &openAPIResponse{Description: resp.Description}
+			if resp.Body != nil {
+				r.Content = jsonContent(schemas.of(reflect.TypeOf(resp.Body)))
+			} else {
+				r.Content = map[string]openAPIMedia{"text/plain": {&openAPISchema{Type: "string"}}}
+			}
+			op.Responses[strconv.Itoa(resp.Status)] = r
+		}
+		if doc.Paths[rt.Path] == nil {
+			doc.Paths[rt.Path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+	return doc
+}
+
+// writeOpenAPI writes the specification of routes, and TypeScript and Python
+// clients generated from it, to a directory.
+func writeOpenAPI(dir string, routes []route) error {
+	doc := openAPI(routes)
+	spec, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		"openapi.json": append(spec, '\n'),
+		"talekmail.ts": typeScriptClient(doc),
+		"talekmail.py": pythonClient(doc),
+	}
+	for name, dat := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), dat, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/** PRIVATE METHODS **/
+
+// schemaSet holds the schemas of the structs of a specification, by name.
+type schemaSet map[string]*openAPISchema
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// of returns the schema of a type as encoding/json encodes it, adding the
+// schemas of structs to the set and referring to them.
+func (s schemaSet) of(t reflect.Type) *openAPISchema {
+	if t == timeType {
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return &openAPISchema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.of(t.Elem())
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: s.of(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: s.of(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+			// Added before its fields, so recursive types refer to it.
+			s[name] = schema
+			s.fields(t, schema)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	}
+	return &openAPISchema{}
+}
+
+// fields adds the properties of a struct to its schema. Fields which are
+// always encoded are required.
+func (s schemaSet) fields(t reflect.Type, schema *openAPISchema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := f.Name
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		omitempty, quoted := false, false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+			quoted = quoted || opt == "string"
+		}
+		if quoted {
+			schema.Properties[name] = &openAPISchema{Type: "string"}
+		} else {
+			schema.Properties[name] = s.of(f.Type)
+		}
+		if !omitempty && f.Type.Kind() != reflect.Ptr {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+}
+
+// schemaName names the schema of a struct, exported.
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return string(name)
+}
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMedia {
+	return map[string]openAPIMedia{"application/json": {schema}}
+}
+
+// pathParameters returns the names of the {parameters} of a path.
+func pathParameters(path string) []string {
+	var names []string
+	for _, part := range strings.Split(path, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			names = append(names, part[1:len(part)-1])
+		}
+	}
+	return names
+}
+
+// openAPIOp is an operation of a specification, with where it is found.
+type openAPIOp struct {
+	path   string
+	method string
+	*openAPIOperation
+}
+
+// operations lists the operations of a specification by path and method.
+func (doc *openAPIDoc) operations() []openAPIOp {
+	var ops []openAPIOp
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			ops = append(ops, openAPIOp{path, strings.ToUpper(method), op})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].path != ops[j].path {
+			return ops[i].path < ops[j].path
+		}
+		return ops[i].method < ops[j].method
+	})
+	return ops
+}
+
+// success returns the schema of the body of the successful reply of an
+// operation, or nil.
+func (op openAPIOp) success() *openAPISchema {
+	var codes []string
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if strings.HasPrefix(code, "2") {
+			if media, ok := op.Responses[code].Content["application/json"]; ok {
+				return media.Schema
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// request returns the schema of the body of an operation, or nil.
+func (op openAPIOp) request() *openAPISchema {
+	if op.RequestBody == nil {
+		return nil
+	}
+	return op.RequestBody.Content["application/json"].Schema
+}
+
+// sortedKeys returns the keys of a map of schemas in order.
+func sortedKeys(m map[string]*openAPISchema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isRequired(schema *openAPISchema, name string) bool {
+	for _, r := range schema.Required {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatComment notes how a string property is encoded.
+func formatComment(schema *openAPISchema) string {
+	switch schema.Format {
+	case "byte":
+		return "base64"
+	case "date-time":
+		return "RFC 3339 time"
+	}
+	return ""
+}
+
+func typeScriptType(schema *openAPISchema) string {
+	switch {
+	case schema.Ref != "":
+		return strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+	case schema.Type == "string":
+		return "string"
+	case schema.Type == "integer" || schema.Type == "number":
+		return "number"
+	case schema.Type == "boolean":
+		return "boolean"
+	case schema.Type == "array":
+		return typeScriptType(schema.Items) + "[]"
+	case schema.Type == "object" && schema.AdditionalProperties != nil:
+		return "{ [key: string]: " + typeScriptType(schema.AdditionalProperties) + " }"
+	}
+	return "unknown"
+}
+
+// typeScriptClient generates a TypeScript client of a specification, using
+// fetch.
+func typeScriptClient(doc *openAPIDoc) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n// Client of the %s, version %s.\n", generatedHeader, doc.Info.Title, doc.Info.Version)
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		schema := doc.Components.Schemas[name]
+		fmt.Fprintf(&b, "\nexport interface %s {\n", name)
+		for _, prop := range sortedKeys(schema.Properties) {
+			optional := "?"
+			if isRequired(schema, prop) {
+				optional = ""
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;", prop, optional, typeScriptType(schema.Properties[prop]))
+			if comment := formatComment(schema.Properties[prop]); comment != "" {
+				fmt.Fprintf(&b, " // %s", comment)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n")
+	}
+
+	b.WriteString(`
+export class ApiError extends Error {
+  constructor(public status: number, message: string) {
+    super(message);
+  }
+}
+
+export class Client {
+  constructor(private baseUrl: string, private fetchImpl: typeof fetch = fetch) {}
+
+  private async call<T>(method: string, path: string, body?: unknown): Promise<T> {
+    const init: RequestInit = { method };
+    if (body !== undefined) {
+      init.headers = { "Content-Type": "application/json" };
+      init.body = JSON.stringify(body);
+    }
+    const resp = await this.fetchImpl(this.baseUrl.replace(/\/$/, "") + path, init);
+    if (!resp.ok) {
+      throw new ApiError(resp.status, (await resp.text()).trim());
+    }
+    return (await resp.json()) as T;
+  }
+`)
+	for _, op := range doc.operations() {
+		var params []string
+		for _, p := range op.Parameters {
+			params = append(params, p.Name+": string")
+		}
+		args := []string{strconv.Quote(op.method), "`" + typeScriptPath(op.path) + "`"}
+		if req := op.request(); req != nil {
+			params = append(params, "body: "+typeScriptType(req))
+			args = append(args, "body")
+		}
+		result := "void"
+		if s := op.success(); s != nil {
+			result = typeScriptType(s)
+		}
+		fmt.Fprintf(&b, "\n  /** %s */\n  %s(%s): Promise<%s> {\n", op.Summary, op.OperationID, strings.Join(params, ", "), result)
+		fmt.Fprintf(&b, "    return this.call<%s>(%s);\n  }\n", result, strings.Join(args, ", "))
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// typeScriptPath makes a template literal of a path, with its parameters
+// escaped.
+func typeScriptPath(path string) string {
+	for _, name := range pathParameters(path) {
+		path = strings.Replace(path, "{"+name+"}", "${encodeURIComponent("+name+")}", 1)
+	}
+	return path
+}
+
+func pythonType(schema *openAPISchema) string {
+	switch {
+	case schema.Ref != "":
+		return strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+	case schema.Type == "string":
+		return "str"
+	case schema.Type == "integer":
+		return "int"
+	case schema.Type == "number":
+		return "float"
+	case schema.Type == "boolean":
+		return "bool"
+	case schema.Type == "array":
+		return "List[" + pythonType(schema.Items) + "]"
+	case schema.Type == "object" && schema.AdditionalProperties != nil:
+		return "Dict[str, " + pythonType(schema.AdditionalProperties) + "]"
+	}
+	return "Any"
+}
+
+// pythonName converts a camelCase name to snake_case.
+func pythonName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pythonProperties writes the properties of a TypedDict.
+func pythonProperties(b *bytes.Buffer, schema *openAPISchema, props []string) {
+	for _, prop := range props {
+		fmt.Fprintf(b, "    %s: %s", prop, pythonType(schema.Properties[prop]))
+		if comment := formatComment(schema.Properties[prop]); comment != "" {
+			fmt.Fprintf(b, "  # %s", comment)
+		}
+		b.WriteString("\n")
+	}
+}
+
+// pythonClient generates a Python 3.8 client of a specification, using only
+// the standard library. Schemas are TypedDicts of the decoded JSON.
+func pythonClient(doc *openAPIDoc) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\"\"\"Client of the %s, version %s.\"\"\"\n", generatedHeader, doc.Info.Title, doc.Info.Version)
+	b.WriteString(`
+from __future__ import annotations
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+from typing import Any, Dict, List, TypedDict
+`)
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		schema := doc.Components.Schemas[name]
+		var required, optional []string
+		for _, prop := range sortedKeys(schema.Properties) {
+			if isRequired(schema, prop) {
+				required = append(required, prop)
+			} else {
+				optional = append(optional, prop)
+			}
+		}
+		switch {
+		case len(optional) == 0:
+			fmt.Fprintf(&b, "\n\nclass %s(TypedDict):\n", name)
+		case len(required) == 0:
+			fmt.Fprintf(&b, "\n\nclass %s(TypedDict, total=False):\n", name)
+		default:
+			fmt.Fprintf(&b, "\n\nclass _%sOptional(TypedDict, total=False):\n", name)
+			pythonProperties(&b, schema, optional)
+			optional = nil
+			fmt.Fprintf(&b, "\n\nclass %s(_%sOptional):\n", name, name)
+		}
+		pythonProperties(&b, schema, append(required, optional...))
+		if len(schema.Properties) == 0 {
+			b.WriteString("    pass\n")
+		}
+	}
+
+	b.WriteString(`
+
+class ApiError(Exception):
+    def __init__(self, status: int, message: str):
+        super().__init__(f"{status}: {message}")
+        self.status = status
+        self.message = message
+
+
+class Client:
+    def __init__(self, base_url: str, timeout: float = 30.0):
+        self.base_url = base_url.rstrip("/")
+        self.timeout = timeout
+
+    def _call(self, method: str, path: str, body: Any = None) -> Any:
+        data = None
+        headers = {}
+        if body is not None:
+            data = json.dumps(body).encode()
+            headers["Content-Type"] = "application/json"
+        req = urllib.request.Request(self.base_url + path, data=data, headers=headers, method=method)
+        try:
+            with urllib.request.urlopen(req, timeout=self.timeout) as resp:
+                return json.load(resp)
+        except urllib.error.HTTPError as e:
+            raise ApiError(e.code, e.read().decode(errors="replace").strip()) from None
+`)
+	for _, op := range doc.operations() {
+		params := []string{"self"}
+		for _, p := range op.Parameters {
+			params = append(params, p.Name+": str")
+		}
+		args := []string{strconv.Quote(op.method), pythonPath(op.path)}
+		if req := op.request(); req != nil {
+			params = append(params, "body: "+pythonType(req))
+			args = append(args, "body")
+		}
+		result := "None"
+		if s := op.success(); s != nil {
+			result = pythonType(s)
+		}
+		fmt.Fprintf(&b, "\n    def %s(%s) -> %s:\n", pythonName(op.OperationID), strings.Join(params, ", "), result)
+		fmt.Fprintf(&b, "        \"\"\"%s.\"\"\"\n", op.Summary)
+		fmt.Fprintf(&b, "        return self._call(%s)\n", strings.Join(args, ", "))
+	}
+	return b.Bytes()
+}
+
+// pythonPath makes an expression of a path, with its parameters escaped.
+func pythonPath(path string) string {
+	var parts []string
+	for len(path) > 0 {
+		open := strings.IndexByte(path, '{')
+		if open < 0 {
+			parts = append(parts, strconv.Quote(path))
+			break
+		}
+		end := strings.IndexByte(path, '}')
+		if open > 0 {
+			parts = append(parts, strconv.Quote(path[:open]))
+		}
+		parts = append(parts, "urllib.parse.quote("+path[open+1:end]+", safe=\"\")")
+		path = path[end+1:]
+	}
+	return strings.Join(parts, " + ")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenAPIGenerated checks the committed specification and clients are
+// those go generate writes from the current routes.
+func TestOpenAPIGenerated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = writeOpenAPI(dir, routes); err != nil {
+		t.Fatalf("Failed to write the OpenAPI specification: %v", err)
+	}
+	for _, name := range []string{"openapi.json", "talekmail.py", "talekmail.ts"} {
+		generated, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed, err := ioutil.ReadFile(filepath.Join("clients", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(generated, committed) {
+			t.Fatalf("clients/%s is stale; run go generate.", name)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/privacylab/talek/libtalek"
+)
+
+// maxSubmission bounds the body of a submission.
+const maxSubmission = 1 << 20
+
+// submission is a letter submitted to the gateway.
+type submission struct {
+	To   string
+	From string
+	Body []byte
+	// Bounce is an optional stub of the sender's mailbox, issued to the
+	// gateway, through which they are told of letters that bounce.
+	Bounce *libtalek.MailboxStub `json:",omitempty"`
+}
+
+// submitted is the reply to a submission.
+type submitted struct {
+	ID string
+}
+
+// submissions serves the submission protocol of the gateway, described by
+// routes.
+type submissions struct {
+	gateway   *libtalek.Gateway
+	maxLength uint64
+}
+
+// routes are the operations of the submission protocol. The OpenAPI
+// specification of the gateway, and the clients generated from it, are made
+// from them, so they are described here along with their handlers.
+var routes = []route{
+	{
+		ID:      "submitLetter",
+		Method:  "POST",
+		Path:    "/letters",
+		Summary: "Queue a letter for a recipient",
+		Request: submission{},
+		Responses: []response{
+			{http.StatusAccepted, "The letter is queued", submitted{}},
+			{http.StatusBadRequest, "The submission is malformed", nil},
+			{http.StatusNotFound, "The gateway has no such recipient", nil},
+			{http.StatusRequestEntityTooLarge, "The letter is too long", nil},
+			{http.StatusServiceUnavailable, "The queue of the recipient is full, retry after Retry-After seconds", nil},
+		},
+		handle: (*submissions).submit,
+	},
+	{
+		ID:      "getLetterStatus",
+		Method:  "GET",
+		Path:    "/letters/{id}",
+		Summary: "Read the status of a submitted letter",
+		Responses: []response{
+			{http.StatusOK, "The status of the letter", libtalek.GatewayStatus{}},
+			{http.StatusNotFound, "The gateway has no such letter, or has forgotten it", nil},
+		},
+		handle: (*submissions).status,
+	},
+}
+
+func (s *submissions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/openapi.json" {
+		reply(w, http.StatusOK, openAPI(routes))
+		return
+	}
+	for _, rt := range routes {
+		if param, ok := rt.match(r); ok {
+			rt.handle(s, w, r, param)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *submissions) submit(w http.ResponseWriter, r *http.Request, _ string) {
+	var sub submission
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmission)).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Forwarded letters carry the sender's name and a kind.
+	if uint64(len(sub.Body)+len(sub.From)+2) > s.maxLength {
+		http.Error(w, "letter is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	id, err := s.gateway.Submit(sub.To, sub.From, sub.Body, sub.Bounce)
+	switch err {
+	case nil:
+		reply(w, http.StatusAccepted, submitted{id})
+	case libtalek.ErrUnknownRecipient:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case libtalek.ErrQueueFull:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *submissions) status(w http.ResponseWriter, r *http.Request, id string) {
+	status, err := s.gateway.Status(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	reply(w, http.StatusOK, status)
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// route is an operation of the submission protocol. A path may end with a
+// single {parameter}.
+type route struct {
+	ID        string
+	Method    string
+	Path      string
+	Summary   string
+	Request   interface{} // Value of the type of the JSON body, if any
+	Responses []response
+	handle    func(s *submissions, w http.ResponseWriter, r *http.Request, param string)
+}
+
+// response is a reply of an operation. Replies without a body are errors,
+// described in plain text.
+type response struct {
+	Status      int
+	Description string
+	Body        interface{} // Value of the type of the JSON body, if any
+}
+
+// match checks whether a request is for the route, returning the value of
+// its path parameter.
+func (rt *route) match(r *http.Request) (string, bool) {
+	if r.Method != rt.Method {
+		return "", false
+	}
+	open := strings.IndexByte(rt.Path, '{')
+	if open < 0 {
+		return "", r.URL.Path == rt.Path
+	}
+	if !strings.HasPrefix(r.URL.Path, rt.Path[:open]) {
+		return "", false
+	}
+	param := r.URL.Path[open:]
+	return param, len(param) > 0 && !strings.Contains(param, "/")
+}
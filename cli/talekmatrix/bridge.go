@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/libtalek"
+)
+
+// backfillLimit is how many of the latest events of a room are searched for
+// those missed while the bridge was down.
+const backfillLimit = 50
+
+// maxSeenTransactions bounds how many transaction IDs are remembered to
+// recognize those the homeserver retries.
+const maxSeenTransactions = 1024
+
+// bridgedMessage is what the bridge writes to, and reads from, topics.
+type bridgedMessage struct {
+	Kind       string `json:"kind"` // "message" or "member"
+	Sender     string `json:"sender"`
+	MsgType    string `json:"msgtype,omitempty"`
+	Body       string `json:"body,omitempty"`
+	Membership string `json:"membership,omitempty"`
+	Timestamp  int64  `json:"ts"`
+}
+
+// room is a Matrix room and the pair of topics it is bridged over.
+type room struct {
+	config RoomConfig
+
+	mu     sync.Mutex // Held while publishing, for topic and lastEvent
+	topic  *libtalek.Topic
+	handle *libtalek.Handle
+	// lastEvent is the last event of the room written to the topic.
+	lastEvent string
+}
+
+// bridge maps Matrix rooms to Talek topics: events of a room are written to
+// the topic of the room, and items read from its handle are posted back.
+type bridge struct {
+	config *Config
+	matrix *matrixClient
+	client *libtalek.Client
+	store  libtalek.Store
+	rooms  map[string]*room
+
+	mu   sync.Mutex
+	seen map[string]bool // Transactions from the homeserver
+	txns []string        // In order seen, to forget the oldest
+}
+
+func newBridge(config *Config, client *libtalek.Client, store libtalek.Store) (*bridge, error) {
+	b := &bridge{
+		config: config,
+		matrix: newMatrixClient(config.Homeserver, config.ASToken, config.BotUser),
+		client: client,
+		store:  store,
+		rooms:  make(map[string]*room),
+		seen:   make(map[string]bool),
+	}
+	for _, rc := range config.Rooms {
+		topic, err := libtalek.LoadTopic(store, rc.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("room %s: loading topic: %v", rc.Room, err)
+		}
+		handle, err := libtalek.LoadHandle(store, rc.Handle)
+		if err != nil {
+			return nil, fmt.Errorf("room %s: loading handle: %v", rc.Room, err)
+		}
+		r := &room{config: rc, topic: topic, handle: handle}
+		if dat, err := store.Get(rc.Topic + ".last"); err == nil {
+			r.lastEvent = string(dat)
+		}
+		b.rooms[rc.Room] = r
+	}
+	return b, nil
+}
+
+// run reads the handles of all rooms, after catching up on what each missed.
+func (b *bridge) run() {
+	for _, r := range b.rooms {
+		if err := b.matrix.join(r.config.Room); err != nil {
+			log.Printf("Could not join %s: %v", r.config.Room, err)
+		}
+		go b.backfill(r)
+		go b.readTopic(r)
+	}
+}
+
+// ServeHTTP accepts transactions of events pushed by the homeserver.
+func (b *bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	const prefix = "/_matrix/app/v1/transactions/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		// Users and rooms aren't provisioned on demand.
+		matrixError(w, http.StatusNotFound, "M_NOT_FOUND", "not found")
+		return
+	}
+	if req.Method != "PUT" {
+		matrixError(w, http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "method not allowed")
+		return
+	}
+	if !b.authorized(req) {
+		matrixError(w, http.StatusForbidden, "M_FORBIDDEN", "bad hs_token")
+		return
+	}
+	txnID := strings.TrimPrefix(req.URL.Path, prefix)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<22))
+	if err != nil {
+		matrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	var txn matrixTransaction
+	if err = json.Unmarshal(body, &txn); err != nil {
+		matrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	if b.markSeen(txnID) {
+		for i := range txn.Events {
+			b.onEvent(&txn.Events[i])
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+/** PRIVATE METHODS **/
+
+func (b *bridge) authorized(req *http.Request) bool {
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.config.HSToken)) == 1
+}
+
+// markSeen records a transaction, returning false if it was seen before.
+func (b *bridge) markSeen(txnID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[txnID] {
+		return false
+	}
+	b.seen[txnID] = true
+	b.txns = append(b.txns, txnID)
+	if len(b.txns) > maxSeenTransactions {
+		delete(b.seen, b.txns[0])
+		b.txns = b.txns[1:]
+	}
+	return true
+}
+
+// onEvent handles an event pushed by the homeserver.
+func (b *bridge) onEvent(ev *matrixEvent) {
+	r, ok := b.rooms[ev.RoomID]
+	if ev.Type == "m.room.member" && ev.StateKey != nil && *ev.StateKey == b.config.BotUser {
+		var content memberContent
+		if json.Unmarshal(ev.Content, &content) == nil && content.Membership == "invite" {
+			if !ok {
+				if err := b.matrix.leave(ev.RoomID); err != nil {
+					log.Printf("Could not refuse invite to %s: %v", ev.RoomID, err)
+				}
+				return
+			}
+			if err := b.matrix.join(ev.RoomID); err != nil {
+				log.Printf("Could not join %s: %v", ev.RoomID, err)
+			}
+		}
+		return
+	}
+	if !ok || ev.Sender == b.config.BotUser {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b.publish(r, ev)
+}
+
+// backfill writes the events of a room since the last one written.
+func (b *bridge) backfill(r *room) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lastEvent) == 0 {
+		// Nothing was bridged yet, so nothing was missed.
+		return
+	}
+	events, err := b.matrix.recent(r.config.Room, backfillLimit)
+	if err != nil {
+		log.Printf("Could not backfill %s: %v", r.config.Room, err)
+		return
+	}
+	missed := -1
+	for i := range events {
+		if events[i].EventID == r.lastEvent {
+			missed = i
+			break
+		}
+	}
+	if missed < 0 {
+		log.Printf("Last bridged event of %s is older than %d events, some may not be bridged", r.config.Room, backfillLimit)
+		missed = len(events)
+	}
+	for i := missed - 1; i >= 0; i-- {
+		if events[i].Sender != b.config.BotUser {
+			b.publish(r, &events[i])
+		}
+	}
+}
+
+// publish converts an event and writes it to the topic of its room. Must be
+// called with the lock of the room held.
+func (b *bridge) publish(r *room, ev *matrixEvent) {
+	msg := convertEvent(ev)
+	if msg == nil {
+		return
+	}
+	dat, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Could not encode event %s: %v", ev.EventID, err)
+		return
+	}
+	if max := b.client.MaxLength(); uint64(len(dat)) > max {
+		msg.Body = "[message too long, not bridged]"
+		msg.MsgType = "m.notice"
+		dat, _ = json.Marshal(msg)
+	}
+	if err = b.client.Publish(r.topic, dat); err != nil {
+		log.Printf("Could not publish event %s: %v", ev.EventID, err)
+		return
+	}
+	if err = libtalek.SaveTopic(b.store, r.config.Topic, r.topic); err != nil {
+		log.Printf("Could not save topic %s: %v", r.config.Topic, err)
+	}
+	r.lastEvent = ev.EventID
+	if err = b.store.Put(r.config.Topic+".last", []byte(ev.EventID)); err != nil {
+		log.Printf("Could not save last event of %s: %v", r.config.Room, err)
+	}
+}
+
+// readTopic posts the items read from the handle of a room to the room.
+func (b *bridge) readTopic(r *room) {
+	for dat := range b.client.Poll(r.handle) {
+		// The handle is saved as each item is read, so a restarted bridge
+		// continues reading from the next.
+		if err := libtalek.SaveHandle(b.store, r.config.Handle, r.handle); err != nil {
+			log.Printf("Could not save handle %s: %v", r.config.Handle, err)
+		}
+		var msg bridgedMessage
+		if err := json.Unmarshal(dat, &msg); err != nil {
+			log.Printf("Ignoring malformed item for %s: %v", r.config.Room, err)
+			continue
+		}
+		content := renderMessage(&msg)
+		if content == nil {
+			continue
+		}
+		txnID := fmt.Sprintf("talek-%s-%d", msg.Sender, msg.Timestamp)
+		for attempt := 0; ; attempt++ {
+			err := b.matrix.send(r.config.Room, txnID, content)
+			if err == nil {
+				break
+			}
+			if attempt == 4 {
+				log.Printf("Dropping item for %s: %v", r.config.Room, err)
+				break
+			}
+			time.Sleep(time.Second << uint(attempt))
+		}
+	}
+}
+
+// convertEvent converts a Matrix event for a topic, or returns nil for
+// events which aren't bridged.
+func convertEvent(ev *matrixEvent) *bridgedMessage {
+	msg := &bridgedMessage{Sender: ev.Sender, Timestamp: ev.OriginServerTS}
+	switch ev.Type {
+	case "m.room.message":
+		var content messageContent
+		if err := json.Unmarshal(ev.Content, &content); err != nil || len(content.MsgType) == 0 {
+			return nil
+		}
+		msg.Kind = "message"
+		msg.MsgType = content.MsgType
+		msg.Body = content.Body
+		switch content.MsgType {
+		case "m.text", "m.notice", "m.emote":
+		default:
+			// Media lives on the homeserver, which the other side may not
+			// reach, so only its description is bridged.
+			msg.MsgType = "m.notice"
+			msg.Body = fmt.Sprintf("[%s not bridged: %s]", strings.TrimPrefix(content.MsgType, "m."), content.Body)
+		}
+	case "m.room.member":
+		var content memberContent
+		if err := json.Unmarshal(ev.Content, &content); err != nil || ev.StateKey == nil {
+			return nil
+		}
+		msg.Kind = "member"
+		msg.Sender = *ev.StateKey
+		msg.Membership = content.Membership
+	default:
+		return nil
+	}
+	return msg
+}
+
+// renderMessage converts an item read from a topic to the content of a
+// message posted by the bot, or returns nil for items which aren't shown.
+func renderMessage(msg *bridgedMessage) *messageContent {
+	switch msg.Kind {
+	case "message":
+		msgType := msg.MsgType
+		if msgType != "m.text" && msgType != "m.emote" {
+			msgType = "m.notice"
+		}
+		body := msg.Sender + ": " + msg.Body
+		if msgType == "m.emote" {
+			body = "* " + msg.Sender + " " + msg.Body
+			msgType = "m.text"
+		}
+		return &messageContent{MsgType: msgType, Body: body}
+	case "member":
+		var verb string
+		switch msg.Membership {
+		case "join":
+			verb = "joined"
+		case "leave":
+			verb = "left"
+		case "ban":
+			verb = "was banned"
+		case "invite":
+			verb = "was invited"
+		default:
+			return nil
+		}
+		return &messageContent{MsgType: "m.notice", Body: msg.Sender + " " + verb + " the bridged room"}
+	}
+	return nil
+}
+
+func matrixError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": code, "error": message})
+}
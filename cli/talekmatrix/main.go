@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/securemem"
+	"github.com/spf13/pflag"
+)
+
+// Config is the configuration of the bridge as a Matrix application service.
+type Config struct {
+	// Homeserver is the base URL of the client-server API of the homeserver.
+	Homeserver string
+	// ASToken authenticates the bridge to the homeserver, and HSToken the
+	// homeserver to the bridge, as in the registration of the service.
+	ASToken string
+	HSToken string
+	// BotUser is the Matrix user the bridge posts as.
+	BotUser string
+	// Rooms are the bridged rooms.
+	Rooms []RoomConfig
+}
+
+// RoomConfig bridges a Matrix room over a pair of topics, one for each
+// direction. The other side of the bridge writes the topic of Handle, and
+// reads that of Topic.
+type RoomConfig struct {
+	Room   string // Room ID, as !opaque:server
+	Topic  string // Stored topic events of the room are written to
+	Handle string // Stored handle items posted to the room are read from
+}
+
+// Validate checks the configuration is complete.
+func (c *Config) Validate() error {
+	if !strings.HasPrefix(c.Homeserver, "http://") && !strings.HasPrefix(c.Homeserver, "https://") {
+		return &common.ValidationError{Field: "Homeserver", Reason: "must be an http or https URL"}
+	}
+	if len(c.ASToken) == 0 || len(c.HSToken) == 0 {
+		return &common.ValidationError{Field: "ASToken", Reason: "both tokens must be set"}
+	}
+	if !strings.HasPrefix(c.BotUser, "@") {
+		return &common.ValidationError{Field: "BotUser", Reason: "must be a user ID"}
+	}
+	seen := make(map[string]bool)
+	for _, r := range c.Rooms {
+		if !strings.HasPrefix(r.Room, "!") {
+			return &common.ValidationError{Field: "Rooms", Reason: fmt.Sprintf("%q is not a room ID", r.Room)}
+		}
+		if len(r.Topic) == 0 || len(r.Handle) == 0 {
+			return &common.ValidationError{Field: "Rooms", Reason: fmt.Sprintf("%s needs a topic and a handle", r.Room)}
+		}
+		if seen[r.Room] {
+			return &common.ValidationError{Field: "Rooms", Reason: fmt.Sprintf("%s is bridged twice", r.Room)}
+		}
+		seen[r.Room] = true
+	}
+	return nil
+}
+
+// Bridges Matrix rooms over talek topics, so Matrix clients can talk through
+// talek without the servers learning who talks to whom.
+func main() {
+	log.Println("---------------------------")
+	log.Println("--- Talek Matrix Bridge ---")
+	log.Println("---------------------------")
+
+	configPath := pflag.String("config", "talek.conf", "Client configuration for talek")
+	bridgePath := pflag.String("bridge", "matrix.conf", "Bridge configuration")
+	storeDir := pflag.String("store", ".", "Directory of the topics and handles of bridged rooms")
+	listen := pflag.StringP("listen", "l", ":9000", "Address the homeserver pushes events to")
+	registration := pflag.Bool("registration", false, "Print the application service registration for the homeserver and exit")
+	passphrase := pflag.String("passphrase", "", "Passphrase stored topics and handles are encrypted with (env TALEK_PASSPHRASE)")
+	secureMemory := pflag.Bool("secure-memory", false, "Keep topic keys and seeds in locked memory, out of swap and core dumps (env TALEK_SECURE_MEMORY)")
+	verbose := pflag.Bool("verbose", false, "Print diagnostic information")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		log.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	if *secureMemory {
+		if err = securemem.Enable(); err != nil {
+			log.Fatalf("Could not lock memory for keys: %v\n", err)
+		}
+	}
+
+	bridgeConfig, err := bridgeConfigFromFile(*bridgePath)
+	if err != nil {
+		log.Fatalf("Could not load bridge configuration %s: %v\n", *bridgePath, err)
+	}
+	if *registration {
+		printRegistration(bridgeConfig, *listen)
+		return
+	}
+
+	config := libtalek.ClientConfigFromFile(*configPath)
+	if config == nil {
+		pflag.Usage()
+		return
+	}
+	fs, err := libtalek.NewFileStore(*storeDir)
+	if err != nil {
+		log.Fatalf("Could not open store %s: %v\n", *storeDir, err)
+	}
+	store := libtalek.Store(fs)
+	if len(*passphrase) > 0 {
+		if store, err = libtalek.NewPassphraseStore(fs, []byte(*passphrase)); err != nil {
+			log.Fatalf("Could not open store %s: %v\n", *storeDir, err)
+		}
+	}
+
+	client := libtalek.NewClient("Bridge", *config, common.NewFrontendRPC("RPC", config.FrontendAddr))
+	if client == nil {
+		log.Fatalln("Could not create talek client.")
+	}
+	client.Verbose = *verbose
+
+	b, err := newBridge(bridgeConfig, client, store)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Couldn't listen to %s: %v\n", *listen, err)
+	}
+	go http.Serve(listener, b)
+	b.run()
+
+	log.Printf("Bridging %d rooms.\n", len(bridgeConfig.Rooms))
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	listener.Close()
+	client.Flush()
+	client.Kill()
+}
+
+func bridgeConfigFromFile(file string) (*Config, error) {
+	dat, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err = json.Unmarshal(dat, config); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// printRegistration prints the registration of the bridge, which the
+// homeserver is configured with. The bridge claims no users or rooms of its
+// own beyond its bot user.
+func printRegistration(config *Config, listen string) {
+	localpart := strings.SplitN(strings.TrimPrefix(config.BotUser, "@"), ":", 2)[0]
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || len(host) == 0 {
+		host = "localhost"
+	}
+	fmt.Printf("id: talek\n")
+	fmt.Printf("url: http://%s\n", net.JoinHostPort(host, port))
+	fmt.Printf("as_token: %q\n", config.ASToken)
+	fmt.Printf("hs_token: %q\n", config.HSToken)
+	fmt.Printf("sender_localpart: %q\n", localpart)
+	fmt.Printf("rate_limited: false\n")
+	fmt.Printf("namespaces:\n  users: []\n  aliases: []\n  rooms: []\n")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// matrixEvent is the part of a Matrix room event the bridge reads.
+type matrixEvent struct {
+	EventID        string          `json:"event_id"`
+	Type           string          `json:"type"`
+	RoomID         string          `json:"room_id"`
+	Sender         string          `json:"sender"`
+	StateKey       *string         `json:"state_key,omitempty"`
+	OriginServerTS int64           `json:"origin_server_ts"`
+	Content        json.RawMessage `json:"content"`
+}
+
+// messageContent is the content of an m.room.message event.
+type messageContent struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+// memberContent is the content of an m.room.member event.
+type memberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+}
+
+// matrixTransaction is a batch of events a homeserver pushes to the bridge.
+type matrixTransaction struct {
+	Events []matrixEvent `json:"events"`
+}
+
+// matrixClient makes the calls of an application service to the client-server
+// API of its homeserver.
+type matrixClient struct {
+	homeserver string
+	token      string
+	user       string // The bot user the bridge acts as
+	http       *http.Client
+}
+
+func newMatrixClient(homeserver string, token string, user string) *matrixClient {
+	return &matrixClient{homeserver, token, user, &http.Client{Timeout: 30 * time.Second}}
+}
+
+// send posts a message to a room. The transaction ID makes retries of it
+// idempotent.
+func (m *matrixClient) send(room string, txnID string, content *messageContent) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(room), url.PathEscape(txnID))
+	return m.call("PUT", path, nil, content, nil)
+}
+
+// join has the bot user join a room it was invited to.
+func (m *matrixClient) join(room string) error {
+	return m.call("POST", "/_matrix/client/v3/join/"+url.PathEscape(room), nil, struct{}{}, nil)
+}
+
+// leave has the bot user leave, or refuse the invitation to, a room.
+func (m *matrixClient) leave(room string) error {
+	return m.call("POST", "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/leave", nil, struct{}{}, nil)
+}
+
+// recent returns up to limit of the latest events of a room, newest first.
+func (m *matrixClient) recent(room string, limit int) ([]matrixEvent, error) {
+	query := url.Values{"dir": {"b"}, "limit": {fmt.Sprint(limit)}}
+	var reply struct {
+		Chunk []matrixEvent `json:"chunk"`
+	}
+	err := m.call("GET", "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/messages", query, nil, &reply)
+	return reply.Chunk, err
+}
+
+func (m *matrixClient) call(method string, path string, query url.Values, body interface{}, reply interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	// Application services name the user they act as.
+	query.Set("user_id", m.user)
+	var in io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(dat)
+	}
+	req, err := http.NewRequest(method, m.homeserver+path+"?"+query.Encode(), in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(dat))
+	}
+	if reply != nil {
+		return json.Unmarshal(dat, reply)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/securemem"
+	"github.com/privacylab/talek/server"
+)
+
+// loadBackupKey reads the key backups are encrypted with, as 64 hex digits.
+func loadBackupKey(file string) (*[32]byte, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(dat)
+	key, err := hex.DecodeString(strings.TrimSpace(string(dat)))
+	defer securemem.Wipe(key)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s does not hold 64 hex digits", file)
+	}
+	k := securemem.Key32()
+	copy(k[:], key)
+	return k, nil
+}
+
+// backupReplica backs up the state of the running replica of a configuration,
+// and the configuration with its keys, to a directory of backups.
+func backupReplica(serverConfig server.Config, configString []byte, from string, dir string, keyFile string, keep int) error {
+	key, err := loadBackupKey(keyFile)
+	if err != nil {
+		return err
+	}
+	defer securemem.Free(key[:])
+	store, err := server.NewDirStore(dir)
+	if err != nil {
+		return err
+	}
+
+	td := *serverConfig.TrustDomain
+	if from != "" {
+		td.Address = from
+	}
+	rpc := common.NewReplicaRPC("backup", &td)
+	if rpc == nil {
+		return fmt.Errorf("no address to back up the replica from")
+	}
+	defer rpc.Close()
+	state, err := server.FetchSnapshot(rpc)
+	if err != nil {
+		return err
+	}
+	m, err := server.WriteBackup(store, key, state, configString)
+	if err != nil {
+		return err
+	}
+	log.Printf("Backed up %d bytes of state as %s, storing %d of its %d chunks.\n", m.Size, m.Name, m.Stored, len(m.Chunks))
+	return server.PruneBackups(store, key, keep)
+}
+
+// restoreBackup restores a backup from a directory of backups, the latest if
+// name is empty. The configuration backed up is written to configPath unless
+// a file is there already. It returns the configuration and the state of the
+// replica.
+func restoreBackup(dir string, keyFile string, name string, configPath string) ([]byte, []byte, error) {
+	key, err := loadBackupKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer securemem.Free(key[:])
+	store, err := server.NewDirStore(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, state, err := server.ReadBackup(store, key, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Restoring %s, of %v.\n", m.Name, m.Created)
+	if _, err = os.Stat(configPath); os.IsNotExist(err) {
+		if err = ioutil.WriteFile(configPath, m.Config, 0600); err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Restored the configuration to %s.\n", configPath)
+	}
+	return m.Config, state, nil
+}
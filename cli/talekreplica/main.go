@@ -2,19 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/coreos/etcd/pkg/flags"
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/securemem"
 	"github.com/privacylab/talek/server"
 	"github.com/spf13/pflag"
 )
 
-// Starts a single, centralized talek replica operating with configuration from talekutil
+// Starts a single, centralized talek replica operating with configuration from talekutil.
+//
+// `talekreplica backup` instead backs up the running replica of the
+// configuration to --backup-dir, and `talekreplica restore` starts the
+// replica from the latest backup there.
 func main() {
 	log.Println("---------------------")
 	log.Println("--- Talek Replica ---")
@@ -26,6 +34,19 @@ func main() {
 	commonPath := pflag.StringP("common", "f", "common.conf", "Talek Common Configuration (env TALEK_COMMON)")
 	backing := pflag.StringP("backing", "b", "cpu.0", "PIR daemon method (env TALEK_BACKING)")
 	listen := pflag.StringP("listen", "l", ":8080", "Listening Address")
+	metrics := pflag.String("metrics", "", "Address to serve Prometheus metrics at /metrics on, or none (env TALEK_METRICS)")
+	benchmark := pflag.Duration("benchmark", 0, "Measure the throughput of a shard of the configuration for this long in each of writes and reads, then exit")
+	secureMemory := pflag.Bool("secure-memory", false, "Keep the private keys of the trust domain in locked memory, out of swap and core dumps (env TALEK_SECURE_MEMORY)")
+	backupDir := pflag.String("backup-dir", "backups", "Directory of encrypted backups, for backup and restore (env TALEK_BACKUP_DIR)")
+	backupKey := pflag.String("backup-key", "backup.key", "File of the 64 hex digit key backups are encrypted with (env TALEK_BACKUP_KEY)")
+	backupFrom := pflag.String("backup-from", "", "Address of the replica to back up, if not that of its trust domain")
+	backupName := pflag.String("backup-name", "", "Backup to restore, such as backups/01234, rather than the latest")
+	keepBackups := pflag.Int("keep-backups", 0, "Backups kept after a backup, deleting older ones, or 0 to keep all")
+	logLevel := pflag.String("log-level", "", "Level of all loggers: trace, info, warn, error or off, changeable at runtime with SetLogLevel (env TALEK_LOG_LEVEL)")
+	logFile := pflag.String("log-file", "", "File to log to rather than standard output, rotated by size and age (env TALEK_LOG_FILE)")
+	logMaxSize := pflag.Int64("log-max-size", 100, "Megabytes the log file grows to before it is rotated, or 0 for no limit")
+	logMaxAge := pflag.Duration("log-max-age", 24*time.Hour, "How long the log file is written to before it is rotated, or 0 for no limit")
+	logKeep := pflag.Int("log-keep", 7, "Rotated log files kept, or 0 to keep all")
 	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if err != nil {
 		log.Printf("Error reading environment variables, %v\n", err)
@@ -33,15 +54,41 @@ func main() {
 	}
 	pflag.Parse()
 
+	logs, err := common.ConfigureLogging(*logLevel, *logFile, *logMaxSize<<20, *logMaxAge, *logKeep)
+	if err != nil {
+		log.Printf("Could not configure logging: %v\n", err)
+		return
+	}
+	if logs != nil {
+		defer logs.Close()
+	}
+
 	log.Printf("Arguments:\n")
 	log.Printf("config=%v\n", *configPath)
 	log.Printf("backing=%v\n", *backing)
 
-	configString, err := ioutil.ReadFile(*configPath)
-	if err != nil {
+	if *secureMemory {
+		if err = securemem.Enable(); err != nil {
+			log.Printf("Could not lock memory for keys: %v\n", err)
+			return
+		}
+	}
+
+	var configString, restored, backupConfig []byte
+	if pflag.Arg(0) == "restore" {
+		configString, restored, err = restoreBackup(*backupDir, *backupKey, *backupName, *configPath)
+		if err != nil {
+			log.Printf("Could not restore the backup: %v\n", err)
+			return
+		}
+	} else if configString, err = ioutil.ReadFile(*configPath); err != nil {
 		log.Printf("Could not read %s!\n", *configPath)
 		return
 	}
+	if pflag.Arg(0) == "backup" {
+		backupConfig = append([]byte{}, configString...)
+		defer securemem.Wipe(backupConfig)
+	}
 	commonString, err := ioutil.ReadFile(*commonPath)
 	if err != nil {
 		log.Printf("Could not read %s!\n", *commonPath)
@@ -58,7 +105,9 @@ func main() {
 		TrustDomain:      &common.TrustDomainConfig{},
 		TrustDomainIndex: 0,
 	}
-	if err = json.Unmarshal(configString, &serverConfig); err != nil {
+	err = json.Unmarshal(configString, &serverConfig)
+	securemem.Wipe(configString)
+	if err != nil {
 		log.Printf("Could not parse %s: %v\n", *configPath, err)
 		return
 	}
@@ -71,18 +120,58 @@ func main() {
 	log.Printf("serverConfig=%#+v\n", serverConfig)
 	log.Printf("serverConfig.Config=%#+v\n", serverConfig.Config)
 
+	if pflag.Arg(0) == "backup" {
+		if err = backupReplica(serverConfig, backupConfig, *backupFrom, *backupDir, *backupKey, *keepBackups); err != nil {
+			log.Printf("Backup failed: %v\n", err)
+		}
+		return
+	}
+
+	if *benchmark > 0 {
+		result, err := server.MeasureShard(serverConfig.TrustDomain.Name, *backing, serverConfig, *benchmark)
+		if err != nil {
+			log.Printf("Benchmark failed: %v\n", err)
+			return
+		}
+		fmt.Printf("writes/sec: %.0f\nreads/sec: %.0f\n(%v)\n", result.WritesPerSecond(), result.ReadsPerSecond(), result)
+		return
+	}
+
 	r := server.NewReplicaServer(serverConfig.TrustDomain.Name, *backing, serverConfig)
-	listener, err := r.Run(*listen)
+	if restored != nil {
+		if err = r.Replica.Restore(restored); err != nil {
+			log.Printf("Could not restore the state of the replica: %v\n", err)
+			return
+		}
+	}
+	var listeners []net.Listener
+	if len(serverConfig.Listeners) > 0 {
+		listeners, err = r.Listen(serverConfig.Listeners)
+	} else {
+		var listener net.Listener
+		listener, err = r.Run(*listen)
+		listeners = []net.Listener{listener}
+	}
 	if err != nil {
 		log.Printf("Couldn't listen to frontend address: %v\n", err)
 		return
 	}
 
+	if *metrics != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", r.Replica.ServeMetrics)
+		go func() {
+			log.Printf("Metrics stopped: %v\n", http.ListenAndServe(*metrics, mux))
+		}()
+	}
+
 	log.Println("Running.")
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
 	r.Replica.Close()
-	listener.Close()
+	for _, l := range listeners {
+		l.Close()
+	}
 }
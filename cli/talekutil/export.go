@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+)
+
+// exportUtil encrypts the topic, handle or private trust domain saved in
+// infile under a passphrase, and writes it armored to outfile.
+func exportUtil(infile string, outfile string, passphrase string) {
+	if passphrase == "" {
+		fmt.Println("Exports are encrypted, provide --passphrase.")
+		os.Exit(2)
+	}
+	txt, err := loadStored(infile, passphrase)
+	if err != nil {
+		fmt.Printf("Could not read %s: %v\n", infile, err)
+		os.Exit(2)
+	}
+
+	var armored []byte
+	switch {
+	case bytes.HasPrefix(txt, []byte("{")):
+		td := &common.TrustDomainConfig{}
+		if err = json.Unmarshal(txt, td); err == nil {
+			armored, err = libtalek.ExportTrustDomain(td, []byte(passphrase))
+		}
+	// Topics are a signing private key of 64 bytes, then their handle.
+	case bytes.IndexByte(txt, '.') == 2*64:
+		topic := &libtalek.Topic{}
+		if err = topic.UnmarshalText(txt); err == nil {
+			armored, err = libtalek.ExportTopic(topic, []byte(passphrase))
+		}
+	default:
+		handle := &libtalek.Handle{}
+		if err = handle.UnmarshalText(txt); err == nil {
+			armored, err = libtalek.ExportHandle(handle, []byte(passphrase))
+		}
+	}
+	if err != nil {
+		fmt.Printf("Could not export %s: %v\n", infile, err)
+		os.Exit(2)
+	}
+	if err = ioutil.WriteFile(outfile, armored, 0600); err != nil {
+		fmt.Printf("Failed to write file: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+// importUtil restores an export of infile to outfile. Topics and handles are
+// saved encrypted with the passphrase, as talekclient reads them with
+// --passphrase; trust domains as the private configuration of talekutil
+// --trustdomain --private.
+func importUtil(infile string, outfile string, passphrase string) {
+	armored, err := ioutil.ReadFile(infile)
+	if err != nil {
+		fmt.Printf("Could not read %s: %v\n", infile, err)
+		os.Exit(2)
+	}
+	kind, _, err := libtalek.OpenExport(armored, []byte(passphrase))
+	if err != nil {
+		fmt.Printf("Could not import %s: %v\n", infile, err)
+		os.Exit(2)
+	}
+
+	if kind == libtalek.ArmorTrustDomain {
+		var td *common.TrustDomainConfig
+		var dat []byte
+		if td, err = libtalek.ImportTrustDomain(armored, []byte(passphrase)); err == nil {
+			dat, err = json.MarshalIndent(td.Private(), "", "  ")
+		}
+		if err == nil {
+			err = ioutil.WriteFile(outfile, dat, 0600)
+		}
+		if err != nil {
+			fmt.Printf("Could not import %s: %v\n", infile, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	fs, err := libtalek.NewFileStore(filepath.Dir(outfile))
+	if err == nil {
+		var store *libtalek.EncryptedStore
+		if store, err = libtalek.NewPassphraseStore(fs, []byte(passphrase)); err == nil {
+			err = importStored(store, filepath.Base(outfile), kind, armored, passphrase)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Could not import %s: %v\n", infile, err)
+		os.Exit(2)
+	}
+}
+
+func importStored(store libtalek.Store, name string, kind string, armored []byte, passphrase string) error {
+	switch kind {
+	case libtalek.ArmorTopic:
+		topic, err := libtalek.ImportTopic(armored, []byte(passphrase))
+		if err != nil {
+			return err
+		}
+		return libtalek.SaveTopic(store, name, topic)
+	case libtalek.ArmorHandle:
+		handle, err := libtalek.ImportHandle(armored, []byte(passphrase))
+		if err != nil {
+			return err
+		}
+		return libtalek.SaveHandle(store, name, handle)
+	}
+	return fmt.Errorf("unknown kind of export %q", kind)
+}
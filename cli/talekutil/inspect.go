@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/libtalek"
+)
+
+// inspected is a decoded topic or handle, as printed by inspect. Secrets are
+// redacted to a short digest, which still tells whether two files share them.
+type inspected struct {
+	File              string          `json:"file"`
+	Kind              string          `json:"kind"` // "topic" or "handle"
+	ID                uint64          `json:"id,omitempty"`
+	Seqno             uint64          `json:"seqno"`
+	Broadcast         bool            `json:"broadcast"`
+	Seed1             string          `json:"seed1"`
+	Seed2             string          `json:"seed2"`
+	SharedSecret      string          `json:"sharedSecret"`
+	SigningPublicKey  string          `json:"signingPublicKey"`
+	SigningPrivateKey string          `json:"signingPrivateKey,omitempty"`
+	Deniable          bool            `json:"deniable"`
+	Symmetric         bool            `json:"symmetric"`
+	Nonced            bool            `json:"nonced"`
+	ChainKey          string          `json:"chainKey,omitempty"`
+	ChainSeqno        uint64          `json:"chainSeqno,omitempty"`
+	Checks            []inspectCheck  `json:"checks"`
+	Buckets           []inspectBucket `json:"buckets,omitempty"`
+
+	handle *libtalek.Handle
+}
+
+type inspectCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// inspectBucket is the pair of buckets an item at a seqno is written to, and
+// read from.
+type inspectBucket struct {
+	Seqno   uint64 `json:"seqno"`
+	Bucket1 uint64 `json:"bucket1"`
+	Bucket2 uint64 `json:"bucket2"`
+}
+
+// inspectReport is what inspect prints as JSON. With a second file, it
+// compares the two, as a writer's topic and a reader's handle.
+type inspectReport struct {
+	Inspected []*inspected   `json:"inspected"`
+	Compare   []inspectCheck `json:"compare,omitempty"`
+}
+
+// inspectUtil decodes a serialized topic or handle, checks its keys, and
+// prints the buckets of its next count items under a common configuration.
+// With compare, the two are checked to follow the same log, to debug readers
+// that never see a writer's messages. Secrets are redacted unless asked for.
+func inspectUtil(infile string, compare string, incommon string, passphrase string, count int, secrets bool) {
+	var config *common.Config
+	if incommon != "" {
+		if config = common.ConfigFromFile(incommon); config == nil {
+			fmt.Printf("Could not load common configuration %s\n", incommon)
+			os.Exit(2)
+		}
+	}
+
+	report := inspectReport{}
+	for _, file := range []string{infile, compare} {
+		if file == "" {
+			continue
+		}
+		i, err := inspectFile(file, passphrase, secrets)
+		if err != nil {
+			fmt.Printf("Could not decode %s: %v\n", file, err)
+			os.Exit(2)
+		}
+		if config != nil {
+			for n := uint64(0); n < uint64(count); n++ {
+				b1, b2 := common.ItemBuckets(config, i.handle.Seed1, i.handle.Seed2, i.Seqno+n)
+				i.Buckets = append(i.Buckets, inspectBucket{i.Seqno + n, b1, b2})
+			}
+		}
+		report.Inspected = append(report.Inspected, i)
+	}
+	if len(report.Inspected) == 2 {
+		report.Compare = compareHandles(report.Inspected[0].handle, report.Inspected[1].handle)
+	}
+
+	dat, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to export report: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Println(string(dat))
+}
+
+func inspectFile(file string, passphrase string, secrets bool) (*inspected, error) {
+	txt, err := loadStored(file, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &inspected{File: file}
+	var topic *libtalek.Topic
+	// Topics are a signing private key of 64 bytes, then their handle.
+	if dot := bytes.IndexByte(txt, '.'); dot == 2*64 {
+		topic = &libtalek.Topic{}
+		if err = topic.UnmarshalText(txt); err != nil {
+			return nil, err
+		}
+		i.Kind = "topic"
+		i.ID = topic.ID
+		i.handle = &topic.Handle
+		i.SigningPrivateKey = secret(topic.SigningPrivateKey[:], secrets)
+	} else {
+		i.handle = &libtalek.Handle{}
+		if err = i.handle.UnmarshalText(txt); err != nil {
+			return nil, err
+		}
+		i.Kind = "handle"
+	}
+
+	h := i.handle
+	i.Seqno = h.Seqno
+	i.Broadcast = h.IsBroadcast()
+	s1, _ := h.Seed1.MarshalBinary()
+	s2, _ := h.Seed2.MarshalBinary()
+	// The seeds of broadcast topics are public.
+	i.Seed1 = secret(s1, secrets || i.Broadcast)
+	i.Seed2 = secret(s2, secrets || i.Broadcast)
+	i.SharedSecret = secret(h.SharedSecret[:], secrets)
+	i.SigningPublicKey = hex.EncodeToString(h.SigningPublicKey[:])
+	i.Symmetric = h.Envelope == libtalek.EnvelopeSymmetric
+	i.Nonced = h.Envelope == libtalek.EnvelopeNonced
+	if h.IsDeniable() {
+		i.Deniable = true
+		i.ChainKey = secret(h.ChainKey[:], secrets)
+		i.ChainSeqno = h.ChainSeqno
+	}
+
+	i.Checks = append(i.Checks, inspectCheck{Name: "seeds", OK: len(s1) == drbg.SeedLength && len(s2) == drbg.SeedLength && !bytes.Equal(s1, s2)})
+	i.Checks = append(i.Checks, inspectCheck{Name: "shared secret", OK: *h.SharedSecret != [32]byte{}})
+	if topic != nil {
+		c := inspectCheck{Name: "topic keys", OK: true}
+		if err := topic.Check(); err != nil {
+			c.OK = false
+			c.Detail = err.Error()
+		}
+		i.Checks = append(i.Checks, c)
+	}
+	return i, nil
+}
+
+// loadStored reads a value saved by a client, opening it with the passphrase
+// if it was saved encrypted.
+func loadStored(file string, passphrase string) ([]byte, error) {
+	fs, err := libtalek.NewFileStore(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	txt, err := fs.Get(filepath.Base(file))
+	if err != nil {
+		return nil, err
+	}
+	if libtalek.IsEncrypted(txt) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("encrypted, provide --passphrase")
+		}
+		store, err := libtalek.NewPassphraseStore(fs, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		if txt, err = store.Get(filepath.Base(file)); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSpace(txt), nil
+}
+
+// compareHandles checks two handles follow the same log.
+func compareHandles(a *libtalek.Handle, b *libtalek.Handle) []inspectCheck {
+	checks := []inspectCheck{
+		{Name: "seeds", OK: drbg.Equal(a.Seed1, b.Seed1) && drbg.Equal(a.Seed2, b.Seed2)},
+		{Name: "shared secret", OK: *a.SharedSecret == *b.SharedSecret},
+		{Name: "signing public key", OK: *a.SigningPublicKey == *b.SigningPublicKey},
+	}
+	seqno := inspectCheck{Name: "seqno", OK: a.Seqno == b.Seqno}
+	if a.Seqno > b.Seqno {
+		seqno.Detail = fmt.Sprintf("second is %d items behind", a.Seqno-b.Seqno)
+	} else if b.Seqno > a.Seqno {
+		seqno.Detail = fmt.Sprintf("second is %d items ahead", b.Seqno-a.Seqno)
+	}
+	return append(checks, seqno)
+}
+
+// secret shows a secret in hex when asked to, and otherwise only a digest of
+// it, by which files holding the same secret can be matched.
+func secret(value []byte, show bool) string {
+	if show {
+		return hex.EncodeToString(value)
+	}
+	digest := sha256.Sum256(value)
+	return "redacted:" + hex.EncodeToString(digest[:4])
+}
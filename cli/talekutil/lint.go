@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/server"
+)
+
+// lintFinding is a problem lint found with one of the configuration files.
+type lintFinding struct {
+	File     string `json:"file"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+}
+
+// lintReport is printed by lint as JSON. It is OK without errors, though it
+// may have warnings.
+type lintReport struct {
+	OK       bool          `json:"ok"`
+	Findings []lintFinding `json:"findings"`
+}
+
+func (r *lintReport) errorf(file string, format string, args ...interface{}) {
+	r.OK = false
+	r.Findings = append(r.Findings, lintFinding{file, "error", fmt.Sprintf(format, args...)})
+}
+
+func (r *lintReport) warnf(file string, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, lintFinding{file, "warning", fmt.Sprintf(format, args...)})
+}
+
+// lintUtil checks a common configuration, replica configurations, and a client
+// configuration, each optional, and that they are consistent with one
+// another. The report is printed as JSON, and talekutil exits with status 1
+// if it has errors.
+func lintUtil(commonfile string, replicafiles string, clientfile string) {
+	report := lintReport{OK: true, Findings: []lintFinding{}}
+	lint(&report, commonfile, replicafiles, clientfile)
+
+	dat, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to export report: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Println(string(dat))
+	if !report.OK {
+		os.Exit(1)
+	}
+}
+
+func lint(report *lintReport, commonfile string, replicafiles string, clientfile string) {
+	var commonConfig *common.Config
+	if commonfile != "" {
+		if commonConfig = common.ConfigFromFile(commonfile); commonConfig == nil {
+			report.errorf(commonfile, "could not load common configuration")
+		} else if err := commonConfig.Validate(); err != nil {
+			report.errorf(commonfile, "%v", err)
+		}
+	}
+
+	// Replicas, by trust domain index.
+	replicas := make(map[int]*server.Config)
+	replicaFiles := make(map[int]string)
+	if replicafiles != "" {
+		for _, file := range strings.Split(replicafiles, ",") {
+			sc := loadReplica(report, file, commonConfig)
+			if sc == nil {
+				continue
+			}
+			if other, ok := replicaFiles[sc.TrustDomainIndex]; ok {
+				report.errorf(file, "trust domain index %d is also that of %s", sc.TrustDomainIndex, other)
+				continue
+			}
+			replicas[sc.TrustDomainIndex] = sc
+			replicaFiles[sc.TrustDomainIndex] = file
+		}
+	}
+
+	if clientfile == "" {
+		return
+	}
+	clientConfig := new(libtalek.ClientConfig)
+	dat, err := ioutil.ReadFile(clientfile)
+	if err == nil {
+		err = json.Unmarshal(dat, clientConfig)
+	}
+	if err != nil {
+		report.errorf(clientfile, "could not load client configuration: %v", err)
+		return
+	}
+	if err := clientConfig.Validate(); err != nil {
+		report.errorf(clientfile, "%v", err)
+	}
+	if clientConfig.FrontendAddr == "" {
+		report.warnf(clientfile, "no frontend address")
+	}
+	if commonConfig != nil && clientConfig.Config != nil {
+		// The client's own intervals are what it uses, unless its traffic
+		// is shaped.
+		conf := *clientConfig.Config
+		if conf.ShapeWrites == 0 {
+			conf.WriteInterval = clientConfig.WriteInterval
+		}
+		if conf.ShapeReads == 0 {
+			conf.ReadInterval = clientConfig.ReadInterval
+		}
+		if !sameConfig(commonConfig, &conf) {
+			report.errorf(clientfile, "common configuration differs from that of %s", commonfile)
+		}
+	}
+
+	addresses := make(map[string]int)
+	for i, td := range clientConfig.TrustDomains {
+		if td.Private().PrivateKey != [32]byte{} {
+			report.warnf(clientfile, "trust domain %d includes its private key", i)
+		}
+		if td.Address != "" {
+			if j, ok := addresses[td.Address]; ok {
+				report.errorf(clientfile, "trust domains %d and %d share address %s", j, i, td.Address)
+			}
+			addresses[td.Address] = i
+		}
+
+		sc, ok := replicas[i]
+		if !ok {
+			if replicafiles != "" {
+				report.warnf(clientfile, "no replica configuration given for trust domain %d", i)
+			}
+			continue
+		}
+		file := replicaFiles[i]
+		if td.DNSName == "" && (td.PublicKey != sc.TrustDomain.PublicKey || td.SignPublicKey != sc.TrustDomain.SignPublicKey) {
+			report.errorf(file, "keys differ from those of trust domain %d in %s", i, clientfile)
+		}
+		if td.DNSName != "" && !strings.EqualFold(td.Fingerprint, sc.TrustDomain.KeyFingerprint()) {
+			report.errorf(file, "keys do not match the fingerprint of trust domain %d in %s", i, clientfile)
+		}
+		if td.Name != sc.TrustDomain.Name {
+			report.warnf(file, "name %q differs from %q of trust domain %d in %s", sc.TrustDomain.Name, td.Name, i, clientfile)
+		}
+		if td.DNSName == "" && !sameAddress(td.Address, sc.TrustDomain.Address) {
+			report.warnf(file, "address %q differs from %q of trust domain %d in %s", sc.TrustDomain.Address, td.Address, i, clientfile)
+		}
+	}
+	for i, file := range replicaFiles {
+		if i >= len(clientConfig.TrustDomains) {
+			report.errorf(file, "trust domain index %d is not among the %d trust domains of %s", i, len(clientConfig.TrustDomains), clientfile)
+		}
+	}
+}
+
+// loadReplica loads a replica configuration as talekreplica does, with the
+// common configuration taking precedence.
+func loadReplica(report *lintReport, file string, commonConfig *common.Config) *server.Config {
+	sc := &server.Config{Config: &common.Config{}}
+	dat, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(dat, sc)
+	}
+	if err != nil {
+		report.errorf(file, "could not load replica configuration: %v", err)
+		return nil
+	}
+	if commonConfig != nil {
+		*sc.Config = *commonConfig
+	}
+	if err := sc.Validate(); err != nil {
+		report.errorf(file, "%v", err)
+	}
+	if sc.TrustDomain == nil {
+		report.errorf(file, "no trust domain")
+		return nil
+	}
+	if sc.TrustDomain.Private().PrivateKey == [32]byte{} {
+		report.errorf(file, "trust domain has no private key")
+	}
+	return sc
+}
+
+// sameConfig compares configurations by the encoding config bundles sign.
+func sameConfig(a *common.Config, b *common.Config) bool {
+	return bytes.Equal(common.NewConfigBundle(a, nil).Canonical(), common.NewConfigBundle(b, nil).Canonical())
+}
+
+// sameAddress compares addresses, with or without an http scheme.
+func sameAddress(a string, b string) bool {
+	return strings.TrimPrefix(a, "http://") == strings.TrimPrefix(b, "http://")
+}
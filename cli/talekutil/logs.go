@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/privacylab/talek/common"
+)
+
+// logServer is a server whose logging can be changed at runtime.
+type logServer interface {
+	SetLogLevel(args *common.LogLevelArgs, reply *common.LogReply) error
+	RotateLogs(args *interface{}, reply *common.LogReply) error
+	Close()
+}
+
+// logsUtil sets the log level of a component of the frontend or replica at
+// address, or of all its components, and rotates its log file, then prints
+// the level of each of its components.
+func logsUtil(kind string, address string, component string, level string, rotate bool) {
+	var server logServer
+	switch kind {
+	case "frontend":
+		server = common.NewFrontendRPC("talekutil", address)
+	case "replica":
+		server = common.NewReplicaRPC("talekutil", &common.TrustDomainConfig{Address: address, IsValid: true})
+	default:
+		fmt.Println("logs needs a server: talekutil logs frontend|replica --address host:port")
+		os.Exit(1)
+	}
+	defer server.Close()
+
+	var reply common.LogReply
+	err := server.SetLogLevel(&common.LogLevelArgs{Component: component, Level: level}, &reply)
+	if err == nil && reply.Err == "" && rotate {
+		err = server.RotateLogs(nil, &reply)
+	}
+	if err == nil && reply.Err != "" {
+		err = fmt.Errorf("%s", reply.Err)
+	}
+	if err != nil {
+		fmt.Printf("Could not change logging of %s: %v\n", address, err)
+		os.Exit(1)
+	}
+	components := make([]string, 0, len(reply.Levels))
+	for c := range reply.Levels {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	for _, c := range components {
+		fmt.Printf("%-32s %s\n", c, reply.Levels[c])
+	}
+}
@@ -26,6 +26,8 @@ func main() {
 	outputReplica := pflag.Bool("replica", false, "Create configuration for a talek server.")
 	outputTD := pflag.Bool("trustdomain", false, "Create raw trustdomain configuration.")
 	outputCommon := pflag.Bool("common", false, "Create common config template.")
+	outputBundle := pflag.Bool("bundle", false, "Create a config bundle of --incommon and --trustdomains for trust domains to sign.")
+	signBundle := pflag.String("sign", "", "Sign the config bundle at this path with the private trust domain of --infile.")
 	name := pflag.String("name", "talek", "Server Name.")
 	address := pflag.String("address", "localhost:9000", "Server Address.")
 	index := pflag.Int("index", 0, "Trust Domain Index.")
@@ -34,6 +36,17 @@ func main() {
 	outfile := pflag.String("outfile", "talek.json", "Save configuration to file.")
 	private := pflag.Bool("private", false, "Include private key configuration.")
 	trustdomains := pflag.String("trustdomains", "talek.json", "Comma separated list of trust domains.")
+	replicas := pflag.String("replicas", "", "Comma separated list of replica configurations for lint.")
+	compare := pflag.String("compare", "", "Compare the topic or handle of --infile with the one in this file, for inspect.")
+	passphrase := pflag.String("passphrase", "", "Decrypt topics and handles saved with this passphrase, for inspect and export; encrypt exports, and decrypt them for import.")
+	count := pflag.Int("count", 8, "Number of upcoming seqnos to print buckets of, for inspect.")
+	secrets := pflag.Bool("secrets", false, "Print secret keys and seeds, rather than redacting them, for inspect.")
+	epoch := pflag.Uint64("epoch", 0, "First write epoch of the configuration of --incommon, for transition. 0 for the first clients can learn of it by.")
+	crossover := pflag.Uint64("crossover", 10, "Epochs the previous configuration is still accepted, for transition.")
+	component := pflag.String("component", "", "Component to set the log level of, for logs. Empty for all.")
+	level := pflag.String("level", "", "Log level to set, of trace, info, warn, error or off, for logs. Empty to only list levels.")
+	rotate := pflag.Bool("rotate", false, "Rotate the log file of the server, for logs.")
+	to := pflag.String("to", "", "Address of the replica to move the trust domain of --index to, for migrate.")
 	ferr := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if ferr != nil {
 		fmt.Printf("Error reading environment variables, %v\n", ferr)
@@ -41,6 +54,46 @@ func main() {
 	}
 	pflag.Parse()
 
+	// talekutil lint --incommon common.json --replicas r0.json,r1.json --infile talek.json
+	if pflag.Arg(0) == "lint" {
+		lintUtil(*incommon, *replicas, *infile)
+		return
+	}
+	// talekutil inspect --infile topic --compare handle --incommon common.json
+	if pflag.Arg(0) == "inspect" {
+		inspectUtil(*infile, *compare, *incommon, *passphrase, *count, *secrets)
+		return
+	}
+	// talekutil transition --incommon next.json --address frontend:port --epoch 1000 --crossover 10
+	if pflag.Arg(0) == "transition" {
+		transitionUtil(*incommon, *address, *epoch, *crossover)
+		return
+	}
+	// talekutil migrate --address frontend:port --index 1 --to replica:port
+	if pflag.Arg(0) == "migrate" {
+		migrateUtil(*address, *index, *to)
+		return
+	}
+	// talekutil logs frontend --address frontend:port --component Frontend:talek --level trace --rotate
+	if pflag.Arg(0) == "logs" {
+		logsUtil(pflag.Arg(1), *address, *component, *level, *rotate)
+		return
+	}
+	// talekutil export --infile topic --outfile topic.asc --passphrase ...
+	// talekutil import --infile topic.asc --outfile topic --passphrase ...
+	if pflag.Arg(0) == "export" || pflag.Arg(0) == "import" {
+		if *infile == "" || !pflag.CommandLine.Changed("outfile") {
+			fmt.Printf("%s needs --infile and --outfile.\n", pflag.Arg(0))
+			return
+		}
+		if pflag.Arg(0) == "export" {
+			exportUtil(*infile, *outfile, *passphrase)
+		} else {
+			importUtil(*infile, *outfile, *passphrase)
+		}
+		return
+	}
+
 	if *outputCommon {
 		com := common.Config{
 			NumBuckets:         1024,
@@ -58,6 +111,7 @@ func main() {
 			ReadBatch:     8,
 			WriteInterval: time.Second,
 			ReadInterval:  time.Second,
+			HonorTTL:      true,
 			Config: &com,
 		}
 	
@@ -71,8 +125,17 @@ func main() {
 		return
 	}
 
+	if *outputBundle {
+		bundleUtil(*incommon, *outfile, *trustdomains)
+		return
+	}
+	if len(*signBundle) > 0 {
+		signUtil(*signBundle, *infile, *index, *outfile)
+		return
+	}
+
 	if !*outputReplica && !*outputTD && !*outputClient {
-		fmt.Println("Talekutil needs a mode: --client, --replica, or --trustdomain.")
+		fmt.Println("Talekutil needs a mode: --client, --replica, or --trustdomain, or the lint, inspect, export, import, transition, migrate or logs command.")
 		return
 	} else if (*outputReplica && *outputTD) || (*outputClient && *outputReplica) || (*outputClient && *outputTD) {
 		fmt.Println("Mode must be one of --replica or --trustdomain or --client.")
@@ -156,6 +219,9 @@ func main() {
 			fmt.Printf("Failed to write file: %v\n", err)
 			return
 		}
+		// For clients to discover the trust domain by a DNS name.
+		fmt.Printf("Fingerprint: %s\n", tdc.KeyFingerprint())
+		fmt.Printf("TXT record: %s\n", tdc.DiscoveryRecord())
 	} else if *outputReplica {
 		// We write a custom version of the replica config that is still able to be
 		// unmarshaled. In particular, the code below uses the serialized version of
@@ -199,22 +265,31 @@ func main() {
 	}
 }
 
-// update/create client configuration with an explicit set of server trust domains.
-func clientUtil(infile string, outfile string, trustfiles string) {
+// loadTrustDomains reads a comma separated list of trust domain files.
+func loadTrustDomains(trustfiles string) []*common.TrustDomainConfig {
 	domainPaths := strings.Split(trustfiles, ",")
 	trustDomains := make([]*common.TrustDomainConfig, len(domainPaths))
 	for i, path := range domainPaths {
 		tdString, err := ioutil.ReadFile(path)
 		if err != nil {
 			log.Printf("Could not read %s!\n", path)
-			return
+			return nil
 		}
 		trustDomains[i] = new(common.TrustDomainConfig)
 		if err := json.Unmarshal(tdString, trustDomains[i]); err != nil {
 			log.Printf("Could not parse %s: %v\n", path, err)
-			return
+			return nil
 		}
 	}
+	return trustDomains
+}
+
+// update/create client configuration with an explicit set of server trust domains.
+func clientUtil(infile string, outfile string, trustfiles string) {
+	trustDomains := loadTrustDomains(trustfiles)
+	if trustDomains == nil {
+		return
+	}
 
 	clientconf := libtalek.ClientConfig{
 		ReadInterval:  time.Second,
@@ -244,3 +319,51 @@ func clientUtil(infile string, outfile string, trustfiles string) {
 		return
 	}
 }
+
+// create an unsigned config bundle of a common configuration and trust domains.
+func bundleUtil(incommon string, outfile string, trustfiles string) {
+	config := common.ConfigFromFile(incommon)
+	if config == nil {
+		fmt.Printf("Could not load common configuration %s\n", incommon)
+		return
+	}
+	trustDomains := loadTrustDomains(trustfiles)
+	if trustDomains == nil {
+		return
+	}
+	writeBundle(common.NewConfigBundle(config, trustDomains), outfile)
+}
+
+// add the signature of a trust domain to a config bundle.
+func signUtil(bundlefile string, infile string, index int, outfile string) {
+	bundle, err := common.ConfigBundleFromFile(bundlefile)
+	if err != nil {
+		fmt.Printf("Could not load bundle: %v\n", err)
+		return
+	}
+	var sc server.Config
+	dat, err := ioutil.ReadFile(infile)
+	if err == nil {
+		err = json.Unmarshal(dat, &sc)
+	}
+	if err != nil || sc.TrustDomain == nil {
+		fmt.Printf("Could not load private trust domain from %s: %v\n", infile, err)
+		return
+	}
+	if err := bundle.Sign(index, sc.TrustDomain); err != nil {
+		fmt.Printf("Could not sign bundle: %v\n", err)
+		return
+	}
+	writeBundle(bundle, outfile)
+}
+
+func writeBundle(bundle *common.ConfigBundle, outfile string) {
+	dat, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to export bundle: %v\n", err)
+		return
+	}
+	if err = ioutil.WriteFile(outfile, dat, 0644); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", outfile, err)
+	}
+}
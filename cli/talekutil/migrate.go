@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/privacylab/talek/common"
+)
+
+// migrateUtil moves the replica of a trust domain to the replica at to, which
+// must have joined the trust domain from it, and waits for the frontend to
+// cut over.
+func migrateUtil(frontend string, index int, to string) {
+	if to == "" {
+		fmt.Println("migrate needs the address of the new replica, --to.")
+		os.Exit(1)
+	}
+	rpc := common.NewFrontendRPC("talekutil", frontend)
+	defer rpc.Close()
+
+	var reply common.MigrateReply
+	if err := rpc.Migrate(&common.MigrateArgs{TrustDomain: index, Address: to}, &reply); err != nil {
+		fmt.Printf("Could not reach frontend: %v\n", err)
+		os.Exit(1)
+	}
+	if reply.Err != "" {
+		fmt.Printf("Migration failed: %s\n", reply.Err)
+		os.Exit(1)
+	}
+	fmt.Printf("Trust domain %d is served by %s from epoch %d.\n", index, to, reply.Epoch)
+}
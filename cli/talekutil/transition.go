@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/privacylab/talek/common"
+)
+
+// transitionUtil stages a transition to the common configuration of
+// commonfile at the frontend, following on from the generation it uses.
+func transitionUtil(commonfile string, frontend string, epoch uint64, crossover uint64) {
+	next := common.ConfigFromFile(commonfile)
+	if next == nil {
+		fmt.Printf("Could not load common configuration %s.\n", commonfile)
+		os.Exit(1)
+	}
+	rpc := common.NewFrontendRPC("talekutil", frontend)
+	defer rpc.Close()
+
+	var stats common.FrontendStats
+	if err := rpc.GetStats(nil, &stats); err != nil {
+		fmt.Printf("Could not reach frontend: %v\n", err)
+		os.Exit(1)
+	}
+	if epoch == 0 {
+		// Far enough ahead for clients fetching updates every InterestMultiple
+		// epochs to learn of it.
+		epoch = stats.Epoch + 2*next.InterestMultiple + 1
+	}
+	t := &common.ConfigTransition{
+		Generation: stats.Generation + 1,
+		Epoch:      epoch,
+		Crossover:  crossover,
+		Next:       *next,
+	}
+	var reply common.TransitionReply
+	if err := rpc.StageTransition(t, &reply); err != nil {
+		fmt.Printf("Could not stage transition: %v\n", err)
+		os.Exit(1)
+	}
+	if reply.Err != "" {
+		fmt.Printf("Frontend refused transition: %s\n", reply.Err)
+		os.Exit(1)
+	}
+	fmt.Printf("Staged %v, now in epoch %d.\n", t, stats.Epoch)
+}
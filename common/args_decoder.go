@@ -0,0 +1,569 @@
+package common
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+/**
+ * Streaming decoders of the writes and reads clients send frontends, which
+ * parse fully untrusted input. Each field is bounded as its encoding is read,
+ * and refused past its limit before memory is allocated for it.
+ */
+
+// ArgsVersion is the version of the encoding of the writes and reads clients
+// send. Args may name it in a Version field; those naming any other are
+// refused.
+const ArgsVersion = 1
+
+// ErrArgsVersion refuses args of an encoding this version doesn't know.
+var ErrArgsVersion = errors.New("args of an unknown version")
+
+// maxArgsToken bounds the JSON tokens whose length no limit sets otherwise:
+// keys, times, methods and RPC IDs.
+const maxArgsToken = 64
+
+// ArgsLimits bound the fields of the writes and reads a frontend parses.
+type ArgsLimits struct {
+	DataSize      int // Of a write
+	SealedPirArgs int // Of each trust domain of a read
+}
+
+// NewArgsLimits returns the limits of the args a configuration accepts: those
+// of its largest size class.
+func NewArgsLimits(conf *Config) ArgsLimits {
+	var l ArgsLimits
+	l.Widen(conf)
+	return l
+}
+
+// Widen raises the limits to also accept the args of a configuration.
+func (l *ArgsLimits) Widen(conf *Config) {
+	for i := 0; i < conf.NumClasses(); i++ {
+		class, err := conf.Class(uint8(i))
+		if err != nil {
+			continue
+		}
+		size := int(maxBatchFrame)
+		if class.DataSize < uint64(size) {
+			size = int(class.DataSize)
+		}
+		if size > l.DataSize {
+			l.DataSize = size
+		}
+		if sealed := maxSealedPirArgs(class); sealed > l.SealedPirArgs {
+			l.SealedPirArgs = sealed
+		}
+	}
+}
+
+// rpcOverhead bounds what an RPC of a client holds besides the data of a
+// write or the PIR args of a read: its method and ID, and the other fields.
+const rpcOverhead = 4096
+
+// MaxRPCSize bounds the body of an RPC a client sends a frontend accepting
+// args within the limits, after decompression: the larger of a write of the
+// largest data, and a read for as many trust domains as a read may be for.
+func (l ArgsLimits) MaxRPCSize() int64 {
+	encoded := base64.StdEncoding.EncodedLen
+	write := encoded(l.DataSize) + encoded(MaxInterestVectorSize) + encoded(MaxPuzzleSeed)
+	read := MaxTrustDomains * (encoded(l.SealedPirArgs) + len(`"",`))
+	if read > write {
+		write = read
+	}
+	return int64(write + rpcOverhead)
+}
+
+// DecodeWriteArgs parses the JSON encoding of a write from r. Fields past
+// limits, fields WriteArgs lacks, and a version other than ArgsVersion are
+// refused.
+func DecodeWriteArgs(r io.Reader, limits ArgsLimits, args *WriteArgs) error {
+	return newArgsScanner(r).writeArgs(limits, args)
+}
+
+// DecodeReadArgs parses the JSON encoding of a read from r. Fields past
+// limits, fields EncodedReadArgs lacks, and a version other than ArgsVersion
+// are refused.
+func DecodeReadArgs(r io.Reader, limits ArgsLimits, args *EncodedReadArgs) error {
+	return newArgsScanner(r).readArgs(limits, args)
+}
+
+// errRPCMethodRead stops ReadRPCMethod at the method of a request.
+var errRPCMethodRead = errors.New("method read")
+
+// ReadRPCMethod returns the method of a JSON-RPC request, which must precede
+// its params, as clients write it.
+func ReadRPCMethod(r io.Reader) (string, error) {
+	s := newArgsScanner(r)
+	var method []byte
+	err := s.object("request", func(key string) (err error) {
+		switch key {
+		case "id":
+			_, err = s.id()
+			return err
+		case "method":
+			if method, err = s.string("method", maxArgsToken); err == nil {
+				err = errRPCMethodRead
+			}
+			return err
+		}
+		return invalid("request", "%s before the method", key)
+	})
+	if err == errRPCMethodRead {
+		return string(method), nil
+	} else if err == nil {
+		err = invalid("request", "no method")
+	}
+	return "", err
+}
+
+// DecodeWriteRPC parses a JSON-RPC request for a write, whose method must
+// precede its params, as clients write it. The write is parsed as
+// DecodeWriteArgs does, and the raw ID of the request returned.
+func DecodeWriteRPC(r io.Reader, limits ArgsLimits, args *WriteArgs) (json.RawMessage, error) {
+	s := newArgsScanner(r)
+	return s.rpc(func() error {
+		return s.writeArgs(limits, args)
+	})
+}
+
+// DecodeReadRPC parses a JSON-RPC request for a read, as DecodeWriteRPC does
+// one for a write.
+func DecodeReadRPC(r io.Reader, limits ArgsLimits, args *EncodedReadArgs) (json.RawMessage, error) {
+	s := newArgsScanner(r)
+	return s.rpc(func() error {
+		return s.readArgs(limits, args)
+	})
+}
+
+/** PRIVATE METHODS **/
+
+// argsScanner reads JSON a byte at a time, holding nothing of it but the
+// value being parsed.
+type argsScanner struct {
+	r *bufio.Reader
+}
+
+func newArgsScanner(r io.Reader) *argsScanner {
+	return &argsScanner{bufio.NewReader(r)}
+}
+
+func (s *argsScanner) writeArgs(limits ArgsLimits, args *WriteArgs) error {
+	return s.object("write", func(key string) error {
+		switch key {
+		case "bucket1":
+			return s.uint64("bucket1", &args.Bucket1)
+		case "bucket2":
+			return s.uint64("bucket2", &args.Bucket2)
+		case "data":
+			return s.bytes("data", limits.DataSize, &args.Data)
+		case "interestvector":
+			return s.bytes("interest vector", MaxInterestVectorSize, &args.InterestVector)
+		case "ttl":
+			return s.uint64("ttl", &args.TTL)
+		case "broadcastkey":
+			return s.bytes("broadcast key", ed25519.PublicKeySize, &args.BroadcastKey)
+		case "broadcastseqno":
+			return s.uint64("broadcast seqno", &args.BroadcastSeqNo)
+		case "priority":
+			return s.uint8("priority", &args.Priority)
+		case "deadline":
+			return s.time("deadline", &args.Deadline)
+		case "idempotencykey":
+			return s.uint64("idempotency key", &args.IdempotencyKey)
+		case "puzzleseed":
+			return s.bytes("puzzle seed", MaxPuzzleSeed, &args.PuzzleSeed)
+		case "puzzlenonce":
+			return s.uint64("puzzle nonce", &args.PuzzleNonce)
+		case "token":
+			return s.token(&args.Token)
+		case "generation":
+			return s.uint64("generation", &args.Generation)
+		case "class":
+			return s.uint8("class", &args.Class)
+		case "globalseqno":
+			return s.uint64("global seqno", &args.GlobalSeqNo)
+		case "version":
+			return s.version()
+		}
+		return invalid("write", "unknown field %q", key)
+	})
+}
+
+func (s *argsScanner) readArgs(limits ArgsLimits, args *EncodedReadArgs) error {
+	return s.object("read", func(key string) error {
+		switch key {
+		case "clientkey":
+			return s.byteArray("client key", args.ClientKey[:])
+		case "nonce":
+			return s.byteArray("nonce", args.Nonce[:])
+		case "pirargs":
+			args.PirArgs = nil
+			if null, err := s.null(); null || err != nil {
+				return err
+			}
+			args.PirArgs = [][]byte{}
+			return s.array("read", MaxTrustDomains, func() error {
+				var sealed []byte
+				if err := s.bytes("read", limits.SealedPirArgs, &sealed); err != nil {
+					return err
+				}
+				args.PirArgs = append(args.PirArgs, sealed)
+				return nil
+			})
+		case "deadline":
+			return s.time("deadline", &args.Deadline)
+		case "idempotencykey":
+			return s.uint64("idempotency key", &args.IdempotencyKey)
+		case "generation":
+			return s.uint64("generation", &args.Generation)
+		case "class":
+			return s.uint8("class", &args.Class)
+		case "tier":
+			return s.uint8("tier", &args.Tier)
+		case "version":
+			return s.version()
+		}
+		return invalid("read", "unknown field %q", key)
+	})
+}
+
+func (s *argsScanner) token(token **Token) error {
+	*token = nil
+	if null, err := s.null(); null || err != nil {
+		return err
+	}
+	t := &Token{}
+	*token = t
+	return s.object("token", func(key string) error {
+		switch key {
+		case "keyid":
+			return s.byteArray("token", t.KeyID[:])
+		case "nonce":
+			return s.byteArray("token", t.Nonce[:])
+		case "signature":
+			return s.bytes("token", TokenKeyBits/8, &t.Signature)
+		}
+		return invalid("token", "unknown field %q", key)
+	})
+}
+
+func (s *argsScanner) version() error {
+	var v uint64
+	if err := s.uint64("version", &v); err != nil {
+		return err
+	}
+	if v != ArgsVersion {
+		return ErrArgsVersion
+	}
+	return nil
+}
+
+// rpc parses a JSON-RPC request whose single param params parses.
+func (s *argsScanner) rpc(params func() error) (json.RawMessage, error) {
+	id := json.RawMessage("null")
+	method, decoded := false, false
+	err := s.object("request", func(key string) (err error) {
+		switch key {
+		case "id":
+			id, err = s.id()
+			return err
+		case "method":
+			method = true
+			_, err = s.string("method", maxArgsToken)
+			return err
+		case "params":
+			if !method {
+				return invalid("request", "params before the method")
+			}
+			return s.array("params", 1, func() error {
+				decoded = true
+				return params()
+			})
+		}
+		return invalid("request", "unknown field %q", key)
+	})
+	if err == nil && !decoded {
+		err = invalid("params", "no param")
+	}
+	return id, err
+}
+
+// id reads the ID of an RPC: a number, a string or null.
+func (s *argsScanner) id() (json.RawMessage, error) {
+	b, err := s.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b == 'n':
+		return json.RawMessage("null"), s.literal("null")
+	case b == '"':
+		id, err := s.string("id", maxArgsToken)
+		return json.RawMessage(strconv.Quote(string(id))), err
+	}
+	var id uint64
+	err = s.uint64("id", &id)
+	return json.RawMessage(strconv.FormatUint(id, 10)), err
+}
+
+// object reads a JSON object, passing the key of each member to member, which
+// reads its value. Keys are matched without regard to case, as encoding/json
+// matches them, and are refused if repeated.
+func (s *argsScanner) object(field string, member func(key string) error) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	if b, err := s.peek(); err != nil {
+		return err
+	} else if b == '}' {
+		s.r.ReadByte()
+		return nil
+	}
+	seen := make(map[string]bool)
+	for {
+		k, err := s.string(field, maxArgsToken)
+		if err != nil {
+			return err
+		}
+		key := strings.ToLower(string(k))
+		if seen[key] {
+			return invalid(field, "repeated field %q", k)
+		}
+		seen[key] = true
+		if err = s.expect(':'); err != nil {
+			return err
+		}
+		if err = member(key); err != nil {
+			return err
+		}
+		b, err := s.skip()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case '}':
+			return nil
+		case ',':
+		default:
+			return fmt.Errorf("unexpected %q in %s", b, field)
+		}
+	}
+}
+
+// array reads a JSON array of at most max elements, each read by elem.
+func (s *argsScanner) array(field string, max int, elem func() error) error {
+	if err := s.expect('['); err != nil {
+		return err
+	}
+	if b, err := s.peek(); err != nil {
+		return err
+	} else if b == ']' {
+		s.r.ReadByte()
+		return nil
+	}
+	for i := 0; ; i++ {
+		if i == max {
+			return invalid(field, "more than %d elements", max)
+		}
+		if err := elem(); err != nil {
+			return err
+		}
+		b, err := s.skip()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case ']':
+			return nil
+		case ',':
+		default:
+			return fmt.Errorf("unexpected %q in %s", b, field)
+		}
+	}
+}
+
+// byteArray reads a fixed size array of bytes, which encoding/json encodes as
+// an array of numbers, into dst. Arrays of any other length are refused.
+func (s *argsScanner) byteArray(field string, dst []byte) error {
+	n := 0
+	err := s.array(field, len(dst), func() error {
+		n++
+		return s.uint8(field, &dst[n-1])
+	})
+	if err == nil && n != len(dst) {
+		err = invalid(field, "%d bytes rather than %d", n, len(dst))
+	}
+	return err
+}
+
+// bytes reads a byte slice, which encoding/json encodes in base64, of at most
+// max bytes. Its length is checked against the length of its encoding, before
+// any memory is allocated for it.
+func (s *argsScanner) bytes(field string, max int, dst *[]byte) error {
+	*dst = nil
+	if null, err := s.null(); null || err != nil {
+		return err
+	}
+	enc, err := s.string(field, base64.StdEncoding.EncodedLen(max))
+	if err != nil {
+		return err
+	}
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+	n, err := base64.StdEncoding.Decode(b, enc)
+	if err != nil {
+		return invalid(field, "%v", err)
+	} else if n > max {
+		return invalid(field, "%d bytes exceed %d", n, max)
+	}
+	*dst = b[:n]
+	return nil
+}
+
+// string reads a JSON string of at most max bytes. Nothing clients send holds
+// characters encoding/json escapes, so escapes are refused.
+func (s *argsScanner) string(field string, max int) ([]byte, error) {
+	if err := s.expect('"'); err != nil {
+		return nil, err
+	}
+	var b []byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch {
+		case c == '"':
+			return b, nil
+		case c == '\\' || c < 0x20:
+			return nil, invalid(field, "escaped or control character")
+		case len(b) == max:
+			return nil, invalid(field, "more than %d bytes", max)
+		}
+		b = append(b, c)
+	}
+}
+
+func (s *argsScanner) time(field string, dst *time.Time) error {
+	b, err := s.string(field, maxArgsToken)
+	if err != nil {
+		return err
+	}
+	if *dst, err = time.Parse(time.RFC3339, string(b)); err != nil {
+		return invalid(field, "%v", err)
+	}
+	return nil
+}
+
+func (s *argsScanner) uint8(field string, dst *uint8) error {
+	x, err := s.uint(field, 8)
+	*dst = uint8(x)
+	return err
+}
+
+func (s *argsScanner) uint64(field string, dst *uint64) error {
+	x, err := s.uint(field, 64)
+	*dst = x
+	return err
+}
+
+// uint reads an unsigned JSON integer of at most bits bits.
+func (s *argsScanner) uint(field string, bits int) (uint64, error) {
+	var digits [20]byte
+	n := 0
+	b, err := s.skip()
+	for err == nil && b >= '0' && b <= '9' {
+		if n == len(digits) {
+			return 0, invalid(field, "more than %d digits", len(digits))
+		}
+		digits[n] = b
+		n++
+		b, err = s.r.ReadByte()
+	}
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	s.r.UnreadByte()
+	if n > 1 && digits[0] == '0' {
+		return 0, invalid(field, "leading zero")
+	}
+	x, err := strconv.ParseUint(string(digits[:n]), 10, bits)
+	if err != nil {
+		return 0, invalid(field, "not an integer of %d bits", bits)
+	}
+	return x, nil
+}
+
+// null reads a JSON null, if one is next, and reports whether it was.
+func (s *argsScanner) null() (bool, error) {
+	b, err := s.peek()
+	if err != nil || b != 'n' {
+		return false, err
+	}
+	return true, s.literal("null")
+}
+
+func (s *argsScanner) literal(word string) error {
+	for i := 0; i < len(word); i++ {
+		b, err := s.next()
+		if err != nil {
+			return err
+		} else if b != word[i] {
+			return fmt.Errorf("expected %q", word)
+		}
+	}
+	return nil
+}
+
+// expect reads the byte c, past whitespace.
+func (s *argsScanner) expect(c byte) error {
+	b, err := s.skip()
+	if err == nil && b != c {
+		err = fmt.Errorf("expected %q rather than %q", c, b)
+	}
+	return err
+}
+
+// peek returns the next byte past whitespace, without reading it.
+func (s *argsScanner) peek() (byte, error) {
+	b, err := s.skip()
+	if err == nil {
+		s.r.UnreadByte()
+	}
+	return b, err
+}
+
+// skip reads the next byte past whitespace.
+func (s *argsScanner) skip() (byte, error) {
+	for {
+		b, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			return b, nil
+		}
+	}
+}
+
+// next reads the next byte, whitespace or not.
+func (s *argsScanner) next() (byte, error) {
+	b, err := s.r.ReadByte()
+	return b, unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
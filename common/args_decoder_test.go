@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeArgs(t *testing.T) {
+	limits := NewArgsLimits(&Config{NumBuckets: 100, DataSize: 32, Classes: [MaxSizeClasses - 1]SizeClass{{NumBuckets: 10, BucketDepth: 1, DataSize: 64}}})
+	if limits.DataSize != 64 || limits.SealedPirArgs != maxSealedPirArgs(&Config{NumBuckets: 100}) {
+		t.Fatalf("Limits of the largest class were not taken: %+v", limits)
+	}
+
+	write := &WriteArgs{Bucket1: 3, Bucket2: 1 << 40, Data: bytes.Repeat([]byte{5}, 64), InterestVector: []byte{1, 2},
+		Priority: WriteBulk, Deadline: time.Now().Round(0), IdempotencyKey: 9, PuzzleSeed: []byte{3},
+		Token: &Token{KeyID: [8]byte{1}, Nonce: [32]byte{2}, Signature: []byte{3}}, Class: 1}
+	encoded, _ := json.Marshal(write)
+	var decoded WriteArgs
+	if err := DecodeWriteArgs(bytes.NewReader(encoded), limits, &decoded); err != nil {
+		t.Fatalf("Valid write refused: %v", err)
+	}
+	if again, _ := json.Marshal(&decoded); !bytes.Equal(again, encoded) {
+		t.Fatalf("Write decoded as %s.", again)
+	}
+
+	read := &EncodedReadArgs{ClientKey: [32]byte{1}, Nonce: [24]byte{2}, PirArgs: [][]byte{{3}, {4, 5}}, IdempotencyKey: 6, Tier: TierHot}
+	encoded, _ = json.Marshal(read)
+	var decodedRead EncodedReadArgs
+	if err := DecodeReadArgs(bytes.NewReader(encoded), limits, &decodedRead); err != nil {
+		t.Fatalf("Valid read refused: %v", err)
+	}
+	if again, _ := json.Marshal(&decodedRead); !bytes.Equal(again, encoded) {
+		t.Fatalf("Read decoded as %s.", again)
+	}
+
+	for _, w := range []string{
+		`{"Data":"` + strings.Repeat("A", 100) + `"}`,
+		`{"Bucket1":1,"Secret":2}`,
+		`{"Bucket1":1,"bucket1":2}`,
+		`{"Bucket1":18446744073709551616}`,
+		`{"Priority":256}`,
+		`{"Token":{"KeyID":[1,2,3]}}`,
+		`{"Bucket1":1`,
+	} {
+		if err := DecodeWriteArgs(strings.NewReader(w), limits, &WriteArgs{}); err == nil {
+			t.Fatalf("Invalid write %s was decoded.", w)
+		}
+	}
+	if err := DecodeWriteArgs(strings.NewReader(`{"Version":1,"Bucket1":1}`), limits, &WriteArgs{}); err != nil {
+		t.Fatalf("Write of this version refused: %v", err)
+	}
+	if err := DecodeWriteArgs(strings.NewReader(`{"Version":2,"Bucket1":1}`), limits, &WriteArgs{}); err != ErrArgsVersion {
+		t.Fatalf("Write of an unknown version was not refused: %v", err)
+	}
+	largest := &EncodedReadArgs{PirArgs: make([][]byte, MaxTrustDomains)}
+	for i := range largest.PirArgs {
+		largest.PirArgs[i] = make([]byte, limits.SealedPirArgs)
+	}
+	encoded, _ = json.Marshal(map[string]interface{}{"method": "Frontend.Read", "params": []interface{}{largest}, "id": 1})
+	if size := limits.MaxRPCSize(); int64(len(encoded)) > size || size >= maxBatchFrame {
+		t.Fatalf("RPCs of clients are bounded by %d bytes, of %d for the largest read.", size, len(encoded))
+	}
+	tooMany := `{"PirArgs":[` + strings.Repeat(`"AA==",`, MaxTrustDomains) + `"AA=="]}`
+	if err := DecodeReadArgs(strings.NewReader(tooMany), limits, &EncodedReadArgs{}); err == nil {
+		t.Fatal("Read for too many trust domains was decoded.")
+	}
+}
+
+func TestDecodeArgsRPC(t *testing.T) {
+	limits := NewArgsLimits(&Config{NumBuckets: 100, DataSize: 32})
+	request := `{"method":"Frontend.Write","params":[{"Bucket1":4}],"id":7}`
+	if method, err := ReadRPCMethod(strings.NewReader(request)); err != nil || method != "Frontend.Write" {
+		t.Fatalf("Method read as %q: %v", method, err)
+	}
+	var args WriteArgs
+	id, err := DecodeWriteRPC(strings.NewReader(request), limits, &args)
+	if err != nil || string(id) != "7" || args.Bucket1 != 4 {
+		t.Fatalf("Request decoded as %s, %+v: %v", id, args, err)
+	}
+	if id, err = DecodeWriteRPC(strings.NewReader(`{"id":"a","method":"Frontend.Write","params":[{}]}`), limits, &args); err != nil || string(id) != `"a"` {
+		t.Fatalf("Request with its ID first decoded as %s: %v", id, err)
+	}
+	for _, r := range []string{
+		`{"params":[{}],"method":"Frontend.Write","id":7}`,
+		`{"method":"Frontend.Write","params":[],"id":7}`,
+		`{"method":"Frontend.Write","params":[{},{}],"id":7}`,
+		`{"method":"Frontend.Write","params":[{}],"id":7,"extra":1}`,
+	} {
+		if _, err := DecodeWriteRPC(strings.NewReader(r), limits, &WriteArgs{}); err == nil {
+			t.Fatalf("Invalid request %s was decoded.", r)
+		}
+	}
+}
+
+func TestDecodePirArgs(t *testing.T) {
+	seed := bytes.Repeat([]byte{9}, 16)
+	encoded, _ := appendPirArgsGob(nil, 300, seed, func(vector []byte) error {
+		vector[299] = 1
+		return nil
+	})
+	args, err := decodePirArgs(encoded)
+	if err != nil || len(args.RequestVector) != 300 || args.RequestVector[299] != 1 || !bytes.Equal(args.PadSeed, seed) {
+		t.Fatalf("PIR args decoded as %+v: %v", args, err)
+	}
+
+	if _, err = decodePirArgs(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("Truncated PIR args were decoded.")
+	}
+	other := append([]byte(nil), encoded...)
+	other[len(pirArgsType)-1]++
+	if _, err = decodePirArgs(other); err != ErrArgsVersion {
+		t.Fatalf("PIR args of another type were not refused: %v", err)
+	}
+	// A third field, as a later version might add.
+	n, size := readGobUint(encoded[len(pirArgsType):])
+	other = appendGobUint(append([]byte(nil), pirArgsType...), n+3)
+	other = append(append(other, encoded[len(pirArgsType)+size:len(encoded)-1]...), 1, 1, 7, 0)
+	if _, err = decodePirArgs(other); err != ErrArgsVersion {
+		t.Fatalf("PIR args with an unknown field were not refused: %v", err)
+	}
+}
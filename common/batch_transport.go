@@ -0,0 +1,518 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The batch transport carries BatchRead calls between frontend and replicas
+// in a binary framing, rather than as JSON RPCs, whose encoding of request
+// vectors and reply data dominates the latency of large batches. Each frame is
+// a uint64 length followed by that many bytes, on a persistent connection
+// carrying one call at a time. Byte slices are written directly from the
+// caller's buffers with vectored writes, and read as slices of the frame.
+//
+// A connection opens with the client sending a frame listing the codecs it
+// offers, and the server answering with a frame naming the one it picked.
+// Frames compressed with it have the top bit of their length set.
+//
+// The transport runs over any stream transport, TCP or a unix socket between
+// frontend and replicas in a datacenter. Over TCP on Linux, frames of at least
+// zeroCopyThreshold bytes are also sent without the kernel copying them, with
+// MSG_ZEROCOPY. RDMA, which the Go runtime reaches only through cgo and the
+// verbs libraries, is not used.
+
+// maxBatchFrame bounds the size of any frame, as a replica answers reads of
+// any size the frontend configures.
+const maxBatchFrame = 1 << 30
+
+// batchFrameSlack is the room left in a frame, beyond the args or buckets of
+// its reads, for errors and the aborted writes of sequence number ranges.
+const batchFrameSlack = 1 << 20
+
+// MaxBatchFrame bounds the frames of a batch of reads of any size class of a
+// configuration: the request carrying the args of each read, and the reply
+// carrying the bucket read for each.
+func MaxBatchFrame(conf *Config, batch int) uint64 {
+	var largest uint64
+	for i := 0; i < conf.NumClasses(); i++ {
+		class, err := conf.Class(uint8(i))
+		if err != nil {
+			continue
+		}
+		// ClientKey, Nonce, the count of PirArgs and Deadline, and each
+		// PirArgs with its length.
+		request := uint64(8+32+8+24+8+8) + MaxTrustDomains*uint64(8+maxSealedPirArgs(class))
+		// The bucket read, its length, and the fixed fields of the reply.
+		reply := 8 + class.BucketDepth*class.DataSize + 8*8 + MaxTrustDomains*8
+		if request > largest {
+			largest = request
+		}
+		if reply > largest {
+			largest = reply
+		}
+	}
+	limit := uint64(batch)*largest + batchFrameSlack
+	if limit > maxBatchFrame {
+		return maxBatchFrame
+	}
+	return limit
+}
+
+// compressedFrame flags the length of a frame compressed with the codec of its
+// connection.
+const compressedFrame = 1 << 63
+
+// Frames shorter than this are copied into the socket's buffers, as pinning
+// their pages costs more than copying them.
+const zeroCopyThreshold = 1 << 15
+
+// Slices shorter than this are copied into the frame's header buffers rather
+// than written separately.
+const batchCopyThreshold = 512
+
+var errBatchFrame = errors.New("malformed batch frame")
+
+// BatchClient makes BatchRead calls over a pool of persistent batch transport
+// connections to a replica.
+type BatchClient struct {
+	via     Transport
+	address string
+	timeout time.Duration
+	offer   atomic.Value // []Compression offered to the server
+	conns   chan *batchConn
+}
+
+// batchConn is a connection with the codec negotiated for it.
+type batchConn struct {
+	net.Conn
+	codec Compression
+	// zeroCopy sends large frames with MSG_ZEROCOPY, nil where that isn't
+	// supported or pays off.
+	zeroCopy *zeroCopy
+}
+
+// NewBatchClient creates a client of the batch listener at address, holding up
+// to size connections open. An address starting with "/" is a unix socket,
+// and one of "name:address" is reached over a registered transport. Requests
+// are sent with MSG_ZEROCOPY where it is supported.
+func NewBatchClient(address string, size int, timeout time.Duration) *BatchClient {
+	c := &BatchClient{}
+	c.via, c.address = ResolveAddress(address)
+	c.timeout = timeout
+	c.conns = make(chan *batchConn, size)
+	c.offer.Store(SupportedCompression)
+	return c
+}
+
+// SetCompression changes the codecs offered to the server, most preferred
+// first, for connections opened after.
+func (c *BatchClient) SetCompression(offer []Compression) {
+	c.offer.Store(offer)
+}
+
+// BatchRead performs a set of PIR reads, abandoning them at their deadline.
+func (c *BatchClient) BatchRead(args *BatchReadRequest, reply *BatchReadReply) error {
+	if Expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	var conn *batchConn
+	select {
+	case conn = <-c.conns:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return err
+		}
+	}
+
+	var w batchWriter
+	w.request(args)
+	err := conn.SetDeadline(args.Deadline)
+	if err == nil {
+		err = w.writeTo(conn)
+	}
+	if err == nil {
+		var frame []byte
+		if frame, err = readBatchFrame(conn, conn.codec, maxBatchFrame); err == nil {
+			err = decodeBatchReply(frame, reply)
+		}
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		// The connection may be part way through a frame.
+		conn.Close()
+		return err
+	}
+
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return nil
+}
+
+// dial opens a connection, negotiating its codec.
+func (c *BatchClient) dial() (*batchConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	conn, err := c.via.Dial(ctx, c.address)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var frame []byte
+	err = conn.SetDeadline(time.Now().Add(c.timeout))
+	if err == nil {
+		err = writeRawFrame(conn, []byte(JoinCompression(c.offer.Load().([]Compression))))
+	}
+	if err == nil {
+		frame, err = readBatchFrame(conn, CompressionNone, batchFrameSlack)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &batchConn{conn, Compression(frame), newZeroCopy(conn)}, nil
+}
+
+// Close closes the idle connections of the client.
+func (c *BatchClient) Close() {
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// ServeBatches answers BatchRead calls on a batch transport connection with
+// reader, until the connection closes. Its codec is the first of accept the
+// client offers. Requests are refused beyond limit bytes, as of MaxBatchFrame
+// for the batches the server is configured for. With zeroCopy, replies are
+// sent with MSG_ZEROCOPY where it is supported.
+func ServeBatches(conn net.Conn, accept []Compression, zeroCopy bool, limit func() uint64, reader func(*BatchReadRequest, *BatchReadReply) error) error {
+	defer conn.Close()
+	offer, err := readBatchFrame(conn, CompressionNone, batchFrameSlack)
+	if err != nil {
+		return err
+	}
+	// Codecs this server doesn't know are ignored, rather than refused.
+	var offered []Compression
+	for _, name := range strings.Split(string(offer), ",") {
+		offered = append(offered, Compression(name))
+	}
+	bc := &batchConn{Conn: conn, codec: NegotiateCompression(accept, offered)}
+	if err = writeRawFrame(conn, []byte(bc.codec)); err != nil {
+		return err
+	}
+	if zeroCopy {
+		bc.zeroCopy = newZeroCopy(conn)
+	}
+
+	for {
+		frame, err := readBatchFrame(conn, bc.codec, limit())
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		reply := &BatchReadReply{}
+		args := &BatchReadRequest{}
+		if err = decodeBatchRequest(frame, args); err != nil {
+			return err
+		}
+		if err = reader(args, reply); err != nil && reply.Err == "" {
+			reply.Err = err.Error()
+		}
+
+		var w batchWriter
+		w.reply(reply)
+		if err = w.writeTo(bc); err != nil {
+			return err
+		}
+	}
+}
+
+// readBatchFrame reads a frame of at most limit bytes, decompressing it with
+// codec if it is flagged as compressed.
+func readBatchFrame(r io.Reader, codec Compression, limit uint64) ([]byte, error) {
+	var length [8]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint64(length[:])
+	compressed := n&compressedFrame != 0
+	n &^= compressedFrame
+	if n > limit {
+		return nil, fmt.Errorf("batch frame of %d bytes exceeds %d", n, limit)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return frame, nil
+	}
+	if codec == CompressionNone {
+		return nil, errBatchFrame
+	}
+	return codec.Decompress(bytes.NewReader(frame), int64(limit))
+}
+
+// writeRawFrame writes a frame of a single byte slice.
+func writeRawFrame(w io.Writer, frame []byte) error {
+	bufs := make(net.Buffers, 2)
+	bufs[0] = make([]byte, 8)
+	binary.LittleEndian.PutUint64(bufs[0], uint64(len(frame)))
+	bufs[1] = frame
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// batchWriter builds a frame as a list of buffers, referencing large slices
+// rather than copying them.
+type batchWriter struct {
+	bufs net.Buffers
+	cur  []byte
+	size uint64
+}
+
+func (w *batchWriter) u64(v uint64) {
+	w.cur = append(w.cur, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(w.cur[len(w.cur)-8:], v)
+	w.size += 8
+}
+
+func (w *batchWriter) bytes(b []byte) {
+	w.u64(uint64(len(b)))
+	w.size += uint64(len(b))
+	if len(b) < batchCopyThreshold {
+		w.cur = append(w.cur, b...)
+		return
+	}
+	w.bufs = append(w.bufs, w.cur, b)
+	w.cur = nil
+}
+
+// time writes a time as nanoseconds since the unix epoch, or 0 for the zero
+// time.
+func (w *batchWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.u64(0)
+		return
+	}
+	w.u64(uint64(t.UnixNano()))
+}
+
+func (w *batchWriter) rng(r *Range) {
+	w.u64(r.Start)
+	w.u64(r.End)
+	w.u64(uint64(len(r.Aborted)))
+	for _, a := range r.Aborted {
+		w.u64(a)
+	}
+}
+
+// finish prefixes the frame with its length.
+func (w *batchWriter) finish() {
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], w.size)
+	w.bufs = append(append(net.Buffers{length[:]}, w.bufs...), w.cur)
+	w.cur = nil
+}
+
+// writeTo writes the frame, compressing it with the codec of conn if that
+// makes it smaller. The zero-copy buffers are then given up for a compressed
+// copy. Large frames are sent with MSG_ZEROCOPY on connections supporting it,
+// until the kernel notes it copies them anyway.
+func (w *batchWriter) writeTo(conn *batchConn) error {
+	size := w.size
+	if conn.codec != CompressionNone {
+		payload := make([]byte, 0, w.size)
+		for _, b := range w.bufs[1:] {
+			payload = append(payload, b...)
+		}
+		compressed, encoding := conn.codec.Compress(payload)
+		if encoding != CompressionNone && len(compressed) < len(payload) {
+			length := make([]byte, 8)
+			binary.LittleEndian.PutUint64(length, uint64(len(compressed))|compressedFrame)
+			w.bufs = net.Buffers{length, compressed}
+			size = uint64(len(compressed))
+		}
+	}
+	if conn.zeroCopy == nil || size < zeroCopyThreshold {
+		_, err := w.bufs.WriteTo(conn.Conn)
+		return err
+	}
+	err := conn.zeroCopy.write(conn.Conn, w.bufs)
+	if conn.zeroCopy.copied {
+		conn.zeroCopy = nil
+	}
+	return err
+}
+
+func (w *batchWriter) request(args *BatchReadRequest) {
+	w.rng(&args.SeqNoRange)
+	w.time(args.Deadline)
+	w.u64(args.Generation)
+	w.u64(uint64(args.Class))
+	w.u64(uint64(args.Tier))
+	w.u64(args.Epoch)
+	w.bytes(args.Signature[:])
+	w.u64(uint64(len(args.Args)))
+	for i := range args.Args {
+		a := &args.Args[i]
+		w.bytes(a.ClientKey[:])
+		w.bytes(a.Nonce[:])
+		w.u64(uint64(len(a.PirArgs)))
+		for _, p := range a.PirArgs {
+			w.bytes(p)
+		}
+		w.time(a.Deadline)
+	}
+	w.finish()
+}
+
+func (w *batchWriter) reply(reply *BatchReadReply) {
+	w.bytes([]byte(reply.Err))
+	w.u64(uint64(len(reply.Replies)))
+	for i := range reply.Replies {
+		r := &reply.Replies[i]
+		w.bytes([]byte(r.Err))
+		w.u64(uint64(len(r.FailedDomains)))
+		for _, d := range r.FailedDomains {
+			w.u64(uint64(d))
+		}
+		w.bytes(r.Data)
+		w.rng(&r.GlobalSeqNo)
+		w.u64(r.LastInterestSN)
+		w.u64(uint64(r.RetryAfter))
+	}
+	w.finish()
+}
+
+// batchReader decodes a frame. Byte slices are returned as slices of it.
+type batchReader struct {
+	frame []byte
+	err   error
+}
+
+func (r *batchReader) u64() uint64 {
+	if r.err != nil || len(r.frame) < 8 {
+		r.err = errBatchFrame
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.frame)
+	r.frame = r.frame[8:]
+	return v
+}
+
+// count reads the length of a list of items of at least min bytes each.
+func (r *batchReader) count(min int) int {
+	n := r.u64()
+	if r.err == nil && n > uint64(len(r.frame)/min) {
+		r.err = errBatchFrame
+		return 0
+	}
+	return int(n)
+}
+
+func (r *batchReader) bytes() []byte {
+	n := r.count(1)
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	b := r.frame[:n:n]
+	r.frame = r.frame[n:]
+	return b
+}
+
+func (r *batchReader) time() time.Time {
+	if n := r.u64(); n != 0 {
+		return time.Unix(0, int64(n))
+	}
+	return time.Time{}
+}
+
+func (r *batchReader) rng(out *Range) {
+	out.Start = r.u64()
+	out.End = r.u64()
+	if n := r.count(8); n > 0 {
+		out.Aborted = make([]uint64, n)
+		for i := range out.Aborted {
+			out.Aborted[i] = r.u64()
+		}
+	}
+}
+
+func decodeBatchRequest(frame []byte, args *BatchReadRequest) error {
+	r := &batchReader{frame: frame}
+	r.rng(&args.SeqNoRange)
+	args.Deadline = r.time()
+	args.Generation = r.u64()
+	args.Class = uint8(r.u64())
+	args.Tier = uint8(r.u64())
+	args.Epoch = r.u64()
+	if copy(args.Signature[:], r.bytes()) != len(args.Signature) {
+		r.err = errBatchFrame
+	}
+	args.Args = make([]EncodedReadArgs, r.count(8))
+	for i := range args.Args {
+		a := &args.Args[i]
+		if copy(a.ClientKey[:], r.bytes()) != len(a.ClientKey) || copy(a.Nonce[:], r.bytes()) != len(a.Nonce) {
+			r.err = errBatchFrame
+		}
+		if n := r.count(8); n > 0 {
+			a.PirArgs = make([][]byte, n)
+			for j := range a.PirArgs {
+				a.PirArgs[j] = r.bytes()
+			}
+		}
+		a.Deadline = r.time()
+		if r.err != nil {
+			break
+		}
+	}
+	return r.err
+}
+
+func decodeBatchReply(frame []byte, reply *BatchReadReply) error {
+	r := &batchReader{frame: frame}
+	reply.Err = string(r.bytes())
+	reply.Replies = make([]ReadReply, r.count(8))
+	for i := range reply.Replies {
+		rr := &reply.Replies[i]
+		rr.Err = string(r.bytes())
+		if n := r.count(8); n > 0 {
+			rr.FailedDomains = make([]int, n)
+			for j := range rr.FailedDomains {
+				rr.FailedDomains[j] = int(r.u64())
+			}
+		}
+		rr.Data = r.bytes()
+		r.rng(&rr.GlobalSeqNo)
+		rr.LastInterestSN = r.u64()
+		rr.RetryAfter = time.Duration(r.u64())
+		if r.err != nil {
+			break
+		}
+	}
+	return r.err
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBatch() *BatchReadRequest {
+	args := &BatchReadRequest{SeqNoRange: Range{Start: 3, End: 9, Aborted: []uint64{4, 7}}, Deadline: time.Unix(0, 4e18), Generation: 2, Class: 1, Tier: 1, Epoch: 5}
+	args.Args = make([]EncodedReadArgs, 3)
+	args.Args[0].ClientKey[0] = 1
+	args.Args[0].Nonce[23] = 2
+	args.Args[0].PirArgs = [][]byte{bytes.Repeat([]byte{5}, 2000), {6, 7}}
+	// args.Args[1] is a pad request, without PirArgs.
+	args.Args[2].PirArgs = [][]byte{{8}}
+	args.Args[2].Deadline = time.Unix(0, 4e18-1)
+	args.Signature[63] = 9
+	return args
+}
+
+func testBatchReply(args *BatchReadRequest) *BatchReadReply {
+	reply := &BatchReadReply{Replies: make([]ReadReply, len(args.Args))}
+	for i, a := range args.Args {
+		reply.Replies[i].Data = bytes.Repeat([]byte{byte(i)}, 1024)
+		reply.Replies[i].GlobalSeqNo = args.SeqNoRange
+		reply.Replies[i].LastInterestSN = uint64(len(a.PirArgs))
+	}
+	reply.Replies[1].Err = "padded"
+	reply.Replies[1].FailedDomains = []int{0, 2}
+	reply.Replies[1].RetryAfter = time.Second
+	return reply
+}
+
+func TestBatchCodec(t *testing.T) {
+	args := testBatch()
+	var w batchWriter
+	w.request(args)
+	var buf bytes.Buffer
+	w.bufs.WriteTo(&buf)
+	frame, err := readBatchFrame(&buf, CompressionNone, maxBatchFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &BatchReadRequest{}
+	if err = decodeBatchRequest(frame, decoded); err != nil || !reflect.DeepEqual(decoded, args) {
+		t.Fatalf("Request did not round trip: %+v, %v", decoded, err)
+	}
+
+	reply := testBatchReply(args)
+	w = batchWriter{}
+	w.reply(reply)
+	buf.Reset()
+	w.bufs.WriteTo(&buf)
+	if frame, err = readBatchFrame(&buf, CompressionNone, maxBatchFrame); err != nil {
+		t.Fatal(err)
+	}
+	decodedReply := &BatchReadReply{}
+	if err = decodeBatchReply(frame, decodedReply); err != nil || !reflect.DeepEqual(decodedReply, reply) {
+		t.Fatalf("Reply did not round trip: %+v, %v", decodedReply, err)
+	}
+
+	// Every truncation of a frame is malformed.
+	for i := 0; i < len(frame); i++ {
+		if err = decodeBatchReply(frame[:i], &BatchReadReply{}); err == nil {
+			t.Fatalf("Truncated frame of %d bytes decoded", i)
+		}
+	}
+}
+
+func TestBatchClient(t *testing.T) {
+	for _, accept := range [][]Compression{nil, {CompressionZstd, CompressionSnappy}} {
+		testBatchClient(t, accept)
+	}
+}
+
+func testBatchClient(t *testing.T, accept []Compression) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conns := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- struct{}{}
+			go ServeBatches(conn, accept, true, func() uint64 { return 1 << 16 }, func(args *BatchReadRequest, reply *BatchReadReply) error {
+				if len(args.Args) == 0 {
+					return errors.New("empty batch")
+				}
+				*reply = *testBatchReply(args)
+				return nil
+			})
+		}
+	}()
+
+	client := NewBatchClient(listener.Addr().String(), 1, time.Second)
+	client.SetCompression([]Compression{CompressionSnappy, CompressionZstd})
+	defer client.Close()
+	args := testBatch()
+	for i := 0; i < 5; i++ {
+		reply := &BatchReadReply{}
+		if err := client.BatchRead(args, reply); err != nil || !reflect.DeepEqual(reply, testBatchReply(args)) {
+			t.Fatalf("BatchRead failed: %+v, %v", reply, err)
+		}
+	}
+	reply := &BatchReadReply{}
+	if err := client.BatchRead(&BatchReadRequest{}, reply); err != nil || reply.Err != "empty batch" {
+		t.Fatalf("Error should be returned in the reply, got %q, %v", reply.Err, err)
+	}
+	if err := client.BatchRead(&BatchReadRequest{Deadline: time.Now().Add(-time.Second)}, reply); err != ErrDeadlineExceeded {
+		t.Fatalf("Expired batch should not be sent, got %v", err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("Calls should share one connection, made %d", len(conns))
+	}
+	oversized := testBatch()
+	oversized.Args[0].PirArgs[0] = make([]byte, 1<<17)
+	if err := client.BatchRead(oversized, &BatchReadReply{}); err == nil {
+		t.Fatal("Batch beyond the frame limit of the server was read.")
+	}
+	client.BatchRead(args, &BatchReadReply{})
+	conn := <-client.conns
+	if codec := NegotiateCompression(accept, SupportedCompression); conn.codec != codec {
+		t.Fatalf("Connection should use %s, negotiated %s", codec, conn.codec)
+	}
+	client.conns <- conn
+}
+
+func TestMaxBatchFrame(t *testing.T) {
+	conf := &Config{NumBuckets: 1024, BucketDepth: 4, DataSize: 1024}
+	one := MaxBatchFrame(conf, 1)
+	if one <= 4*1024 || MaxBatchFrame(conf, 8)-batchFrameSlack != 8*(one-batchFrameSlack) {
+		t.Fatalf("Frames of a batch bounded at %d.", one)
+	}
+	if MaxBatchFrame(&Config{NumBuckets: 1 << 30, BucketDepth: 64, DataSize: 1 << 20}, 64) != maxBatchFrame {
+		t.Fatal("Frame limit exceeds the largest frame.")
+	}
+
+	var buf bytes.Buffer
+	writeRawFrame(&buf, make([]byte, 100))
+	if _, err := readBatchFrame(bytes.NewReader(buf.Bytes()), CompressionNone, 99); err == nil {
+		t.Fatal("Frame beyond the limit was read.")
+	}
+	if frame, err := readBatchFrame(&buf, CompressionNone, 100); err != nil || len(frame) != 100 {
+		t.Fatalf("Frame within the limit read as %d bytes: %v", len(frame), err)
+	}
+}
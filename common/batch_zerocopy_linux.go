@@ -0,0 +1,192 @@
+package common
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Frames are sent with MSG_ZEROCOPY, from which the kernel pins the pages of
+// the caller's buffers and transmits from them, rather than copying them into
+// the socket's buffers. A notification on the socket's error queue tells when
+// the pages are released, and until then the buffers must not change: a
+// frame's send returns only once all its pages are released.
+const (
+	soZeroCopy             = 60
+	msgZeroCopy            = 0x4000000
+	soEEOriginZeroCopy     = 5
+	soEECodeZeroCopyCopied = 1
+)
+
+// zeroCopy sends the frames of a TCP connection with MSG_ZEROCOPY.
+type zeroCopy struct {
+	raw syscall.RawConn
+	oob []byte
+	// Sends made and those the kernel has released the pages of, as numbered
+	// in its notifications.
+	sent, done uint32
+	// copied is set once the kernel notes it copied the pages of a send
+	// anyway, as it does over loopback, making the notifications overhead.
+	copied bool
+}
+
+// newZeroCopy enables MSG_ZEROCOPY on conn, returning nil if it is not a TCP
+// connection or the kernel does not support it.
+func newZeroCopy(conn net.Conn) *zeroCopy {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soZeroCopy, 1)
+	}); err != nil || serr != nil {
+		return nil
+	}
+	return &zeroCopy{raw: raw, oob: make([]byte, 512)}
+}
+
+// write sends bufs, returning once the kernel has released all of them.
+func (z *zeroCopy) write(conn net.Conn, bufs net.Buffers) error {
+	bufs = consume(bufs, 0)
+	var errno syscall.Errno
+	err := z.raw.Write(func(fd uintptr) bool {
+		for len(bufs) > 0 {
+			n, e := sendmsg(fd, bufs, msgZeroCopy)
+			switch {
+			case e == 0 && n == 0:
+				errno = syscall.EIO
+				return true
+			case e == 0:
+				z.sent++
+				bufs = consume(bufs, n)
+			case e == syscall.EINTR:
+			case e == syscall.EAGAIN:
+				return false
+			default:
+				errno = e
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil && errno != 0 {
+		err = os.NewSyscallError("sendmsg", errno)
+	}
+	if werr := z.wait(); err == nil {
+		err = werr
+	}
+	// Beyond the memory the kernel allows pinning for the socket, the rest
+	// of the frame is copied.
+	if errno == syscall.ENOBUFS {
+		_, err = bufs.WriteTo(conn)
+	}
+	return err
+}
+
+// wait reads the notifications of the error queue until every send made is
+// released, or the connection's read deadline passes.
+func (z *zeroCopy) wait() error {
+	var werr error
+	err := z.raw.Read(func(fd uintptr) bool {
+		for z.done != z.sent {
+			_, oobn, _, _, err := syscall.Recvmsg(int(fd), nil, z.oob, syscall.MSG_ERRQUEUE)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				return false
+			}
+			if err != nil {
+				werr = os.NewSyscallError("recvmsg", err)
+				return true
+			}
+			if werr = z.notified(z.oob[:oobn]); werr != nil {
+				return true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// notified counts the sends released in the control messages read from the
+// error queue, returning the error of any other message queued on it.
+func (z *zeroCopy) notified(oob []byte) error {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if !(m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR) &&
+			!(m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+			continue
+		}
+		if len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+			return errBatchFrame
+		}
+		ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+		if ee.Origin != soEEOriginZeroCopy {
+			if ee.Errno != 0 {
+				return syscall.Errno(ee.Errno)
+			}
+			continue
+		}
+		// Sends from Info to Data, inclusive, are released.
+		z.done += ee.Data - ee.Info + 1
+		if ee.Code&soEECodeZeroCopyCopied != 0 {
+			z.copied = true
+		}
+	}
+	return nil
+}
+
+// sockExtendedErr is struct sock_extended_err, heading the control messages
+// of the error queue.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+// sendmsg sends the first non-empty buffer of bufs.
+func sendmsg(fd uintptr, bufs net.Buffers, flags int) (int, syscall.Errno) {
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		n, err := syscall.SendmsgN(int(fd), b, nil, nil, flags)
+		if errno, ok := err.(syscall.Errno); ok {
+			return 0, errno
+		} else if err != nil {
+			return 0, syscall.EIO
+		}
+		return n, 0
+	}
+	return 0, 0
+}
+
+// consume drops the first n bytes of bufs, and any empty buffers heading the
+// rest.
+func consume(bufs net.Buffers, n int) net.Buffers {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 {
+		bufs[0] = bufs[0][n:]
+	}
+	return bufs
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBatchZeroCopy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	zc := newZeroCopy(conn)
+	if zc == nil {
+		t.Skip("MSG_ZEROCOPY is not supported.")
+	}
+
+	reply := &BatchReadReply{Replies: []ReadReply{{Data: bytes.Repeat([]byte{9}, 1<<20)}, {Err: "failed"}}}
+	read := make(chan error, 1)
+	go func() {
+		frame, err := readBatchFrame(server, CompressionNone, maxBatchFrame)
+		decoded := &BatchReadReply{}
+		if err == nil {
+			err = decodeBatchReply(frame, decoded)
+		}
+		if err == nil && !reflect.DeepEqual(decoded, reply) {
+			err = errors.New("reply changed in transit")
+		}
+		read <- err
+	}()
+	var w batchWriter
+	w.reply(reply)
+	// Over loopback, the kernel copies the frame anyway, and the connection
+	// stops using MSG_ZEROCOPY after it.
+	bc := &batchConn{Conn: conn, codec: CompressionNone, zeroCopy: zc}
+	if err = w.writeTo(bc); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-read; err != nil {
+		t.Fatal(err)
+	}
+	if zc.sent == 0 || zc.done != zc.sent {
+		t.Fatalf("Frame should return once its %d sends are released, %d were", zc.sent, zc.done)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import "net"
+
+// zeroCopy sends the frames of a connection without copying them, where the
+// kernel supports it.
+type zeroCopy struct {
+	copied bool
+}
+
+// newZeroCopy returns nil, as frames are sent with MSG_ZEROCOPY only on Linux.
+func newZeroCopy(conn net.Conn) *zeroCopy {
+	return nil
+}
+
+func (z *zeroCopy) write(conn net.Conn, bufs net.Buffers) error {
+	_, err := bufs.WriteTo(conn)
+	return err
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+// broadcastSeedLabel domain separates the public derivation of broadcast seeds.
+const broadcastSeedLabel = "talek broadcast seed"
+
+// BroadcastSeeds derives the pair of bucket seeds of a broadcast topic from
+// its signing public key.
+func BroadcastSeeds(signingPublicKey []byte) (*drbg.Seed, *drbg.Seed, error) {
+	if len(signingPublicKey) != 32 {
+		return nil, nil, errors.New("invalid broadcast key")
+	}
+	seeds := make([]*drbg.Seed, 2)
+	for i := range seeds {
+		hash := sha256.New()
+		hash.Write([]byte(broadcastSeedLabel))
+		hash.Write([]byte{byte(i)})
+		hash.Write(signingPublicKey)
+		seeds[i] = &drbg.Seed{}
+		if err := seeds[i].UnmarshalBinary(hash.Sum(nil)[0:drbg.SeedLength]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seeds[0], seeds[1], nil
+}
+
+// ItemBuckets returns the pair of buckets holding the item at seqNo of a topic
+// with the given seeds, under the placement hash and bucket strategy of conf.
+// An unknown placement hash or strategy, which clients and servers refuse to
+// start with, is taken as SipHash or StrategyTwoSeeds.
+func ItemBuckets(conf *Config, seed1 *drbg.Seed, seed2 *drbg.Seed, seqNo uint64) (uint64, uint64) {
+	seqNoBytes := make([]byte, 24)
+	_ = binary.PutUvarint(seqNoBytes, seqNo)
+
+	hash, err := NewPlacementHash(conf.PlacementHash)
+	if err != nil {
+		hash = sipPlacement{}
+	}
+	strategy, err := NewBucketStrategy(conf.BucketStrategy)
+	if err != nil {
+		strategy = twoSeeds{}
+	}
+	return strategy.Buckets(conf, hash, seed1, seed2, seqNoBytes)
+}
+
+// VerifyBroadcast checks that a write claiming to be part of a broadcast topic
+// is placed where that topic's public derivation puts it.
+func VerifyBroadcast(args *WriteArgs, conf *Config) bool {
+	if len(args.BroadcastKey) == 0 || conf.NumBuckets == 0 {
+		return false
+	}
+	s1, s2, err := BroadcastSeeds(args.BroadcastKey)
+	if err != nil {
+		return false
+	}
+	b1, b2 := ItemBuckets(conf, s1, s2, args.BroadcastSeqNo)
+	return args.Bucket1 == b1 && args.Bucket2 == b2
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/agl/ed25519"
+)
+
+// bucketContext prefixes signed bucket roots, so they can't be confused with
+// signed epoch roots of writes.
+const bucketContext = "talek bucket commitment"
+
+// BucketLeaf is the Merkle leaf committing to the contents of the bucket at
+// index.
+func BucketLeaf(index uint64, bucket []byte) [32]byte {
+	var header [9]byte
+	header[0] = merkleLeafPrefix
+	binary.BigEndian.PutUint64(header[1:], index)
+
+	h := sha256.New()
+	h.Write(header[:])
+	h.Write(bucket)
+	var leaf [32]byte
+	copy(leaf[:], h.Sum(nil))
+	return leaf
+}
+
+// BucketTreeSize is the number of leaves of the tree over a database of
+// numBuckets buckets: the next power of two, so the audit path of every
+// bucket is as long. Leaves past the last bucket are zero.
+func BucketTreeSize(numBuckets uint64) uint64 {
+	size := uint64(1)
+	for size < numBuckets {
+		size <<= 1
+	}
+	return size
+}
+
+// BucketProofLength is the length in bytes of the audit path of a bucket of
+// a database of numBuckets buckets.
+func BucketProofLength(numBuckets uint64) int {
+	depth := 0
+	for size := BucketTreeSize(numBuckets); size > 1; size >>= 1 {
+		depth++
+	}
+	return depth * 32
+}
+
+// BucketTree is the Merkle tree over the buckets of a database.
+type BucketTree struct {
+	numBuckets uint64
+	levels     [][][32]byte // From the leaves up to the root
+}
+
+// NewBucketTree computes the tree over the numBuckets buckets of bucketLength
+// bytes in db.
+func NewBucketTree(db []byte, numBuckets uint64, bucketLength int) *BucketTree {
+	t := &BucketTree{numBuckets: numBuckets}
+	leaves := make([][32]byte, BucketTreeSize(numBuckets))
+	for i := uint64(0); i < numBuckets; i++ {
+		leaves[i] = BucketLeaf(i, db[int(i)*bucketLength:int(i+1)*bucketLength])
+	}
+	t.levels = append(t.levels, leaves)
+	for level := leaves; len(level) > 1; {
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			next[i] = merkleNode(level[2*i], level[2*i+1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Root is the root of the tree.
+func (t *BucketTree) Root() [32]byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Size is the number of leaves of the tree.
+func (t *BucketTree) Size() uint64 {
+	return uint64(len(t.levels[0]))
+}
+
+// Proof returns the audit path of the bucket at index, as VerifyMerkleProof
+// takes it.
+func (t *BucketTree) Proof(index uint64) [][32]byte {
+	proof := make([][32]byte, 0, len(t.levels)-1)
+	for _, level := range t.levels[:len(t.levels)-1] {
+		proof = append(proof, level[index^1])
+		index >>= 1
+	}
+	return proof
+}
+
+// ProofShare returns the xor of the audit paths of the buckets a PIR request
+// vector selects. As with the buckets themselves, the shares of the request
+// vectors of a read combine to the audit path of the bucket read, and a
+// single share reveals nothing of which bucket that is.
+func (t *BucketTree) ProofShare(vector []byte) []byte {
+	share := make([]byte, 32*(len(t.levels)-1))
+
+	// The sibling at each level is shared by a block of buckets, so it is in
+	// the share if an odd number of the block is selected.
+	odd := make([]bool, len(t.levels[0]))
+	for i := uint64(0); i < t.numBuckets && int(i/8) < len(vector); i++ {
+		odd[i] = vector[i/8]&(1<<(i%8)) != 0
+	}
+	for l, level := range t.levels[:len(t.levels)-1] {
+		out := share[32*l : 32*(l+1)]
+		for i, selected := range odd {
+			if selected {
+				sibling := level[i^1]
+				for j := range out {
+					out[j] ^= sibling[j]
+				}
+			}
+		}
+		next := make([]bool, len(odd)/2)
+		for i := range next {
+			next[i] = odd[2*i] != odd[2*i+1]
+		}
+		odd = next
+	}
+	return share
+}
+
+// BucketCommitment is a trust domain's signed root of the buckets of its
+// database, as of the writes up to SeqNo, in an epoch. Honest replicas at the
+// same point of the writes commit to the same root.
+type BucketCommitment struct {
+	Epoch uint64
+	SeqNo uint64 // GlobalSeqNo of the last write applied
+	SignedRoot
+}
+
+// BucketSkewError is returned when trust domains answered a read from
+// different points of the writes, as happens while they apply the end of an
+// epoch. The read can't be verified, but should be made again rather than
+// taken as misbehaviour.
+type BucketSkewError struct {
+	TrustDomains []int // Those behind the latest point answered from
+}
+
+func (e *BucketSkewError) Error() string {
+	return fmt.Sprintf("trust domains %v answered from earlier writes", e.TrustDomains)
+}
+
+func bucketMessage(epoch uint64, seqNo uint64, root [32]byte, size uint64) []byte {
+	msg := bytes.NewBufferString(bucketContext)
+	binary.Write(msg, binary.BigEndian, epoch)
+	binary.Write(msg, binary.BigEndian, seqNo)
+	binary.Write(msg, binary.BigEndian, size)
+	msg.Write(root[:])
+	return msg.Bytes()
+}
+
+// SignBuckets signs the root of the tree over the buckets of the database
+// as of the write at seqNo in an epoch.
+func (td *TrustDomainConfig) SignBuckets(epoch uint64, seqNo uint64, root [32]byte, size uint64) BucketCommitment {
+	sig := ed25519.Sign(td.signPrivateKey, bucketMessage(epoch, seqNo, root, size))
+	return BucketCommitment{epoch, seqNo, SignedRoot{root, size, *sig}}
+}
+
+// VerifyBuckets checks that a bucket commitment was made by the trust domain.
+func (td *TrustDomainConfig) VerifyBuckets(c *BucketCommitment) bool {
+	return ed25519.Verify(&td.SignPublicKey, bucketMessage(c.Epoch, c.SeqNo, c.Root, c.Size), &c.Signature)
+}
+
+// PadReply overlays the pad of a seed on the data of a reply and its audit
+// path, as one keystream, so neither is seen by the frontend combining them.
+func PadReply(pad Pad, seed []byte, data []byte, proof []byte) error {
+	if len(proof) == 0 {
+		return pad.Overlay(seed, data)
+	}
+	buf := make([]byte, 0, len(data)+len(proof))
+	buf = append(append(buf, data...), proof...)
+	if err := pad.Overlay(seed, buf); err != nil {
+		return err
+	}
+	copy(data, buf)
+	copy(proof, buf[len(data):])
+	return nil
+}
+
+// VerifyBucket checks the contents of the bucket at index of a database of
+// numBuckets buckets, read with the audit path proof, against the commitments
+// of every trust domain, by index. They must all be signed, and to the root
+// the bucket is proven in. If trust domains answered from different points of
+// the writes, a *BucketSkewError names those behind.
+func VerifyBucket(index uint64, numBuckets uint64, bucket []byte, proof []byte, commitments []BucketCommitment, trustDomains []*TrustDomainConfig) error {
+	if len(commitments) != len(trustDomains) {
+		return errors.New("buckets not committed to by all trust domains")
+	}
+	latest := 0
+	for i, td := range trustDomains {
+		if !td.VerifyBuckets(&commitments[i]) {
+			return fmt.Errorf("invalid bucket commitment from trust domain %d", i)
+		}
+		c := &commitments[i]
+		if c.Epoch > commitments[latest].Epoch || (c.Epoch == commitments[latest].Epoch && c.SeqNo > commitments[latest].SeqNo) {
+			latest = i
+		}
+	}
+	var behind, disagreeing []int
+	for i := range commitments {
+		c := &commitments[i]
+		if c.Epoch != commitments[latest].Epoch || c.SeqNo != commitments[latest].SeqNo {
+			behind = append(behind, i)
+		} else if c.Root != commitments[latest].Root || c.Size != commitments[latest].Size {
+			disagreeing = append(disagreeing, i)
+		}
+	}
+	if len(disagreeing) > 0 {
+		return fmt.Errorf("trust domains %v committed to other buckets than trust domain %d at the same writes", disagreeing, latest)
+	}
+	if len(behind) > 0 {
+		return &BucketSkewError{behind}
+	}
+
+	size := BucketTreeSize(numBuckets)
+	if commitments[0].Size != size || len(proof) != BucketProofLength(numBuckets) {
+		return fmt.Errorf("commitment is not of %d buckets", numBuckets)
+	}
+	path := make([][32]byte, len(proof)/32)
+	for i := range path {
+		copy(path[i][:], proof[32*i:])
+	}
+	if !VerifyMerkleProof(BucketLeaf(index, bucket), index, size, path, commitments[0].Root) {
+		return errors.New("bucket read is not the one committed to")
+	}
+	return nil
+}
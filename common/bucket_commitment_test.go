@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+func TestBucketTree(t *testing.T) {
+	const bucketLength = 16
+	for _, n := range []uint64{1, 2, 5, 8, 13} {
+		db := make([]byte, n*bucketLength)
+		rand.Read(db)
+		tree := NewBucketTree(db, n, bucketLength)
+
+		leaves := make([][32]byte, BucketTreeSize(n))
+		for i := uint64(0); i < n; i++ {
+			leaves[i] = BucketLeaf(i, db[i*bucketLength:(i+1)*bucketLength])
+		}
+		if tree.Root() != MerkleRoot(leaves) || tree.Size() != uint64(len(leaves)) {
+			t.Fatalf("Tree of %d buckets is not the Merkle tree of its leaves.", n)
+		}
+		for i := uint64(0); i < n; i++ {
+			proof := tree.Proof(i)
+			if len(proof)*32 != BucketProofLength(n) {
+				t.Fatalf("Proof of bucket %d of %d is %d long.", i, n, len(proof))
+			}
+			if !VerifyMerkleProof(leaves[i], i, tree.Size(), proof, tree.Root()) {
+				t.Fatalf("Proof of bucket %d of %d failed to verify.", i, n)
+			}
+		}
+	}
+}
+
+func TestBucketProofShare(t *testing.T) {
+	const n, bucketLength = 13, 16
+	db := make([]byte, n*bucketLength)
+	rand.Read(db)
+	tree := NewBucketTree(db, n, bucketLength)
+
+	for bucket := uint64(0); bucket < n; bucket++ {
+		// Two random request vectors differing in the bucket read.
+		v1 := make([]byte, (n+7)/8)
+		rand.Read(v1)
+		v2 := append([]byte(nil), v1...)
+		v2[bucket/8] ^= 1 << (bucket % 8)
+
+		share := tree.ProofShare(v1)
+		other := tree.ProofShare(v2)
+		for i := range share {
+			share[i] ^= other[i]
+		}
+		for l, sibling := range tree.Proof(bucket) {
+			if string(share[32*l:32*(l+1)]) != string(sibling[:]) {
+				t.Fatalf("Shares of a read of bucket %d don't combine to its proof.", bucket)
+			}
+		}
+	}
+}
+
+func TestVerifyBucket(t *testing.T) {
+	const n, bucketLength = 8, 16
+	tds := []*TrustDomainConfig{
+		NewTrustDomainConfig("td0", "", true, false),
+		NewTrustDomainConfig("td1", "", true, false),
+	}
+	db := make([]byte, n*bucketLength)
+	rand.Read(db)
+	tree := NewBucketTree(db, n, bucketLength)
+	commitments := []BucketCommitment{
+		tds[0].SignBuckets(3, 40, tree.Root(), tree.Size()),
+		tds[1].SignBuckets(3, 40, tree.Root(), tree.Size()),
+	}
+	bucket := db[2*bucketLength : 3*bucketLength]
+	var proof []byte
+	for _, sibling := range tree.Proof(2) {
+		proof = append(proof, sibling[:]...)
+	}
+
+	if err := VerifyBucket(2, n, bucket, proof, commitments, tds); err != nil {
+		t.Fatalf("Bucket failed to verify: %v", err)
+	}
+	if VerifyBucket(3, n, bucket, proof, commitments, tds) == nil {
+		t.Fatal("Bucket verified at another index.")
+	}
+	fabricated := append([]byte(nil), bucket...)
+	fabricated[0] ^= 1
+	if VerifyBucket(2, n, fabricated, proof, commitments, tds) == nil {
+		t.Fatal("A fabricated bucket verified.")
+	}
+
+	// A trust domain answering from earlier writes is behind, while one
+	// claiming other buckets at the same writes misbehaves.
+	stale := NewBucketTree(make([]byte, n*bucketLength), n, bucketLength)
+	commitments[1] = tds[1].SignBuckets(3, 39, stale.Root(), stale.Size())
+	if skew, ok := VerifyBucket(2, n, bucket, proof, commitments, tds).(*BucketSkewError); !ok || len(skew.TrustDomains) != 1 || skew.TrustDomains[0] != 1 {
+		t.Fatal("Expected trust domain 1 to be found behind.")
+	}
+	commitments[1] = tds[1].SignBuckets(3, 40, stale.Root(), stale.Size())
+	err := VerifyBucket(2, n, bucket, proof, commitments, tds)
+	if _, ok := err.(*BucketSkewError); err == nil || ok {
+		t.Fatal("A bucket verified against disagreeing commitments.")
+	}
+	commitments[1] = tds[0].SignBuckets(3, 40, tree.Root(), tree.Size())
+	if VerifyBucket(2, n, bucket, proof, commitments, tds) == nil {
+		t.Fatal("A commitment signed by another trust domain verified.")
+	}
+	if VerifyBucket(2, n, bucket, proof, commitments[:1], tds) == nil {
+		t.Fatal("A bucket verified without commitments of all trust domains.")
+	}
+}
+
+func TestPadReply(t *testing.T) {
+	s, _ := drbg.NewSeed()
+	seed, _ := s.MarshalBinary()
+	for _, id := range []uint8{PadSipHash, PadAESCTR} {
+		pad, _ := NewPad(id)
+		data := make([]byte, 64)
+		proof := make([]byte, 96)
+		if err := PadReply(pad, seed, data, proof); err != nil {
+			t.Fatal(err)
+		}
+		alone := make([]byte, 64)
+		pad.Overlay(seed, alone)
+		if !bytes.Equal(alone, data) {
+			t.Fatalf("Pad %d of a proof changed the pad of the data.", id)
+		}
+		PadReply(pad, seed, data, proof)
+		if !bytes.Equal(data, make([]byte, 64)) || !bytes.Equal(proof, make([]byte, 96)) {
+			t.Fatalf("Pad %d of a reply does not remove itself.", id)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/agl/ed25519"
+)
+
+// Domain separation of Merkle tree hashes, as in RFC 6962.
+const (
+	merkleLeafPrefix byte = 0
+	merkleNodePrefix byte = 1
+)
+
+// commitmentContext prefixes signed epoch roots, so the signatures can't be
+// confused with other statements made with trust domain signing keys.
+const commitmentContext = "talek epoch commitment"
+
+// ErrNotCommitted is returned for a commitment to an epoch still in progress.
+var ErrNotCommitted = errors.New("epoch not yet committed")
+
+// WriteLeaf is the Merkle leaf committing to a write accepted at its
+// GlobalSeqNo. It covers everything replicas apply to their database.
+func WriteLeaf(args *WriteArgs) [32]byte {
+	var header [33]byte
+	header[0] = merkleLeafPrefix
+	binary.BigEndian.PutUint64(header[1:9], args.GlobalSeqNo)
+	binary.BigEndian.PutUint64(header[9:17], args.Bucket1)
+	binary.BigEndian.PutUint64(header[17:25], args.Bucket2)
+	binary.BigEndian.PutUint64(header[25:33], args.TTL)
+
+	var lengths [16]byte
+	binary.BigEndian.PutUint64(lengths[0:8], uint64(len(args.Data)))
+	binary.BigEndian.PutUint64(lengths[8:16], uint64(len(args.InterestVector)))
+
+	h := sha256.New()
+	h.Write(header[:])
+	h.Write(lengths[:])
+	h.Write(args.Data)
+	h.Write(args.InterestVector)
+	var leaf [32]byte
+	copy(leaf[:], h.Sum(nil))
+	return leaf
+}
+
+func merkleNode(left, right [32]byte) [32]byte {
+	buf := make([]byte, 0, 65)
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// merkleSplit is the largest power of two smaller than n.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleRoot computes the root of the Merkle tree over leaves. The tree has
+// the shape of RFC 6962, and the root of no leaves is the hash of nothing.
+func MerkleRoot(leaves [][32]byte) [32]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// MerkleProof returns the audit path proving the leaf at index is in the tree.
+func MerkleProof(leaves [][32]byte, index int) [][32]byte {
+	if len(leaves) <= 1 || index < 0 || index >= len(leaves) {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(MerkleProof(leaves[:k], index), MerkleRoot(leaves[k:]))
+	}
+	return append(MerkleProof(leaves[k:], index-k), MerkleRoot(leaves[:k]))
+}
+
+// VerifyMerkleProof checks an audit path for the leaf at index of a tree of
+// size leaves against its root.
+func VerifyMerkleProof(leaf [32]byte, index uint64, size uint64, proof [][32]byte, root [32]byte) bool {
+	if index >= size {
+		return false
+	}
+	// Walk down to the leaf to learn which side each sibling is on, then
+	// hash back up from the leaf.
+	var lefts []bool
+	for size > 1 {
+		k := uint64(merkleSplit(int(size)))
+		if index < k {
+			lefts = append(lefts, false)
+			size = k
+		} else {
+			lefts = append(lefts, true)
+			index -= k
+			size -= k
+		}
+	}
+	if len(lefts) != len(proof) {
+		return false
+	}
+	node := leaf
+	for i, sibling := range proof {
+		if lefts[len(lefts)-1-i] {
+			node = merkleNode(sibling, node)
+		} else {
+			node = merkleNode(node, sibling)
+		}
+	}
+	return node == root
+}
+
+// SignedRoot is a trust domain's signed statement of the root of the writes
+// it applied in an epoch.
+type SignedRoot struct {
+	Root      [32]byte
+	Size      uint64
+	Signature [64]byte
+}
+
+// EpochCommitment is the frontend's published commitment to the writes it
+// accepted in an epoch, with the signed root of each replica, by trust domain
+// index.
+type EpochCommitment struct {
+	Epoch    uint64
+	SeqNos   Range // Global sequence numbers of writes in the epoch
+	Root     [32]byte
+	Size     uint64
+	Replicas []SignedRoot
+}
+
+// EquivocationError is returned when trust domains have signed conflicting
+// roots for an epoch. The signed roots it was found from prove it.
+type EquivocationError struct {
+	Epoch        uint64
+	TrustDomains []int
+}
+
+func (e *EquivocationError) Error() string {
+	return fmt.Sprintf("trust domains %v signed conflicting roots for epoch %d", e.TrustDomains, e.Epoch)
+}
+
+func commitmentMessage(epoch uint64, root [32]byte, size uint64) []byte {
+	msg := bytes.NewBufferString(commitmentContext)
+	binary.Write(msg, binary.BigEndian, epoch)
+	binary.Write(msg, binary.BigEndian, size)
+	msg.Write(root[:])
+	return msg.Bytes()
+}
+
+// SignRoot signs the root of the writes applied in an epoch.
+func (td *TrustDomainConfig) SignRoot(epoch uint64, root [32]byte, size uint64) SignedRoot {
+	sig := ed25519.Sign(td.signPrivateKey, commitmentMessage(epoch, root, size))
+	return SignedRoot{root, size, *sig}
+}
+
+// VerifyRoot checks that a signed root for an epoch was made by the trust domain.
+func (td *TrustDomainConfig) VerifyRoot(epoch uint64, signed *SignedRoot) bool {
+	return ed25519.Verify(&td.SignPublicKey, commitmentMessage(epoch, signed.Root, signed.Size), &signed.Signature)
+}
+
+// Verify checks a commitment was signed by every trust domain, and that all of
+// them applied the writes the frontend committed to. If signed roots differ,
+// an EquivocationError names the trust domains disagreeing with the frontend.
+func (c *EpochCommitment) Verify(trustDomains []*TrustDomainConfig) error {
+	if len(c.Replicas) != len(trustDomains) {
+		return errors.New("commitment not signed by all trust domains")
+	}
+	var disagreeing []int
+	for i, td := range trustDomains {
+		if !td.VerifyRoot(c.Epoch, &c.Replicas[i]) {
+			return fmt.Errorf("invalid signature from trust domain %d", i)
+		}
+		if c.Replicas[i].Root != c.Root || c.Replicas[i].Size != c.Size {
+			disagreeing = append(disagreeing, i)
+		}
+	}
+	if len(disagreeing) > 0 {
+		return &EquivocationError{c.Epoch, disagreeing}
+	}
+	return nil
+}
+
+// Equivocation compares two validly signed commitments for the same epoch,
+// such as ones served to different clients, returning an EquivocationError
+// naming the trust domains that signed conflicting roots, or nil.
+func Equivocation(a, b *EpochCommitment, trustDomains []*TrustDomainConfig) error {
+	if a.Epoch != b.Epoch || len(a.Replicas) != len(trustDomains) || len(b.Replicas) != len(trustDomains) {
+		return nil
+	}
+	var conflicting []int
+	for i, td := range trustDomains {
+		ra, rb := &a.Replicas[i], &b.Replicas[i]
+		if (ra.Root != rb.Root || ra.Size != rb.Size) && td.VerifyRoot(a.Epoch, ra) && td.VerifyRoot(b.Epoch, rb) {
+			conflicting = append(conflicting, i)
+		}
+	}
+	if len(conflicting) > 0 {
+		return &EquivocationError{a.Epoch, conflicting}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"testing"
+)
+
+func testLeaves(n int) [][32]byte {
+	leaves := make([][32]byte, n)
+	for i := range leaves {
+		leaves[i] = WriteLeaf(&WriteArgs{GlobalSeqNo: uint64(i + 1), Data: []byte{byte(i)}})
+	}
+	return leaves
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeaves(n)
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			proof := MerkleProof(leaves, i)
+			if !VerifyMerkleProof(leaves[i], uint64(i), uint64(n), proof, root) {
+				t.Fatalf("Proof of leaf %d of %d failed to verify.", i, n)
+			}
+			if n > 1 && VerifyMerkleProof(leaves[(i+1)%n], uint64(i), uint64(n), proof, root) {
+				t.Fatalf("Proof of leaf %d of %d verified another leaf.", i, n)
+			}
+		}
+	}
+	if MerkleRoot(testLeaves(4)) == MerkleRoot(testLeaves(5)) {
+		t.Fatal("Roots of different trees should differ.")
+	}
+	if WriteLeaf(&WriteArgs{GlobalSeqNo: 1}) == WriteLeaf(&WriteArgs{GlobalSeqNo: 2}) {
+		t.Fatal("Leaves should commit to the position of a write.")
+	}
+}
+
+func TestEpochCommitment(t *testing.T) {
+	tds := []*TrustDomainConfig{
+		NewTrustDomainConfig("td0", "", true, false),
+		NewTrustDomainConfig("td1", "", true, false),
+	}
+	leaves := testLeaves(3)
+	root := MerkleRoot(leaves)
+	c := &EpochCommitment{Epoch: 4, Root: root, Size: 3}
+	for _, td := range tds {
+		c.Replicas = append(c.Replicas, td.SignRoot(4, root, 3))
+	}
+	if err := c.Verify(tds); err != nil {
+		t.Fatalf("Valid commitment failed to verify: %v", err)
+	}
+
+	forged := *c
+	forged.Epoch = 5
+	if err := forged.Verify(tds); err == nil {
+		t.Fatal("Signatures should be bound to their epoch.")
+	}
+
+	// A replica which applied a different set of writes is caught.
+	other := MerkleRoot(leaves[:2])
+	split := *c
+	split.Replicas = []SignedRoot{c.Replicas[0], tds[1].SignRoot(4, other, 2)}
+	err := split.Verify(tds)
+	if e, ok := err.(*EquivocationError); !ok || len(e.TrustDomains) != 1 || e.TrustDomains[0] != 1 {
+		t.Fatalf("Expected trust domain 1 to be found equivocating, got %v", err)
+	}
+
+	// As are conflicting roots served in different commitments.
+	conflict := &EpochCommitment{Epoch: 4, Root: other, Size: 2}
+	for _, td := range tds {
+		conflict.Replicas = append(conflict.Replicas, td.SignRoot(4, other, 2))
+	}
+	err = Equivocation(c, conflict, tds)
+	if e, ok := err.(*EquivocationError); !ok || len(e.TrustDomains) != 2 {
+		t.Fatalf("Expected both trust domains to be found equivocating, got %v", err)
+	}
+	if Equivocation(c, c, tds) != nil {
+		t.Fatal("A commitment does not conflict with itself.")
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a codec for the payloads of RPCs. Whether payloads compress
+// depends on the deployment: request vectors expanded from PRG seeds and
+// replies of encrypted items are incompressible, while explicit request
+// vectors and sparse databases are not. So the codec of a connection is
+// negotiated: the client offers those it supports, and the server picks the
+// first of those it accepts, in its own order of preference.
+type Compression string
+
+// Supported codecs.
+const (
+	CompressionNone   Compression = "none"
+	CompressionSnappy Compression = "snappy"
+	CompressionZstd   Compression = "zstd"
+)
+
+// SupportedCompression is every codec, as offered by clients by default.
+var SupportedCompression = []Compression{CompressionZstd, CompressionSnappy, CompressionNone}
+
+// Headers negotiating the codec of JSON RPCs. The client lists the codecs it
+// offers, and the server answers with the one it picked. Bodies compressed with
+// a codec carry it as their Content-Encoding.
+const (
+	CompressionOfferHeader  = "Talek-Accept-Compression"
+	CompressionChosenHeader = "Talek-Compression"
+)
+
+// Payloads shorter than this are sent uncompressed, whatever the codec.
+const minCompressSize = 256
+
+// zstd encoders are safe for concurrent use of EncodeAll. Decoders are made
+// for each payload, bounded by its limit.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// ParseCompression parses a list of codec names, as found in configuration
+// and negotiation headers.
+func ParseCompression(names []string) ([]Compression, error) {
+	codecs := make([]Compression, 0, len(names))
+	for _, n := range names {
+		c := Compression(strings.TrimSpace(n))
+		switch c {
+		case CompressionNone, CompressionSnappy, CompressionZstd:
+			codecs = append(codecs, c)
+		default:
+			return nil, fmt.Errorf("unknown compression %q", n)
+		}
+	}
+	return codecs, nil
+}
+
+// JoinCompression formats a list of codecs as a negotiation header.
+func JoinCompression(codecs []Compression) string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ",")
+}
+
+// NegotiateCompression picks the first codec of accepted which is offered.
+// Without one in common, payloads are not compressed.
+func NegotiateCompression(accepted []Compression, offered []Compression) Compression {
+	for _, a := range accepted {
+		for _, o := range offered {
+			if a == o {
+				return a
+			}
+		}
+	}
+	return CompressionNone
+}
+
+// Compress compresses a payload with the codec, if it is long enough to be
+// worth it, returning the codec it ends up encoded with.
+func (c Compression) Compress(src []byte) ([]byte, Compression) {
+	if len(src) < minCompressSize {
+		return src, CompressionNone
+	}
+	switch c {
+	case CompressionSnappy:
+		// The framed format, rather than a single block, so payloads can be
+		// decompressed as a stream.
+		var buf bytes.Buffer
+		w := snappy.NewBufferedWriter(&buf)
+		w.Write(src)
+		w.Close()
+		return buf.Bytes(), c
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(src, nil), c
+	}
+	return src, CompressionNone
+}
+
+// Decompress reads a payload encoded with the codec from src, and
+// decompresses it. The empty codec is no compression. The payload is
+// decompressed as a stream, and refused once it exceeds limit bytes, so no
+// more than that is ever held of it.
+func (c Compression) Decompress(src io.Reader, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch c {
+	case "", CompressionNone:
+		r = src
+	case CompressionSnappy:
+		r = snappy.NewReader(src)
+	case CompressionZstd:
+		d, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		return nil, fmt.Errorf("payload decompresses to more than %d bytes", limit)
+	}
+	return data, err
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("talek"), 1000)
+	for _, c := range SupportedCompression {
+		compressed, encoding := c.Compress(payload)
+		if encoding != c {
+			t.Fatalf("%s payload encoded as %s", c, encoding)
+		}
+		if c != CompressionNone && len(compressed) >= len(payload) {
+			t.Fatalf("%s did not compress", c)
+		}
+		if out, err := encoding.Decompress(bytes.NewReader(compressed), int64(len(payload))); err != nil || !bytes.Equal(out, payload) {
+			t.Fatalf("%s did not round trip: %v", c, err)
+		}
+		if _, err := encoding.Decompress(bytes.NewReader(compressed), int64(len(payload)-1)); err == nil {
+			t.Fatalf("%s decompressed past its limit", c)
+		}
+		if c != CompressionNone {
+			if _, err := c.Decompress(bytes.NewReader(payload), int64(len(payload))); err == nil {
+				t.Fatalf("%s decompressed garbage", c)
+			}
+		}
+	}
+	if _, encoding := CompressionZstd.Compress([]byte("short")); encoding != CompressionNone {
+		t.Fatal("Short payloads should not be compressed.")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	codecs, err := ParseCompression([]string{"snappy", " zstd"})
+	if err != nil || len(codecs) != 2 {
+		t.Fatalf("Failed to parse codecs: %v, %v", codecs, err)
+	}
+	if _, err := ParseCompression([]string{"lzma"}); err == nil {
+		t.Fatal("Unknown codecs should be refused.")
+	}
+	if c := NegotiateCompression(codecs, SupportedCompression); c != CompressionSnappy {
+		t.Fatalf("Server's preference should win, got %s", c)
+	}
+	if c := NegotiateCompression(codecs, []Compression{CompressionNone, "lzma"}); c != CompressionNone {
+		t.Fatalf("Without a codec in common, none should be used, got %s", c)
+	}
+	if c := NegotiateCompression(nil, SupportedCompression); c != CompressionNone {
+		t.Fatalf("Servers accept no compression by default, got %s", c)
+	}
+}
@@ -2,11 +2,14 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"time"
 )
 
-// Config is a shared configuration needed by both libtalek and server
+// Config is a shared configuration needed by both libtalek and server.
+// Fields added to it must also be written by ConfigBundle.Canonical, so that
+// signed bundles cover them.
 type Config struct {
 	// How many buckets are in the server?
 	NumBuckets uint64
@@ -26,17 +29,142 @@ type Config struct {
 	InterestSeed int64
 	// Max fraction of DB capacity that can store messages
 	MaxLoadFactor float64
+	// Hash placing the items of topics into buckets, e.g. PlacementSipHash
+	PlacementHash uint8
+	// Strategy choosing the buckets of items, e.g. StrategyTwoLeft
+	BucketStrategy uint8
+	// Algorithm trust domains pad their replies with, e.g. PadAESCTR
+	PadAlgorithm uint8
+	// Should replicas commit to the buckets of their database, answering reads
+	// with audit paths clients verify against the commitments?
+	VerifyBuckets bool
+	// Traffic every client must present, which libtalek enforces in place of
+	// the intervals of client configurations: how many reads are made each
+	// ReadInterval, and writes each WriteInterval, evenly spaced but for a
+	// random jitter of up to ShapeJitter. 0 reads or writes leaves clients
+	// their own intervals for them.
+	ShapeReads  uint64
+	ShapeWrites uint64
+	ShapeJitter time.Duration `json:",string"`
+	// Further size classes, each a bucket space of its own, which topics are
+	// bound to as they are created. Class 0 is the space of NumBuckets,
+	// BucketDepth and DataSize, and class i that of Classes[i-1]. Unused
+	// classes are zero, after those in use. Frontends learn the class of
+	// each read and write, and cover traffic is made in class 0.
+	Classes [MaxSizeClasses - 1]SizeClass
+	// With HotBuckets, items of class 0 are also kept for HotEpochs epochs in
+	// a hot tier of HotBuckets buckets, which reads of recent items are made
+	// of at a fraction of the PIR cost of the whole database, the cold tier.
+	// Items are in the bucket of the hot tier of their buckets modulo
+	// HotBuckets. Frontends batch reads of the cold tier only every
+	// ColdReadMultiple read intervals. 0 HotBuckets keeps a single tier.
+	HotBuckets       uint64
+	HotEpochs        uint64
+	ColdReadMultiple uint64
 
 	/** @todo remove below **/
 	// What fraction of items should be removed from the DB when items are removed?
 	LoadFactorStep float64
 }
 
+// MaxSizeClasses is how many size classes a configuration may have, counting
+// class 0.
+const MaxSizeClasses = 4
+
+// ErrClass turns away a request of a size class the configuration lacks.
+var ErrClass = errors.New("size class not configured")
+
+// Tiers of the database reads are made of.
+const (
+	// TierCold is the whole database.
+	TierCold uint8 = iota
+	// TierHot holds the items of the last HotEpochs epochs.
+	TierHot
+)
+
+// ErrTier turns away a read of a tier the configuration lacks.
+var ErrTier = errors.New("tier not configured")
+
+// SizeClass is a bucket space with items of its own size, so topics of short
+// messages and of large ones needn't share one item size.
+type SizeClass struct {
+	NumBuckets  uint64
+	BucketDepth uint64
+	DataSize    uint64
+}
+
+// NumClasses is how many size classes the configuration has, counting class 0.
+func (cc *Config) NumClasses() int {
+	n := 1
+	for n < MaxSizeClasses && cc.Classes[n-1] != (SizeClass{}) {
+		n++
+	}
+	return n
+}
+
+// Class returns the configuration of a size class: a copy of the
+// configuration with the bucket space of the class in place of that of class
+// 0, and no further classes or tiers. Class 0 is the configuration itself.
+// Returns ErrClass if the configuration lacks the class.
+func (cc *Config) Class(class uint8) (*Config, error) {
+	if class == 0 {
+		return cc, nil
+	}
+	if int(class) >= cc.NumClasses() {
+		return nil, ErrClass
+	}
+	c := *cc
+	space := cc.Classes[class-1]
+	c.NumBuckets, c.BucketDepth, c.DataSize = space.NumBuckets, space.BucketDepth, space.DataSize
+	c.Classes = [MaxSizeClasses - 1]SizeClass{}
+	c.HotBuckets, c.HotEpochs, c.ColdReadMultiple = 0, 0, 0
+	return &c, nil
+}
+
+// Tier returns the configuration of a tier of the database: for TierHot, a
+// copy of the configuration with the buckets of the hot tier in place of
+// NumBuckets. TierCold is the configuration itself. Returns ErrTier if the
+// configuration lacks the tier.
+func (cc *Config) Tier(tier uint8) (*Config, error) {
+	switch {
+	case tier == TierCold:
+		return cc, nil
+	case tier == TierHot && cc.HotBuckets > 0:
+		c := *cc
+		c.NumBuckets = cc.HotBuckets
+		return &c, nil
+	}
+	return nil, ErrTier
+}
+
+// HotBucket is the bucket of the hot tier holding the items of a bucket.
+func (cc *Config) HotBucket(bucket uint64) uint64 {
+	return bucket % cc.HotBuckets
+}
+
 // WindowSize is a computed property of Config for how many items are available at a time
 func (cc *Config) WindowSize() uint64 {
 	return uint64(float64(cc.NumBuckets*cc.BucketDepth) * cc.MaxLoadFactor)
 }
 
+// ReadSlot is the wait between reads of the traffic shape, or 0 if it leaves
+// clients their own read interval.
+func (cc *Config) ReadSlot() time.Duration {
+	if cc.ShapeReads == 0 {
+		return 0
+	}
+	return cc.ReadInterval / time.Duration(cc.ShapeReads)
+}
+
+// WriteSlot is the wait between writes of the traffic shape, or 0 if it
+// leaves clients their own write interval.
+func (cc *Config) WriteSlot() time.Duration {
+	if cc.ShapeWrites == 0 {
+		return 0
+	}
+	return cc.WriteInterval / time.Duration(cc.ShapeWrites)
+}
+
 // ConfigFromFile restores a JSON file. returns the config on success or nil if
 // loading or parsing the file fails.
 func ConfigFromFile(file string) *Config {
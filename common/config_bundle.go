@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// configBundleContext prefixes the canonical encoding of config bundles, so
+// their signatures can't be confused with other statements made with trust
+// domain signing keys.
+const configBundleContext = "talek config bundle v1"
+
+// ConfigBundle is a common configuration and the public records of the trust
+// domains serving it, signed jointly by every one of them. Clients holding the
+// signing keys of the trust domains accept a bundle only with all of their
+// signatures, so no single operator can change the parameters clients rely on
+// for their privacy, such as NumBuckets or the intervals of reads and writes.
+type ConfigBundle struct {
+	Config       Config
+	TrustDomains []*TrustDomainConfig
+	Signatures   [][64]byte // By trust domain index
+}
+
+// NewConfigBundle creates an unsigned bundle of a configuration and trust
+// domains.
+func NewConfigBundle(config *Config, trustDomains []*TrustDomainConfig) *ConfigBundle {
+	b := &ConfigBundle{}
+	b.Config = *config
+	b.TrustDomains = make([]*TrustDomainConfig, len(trustDomains))
+	for i, td := range trustDomains {
+		// Only the public record of each trust domain is bundled.
+		b.TrustDomains[i] = &TrustDomainConfig{
+			Name:          td.Name,
+			Address:       td.Address,
+			BatchAddress:  td.BatchAddress,
+			IsValid:       td.IsValid,
+			IsDistributed: td.IsDistributed,
+			PublicKey:     td.PublicKey,
+			SignPublicKey: td.SignPublicKey,
+		}
+	}
+	b.Signatures = make([][64]byte, len(trustDomains))
+	return b
+}
+
+// ConfigBundleFromFile restores a bundle from its JSON form. The bundle must
+// still be verified before it is trusted.
+func ConfigBundleFromFile(file string) (*ConfigBundle, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	b := new(ConfigBundle)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Canonical is the encoding of the bundle its trust domains sign. Every field
+// of the configuration and of the trust domains' public records is written in
+// a fixed order and width, independent of how the bundle is serialized.
+func (b *ConfigBundle) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(configBundleContext)
+	buf.config(&b.Config)
+	buf.u64(uint64(len(b.TrustDomains)))
+	for _, td := range b.TrustDomains {
+		buf.str(td.Name)
+		buf.str(td.Address)
+		buf.str(td.BatchAddress)
+		buf.flag(td.IsValid)
+		buf.flag(td.IsDistributed)
+		buf.Write(td.PublicKey[:])
+		buf.Write(td.SignPublicKey[:])
+	}
+	return buf.Bytes()
+}
+
+// canonicalBuffer writes the fields of statements signed with trust domain
+// keys in a fixed order and width.
+type canonicalBuffer struct {
+	bytes.Buffer
+}
+
+func (buf *canonicalBuffer) u64(v uint64) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func (buf *canonicalBuffer) str(s string) {
+	buf.u64(uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func (buf *canonicalBuffer) data(b []byte) {
+	buf.u64(uint64(len(b)))
+	buf.Write(b)
+}
+
+// time writes a time to the nanosecond, the zero time as 0.
+func (buf *canonicalBuffer) time(t time.Time) {
+	if t.IsZero() {
+		buf.u64(0)
+		return
+	}
+	buf.u64(uint64(t.UnixNano()))
+}
+
+func (buf *canonicalBuffer) flag(f bool) {
+	if f {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+// config writes every field of a common configuration.
+func (buf *canonicalBuffer) config(c *Config) {
+	buf.u64(c.NumBuckets)
+	buf.u64(c.BucketDepth)
+	buf.u64(c.DataSize)
+	buf.u64(math.Float64bits(c.BloomFalsePositive))
+	buf.u64(uint64(c.WriteInterval))
+	buf.u64(uint64(c.ReadInterval))
+	buf.u64(c.InterestMultiple)
+	buf.u64(uint64(c.InterestSeed))
+	buf.u64(math.Float64bits(c.MaxLoadFactor))
+	buf.WriteByte(c.PlacementHash)
+	buf.WriteByte(c.PadAlgorithm)
+	buf.u64(math.Float64bits(c.LoadFactorStep))
+	buf.flag(c.VerifyBuckets)
+	buf.WriteByte(c.BucketStrategy)
+	buf.u64(c.ShapeReads)
+	buf.u64(c.ShapeWrites)
+	buf.u64(uint64(c.ShapeJitter))
+	for _, class := range c.Classes {
+		buf.u64(class.NumBuckets)
+		buf.u64(class.BucketDepth)
+		buf.u64(class.DataSize)
+	}
+	buf.u64(c.HotBuckets)
+	buf.u64(c.HotEpochs)
+	buf.u64(c.ColdReadMultiple)
+}
+
+// Sign adds the signature of the trust domain at index to the bundle. The
+// trust domain must be that of the bundle, with its private key.
+func (b *ConfigBundle) Sign(index int, td *TrustDomainConfig) error {
+	if index < 0 || index >= len(b.TrustDomains) {
+		return fmt.Errorf("bundle has no trust domain %d", index)
+	}
+	if td.SignPublicKey != b.TrustDomains[index].SignPublicKey {
+		return fmt.Errorf("signing key is not that of trust domain %d", index)
+	}
+	if len(b.Signatures) != len(b.TrustDomains) {
+		b.Signatures = make([][64]byte, len(b.TrustDomains))
+	}
+	b.Signatures[index] = *ed25519.Sign(td.signPrivateKey, b.Canonical())
+	return nil
+}
+
+// Verify checks the bundle is of the trust domains whose signing keys the
+// caller already holds, by index, and that every one of them signed it.
+func (b *ConfigBundle) Verify(trusted []*TrustDomainConfig) error {
+	if len(trusted) == 0 {
+		return fmt.Errorf("no trust domains to verify bundle against")
+	}
+	if len(b.TrustDomains) != len(trusted) || len(b.Signatures) != len(trusted) {
+		return fmt.Errorf("bundle is of %d trust domains rather than %d", len(b.TrustDomains), len(trusted))
+	}
+	msg := b.Canonical()
+	for i, td := range trusted {
+		if b.TrustDomains[i].SignPublicKey != td.SignPublicKey {
+			return fmt.Errorf("bundle changes the signing key of trust domain %d", i)
+		}
+		if !ed25519.Verify(&td.SignPublicKey, msg, &b.Signatures[i]) {
+			return fmt.Errorf("bundle not signed by trust domain %d", i)
+		}
+	}
+	return nil
+}
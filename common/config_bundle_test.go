@@ -0,0 +1,67 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConfigBundle(t *testing.T) {
+	tds := []*TrustDomainConfig{
+		NewTrustDomainConfig("td0", "localhost:9000", true, false),
+		NewTrustDomainConfig("td1", "localhost:9001", true, false),
+	}
+	config := &Config{NumBuckets: 1024, DataSize: 256, WriteInterval: time.Second, ReadInterval: time.Second}
+	bundle := NewConfigBundle(config, tds)
+	if err := bundle.Verify(tds); err == nil {
+		t.Fatal("Unsigned bundle should not verify.")
+	}
+	if err := bundle.Sign(0, tds[1]); err == nil {
+		t.Fatal("Trust domain should not sign for another.")
+	}
+	for i, td := range tds {
+		if err := bundle.Sign(i, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bundle.Verify(tds); err != nil {
+		t.Fatalf("Signed bundle failed to verify: %v", err)
+	}
+
+	// Bundles survive serialization, without private keys.
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(ConfigBundle)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Verify(tds); err != nil {
+		t.Fatalf("Restored bundle failed to verify: %v", err)
+	}
+	if restored.TrustDomains[0].signPrivateKey != nil {
+		t.Fatal("Bundle should not carry private keys.")
+	}
+
+	// Any change to the configuration or trust domains invalidates it.
+	restored.Config.NumBuckets = 512
+	if err := restored.Verify(tds); err == nil {
+		t.Fatal("Bundle with a changed configuration should not verify.")
+	}
+	restored.Config.NumBuckets = config.NumBuckets
+	restored.TrustDomains[1].Address = "evil:9001"
+	if err := restored.Verify(tds); err == nil {
+		t.Fatal("Bundle with a changed trust domain should not verify.")
+	}
+
+	// Nor can the trust domains be replaced with ones signing a new bundle.
+	other := []*TrustDomainConfig{tds[0], NewTrustDomainConfig("td1", "evil:9001", true, false)}
+	forged := NewConfigBundle(config, other)
+	for i, td := range other {
+		forged.Sign(i, td)
+	}
+	if err := forged.Verify(tds); err == nil {
+		t.Fatal("Bundle of other trust domains should not verify.")
+	}
+}
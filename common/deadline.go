@@ -0,0 +1,30 @@
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDeadlineExceeded is the error of a request whose caller stopped waiting
+// for it before it was served, so it was abandoned.
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+// Expired reports whether a deadline has passed. The zero deadline never does.
+func Expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// LatestDeadline returns the latest of a set of deadlines, by which work for
+// all of them can be abandoned. It is zero if any of them is.
+func LatestDeadline(deadlines ...time.Time) time.Time {
+	var latest time.Time
+	for _, d := range deadlines {
+		if d.IsZero() {
+			return time.Time{}
+		}
+		if d.After(latest) {
+			latest = d
+		}
+	}
+	return latest
+}
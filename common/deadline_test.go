@@ -0,0 +1,20 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+	now := time.Now()
+	if Expired(time.Time{}) || Expired(now.Add(time.Minute)) || !Expired(now.Add(-time.Minute)) {
+		t.Fatal("Expired misjudged a deadline.")
+	}
+
+	if d := LatestDeadline(now, now.Add(time.Second), now.Add(-time.Second)); !d.Equal(now.Add(time.Second)) {
+		t.Fatalf("Expected the latest deadline, got %v", d)
+	}
+	if d := LatestDeadline(now, time.Time{}); !d.IsZero() {
+		t.Fatalf("A request without a deadline should leave the batch without one, got %v", d)
+	}
+}
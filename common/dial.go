@@ -0,0 +1,17 @@
+package common
+
+import (
+	"net"
+	"time"
+)
+
+// dialFallbackDelay is how long a dial waits on the addresses of the family
+// resolved first before racing those of the other, as in RFC 6555.
+const dialFallbackDelay = 300 * time.Millisecond
+
+// newDialer creates a dialer for the RPC transports. Hosts with both IPv6 and
+// IPv4 addresses are dialed in both families, so a server is reached wherever
+// one family is broken or absent, as on IPv6-only networks.
+func newDialer(timeout time.Duration, keepAlive time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, KeepAlive: keepAlive, FallbackDelay: dialFallbackDelay}
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Trust domains are discovered from DNS records of their DNSName. The SRV
+// record _talek._tcp.<name> gives the host and port of the replica, and a TXT
+// record of <name> gives its keys, as
+//
+//	talek-td=1 pk=<base64 PublicKey> spk=<base64 SignPublicKey>
+//
+// DNS is not trusted with the keys: those found must match the fingerprint
+// pinned in the client's configuration. Operators can then move trust
+// domains between hosts without reissuing configuration to clients.
+const (
+	discoveryService   = "talek"
+	discoveryTXTPrefix = "talek-td=1"
+	// fingerprintContext domain separates fingerprints of trust domain keys.
+	fingerprintContext = "talek trust domain keys"
+)
+
+// Resolver looks up the DNS records trust domains are discovered from.
+// net.DefaultResolver is one.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// KeyFingerprint is the hex SHA-256 of the trust domain's public keys, by
+// which clients pin the keys of trust domains they discover.
+func (td *TrustDomainConfig) KeyFingerprint() string {
+	h := sha256.New()
+	h.Write([]byte(fingerprintContext))
+	h.Write(td.PublicKey[:])
+	h.Write(td.SignPublicKey[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DiscoveryRecord is the TXT record publishing the trust domain's keys.
+func (td *TrustDomainConfig) DiscoveryRecord() string {
+	return fmt.Sprintf("%s pk=%s spk=%s", discoveryTXTPrefix,
+		base64.StdEncoding.EncodeToString(td.PublicKey[:]),
+		base64.StdEncoding.EncodeToString(td.SignPublicKey[:]))
+}
+
+// Discover looks up the address and keys of a trust domain with a DNSName,
+// checking the keys against its Fingerprint. Trust domains without a DNSName
+// are left as configured. The scheme of a configured Address is kept, and
+// is otherwise http.
+func (td *TrustDomainConfig) Discover(ctx context.Context, resolver Resolver) error {
+	if td.DNSName == "" {
+		return nil
+	}
+	if td.Fingerprint == "" {
+		return fmt.Errorf("trust domain %s has no fingerprint to check its keys by", td.DNSName)
+	}
+
+	_, addrs, err := resolver.LookupSRV(ctx, discoveryService, "tcp", td.DNSName)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no SRV record for trust domain %s", td.DNSName)
+	}
+	records, err := resolver.LookupTXT(ctx, td.DNSName)
+	if err != nil {
+		return err
+	}
+	found := &TrustDomainConfig{}
+	if err := found.parseDiscoveryRecord(records); err != nil {
+		return fmt.Errorf("trust domain %s: %v", td.DNSName, err)
+	}
+	if !strings.EqualFold(found.KeyFingerprint(), td.Fingerprint) {
+		return fmt.Errorf("keys published for trust domain %s do not match its fingerprint", td.DNSName)
+	}
+
+	// The resolver orders records by priority, and randomly by weight.
+	scheme := "http"
+	if i := strings.Index(td.Address, "://"); i > 0 {
+		scheme = td.Address[:i]
+	}
+	host := strings.TrimSuffix(addrs[0].Target, ".")
+	td.Address = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(addrs[0].Port)))
+	td.PublicKey = found.PublicKey
+	td.SignPublicKey = found.SignPublicKey
+	td.IsValid = true
+	if td.Name == "" {
+		td.Name = td.DNSName
+	}
+	return nil
+}
+
+// parseDiscoveryRecord takes the keys from the first discovery record among
+// TXT records.
+func (td *TrustDomainConfig) parseDiscoveryRecord(records []string) error {
+	for _, record := range records {
+		fields := strings.Fields(record)
+		if len(fields) == 0 || fields[0] != discoveryTXTPrefix {
+			continue
+		}
+		var pk, spk []byte
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			var err error
+			switch kv[0] {
+			case "pk":
+				pk, err = base64.StdEncoding.DecodeString(kv[1])
+			case "spk":
+				spk, err = base64.StdEncoding.DecodeString(kv[1])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(pk) != len(td.PublicKey) || len(spk) != len(td.SignPublicKey) {
+			return fmt.Errorf("discovery record lacks keys")
+		}
+		copy(td.PublicKey[:], pk)
+		copy(td.SignPublicKey[:], spk)
+		return nil
+	}
+	return fmt.Errorf("no discovery record")
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// staticResolver answers lookups from fixed records.
+type staticResolver struct {
+	srv map[string][]*net.SRV
+	txt map[string][]string
+}
+
+func (s *staticResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	addrs, ok := s.srv["_"+service+"._"+proto+"."+name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return "", addrs, nil
+}
+
+func (s *staticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return s.txt[name], nil
+}
+
+func TestDiscover(t *testing.T) {
+	published := NewTrustDomainConfig("td", "", true, false)
+	resolver := &staticResolver{
+		srv: map[string][]*net.SRV{"_talek._tcp.td.example": {{Target: "replica2.example.", Port: 9002}}},
+		txt: map[string][]string{"td.example": {"v=spf1 -all", published.DiscoveryRecord()}},
+	}
+
+	td := &TrustDomainConfig{DNSName: "td.example", Fingerprint: published.KeyFingerprint(), Address: "https://old.example:9000"}
+	if err := td.Discover(context.Background(), resolver); err != nil {
+		t.Fatal(err)
+	}
+	if td.Address != "https://replica2.example:9002" || !td.IsValid || td.Name != "td.example" {
+		t.Fatalf("Trust domain not discovered: %+v", td)
+	}
+	if td.PublicKey != published.PublicKey || td.SignPublicKey != published.SignPublicKey {
+		t.Fatal("Discovered keys differ from those published.")
+	}
+
+	// Keys not matching the pinned fingerprint are refused.
+	impostor := NewTrustDomainConfig("td", "", true, false)
+	resolver.txt["td.example"] = []string{impostor.DiscoveryRecord()}
+	td = &TrustDomainConfig{DNSName: "td.example", Fingerprint: published.KeyFingerprint()}
+	if err := td.Discover(context.Background(), resolver); err == nil {
+		t.Fatal("Keys not matching the fingerprint should be refused.")
+	}
+	if err := (&TrustDomainConfig{DNSName: "td.example"}).Discover(context.Background(), resolver); err == nil {
+		t.Fatal("Discovery without a fingerprint should be refused.")
+	}
+	if err := (&TrustDomainConfig{DNSName: "gone.example", Fingerprint: "00"}).Discover(context.Background(), resolver); err == nil {
+		t.Fatal("Discovery without an SRV record should fail.")
+	}
+
+	// Trust domains without a DNS name are left alone.
+	static := &TrustDomainConfig{Address: "http://static:9000"}
+	if err := static.Discover(context.Background(), resolver); err != nil || static.Address != "http://static:9000" {
+		t.Fatalf("Configured trust domain changed: %+v, %v", static, err)
+	}
+}
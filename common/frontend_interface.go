@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // FrontendInterface is the interface between libtalek and the frontend
 type FrontendInterface interface {
 	GetName(args *interface{}, reply *string) error
@@ -7,4 +9,13 @@ type FrontendInterface interface {
 	Write(args *WriteArgs, reply *WriteReply) error
 	Read(args *EncodedReadArgs, reply *ReadReply) error
 	GetUpdates(args *GetUpdatesArgs, reply *GetUpdatesReply) error
+	GetCommitment(args *GetCommitmentArgs, reply *GetCommitmentReply) error
+	IssueTokens(args *IssueTokensArgs, reply *IssueTokensReply) error
+}
+
+// ReadStreamer is implemented by frontends which can be handed a read before
+// it is encoded, and encode it as they send it, so that the client needn't
+// hold the request vectors of every trust domain at once.
+type ReadStreamer interface {
+	ReadStream(args *ReadArgs, trustDomains []*TrustDomainConfig, deadline time.Time, reply *ReadReply) error
 }
@@ -2,6 +2,7 @@ package common
 
 import (
 	"errors"
+	"time"
 )
 
 // Error provides RPC errors as strings.
@@ -11,12 +12,40 @@ type Error string
  * PROTOCOL
  *************/
 
+// Priority classes of writes, as flagged by clients.
+const (
+	// WriteInteractive writes carry latency-sensitive messages.
+	WriteInteractive uint8 = iota
+	// WriteBulk writes carry transfers that can wait behind interactive ones.
+	WriteBulk
+)
+
 // WriteArgs are passed in writes.
 type WriteArgs struct {
 	Bucket1        uint64
 	Bucket2        uint64
 	Data           []byte
 	InterestVector []byte // sha256 hash - expect 32bytes
+	TTL            uint64 // Requested retention in write epochs. 0 for no hint.
+	BroadcastKey   []byte // Signing key of a broadcast topic, letting servers verify its placement.
+	BroadcastSeqNo uint64 // Position of the write within its broadcast topic.
+	Priority       uint8  // Scheduling class at the frontend, WriteInteractive or WriteBulk.
+	// When the caller stops waiting. The frontend abandons the write if it is
+	// still queued by then. Zero for none.
+	Deadline time.Time
+	// Identifies the write across retries, so the frontend makes it once.
+	// Zero for none.
+	IdempotencyKey uint64
+	// A solution to the puzzle of the frontend, when it asks for one.
+	PuzzleSeed  []byte
+	PuzzleNonce uint64
+	// An unspent token of the frontend, when it requires one.
+	Token *Token
+	// Generation of the configuration the write was made under, 0 until the
+	// first ConfigTransition.
+	Generation uint64
+	// Size class of the topic written, whose bucket space the write is of.
+	Class uint8
 	//Internal
 	GlobalSeqNo uint64
 	ReplyChan   chan *WriteReply `json:"-"`
@@ -24,8 +53,73 @@ type WriteArgs struct {
 
 // WriteReply contain return status of writes
 type WriteReply struct {
-	Err         string
-	GlobalSeqNo uint64
+	Err           string
+	GlobalSeqNo   uint64
+	FailedDomains []int // Trust domains, by index, that failed the write.
+	// The write epoch the write was sequenced in. It is read by reads
+	// answered in later epochs, once replicas have sealed it.
+	Epoch uint64
+	// Set with Err when the frontend is overloaded: how long to wait before
+	// writing again. The write was not accepted.
+	RetryAfter time.Duration
+	// The puzzle writes must solve while the frontend is under load, nil
+	// otherwise. Set with ErrPuzzleRequired when the write was turned away.
+	Puzzle *Puzzle
+}
+
+// FrontendStats describe a frontend, and the shards of the replicas it reads
+// from.
+type FrontendStats struct {
+	Err      string
+	Replicas []ShardStats // By trust domain index
+
+	Epoch         uint64 // Write epoch in progress
+	SeqNo         uint64 // Last write sequenced
+	PendingWrites int    // Writes waiting to be forwarded to replicas
+	PendingReads  int    // Reads waiting for their batch to be answered
+	// Writes dropped as duplicates of writes of their epoch, since started.
+	DuplicateWrites uint64
+	Standby         bool   // Replicated, and not the leader
+	Generation      uint64 // Of the configuration in use
+	// Recent epochs, oldest first, with noise added by the frontend.
+	Epochs []EpochStats
+
+	// Latencies of reads at the frontend: waiting for their batch, read by
+	// the replica of each trust domain, and from arrival to reply.
+	BatchLatency   Histogram
+	ReplicaLatency []Histogram // By trust domain index
+	ReadLatency    Histogram
+
+	// What the frontend forwarded to each trust domain, by index, against
+	// its quotas.
+	Quotas []TrustDomainUsage
+}
+
+// TrustDomainUsage accounts for the reads and writes a frontend forwarded to
+// the replica of a trust domain, with the quotas it enforces. Zero quotas
+// don't bound.
+type TrustDomainUsage struct {
+	MaxReadBatch     int
+	MaxReadsInFlight int
+	MaxWriteBytes    int // Per write interval
+
+	ReadsForwarded  uint64
+	ReadBatches     uint64
+	ReadsShed       uint64 // Turned away with its reads in flight at quota
+	ReadsInFlight   int
+	WritesForwarded uint64
+	WriteBytes      uint64
+	WriteThrottled  uint64 // Write intervals its quota cut short
+}
+
+// EpochStats count the activity of a write epoch. They are noised for
+// differential privacy before leaving the frontend, and counts below its
+// threshold are reported as 0, so they are estimates.
+type EpochStats struct {
+	Epoch         uint64
+	Writes        uint64
+	Reads         uint64
+	ActiveClients uint64 // Estimated from reads, as clients read at a fixed rate
 }
 
 // PirArgs have the actual PIR for shards to perform.
@@ -37,6 +131,16 @@ type PirArgs struct {
 // ReadArgs have the ReadArgs for each trust domain in unencrypted form.
 type ReadArgs struct {
 	TD []PirArgs
+	// The pad algorithm trust domains answer with. It is not sent.
+	PadAlgorithm uint8
+	// Generation of the configuration the read was made under.
+	Generation uint64
+	// Size class of the bucket space read, and its tier.
+	Class uint8
+	Tier  uint8
+	// When set, the request vectors of TD are left empty, and generated from
+	// Vectors only as the args are encoded.
+	Vectors *RequestVectors
 }
 
 // EncodedReadArgs are a trust-domain-encrypted form of ReadArgs
@@ -44,14 +148,38 @@ type EncodedReadArgs struct {
 	ClientKey [32]byte
 	Nonce     [24]byte
 	PirArgs   [][]byte //An encrypted PirArgs for each trust domain
+	// When the caller stops waiting, after which the read is abandoned. Zero
+	// for none.
+	Deadline time.Time
+	// Identifies the read across retries, which join it while it is in
+	// progress at the frontend. Zero for none.
+	IdempotencyKey uint64
+	// Generation of the configuration the read was made under.
+	Generation uint64
+	// Size class of the bucket space read, and its tier.
+	Class uint8
+	Tier  uint8
 }
 
 // ReadReply contain the response to a read.
 type ReadReply struct {
 	Err            string
+	FailedDomains  []int // Trust domains, by index, that failed the read.
 	Data           []byte
 	GlobalSeqNo    Range
 	LastInterestSN uint64
+	// The write epoch the read was answered in, from the database sealed at
+	// the end of the epoch before, and the GlobalSeqNo of the last write
+	// sealed in it. Writes of earlier epochs are read.
+	Epoch       uint64
+	SealedSeqNo uint64
+	// Set with Err when the frontend is overloaded: how long to wait before
+	// reading again.
+	RetryAfter time.Duration
+	// With Config.VerifyBuckets, the padded audit path of the bucket read, and
+	// the commitment of each trust domain to the buckets it read from.
+	Proof   []byte
+	Buckets []BucketCommitment
 }
 
 // Combine xors two partial read replies together
@@ -65,6 +193,17 @@ func (r *ReadReply) Combine(other []byte) error {
 	return nil
 }
 
+// CombineProof xors two partial audit paths of read replies together.
+func (r *ReadReply) CombineProof(other []byte) error {
+	if len(r.Proof) != len(other) {
+		return errors.New("cannot combine proofs of different length")
+	}
+	for i := 0; i < len(r.Proof); i++ {
+		r.Proof[i] ^= other[i]
+	}
+	return nil
+}
+
 // ReadRequest is the actual request sent to the frontend from libtalek.
 // response occurs on the provided replychan
 type ReadRequest struct {
@@ -87,4 +226,41 @@ type GetUpdatesReply struct {
 	Err            string
 	InterestVector []byte
 	Signature      [][32]byte
+	// The write epoch in progress and the generation of the configuration in
+	// use, with the transition to the next one once it is staged, so clients
+	// can move to it at its epoch.
+	Epoch      uint64
+	Generation uint64
+	Transition *ConfigTransition
+}
+
+// GetCommitmentArgs ask for the commitment to the epoch containing a write.
+type GetCommitmentArgs struct {
+	SeqNo uint64 // GlobalSeqNo of the write, or 0 for the latest epoch.
+}
+
+// IssueTokensArgs ask the frontend to sign tokens blinded for its key KeyID,
+// drawn from the budget of an account. Without blinded tokens, they ask only
+// for the current key.
+type IssueTokensArgs struct {
+	Account string
+	KeyID   [8]byte
+	Blinded [][]byte
+}
+
+// IssueTokensReply has the current key of the frontend, and its signatures of
+// the blinded tokens, in order. Tokens blinded for another key are not signed.
+type IssueTokensReply struct {
+	Err        string
+	Key        *TokenKey
+	Signatures [][]byte
+}
+
+// GetCommitmentReply has an epoch commitment, and the proof of inclusion of
+// the requested write.
+type GetCommitmentReply struct {
+	Err        string
+	Commitment EpochCommitment
+	Index      uint64 // Position of the write among the leaves of the epoch
+	Proof      [][32]byte
 }
@@ -1,8 +1,16 @@
 package common
 
 import (
+	"io"
 	"log"
 	"os"
+	"time"
+)
+
+// Connection to the frontend
+const (
+	frontendKeepAlive      = 30 * time.Second
+	frontendHealthInterval = 5 * time.Second
 )
 
 // FrontendRPC is a stub for RPCs to the talek server.
@@ -11,15 +19,19 @@ type FrontendRPC struct {
 	name         string
 	address      string
 	methodPrefix string
+	pool         *RPCPool
 }
 
-// NewFrontendRPC instantiates a LeaderRPC stub
+// NewFrontendRPC instantiates a LeaderRPC stub. Its calls are multiplexed over
+// a single HTTP/2 connection to the frontend.
 func NewFrontendRPC(name string, address string) *FrontendRPC {
 	f := &FrontendRPC{}
 	f.log = log.New(os.Stdout, "[FrontendRPC:"+name+"] ", log.Ldate|log.Ltime|log.Lshortfile)
 	f.name = name
 	f.address = address
 	f.methodPrefix = "Frontend"
+	f.pool = NewMultiplexedRPCPool(address, frontendKeepAlive, frontendHealthInterval)
+	f.pool.SetRetryPolicy(DefaultRetryPolicy)
 
 	return f
 }
@@ -33,25 +45,99 @@ func (f *FrontendRPC) GetName(_ *interface{}, reply *string) error {
 // GetConfig tells the client about current config.
 func (f *FrontendRPC) GetConfig(_ *interface{}, reply *Config) error {
 	var args interface{}
-	err := RPCCall(f.address, f.methodPrefix+".GetConfig", &args, reply)
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".GetConfig", &args, reply)
 	return err
 }
 
+// Write makes a write, retrying it if it fails in transit. It is given an
+// idempotency key if it has none, so the frontend makes it only once.
 func (f *FrontendRPC) Write(args *WriteArgs, reply *WriteReply) error {
 	//l.log.Printf("Write: enter\n")
-	err := RPCCall(f.address, f.methodPrefix+".Write", args, reply)
+	if args.IdempotencyKey == 0 {
+		args.IdempotencyKey = NewIdempotencyKey()
+	}
+	err := f.pool.CallRetry(args.Deadline, f.methodPrefix+".Write", args, reply)
 	return err
 }
 
+// Read makes a read, retrying it if it fails in transit. It is given an
+// idempotency key if it has none, so retries join a read still in progress.
 func (f *FrontendRPC) Read(args *EncodedReadArgs, reply *ReadReply) error {
 	//l.log.Printf("Read: enter\n")
-	err := RPCCall(f.address, f.methodPrefix+".Read", args, reply)
+	if args.IdempotencyKey == 0 {
+		args.IdempotencyKey = NewIdempotencyKey()
+	}
+	err := f.pool.CallRetry(args.Deadline, f.methodPrefix+".Read", args, reply)
+	return err
+}
+
+// ReadStream makes a read as Read does, encoding it for the trust domains
+// only as it is sent: the args of one trust domain are sealed and written at
+// a time, rather than all of them being held for the call.
+func (f *FrontendRPC) ReadStream(args *ReadArgs, trustDomains []*TrustDomainConfig, deadline time.Time, reply *ReadReply) error {
+	key := NewIdempotencyKey()
+	err := f.pool.CallStream(deadline, f.methodPrefix+".Read", func(w io.Writer) error {
+		return args.EncodeJSON(w, trustDomains, deadline, key)
+	}, reply)
 	return err
 }
 
 // GetUpdates provides the global interest vector.
 func (f *FrontendRPC) GetUpdates(args *GetUpdatesArgs, reply *GetUpdatesReply) error {
 	//l.log.Printf("GetUpdates: enter\n")
-	err := RPCCall(f.address, f.methodPrefix+".GetUpdates", args, reply)
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".GetUpdates", args, reply)
+	return err
+}
+
+// GetCommitment provides the signed commitment to the writes of an epoch.
+func (f *FrontendRPC) GetCommitment(args *GetCommitmentArgs, reply *GetCommitmentReply) error {
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".GetCommitment", args, reply)
+	return err
+}
+
+// IssueTokens signs blinded write tokens of an account.
+func (f *FrontendRPC) IssueTokens(args *IssueTokensArgs, reply *IssueTokensReply) error {
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".IssueTokens", args, reply)
+	return err
+}
+
+// GetStats provides the statistics of the frontend and its replicas.
+func (f *FrontendRPC) GetStats(args *interface{}, reply *FrontendStats) error {
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".GetStats", args, reply)
 	return err
 }
+
+// GetStatus provides the health of the frontend and of the replica of each
+// of its trust domains.
+func (f *FrontendRPC) GetStatus(args *interface{}, reply *ClusterStatus) error {
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".GetStatus", args, reply)
+	return err
+}
+
+// StageTransition stages a transition of the common configuration.
+func (f *FrontendRPC) StageTransition(args *ConfigTransition, reply *TransitionReply) error {
+	err := f.pool.CallRetry(time.Time{}, f.methodPrefix+".StageTransition", args, reply)
+	return err
+}
+
+// Migrate moves the replica of a trust domain to another host. It is not
+// retried, as a migration runs for epochs and can't be repeated while it does.
+func (f *FrontendRPC) Migrate(args *MigrateArgs, reply *MigrateReply) error {
+	return f.pool.Call(f.methodPrefix+".Migrate", args, reply)
+}
+
+// SetLogLevel changes the level of the loggers of a component of the
+// frontend.
+func (f *FrontendRPC) SetLogLevel(args *LogLevelArgs, reply *LogReply) error {
+	return f.pool.Call(f.methodPrefix+".SetLogLevel", args, reply)
+}
+
+// RotateLogs rotates the log file of the frontend.
+func (f *FrontendRPC) RotateLogs(args *interface{}, reply *LogReply) error {
+	return f.pool.Call(f.methodPrefix+".RotateLogs", args, reply)
+}
+
+// Close releases the connection to the frontend.
+func (f *FrontendRPC) Close() {
+	f.pool.Close()
+}
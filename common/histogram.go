@@ -0,0 +1,210 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histograms divide each power of two into histogramSubBuckets buckets,
+// bounding the relative error of a recorded latency to 1/64.
+const (
+	histogramSubBits    = 6
+	histogramSubBuckets = 1 << histogramSubBits
+)
+
+// Histogram counts latencies in log-linear buckets of microseconds, as HDR
+// histograms do: exactly below 64µs, and to within 1/64 of their value above,
+// however long they are. It is plain data, so it can be sent in stats replies,
+// and is not safe for concurrent use; LatencyRecorder is.
+type Histogram struct {
+	Counts []uint64      // By bucket, trimmed after the last non-zero
+	Total  uint64        // Latencies recorded
+	Sum    time.Duration // Of latencies recorded
+	Max    time.Duration
+}
+
+// histogramIndex returns the bucket of a latency of v microseconds.
+func histogramIndex(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histogramSubBits - 1
+	return histogramSubBuckets*(shift+1) + int(v>>uint(shift)) - histogramSubBuckets
+}
+
+// histogramUpper returns the largest latency, in microseconds, of a bucket.
+func histogramUpper(i int) uint64 {
+	if i < histogramSubBuckets {
+		return uint64(i)
+	}
+	shift := uint(i/histogramSubBuckets - 1)
+	top := uint64(i%histogramSubBuckets + histogramSubBuckets)
+	return (top+1)<<shift - 1
+}
+
+// Record counts a latency.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := histogramIndex(uint64(d / time.Microsecond))
+	if i >= len(h.Counts) {
+		h.Counts = append(h.Counts, make([]uint64, i+1-len(h.Counts))...)
+	}
+	h.Counts[i]++
+	h.Total++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Merge adds the latencies of another histogram.
+func (h *Histogram) Merge(o *Histogram) {
+	if len(o.Counts) > len(h.Counts) {
+		h.Counts = append(h.Counts, make([]uint64, len(o.Counts)-len(h.Counts))...)
+	}
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.Total += o.Total
+	h.Sum += o.Sum
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+}
+
+// Since returns the latencies recorded after an earlier snapshot of the same
+// histogram. Its Max is that of the whole histogram.
+func (h *Histogram) Since(prev *Histogram) Histogram {
+	d := Histogram{Counts: append([]uint64(nil), h.Counts...), Max: h.Max}
+	for i := 0; i < len(prev.Counts) && i < len(d.Counts); i++ {
+		d.Counts[i] -= prev.Counts[i]
+	}
+	d.Total = h.Total - prev.Total
+	d.Sum = h.Sum - prev.Sum
+	return d
+}
+
+// Quantile returns the latency below which a fraction q of those recorded
+// fall, rounded up to its bucket, or 0 if none were recorded.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			d := time.Duration(histogramUpper(i)) * time.Microsecond
+			if d > h.Max {
+				d = h.Max
+			}
+			return d
+		}
+	}
+	return h.Max
+}
+
+// Mean returns the mean latency recorded, or 0 if none were.
+func (h *Histogram) Mean() time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Total)
+}
+
+// String summarizes the histogram by its quantiles.
+func (h *Histogram) String() string {
+	return fmt.Sprintf("n=%d p50=%v p90=%v p99=%v max=%v", h.Total, h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max)
+}
+
+// histogramMetricBounds are the upper bounds, in microseconds, of the buckets
+// histograms are exported with: powers of two from 64µs to about a minute.
+var histogramMetricBounds = func() []uint64 {
+	var bounds []uint64
+	for b := uint64(histogramSubBuckets); b <= 1<<26; b <<= 1 {
+		bounds = append(bounds, b)
+	}
+	return bounds
+}()
+
+// WriteMetric writes the histogram in the Prometheus text format, as the
+// metric name in seconds with a set of labels such as `stage="read"`, which
+// may be empty. The HELP and TYPE lines of the metric are written separately,
+// once for all its label sets, by WriteMetricHeader.
+func (h *Histogram) WriteMetric(w io.Writer, name string, labels string) error {
+	seen, i := uint64(0), 0
+	for _, bound := range histogramMetricBounds {
+		for ; i < len(h.Counts) && histogramUpper(i) < bound; i++ {
+			seen += h.Counts[i]
+		}
+		le := fmt.Sprintf("le=\"%g\"", float64(bound)/float64(time.Second/time.Microsecond))
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricLabels(labels, le), seen); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricLabels(labels, `le="+Inf"`), h.Total); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum%s %g\n", name, metricLabels(labels), h.Sum.Seconds()); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count%s %d\n", name, metricLabels(labels), h.Total)
+	return err
+}
+
+// metricLabels joins the non-empty sets of labels of a sample.
+func metricLabels(labels ...string) string {
+	set := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l != "" {
+			set = append(set, l)
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(set, ",") + "}"
+}
+
+// WriteMetricHeader writes the HELP and TYPE lines of a histogram metric.
+func WriteMetricHeader(w io.Writer, name string, help string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	return err
+}
+
+// LatencyRecorder is a Histogram safe for concurrent use.
+type LatencyRecorder struct {
+	lock sync.Mutex
+	h    Histogram
+}
+
+// Record counts a latency.
+func (r *LatencyRecorder) Record(d time.Duration) {
+	r.lock.Lock()
+	r.h.Record(d)
+	r.lock.Unlock()
+}
+
+// RecordSince counts the latency since a start time.
+func (r *LatencyRecorder) RecordSince(start time.Time) {
+	r.Record(time.Since(start))
+}
+
+// Snapshot returns a copy of the latencies recorded so far.
+func (r *LatencyRecorder) Snapshot() Histogram {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	h := r.h
+	h.Counts = append([]uint64(nil), r.h.Counts...)
+	return h
+}
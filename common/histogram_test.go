@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	for v := uint64(0); v < 1<<20; v += 1 + v/100 {
+		i := histogramIndex(v)
+		if upper := histogramUpper(i); upper < v || float64(upper-v) > float64(v)/histogramSubBuckets {
+			t.Fatalf("%dµs is placed in bucket %d up to %dµs", v, i, upper)
+		}
+		if i > 0 && histogramUpper(i-1) >= v {
+			t.Fatalf("%dµs is above bucket %d", v, i)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var r LatencyRecorder
+	for i := 1; i <= 1000; i++ {
+		r.Record(time.Duration(i) * time.Millisecond)
+	}
+	h := r.Snapshot()
+	for _, c := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Millisecond}, {0.99, 990 * time.Millisecond}, {1, time.Second}} {
+		got := h.Quantile(c.q)
+		if got < c.want || got > c.want+c.want/histogramSubBuckets {
+			t.Fatalf("Quantile %v is %v, not about %v", c.q, got, c.want)
+		}
+	}
+	if h.Max != time.Second || h.Mean() != 500500*time.Microsecond {
+		t.Fatalf("Max %v and mean %v", h.Max, h.Mean())
+	}
+
+	r.Record(2 * time.Second)
+	since := r.Snapshot()
+	since = since.Since(&h)
+	if since.Total != 1 || since.Quantile(0.5) < 2*time.Second {
+		t.Fatalf("Since a snapshot recorded %s", since.String())
+	}
+	h.Merge(&since)
+	if all := r.Snapshot(); h.Total != all.Total || h.Sum != all.Sum || h.Max != all.Max {
+		t.Fatal("Merging the difference should give the whole histogram.")
+	}
+}
+
+func TestHistogramMetric(t *testing.T) {
+	var h Histogram
+	h.Record(100 * time.Microsecond)
+	h.Record(10 * time.Millisecond)
+	var out bytes.Buffer
+	WriteMetricHeader(&out, "talek_read_seconds", "Latency of reads.")
+	if err := h.WriteMetric(&out, "talek_read_seconds", `stage="read"`); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE talek_read_seconds histogram",
+		`talek_read_seconds_bucket{stage="read",le="6.4e-05"} 0`,
+		`talek_read_seconds_bucket{stage="read",le="0.000128"} 1`,
+		`talek_read_seconds_bucket{stage="read",le="0.016384"} 2`,
+		`talek_read_seconds_bucket{stage="read",le="+Inf"} 2`,
+		`talek_read_seconds_count{stage="read"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("Metric lacks %q:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package common
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sipHash computes SipHash-c-d of p with the 128-bit key (k0, k1), taking c
+// compression and d finalization rounds. github.com/dchest/siphash only
+// provides SipHash-2-4, which stays the default placement hash; this serves
+// the more conservative variants.
+func sipHash(c int, d int, k0 uint64, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		for i := 0; i < c; i++ {
+			round()
+		}
+		v0 ^= m
+	}
+
+	var last [8]byte
+	copy(last[:], p)
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	for i := 0; i < c; i++ {
+		round()
+	}
+	v0 ^= m
+
+	v2 ^= 0xff
+	for i := 0; i < d; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// BLAKE3 constants, from the specification.
+const (
+	blake3BlockLen   = 64
+	blake3ChunkLen   = 1024
+	blake3KeyLen     = 32
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+	blake3KeyedHash  = 1 << 4
+)
+
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3Compress returns the chaining value of a block of a node.
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [8]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	var out [8]uint32
+	for i := range out {
+		out[i] = s[i] ^ s[i+8]
+	}
+	return out
+}
+
+// blake3Node is a node of the tree awaiting its last compression, which
+// differs for the root.
+type blake3Node struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (n *blake3Node) chainingValue() [8]uint32 {
+	return blake3Compress(&n.cv, &n.block, n.counter, n.blockLen, n.flags)
+}
+
+// blake3Chunk returns the node of the last block of a chunk of at most
+// blake3ChunkLen bytes.
+func blake3Chunk(key *[8]uint32, chunk []byte, counter uint64, flags uint32) blake3Node {
+	n := blake3Node{cv: *key, counter: counter, flags: flags | blake3ChunkStart}
+	for {
+		var buf [blake3BlockLen]byte
+		n.blockLen = uint32(copy(buf[:], chunk))
+		chunk = chunk[n.blockLen:]
+		for i := range n.block {
+			n.block[i] = binary.LittleEndian.Uint32(buf[4*i:])
+		}
+		if len(chunk) == 0 {
+			n.flags |= blake3ChunkEnd
+			return n
+		}
+		n.cv = n.chainingValue()
+		n.flags &^= blake3ChunkStart
+	}
+}
+
+func blake3ParentNode(key *[8]uint32, left [8]uint32, right [8]uint32, flags uint32) blake3Node {
+	n := blake3Node{cv: *key, blockLen: blake3BlockLen, flags: flags | blake3Parent}
+	copy(n.block[:8], left[:])
+	copy(n.block[8:], right[:])
+	return n
+}
+
+// blake3Keyed computes the 256-bit keyed BLAKE3 hash of p.
+func blake3Keyed(key *[blake3KeyLen]byte, p []byte) [32]byte {
+	var k [8]uint32
+	for i := range k {
+		k[i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	return blake3Hash(&k, blake3KeyedHash, p)
+}
+
+func blake3Hash(key *[8]uint32, flags uint32, p []byte) [32]byte {
+	// Every chunk but the last is merged into the stack of subtree chaining
+	// values as soon as it completes, as in the reference implementation.
+	var stack [][8]uint32
+	counter := uint64(0)
+	for len(p) > blake3ChunkLen {
+		chunk := blake3Chunk(key, p[:blake3ChunkLen], counter, flags)
+		cv := chunk.chainingValue()
+		p = p[blake3ChunkLen:]
+		counter++
+		for total := counter; total&1 == 0; total >>= 1 {
+			parent := blake3ParentNode(key, stack[len(stack)-1], cv, flags)
+			cv = parent.chainingValue()
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, cv)
+	}
+	node := blake3Chunk(key, p, counter, flags)
+	for i := len(stack) - 1; i >= 0; i-- {
+		node = blake3ParentNode(key, stack[i], node.chainingValue(), flags)
+	}
+
+	node.flags |= blake3Root
+	cv := node.chainingValue()
+	var out [32]byte
+	for i, w := range cv {
+		binary.LittleEndian.PutUint32(out[4*i:], w)
+	}
+	return out
+}
@@ -0,0 +1,29 @@
+package common
+
+// LogLevelArgs change the level of the loggers of a component of a server at
+// runtime.
+type LogLevelArgs struct {
+	Component string // Empty for all components
+	Level     string // Such as "warn". Empty to only report the levels.
+}
+
+// LogReply reports the level of the loggers of each component of a server.
+type LogReply struct {
+	Err    string
+	Levels map[string]string
+}
+
+// ServeLogLevel serves LogLevelArgs for a server.
+func ServeLogLevel(args *LogLevelArgs, reply *LogReply) {
+	if args.Level != "" {
+		level, err := ParseLevel(args.Level)
+		if err != nil {
+			reply.Err = err.Error()
+			return
+		}
+		if SetLogLevel(args.Component, level) == 0 && args.Component != "" {
+			reply.Err = "no loggers of component " + args.Component + " yet"
+		}
+	}
+	reply.Levels = LogLevels()
+}
@@ -1,44 +1,95 @@
 package common
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
 )
 
+// Level is the least severe level of messages a logger prints.
+type Level int
+
+// Levels of logging, least severe first.
+const (
+	LevelTrace Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = []string{"trace", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < LevelTrace || l > LevelOff {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, such as "warn".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelTrace, fmt.Errorf("unknown log level %q", name)
+}
+
+var loggersLock sync.Mutex
 var loggers = make([]*Logger, 0)
 var loggersSilent = false
 
+// Levels set for components, which loggers created later take too.
+var componentLevels = make(map[string]Level)
+
 // Logger tracks status.
 type Logger struct {
 	name  string
+	level Level // Guarded by loggersLock
 	Trace *log.Logger
 	Info  *log.Logger
 	Warn  *log.Logger
 	Error *log.Logger
 }
 
-// NewLogger makes a logger.
+// NewLogger makes a logger. Its name is the component its level is set by.
 func NewLogger(name string) *Logger {
 	l := &Logger{}
 	l.name = name
-	l.Trace = log.New(os.Stdout, "["+name+"] TRACE: ", log.Ldate|log.Ltime|log.Lshortfile)
-	l.Info = log.New(os.Stdout, "["+name+"] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	l.Warn = log.New(os.Stderr, "["+name+"] WARN: ", log.Ldate|log.Ltime|log.Lshortfile)
-	l.Error = log.New(os.Stderr, "["+name+"] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	l.Trace = log.New(LogStdout, "["+name+"] TRACE: ", log.Ldate|log.Ltime|log.Lshortfile)
+	l.Info = log.New(LogStdout, "["+name+"] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	l.Warn = log.New(LogStderr, "["+name+"] WARN: ", log.Ldate|log.Ltime|log.Lshortfile)
+	l.Error = log.New(LogStderr, "["+name+"] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+	if level, ok := componentLevels[name]; ok {
+		l.level = level
+	} else {
+		l.level = componentLevels[""]
+	}
 	if loggersSilent {
 		l.Disable()
+	} else {
+		l.Enable()
 	}
 	loggers = append(loggers, l)
 	return l
 }
 
-// Enable re-establishes the output for a logger
+// Enable re-establishes the output for a logger, of messages of its level
+// and above.
 func (l *Logger) Enable() {
-	l.Trace.SetOutput(os.Stdout)
-	l.Info.SetOutput(os.Stdout)
-	l.Warn.SetOutput(os.Stderr)
-	l.Error.SetOutput(os.Stderr)
+	l.Trace.SetOutput(levelOutput(l.level, LevelTrace, LogStdout))
+	l.Info.SetOutput(levelOutput(l.level, LevelInfo, LogStdout))
+	l.Warn.SetOutput(levelOutput(l.level, LevelWarn, LogStderr))
+	l.Error.SetOutput(levelOutput(l.level, LevelError, LogStderr))
 }
 
 // Disable will stop this logger from printing
@@ -49,10 +100,113 @@ func (l *Logger) Disable() {
 	l.Error.SetOutput(ioutil.Discard)
 }
 
+func levelOutput(level Level, of Level, w io.Writer) io.Writer {
+	if of < level {
+		return ioutil.Discard
+	}
+	return w
+}
+
 // SilenceLoggers will disable all loggers created with this library
 func SilenceLoggers() {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
 	loggersSilent = true
 	for _, l := range loggers {
 		l.Disable()
 	}
 }
+
+// SetLogLevel sets the level of the loggers of a component, or of all of
+// them if component is empty, including those created later. It returns how
+// many loggers it set.
+func SetLogLevel(component string, level Level) int {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+	if component == "" {
+		componentLevels = map[string]Level{"": level}
+	} else {
+		componentLevels[component] = level
+	}
+	set := 0
+	for _, l := range loggers {
+		if component == "" || l.name == component {
+			l.level = level
+			if !loggersSilent {
+				l.Enable()
+			}
+			set++
+		}
+	}
+	return set
+}
+
+// LogLevels returns the level of each component with a logger.
+func LogLevels() map[string]string {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+	levels := make(map[string]string, len(loggers))
+	for _, l := range loggers {
+		levels[l.name] = l.level.String()
+	}
+	return levels
+}
+
+// logOutput is a writer whose destination can be changed while in use.
+type logOutput struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.w.Write(p)
+}
+
+func (o *logOutput) set(w io.Writer) {
+	o.lock.Lock()
+	o.w = w
+	o.lock.Unlock()
+}
+
+// LogStdout and LogStderr are where loggers print, standard output and
+// error unless redirected by SetLogOutput. Servers give them to loggers of
+// their own, so their logs are redirected too.
+var (
+	logStdout           = &logOutput{w: os.Stdout}
+	logStderr           = &logOutput{w: os.Stderr}
+	LogStdout io.Writer = logStdout
+	LogStderr io.Writer = logStderr
+)
+
+// logFile is the log file set by SetLogOutput, if it rotates.
+var logFile *RotatingFile
+
+// SetLogOutput sends all logging, including that of the standard logger, to
+// w, or back to standard output and error if w is nil.
+func SetLogOutput(w io.Writer) {
+	if w == nil {
+		logStdout.set(os.Stdout)
+		logStderr.set(os.Stderr)
+		log.SetOutput(os.Stderr)
+	} else {
+		logStdout.set(w)
+		logStderr.set(w)
+		log.SetOutput(LogStdout)
+	}
+	loggersLock.Lock()
+	logFile, _ = w.(*RotatingFile)
+	loggersLock.Unlock()
+}
+
+// RotateLogs rotates the log file set by SetLogOutput now.
+func RotateLogs() error {
+	loggersLock.Lock()
+	f := logFile
+	loggersLock.Unlock()
+	if f == nil {
+		return fmt.Errorf("not logging to a rotating file")
+	}
+	return f.Rotate()
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(nil)
+
+	l := NewLogger("leveled")
+	if SetLogLevel("leveled", LevelWarn) != 1 {
+		t.Fatal("Level not set on the logger of the component.")
+	}
+	l.Info.Print("hidden")
+	l.Warn.Print("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Fatalf("Logged %q at level warn.", buf.String())
+	}
+	if LogLevels()["leveled"] != "warn" {
+		t.Fatalf("Level reported as %q.", LogLevels()["leveled"])
+	}
+	if later := NewLogger("leveled"); later.level != LevelWarn {
+		t.Fatal("Logger created later did not take the level of its component.")
+	}
+
+	var reply LogReply
+	ServeLogLevel(&LogLevelArgs{Component: "leveled", Level: "loud"}, &reply)
+	if reply.Err == "" {
+		t.Fatal("Unknown level accepted.")
+	}
+	SetLogLevel("leveled", LevelTrace)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taleklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "talek.log")
+	f, err := OpenRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Fatalf("Kept %d rotated files rather than 2.", len(rotated))
+	}
+	dat, _ := ioutil.ReadFile(path)
+	if string(dat) != "0123456789" {
+		t.Fatalf("Log file holds %q after rotating.", dat)
+	}
+
+	if err := f.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if dat, _ := ioutil.ReadFile(path); len(dat) != 0 {
+		t.Fatal("Log file not emptied by a forced rotation.")
+	}
+}
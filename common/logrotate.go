@@ -0,0 +1,143 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file which is rotated once it grows past a size, or
+// has been written to for longer than an age. Rotated files are renamed with
+// the time they were rotated, and the oldest are deleted beyond those kept.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens a log file, appending to it. maxSize of 0 and
+// maxAge of 0 don't rotate the file by size and age, and keep of 0 keeps
+// all rotated files.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ConfigureLogging sets the level of all loggers, unless level is empty, and
+// sends all logging to a rotating file, unless path is empty, as the server
+// daemons are configured by their flags. It returns the file, if any, to be
+// closed on exit.
+func ConfigureLogging(level string, path string, maxSize int64, maxAge time.Duration, keep int) (*RotatingFile, error) {
+	if level != "" {
+		l, err := ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		SetLogLevel("", l)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	f, err := OpenRotatingFile(path, maxSize, maxAge, keep)
+	if err != nil {
+		return nil, err
+	}
+	SetLogOutput(f)
+	return f, nil
+}
+
+// Write appends to the file, first rotating it if the write would take it
+// past its size, or it is past its age.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (f *RotatingFile) Rotate() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// rotate renames the file aside, opens a new one, and deletes the oldest
+// rotated files beyond those kept. Called with the lock held.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	rotated := fmt.Sprintf("%s.%s", f.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(f.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.keep > 0 {
+		old, err := filepath.Glob(f.path + ".*")
+		if err != nil {
+			return err
+		}
+		sort.Strings(old)
+		for i := 0; i < len(old)-f.keep; i++ {
+			os.Remove(old[i])
+		}
+	}
+	return nil
+}
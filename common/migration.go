@@ -0,0 +1,16 @@
+package common
+
+// MigrateArgs asks a frontend to move the replica of a trust domain to
+// another host. The replica at Address must already hold the state of the
+// trust domain, having joined it from the replica it replaces.
+type MigrateArgs struct {
+	TrustDomain int // Index of the trust domain
+	Address     string
+}
+
+// MigrateReply is the result of a migration, once the frontend has cut over
+// to the new replica or given up.
+type MigrateReply struct {
+	Err   string
+	Epoch uint64 // First epoch the new replica serves
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+// Pad algorithms, as identified by Config.PadAlgorithm.
+const (
+	// PadSipHash pads with the SipHash-2-4 drbg of a pad seed.
+	PadSipHash uint8 = iota
+	// PadAESCTR pads with AES-128 in counter mode, keyed by a pad seed.
+	PadAESCTR
+)
+
+// Pad overlays the reply of a trust domain with the keystream of the pad seed
+// a client sent it. Overlaying twice with the same seed removes the pad, so
+// clients and servers of a deployment must use the same one.
+type Pad interface {
+	Overlay(seed, data []byte) error
+}
+
+type sipPad struct{}
+
+func (sipPad) Overlay(seed, data []byte) error {
+	return drbg.Overlay(seed, data)
+}
+
+type aesPad struct{}
+
+func (aesPad) Overlay(seed, data []byte) error {
+	return drbg.OverlayAES(seed, data)
+}
+
+var pads = map[uint8]Pad{
+	PadSipHash: sipPad{},
+	PadAESCTR:  aesPad{},
+}
+
+// NewPad returns the pad with an algorithm ID.
+func NewPad(id uint8) (Pad, error) {
+	pad, ok := pads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown pad algorithm %d", id)
+	}
+	return pad, nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+func TestPad(t *testing.T) {
+	if _, err := NewPad(255); err == nil {
+		t.Fatal("Unknown pad algorithms should be refused.")
+	}
+
+	s, _ := drbg.NewSeed()
+	seed, _ := s.MarshalBinary()
+	padded := make(map[uint8][]byte)
+	for _, id := range []uint8{PadSipHash, PadAESCTR} {
+		pad, err := NewPad(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 64)
+		pad.Overlay(seed, data)
+		padded[id] = append([]byte{}, data...)
+		pad.Overlay(seed, data)
+		if !bytes.Equal(data, make([]byte, 64)) {
+			t.Fatalf("Pad %d does not remove itself.", id)
+		}
+	}
+	if bytes.Equal(padded[PadSipHash], padded[PadAESCTR]) {
+		t.Fatal("Pad algorithms should pad differently.")
+	}
+}
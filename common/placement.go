@@ -0,0 +1,164 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dchest/siphash"
+	"github.com/privacylab/talek/drbg"
+)
+
+// Bucket placement hashes, as identified by Config.PlacementHash.
+const (
+	// PlacementSipHash keys SipHash-2-4 with a topic seed.
+	PlacementSipHash uint8 = iota
+	// PlacementHMACSHA256 keys HMAC-SHA256 with a topic seed.
+	PlacementHMACSHA256
+	// PlacementSipHash48 keys SipHash-4-8, the conservative variant of
+	// SipHash, with a topic seed.
+	PlacementSipHash48
+	// PlacementBLAKE3 keys BLAKE3 in keyed hash mode with a topic seed.
+	PlacementBLAKE3
+)
+
+// PlacementHash maps the encoded position of an item within a topic to a
+// bucket, keyed by one of the topic's seeds. Clients and servers of a
+// deployment must use the same one.
+type PlacementHash interface {
+	Hash(seed *drbg.Seed, position []byte) uint64
+}
+
+type sipPlacement struct{}
+
+func (sipPlacement) Hash(seed *drbg.Seed, position []byte) uint64 {
+	k0, k1 := seed.KeyUint128()
+	return siphash.Hash(k0, k1, position)
+}
+
+type hmacPlacement struct{}
+
+func (hmacPlacement) Hash(seed *drbg.Seed, position []byte) uint64 {
+	mac := hmac.New(sha256.New, seed.Key())
+	mac.Write(position)
+	return binary.LittleEndian.Uint64(mac.Sum(nil))
+}
+
+type sip48Placement struct{}
+
+func (sip48Placement) Hash(seed *drbg.Seed, position []byte) uint64 {
+	k0, k1 := seed.KeyUint128()
+	return sipHash(4, 8, k0, k1, position)
+}
+
+type blake3Placement struct{}
+
+// Hash keys BLAKE3 with the 128-bit key of the seed, zero padded to the 256
+// bits BLAKE3 takes.
+func (blake3Placement) Hash(seed *drbg.Seed, position []byte) uint64 {
+	var key [blake3KeyLen]byte
+	copy(key[:], seed.Key())
+	sum := blake3Keyed(&key, position)
+	return binary.LittleEndian.Uint64(sum[:])
+}
+
+var placementHashes = map[uint8]PlacementHash{
+	PlacementSipHash:    sipPlacement{},
+	PlacementHMACSHA256: hmacPlacement{},
+	PlacementSipHash48:  sip48Placement{},
+	PlacementBLAKE3:     blake3Placement{},
+}
+
+// NewPlacementHash returns the placement hash with an algorithm ID.
+func NewPlacementHash(id uint8) (PlacementHash, error) {
+	hash, ok := placementHashes[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown placement hash %d", id)
+	}
+	return hash, nil
+}
+
+// Bucket strategies, as identified by Config.BucketStrategy. Each gives an
+// item two buckets, since writes, reads and the cuckoo tables of servers all
+// carry two.
+const (
+	// StrategyTwoSeeds hashes the position of an item with each of the two
+	// seeds of its topic to a bucket anywhere in the table. Servers try one
+	// of them at random first.
+	StrategyTwoSeeds uint8 = iota
+	// StrategyLeastLoaded draws buckets as StrategyTwoSeeds does, and servers
+	// try the less loaded first: the power of two choices.
+	StrategyLeastLoaded
+	// StrategyTwoLeft draws the first bucket from the left half of the table
+	// and the second from the right, and servers try the left one first
+	// unless it is more loaded: the d-left scheme, with d = 2.
+	StrategyTwoLeft
+)
+
+// BucketStrategy chooses the buckets an item may be placed in, and which of
+// them servers try first. Clients derive the buckets they write and read by
+// it and servers place items by it, so those of a deployment must use the
+// same one.
+type BucketStrategy interface {
+	// Buckets returns the buckets of the item at an encoded position of a
+	// topic with the given seeds.
+	Buckets(conf *Config, hash PlacementHash, seed1 *drbg.Seed, seed2 *drbg.Seed, position []byte) (uint64, uint64)
+	// First returns which bucket of an item, 1 or 2, is tried first, given
+	// how many items each holds and a fair coin of 0 or 1. It must depend on
+	// nothing else, so replicas placing the same items agree.
+	First(load1 uint64, load2 uint64, coin int) int
+}
+
+type twoSeeds struct{}
+
+func (twoSeeds) Buckets(conf *Config, hash PlacementHash, seed1 *drbg.Seed, seed2 *drbg.Seed, position []byte) (uint64, uint64) {
+	return hash.Hash(seed1, position) % conf.NumBuckets, hash.Hash(seed2, position) % conf.NumBuckets
+}
+
+func (twoSeeds) First(_ uint64, _ uint64, coin int) int {
+	return 1 + coin
+}
+
+type leastLoaded struct{ twoSeeds }
+
+func (leastLoaded) First(load1 uint64, load2 uint64, coin int) int {
+	if load1 < load2 {
+		return 1
+	} else if load2 < load1 {
+		return 2
+	}
+	return 1 + coin
+}
+
+type twoLeft struct{}
+
+func (twoLeft) Buckets(conf *Config, hash PlacementHash, seed1 *drbg.Seed, seed2 *drbg.Seed, position []byte) (uint64, uint64) {
+	left := conf.NumBuckets / 2
+	if left == 0 {
+		return twoSeeds{}.Buckets(conf, hash, seed1, seed2, position)
+	}
+	return hash.Hash(seed1, position) % left, left + hash.Hash(seed2, position)%(conf.NumBuckets-left)
+}
+
+func (twoLeft) First(load1 uint64, load2 uint64, _ int) int {
+	if load2 < load1 {
+		return 2
+	}
+	return 1
+}
+
+var bucketStrategies = map[uint8]BucketStrategy{
+	StrategyTwoSeeds:    twoSeeds{},
+	StrategyLeastLoaded: leastLoaded{},
+	StrategyTwoLeft:     twoLeft{},
+}
+
+// NewBucketStrategy returns the bucket strategy with an ID.
+func NewBucketStrategy(id uint8) (BucketStrategy, error) {
+	strategy, ok := bucketStrategies[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket strategy %d", id)
+	}
+	return strategy, nil
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dchest/siphash"
+	"github.com/privacylab/talek/drbg"
+)
+
+func TestPlacementHash(t *testing.T) {
+	if _, err := NewPlacementHash(255); err == nil {
+		t.Fatal("Unknown placement hashes should be refused.")
+	}
+
+	seed1, _ := drbg.NewSeed()
+	seed2, _ := drbg.NewSeed()
+	sip := &Config{NumBuckets: 1 << 16}
+	keyed := &Config{NumBuckets: 1 << 16, PlacementHash: PlacementHMACSHA256}
+
+	differ := false
+	for seqNo := uint64(0); seqNo < 8; seqNo++ {
+		b1, b2 := ItemBuckets(keyed, seed1, seed2, seqNo)
+		if r1, r2 := ItemBuckets(keyed, seed1, seed2, seqNo); r1 != b1 || r2 != b2 {
+			t.Fatal("Placement is not deterministic.")
+		}
+		if b1 >= keyed.NumBuckets || b2 >= keyed.NumBuckets {
+			t.Fatalf("Buckets %d, %d out of range", b1, b2)
+		}
+		if s1, s2 := ItemBuckets(sip, seed1, seed2, seqNo); s1 != b1 || s2 != b2 {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Fatal("Placement hashes should place items differently.")
+	}
+
+	key := make([]byte, 32)
+	s1, s2, _ := BroadcastSeeds(key)
+	b1, b2 := ItemBuckets(keyed, s1, s2, 0)
+	args := &WriteArgs{Bucket1: b1, Bucket2: b2, BroadcastKey: key}
+	if !VerifyBroadcast(args, keyed) {
+		t.Fatal("Broadcast placed by the configured hash should verify.")
+	}
+	if sb1, sb2 := ItemBuckets(sip, s1, s2, 0); (sb1 != b1 || sb2 != b2) && VerifyBroadcast(args, sip) {
+		t.Fatal("Broadcast placed by another hash should not verify.")
+	}
+}
+
+func TestKeyedHashVectors(t *testing.T) {
+	// SipHash vectors are of the key 00..0f, over the empty message and
+	// 00..0e; 2-4 from the SipHash paper, 4-8 pinning this implementation.
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for _, c := range []struct {
+		c, d int
+		msg  []byte
+		want uint64
+	}{
+		{2, 4, nil, 0x726fdb47dd0e0e31},
+		{2, 4, msg, 0xa129ca6149be45e5},
+		{4, 8, nil, 0xc879052b9938da41},
+		{4, 8, msg, 0x83d389d57da9a6e0},
+	} {
+		if got := sipHash(c.c, c.d, k0, k1, c.msg); got != c.want {
+			t.Fatalf("SipHash-%d-%d of %d bytes is %#x, not %#x", c.c, c.d, len(c.msg), got, c.want)
+		}
+	}
+	for n := range msg {
+		if sipHash(2, 4, k0, k1, msg[:n]) != siphash.Hash(k0, k1, msg[:n]) {
+			t.Fatal("SipHash-2-4 should agree with github.com/dchest/siphash.")
+		}
+	}
+
+	// BLAKE3 vectors are from the official test vectors, over the input
+	// i % 251 of each length.
+	input := make([]byte, 1025)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	for _, c := range []struct {
+		n    int
+		want string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	} {
+		iv := blake3IV
+		if got := blake3Hash(&iv, 0, input[:c.n]); hex.EncodeToString(got[:]) != c.want {
+			t.Fatalf("BLAKE3 of %d bytes is %x", c.n, got)
+		}
+	}
+	var key [blake3KeyLen]byte
+	copy(key[:], "whats the Elvish word for friend")
+	if got := blake3Keyed(&key, nil); hex.EncodeToString(got[:]) != "92b2b75604ed3c761f9d6f62392c8a9227ad0ea3f09573e783f1498a4ed60d26" {
+		t.Fatalf("Keyed BLAKE3 of no bytes is %x", got)
+	}
+}
+
+func TestPlacementVectors(t *testing.T) {
+	// Placement of the first items of the broadcast topic of the zero key,
+	// which clients and servers of every deployment must agree on.
+	s1, s2, err := BroadcastSeeds(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		id   uint8
+		want [4]uint64 // Seed 1 and 2 at seqNo 0, then at seqNo 1
+	}{
+		{PlacementSipHash, [4]uint64{0x72b4a251e9f51bbf, 0x565756171482447d, 0x2cd534dc69a1812a, 0x0168a1392630b667}},
+		{PlacementHMACSHA256, [4]uint64{0x24476266aa8a48bd, 0x1f6aba7de8b1dd0a, 0x8af4230beb397b46, 0x2235411a18581380}},
+		{PlacementSipHash48, [4]uint64{0xf3f6876cfbf886f6, 0x3617be66f35fa22a, 0x3aac2108a585d2c6, 0xbd8bfc585526c74b}},
+		{PlacementBLAKE3, [4]uint64{0x06e982732eda2773, 0x9063cd7a28f546df, 0x370fe275ef555af4, 0x62bea5b166fdfe3a}},
+	} {
+		hash, err := NewPlacementHash(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for seqNo := uint64(0); seqNo < 2; seqNo++ {
+			position := make([]byte, 24)
+			binary.PutUvarint(position, seqNo)
+			h1, h2 := hash.Hash(s1, position), hash.Hash(s2, position)
+			if h1 != c.want[2*seqNo] || h2 != c.want[2*seqNo+1] {
+				t.Fatalf("Placement hash %d placed item %d at %#x, %#x", c.id, seqNo, h1, h2)
+			}
+		}
+	}
+}
+
+func TestBucketStrategy(t *testing.T) {
+	if _, err := NewBucketStrategy(255); err == nil {
+		t.Fatal("Unknown bucket strategies should be refused.")
+	}
+
+	seed1, _ := drbg.NewSeed()
+	seed2, _ := drbg.NewSeed()
+	conf := &Config{NumBuckets: 1001}
+	left := &Config{NumBuckets: 1001, BucketStrategy: StrategyTwoLeft}
+	least := &Config{NumBuckets: 1001, BucketStrategy: StrategyLeastLoaded}
+	for seqNo := uint64(0); seqNo < 64; seqNo++ {
+		// Items are where they were before strategies could be chosen.
+		position := make([]byte, 24)
+		binary.PutUvarint(position, seqNo)
+		b1, b2 := ItemBuckets(conf, seed1, seed2, seqNo)
+		sip := sipPlacement{}
+		if b1 != sip.Hash(seed1, position)%1001 || b2 != sip.Hash(seed2, position)%1001 {
+			t.Fatal("Two seeds should place items as before.")
+		}
+		if l1, l2 := ItemBuckets(least, seed1, seed2, seqNo); l1 != b1 || l2 != b2 {
+			t.Fatal("Least loaded should draw the buckets of two seeds.")
+		}
+		if l1, l2 := ItemBuckets(left, seed1, seed2, seqNo); l1 >= 500 || l2 < 500 || l2 >= 1001 {
+			t.Fatalf("Two left drew buckets %d, %d", l1, l2)
+		}
+	}
+
+	for _, c := range []struct {
+		strategy     uint8
+		load1, load2 uint64
+		coin, first  int
+	}{
+		{StrategyTwoSeeds, 0, 5, 1, 2},
+		{StrategyLeastLoaded, 0, 5, 1, 1},
+		{StrategyLeastLoaded, 5, 0, 0, 2},
+		{StrategyLeastLoaded, 3, 3, 1, 2},
+		{StrategyTwoLeft, 3, 3, 1, 1},
+		{StrategyTwoLeft, 4, 3, 0, 2},
+	} {
+		strategy, _ := NewBucketStrategy(c.strategy)
+		if first := strategy.First(c.load1, c.load2, c.coin); first != c.first {
+			t.Fatalf("Strategy %d tried bucket %d first of loads %d, %d", c.strategy, first, c.load1, c.load2)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// MaxPuzzleDifficulty bounds the leading zero bits a puzzle may ask for, so a
+// frontend can't set work a client could never finish.
+const MaxPuzzleDifficulty = 32
+
+// MaxPuzzleSeed bounds the seed of a puzzle.
+const MaxPuzzleSeed = 32
+
+// ErrPuzzleRequired turns away a write without a solution to the current
+// puzzle of the frontend, which the reply carries.
+var ErrPuzzleRequired = errors.New("write needs a solution to the puzzle of the frontend")
+
+// Puzzle is a proof of work a frontend under load asks of writes, throttling
+// floods without identifying who sends them. A solution is a nonce for which
+// the hash of the seed, the write and the nonce has Difficulty leading zero
+// bits. It is bound to the write, so one solution can't carry many writes.
+type Puzzle struct {
+	Seed       []byte
+	Difficulty uint8
+}
+
+// Solve finds a solution for a write, and sets it on the write.
+func (p *Puzzle) Solve(w *WriteArgs) {
+	digest := writeDigest(w)
+	var nonce uint64
+	for leadingZeros(puzzleHash(p.Seed, &digest, nonce)) < int(p.Difficulty) {
+		nonce++
+	}
+	w.PuzzleSeed = p.Seed
+	w.PuzzleNonce = nonce
+}
+
+// Verify checks the write carries a solution to the puzzle, returning the
+// hash of the solution, by which replays can be recognized.
+func (p *Puzzle) Verify(w *WriteArgs) ([32]byte, bool) {
+	if string(w.PuzzleSeed) != string(p.Seed) {
+		return [32]byte{}, false
+	}
+	digest := writeDigest(w)
+	hash := puzzleHash(p.Seed, &digest, w.PuzzleNonce)
+	return hash, leadingZeros(hash) >= int(p.Difficulty)
+}
+
+// writeDigest covers what a write places in the database.
+func writeDigest(w *WriteArgs) [32]byte {
+	h := sha256.New()
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:], w.Bucket1)
+	binary.LittleEndian.PutUint64(b[8:], w.Bucket2)
+	h.Write(b[:])
+	h.Write(w.Data)
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func puzzleHash(seed []byte, digest *[32]byte, nonce uint64) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("talek puzzle"))
+	h.Write(seed)
+	h.Write(digest[:])
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], nonce)
+	h.Write(b[:])
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func leadingZeros(hash [32]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
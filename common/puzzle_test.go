@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPuzzle(t *testing.T) {
+	puzzle := &Puzzle{Seed: bytes.Repeat([]byte{7}, MaxPuzzleSeed), Difficulty: 10}
+	w := &WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello")}
+	puzzle.Solve(w)
+	hash, ok := puzzle.Verify(w)
+	if !ok {
+		t.Fatal("Solution was not verified.")
+	}
+	if leadingZeros(hash) < 10 {
+		t.Fatalf("Solution has %d leading zero bits", leadingZeros(hash))
+	}
+
+	// Solutions are bound to the write and the seed.
+	moved := *w
+	moved.Bucket2 = 3
+	if _, ok := puzzle.Verify(&moved); ok {
+		t.Fatal("Solution carried a write to other buckets.")
+	}
+	changed := *w
+	changed.Data = []byte("jello")
+	if _, ok := puzzle.Verify(&changed); ok {
+		t.Fatal("Solution carried other data.")
+	}
+	other := &Puzzle{Seed: bytes.Repeat([]byte{8}, MaxPuzzleSeed), Difficulty: 10}
+	if _, ok := other.Verify(w); ok {
+		t.Fatal("Solution verified against another seed.")
+	}
+	if _, ok := (&Puzzle{Seed: puzzle.Seed, Difficulty: 10}).Verify(&WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello")}); ok {
+		t.Fatal("Write without a solution verified.")
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	var hash [32]byte
+	if leadingZeros(hash) != 256 {
+		t.Fatalf("Zero hash has %d leading zeros", leadingZeros(hash))
+	}
+	hash[1] = 0x10
+	if leadingZeros(hash) != 11 {
+		t.Fatalf("Expected 11 leading zeros, got %d", leadingZeros(hash))
+	}
+}
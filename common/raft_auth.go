@@ -0,0 +1,189 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// Contexts prefix the canonical encodings of the RPCs between the frontends of
+// a trust domain replicating the sequence of writes, which they sign with the
+// key of the trust domain they share.
+const (
+	raftVoteContext     = "talek raft vote v1"
+	raftAppendContext   = "talek raft append v1"
+	raftSnapshotContext = "talek raft snapshot v1"
+)
+
+// RaftCallWindow is how far from the time a member receives a call it may
+// have been sent.
+const RaftCallWindow = time.Minute
+
+// RaftArgs are the args of an RPC between replicating frontends, which peers
+// answer only when signed.
+type RaftArgs interface {
+	Canonical() []byte
+	// Sender is the member making the call.
+	Sender() int
+	// RaftCall addresses and stamps the call.
+	RaftCall() *RaftCall
+	signature() *[64]byte
+}
+
+// RaftCalls stamps the calls a member makes to one of its peers, each later
+// than the last.
+type RaftCalls struct {
+	To int
+
+	lock sync.Mutex
+	last time.Time
+}
+
+// Sign addresses args to the peer, stamps them, and signs them with the key
+// of the trust domain.
+func (c *RaftCalls) Sign(td *TrustDomainConfig, args RaftArgs) {
+	c.lock.Lock()
+	sent := time.Now().Round(0)
+	if !sent.After(c.last) {
+		sent = c.last.Add(time.Nanosecond)
+	}
+	c.last = sent
+	c.lock.Unlock()
+	*args.RaftCall() = RaftCall{To: c.To, Sent: sent}
+	td.SignRaft(args)
+}
+
+// call writes the address and stamp of a call.
+func (buf *canonicalBuffer) call(c *RaftCall) {
+	buf.u64(uint64(c.To))
+	buf.time(c.Sent)
+}
+
+// Canonical is the encoding of a request for a vote its candidate signs.
+func (a *RequestVoteArgs) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(raftVoteContext)
+	buf.call(&a.Call)
+	buf.u64(a.Term)
+	buf.u64(uint64(a.Candidate))
+	buf.u64(a.LastLogIndex)
+	buf.u64(a.LastLogTerm)
+	return buf.Bytes()
+}
+
+// Sender is the member making the call.
+func (a *RequestVoteArgs) Sender() int {
+	return a.Candidate
+}
+
+// RaftCall addresses and stamps the call.
+func (a *RequestVoteArgs) RaftCall() *RaftCall {
+	return &a.Call
+}
+
+func (a *RequestVoteArgs) signature() *[64]byte {
+	return &a.Signature
+}
+
+// Canonical is the encoding of entries replicated by the leader it signs. Of
+// the writes, the fields forwarded to replicas are written.
+func (a *AppendEntriesArgs) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(raftAppendContext)
+	buf.call(&a.Call)
+	buf.u64(a.Term)
+	buf.u64(uint64(a.Leader))
+	buf.u64(a.PrevLogIndex)
+	buf.u64(a.PrevLogTerm)
+	buf.u64(a.LeaderCommit)
+	buf.u64(a.Forwarded)
+	buf.u64(uint64(len(a.Entries)))
+	for i := range a.Entries {
+		e := &a.Entries[i]
+		buf.u64(e.Term)
+		buf.flag(e.EpochEnd)
+		buf.flag(e.Write != nil)
+		if w := e.Write; w != nil {
+			buf.u64(w.Bucket1)
+			buf.u64(w.Bucket2)
+			buf.data(w.Data)
+			buf.data(w.InterestVector)
+			buf.u64(w.TTL)
+			buf.data(w.BroadcastKey)
+			buf.u64(w.BroadcastSeqNo)
+			buf.u64(w.Generation)
+			buf.WriteByte(w.Class)
+			buf.u64(w.GlobalSeqNo)
+		}
+		buf.transition(e.Transition)
+	}
+	return buf.Bytes()
+}
+
+// Sender is the member making the call.
+func (a *AppendEntriesArgs) Sender() int {
+	return a.Leader
+}
+
+// RaftCall addresses and stamps the call.
+func (a *AppendEntriesArgs) RaftCall() *RaftCall {
+	return &a.Call
+}
+
+func (a *AppendEntriesArgs) signature() *[64]byte {
+	return &a.Signature
+}
+
+// Canonical is the encoding of a snapshot installed by the leader it signs.
+func (a *InstallSnapshotArgs) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(raftSnapshotContext)
+	buf.call(&a.Call)
+	buf.u64(a.Term)
+	buf.u64(uint64(a.Leader))
+	buf.u64(a.Forwarded)
+	s := &a.Snapshot
+	buf.u64(s.Index)
+	buf.u64(s.Term)
+	buf.u64(s.Epoch)
+	buf.u64(s.Writes)
+	buf.u64(s.SeqNo)
+	buf.transition(s.Transition)
+	return buf.Bytes()
+}
+
+// Sender is the member making the call.
+func (a *InstallSnapshotArgs) Sender() int {
+	return a.Leader
+}
+
+// RaftCall addresses and stamps the call.
+func (a *InstallSnapshotArgs) RaftCall() *RaftCall {
+	return &a.Call
+}
+
+func (a *InstallSnapshotArgs) signature() *[64]byte {
+	return &a.Signature
+}
+
+// transition writes a transition, if any, and whether there is one.
+func (buf *canonicalBuffer) transition(t *ConfigTransition) {
+	buf.flag(t != nil)
+	if t != nil {
+		buf.u64(t.Generation)
+		buf.u64(t.Epoch)
+		buf.u64(t.Crossover)
+		buf.config(&t.Next)
+	}
+}
+
+// SignRaft signs an RPC to a peer replicating the writes of the trust domain.
+func (td *TrustDomainConfig) SignRaft(args RaftArgs) {
+	*args.signature() = *ed25519.Sign(td.signPrivateKey, args.Canonical())
+}
+
+// VerifyRaft checks that an RPC from a peer was signed by the trust domain.
+func (td *TrustDomainConfig) VerifyRaft(args RaftArgs) bool {
+	return ed25519.Verify(&td.SignPublicKey, args.Canonical(), args.signature())
+}
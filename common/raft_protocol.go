@@ -0,0 +1,96 @@
+package common
+
+import "time"
+
+// RaftPeer is the interface between the frontends of a trust domain which
+// replicate the sequence of accepted writes.
+type RaftPeer interface {
+	RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// RaftEntry is an entry of the replicated log of sequenced writes, epoch
+// advances and staged configuration transitions. Entries with none of them are
+// made by a new leader to commit the log it inherited.
+type RaftEntry struct {
+	Term       uint64
+	Write      *WriteArgs
+	EpochEnd   bool
+	Transition *ConfigTransition
+}
+
+// RaftSnapshot stands in for the entries of the replicated log up to Index once
+// they are compacted away, with what a leader taking over rebuilds from them.
+// Logs are compacted only at the end of an epoch.
+type RaftSnapshot struct {
+	Index      uint64            // Of the last entry compacted
+	Term       uint64            // Of the last entry compacted
+	Epoch      uint64            // Epochs ended by the entries
+	Writes     uint64            // Writes sequenced by the entries
+	SeqNo      uint64            // Of the last write sequenced
+	Transition *ConfigTransition // Last transition staged, if any
+}
+
+// RaftCall addresses an RPC between replicating frontends to a member, and
+// stamps it with when it was sent. Signed with the args, it keeps a call from
+// being replayed to another member, or again to the same one.
+type RaftCall struct {
+	To   int       // Member the call is sent to
+	Sent time.Time // Later than that of any earlier call to the member
+}
+
+// RequestVoteArgs are sent by a candidate to become leader.
+type RequestVoteArgs struct {
+	Term         uint64
+	Candidate    int
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	Call         RaftCall
+	// Signature of the Canonical args with the key of the trust domain.
+	Signature [64]byte
+}
+
+// RequestVoteReply grants or refuses a vote.
+type RequestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendEntriesArgs replicate the leader's log, and serve as its heartbeat.
+type AppendEntriesArgs struct {
+	Term         uint64
+	Leader       int
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []RaftEntry
+	LeaderCommit uint64
+	Forwarded    uint64 // Last entry the leader has forwarded to replicas
+	Call         RaftCall
+	// Signature of the Canonical args with the key of the trust domain.
+	Signature [64]byte
+}
+
+// AppendEntriesReply acknowledges appended entries.
+type AppendEntriesReply struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64 // Last index of the follower's log, to back up to on failure
+}
+
+// InstallSnapshotArgs replace the log of a follower so far behind that the
+// entries it lacks have been compacted away.
+type InstallSnapshotArgs struct {
+	Term      uint64
+	Leader    int
+	Snapshot  RaftSnapshot
+	Forwarded uint64 // Last entry the leader has forwarded to replicas
+	Call      RaftCall
+	// Signature of the Canonical args with the key of the trust domain.
+	Signature [64]byte
+}
+
+// InstallSnapshotReply acknowledges an installed snapshot.
+type InstallSnapshotReply struct {
+	Term uint64
+}
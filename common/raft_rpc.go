@@ -0,0 +1,62 @@
+package common
+
+import (
+	"log"
+	"os"
+)
+
+// RaftRPC is a stub for the replication interface of a peer frontend. Calls
+// are signed with the key of the trust domain the frontends share.
+type RaftRPC struct {
+	log          *log.Logger
+	name         string
+	methodPrefix string
+	pool         *RPCPool
+	trustDomain  *TrustDomainConfig
+	calls        RaftCalls
+}
+
+// NewRaftRPC creates a new RaftRPC to member to at address, signing calls
+// with the private key of trustDomain.
+func NewRaftRPC(name string, address string, to int, trustDomain *TrustDomainConfig) *RaftRPC {
+	r := &RaftRPC{}
+	r.log = log.New(os.Stdout, "[RaftRPC:"+name+"] ", log.Ldate|log.Ltime|log.Lshortfile)
+	r.name = name
+	r.methodPrefix = "Raft"
+	// Raft has its own failure detection, so the pool is not health checked.
+	r.pool = NewRPCPool(address, 2, replicaKeepAlive, 0)
+	r.trustDomain = trustDomain
+	r.calls.To = to
+
+	return r
+}
+
+// RequestVote asks the peer to vote for a candidate.
+func (r *RaftRPC) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	// Args may be shared by calls to several peers, so a copy is signed.
+	signed := *args
+	r.calls.Sign(r.trustDomain, &signed)
+	err := r.pool.Call(r.methodPrefix+".RequestVote", &signed, reply)
+	return err
+}
+
+// AppendEntries replicates log entries to the peer.
+func (r *RaftRPC) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	signed := *args
+	r.calls.Sign(r.trustDomain, &signed)
+	err := r.pool.Call(r.methodPrefix+".AppendEntries", &signed, reply)
+	return err
+}
+
+// InstallSnapshot replaces the log of a peer behind the compacted log.
+func (r *RaftRPC) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	signed := *args
+	r.calls.Sign(r.trustDomain, &signed)
+	err := r.pool.Call(r.methodPrefix+".InstallSnapshot", &signed, reply)
+	return err
+}
+
+// Close releases the connections to the peer.
+func (r *RaftRPC) Close() {
+	r.pool.Close()
+}
@@ -8,47 +8,78 @@ package common
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
 
 // Encode encrypts a read request for a given trust domain configuration.
 func (r *ReadArgs) Encode(trustDomains []*TrustDomainConfig) (out EncodedReadArgs, err error) {
-	pubKey, priKey, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		return
-	}
-	nonce := make([]byte, 24)
-	_, err = rand.Read(nonce)
+	s, err := r.newSealer(trustDomains)
 	if err != nil {
 		return
 	}
-
-	// Allocate memory
-	copy(out.ClientKey[:], pubKey[:])
-	copy(out.Nonce[:], nonce)
-
+	out.ClientKey = s.clientKey
+	out.Nonce = s.nonce
+	out.Generation = r.Generation
+	out.Class = r.Class
+	out.Tier = r.Tier
 	out.PirArgs = make([][]byte, len(trustDomains))
-
-	for i := 0; i < len(trustDomains); i++ {
-		var msg bytes.Buffer
-		enc := gob.NewEncoder(&msg)
-		err = enc.Encode(r.TD[i])
-		if err != nil {
+	for i := range trustDomains {
+		if out.PirArgs[i], err = s.seal(i); err != nil {
 			return
 		}
-		msgBytes := msg.Bytes()
-		out.PirArgs[i] = make([]byte, 0, len(msgBytes)+box.Overhead)
-		ret := box.Seal(out.PirArgs[i], msgBytes, &out.Nonce, &trustDomains[i].PublicKey, priKey)
-		out.PirArgs[i] = ret
 	}
 	return
 }
 
+// EncodeJSON writes the read, encoded for the trust domains, as the JSON of
+// the EncodedReadArgs Encode would return. The args of each trust domain are
+// sealed only as they are written, so a single request vector is in memory
+// at a time, however many trust domains there are.
+func (r *ReadArgs) EncodeJSON(w io.Writer, trustDomains []*TrustDomainConfig, deadline time.Time, idempotencyKey uint64) error {
+	s, err := r.newSealer(trustDomains)
+	if err != nil {
+		return err
+	}
+	clientKey, _ := json.Marshal(s.clientKey)
+	nonce, _ := json.Marshal(s.nonce)
+	if _, err = fmt.Fprintf(w, `{"ClientKey":%s,"Nonce":%s,"PirArgs":[`, clientKey, nonce); err != nil {
+		return err
+	}
+	for i := range trustDomains {
+		sealed, err := s.seal(i)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err = writeJSONBytes(w, sealed); err != nil {
+			return err
+		}
+	}
+	deadlineJSON, err := json.Marshal(deadline)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `],"Deadline":%s,"IdempotencyKey":%d,"Generation":%d,"Class":%d,"Tier":%d}`, deadlineJSON, idempotencyKey, r.Generation, r.Class, r.Tier)
+	return err
+}
+
 // Bucket returns the bucket index that a read requests, or -1 for invalid args.
 func (r *ReadArgs) Bucket() int {
+	if r.Vectors != nil {
+		return r.Vectors.Bucket
+	}
 	finalvec := make([]byte, len(r.TD[0].RequestVector))
 	for i := 0; i < len(r.TD); i++ {
 		for j := 0; j < len(finalvec); j++ {
@@ -72,13 +103,267 @@ func (r *ReadArgs) Bucket() int {
 
 // Decode decrypts a specific trust domain of encoded args to recover the pad and request vector.
 func (r *EncodedReadArgs) Decode(id int, trustDomain *TrustDomainConfig) (out PirArgs, err error) {
-	if len(r.PirArgs[id]) < box.Overhead {
+	if id < 0 || id >= len(r.PirArgs) || len(r.PirArgs[id]) < box.Overhead {
 		err = errors.New("Attempted Decoding of invalid Trust Domain")
 		return
 	}
+	if trustDomain.privateKey == nil {
+		err = errors.New("trust domain has no private key")
+		return
+	}
 	msg := make([]byte, 0, len(r.PirArgs[id])-box.Overhead)
-	decrypted, _ := box.Open(msg, r.PirArgs[id], &r.Nonce, &r.ClientKey, &trustDomain.privateKey)
-	dec := gob.NewDecoder(bytes.NewBuffer(decrypted))
-	err = dec.Decode(&out)
-	return
+	decrypted, ok := box.Open(msg, r.PirArgs[id], &r.Nonce, &r.ClientKey, trustDomain.privateKey)
+	if !ok {
+		err = errors.New("read args failed to decrypt")
+		return
+	}
+	return decodePirArgs(decrypted)
+}
+
+/** PRIVATE METHODS **/
+
+// readSealer seals the args of a read for each of its trust domains, under
+// one ephemeral client key.
+type readSealer struct {
+	args      *ReadArgs
+	clientKey [32]byte
+	nonce     [24]byte
+	shared    []*[32]byte // Keys shared with each trust domain
+	plain     []byte      // Reused for the args of each trust domain
+}
+
+func (r *ReadArgs) newSealer(trustDomains []*TrustDomainConfig) (*readSealer, error) {
+	if len(r.TD) < len(trustDomains) {
+		return nil, fmt.Errorf("read has args for %d trust domains rather than %d", len(r.TD), len(trustDomains))
+	}
+	if r.Vectors != nil && len(r.Vectors.Seeds) < len(trustDomains) {
+		return nil, fmt.Errorf("read has request vectors for %d trust domains rather than %d", len(r.Vectors.Seeds), len(trustDomains))
+	}
+	pubKey, priKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &readSealer{args: r, clientKey: *pubKey}
+	if _, err = rand.Read(s.nonce[:]); err != nil {
+		return nil, err
+	}
+	s.shared = make([]*[32]byte, len(trustDomains))
+	for i, td := range trustDomains {
+		s.shared[i] = new([32]byte)
+		box.Precompute(s.shared[i], &td.PublicKey, priKey)
+	}
+	return s, nil
+}
+
+// seal encrypts the args of a trust domain. Its request vector is generated
+// straight into their gob encoding.
+func (s *readSealer) seal(i int) ([]byte, error) {
+	td := &s.args.TD[i]
+	vectorLength := len(td.RequestVector)
+	if s.args.Vectors != nil {
+		vectorLength = s.args.Vectors.Length
+	}
+	var err error
+	s.plain, err = appendPirArgsGob(s.plain[:0], vectorLength, td.PadSeed, func(vector []byte) error {
+		if s.args.Vectors == nil {
+			copy(vector, td.RequestVector)
+			return nil
+		}
+		for done := 0; done < len(vector); done += vectorChunk {
+			chunk := vector[done:]
+			if len(chunk) > vectorChunk {
+				chunk = chunk[:vectorChunk]
+			}
+			if err := s.args.Vectors.Fill(i, done, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(s.plain)+box.Overhead)
+	return box.SealAfterPrecomputation(sealed, s.plain, &s.nonce, s.shared[i]), nil
+}
+
+// writeJSONBytes writes bytes as a JSON string, base64 encoded as
+// encoding/json would, without a copy of the encoding in memory.
+func writeJSONBytes(w io.Writer, b []byte) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := enc.Write(b); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, `"`)
+	return err
+}
+
+// The gob encoding of PirArgs is a message defining their type, then one of
+// their value. pirArgsType is the first, and pirArgsID identifies the type in
+// the second, as encoding/gob sends them, so the args can be encoded without
+// their request vector being copied into the encoder.
+var pirArgsType, pirArgsID = pirArgsGobFraming()
+
+func pirArgsGobFraming() ([]byte, []byte) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&PirArgs{RequestVector: []byte{1}, PadSeed: []byte{2}}); err != nil {
+		panic(err)
+	}
+	// Split off the last message, of the value: its type ID, then each field
+	// by its delta, length and bytes, then the end of the struct.
+	stream := buf.Bytes()
+	start := 0
+	for {
+		n, size := readGobUint(stream[start:])
+		if start+size+int(n) >= len(stream) {
+			value := stream[start+size:]
+			fields := []byte{1, 1, 1, 1, 1, 2, 0}
+			if !bytes.HasSuffix(value, fields) {
+				panic("unexpected gob encoding of PirArgs")
+			}
+			return stream[:start], value[:len(value)-len(fields)]
+		}
+		start += size + int(n)
+	}
+}
+
+// appendPirArgsGob appends the gob encoding of PirArgs with a request vector
+// of vectorLength bytes, which fill writes in place.
+func appendPirArgsGob(b []byte, vectorLength int, padSeed []byte, fill func(vector []byte) error) ([]byte, error) {
+	value := len(pirArgsID) + 1
+	delta := uint64(1)
+	if vectorLength > 0 {
+		value += 1 + gobUintLength(uint64(vectorLength)) + vectorLength
+		delta = 0
+	}
+	if len(padSeed) > 0 {
+		value += 1 + gobUintLength(uint64(len(padSeed))) + len(padSeed)
+	}
+
+	b = append(b, pirArgsType...)
+	b = appendGobUint(b, uint64(value))
+	b = append(b, pirArgsID...)
+	if vectorLength > 0 {
+		b = appendGobUint(b, 1)
+		b = appendGobUint(b, uint64(vectorLength))
+		start := len(b)
+		for len(b)-start < vectorLength {
+			b = append(b, 0)
+		}
+		if err := fill(b[start:]); err != nil {
+			return nil, err
+		}
+	}
+	if len(padSeed) > 0 {
+		b = appendGobUint(b, delta+1)
+		b = appendGobUint(b, uint64(len(padSeed)))
+		b = append(b, padSeed...)
+	}
+	return append(b, 0), nil
+}
+
+// errPirArgsFraming refuses PirArgs whose encoding breaks off, or runs past
+// the lengths it gives.
+var errPirArgsFraming = errors.New("malformed read args")
+
+// decodePirArgs parses PirArgs from the gob encoding appendPirArgsGob writes,
+// the only one clients send. Encodings defining any other type, as clients of
+// another version might send, are refused as ErrArgsVersion. Each length is
+// checked against the bytes left before it is taken, and the fields returned
+// share the memory of b.
+func decodePirArgs(b []byte) (out PirArgs, err error) {
+	if !bytes.HasPrefix(b, pirArgsType) {
+		return out, ErrArgsVersion
+	}
+	b = b[len(pirArgsType):]
+	n, size := readGobUint(b)
+	if size == 0 || n != uint64(len(b)-size) {
+		return out, errPirArgsFraming
+	}
+	b = b[size:]
+	if !bytes.HasPrefix(b, pirArgsID) {
+		return out, ErrArgsVersion
+	}
+	b = b[len(pirArgsID):]
+
+	// Each field is its delta from the last, its length and its bytes.
+	field := uint64(0)
+	for {
+		delta, size := readGobUint(b)
+		if size == 0 {
+			return out, errPirArgsFraming
+		}
+		b = b[size:]
+		if delta == 0 {
+			if len(b) > 0 {
+				return out, errPirArgsFraming
+			}
+			return out, nil
+		}
+		if delta > 2 || field+delta > 2 {
+			return out, ErrArgsVersion
+		}
+		field += delta
+		length, size := readGobUint(b)
+		if size == 0 || length > uint64(len(b)-size) {
+			return out, errPirArgsFraming
+		}
+		value := b[size : size+int(length)]
+		b = b[size+int(length):]
+		if field == 1 {
+			out.RequestVector = value
+		} else {
+			out.PadSeed = value
+		}
+	}
+}
+
+// appendGobUint appends an unsigned integer as gob encodes it: a byte below
+// 128, or else its big-endian bytes preceded by their negated count.
+func appendGobUint(b []byte, x uint64) []byte {
+	if x < 128 {
+		return append(b, byte(x))
+	}
+	n := gobUintLength(x) - 1
+	b = append(b, byte(-n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(x>>(8*uint(i))))
+	}
+	return b
+}
+
+func gobUintLength(x uint64) int {
+	n := 1
+	if x >= 128 {
+		for ; x > 0; x >>= 8 {
+			n++
+		}
+	}
+	return n
+}
+
+// readGobUint reads an unsigned integer encoded by gob, returning it and the
+// bytes it took, or no bytes if b holds no whole integer.
+func readGobUint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0] < 128 {
+		return uint64(b[0]), 1
+	}
+	n := 256 - int(b[0])
+	if n > 8 || n >= len(b) {
+		return 0, 0
+	}
+	var x uint64
+	for i := 1; i <= n; i++ {
+		x = x<<8 | uint64(b[i])
+	}
+	return x, 1 + n
 }
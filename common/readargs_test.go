@@ -3,9 +3,17 @@ package common
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/privacylab/talek/drbg"
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -19,7 +27,7 @@ func TestEncodeDecode(t *testing.T) {
 		msg.TD[i].PadSeed = make([]byte, 4)
 		serverPub, serverPri, _ := box.GenerateKey(rand.Reader)
 		copy(config[i].PublicKey[:], serverPub[:])
-		copy(config[i].privateKey[:], serverPri[:])
+		config[i].privateKey = serverPri
 	}
 
 	encodedArgs, err := msg.Encode(config)
@@ -39,3 +47,138 @@ func TestEncodeDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestPirArgsGob(t *testing.T) {
+	seed := bytes.Repeat([]byte{9}, drbg.SeedLength)
+	for _, length := range []int{0, 1, 127, 128, 255, 256, 70000} {
+		for _, padSeed := range [][]byte{nil, seed} {
+			args := PirArgs{RequestVector: bytes.Repeat([]byte{3}, length), PadSeed: padSeed}
+			var expected bytes.Buffer
+			gob.NewEncoder(&expected).Encode(&args)
+			actual, err := appendPirArgsGob(nil, length, padSeed, func(vector []byte) error {
+				copy(vector, args.RequestVector)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, expected.Bytes()) {
+				t.Fatalf("Encoding of a %d byte vector differs from gob's.", length)
+			}
+		}
+	}
+}
+
+// testTrustDomains makes trust domains with private keys.
+func testTrustDomains(n int) []*TrustDomainConfig {
+	tds := make([]*TrustDomainConfig, n)
+	for i := range tds {
+		tds[i] = &TrustDomainConfig{}
+		serverPub, serverPri, _ := box.GenerateKey(rand.Reader)
+		copy(tds[i].PublicKey[:], serverPub[:])
+		tds[i].privateKey = serverPri
+	}
+	return tds
+}
+
+// streamedRead makes a read of seeded request vectors.
+func streamedRead(t *testing.T, conf *Config, bucket uint64, tds int) *ReadArgs {
+	vectors, err := NewRequestVectors(bucket, conf, tds, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := &ReadArgs{TD: make([]PirArgs, tds), Vectors: vectors}
+	for i := range read.TD {
+		read.TD[i].PadSeed = bytes.Repeat([]byte{byte(i + 1)}, drbg.SeedLength)
+	}
+	return read
+}
+
+// checkDecoded checks each trust domain was sent its vector of a read.
+func checkDecoded(t *testing.T, encoded *EncodedReadArgs, read *ReadArgs, tds []*TrustDomainConfig) {
+	for i, td := range tds {
+		pir, err := encoded.Decode(i, td)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector, _ := read.Vectors.Vector(i)
+		if !bytes.Equal(pir.RequestVector, vector) || !bytes.Equal(pir.PadSeed, read.TD[i].PadSeed) {
+			t.Fatalf("Trust domain %d was sent the wrong args.", i)
+		}
+	}
+}
+
+func TestEncodeVectors(t *testing.T) {
+	conf := &Config{NumBuckets: 1000000}
+	tds := testTrustDomains(3)
+	read := streamedRead(t, conf, 4242, 3)
+	read.Class, read.Tier = 2, TierHot
+	if read.Bucket() != 4242 {
+		t.Fatalf("Read of bucket %d rather than 4242.", read.Bucket())
+	}
+
+	encoded, err := read.Encode(tds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = encoded.Validate(conf, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkDecoded(t, &encoded, read, tds)
+
+	// The JSON encoding is that of the encoded args.
+	var buf bytes.Buffer
+	deadline := time.Now().Add(time.Minute).Round(0)
+	if err = read.EncodeJSON(&buf, tds, deadline, 77); err != nil {
+		t.Fatal(err)
+	}
+	var decoded EncodedReadArgs
+	if err = json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Deadline.Equal(deadline) || decoded.IdempotencyKey != 77 || decoded.Class != 2 || encoded.Class != 2 || decoded.Tier != TierHot || len(decoded.PirArgs) != 3 {
+		t.Fatalf("Decoded %+v", decoded)
+	}
+	checkDecoded(t, &decoded, read, tds)
+
+	if err = read.EncodeJSON(&buf, testTrustDomains(4), deadline, 0); err == nil {
+		t.Fatal("Encoded a read for more trust domains than it has args for.")
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	conf := &Config{NumBuckets: 100000}
+	tds := testTrustDomains(2)
+	read := streamedRead(t, conf, 99999, 2)
+
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string
+			Params [1]EncodedReadArgs
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args := &req.Params[0]
+		if req.Method != "Frontend.Read" || args.IdempotencyKey == 0 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		checkDecoded(t, args, read, tds)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": ReadReply{LastInterestSN: 5}, "error": nil, "id": 0})
+	}), &http2.Server{}))
+	defer server.Close()
+
+	frontend := NewFrontendRPC("test", server.URL)
+	defer frontend.Close()
+	var _ ReadStreamer = frontend
+	var reply ReadReply
+	if err := frontend.ReadStream(read, tds, time.Now().Add(10*time.Second), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.LastInterestSN != 5 {
+		t.Fatalf("Unexpected reply %+v", reply)
+	}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"errors"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// Contexts prefix the canonical encodings of what frontends forward to
+// replicas, so their signatures can't be confused with other statements made
+// with trust domain signing keys.
+const (
+	replicaWriteContext = "talek replica write v1"
+	replicaBatchContext = "talek replica batch v1"
+	replicaJoinContext  = "talek replica join v1"
+)
+
+// JoinWindow is how far from the time a replica receives a request to join
+// the trust domain it may have been signed.
+const JoinWindow = time.Minute
+
+// ErrUnauthenticated is returned by replicas to writes and reads not signed by
+// the trust domain of their frontend.
+var ErrUnauthenticated = errors.New("request not signed by the frontend")
+
+// CanSign is whether the trust domain config holds its signing private key.
+func (td *TrustDomainConfig) CanSign() bool {
+	return td.signPrivateKey != nil
+}
+
+// Canonical is the encoding of a forwarded write its frontend signs. Fields
+// only the frontend acts on, such as puzzles and tokens, are left out.
+func (a *ReplicaWriteArgs) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(replicaWriteContext)
+	buf.u64(a.Bucket1)
+	buf.u64(a.Bucket2)
+	buf.data(a.Data)
+	buf.data(a.InterestVector)
+	buf.u64(a.TTL)
+	buf.data(a.BroadcastKey)
+	buf.u64(a.BroadcastSeqNo)
+	buf.u64(a.Generation)
+	buf.WriteByte(a.Class)
+	buf.u64(a.GlobalSeqNo)
+	buf.flag(a.EpochFlag)
+	buf.flag(a.InterestFlag)
+	buf.u64(a.Epoch)
+	buf.Write(a.EpochRoot[:])
+	buf.flag(a.Replay)
+	buf.transition(a.Transition)
+	return buf.Bytes()
+}
+
+// Canonical is the encoding of a batch of reads its frontend signs, of the
+// fields carried by both RPCs and the batch transport.
+func (b *BatchReadRequest) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(replicaBatchContext)
+	buf.u64(b.SeqNoRange.Start)
+	buf.u64(b.SeqNoRange.End)
+	buf.u64(uint64(len(b.SeqNoRange.Aborted)))
+	for _, seqNo := range b.SeqNoRange.Aborted {
+		buf.u64(seqNo)
+	}
+	buf.time(b.Deadline)
+	buf.u64(b.Generation)
+	buf.WriteByte(b.Class)
+	buf.WriteByte(b.Tier)
+	buf.u64(b.Epoch)
+	buf.u64(uint64(len(b.Args)))
+	for i := range b.Args {
+		a := &b.Args[i]
+		buf.Write(a.ClientKey[:])
+		buf.Write(a.Nonce[:])
+		buf.u64(uint64(len(a.PirArgs)))
+		for _, p := range a.PirArgs {
+			buf.data(p)
+		}
+		buf.time(a.Deadline)
+	}
+	return buf.Bytes()
+}
+
+// Canonical is the encoding of a request to join the trust domain its
+// replica signs.
+func (a *JoinArgs) Canonical() []byte {
+	buf := &canonicalBuffer{}
+	buf.WriteString(replicaJoinContext)
+	buf.str(a.Address)
+	buf.time(a.Issued)
+	return buf.Bytes()
+}
+
+// SignWrite signs a write the frontend of the trust domain forwards.
+func (td *TrustDomainConfig) SignWrite(args *ReplicaWriteArgs) {
+	args.Signature = *ed25519.Sign(td.signPrivateKey, args.Canonical())
+}
+
+// VerifyWrite checks that a forwarded write was signed by the trust domain.
+func (td *TrustDomainConfig) VerifyWrite(args *ReplicaWriteArgs) bool {
+	return ed25519.Verify(&td.SignPublicKey, args.Canonical(), &args.Signature)
+}
+
+// SignBatch signs a batch of reads the frontend of the trust domain forwards.
+func (td *TrustDomainConfig) SignBatch(args *BatchReadRequest) {
+	args.Signature = *ed25519.Sign(td.signPrivateKey, args.Canonical())
+}
+
+// VerifyBatch checks that a batch of reads was signed by the trust domain.
+func (td *TrustDomainConfig) VerifyBatch(args *BatchReadRequest) bool {
+	return ed25519.Verify(&td.SignPublicKey, args.Canonical(), &args.Signature)
+}
+
+// SignJoin signs a request of a replica to join the trust domain.
+func (td *TrustDomainConfig) SignJoin(args *JoinArgs) {
+	args.Signature = *ed25519.Sign(td.signPrivateKey, args.Canonical())
+}
+
+// VerifyJoin checks that a request to join was signed by the trust domain,
+// within JoinWindow of now.
+func (td *TrustDomainConfig) VerifyJoin(args *JoinArgs) bool {
+	if age := time.Since(args.Issued); age > JoinWindow || age < -JoinWindow {
+		return false
+	}
+	return ed25519.Verify(&td.SignPublicKey, args.Canonical(), &args.Signature)
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplicaAuth(t *testing.T) {
+	frontend := NewTrustDomainConfig("td0", "", true, false)
+	other := NewTrustDomainConfig("td1", "", true, false)
+
+	write := &ReplicaWriteArgs{WriteArgs: WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("data"), GlobalSeqNo: 3}}
+	if frontend.VerifyWrite(write) {
+		t.Fatal("Unsigned write was verified.")
+	}
+	frontend.SignWrite(write)
+	if !frontend.VerifyWrite(write) {
+		t.Fatal("Signed write failed to verify.")
+	}
+	if other.VerifyWrite(write) {
+		t.Fatal("Write was verified by another trust domain.")
+	}
+	write.Bucket2 = 4
+	if frontend.VerifyWrite(write) {
+		t.Fatal("Write was verified after its buckets changed.")
+	}
+	write.Bucket2 = 2
+	write.Transition = &ConfigTransition{Generation: 1}
+	if frontend.VerifyWrite(write) {
+		t.Fatal("Write was verified with a transition added.")
+	}
+
+	batch := &BatchReadRequest{
+		Args:       []EncodedReadArgs{{PirArgs: [][]byte{[]byte("pir")}}},
+		SeqNoRange: Range{Start: 1, End: 5},
+		Deadline:   time.Now().Add(time.Second),
+	}
+	frontend.SignBatch(batch)
+	if !frontend.VerifyBatch(batch) || other.VerifyBatch(batch) {
+		t.Fatal("Batch should verify only by the trust domain signing it.")
+	}
+	batch.SeqNoRange.End = 6
+	if frontend.VerifyBatch(batch) {
+		t.Fatal("Batch was verified after its range changed.")
+	}
+
+	public := &TrustDomainConfig{SignPublicKey: frontend.SignPublicKey}
+	if public.CanSign() || !frontend.CanSign() {
+		t.Fatal("Trust domains should sign only with their private key.")
+	}
+}
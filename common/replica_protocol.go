@@ -1,10 +1,37 @@
 package common
 
+import (
+	"errors"
+	"time"
+
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// ErrBucketsFull rejects a write whose buckets are both full, when replicas
+// are configured to refuse such writes rather than make room for them.
+var ErrBucketsFull = errors.New("both buckets of the write are full")
+
+// ErrNotSealed refuses a batch of reads at a replica which has not sealed the
+// epochs before it as the frontend has, so its database may hold other writes
+// than those of the other trust domains.
+var ErrNotSealed = errors.New("epoch of the reads not sealed")
+
 // ReplicaWriteArgs forwards a client write from frontend to replicas.
 type ReplicaWriteArgs struct {
 	WriteArgs
 	EpochFlag    bool
 	InterestFlag bool
+	// With EpochFlag, the epoch ending and the frontend's root of its writes.
+	Epoch     uint64
+	EpochRoot [32]byte
+	// Set when a new frontend leader re-sends what its predecessor may already
+	// have, so replicas skip writes and epochs they have applied.
+	Replay bool
+	// With EpochFlag, the staged transition of the configuration, if any.
+	Transition *ConfigTransition
+	// The frontend's signature of the Canonical write with the key of its
+	// trust domain, checked by replicas configured with that trust domain.
+	Signature [64]byte
 }
 
 // ReplicaWriteReply contain return status of writes
@@ -13,19 +40,155 @@ type ReplicaWriteReply struct {
 	GlobalSeqNo uint64
 	InterestVec []byte
 	Signature   []byte
+	// With EpochFlag, the replica's signed root of the writes it applied.
+	Committed SignedRoot
 }
 
 // BatchReadRequest are a batch of requests sent to PIR servers from frontend.
 type BatchReadRequest struct {
 	Args       []EncodedReadArgs // Set of Read requests
 	SeqNoRange Range
-	ReplyChan  chan *BatchReadReply `json:"-"`
+	// Generation of the configuration of every read of the batch, whose
+	// database it is read from.
+	Generation uint64
+	// Size class of every read of the batch, whose bucket space it is read
+	// from, and the tier of it.
+	Class uint8
+	Tier  uint8
+	// The write epoch in progress at the frontend. Replicas answer the batch
+	// only from the database sealed at the end of the epoch before, which the
+	// frontend holds the batch back for at every replica.
+	Epoch uint64
+	// When the callers of all the reads stop waiting, after which replicas
+	// abandon the batch. Zero for none.
+	Deadline time.Time
+	// The frontend's signature of the Canonical batch with the key of its
+	// trust domain, checked by replicas configured with that trust domain.
+	Signature [64]byte
+	ReplyChan chan *BatchReadReply `json:"-"`
 }
 
 // BatchReadReply is a response to a BatchReadRequest.
 type BatchReadReply struct {
 	Err     string
 	Replies []ReadReply
+	// With Config.VerifyBuckets, the commitment to the buckets read from.
+	Buckets BucketCommitment
+}
+
+// ShardStats describe the database and read pipeline of a replica's shard.
+type ShardStats struct {
+	Err string
+
+	Items     uint64   // Items in the table, including stashed ones
+	Stashed   uint64   // Items waiting in the stash for room in a bucket
+	Capacity  uint64   // Items the table can hold
+	Occupancy []uint64 // Occupancy[i] is the number of buckets holding i items
+
+	Inserts        uint64 // Items written
+	InsertFailures uint64 // Items the table could not place without evicting
+	Evictions      uint64 // Items evicted to bound the load factor
+	Expired        uint64 // Items freed when their TTL passed
+	Rejected       uint64 // Writes refused as their buckets were full
+	Rebalanced     uint64 // Items moved to even out bucket occupancy
+
+	Reads     ReadQueueStats
+	DBBytes   uint64 // Size of the PIR database
+	HeapBytes uint64 // Heap in use by the replica process
+
+	PIR PIRStats
+}
+
+// PIRStats describe the PIR backend of a shard, so frontends and operators
+// can place load by what it is capable of.
+type PIRStats struct {
+	Backing    string   // Backing the shard reads with
+	Available  []string // Backings the replica was built with
+	Devices    []pirinterface.DeviceInfo
+	Throughput float64 // Requests read per second of backend time
+}
+
+// ReadQueueStats describe the read pipeline of a shard.
+type ReadQueueStats struct {
+	Queued    int    // Batches waiting for the PIR backend
+	Capacity  int    // Batches which may wait before callers block
+	Completed uint64 // Batches read
+	Stalls    uint64 // Batches which found the queue full
+	Abandoned uint64 // Batches dropped as their deadline passed in the queue
+	// Latencies of batches waiting in the queue, and being read by the PIR
+	// backend.
+	QueueLatency Histogram
+	ReadLatency  Histogram
+}
+
+// ChecksumArgs ask a replica for checksums of its database, by range of
+// buckets.
+type ChecksumArgs struct {
+	BucketsPerRange uint64 // 0 for a single range of the whole database
+	// Keys the checksums, so a caller choosing a fresh key learns nothing of
+	// the database beyond whether ranges of two replicas are equal.
+	Key []byte
+}
+
+// ChecksumReply holds the checksums of a replica's database, as of the last
+// write it applied.
+type ChecksumReply struct {
+	Err             string
+	SeqNo           uint64 // GlobalSeqNo of the last write applied
+	BucketsPerRange uint64
+	Checksums       [][32]byte
+}
+
+// Diverged returns the ranges in which two replicas' checksums, taken with the
+// same key and ranges, differ. Replicas can only be compared at the same SeqNo.
+func (c *ChecksumReply) Diverged(other *ChecksumReply) ([]int, error) {
+	if c.SeqNo != other.SeqNo || c.BucketsPerRange != other.BucketsPerRange || len(c.Checksums) != len(other.Checksums) {
+		return nil, errors.New("checksums are not of the same ranges and writes")
+	}
+	var diverged []int
+	for i := range c.Checksums {
+		if c.Checksums[i] != other.Checksums[i] {
+			diverged = append(diverged, i)
+		}
+	}
+	return diverged, nil
+}
+
+// JoinArgs ask a replica to transfer its state to a replica joining the trust
+// domain.
+type JoinArgs struct {
+	Address string    // Where the joining replica is served, to stream writes to
+	Issued  time.Time // When the request was signed, bounding its replay
+	// Of the canonical encoding, by the trust domain or its frontend.
+	Signature [64]byte
+}
+
+// StateArgs ask for a chunk of a snapshot of a replica's state.
+type StateArgs struct {
+	SnapshotID uint64
+	Offset     uint64
+}
+
+// StateReply is a chunk of a snapshot of a replica's state.
+type StateReply struct {
+	Err        string
+	SnapshotID uint64
+	Size       uint64   // Bytes in the whole snapshot
+	Digest     [32]byte // SHA-256 of the whole snapshot
+	Chunk      []byte
+}
+
+// LaunchArgs change the parameters a replica's GPU backend launches PIR
+// kernels with.
+type LaunchArgs struct {
+	Params pirinterface.LaunchParams
+}
+
+// LaunchReply holds the parameters a replica's GPU backend launches PIR
+// kernels with.
+type LaunchReply struct {
+	Err    string
+	Params pirinterface.LaunchParams
 }
 
 /*************
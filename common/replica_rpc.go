@@ -3,6 +3,15 @@ package common
 import (
 	"log"
 	"os"
+	"time"
+)
+
+// Connection pooling to replicas
+const (
+	replicaPoolSize       = 4
+	replicaKeepAlive      = 30 * time.Second
+	replicaHealthInterval = 5 * time.Second
+	replicaDialTimeout    = 10 * time.Second
 )
 
 // ReplicaRPC is a stub for the replica RPC interface
@@ -11,6 +20,8 @@ type ReplicaRPC struct {
 	name         string
 	address      string
 	methodPrefix string
+	pool         *RPCPool
+	batch        *BatchClient // nil to send reads as RPCs
 }
 
 // NewReplicaRPC creates a new ReplicaRPC
@@ -25,19 +36,98 @@ func NewReplicaRPC(name string, config *TrustDomainConfig) *ReplicaRPC {
 		return nil
 	}
 	r.methodPrefix = "Replica"
+	r.pool = NewRPCPool(r.address, replicaPoolSize, replicaKeepAlive, replicaHealthInterval)
+	r.pool.SetRetryPolicy(DefaultRetryPolicy)
+	if config.BatchAddress != "" {
+		r.batch = NewBatchClient(config.BatchAddress, replicaPoolSize, replicaDialTimeout)
+	}
 
 	return r
 }
 
 func (r *ReplicaRPC) Write(args *ReplicaWriteArgs, reply *ReplicaWriteReply) error {
 	//f.log.Printf("Write: enter\n")
-	err := RPCCall(r.address, r.methodPrefix+".Write", args, reply)
+	err := r.pool.Call(r.methodPrefix+".Write", args, reply)
 	return err
 }
 
-// BatchRead performs a set of PIR reads.
+// BatchRead performs a set of PIR reads, over the batch transport when the
+// replica has a batch listener.
 func (r *ReplicaRPC) BatchRead(args *BatchReadRequest, reply *BatchReadReply) error {
 	//f.log.Printf("BatchRead: enter\n")
-	err := RPCCall(r.address, r.methodPrefix+".BatchRead", args, reply)
+	if r.batch != nil {
+		if !r.pool.Healthy() {
+			return ErrUnhealthy
+		}
+		return r.batch.BatchRead(args, reply)
+	}
+	err := r.pool.CallRetry(args.Deadline, r.methodPrefix+".BatchRead", args, reply)
 	return err
 }
+
+// GetStats reports on the replica's shard.
+func (r *ReplicaRPC) GetStats(args *interface{}, reply *ShardStats) error {
+	return r.pool.Call(r.methodPrefix+".GetStats", args, reply)
+}
+
+// GetStatus reports the version and progress of the replica.
+func (r *ReplicaRPC) GetStatus(args *interface{}, reply *ReplicaStatus) error {
+	return r.pool.Call(r.methodPrefix+".GetStatus", args, reply)
+}
+
+// GetChecksums gets checksums of ranges of the replica's database.
+func (r *ReplicaRPC) GetChecksums(args *ChecksumArgs, reply *ChecksumReply) error {
+	return r.pool.Call(r.methodPrefix+".GetChecksums", args, reply)
+}
+
+// Join asks the replica to transfer its state to a replica joining the trust
+// domain, returning the first chunk of it.
+func (r *ReplicaRPC) Join(args *JoinArgs, reply *StateReply) error {
+	return r.pool.Call(r.methodPrefix+".Join", args, reply)
+}
+
+// GetState gets a further chunk of the replica's state.
+func (r *ReplicaRPC) GetState(args *StateArgs, reply *StateReply) error {
+	return r.pool.Call(r.methodPrefix+".GetState", args, reply)
+}
+
+// Snapshot asks the replica for a snapshot of its state to back up,
+// returning the first chunk of it.
+func (r *ReplicaRPC) Snapshot(args *interface{}, reply *StateReply) error {
+	return r.pool.Call(r.methodPrefix+".Snapshot", args, reply)
+}
+
+// SetLogLevel changes the level of the loggers of a component of the replica.
+func (r *ReplicaRPC) SetLogLevel(args *LogLevelArgs, reply *LogReply) error {
+	return r.pool.Call(r.methodPrefix+".SetLogLevel", args, reply)
+}
+
+// RotateLogs rotates the log file of the replica.
+func (r *ReplicaRPC) RotateLogs(args *interface{}, reply *LogReply) error {
+	return r.pool.Call(r.methodPrefix+".RotateLogs", args, reply)
+}
+
+// GetLaunchParams gets the kernel launch parameters of the replica's PIR
+// backend.
+func (r *ReplicaRPC) GetLaunchParams(args *interface{}, reply *LaunchReply) error {
+	return r.pool.Call(r.methodPrefix+".GetLaunchParams", args, reply)
+}
+
+// SetLaunchParams adjusts the kernel launch parameters of the replica's PIR
+// backend.
+func (r *ReplicaRPC) SetLaunchParams(args *LaunchArgs, reply *LaunchReply) error {
+	return r.pool.Call(r.methodPrefix+".SetLaunchParams", args, reply)
+}
+
+// Healthy reports whether the replica is reachable.
+func (r *ReplicaRPC) Healthy() bool {
+	return r.pool.Healthy()
+}
+
+// Close releases the connections to the replica.
+func (r *ReplicaRPC) Close() {
+	r.pool.Close()
+	if r.batch != nil {
+		r.batch.Close()
+	}
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+// vectorChunk is how much of a request vector is generated at once.
+const vectorChunk = 4096
+
+// RequestVectors are the request vectors of a PIR read, generated in chunks as
+// they are encoded rather than held in memory: with millions of buckets, each
+// trust domain's vector is hundreds of kilobytes. The vector of every trust
+// domain but the first is the AES counter mode keystream of a seed, and the
+// first is their xor with the bucket read, so that together they select only
+// it. The vectors of a cover read, which selects no bucket in particular, are
+// all keystreams.
+type RequestVectors struct {
+	Length int      // Of each vector, in bytes
+	Bucket int      // Selected by the vectors, or -1 for a cover read
+	Seeds  [][]byte // By trust domain. The first is nil unless Bucket is -1.
+}
+
+// NewRequestVectors creates the request vectors of a read of a bucket from
+// trustDomains trust domains.
+func NewRequestVectors(bucket uint64, conf *Config, trustDomains int, rand io.Reader) (*RequestVectors, error) {
+	if bucket >= conf.NumBuckets {
+		return nil, fmt.Errorf("bucket %d is not below %d", bucket, conf.NumBuckets)
+	}
+	v, err := newRequestVectors(conf, trustDomains, 1, rand)
+	if err != nil {
+		return nil, err
+	}
+	v.Bucket = int(bucket)
+	return v, nil
+}
+
+// NewCoverRequestVectors creates random request vectors, of a read made only
+// to hide when real reads are made.
+func NewCoverRequestVectors(conf *Config, trustDomains int, rand io.Reader) (*RequestVectors, error) {
+	v, err := newRequestVectors(conf, trustDomains, 0, rand)
+	if err != nil {
+		return nil, err
+	}
+	v.Bucket = -1
+	return v, nil
+}
+
+// Fill generates a chunk of the vector of a trust domain, from offset on.
+func (v *RequestVectors) Fill(td int, offset int, chunk []byte) error {
+	if td < 0 || td >= len(v.Seeds) {
+		return fmt.Errorf("no request vector for trust domain %d", td)
+	}
+	if offset < 0 || offset+len(chunk) > v.Length {
+		return errors.New("chunk exceeds the request vector")
+	}
+	if td > 0 || v.Bucket < 0 {
+		return keystream(v.Seeds[td], offset, chunk)
+	}
+
+	for i := range chunk {
+		chunk[i] = 0
+	}
+	scratch := make([]byte, vectorChunk)
+	for i := 1; i < len(v.Seeds); i++ {
+		for done := 0; done < len(chunk); done += vectorChunk {
+			part := chunk[done:]
+			if len(part) > vectorChunk {
+				part = part[:vectorChunk]
+			}
+			if err := keystream(v.Seeds[i], offset+done, scratch[:len(part)]); err != nil {
+				return err
+			}
+			for j := range part {
+				part[j] ^= scratch[j]
+			}
+		}
+	}
+	if bit := v.Bucket / 8; bit >= offset && bit < offset+len(chunk) {
+		chunk[bit-offset] ^= 1 << uint(v.Bucket%8)
+	}
+	return nil
+}
+
+// Vector generates the whole vector of a trust domain.
+func (v *RequestVectors) Vector(td int) ([]byte, error) {
+	vector := make([]byte, v.Length)
+	if err := v.Fill(td, 0, vector); err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+/** PRIVATE METHODS **/
+
+// newRequestVectors creates vectors with seeds for the trust domains from
+// first on.
+func newRequestVectors(conf *Config, trustDomains int, first int, rand io.Reader) (*RequestVectors, error) {
+	if trustDomains < 1 {
+		return nil, errors.New("a read needs a trust domain")
+	}
+	v := &RequestVectors{Length: RequestVectorLength(conf), Seeds: make([][]byte, trustDomains)}
+	for i := first; i < trustDomains; i++ {
+		v.Seeds[i] = make([]byte, drbg.SeedLength)
+		if _, err := io.ReadFull(rand, v.Seeds[i]); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// keystream fills a chunk with the keystream of a seed from offset on, as
+// drbg.OverlayAES would overlay it: seeking is a matter of starting the
+// counter at the block of the offset.
+func keystream(seed []byte, offset int, chunk []byte) error {
+	if len(seed) < drbg.SeedLength {
+		return errors.New("invalid seed provided")
+	}
+	block, err := aes.NewCipher(seed[:16])
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, seed[16:drbg.SeedLength])
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	for i := range chunk {
+		chunk[i] = 0
+	}
+	stream.XORKeyStream(chunk, chunk)
+	return nil
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+func TestRequestVectors(t *testing.T) {
+	conf := &Config{NumBuckets: 100003}
+	for _, tds := range []int{1, 2, 3} {
+		for _, bucket := range []uint64{0, 7, 8, 65537, conf.NumBuckets - 1} {
+			v, err := NewRequestVectors(bucket, conf, tds, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read := &ReadArgs{TD: make([]PirArgs, tds)}
+			for i := range read.TD {
+				if read.TD[i].RequestVector, err = v.Vector(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if read.Bucket() != int(bucket) {
+				t.Fatalf("Vectors of %d trust domains read bucket %d rather than %d.", tds, read.Bucket(), bucket)
+			}
+		}
+	}
+
+	if _, err := NewRequestVectors(conf.NumBuckets, conf, 2, rand.Reader); err == nil {
+		t.Fatal("Vectors were made for a bucket beyond the database.")
+	}
+	cover, _ := NewCoverRequestVectors(conf, 3, rand.Reader)
+	if cover.Bucket != -1 || cover.Seeds[0] == nil {
+		t.Fatal("Cover vectors should select no bucket.")
+	}
+}
+
+func TestRequestVectorChunks(t *testing.T) {
+	conf := &Config{NumBuckets: 8 * 4 * vectorChunk}
+	v, _ := NewRequestVectors(12345, conf, 3, rand.Reader)
+	for td := 0; td < 3; td++ {
+		whole, _ := v.Vector(td)
+		for _, offset := range []int{0, 1, 15, 16, 1000, vectorChunk - 3} {
+			chunk := make([]byte, 2*vectorChunk+7)
+			if err := v.Fill(td, offset, chunk); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(chunk, whole[offset:offset+len(chunk)]) {
+				t.Fatalf("Chunk at %d of trust domain %d differs from the vector.", offset, td)
+			}
+		}
+	}
+	if err := v.Fill(0, v.Length-1, make([]byte, 2)); err == nil {
+		t.Fatal("Filled a chunk beyond the vector.")
+	}
+
+	// Random vectors are the keystream of their seed.
+	expected := make([]byte, v.Length)
+	drbg.OverlayAES(v.Seeds[1], expected)
+	if actual, _ := v.Vector(1); !bytes.Equal(actual, expected) {
+		t.Fatal("Vector is not the keystream of its seed.")
+	}
+}
@@ -0,0 +1,312 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/rpc/json"
+	"golang.org/x/net/http2"
+)
+
+// streamBuffer is how much of a streamed payload is written to the
+// connection at once.
+const streamBuffer = 32 << 10
+
+// ErrUnhealthy is returned by an RPCPool without attempting a call while its
+// server is failing health checks.
+var ErrUnhealthy = errors.New("server is unreachable")
+
+// RPCPool makes JSON RPCs to a single server over a pool of persistent
+// connections, rather than dialing for each call. Connections are kept alive
+// with TCP keepalives, and the server is health checked so calls fail fast
+// while it is unreachable. Connections are re-established once it recovers.
+// Calls which are safe to repeat may be retried, by a RetryPolicy. Payloads
+// are compressed with the codec negotiated with the server.
+type RPCPool struct {
+	endpoint  *endpoint
+	transport pooledTransport
+	client    *http.Client
+
+	unhealthy int32        // Use atomic
+	retry     atomic.Value // RetryPolicy of CallRetry
+	offer     atomic.Value // []Compression offered to the server
+	codec     atomic.Value // Compression of requests, as picked by the server
+	done      chan struct{}
+}
+
+// pooledTransport is an HTTP transport whose connections can be dropped.
+type pooledTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// NewRPCPool creates a pool of up to size connections to the server at
+// address, checking its health every interval. An interval of 0 disables
+// health checks. The address is a URL, or "name:address" to reach the
+// server over a registered transport.
+func NewRPCPool(address string, size int, keepAlive time.Duration, interval time.Duration) *RPCPool {
+	ep := resolveEndpoint(address, keepAlive)
+	return newRPCPool(ep, &http.Transport{
+		DialContext:         ep.dial,
+		MaxIdleConns:        size,
+		MaxIdleConnsPerHost: size,
+		MaxConnsPerHost:     size,
+		IdleConnTimeout:     2 * keepAlive,
+	}, interval)
+}
+
+// NewMultiplexedRPCPool creates a pool which makes every RPC as a stream of a
+// single HTTP/2 connection to the server at address, so concurrent calls
+// neither open connections of their own nor wait behind one another. The
+// server must speak HTTP/2: over TLS for https addresses, and in cleartext
+// otherwise.
+func NewMultiplexedRPCPool(address string, keepAlive time.Duration, interval time.Duration) *RPCPool {
+	ep := resolveEndpoint(address, keepAlive)
+	return newRPCPool(ep, &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := ep.dial(context.Background(), network, addr)
+			if err != nil || !ep.secure {
+				return conn, err
+			}
+			tlsConn := tls.Client(conn, config)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}, interval)
+}
+
+// endpoint is where a pool's RPCs are posted, and how it is reached.
+type endpoint struct {
+	url       string
+	transport Transport
+	address   string // On the transport
+	secure    bool
+	keepAlive time.Duration
+}
+
+// resolveEndpoint finds the transport an RPC address is reached over.
+// Servers of a registered transport other than TCP are posted to at a
+// placeholder URL, since their address needn't be a host.
+func resolveEndpoint(address string, keepAlive time.Duration) *endpoint {
+	if u, err := url.Parse(address); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		host := u.Host
+		if u.Port() == "" && u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return &endpoint{address, GetTransport("tcp"), host, u.Scheme == "https", keepAlive}
+	}
+	t, addr := ResolveAddress(address)
+	return &endpoint{"http://talek/", t, addr, false, keepAlive}
+}
+
+// dial connects to the endpoint, whichever address HTTP asks for. Connections
+// of the default transports are kept alive at the pool's period.
+func (e *endpoint) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if ip, ok := e.transport.(*ipTransport); ok {
+		return newDialer(0, e.keepAlive).DialContext(ctx, ip.network, e.address)
+	}
+	return e.transport.Dial(ctx, e.address)
+}
+
+func newRPCPool(ep *endpoint, transport pooledTransport, interval time.Duration) *RPCPool {
+	p := &RPCPool{}
+	p.endpoint = ep
+	p.transport = transport
+	p.client = &http.Client{Transport: p.transport}
+	p.done = make(chan struct{})
+	p.SetCompression(SupportedCompression)
+	if interval > 0 {
+		go p.healthCheck(interval)
+	}
+	return p
+}
+
+// Call makes an RPC over a pooled connection.
+func (p *RPCPool) Call(methodName string, args interface{}, reply interface{}) error {
+	return p.CallDeadline(time.Time{}, methodName, args, reply)
+}
+
+// CallDeadline makes an RPC over a pooled connection, abandoning it once the
+// deadline passes. A zero deadline waits indefinitely.
+func (p *RPCPool) CallDeadline(deadline time.Time, methodName string, args interface{}, reply interface{}) error {
+	if !p.Healthy() {
+		return ErrUnhealthy
+	}
+	if Expired(deadline) {
+		return ErrDeadlineExceeded
+	}
+
+	message, err := json.EncodeClientRequest(methodName, args)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(deadline, payload{message: message}, reply)
+	return err
+}
+
+// payload is the body of an RPC: encoded in memory, or written as it is sent.
+type payload struct {
+	message []byte
+	stream  func(w io.Writer) error
+}
+
+// call makes a single attempt at an encoded RPC, reporting whether it failed
+// in transit, rather than being answered with an error.
+func (p *RPCPool) call(deadline time.Time, message payload, reply interface{}) (transit bool, err error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	codec, _ := p.codec.Load().(Compression)
+	if message.stream != nil {
+		// Streamed payloads are request vectors, which don't compress.
+		codec = CompressionNone
+	}
+	resp, err := p.post(ctx, message, codec)
+	if err == nil && resp.StatusCode == http.StatusUnsupportedMediaType && codec != CompressionNone {
+		// The server no longer accepts the codec, so negotiate again.
+		resp.Body.Close()
+		p.codec.Store(CompressionNone)
+		resp, err = p.post(ctx, message, CompressionNone)
+	}
+	if err != nil {
+		// Drop connections which may be broken, so later calls redial, and
+		// negotiate compression with whichever server answers them.
+		p.transport.CloseIdleConnections()
+		p.codec.Store(CompressionNone)
+		return true, err
+	}
+	defer resp.Body.Close()
+	if chosen := Compression(resp.Header.Get(CompressionChosenHeader)); chosen != "" {
+		offer := p.offer.Load().([]Compression)
+		p.codec.Store(NegotiateCompression([]Compression{chosen}, offer))
+	}
+
+	var body io.Reader = resp.Body
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		// Replies of replicas to batches of reads are the largest.
+		data, err := Compression(encoding).Decompress(resp.Body, maxBatchFrame)
+		if _, ok := err.(net.Error); ok || err == io.ErrUnexpectedEOF {
+			return true, err
+		} else if err != nil {
+			return false, err
+		}
+		body = bytes.NewReader(data)
+	}
+	err = json.DecodeClientResponse(body, reply)
+	// The connection only returns to the pool once its response is consumed.
+	io.Copy(ioutil.Discard, resp.Body)
+	if _, ok := err.(net.Error); ok || err == io.ErrUnexpectedEOF {
+		return true, err
+	}
+	return false, err
+}
+
+// post sends an encoded RPC, with its body compressed by codec. A streamed
+// body is written to the request as the transport reads it.
+func (p *RPCPool) post(ctx context.Context, message payload, codec Compression) (*http.Response, error) {
+	var body io.ReadCloser
+	encoding := CompressionNone
+	if message.stream != nil {
+		r, w := io.Pipe()
+		go func() {
+			buf := bufio.NewWriterSize(w, streamBuffer)
+			err := message.stream(buf)
+			if err == nil {
+				err = buf.Flush()
+			}
+			w.CloseWithError(err)
+		}()
+		body = r
+	} else {
+		var compressed []byte
+		compressed, encoding = codec.Compress(message.message)
+		body = ioutil.NopCloser(bytes.NewReader(compressed))
+	}
+	req, err := http.NewRequest("POST", p.endpoint.url, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != CompressionNone {
+		req.Header.Set("Content-Encoding", string(encoding))
+	}
+	req.Header.Set(CompressionOfferHeader, JoinCompression(p.offer.Load().([]Compression)))
+	return p.client.Do(req)
+}
+
+// SetCompression changes the codecs offered to the server, most preferred
+// first. The codec of requests is renegotiated with the next call.
+func (p *RPCPool) SetCompression(offer []Compression) {
+	p.offer.Store(offer)
+	p.codec.Store(CompressionNone)
+}
+
+// Healthy reports whether the server passed its last health check.
+func (p *RPCPool) Healthy() bool {
+	return atomic.LoadInt32(&p.unhealthy) == 0
+}
+
+// Close stops health checks, and closes idle connections of the pool.
+func (p *RPCPool) Close() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	p.transport.CloseIdleConnections()
+}
+
+// healthCheck periodically checks the server accepts connections.
+func (p *RPCPool) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		if err := p.probe(interval); err != nil {
+			if atomic.CompareAndSwapInt32(&p.unhealthy, 0, 1) {
+				p.transport.CloseIdleConnections()
+			}
+		} else {
+			atomic.StoreInt32(&p.unhealthy, 0)
+		}
+	}
+}
+
+func (p *RPCPool) probe(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := p.endpoint.transport.Dial(ctx, p.endpoint.address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
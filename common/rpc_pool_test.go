@@ -0,0 +1,194 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// echoServer answers every RPC with its name, counting connections made to it.
+func echoServer(listener net.Listener, conns *int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":"echo","error":null,"id":0}`))
+	}))
+	s.Listener.Close()
+	s.Listener = listener
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	s.Start()
+	return s
+}
+
+func TestRPCPoolReuse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int32
+	server := echoServer(listener, &conns)
+	defer server.Close()
+
+	pool := NewRPCPool(server.URL, 2, time.Minute, 0)
+	defer pool.Close()
+	for i := 0; i < 10; i++ {
+		var reply string
+		if err := pool.Call("Test.Echo", nil, &reply); err != nil || reply != "echo" {
+			t.Fatalf("Call %d failed: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Sequential calls should share a connection, %d were made.", n)
+	}
+}
+
+func TestRPCPoolReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	var conns int32
+	server := echoServer(listener, &conns)
+
+	pool := NewRPCPool(server.URL, 2, time.Minute, 10*time.Millisecond)
+	defer pool.Close()
+	var reply string
+	if err := pool.Call("Test.Echo", nil, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls fail fast while the server is down.
+	server.Close()
+	for start := time.Now(); pool.Healthy(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Pool did not notice the server going away.")
+		}
+	}
+	if err := pool.Call("Test.Echo", nil, &reply); err != ErrUnhealthy {
+		t.Fatalf("Expected calls to fail fast, got %v", err)
+	}
+
+	// And succeed over a new connection once it is back.
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("Could not restart server at %s: %v", addr, err)
+	}
+	server = echoServer(listener, &conns)
+	defer server.Close()
+	for start := time.Now(); !pool.Healthy(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Pool did not notice the server returning.")
+		}
+	}
+	if err := pool.Call("Test.Echo", nil, &reply); err != nil || reply != "echo" {
+		t.Fatalf("Call after reconnecting failed: %v", err)
+	}
+}
+
+func TestMultiplexedRPCPool(t *testing.T) {
+	const calls = 10
+	// After the first, each call is answered only once all have arrived, so
+	// calls waiting behind one another on a connection would never complete.
+	var arrived sync.WaitGroup
+	arrived.Add(calls)
+	var first int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected HTTP/2", http.StatusBadRequest)
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&first, 0, 1) {
+			arrived.Done()
+			arrived.Wait()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":"echo","error":null,"id":0}`))
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int32
+	server := echoServer(listener, &conns)
+	server.Config.Handler = h2c.NewHandler(handler, &http2.Server{})
+	defer server.Close()
+
+	pool := NewMultiplexedRPCPool(server.URL, time.Minute, 0)
+	defer pool.Close()
+	var reply string
+	if err := pool.Call("Test.Echo", nil, &reply); err != nil || reply != "echo" {
+		t.Fatalf("Call failed: %v", err)
+	}
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			var reply string
+			errs <- pool.Call("Test.Echo", nil, &reply)
+		}()
+	}
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("Call failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Concurrent calls were not multiplexed.")
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Calls should share a connection, %d were made.", n)
+	}
+}
+
+func TestRPCPoolRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2:
+			// Drop the connection without answering.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case 3:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"result":"echo","error":null,"id":0}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"result":null,"error":"refused","id":0}`))
+		}
+	}))
+	defer server.Close()
+
+	pool := NewRPCPool(server.URL, 1, time.Minute, 0)
+	defer pool.Close()
+	var reply string
+	if err := pool.CallRetry(time.Time{}, "Test.Echo", nil, &reply); err == nil {
+		t.Fatal("Calls should not be retried without a policy.")
+	}
+
+	pool.SetRetryPolicy(RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	if err := pool.CallRetry(time.Time{}, "Test.Echo", nil, &reply); err != nil || reply != "echo" {
+		t.Fatalf("Call should succeed on retry: %q, %v", reply, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("Expected 3 attempts, made %d", n)
+	}
+
+	// Calls answered with an error are not retried.
+	if err := pool.CallRetry(time.Time{}, "Test.Echo", nil, &reply); err == nil {
+		t.Fatal("Expected the call's error.")
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("Answered call should not be retried, made %d attempts", n)
+	}
+}
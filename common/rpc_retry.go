@@ -0,0 +1,107 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/rpc/json"
+)
+
+// RetryPolicy is how calls which fail in transit are retried. Calls answered
+// with an error are not retried.
+type RetryPolicy struct {
+	Attempts   int           // Tries of a call in all. 0 or 1 makes a single try.
+	Backoff    time.Duration // Wait before the first retry, doubling for each after.
+	MaxBackoff time.Duration // Longest wait between tries.
+}
+
+// DefaultRetryPolicy is the policy of the RPC stubs to frontends and replicas.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 50 * time.Millisecond, MaxBackoff: time.Second}
+
+// wait is how long to wait before the retry following the given attempt.
+func (r RetryPolicy) wait(attempt int) time.Duration {
+	wait := r.Backoff
+	for i := 0; i < attempt && wait < r.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if r.MaxBackoff > 0 && wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+	return wait
+}
+
+// NewIdempotencyKey picks a random key identifying a call across its retries,
+// so the server can answer a retry of a call it has already made with the
+// same reply, rather than making it again.
+func NewIdempotencyKey() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if key := binary.LittleEndian.Uint64(b[:]); key != 0 {
+			return key
+		}
+	}
+}
+
+// SetRetryPolicy changes how the pool's CallRetry retries calls.
+func (p *RPCPool) SetRetryPolicy(policy RetryPolicy) {
+	p.retry.Store(policy)
+}
+
+// CallRetry makes an RPC, retrying it by the pool's policy if it fails in
+// transit, until its deadline. It must only be used for calls which are safe
+// to repeat: reads, or writes with an idempotency key the server understands.
+func (p *RPCPool) CallRetry(deadline time.Time, methodName string, args interface{}, reply interface{}) error {
+	message, err := json.EncodeClientRequest(methodName, args)
+	if err != nil {
+		return err
+	}
+	return p.retryCall(deadline, payload{message: message}, reply)
+}
+
+// CallStream makes an RPC as CallRetry does, but with its args written by
+// params as the request is sent, rather than encoded in memory first. They
+// are written again for each retry. Streamed requests are not compressed.
+func (p *RPCPool) CallStream(deadline time.Time, methodName string, params func(w io.Writer) error, reply interface{}) error {
+	id := NewIdempotencyKey() >> 1
+	return p.retryCall(deadline, payload{stream: func(w io.Writer) error {
+		// The envelope of a JSON RPC, as json.EncodeClientRequest makes it.
+		if _, err := fmt.Fprintf(w, `{"method":%q,"params":[`, methodName); err != nil {
+			return err
+		}
+		if err := params(w); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, `],"id":%d}`, id)
+		return err
+	}}, reply)
+}
+
+// retryCall makes an encoded RPC, retrying it by the pool's policy.
+func (p *RPCPool) retryCall(deadline time.Time, message payload, reply interface{}) error {
+	policy, _ := p.retry.Load().(RetryPolicy)
+	for attempt := 0; ; attempt++ {
+		if !p.Healthy() {
+			return ErrUnhealthy
+		}
+		if Expired(deadline) {
+			return ErrDeadlineExceeded
+		}
+		transit, err := p.call(deadline, message, reply)
+		if !transit || attempt+1 >= policy.Attempts {
+			return err
+		}
+		wait := policy.wait(attempt)
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-p.done:
+			return err
+		}
+	}
+}
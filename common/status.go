@@ -0,0 +1,59 @@
+package common
+
+import "time"
+
+// Version is the version of talek the servers were built from, set when
+// building with -ldflags "-X github.com/privacylab/talek/common.Version=v1.2.3".
+var Version = "dev"
+
+// StandbyStatus describes a standby copy of a replica.
+type StandbyStatus struct {
+	Name    string
+	Pending int  // Applied writes not yet streamed
+	InSync  bool // False once the standby fell too far behind to catch up
+}
+
+// ReplicaStatus describes the health of a replica: what it runs, and how far
+// it has applied writes.
+type ReplicaStatus struct {
+	Err string
+
+	Name      string
+	Version   string // Empty if the replica is too old to report its status
+	GoVersion string
+	Started   time.Time
+
+	Epochs         uint64 // Epochs committed
+	CommittedSeqNo uint64 // Last write applied
+	Generation     uint64 // Of the configuration in use
+	Joining        bool   // Still transferring its state from another replica
+	Standbys       []StandbyStatus
+	PIR            PIRStats
+
+	// How far the replica is behind the frontend reporting it, in writes
+	// sequenced and epochs begun. Set by the frontend.
+	WriteLag uint64
+	EpochLag uint64
+}
+
+// ClusterStatus describes the health of a frontend and of the replica of each
+// trust domain it forwards to, for dashboards and health checks.
+type ClusterStatus struct {
+	Err string
+
+	Name       string
+	Version    string
+	GoVersion  string
+	Started    time.Time
+	Epoch      uint64 // Write epoch in progress
+	SeqNo      uint64 // Last write sequenced
+	Generation uint64 // Of the configuration in use
+	Standby    bool   // Replicated, and not the leader
+
+	Replicas []ReplicaStatus // By trust domain index
+
+	// Healthy is false when any replica failed to report, is joining, has a
+	// standby out of sync, or lags behind the frontend. Problems says why.
+	Healthy  bool
+	Problems []string
+}
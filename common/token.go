@@ -0,0 +1,262 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+)
+
+// TokenKeyBits is the size of the keys frontends sign write tokens with.
+const TokenKeyBits = 2048
+
+// tokenKeyExponent is the public exponent of keys tokens are signed with.
+const tokenKeyExponent = 65537
+
+// MaxTokensPerIssue bounds the tokens a client may be issued in one request.
+const MaxTokensPerIssue = 64
+
+// tokenContext prefixes the nonces of tokens before they are signed.
+const tokenContext = "talek write token"
+
+// ErrTokenRequired turns away a write without an unspent token signed by a
+// current key of the frontend.
+var ErrTokenRequired = errors.New("write needs an unspent token of the frontend")
+
+// TokenKey is the public key a frontend signs write tokens with.
+type TokenKey struct {
+	N *big.Int
+	E int
+}
+
+// Token authorizes a single write. It is a signature of the frontend on a
+// random nonce, made blind: the frontend never saw the nonce or signature
+// when it issued the token, so it can't link the write spending it to the
+// issuance, or to other writes of the same client.
+type Token struct {
+	KeyID     [8]byte
+	Nonce     [32]byte
+	Signature []byte
+}
+
+// BlindToken is a token being issued, held by the client until the frontend
+// has signed Blinded.
+type BlindToken struct {
+	Blinded []byte
+
+	key   *TokenKey
+	nonce [32]byte
+	r     *big.Int // Blinding factor
+}
+
+// ID identifies a key, so tokens name the key they are signed with.
+func (k *TokenKey) ID() [8]byte {
+	h := sha256.New()
+	h.Write([]byte(tokenContext))
+	h.Write(k.N.Bytes())
+	var e [8]byte
+	binary.BigEndian.PutUint64(e[:], uint64(k.E))
+	h.Write(e[:])
+	var id [8]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// Validate checks a key is of the size and exponent tokens are signed with.
+func (k *TokenKey) Validate() error {
+	if k.N == nil || k.N.BitLen() != TokenKeyBits || k.N.Bit(0) == 0 {
+		return &ValidationError{Field: "token key", Reason: fmt.Sprintf("modulus is not an odd %d bits", TokenKeyBits)}
+	}
+	if k.E != tokenKeyExponent {
+		return &ValidationError{Field: "token key", Reason: fmt.Sprintf("exponent %d is not %d", k.E, tokenKeyExponent)}
+	}
+	return nil
+}
+
+// Equal is whether two keys are the same.
+func (k *TokenKey) Equal(other *TokenKey) bool {
+	return k.N != nil && other.N != nil && k.N.Cmp(other.N) == 0 && k.E == other.E
+}
+
+// Blind creates a token with a random nonce, blinded for the frontend to sign.
+func (k *TokenKey) Blind(random io.Reader) (*BlindToken, error) {
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	b := &BlindToken{key: k}
+	if _, err := io.ReadFull(random, b.nonce[:]); err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	for {
+		r, err := rand.Int(random, k.N)
+		if err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 && new(big.Int).GCD(nil, nil, r, k.N).Cmp(one) == 0 {
+			b.r = r
+			break
+		}
+	}
+	// m * r^e mod N
+	m := tokenHash(b.nonce[:], k.N)
+	m.Mul(m, new(big.Int).Exp(b.r, big.NewInt(int64(k.E)), k.N))
+	m.Mod(m, k.N)
+	b.Blinded = m.Bytes()
+	return b, nil
+}
+
+// Unblind turns the signature of the frontend on a blinded token into the
+// token, failing if it is not a valid signature of the key.
+func (b *BlindToken) Unblind(blindSignature []byte) (*Token, error) {
+	s := new(big.Int).SetBytes(blindSignature)
+	s.Mul(s, new(big.Int).ModInverse(b.r, b.key.N))
+	s.Mod(s, b.key.N)
+	t := &Token{KeyID: b.key.ID(), Nonce: b.nonce, Signature: s.Bytes()}
+	if !b.key.Verify(t) {
+		return nil, errors.New("invalid token signature")
+	}
+	return t, nil
+}
+
+// Verify checks a token is signed with the key.
+func (k *TokenKey) Verify(t *Token) bool {
+	if t.KeyID != k.ID() || len(t.Signature) > (k.N.BitLen()+7)/8 {
+		return false
+	}
+	s := new(big.Int).SetBytes(t.Signature)
+	if s.Cmp(k.N) >= 0 {
+		return false
+	}
+	s.Exp(s, big.NewInt(int64(k.E)), k.N)
+	return s.Cmp(tokenHash(t.Nonce[:], k.N)) == 0
+}
+
+// TokenSigner issues tokens of a key.
+type TokenSigner struct {
+	key    *rsa.PrivateKey
+	public TokenKey
+}
+
+// NewTokenSigner generates a key to sign tokens with.
+func NewTokenSigner(random io.Reader) (*TokenSigner, error) {
+	key, err := rsa.GenerateKey(random, TokenKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return newTokenSigner(key)
+}
+
+// LoadTokenSigner reads a key to sign tokens with from a PEM file, in PKCS #1
+// or PKCS #8 form, as made by "openssl genrsa 2048".
+func LoadTokenSigner(file string) (*TokenSigner, error) {
+	encoded, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM key", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return newTokenSigner(key)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds no RSA key", file)
+	}
+	return newTokenSigner(rsaKey)
+}
+
+func newTokenSigner(key *rsa.PrivateKey) (*TokenSigner, error) {
+	s := &TokenSigner{key, TokenKey{key.N, key.E}}
+	if err := s.public.Validate(); err != nil {
+		return nil, err
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	if len(key.Primes) != 2 {
+		return nil, &ValidationError{Field: "token key", Reason: fmt.Sprintf("%d primes rather than 2", len(key.Primes))}
+	}
+	key.Precompute()
+	return s, nil
+}
+
+// Key is the public key of the signer.
+func (s *TokenSigner) Key() *TokenKey {
+	return &s.public
+}
+
+// SignBlinded signs a blinded token. crypto/rsa only applies its private key
+// beneath a padding scheme, so the raw operation is made here as it makes
+// it: blinded by a random factor, so its timing is independent of the input,
+// and checked with the public key, so a faulty result doesn't leak the key.
+func (s *TokenSigner) SignBlinded(blinded []byte) ([]byte, error) {
+	n := s.key.N
+	m := new(big.Int).SetBytes(blinded)
+	if m.Sign() <= 0 || m.Cmp(n) >= 0 {
+		return nil, errors.New("blinded token out of range")
+	}
+
+	var r, rInv *big.Int
+	for rInv == nil {
+		var err error
+		if r, err = rand.Int(rand.Reader, n); err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 {
+			rInv = new(big.Int).ModInverse(r, n)
+		}
+	}
+	e := big.NewInt(int64(s.key.E))
+	c := new(big.Int).Exp(r, e, n)
+	c.Mul(c, m)
+	c.Mod(c, n)
+
+	// c^d by the Chinese remainder theorem: m2 + q * (qInv * (m1 - m2) mod p)
+	p, q := s.key.Primes[0], s.key.Primes[1]
+	m1 := new(big.Int).Exp(c, s.key.Precomputed.Dp, p)
+	m2 := new(big.Int).Exp(c, s.key.Precomputed.Dq, q)
+	m1.Sub(m1, m2)
+	m1.Mul(m1, s.key.Precomputed.Qinv)
+	m1.Mod(m1, p)
+	m1.Mul(m1, q)
+	m1.Add(m1, m2)
+
+	m1.Mul(m1, rInv)
+	m1.Mod(m1, n)
+	if new(big.Int).Exp(m1, e, n).Cmp(m) != 0 {
+		return nil, errors.New("token signature failed to verify")
+	}
+	return m1.Bytes(), nil
+}
+
+// tokenHash hashes a nonce to the full domain of a key, so signatures can't be
+// combined into signatures of other nonces.
+func tokenHash(nonce []byte, n *big.Int) *big.Int {
+	length := (n.BitLen()+7)/8 + 16
+	out := make([]byte, 0, length+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(out) < length; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		h := sha256.New()
+		h.Write([]byte(tokenContext))
+		h.Write(counter[:])
+		h.Write(nonce)
+		out = h.Sum(out)
+	}
+	m := new(big.Int).SetBytes(out[:length])
+	return m.Mod(m, n)
+}
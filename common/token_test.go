@@ -0,0 +1,103 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	signer, err := NewTokenSigner(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signer.Key()
+	blind, err := key.Blind(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.SignBlinded(blind.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := blind.Unblind(sig)
+	if err != nil {
+		t.Fatalf("Token failed to unblind: %v", err)
+	}
+	if !key.Verify(token) {
+		t.Fatal("Token failed to verify.")
+	}
+
+	// The frontend saw neither the nonce nor the signature of the token.
+	if string(blind.Blinded) == string(token.Signature) || string(sig) == string(token.Signature) {
+		t.Fatal("Token is linkable to its issuance.")
+	}
+
+	forged := *token
+	forged.Nonce[0] ^= 1
+	if key.Verify(&forged) {
+		t.Fatal("A token verified for another nonce.")
+	}
+	other, err := NewTokenSigner(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Key().Verify(token) {
+		t.Fatal("A token verified with another key.")
+	}
+	if _, err := blind.Unblind(sig[1:]); err == nil {
+		t.Fatal("An invalid signature unblinded.")
+	}
+	if _, err := signer.SignBlinded(key.N.Bytes()); err == nil {
+		t.Fatal("Signed a blinded token out of range.")
+	}
+
+	if err := key.Validate(); err != nil {
+		t.Fatalf("Valid key refused: %v", err)
+	}
+	small := &TokenKey{N: new(big.Int).Rsh(key.N, 1024), E: key.E}
+	if err := small.Validate(); err == nil {
+		t.Fatal("Key of a small modulus was accepted.")
+	}
+	if _, err := small.Blind(rand.Reader); err == nil {
+		t.Fatal("Token blinded for a key of a small modulus.")
+	}
+	if err := (&TokenKey{N: key.N, E: 3}).Validate(); err == nil {
+		t.Fatal("Key of another exponent was accepted.")
+	}
+	if !key.Equal(&TokenKey{N: new(big.Int).Set(key.N), E: key.E}) || key.Equal(other.Key()) {
+		t.Fatal("Keys compared wrongly.")
+	}
+}
+
+func TestLoadTokenSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, TokenKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "talektoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token.pem")
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	ioutil.WriteFile(file, encoded, 0600)
+	signer, err := LoadTokenSigner(file)
+	if err != nil || signer.Key().N.Cmp(key.N) != 0 {
+		t.Fatalf("Token key failed to load: %v", err)
+	}
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	encoded = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(small)})
+	ioutil.WriteFile(file, encoded, 0600)
+	if _, err := LoadTokenSigner(file); err == nil {
+		t.Fatal("Token key of a small modulus was loaded.")
+	}
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrGeneration turns away a request made under a generation of the
+// configuration which is no longer, or not yet, accepted. Clients fetch
+// updates to learn of the generation in use.
+var ErrGeneration = errors.New("configuration generation not accepted")
+
+// ConfigTransition stages a change of the common configuration at a future
+// write epoch boundary, so a deployment can be reconfigured without stopping.
+// Frontends announce it to clients in GetUpdates ahead of time. From Epoch,
+// writes and reads are made under Next, as its Generation, while for Crossover
+// epochs those of clients still under the previous generation are accepted
+// too, and served from the database of their own generation.
+type ConfigTransition struct {
+	Generation uint64 // Of Next, one past the generation in use
+	Epoch      uint64 // First write epoch under Next
+	Crossover  uint64 // Epochs from Epoch the previous generation is accepted
+	Next       Config
+}
+
+// TransitionReply is the result of staging a transition at a frontend.
+type TransitionReply struct {
+	Err string
+}
+
+// Validate checks a transition follows on from the configuration of the
+// generation before it. Only the shape of items and the database, and the
+// intervals, may change: the buckets of topics, the interest vectors of
+// writes, and the pads of replies must mean the same under both generations.
+func (t *ConfigTransition) Validate(current *Config, generation uint64) error {
+	if t.Generation != generation+1 {
+		return invalid("transition", "generation %d does not follow %d", t.Generation, generation)
+	}
+	if err := t.Next.Validate(); err != nil {
+		return err
+	}
+	next := &t.Next
+	if next.NumBuckets != current.NumBuckets || next.PlacementHash != current.PlacementHash || next.BucketStrategy != current.BucketStrategy {
+		return invalid("transition", "the buckets of topics can't change")
+	}
+	if next.InterestSeed != current.InterestSeed || next.BloomFalsePositive != current.BloomFalsePositive {
+		return invalid("transition", "interest vectors can't change")
+	}
+	if next.PadAlgorithm != current.PadAlgorithm || next.VerifyBuckets != current.VerifyBuckets {
+		return invalid("transition", "replies can't change how they are padded or verified")
+	}
+	return nil
+}
+
+// Crossing reports whether both generations of the transition are accepted
+// in an epoch.
+func (t *ConfigTransition) Crossing(epoch uint64) bool {
+	return epoch >= t.Epoch && epoch-t.Epoch < t.Crossover
+}
+
+// String describes the transition for logs.
+func (t *ConfigTransition) String() string {
+	return fmt.Sprintf("generation %d from epoch %d, crossing over for %d epochs", t.Generation, t.Epoch, t.Crossover)
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport carries the connections RPCs are made over. Transports register
+// themselves under a name, and are chosen by the addresses servers are given:
+// "name:address" for a registered transport, a URL or "host:port" for TCP,
+// and a path starting with "/" for a unix socket. Servers listen on them by
+// naming them as the Network of a listener. Transports carrying messages,
+// rather than streams, present their sessions as connections.
+//
+// "tcp", "tcp4", "tcp6" and "unix" are registered by default, and may be
+// replaced, for instance to reach every server through a proxy.
+type Transport interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// Framing is how RPCs are carried over the connections of a transport.
+type Framing string
+
+// Framings of RPCs.
+const (
+	// FramingHTTP carries JSON RPCs over HTTP/1.1, or multiplexed over
+	// cleartext HTTP/2 or TLS.
+	FramingHTTP Framing = ""
+	// FramingBatch carries only BatchRead calls, over the batch transport.
+	FramingBatch Framing = "batch"
+)
+
+// defaultKeepAlive is the period of TCP keepalives of the default transports.
+const defaultKeepAlive = 30 * time.Second
+
+var (
+	transportsLock sync.Mutex
+	transports     = map[string]Transport{
+		"tcp":  &ipTransport{"tcp"},
+		"tcp4": &ipTransport{"tcp4"},
+		"tcp6": &ipTransport{"tcp6"},
+		"unix": &ipTransport{"unix"},
+	}
+)
+
+// RegisterTransport makes a transport available under a name, replacing any
+// registered before.
+func RegisterTransport(name string, t Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[name] = t
+}
+
+// GetTransport returns the transport registered under a name, or nil.
+func GetTransport(name string) Transport {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	return transports[name]
+}
+
+// ResolveAddress returns the transport an address of a server is dialed
+// over, and the address on it.
+func ResolveAddress(address string) (Transport, string) {
+	if i := strings.Index(address, ":"); i > 0 {
+		if t := GetTransport(address[:i]); t != nil {
+			return t, address[i+1:]
+		}
+	}
+	if strings.HasPrefix(address, "/") {
+		return GetTransport("unix"), address
+	}
+	return GetTransport("tcp"), address
+}
+
+// ListenTransport listens on an address of the transport registered as
+// network.
+func ListenTransport(network string, address string) (net.Listener, error) {
+	t := GetTransport(network)
+	if t == nil {
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+	return t.Listen(address)
+}
+
+// ipTransport is a transport of the net package.
+type ipTransport struct {
+	network string
+}
+
+func (t *ipTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return newDialer(0, defaultKeepAlive).DialContext(ctx, t.network, address)
+}
+
+func (t *ipTransport) Listen(address string) (net.Listener, error) {
+	if t.network == "unix" {
+		// Replace a socket left behind by an earlier run.
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(t.network, address)
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// refusingTransport refuses every connection, recording the addresses asked.
+type refusingTransport struct {
+	dialed []string
+}
+
+var errRefused = errors.New("refused")
+
+func (r *refusingTransport) Dial(_ context.Context, address string) (net.Conn, error) {
+	r.dialed = append(r.dialed, address)
+	return nil, errRefused
+}
+
+func (r *refusingTransport) Listen(address string) (net.Listener, error) {
+	return nil, errRefused
+}
+
+func TestResolveAddress(t *testing.T) {
+	refusing := &refusingTransport{}
+	RegisterTransport("refusing", refusing)
+
+	for address, want := range map[string]struct {
+		transport Transport
+		address   string
+	}{
+		"localhost:9000":        {GetTransport("tcp"), "localhost:9000"},
+		"[::1]:9000":            {GetTransport("tcp"), "[::1]:9000"},
+		"/run/talek.sock":       {GetTransport("unix"), "/run/talek.sock"},
+		"tcp6:[::1]:9000":       {GetTransport("tcp6"), "[::1]:9000"},
+		"refusing:a:b":          {refusing, "a:b"},
+		"unregistered:frontend": {GetTransport("tcp"), "unregistered:frontend"},
+	} {
+		transport, addr := ResolveAddress(address)
+		if transport != want.transport || addr != want.address {
+			t.Fatalf("%s resolved to %v %q", address, transport, addr)
+		}
+	}
+
+	// Pools and batch clients dial over the transport of their address.
+	pool := NewRPCPool("refusing:frontend", 1, 0, 0)
+	defer pool.Close()
+	if err := pool.Call("Frontend.GetName", nil, new(string)); err == nil {
+		t.Fatal("Call over a refusing transport should fail.")
+	}
+	batch := NewBatchClient("refusing:replica", 1, 0)
+	if err := batch.BatchRead(&BatchReadRequest{}, &BatchReadReply{}); err == nil {
+		t.Fatal("Batch read over a refusing transport should fail.")
+	}
+	if len(refusing.dialed) != 2 || refusing.dialed[0] != "frontend" || refusing.dialed[1] != "replica" {
+		t.Fatalf("Unexpected dials %v", refusing.dialed)
+	}
+
+	if _, err := ListenTransport("carrier pigeon", "coop"); err == nil {
+		t.Fatal("Listening on an unknown transport should fail.")
+	}
+}
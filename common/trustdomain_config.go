@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 
 	"github.com/agl/ed25519"
+	"github.com/privacylab/talek/securemem"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -12,12 +13,19 @@ import (
 type TrustDomainConfig struct {
 	Name           string
 	Address        string
+	BatchAddress   string // Batch transport listener, if reads are sent over one
 	IsValid        bool
 	IsDistributed  bool
-	PublicKey      [32]byte // For PIR Encryption
-	SignPublicKey  [32]byte // For Signing Interest Vectors
-	privateKey     [32]byte
-	signPrivateKey [64]byte
+	PublicKey      [32]byte  // For PIR Encryption
+	SignPublicKey  [32]byte  // For Signing Interest Vectors
+	privateKey     *[32]byte // In secure memory, nil without private keys
+	signPrivateKey *[64]byte
+
+	// DNS name to discover the address and keys of the trust domain from,
+	// with Discover. The keys found must match the hex KeyFingerprint pinned
+	// as Fingerprint.
+	DNSName     string
+	Fingerprint string
 }
 
 // PrivateTrustDomainConfig allows export of the trust domain Private Key.
@@ -41,7 +49,9 @@ func NewTrustDomainConfig(name string, address string, isValid bool,
 		return td
 	}
 	copy(td.PublicKey[:], pubKey[:])
+	td.privateKey = securemem.Key32()
 	copy(td.privateKey[:], priKey[:])
+	securemem.Wipe(priKey[:])
 
 	spubKey, spriKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -49,7 +59,9 @@ func NewTrustDomainConfig(name string, address string, isValid bool,
 		return td
 	}
 	copy(td.SignPublicKey[:], spubKey[:])
+	td.signPrivateKey = securemem.Key64()
 	copy(td.signPrivateKey[:], spriKey[:])
+	securemem.Wipe(spriKey[:])
 
 	return td
 }
@@ -67,33 +79,54 @@ func (td *TrustDomainConfig) UnmarshalJSON(marshaled []byte) error {
 		SignPrivateKey [64]byte
 		Name           string
 		Address        string
+		BatchAddress   string
 		IsValid        bool
 		IsDistributed  bool
+		DNSName        string
+		Fingerprint    string
 	}
 	var config Config
 	if err := json.Unmarshal(marshaled, &config); err != nil {
 		return err
 	}
 
-	copy(td.privateKey[:], config.PrivateKey[:])
+	// Private keys are kept only if present, in secure memory.
+	td.privateKey, td.signPrivateKey = nil, nil
+	if config.PrivateKey != [32]byte{} {
+		td.privateKey = securemem.Key32()
+		copy(td.privateKey[:], config.PrivateKey[:])
+		securemem.Wipe(config.PrivateKey[:])
+	}
+	if config.SignPrivateKey != [64]byte{} {
+		td.signPrivateKey = securemem.Key64()
+		copy(td.signPrivateKey[:], config.SignPrivateKey[:])
+		securemem.Wipe(config.SignPrivateKey[:])
+	}
 	copy(td.PublicKey[:], config.PublicKey[:])
-	copy(td.signPrivateKey[:], config.SignPrivateKey[:])
 	copy(td.SignPublicKey[:], config.SignPublicKey[:])
 	td.Name = config.Name
 	td.Address = config.Address
+	td.BatchAddress = config.BatchAddress
 	td.IsValid = config.IsValid
 	td.IsDistributed = config.IsDistributed
+	td.DNSName = config.DNSName
+	td.Fingerprint = config.Fingerprint
 
 	return nil
 }
 
 // Private exposes the Private key of a trust domain config for marshalling.
-//   bytes, err := json.Marshal(trustdomainconfig.Private())
+//
+//	bytes, err := json.Marshal(trustdomainconfig.Private())
 func (td *TrustDomainConfig) Private() *PrivateTrustDomainConfig {
 	PTDC := new(PrivateTrustDomainConfig)
 	PTDC.TrustDomainConfig = td
-	copy(PTDC.PrivateKey[:], td.privateKey[:])
-	copy(PTDC.SignPrivateKey[:], td.signPrivateKey[:])
+	if td.privateKey != nil {
+		copy(PTDC.PrivateKey[:], td.privateKey[:])
+	}
+	if td.signPrivateKey != nil {
+		copy(PTDC.SignPrivateKey[:], td.signPrivateKey[:])
+	}
 	return PTDC
 }
 
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/agl/ed25519"
+	"github.com/privacylab/talek/drbg"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Limits on decoded RPC structures. Anything beyond them is rejected before
+// memory is allocated or indices are taken by them.
+const (
+	// MaxTrustDomains bounds the trust domains a read may be encoded for.
+	MaxTrustDomains = 64
+	// MaxInterestVectorSize bounds the interest vector of a write.
+	MaxInterestVectorSize = 256
+	// pirArgsOverhead bounds what gob encoding adds to the fields of PirArgs.
+	pirArgsOverhead = 256
+)
+
+// ValidationError rejects a malformed or oversized RPC structure, naming the
+// field at fault.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid " + e.Field + ": " + e.Reason
+}
+
+func invalid(field string, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks a configuration describes a database clients and servers
+// can use, with algorithms they know.
+func (cc *Config) Validate() error {
+	if cc.NumBuckets == 0 || cc.BucketDepth == 0 || cc.DataSize == 0 {
+		return invalid("database", "%d buckets of %d items of %d bytes", cc.NumBuckets, cc.BucketDepth, cc.DataSize)
+	}
+	if cc.BloomFalsePositive <= 0 || cc.BloomFalsePositive >= 1 {
+		return invalid("bloom false positive rate", "%v is not between 0 and 1", cc.BloomFalsePositive)
+	}
+	if cc.WriteInterval <= 0 || cc.ReadInterval <= 0 {
+		return invalid("intervals", "writes every %v and reads every %v", cc.WriteInterval, cc.ReadInterval)
+	}
+	if cc.MaxLoadFactor <= 0 || cc.MaxLoadFactor > 1 {
+		return invalid("max load factor", "%v is not in (0, 1]", cc.MaxLoadFactor)
+	}
+	if _, err := NewPlacementHash(cc.PlacementHash); err != nil {
+		return invalid("placement hash", "%v", err)
+	}
+	if _, err := NewBucketStrategy(cc.BucketStrategy); err != nil {
+		return invalid("bucket strategy", "%v", err)
+	}
+	if _, err := NewPad(cc.PadAlgorithm); err != nil {
+		return invalid("pad algorithm", "%v", err)
+	}
+	if cc.ShapeJitter < 0 {
+		return invalid("traffic shape", "jitter of %v", cc.ShapeJitter)
+	}
+	if slot := cc.ReadSlot(); cc.ShapeReads > 0 && (slot == 0 || cc.ShapeJitter > slot) {
+		return invalid("traffic shape", "%d reads every %v with jitter of %v", cc.ShapeReads, cc.ReadInterval, cc.ShapeJitter)
+	}
+	if slot := cc.WriteSlot(); cc.ShapeWrites > 0 && (slot == 0 || cc.ShapeJitter > slot) {
+		return invalid("traffic shape", "%d writes every %v with jitter of %v", cc.ShapeWrites, cc.WriteInterval, cc.ShapeJitter)
+	}
+	n := cc.NumClasses()
+	for i, class := range cc.Classes {
+		if i+1 < n && (class.NumBuckets == 0 || class.BucketDepth == 0 || class.DataSize == 0) {
+			return invalid("size class", "class %d of %d buckets of %d items of %d bytes", i+1, class.NumBuckets, class.BucketDepth, class.DataSize)
+		}
+		if i+1 >= n && class != (SizeClass{}) {
+			return invalid("size class", "class %d follows an unused class", i+1)
+		}
+	}
+	// Items must stay hot for as long as the interest vector can tell
+	// clients they are recent.
+	if cc.HotBuckets > 0 && (cc.HotBuckets >= cc.NumBuckets || cc.HotEpochs <= 2*cc.InterestMultiple) {
+		return invalid("tiers", "%d hot buckets of %d for %d epochs, with interest vectors every %d", cc.HotBuckets, cc.NumBuckets, cc.HotEpochs, cc.InterestMultiple)
+	}
+	return nil
+}
+
+// RequestVectorLength is the length of the request vector of a PIR read of
+// the database.
+func RequestVectorLength(conf *Config) int {
+	return int((conf.NumBuckets + 7) / 8)
+}
+
+// maxSealedPirArgs bounds the length of the encrypted PirArgs of one trust
+// domain.
+func maxSealedPirArgs(conf *Config) int {
+	return RequestVectorLength(conf) + drbg.SeedLength + pirArgsOverhead + box.Overhead
+}
+
+// Validate checks a write is of buckets and data the database holds.
+func (w *WriteArgs) Validate(conf *Config) error {
+	if w.Bucket1 >= conf.NumBuckets || w.Bucket2 >= conf.NumBuckets {
+		return invalid("buckets", "%d and %d are not both below %d", w.Bucket1, w.Bucket2, conf.NumBuckets)
+	}
+	if uint64(len(w.Data)) > conf.DataSize {
+		return invalid("data", "%d bytes exceed items of %d", len(w.Data), conf.DataSize)
+	}
+	if len(w.InterestVector) > MaxInterestVectorSize {
+		return invalid("interest vector", "%d bytes exceed %d", len(w.InterestVector), MaxInterestVectorSize)
+	}
+	if len(w.BroadcastKey) != 0 && len(w.BroadcastKey) != ed25519.PublicKeySize {
+		return invalid("broadcast key", "%d bytes is not a signing key", len(w.BroadcastKey))
+	}
+	if len(w.PuzzleSeed) > MaxPuzzleSeed {
+		return invalid("puzzle seed", "%d bytes exceed %d", len(w.PuzzleSeed), MaxPuzzleSeed)
+	}
+	if w.Token != nil && len(w.Token.Signature) > TokenKeyBits/8 {
+		return invalid("token", "%d byte signature exceeds %d", len(w.Token.Signature), TokenKeyBits/8)
+	}
+	return nil
+}
+
+// Validate checks a read is encoded for trustDomains trust domains, with
+// each part no longer than a PIR request of the database.
+func (r *EncodedReadArgs) Validate(conf *Config, trustDomains int) error {
+	if len(r.PirArgs) != trustDomains || trustDomains > MaxTrustDomains {
+		return invalid("read", "encoded for %d trust domains rather than %d", len(r.PirArgs), trustDomains)
+	}
+	return r.validateParts(conf)
+}
+
+func (r *EncodedReadArgs) validateParts(conf *Config) error {
+	max := maxSealedPirArgs(conf)
+	for i, p := range r.PirArgs {
+		if len(p) > max {
+			return invalid("read", "%d bytes for trust domain %d exceed %d", len(p), i, max)
+		}
+	}
+	return nil
+}
+
+// Validate checks decoded PIR arguments are a request of the database.
+func (p *PirArgs) Validate(conf *Config) error {
+	if len(p.RequestVector) != RequestVectorLength(conf) {
+		return invalid("request vector", "%d bytes rather than %d", len(p.RequestVector), RequestVectorLength(conf))
+	}
+	if len(p.PadSeed) != drbg.SeedLength {
+		return invalid("pad seed", "%d bytes rather than %d", len(p.PadSeed), drbg.SeedLength)
+	}
+	return nil
+}
+
+// Validate checks a batch holds at most batchSize reads, each a pad request
+// or encoded for the trust domain at index domain.
+func (b *BatchReadRequest) Validate(conf *Config, batchSize int, domain int) error {
+	if len(b.Args) > batchSize {
+		return invalid("batch", "%d reads exceed batches of %d", len(b.Args), batchSize)
+	}
+	for i := range b.Args {
+		a := &b.Args[i]
+		if len(a.PirArgs) == 0 {
+			continue
+		}
+		if len(a.PirArgs) <= domain || len(a.PirArgs) > MaxTrustDomains {
+			return invalid("batch", "read %d is encoded for %d trust domains", i, len(a.PirArgs))
+		}
+		if err := a.validateParts(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
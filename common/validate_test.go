@@ -0,0 +1,131 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+func TestValidate(t *testing.T) {
+	conf := &Config{NumBuckets: 100, DataSize: 32}
+
+	write := &WriteArgs{Bucket1: 99, Bucket2: 0, Data: make([]byte, 32), BroadcastKey: make([]byte, 32)}
+	if err := write.Validate(conf); err != nil {
+		t.Fatalf("Valid write refused: %v", err)
+	}
+	for _, w := range []WriteArgs{
+		{Bucket1: 100},
+		{Bucket2: 1 << 63},
+		{Data: make([]byte, 33)},
+		{InterestVector: make([]byte, MaxInterestVectorSize+1)},
+		{BroadcastKey: make([]byte, 31)},
+	} {
+		if err, ok := w.Validate(conf).(*ValidationError); !ok {
+			t.Fatalf("Invalid write %+v should be refused, got %v", w, err)
+		}
+	}
+
+	pir := &PirArgs{RequestVector: make([]byte, 13), PadSeed: make([]byte, drbg.SeedLength)}
+	if err := pir.Validate(conf); err != nil {
+		t.Fatalf("Valid PIR args refused: %v", err)
+	}
+	if err := (&PirArgs{RequestVector: make([]byte, 12), PadSeed: pir.PadSeed}).Validate(conf); err == nil {
+		t.Fatal("Short request vector should be refused.")
+	}
+	if err := (&PirArgs{RequestVector: pir.RequestVector}).Validate(conf); err == nil {
+		t.Fatal("Missing pad seed should be refused.")
+	}
+
+	read := &EncodedReadArgs{PirArgs: [][]byte{make([]byte, 100), make([]byte, 100)}}
+	if err := read.Validate(conf, 2); err != nil {
+		t.Fatalf("Valid read refused: %v", err)
+	}
+	if err := read.Validate(conf, 3); err == nil {
+		t.Fatal("Read for the wrong trust domains should be refused.")
+	}
+	read.PirArgs[1] = make([]byte, maxSealedPirArgs(conf)+1)
+	if err := read.Validate(conf, 2); err == nil {
+		t.Fatal("Oversized read should be refused.")
+	}
+
+	batch := &BatchReadRequest{Args: []EncodedReadArgs{{}, {PirArgs: [][]byte{{1}}}}}
+	if err := batch.Validate(conf, 2, 0); err != nil {
+		t.Fatalf("Valid batch refused: %v", err)
+	}
+	if err := batch.Validate(conf, 1, 0); err == nil {
+		t.Fatal("Oversized batch should be refused.")
+	}
+	if err := batch.Validate(conf, 2, 1); err == nil {
+		t.Fatal("Batch lacking this trust domain should be refused.")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			NumBuckets:         64,
+			BucketDepth:        4,
+			DataSize:           512,
+			BloomFalsePositive: 0.05,
+			WriteInterval:      time.Second,
+			ReadInterval:       time.Second,
+			MaxLoadFactor:      0.95,
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Valid config refused: %v", err)
+	}
+	shaped := valid()
+	shaped.ShapeReads, shaped.ShapeWrites, shaped.ShapeJitter = 4, 2, 100*time.Millisecond
+	if err := shaped.Validate(); err != nil {
+		t.Fatalf("Valid traffic shape refused: %v", err)
+	}
+	classed := valid()
+	classed.Classes[0] = SizeClass{NumBuckets: 16, BucketDepth: 2, DataSize: 16384}
+	if err := classed.Validate(); err != nil {
+		t.Fatalf("Valid size class refused: %v", err)
+	}
+	if n := classed.NumClasses(); n != 2 {
+		t.Fatalf("Config with one further size class has %d classes.", n)
+	}
+	if large, err := classed.Class(1); err != nil || large.DataSize != 16384 || large.NumBuckets != 16 || large.NumClasses() != 1 || large.ReadInterval != time.Second {
+		t.Fatalf("Size class 1 configured as %+v: %v", large, err)
+	}
+	if _, err := classed.Class(2); err != ErrClass {
+		t.Fatalf("Unconfigured size class should be refused, got %v", err)
+	}
+	tiered := valid()
+	tiered.InterestMultiple, tiered.HotBuckets, tiered.HotEpochs = 2, 8, 5
+	if err := tiered.Validate(); err != nil {
+		t.Fatalf("Valid tiers refused: %v", err)
+	}
+	if hot, err := tiered.Tier(TierHot); err != nil || hot.NumBuckets != 8 || hot.HotBucket(13) != 5 {
+		t.Fatalf("Hot tier configured as %+v: %v", hot, err)
+	}
+	if _, err := valid().Tier(TierHot); err != ErrTier {
+		t.Fatalf("Hot tier of a configuration without tiers should be refused, got %v", err)
+	}
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.NumBuckets = 0 },
+		func(c *Config) { c.BloomFalsePositive = 1 },
+		func(c *Config) { c.ReadInterval = 0 },
+		func(c *Config) { c.MaxLoadFactor = 1.5 },
+		func(c *Config) { c.PlacementHash = 255 },
+		func(c *Config) { c.BucketStrategy = 255 },
+		func(c *Config) { c.PadAlgorithm = 255 },
+		func(c *Config) { c.ShapeJitter = -time.Second },
+		func(c *Config) { c.ShapeReads, c.ShapeJitter = 4, time.Second },
+		func(c *Config) { c.ShapeWrites = uint64(time.Second) + 1 },
+		func(c *Config) { c.Classes[0] = SizeClass{NumBuckets: 16, DataSize: 16384} },
+		func(c *Config) { c.Classes[1] = SizeClass{NumBuckets: 16, BucketDepth: 2, DataSize: 16384} },
+		func(c *Config) { c.HotBuckets, c.HotEpochs = 64, 5 },
+		func(c *Config) { c.InterestMultiple, c.HotBuckets, c.HotEpochs = 2, 8, 4 },
+	} {
+		c := valid()
+		mutate(c)
+		if err, ok := c.Validate().(*ValidationError); !ok {
+			t.Fatalf("Invalid config %+v should be refused, got %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+)
+
+// countingSource counts the values drawn from a seeded source, so that its
+// position can be restored in another table.
+type countingSource struct {
+	rand.Source
+	seed  int64
+	draws uint64
+}
+
+func newCountingSource(seed int64) *countingSource {
+	return &countingSource{Source: rand.NewSource(seed), seed: seed}
+}
+
+func (c *countingSource) Int63() int64 {
+	c.draws++
+	return c.Source.Int63()
+}
+
+// tableState is the serialized form of a table.
+type tableState struct {
+	NumBuckets  uint64
+	BucketDepth uint64
+	ItemSize    uint64
+	Seed        int64
+	Draws       uint64
+	Index       []locationState
+	Data        []byte
+	Stash       []*Item
+	Rebalanced  uint64
+}
+
+type locationState struct {
+	ID      uint64
+	Filled  bool
+	Pinned  bool
+	Bucket1 uint64
+	Bucket2 uint64
+}
+
+// MarshalBinary serializes the full state of the table, including the position
+// of its random source, so a restored table makes the same placements as this
+// one given the same operations.
+func (t *Table) MarshalBinary() ([]byte, error) {
+	state := tableState{
+		NumBuckets:  t.numBuckets,
+		BucketDepth: t.bucketDepth,
+		ItemSize:    t.itemSize,
+		Seed:        t.source.seed,
+		Draws:       t.source.draws,
+		Index:       make([]locationState, len(t.index)),
+		Data:        t.data,
+		Stash:       t.stash,
+		Rebalanced:  t.rebalanced,
+	}
+	for i, l := range t.index {
+		state.Index[i] = locationState{l.id, l.filled, l.pinned, l.bucket1, l.bucket2}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores the state of a table of the same dimensions,
+// keeping the memory area backing it.
+func (t *Table) UnmarshalBinary(data []byte) error {
+	var state tableState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	if state.NumBuckets != t.numBuckets || state.BucketDepth != t.bucketDepth || state.ItemSize != t.itemSize ||
+		len(state.Index) != len(t.index) || len(state.Data) != len(t.data) {
+		return fmt.Errorf("%v: state of a %dx%d table of %d byte items does not fit", t.name, state.NumBuckets, state.BucketDepth, state.ItemSize)
+	}
+
+	copy(t.data, state.Data)
+	for i, l := range state.Index {
+		t.index[i] = ItemLocation{l.ID, l.Filled, l.Pinned, l.Bucket1, l.Bucket2}
+	}
+	t.stash = state.Stash
+	t.rebalanced = state.Rebalanced
+	t.source = newCountingSource(state.Seed)
+	for t.source.draws < state.Draws {
+		t.source.Int63()
+	}
+	t.rand = rand.New(t.source)
+	return nil
+}
@@ -11,10 +11,15 @@ import (
 // attempt fails.
 const MaxEvictions int = 500
 
+// StashSize is the number of items a table holds aside when they can't be
+// placed after MaxEvictions, until removals make room for them in a bucket.
+const StashSize int = 8
+
 // ItemLocation holds metadata for item placement in a cuckoo table.
 type ItemLocation struct {
 	id      uint64
 	filled  bool
+	pinned  bool
 	bucket1 uint64
 	bucket2 uint64
 }
@@ -27,8 +32,12 @@ type Table struct {
 	itemSize    uint64 // Number of bytes in an item. Must be fixed globally
 	data        []byte // Serialized cuckoo table data of all items {bucket1, bucket2, ...}
 	rand        *rand.Rand
+	source      *countingSource
 	log         *common.Logger
 	index       []ItemLocation // Meta data of each item's bucket locations and ID
+	stash       []*Item        // Items waiting for room in either of their buckets
+	rebalanced  uint64         // Bucket Rebalance continues from
+	strategy    common.BucketStrategy
 }
 
 // NewTable creates a new cuckoo table optionaly backed by a pre-allocated memory area.
@@ -40,12 +49,13 @@ type Table struct {
 // randSeed = seed for PRNG
 func NewTable(name string, numBuckets uint64, bucketDepth uint64, itemSize uint64,
 	data []byte, randSeed int64) *Table {
-	t := &Table{name, numBuckets, bucketDepth, itemSize, nil, nil, nil, nil}
+	t := &Table{name, numBuckets, bucketDepth, itemSize, nil, nil, nil, nil, nil, nil, 0, nil}
 	if data == nil {
 		data = make([]byte, numBuckets*bucketDepth*itemSize)
 	}
 	t.data = data
-	t.rand = rand.New(rand.NewSource(randSeed))
+	t.source = newCountingSource(randSeed)
+	t.rand = rand.New(t.source)
 	t.log = common.NewLogger(name)
 	t.index = make([]ItemLocation, numBuckets*bucketDepth)
 
@@ -61,15 +71,22 @@ func NewTable(name string, numBuckets uint64, bucketDepth uint64, itemSize uint6
  * PUBLIC METHODS
  ********************/
 
+// SetStrategy has the table try the buckets of items in the order a bucket
+// strategy chooses, rather than at random.
+func (t *Table) SetStrategy(strategy common.BucketStrategy) {
+	t.strategy = strategy
+}
+
 // GetCapacity returns the total capacity of the table (numBuckets * depth)
 func (t *Table) GetCapacity() uint64 {
 	return t.numBuckets * t.bucketDepth
 }
 
-// GetNumElements returns the number of elements stored in the table
+// GetNumElements returns the number of elements stored in the table, including
+// those in the stash.
 // Load factor = GetNumElements() / GetCapacity()
 func (t *Table) GetNumElements() uint64 {
-	result := uint64(0)
+	result := uint64(len(t.stash))
 	for _, itemLocation := range t.index {
 		if itemLocation.filled {
 			result++
@@ -79,6 +96,91 @@ func (t *Table) GetNumElements() uint64 {
 	return result
 }
 
+// Stashed returns the number of items in the stash. Stashed items are held by
+// the table, but are not in the data until placed in a bucket.
+func (t *Table) Stashed() int {
+	return len(t.stash)
+}
+
+// Occupancy returns a histogram of bucket load: the number of buckets holding
+// 0, 1, ... up to depth items.
+func (t *Table) Occupancy() []uint64 {
+	histogram := make([]uint64, t.bucketDepth+1)
+	for b := uint64(0); b < t.numBuckets; b++ {
+		count := 0
+		for i := b * t.bucketDepth; i < (b+1)*t.bucketDepth; i++ {
+			if t.index[i].filled {
+				count++
+			}
+		}
+		histogram[count]++
+	}
+	return histogram
+}
+
+// Full checks if both of an item's buckets are full.
+func (t *Table) Full(item *Item) bool {
+	return t.bucketFull(item.Bucket1) && t.bucketFull(item.Bucket2)
+}
+
+// EvictOldest removes the regular item with the lowest ID from either of an
+// item's buckets, making room for it. Returns the removed item, or nil if the
+// buckets hold only pinned items.
+func (t *Table) EvictOldest(item *Item) *Item {
+	oldest := -1
+	for _, b := range []uint64{item.Bucket1, item.Bucket2} {
+		for i := b * t.bucketDepth; i < (b+1)*t.bucketDepth; i++ {
+			if t.index[i].filled && !t.index[i].pinned && (oldest < 0 || t.index[i].id < t.index[oldest].id) {
+				oldest = int(i)
+			}
+		}
+	}
+	if oldest < 0 {
+		return nil
+	}
+	removed := t.getItem(uint64(oldest)).Copy()
+	t.index[oldest].filled = false
+	return removed
+}
+
+// Rebalance moves up to maxMoves regular items to their other bucket where it
+// holds at least two fewer items, evening out bucket occupancy so later inserts
+// need shorter eviction chains. Stashed items are placed first where there is
+// room. Each call continues through the buckets where the last left off.
+// Returns the number of items moved.
+func (t *Table) Rebalance(maxMoves int) int {
+	if t.numBuckets == 0 {
+		return 0
+	}
+	stashed := len(t.stash)
+	t.unstash()
+	moves := stashed - len(t.stash)
+
+	for visited := uint64(0); visited < t.numBuckets && moves < maxMoves; visited++ {
+		b := t.rebalanced
+		t.rebalanced = (t.rebalanced + 1) % t.numBuckets
+		for i := b * t.bucketDepth; i < (b+1)*t.bucketDepth && moves < maxMoves; i++ {
+			l := t.index[i]
+			if !l.filled || l.pinned {
+				continue
+			}
+			other := l.bucket1
+			if other == b {
+				other = l.bucket2
+			}
+			if other == b || t.bucketLoad(other)+1 >= t.bucketLoad(b) {
+				continue
+			}
+			item := t.getItem(i)
+			if t.tryInsertToBucket(other, item, false) {
+				t.index[i].filled = false
+				moves++
+			}
+		}
+	}
+	return moves
+}
+
 // Bucket returns the bucket in a table that the Item is in, if it is in the table.
 // an invalid bucket number and an error, otherwise
 func (t *Table) Bucket(item *Item) (uint64, error) {
@@ -86,14 +188,16 @@ func (t *Table) Bucket(item *Item) (uint64, error) {
 		return item.Bucket1, nil
 	} else if t.isInBucket(item.Bucket2, item) {
 		return item.Bucket2, nil
+	} else if t.stashIndex(item) >= 0 {
+		return t.numBuckets + 1, fmt.Errorf("%v.Bucket(%v): item is stashed", t.name, item)
 	}
 	return t.numBuckets + 1, fmt.Errorf("%v.Bucket(%v): item not in table", t.name, item)
 }
 
-// Contains checks if value exists in specified buckets
+// Contains checks if value exists in specified buckets, or the stash
 // the value must have been inserted with the same bucket1 and bucket2 values
 // Returns:
-// - true if the item is in either bucket
+// - true if the item is in either bucket or the stash
 // - false if either bucket is out of range
 // - false if value not in either bucket
 func (t *Table) Contains(item *Item) bool {
@@ -101,7 +205,21 @@ func (t *Table) Contains(item *Item) bool {
 		return false
 	}
 
-	return t.isInBucket(item.Bucket1, item) || t.isInBucket(item.Bucket2, item)
+	return t.isInBucket(item.Bucket1, item) || t.isInBucket(item.Bucket2, item) || t.stashIndex(item) >= 0
+}
+
+// Pinned checks if an item is in the table, pinned by InsertPinned.
+func (t *Table) Pinned(item *Item) bool {
+	if item.Bucket1 >= t.numBuckets || item.Bucket2 >= t.numBuckets {
+		return false
+	}
+	for i := item.Bucket1 * t.bucketDepth; i < (item.Bucket1+1)*t.bucketDepth; i++ {
+		if t.index[i].filled && t.index[i].pinned && t.index[i].id == item.ID &&
+			t.index[i].bucket1 == item.Bucket1 && t.index[i].bucket2 == item.Bucket2 {
+			return true
+		}
+	}
+	return false
 }
 
 // Insert adds item into the cuckoo table, even if a duplicate value already
@@ -109,38 +227,81 @@ func (t *Table) Contains(item *Item) bool {
 // - true on success, false on failure
 // - false if item.Data is not equal to t.itemSize
 // - false if either bucket is out of range
-// - false if insertion cannot complete because reached MAX_EVICTIONS
+// - false if insertion cannot complete because reached MAX_EVICTIONS, with the stash full
 func (t *Table) Insert(item *Item) (bool, *Item) {
-	var nextBucket uint64
+	if !t.validItem(item) {
+		return false, nil
+	}
+
+	// Randomly select 1 bucket first, unless the strategy chooses by load.
+	coin := t.rand.Int() % 2 // Coin can be 0 or 1
+	first := 1 + coin
+	if t.strategy != nil {
+		first = t.strategy.First(t.bucketLoad(item.Bucket1), t.bucketLoad(item.Bucket2), coin)
+	}
+	if first == 1 {
+		if t.tryInsertToBucket(item.Bucket1, item, false) {
+			return true, nil
+		}
+		return t.relocate(item, item.Bucket1)
+	}
+	if t.tryInsertToBucket(item.Bucket2, item, false) {
+		return true, nil
+	}
+	return t.relocate(item, item.Bucket2)
+}
+
+// InsertPinned adds an item whose position is publicly known, such as a
+// broadcast. A pinned item is placed in its Bucket1 and is never evicted, so
+// it does not move until removed. At most half of a bucket may be pinned, so
+// regular items can always be evicted to make room; once a bucket reaches that
+// limit, further items for it are inserted as regular items.
+// Returns the same values as Insert. Items returned as not placed are not
+// pinned, and may be retried with Insert.
+func (t *Table) InsertPinned(item *Item) (bool, *Item) {
+	if !t.validItem(item) {
+		return false, nil
+	}
+	if t.pinnedInBucket(item.Bucket1) >= t.bucketDepth/2 {
+		return t.Insert(item)
+	}
+	if t.tryInsertToBucket(item.Bucket1, item, true) {
+		return true, nil
+	}
+
+	// Make room by evicting a regular item, which then finds a new place.
+	ok, evicted := t.insertAndEvict(item.Bucket1, item, true)
+	if !ok {
+		return false, item
+	}
+	return t.relocate(evicted, item.Bucket1)
+}
+
+func (t *Table) validItem(item *Item) bool {
 	if item.Bucket1 >= t.numBuckets || item.Bucket2 >= t.numBuckets {
 		t.log.Error.Printf("Insert: invalid buckets=(%v,%v)\n", item.Bucket1, item.Bucket2)
-		return false, nil
+		return false
 	}
 
 	// Check item data size
 	if uint64(len(item.Data)) != t.itemSize {
 		t.log.Error.Printf("Insert: invalid data size=%v\n", len(item.Data))
-		return false, nil
+		return false
 	}
+	return true
+}
 
-	// Randomly select 1 bucket first
-	coin := t.rand.Int() % 2 // Coin can be 0 or 1
-	if coin == 0 {
-		if t.tryInsertToBucket(item.Bucket1, item) {
-			return true, nil
-		}
+// relocate places a regular item which could not be placed in fromBucket in
+// its other bucket, starting the eviction loop.
+func (t *Table) relocate(item *Item, fromBucket uint64) (bool, *Item) {
+	nextBucket := item.Bucket1
+	if fromBucket == item.Bucket1 {
 		nextBucket = item.Bucket2
-	} else {
-		if t.tryInsertToBucket(item.Bucket2, item) {
-			return true, nil
-		}
-		nextBucket = item.Bucket1
 	}
 
-	// Then try the other bucket, starting the eviction loop
 	var ok bool
 	for i := 0; i < MaxEvictions; i++ {
-		if ok, item = t.insertAndEvict(nextBucket, item); !ok {
+		if ok, item = t.insertAndEvict(nextBucket, item, false); !ok {
 			t.log.Error.Fatalf("Lost item. Evicted, but was unable to add.")
 			return false, item
 		} else if item == nil {
@@ -152,6 +313,10 @@ func (t *Table) Insert(item *Item) (bool, *Item) {
 		}
 	}
 
+	if len(t.stash) < StashSize {
+		t.stash = append(t.stash, item.Copy())
+		return true, nil
+	}
 	t.log.Error.Printf("Insert: max %v evictions\n", MaxEvictions)
 	return false, item
 }
@@ -180,7 +345,15 @@ func (t *Table) Remove(item *Item) bool {
 		nextBucket = item.Bucket1
 	}
 
-	return result || t.removeFromBucket(nextBucket, item)
+	if result || t.removeFromBucket(nextBucket, item) {
+		t.unstash()
+		return true
+	}
+	if i := t.stashIndex(item); i >= 0 {
+		t.stash = append(t.stash[:i], t.stash[i+1:]...)
+		return true
+	}
+	return false
 }
 
 /********************
@@ -210,7 +383,7 @@ func (t *Table) isInBucket(bucketIndex uint64, item *Item) bool {
 // - bucket MUST be within bounds
 // - item MUST contain data of size t.itemSize
 // Returns: true if success, false if bucket already full
-func (t *Table) tryInsertToBucket(bucketIndex uint64, item *Item) bool {
+func (t *Table) tryInsertToBucket(bucketIndex uint64, item *Item, pinned bool) bool {
 	// Search for an empty slot
 	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
 		if !t.index[i].filled {
@@ -218,6 +391,7 @@ func (t *Table) tryInsertToBucket(bucketIndex uint64, item *Item) bool {
 			t.index[i].id = item.ID
 			t.index[i].bucket1 = item.Bucket1
 			t.index[i].bucket2 = item.Bucket2
+			t.index[i].pinned = pinned
 			t.index[i].filled = true
 			return true
 		}
@@ -234,26 +408,93 @@ func (t *Table) tryInsertToBucket(bucketIndex uint64, item *Item) bool {
 // - (-1, BucketLocation{}, nil, true) if there's empty space and succeeds
 // - false if insertion triggered an eviction
 //   other values contain the evicted item's alternate bucket, BucketLocation pair, and value
-func (t *Table) insertAndEvict(bucketIndex uint64, item *Item) (bool, *Item) {
+//   Pinned items are never evicted.
+func (t *Table) insertAndEvict(bucketIndex uint64, item *Item, pinned bool) (bool, *Item) {
 	if item.Bucket1 != bucketIndex && item.Bucket2 != bucketIndex {
 		return false, item
 	}
-	if t.tryInsertToBucket(bucketIndex, item) {
+	if t.tryInsertToBucket(bucketIndex, item, pinned) {
 		return true, nil
 	}
 
-	// Eviction
-	itemIndex := bucketIndex*t.bucketDepth + (uint64(t.rand.Int63()) % t.bucketDepth)
+	// Eviction of a random item which is not pinned. Buckets are at most half
+	// pinned, so one always exists.
+	start := uint64(t.rand.Int63()) % t.bucketDepth
+	itemIndex := bucketIndex*t.bucketDepth + start
+	for i := uint64(0); i < t.bucketDepth; i++ {
+		itemIndex = bucketIndex*t.bucketDepth + (start+i)%t.bucketDepth
+		if !t.index[itemIndex].pinned {
+			break
+		}
+	}
+	if t.index[itemIndex].pinned {
+		t.log.Error.Printf("insertAndEvict: bucket %v holds only pinned items\n", bucketIndex)
+		return false, item
+	}
 	removedItem := t.getItem(itemIndex).Copy()
 	t.index[itemIndex].filled = false
 
-	if !t.tryInsertToBucket(bucketIndex, item) {
+	if !t.tryInsertToBucket(bucketIndex, item, pinned) {
 		t.log.Error.Fatalf("insertAndEvict: no space in bucket after eviction!")
 		return false, removedItem
 	}
 	return true, removedItem
 }
 
+func (t *Table) bucketLoad(bucketIndex uint64) uint64 {
+	load := uint64(0)
+	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
+		if t.index[i].filled {
+			load++
+		}
+	}
+	return load
+}
+
+func (t *Table) bucketFull(bucketIndex uint64) bool {
+	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
+		if !t.index[i].filled {
+			return false
+		}
+	}
+	return true
+}
+
+// stashIndex returns the position of an item in the stash, or -1.
+func (t *Table) stashIndex(item *Item) int {
+	for i, s := range t.stash {
+		if item.Equals(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// unstash places stashed items in buckets with room for them.
+func (t *Table) unstash() {
+	kept := t.stash[:0]
+	for _, item := range t.stash {
+		if !t.tryInsertToBucket(item.Bucket1, item, false) && !t.tryInsertToBucket(item.Bucket2, item, false) {
+			kept = append(kept, item)
+		}
+	}
+	for i := len(kept); i < len(t.stash); i++ {
+		t.stash[i] = nil
+	}
+	t.stash = kept
+}
+
+// pinnedInBucket counts the pinned items in a bucket.
+func (t *Table) pinnedInBucket(bucketIndex uint64) uint64 {
+	count := uint64(0)
+	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
+		if t.index[i].filled && t.index[i].pinned {
+			count++
+		}
+	}
+	return count
+}
+
 // Removes a single copy of `value` from the specified bucket
 // bucketLoc and value must both match
 // Preconditions:
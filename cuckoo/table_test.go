@@ -7,6 +7,8 @@ import (
 	"math/rand"
 	"strconv"
 	"testing"
+
+	"github.com/privacylab/talek/common"
 )
 
 const testItemSize = uint64(64)
@@ -361,3 +363,306 @@ func BenchmarkInserts(b *testing.B) {
 		}
 	}
 }
+
+func TestInsertPinned(t *testing.T) {
+	table := NewTable("t", 2, 2, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+
+	pinned := &Item{1, GetBytes("pinned"), 0, 1}
+	if ok, evicted := table.InsertPinned(pinned); !ok || evicted != nil {
+		t.Fatalf("Failed to insert pinned item")
+	}
+	if b, _ := table.Bucket(pinned); b != 0 || !table.Pinned(pinned) {
+		t.Fatalf("Pinned item should be pinned in its first bucket, was %d", b)
+	}
+
+	// Only half of a bucket can be pinned; a second item is placed as a regular item.
+	second := &Item{2, GetBytes("second"), 0, 1}
+	if ok, evicted := table.InsertPinned(second); !ok || evicted != nil {
+		t.Fatalf("Failed to insert second pinned item")
+	}
+	if table.Pinned(second) {
+		t.Fatalf("Bucket should not be more than half pinned")
+	}
+
+	// Fill the table; the pinned item should never move.
+	for i := uint64(3); i < 5; i++ {
+		if ok, evicted := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, 1}); !ok || evicted != nil {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+		if b, _ := table.Bucket(pinned); b != 0 {
+			t.Fatalf("Pinned item was displaced after insert %d", i)
+		}
+	}
+
+	// Inserting beyond capacity fills the stash, then fails, but never gives up
+	// the pinned item.
+	for i := uint64(5); i < uint64(5+StashSize); i++ {
+		if ok, _ := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, 1}); !ok {
+			t.Fatalf("Failed to stash item %d", i)
+		}
+	}
+	for i := uint64(5 + StashSize); i < uint64(10+StashSize); i++ {
+		ok, evicted := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, 1})
+		if ok || evicted == nil {
+			t.Fatalf("Insert into a full table should fail with a leftover item")
+		}
+		if evicted.ID == pinned.ID || !table.Contains(pinned) {
+			t.Fatalf("Pinned item was evicted from a full table")
+		}
+	}
+}
+
+func TestInsertPinnedFullBucket(t *testing.T) {
+	table := NewTable("t", 4, 4, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+
+	// Fill bucket 0 with regular items.
+	for i := uint64(0); i < 4; i++ {
+		if ok, _ := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, i%3 + 1}); !ok {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+	}
+
+	// Pinned items displace regular ones from a full bucket, up to half of it.
+	pins := make([]*Item, 0)
+	for i := uint64(10); i < 14; i++ {
+		item := &Item{i, GetBytes("pin" + strconv.Itoa(int(i))), 0, i%3 + 1}
+		ok, evicted := table.InsertPinned(item)
+		if !ok || evicted != nil {
+			t.Fatalf("Failed to insert pinned item %d", i)
+		}
+		pins = append(pins, item)
+	}
+	pinnedCount := 0
+	for _, p := range pins {
+		if table.Pinned(p) {
+			pinnedCount++
+		}
+		if !table.Contains(p) {
+			t.Fatalf("Item %d was lost", p.ID)
+		}
+	}
+	if pinnedCount != 2 {
+		t.Fatalf("Expected 2 pinned items in bucket, found %d", pinnedCount)
+	}
+
+	// A bucket that is half pinned still accepts regular items by eviction.
+	for i := uint64(20); i < 24; i++ {
+		if ok, _ := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, i%3 + 1}); !ok {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+	}
+	for _, p := range pins[0:2] {
+		if b, _ := table.Bucket(p); b != 0 {
+			t.Fatalf("Pinned item %d was displaced", p.ID)
+		}
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	table := NewTable("t", 4, 2, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+	for i, buckets := range [][2]uint64{{0, 0}, {0, 0}, {1, 1}} {
+		item := &Item{uint64(i), GetBytes("value" + strconv.Itoa(i)), buckets[0], buckets[1]}
+		if ok, _ := table.Insert(item); !ok {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+	}
+	occupancy := table.Occupancy()
+	if len(occupancy) != 3 || occupancy[0] != 2 || occupancy[1] != 1 || occupancy[2] != 1 {
+		t.Fatalf("Unexpected occupancy histogram %v", occupancy)
+	}
+}
+
+func TestStash(t *testing.T) {
+	table := NewTable("t", 2, 1, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+
+	items := make([]*Item, 0)
+	for i := 0; i < 2+StashSize; i++ {
+		item := &Item{uint64(i), GetBytes("value" + strconv.Itoa(i)), 0, 1}
+		if ok, evicted := table.Insert(item); !ok || evicted != nil {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+		items = append(items, item)
+	}
+	if table.Stashed() != StashSize || table.GetNumElements() != uint64(2+StashSize) {
+		t.Fatalf("Expected %d stashed items, found %d", StashSize, table.Stashed())
+	}
+	overflow := &Item{100, GetBytes("overflow"), 0, 1}
+	ok, evicted := table.Insert(overflow)
+	if ok || evicted == nil {
+		t.Fatalf("Insert with a full stash should fail with a leftover item")
+	}
+
+	// The leftover is any one item, and all others are held.
+	items = append(items, overflow)
+	for i, item := range items {
+		if item.Equals(evicted) {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	for _, item := range items {
+		if !table.Contains(item) {
+			t.Fatalf("Item %d was lost", item.ID)
+		}
+	}
+
+	// Removing a placed item makes room for a stashed one.
+	for _, item := range items {
+		if _, err := table.Bucket(item); err == nil {
+			if !table.Remove(item) {
+				t.Fatalf("Failed to remove item %d", item.ID)
+			}
+			break
+		}
+	}
+	if table.Stashed() != StashSize-1 {
+		t.Fatalf("A stashed item should have been placed, %d remain stashed", table.Stashed())
+	}
+
+	// Stashed items can be removed directly.
+	for _, item := range items {
+		if _, err := table.Bucket(item); err != nil && table.Contains(item) {
+			if !table.Remove(item) || table.Contains(item) {
+				t.Fatalf("Failed to remove stashed item %d", item.ID)
+			}
+			break
+		}
+	}
+	if table.Stashed() != StashSize-2 {
+		t.Fatalf("Expected %d stashed items, found %d", StashSize-2, table.Stashed())
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	table := NewTable("t", 2, 2, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+	pinned := &Item{1, GetBytes("pinned"), 0, 1}
+	table.InsertPinned(pinned)
+	for i := uint64(2); i < 5; i++ {
+		if ok, _ := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, 1}); !ok {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+	}
+	item := &Item{5, GetBytes("value5"), 0, 1}
+	if !table.Full(item) {
+		t.Fatalf("Buckets should be full")
+	}
+	if old := table.EvictOldest(item); old == nil || old.ID != 2 {
+		t.Fatalf("Expected the oldest regular item to be evicted, got %v", old)
+	}
+	if table.Full(item) || !table.Contains(pinned) {
+		t.Fatalf("Eviction should free a slot, and keep the pinned item")
+	}
+}
+
+func TestMarshalTable(t *testing.T) {
+	a := NewTable("a", 16, 2, testItemSize, nil, 7)
+	insert := func(table *Table, from, to int) {
+		for i := from; i < to; i++ {
+			table.Insert(&Item{uint64(i), GetBytes("value" + strconv.Itoa(i)), uint64(i) % 4, uint64(i*7) % 16})
+		}
+	}
+	insert(a, 0, 20)
+
+	state, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewTable("b", 16, 2, testItemSize, nil, 0)
+	if err := b.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewTable("c", 8, 2, testItemSize, nil, 7).UnmarshalBinary(state); err == nil {
+		t.Fatal("State should not restore into a table of other dimensions.")
+	}
+
+	// Restored tables make the same placements as the original.
+	insert(a, 20, 40)
+	insert(b, 20, 40)
+	if !bytes.Equal(a.data, b.data) || a.Stashed() != b.Stashed() {
+		t.Fatal("Restored table diverged from the original.")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	table := NewTable("t", 4, 4, testItemSize, nil, 0)
+	if table == nil {
+		t.Fatalf("Error creating table")
+	}
+	// Fill bucket 0 with items which may also go in bucket 1, 2 or 3.
+	for i := uint64(0); i < 4; i++ {
+		if ok, _ := table.Insert(&Item{i, GetBytes("value" + strconv.Itoa(int(i))), 0, 0}); !ok {
+			t.Fatalf("Failed to insert item %d", i)
+		}
+		table.index[i].bucket2 = i%3 + 1
+	}
+	if moves := table.Rebalance(1); moves != 1 {
+		t.Fatalf("Expected 1 move, made %d", moves)
+	}
+	if moves := table.Rebalance(10); moves != 2 {
+		t.Fatalf("Expected to stop once buckets are even, made %d moves", moves)
+	}
+	if occupancy := table.Occupancy(); occupancy[1] != 4 {
+		t.Fatalf("Unexpected occupancy after rebalancing %v", occupancy)
+	}
+	for i := uint64(0); i < 4; i++ {
+		if !table.Contains(&Item{ID: i, Bucket1: 0, Bucket2: i%3 + 1}) {
+			t.Fatalf("Item %d was lost", i)
+		}
+	}
+}
+
+// placedIn counts the items of a table in each bucket.
+func placedIn(table *Table, items []*Item) map[uint64]int {
+	loads := make(map[uint64]int)
+	for _, item := range items {
+		if b, err := table.Bucket(item); err == nil {
+			loads[b]++
+		}
+	}
+	return loads
+}
+
+func TestInsertStrategy(t *testing.T) {
+	least, _ := common.NewBucketStrategy(common.StrategyLeastLoaded)
+	table := NewTable("t", 4, 4, testItemSize, nil, 0)
+	table.SetStrategy(least)
+	// Each item goes to the less loaded of its buckets, whatever the coin.
+	items := make([]*Item, 4)
+	for i := range items {
+		items[i] = &Item{ID: uint64(i + 1), Data: GetBytes(strconv.Itoa(i)), Bucket1: 0, Bucket2: 1}
+		if ok, _ := table.Insert(items[i]); !ok {
+			t.Fatalf("Could not insert item %d", i)
+		}
+	}
+	if loads := placedIn(table, items); loads[0] != 2 || loads[1] != 2 {
+		t.Fatalf("Least loaded placement left buckets holding %v", loads)
+	}
+
+	left, _ := common.NewBucketStrategy(common.StrategyTwoLeft)
+	table = NewTable("t", 4, 4, testItemSize, nil, 0)
+	table.SetStrategy(left)
+	// Ties go left.
+	items = make([]*Item, 3)
+	for i := range items {
+		items[i] = &Item{ID: uint64(i + 1), Data: GetBytes(strconv.Itoa(i)), Bucket1: 0, Bucket2: 2}
+		table.Insert(items[i])
+	}
+	if loads := placedIn(table, items); loads[0] != 2 || loads[2] != 1 {
+		t.Fatalf("Two left placement left buckets holding %v", loads)
+	}
+}
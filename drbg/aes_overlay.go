@@ -0,0 +1,26 @@
+package drbg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// OverlayAES xors data with the AES-128 counter mode keystream of a seed: its
+// key keys AES, and its initialization vector is the upper half of the
+// initial counter block. crypto/aes uses the AES instructions of amd64 and
+// ARMv8 processors where present, so this is far cheaper than Overlay on
+// the replies of large buckets.
+func OverlayAES(seed, data []byte) error {
+	if len(seed) < SeedLength {
+		return errors.New("invalid seed provided")
+	}
+	block, err := aes.NewCipher(seed[:16])
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, seed[16:SeedLength])
+	cipher.NewCTR(block, iv).XORKeyStream(data, data)
+	return nil
+}
@@ -0,0 +1,51 @@
+package drbg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOverlayAES(t *testing.T) {
+	s, _ := NewSeed()
+	seed, _ := s.MarshalBinary()
+
+	buffer := make([]byte, 100)
+	if err := OverlayAES(seed, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buffer, make([]byte, 100)) {
+		t.Fatal("OverlayAES failed to perturb buffer!")
+	}
+	sip := make([]byte, 100)
+	Overlay(seed, sip)
+	if bytes.Equal(buffer, sip) {
+		t.Fatal("OverlayAES should pad differently from Overlay.")
+	}
+	OverlayAES(seed, buffer)
+	if !bytes.Equal(buffer, make([]byte, 100)) {
+		t.Fatal("OverlayAES applied twice should be identity!")
+	}
+	if OverlayAES(seed[:SeedLength-1], buffer) == nil {
+		t.Fatal("Short seed should be refused.")
+	}
+}
+
+func BenchmarkOverlay(b *testing.B) {
+	s, _ := NewSeed()
+	seed, _ := s.MarshalBinary()
+	data := make([]byte, 1<<16)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		Overlay(seed, data)
+	}
+}
+
+func BenchmarkOverlayAES(b *testing.B) {
+	s, _ := NewSeed()
+	seed, _ := s.MarshalBinary()
+	data := make([]byte, 1<<16)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		OverlayAES(seed, data)
+	}
+}
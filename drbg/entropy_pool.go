@@ -0,0 +1,214 @@
+package drbg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+)
+
+// EntropyPool is an accumulator of entropy in the style of Fortuna, for
+// long-lived servers. Events from several sources - the OS, and the timing of
+// network requests - are spread over 32 pools. The generator is reseeded from
+// pool 0 as often as it fills, and from pool i only every 2^i reseeds, so an
+// attacker who once learned the state of the generator loses track of it as
+// soon as enough unobserved events have been mixed in.
+type EntropyPool struct {
+	mu         sync.Mutex
+	pools      [numPools]hash.Hash
+	pool0Len   int
+	next       map[byte]uint // Pool of the next event, per source
+	reseeds    uint64
+	lastReseed time.Time
+	key        [32]byte
+	counter    [aes.BlockSize]byte
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// Sources of events mixed into an EntropyPool.
+const (
+	SourceOS byte = iota
+	SourceNetwork
+	SourceRequest
+)
+
+const (
+	numPools = 32
+	// minPoolSize is the data pool 0 takes before the generator reseeds.
+	minPoolSize = 64
+	// minReseedInterval bounds how often the generator reseeds, so that the
+	// later pools accumulate entropy for longer.
+	minReseedInterval = 100 * time.Millisecond
+	// maxRead bounds the output of the generator between rekeyings.
+	maxRead = 1 << 20
+	// maxEvent bounds the bytes of one event.
+	maxEvent = 32
+)
+
+// NewEntropyPool creates a pool seeded by the OS, which mixes in more OS
+// entropy every interval until closed. An interval of 0 mixes OS entropy only
+// at creation.
+func NewEntropyPool(interval time.Duration) (*EntropyPool, error) {
+	p := &EntropyPool{}
+	for i := range p.pools {
+		p.pools[i] = sha256.New()
+	}
+	p.next = make(map[byte]uint)
+	p.done = make(chan struct{})
+
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	p.rekey(seed[:])
+
+	if interval > 0 {
+		go p.mixOS(interval)
+	}
+	return p, nil
+}
+
+// Close stops mixing OS entropy into the pool. The pool remains usable.
+func (p *EntropyPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+/********************
+ * PUBLIC METHODS
+ ********************/
+
+// AddEvent mixes an event from source into the pools. Events are assigned to
+// pools in turn, by source, so no one source can fill a pool on its own.
+// Only the first 32 bytes of data are used.
+func (p *EntropyPool) AddEvent(source byte, data []byte) {
+	if len(data) > maxEvent {
+		data = data[:maxEvent]
+	}
+	p.mu.Lock()
+	i := p.next[source] % numPools
+	p.next[source]++
+	p.pools[i].Write([]byte{source, byte(len(data))})
+	p.pools[i].Write(data)
+	if i == 0 {
+		p.pool0Len += len(data)
+	}
+	p.mu.Unlock()
+}
+
+// AddTiming mixes the time of an event from source into the pools. The low
+// bits of the arrival of network requests vary with jitter an observer of the
+// server can't measure as precisely.
+func (p *EntropyPool) AddTiming(source byte, t time.Time) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	p.AddEvent(source, b[:])
+}
+
+// Read fills b from the generator, reseeding it first if the pools have
+// accumulated enough since the last reseed. It implements io.Reader.
+func (p *EntropyPool) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pool0Len >= minPoolSize && time.Since(p.lastReseed) >= minReseedInterval {
+		p.reseed()
+	}
+	n := 0
+	for n < len(b) {
+		end := len(b)
+		if end-n > maxRead {
+			end = n + maxRead
+		}
+		p.generate(b[n:end])
+		n = end
+	}
+	return n, nil
+}
+
+// NewSeed creates a Seed from the generator.
+func (p *EntropyPool) NewSeed() (*Seed, error) {
+	seed := &Seed{}
+	seed.alloc(SeedLength)
+	if _, err := p.Read(seed.value); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+/********************
+ * PRIVATE METHODS
+ ********************/
+
+func (p *EntropyPool) mixOS(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var b [maxEvent]byte
+	for {
+		select {
+		case <-p.done:
+			return
+		case t := <-ticker.C:
+			if _, err := rand.Read(b[:]); err == nil {
+				p.AddEvent(SourceOS, b[:])
+			}
+			p.AddTiming(SourceOS, t)
+		}
+	}
+}
+
+// reseed mixes pool i into the key when 2^i divides the count of reseeds.
+// Must be called with the lock held.
+func (p *EntropyPool) reseed() {
+	p.reseeds++
+	seed := append([]byte{}, p.key[:]...)
+	for i := range p.pools {
+		if p.reseeds%(1<<uint(i)) != 0 {
+			break
+		}
+		seed = p.pools[i].Sum(seed)
+		p.pools[i].Reset()
+	}
+	p.pool0Len = 0
+	p.lastReseed = time.Now()
+	p.rekey(seed)
+}
+
+// rekey sets the key of the generator to the double SHA-256 of seed.
+func (p *EntropyPool) rekey(seed []byte) {
+	h := sha256.Sum256(seed)
+	p.key = sha256.Sum256(h[:])
+	p.incrementCounter()
+}
+
+// generate fills b in AES-256 counter mode, then replaces the key so that
+// earlier output can't be recovered from the state of the generator.
+// Must be called with the lock held.
+func (p *EntropyPool) generate(b []byte) {
+	block, _ := aes.NewCipher(p.key[:])
+	var out [aes.BlockSize]byte
+	for i := 0; i < len(b); i += aes.BlockSize {
+		block.Encrypt(out[:], p.counter[:])
+		p.incrementCounter()
+		copy(b[i:], out[:])
+	}
+	var key [32]byte
+	cipher.NewCTR(block, p.counter[:]).XORKeyStream(key[:], key[:])
+	p.incrementCounter()
+	p.incrementCounter()
+	p.key = key
+}
+
+func (p *EntropyPool) incrementCounter() {
+	for i := range p.counter {
+		p.counter[i]++
+		if p.counter[i] != 0 {
+			return
+		}
+	}
+}
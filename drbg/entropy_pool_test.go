@@ -0,0 +1,67 @@
+package drbg
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEntropyPool(t *testing.T) {
+	p, err := NewEntropyPool(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, b := make([]byte, 100), make([]byte, 100)
+	p.Read(a)
+	p.Read(b)
+	if bytes.Equal(a, b) || bytes.Equal(a, make([]byte, 100)) {
+		t.Fatal("Pool repeated its output.")
+	}
+	seed, err := p.NewSeed()
+	if err != nil || len(seed.value) != SeedLength {
+		t.Fatalf("Bad seed from pool: %v", err)
+	}
+
+	// A compromised state is lost once enough events are mixed in.
+	key := p.key
+	for i := 0; i < 2*numPools*minPoolSize/8; i++ {
+		p.AddTiming(SourceRequest, time.Now())
+	}
+	p.lastReseed = time.Now().Add(-minReseedInterval)
+	p.Read(a)
+	if p.reseeds != 1 || p.pool0Len != 0 {
+		t.Fatalf("Pool did not reseed: %d reseeds, %d bytes in pool 0", p.reseeds, p.pool0Len)
+	}
+	clone := &EntropyPool{key: key, counter: p.counter}
+	clone.generate(b)
+	if bytes.Equal(a, b) {
+		t.Fatal("Output follows from the state before reseeding.")
+	}
+
+	// Reseeding waits for pool 0 to fill.
+	p.lastReseed = time.Now().Add(-minReseedInterval)
+	p.Read(a)
+	if p.reseeds != 1 {
+		t.Fatal("Pool reseeded without new events.")
+	}
+}
+
+func TestEntropyPoolMixesOS(t *testing.T) {
+	p, err := NewEntropyPool(time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		p.mu.Lock()
+		n := p.next[SourceOS]
+		p.mu.Unlock()
+		if n > 0 {
+			p.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No OS entropy was mixed in.")
+}
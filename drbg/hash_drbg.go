@@ -1,6 +1,8 @@
 package drbg
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"hash"
@@ -15,7 +17,7 @@ type HashDrbg struct {
 	seed *Seed
 	sip  hash.Hash64
 	ofb  [siphash.Size]byte
-	//ctr uint64
+	ctr  uint64 // Blocks produced
 }
 
 // NewHashDrbg creates a deterministic random number generator from a provided Seed.
@@ -30,17 +32,93 @@ func NewHashDrbg(seed *Seed) (*HashDrbg, error) {
 	} else {
 		d.seed = seed
 	}
-	//d.ctr = 0
 	d.sip = siphash.New(d.seed.Key())
 	copy(d.ofb[:], d.seed.InitVec())
 
 	return d, nil
 }
 
+// Exported states of a HashDrbg are a version byte, its seed and the count of
+// blocks it has produced, and a tag of their SHA-256 detecting corrupt or
+// truncated states. Each block hashes all those before it, so a state is
+// restored by replaying its blocks, up to maxStateBlocks of them.
+const (
+	stateVersion    = 1
+	stateTagSize    = 8
+	stateContext    = "talek hash drbg state"
+	stateBodyLength = 1 + SeedLength + 8
+	maxStateBlocks  = 1 << 24
+	// StateLength is the length of an exported HashDrbg state.
+	StateLength = stateBodyLength + stateTagSize
+)
+
+// NewHashDrbgFromState restores a HashDrbg from a state exported by
+// ExportState, continuing its sequence.
+func NewHashDrbgFromState(state []byte) (*HashDrbg, error) {
+	if len(state) != StateLength {
+		return nil, errors.New("invalid drbg state length")
+	}
+	if state[0] != stateVersion {
+		return nil, errors.New("unsupported drbg state version")
+	}
+	body := state[:stateBodyLength]
+	if !bytes.Equal(state[stateBodyLength:], stateTag(body)) {
+		return nil, errors.New("drbg state fails its integrity check")
+	}
+	ctr := binary.BigEndian.Uint64(body[1+SeedLength:])
+	if ctr > maxStateBlocks {
+		return nil, errors.New("drbg state is too far into its sequence")
+	}
+	seed := &Seed{}
+	seed.alloc(SeedLength)
+	copy(seed.value, body[1:1+SeedLength])
+	d, err := NewHashDrbg(seed)
+	if err != nil {
+		return nil, err
+	}
+	for d.ctr < ctr {
+		d.Next()
+	}
+	return d, nil
+}
+
+func stateTag(body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(stateContext))
+	h.Write(body)
+	return h.Sum(nil)[:stateTagSize]
+}
+
 /********************
  * PUBLIC METHODS
  ********************/
 
+// ExportState exports the state of the drbg, from which NewHashDrbgFromState
+// continues its sequence. The drbg itself then forks onto a fresh seed, so that
+// it and the restored drbg never produce the same blocks. Restoring one state
+// more than once does repeat its sequence.
+func (d *HashDrbg) ExportState() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := make([]byte, 0, StateLength)
+	state = append(state, stateVersion)
+	state = append(state, d.seed.value...)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], d.ctr)
+	state = append(state, ctr[:]...)
+	state = append(state, stateTag(state)...)
+
+	seed, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	d.seed = seed
+	d.sip = siphash.New(d.seed.Key())
+	copy(d.ofb[:], d.seed.InitVec())
+	d.ctr = 0
+	return state, nil
+}
+
 // Next returns the next 8 byte DRBG block.
 func (d *HashDrbg) Next() []byte {
 	d.mu.Lock()
@@ -51,6 +129,7 @@ func (d *HashDrbg) Next() []byte {
 	copy(d.ofb[:], d.sip.Sum(nil))
 	ret := make([]byte, siphash.Size)
 	copy(ret, d.ofb[:])
+	d.ctr++
 	d.mu.Unlock()
 	return ret
 }
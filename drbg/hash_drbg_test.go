@@ -32,6 +32,53 @@ func TestOverlay(t *testing.T) {
 	}
 }
 
+func TestExportState(t *testing.T) {
+	d, err := NewHashDrbg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Next()
+	d.Next()
+	state, err := d.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != StateLength {
+		t.Fatalf("State of %d bytes.", len(state))
+	}
+
+	// The restored drbg continues the sequence from the export.
+	s, _ := NewSeed()
+	s.value = append([]byte{}, state[1:1+SeedLength]...)
+	e, _ := NewHashDrbg(s)
+	e.Next()
+	e.Next()
+	r, err := NewHashDrbgFromState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := r.Next()
+	if !bytes.Equal(next, e.Next()) {
+		t.Fatal("Restored drbg did not continue its sequence.")
+	}
+	if bytes.Equal(next, d.Next()) {
+		t.Fatal("Exporting drbg did not fork from its sequence.")
+	}
+
+	state[len(state)-1] ^= 1
+	if _, err := NewHashDrbgFromState(state); err == nil {
+		t.Fatal("Corrupt state was restored.")
+	}
+	state[len(state)-1] ^= 1
+	state[0] = stateVersion + 1
+	if _, err := NewHashDrbgFromState(state); err == nil {
+		t.Fatal("State of unknown version was restored.")
+	}
+	if _, err := NewHashDrbgFromState(state[1:]); err == nil {
+		t.Fatal("Truncated state was restored.")
+	}
+}
+
 func BenchmarkRandomUint32(b *testing.B) {
 	drbg, _ := NewHashDrbg(nil)
 	b.ResetTimer()
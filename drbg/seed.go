@@ -6,8 +6,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"runtime"
 
 	"github.com/dchest/siphash"
+	"github.com/privacylab/talek/securemem"
 )
 
 // SeedLength is the number of bytes a drbg seed takes in memory.
@@ -17,14 +19,15 @@ const SeedLength = 16 + siphash.Size
 // - SipHash-2-4 keys: key0 and key1
 // - 8 byte nonce (initialization vector)
 type Seed struct {
-	value []byte // Key (first 16 bytes) + InitVec (8 bytes)
+	value     []byte // Key (first 16 bytes) + InitVec (8 bytes)
+	finalized bool   // Whether the value is freed when the seed is collected
 }
 
 // NewSeed creates a new Seed
 func NewSeed() (*Seed, error) {
 	seed := &Seed{}
 
-	seed.value = make([]byte, SeedLength)
+	seed.alloc(SeedLength)
 	_, err := rand.Read(seed.value)
 	if err != nil {
 		return nil, err
@@ -38,13 +41,14 @@ func (s *Seed) UnmarshalBinary(data []byte) error {
 	if len(data) < SeedLength {
 		return errors.New("invalid DRBG seed. Too few bytes")
 	}
-	s.value = data
+	s.alloc(len(data))
+	copy(s.value, data)
 	return nil
 }
 
 // MarshalBinary creates a byte array representation of a Seed.
 func (s *Seed) MarshalBinary() ([]byte, error) {
-	return s.value[:], nil
+	return append([]byte(nil), s.value...), nil
 }
 
 // MarshalText serializes the seed to textual representation
@@ -54,12 +58,16 @@ func (s *Seed) MarshalText() ([]byte, error) {
 
 // UnmarshalText restores the seed from a Text representation.
 func (s *Seed) UnmarshalText(data []byte) error {
-	if err := json.Unmarshal(data, &s.value); err != nil {
+	var value []byte
+	if err := json.Unmarshal(data, &value); err != nil {
 		return err
 	}
-	if len(s.value) != SeedLength {
+	defer securemem.Wipe(value)
+	if len(value) != SeedLength {
 		return errors.New("invalid drbg seed length")
 	}
+	s.alloc(SeedLength)
+	copy(s.value, value)
 	return nil
 }
 
@@ -84,3 +92,14 @@ func (s *Seed) KeyUint128() (uint64, uint64) {
 func (s *Seed) InitVec() []byte {
 	return s.value[16:]
 }
+
+// alloc replaces the value of the seed with n zeroed bytes, from secure
+// memory when it is enabled. Values in secure memory are freed once the seed
+// is collected, so they are never handed out beyond it.
+func (s *Seed) alloc(n int) {
+	s.value = securemem.Alloc(n)
+	if securemem.Locked(s.value) && !s.finalized {
+		s.finalized = true
+		runtime.SetFinalizer(s, func(s *Seed) { securemem.Free(s.value) })
+	}
+}
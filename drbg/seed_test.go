@@ -0,0 +1,35 @@
+package drbg
+
+import (
+	"testing"
+
+	"github.com/privacylab/talek/securemem"
+)
+
+func TestSecureSeed(t *testing.T) {
+	if err := securemem.Enable(); err != nil {
+		t.Skipf("secure memory unavailable: %v", err)
+	}
+	s, err := NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !securemem.Locked(s.value) {
+		t.Fatal("Seed was not allocated in secure memory.")
+	}
+	marshaled, _ := s.MarshalBinary()
+	if securemem.Locked(marshaled) {
+		t.Fatal("Secure memory of a seed was handed out.")
+	}
+
+	restored := &Seed{}
+	if err := restored.UnmarshalBinary(marshaled); err != nil {
+		t.Fatal(err)
+	}
+	if !securemem.Locked(restored.value) || !Equal(s, restored) {
+		t.Fatal("Restored seed was not copied to secure memory.")
+	}
+	if !securemem.Locked(s.Child(1).value) {
+		t.Fatal("Child seed was not allocated in secure memory.")
+	}
+}
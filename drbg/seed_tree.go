@@ -0,0 +1,58 @@
+package drbg
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+
+	"github.com/privacylab/talek/securemem"
+)
+
+// Seeds form a tree, as do the keys of HD wallets: every seed derives a child
+// seed and a child key at each index, so a device backing up one master seed
+// can re-derive every seed below it. Derivation is always hardened: children
+// are a MAC under the secret value of their parent, and reveal nothing of their
+// parent or siblings.
+const seedTreeContext = "talek seed tree"
+
+// Kinds of derived values, separating children from keys at the same index.
+const (
+	childSeed byte = iota
+	childKey
+)
+
+func (s *Seed) derive(kind byte, index uint32) []byte {
+	mac := hmac.New(sha512.New, s.value)
+	mac.Write([]byte(seedTreeContext))
+	mac.Write([]byte{kind})
+	var i [4]byte
+	binary.BigEndian.PutUint32(i[:], index)
+	mac.Write(i[:])
+	return mac.Sum(nil)
+}
+
+// Child derives the child seed at index.
+func (s *Seed) Child(index uint32) *Seed {
+	derived := s.derive(childSeed, index)
+	defer securemem.Wipe(derived)
+	child := &Seed{}
+	child.alloc(SeedLength)
+	copy(child.value, derived)
+	return child
+}
+
+// ChildKey derives 32 bytes of key material at index, for the keys that go
+// along with the seeds below s.
+func (s *Seed) ChildKey(index uint32) *[32]byte {
+	key := new([32]byte)
+	copy(key[:], s.derive(childKey, index))
+	return key
+}
+
+// DerivePath derives the descendant of s along a path of child indices.
+func (s *Seed) DerivePath(path ...uint32) *Seed {
+	for _, index := range path {
+		s = s.Child(index)
+	}
+	return s
+}
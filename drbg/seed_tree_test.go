@@ -0,0 +1,48 @@
+package drbg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSeedTree(t *testing.T) {
+	master, err := NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := master.MarshalBinary()
+	restored := &Seed{}
+	if err := restored.UnmarshalBinary(append([]byte{}, data...)); err != nil {
+		t.Fatal(err)
+	}
+
+	a := master.DerivePath(3, 7)
+	if !Equal(a, restored.Child(3).Child(7)) {
+		t.Fatal("Restored seed derived a different descendant.")
+	}
+	if len(a.value) != SeedLength {
+		t.Fatalf("Child seed of %d bytes.", len(a.value))
+	}
+	if Equal(a, master.DerivePath(3, 8)) || Equal(master.Child(0), master.Child(1)) {
+		t.Fatal("Siblings derived the same seed.")
+	}
+	if bytes.Equal(master.Child(0).value[:16], master.ChildKey(0)[:16]) {
+		t.Fatal("Child seed and key at an index coincide.")
+	}
+	if *master.ChildKey(1) != *restored.ChildKey(1) {
+		t.Fatal("Restored seed derived a different key.")
+	}
+	if !Equal(master.DerivePath(), master) {
+		t.Fatal("Empty path should be the seed itself.")
+	}
+
+	// Children are usable as seeds of a drbg.
+	d, err := NewHashDrbg(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := NewHashDrbg(restored.DerivePath(3, 7))
+	if d.RandomUint64() != e.RandomUint64() {
+		t.Fatal("Drbgs of equal seeds diverged.")
+	}
+}
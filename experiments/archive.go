@@ -0,0 +1,104 @@
+package experiments
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Names of the files of an archive.
+const (
+	archiveSpec        = "spec.json"
+	archiveConfig      = "config.json"
+	archiveEnvironment = "environment.json"
+	archiveRun         = "runs/%d.json"
+)
+
+// WriteArchive writes a gzipped tar of an experiment: its spec, the common
+// configuration and environment it ran with, and the result of each run.
+// Running the spec again reproduces the experiment.
+func WriteArchive(w io.Writer, spec *Spec, result *Result) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	files := []struct {
+		name  string
+		value interface{}
+	}{
+		{archiveSpec, spec},
+		{archiveConfig, result.Config},
+		{archiveEnvironment, result.Environment},
+	}
+	for i := range result.Runs {
+		files = append(files, struct {
+			name  string
+			value interface{}
+		}{fmt.Sprintf(archiveRun, i), &result.Runs[i]})
+	}
+	for _, f := range files {
+		dat, err := json.MarshalIndent(f.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(dat)), ModTime: result.Started}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(dat); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadArchive restores the spec and result of an experiment from its archive.
+func ReadArchive(r io.Reader) (*Spec, *Result, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(zr)
+	spec := new(Spec)
+	result := new(Result)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		var value interface{}
+		var i int
+		switch {
+		case hdr.Name == archiveSpec:
+			value = spec
+		case hdr.Name == archiveConfig:
+			value = &result.Config
+		case hdr.Name == archiveEnvironment:
+			value = &result.Environment
+		case scanRun(hdr.Name, &i):
+			for len(result.Runs) <= i {
+				result.Runs = append(result.Runs, RunResult{})
+			}
+			value = &result.Runs[i]
+		default:
+			continue
+		}
+		if err := json.NewDecoder(tr).Decode(value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		result.Started = hdr.ModTime
+	}
+	result.Name = spec.Name
+	return spec, result, nil
+}
+
+// scanRun parses the index of a run from its file name.
+func scanRun(name string, i *int) bool {
+	n, err := fmt.Sscanf(name, archiveRun, i)
+	return err == nil && n == 1 && *i >= 0 && *i < 1<<16
+}
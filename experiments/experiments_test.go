@@ -0,0 +1,81 @@
+package experiments
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/talektest"
+)
+
+func TestValidate(t *testing.T) {
+	if err := (&Spec{Profile: "groupchat"}).Validate(); err != nil {
+		t.Fatalf("Default spec invalid: %v", err)
+	}
+	invalid := []Spec{
+		{Profile: "nonexistent"},
+		{Profile: "groupchat", Target: "mainframe"},
+		{Profile: "groupchat", Target: TargetCluster},
+		{Profile: "groupchat", Repetitions: -1},
+	}
+	for _, spec := range invalid {
+		if err := spec.Validate(); err == nil {
+			t.Fatalf("Spec %+v considered valid.", spec)
+		}
+	}
+}
+
+func TestRunSimulator(t *testing.T) {
+	spec := Spec{
+		Name: "test",
+		Workload: &talektest.Profile{
+			Name:     "test",
+			Duration: time.Second,
+			Drain:    2 * time.Second,
+			Cohorts: []talektest.Cohort{
+				{Label: "chat", Clients: 2, GroupSize: 2, Rate: 2, Burst: 1, MessageSize: 32},
+			},
+		},
+		Seed:        7,
+		Repetitions: 2,
+	}
+	result, err := Run(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Runs) != 2 {
+		t.Fatalf("%d runs rather than 2", len(result.Runs))
+	}
+	for i, run := range result.Runs {
+		if run.Seed != spec.Seed+int64(i) {
+			t.Fatalf("Run %d seeded with %d", i, run.Seed)
+		}
+		if run.Report == nil || len(run.Report.Cohorts) != 1 || run.Report.Cohorts[0].Published == 0 {
+			t.Fatalf("Run %d published nothing: %+v", i, run.Report)
+		}
+		if run.Frontend.Err != "" || run.Frontend.ReadLatency.Total == 0 {
+			t.Fatalf("Run %d read nothing at the frontend: %+v", i, run.Frontend)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := WriteArchive(&archive, &spec, result); err != nil {
+		t.Fatal(err)
+	}
+	restoredSpec, restored, err := ReadArchive(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredSpec.Seed != spec.Seed || restoredSpec.Workload == nil || restoredSpec.Workload.Cohorts[0].Rate != 2 {
+		t.Fatalf("Spec not restored: %+v", restoredSpec)
+	}
+	if restored.Name != "test" || restored.Config == nil || restored.Config.NumBuckets != result.Config.NumBuckets {
+		t.Fatalf("Configuration not restored: %+v", restored)
+	}
+	if restored.Environment != result.Environment {
+		t.Fatalf("Environment %+v restored as %+v", result.Environment, restored.Environment)
+	}
+	if len(restored.Runs) != 2 || restored.Runs[1].Report.Cohorts[0].Published != result.Runs[1].Report.Cohorts[0].Published {
+		t.Fatalf("Runs not restored: %+v", restored.Runs)
+	}
+}
@@ -0,0 +1,149 @@
+package experiments
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/talektest"
+)
+
+// Result is what an experiment measured.
+type Result struct {
+	Name        string
+	Started     time.Time
+	Environment Environment
+	// The common configuration run with.
+	Config *common.Config
+	Runs   []RunResult
+}
+
+// Environment describes where an experiment ran, as results depend on it.
+type Environment struct {
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	NumCPU    int
+}
+
+// RunResult is what one repetition of the workload measured.
+type RunResult struct {
+	Seed   int64
+	Report *talektest.WorkloadReport
+	// Statistics of the frontend once the workload finished, including the
+	// latency histograms of reads.
+	Frontend common.FrontendStats
+}
+
+// statsSource is a frontend which reports its statistics.
+type statsSource interface {
+	GetStats(args *interface{}, reply *common.FrontendStats) error
+}
+
+// Run runs an experiment.
+func Run(spec Spec) (*Result, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Name:    spec.Name,
+		Started: time.Now(),
+		Environment: Environment{
+			GoVersion: runtime.Version(),
+			GOOS:      runtime.GOOS,
+			GOARCH:    runtime.GOARCH,
+			NumCPU:    runtime.NumCPU(),
+		},
+	}
+	repetitions := spec.Repetitions
+	if repetitions == 0 {
+		repetitions = 1
+	}
+	for i := 0; i < repetitions; i++ {
+		profile, _ := spec.profile()
+		profile.Seed += int64(i)
+		var run *RunResult
+		var err error
+		if spec.Target == TargetCluster {
+			run, err = runCluster(spec, profile, result)
+		} else {
+			run, err = runSimulator(spec, profile, result)
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Runs = append(result.Runs, *run)
+	}
+	return result, nil
+}
+
+// runSimulator replays a workload on a fresh in-process topology.
+func runSimulator(spec Spec, profile talektest.Profile, result *Result) (*RunResult, error) {
+	config := talektest.DefaultConfig()
+	if spec.Config != nil {
+		c := *spec.Config
+		config = &c
+	}
+	result.Config = config
+	top, err := talektest.Start(talektest.Options{
+		TrustDomains: spec.TrustDomains,
+		Config:       config,
+		ReadBatch:    spec.ReadBatch,
+		Interval:     spec.Interval,
+		Backing:      spec.Backing,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer top.Close()
+	return runWorkload(profile, top.NewClient, top.Frontend.Frontend)
+}
+
+// runCluster replays a workload against the deployment of a client
+// configuration.
+func runCluster(spec Spec, profile talektest.Profile, result *Result) (*RunResult, error) {
+	config := libtalek.ClientConfigFromFile(spec.ClientConfig)
+	if config == nil {
+		return nil, fmt.Errorf("could not load client configuration %s", spec.ClientConfig)
+	}
+	result.Config = config.Config
+
+	var clients []*libtalek.Client
+	var rpcs []*common.FrontendRPC
+	defer func() {
+		for _, c := range clients {
+			c.Kill()
+		}
+		for _, rpc := range rpcs {
+			rpc.Close()
+		}
+	}()
+	newClient := func(name string) *libtalek.Client {
+		rpc := common.NewFrontendRPC(name, config.FrontendAddr)
+		c := libtalek.NewClient(name, *config, rpc)
+		if c == nil {
+			rpc.Close()
+			return nil
+		}
+		rpcs = append(rpcs, rpc)
+		clients = append(clients, c)
+		return c
+	}
+	stats := common.NewFrontendRPC("experiment", config.FrontendAddr)
+	rpcs = append(rpcs, stats)
+	return runWorkload(profile, newClient, stats)
+}
+
+func runWorkload(profile talektest.Profile, newClient func(name string) *libtalek.Client, frontend statsSource) (*RunResult, error) {
+	report, err := talektest.RunWorkload(profile, newClient)
+	if err != nil {
+		return nil, err
+	}
+	run := &RunResult{Seed: profile.Seed, Report: report}
+	if err := frontend.GetStats(nil, &run.Frontend); err != nil {
+		run.Frontend.Err = err.Error()
+	}
+	return run, nil
+}
@@ -0,0 +1,111 @@
+// Package experiments runs declared talek performance experiments, against an
+// in-process deployment or a real one, and archives what was run with what
+// it measured, so that published numbers can be reproduced.
+package experiments
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/talektest"
+)
+
+// Targets an experiment can run against.
+const (
+	// TargetSimulator runs a talektest.Topology inside the process.
+	TargetSimulator = "simulator"
+	// TargetCluster runs against the deployment of a client configuration.
+	TargetCluster = "cluster"
+)
+
+// Spec declares an experiment: what it runs against, with which
+// configuration, and the workload replayed.
+type Spec struct {
+	Name string
+	// TargetSimulator, the default, or TargetCluster.
+	Target string
+
+	// The common configuration of the simulator. Default
+	// talektest.DefaultConfig.
+	Config *common.Config
+	// How many trust domains the simulator runs, how many reads its replicas
+	// make at a time, how often its servers and clients write and read, and
+	// the PIR backing of its shards. Zero fields take the defaults of
+	// talektest.Options.
+	TrustDomains int
+	ReadBatch    int
+	Interval     time.Duration `json:",string"`
+	Backing      string
+
+	// Client configuration file of the cluster, with TargetCluster.
+	ClientConfig string
+
+	// A built in workload profile by name, or a workload given in full.
+	Profile  string
+	Workload *talektest.Profile
+	// Overrides the duration of the workload, when set.
+	Duration time.Duration `json:",string"`
+	// Seeds the workload of the first repetition, and each later one takes
+	// the next seed.
+	Seed int64
+	// How many times the workload is run, each on a fresh simulator. Default 1.
+	Repetitions int
+}
+
+// SpecFromFile restores an experiment spec from JSON.
+func SpecFromFile(file string) (*Spec, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	spec := new(Spec)
+	if err := json.Unmarshal(dat, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Validate checks a spec can be run.
+func (s *Spec) Validate() error {
+	switch s.Target {
+	case "", TargetSimulator:
+		if s.Config != nil {
+			if err := s.Config.Validate(); err != nil {
+				return err
+			}
+		}
+	case TargetCluster:
+		if s.ClientConfig == "" {
+			return &common.ValidationError{Field: "client config", Reason: "a cluster is run against with its client configuration"}
+		}
+	default:
+		return &common.ValidationError{Field: "target", Reason: fmt.Sprintf("unknown target %q", s.Target)}
+	}
+	if s.Repetitions < 0 {
+		return &common.ValidationError{Field: "repetitions", Reason: fmt.Sprintf("%d is negative", s.Repetitions)}
+	}
+	if _, err := s.profile(); err != nil {
+		return &common.ValidationError{Field: "workload", Reason: err.Error()}
+	}
+	return nil
+}
+
+// profile resolves the workload of the spec, with its overrides.
+func (s *Spec) profile() (talektest.Profile, error) {
+	var profile talektest.Profile
+	if s.Workload != nil {
+		profile = *s.Workload
+	} else if p, ok := talektest.Profiles[s.Profile]; ok {
+		profile = p
+	} else {
+		return profile, fmt.Errorf("unknown profile %q", s.Profile)
+	}
+	if s.Duration > 0 {
+		profile.Duration = s.Duration
+	}
+	profile.Seed = s.Seed
+	return profile, nil
+}
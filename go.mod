@@ -11,8 +11,10 @@ require (
 	github.com/dchest/siphash v1.2.1
 	github.com/foobaz/go-zopfli v0.0.0-20140122214029-7432051485e2
 	github.com/go-gl/cl v0.0.0-20160402050751-283e73a0ca2a
+	github.com/golang/snappy v0.0.1
 	github.com/google/zopfli v0.0.0-20190118173051-ef109ddf1649
 	github.com/gorilla/rpc v1.1.0
+	github.com/klauspost/compress v1.11.0
 	github.com/spf13/pflag v0.0.0-20170412152249-e453343e6260
 	github.com/willscott/bloom v0.0.0-20190611115233-60e4b211444f
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
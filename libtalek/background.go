@@ -0,0 +1,118 @@
+package libtalek
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// errBackgroundPublish refuses writes of a background client, which has no
+// goroutine to make them.
+var errBackgroundPublish = errors.New("background clients only read")
+
+// errNotBackground refuses a burst of reads from a client which already reads
+// periodically.
+var errNotBackground = errors.New("PollOnce needs a client made with NewBackgroundClient")
+
+// PollResult is the outcome of a burst of reads made by PollOnce.
+type PollResult struct {
+	// Messages read, by handle, oldest first.
+	Messages map[*Handle][][]byte
+	// Errors of handles whose reads failed. They are left where they failed,
+	// to be read again in the next burst.
+	Errors map[*Handle]error
+	// Reads made in the burst.
+	Reads int
+	// Complete is whether every handle caught up, rather than the context
+	// ending the burst first.
+	Complete bool
+}
+
+// NewBackgroundClient creates a client which starts no goroutines and makes
+// no requests of its own: handles registered with Poll are read only when
+// PollOnce is called. It suits mobile apps, which are given short windows of
+// background execution rather than running continuously. Background clients
+// only read.
+func NewBackgroundClient(name string, config ClientConfig, leader common.FrontendInterface) *Client {
+	c := newClient(name, config, leader)
+	if c == nil {
+		return nil
+	}
+	c.background = true
+	return c
+}
+
+// PollOnce reads every handle registered with Poll, or added to a
+// subscription group, until it catches up with its log, and returns what was
+// read, in one burst. Messages are returned rather than sent on the channels
+// of Poll and of groups. Each handle is read as
+// the periodic reads of a client would, both buckets of each position, so a
+// burst costs two reads per handle and two more for each item found. The
+// burst ends early when ctx is done, leaving each handle where it got to.
+// PollOnce returns an error only if the client isn't a background client.
+func (c *Client) PollOnce(ctx context.Context) (*PollResult, error) {
+	if !c.background {
+		return nil, errNotBackground
+	}
+	c.burstLock.Lock()
+	defer c.burstLock.Unlock()
+
+	result := &PollResult{
+		Messages: make(map[*Handle][][]byte),
+		Errors:   make(map[*Handle]error),
+	}
+	c.handleMutex.Lock()
+	pending := append([]*Handle{}, c.handles...)
+	for _, g := range c.groups {
+		pending = append(pending, g.members()...)
+	}
+	c.handleMutex.Unlock()
+
+	for len(pending) > 0 {
+		var advanced []*Handle
+		for _, h := range pending {
+			if ctx.Err() != nil {
+				return result, nil
+			}
+			conf := c.config.Load().(ClientConfig)
+			seqno := h.Seqno
+			// A burst reads the cold tier, which holds every item.
+			h.tier = common.TierCold
+			ra1, ra2, err := h.generatePoll(&conf, c.Rand)
+			if err != nil {
+				result.Errors[h] = err
+				continue
+			}
+			for _, args := range []*common.ReadArgs{ra1, ra2} {
+				_, msg, err := c.read(request{args, h, nil}, &conf, burstDeadline(ctx, conf.RequestTimeout))
+				result.Reads++
+				if msg != nil {
+					result.Messages[h] = append(result.Messages[h], msg)
+				}
+				if err != nil && err != ErrReplay {
+					result.Errors[h] = err
+				}
+			}
+			if _, failed := result.Errors[h]; !failed && h.Seqno > seqno {
+				advanced = append(advanced, h)
+			}
+		}
+		pending = advanced
+	}
+	result.Complete = true
+	return result, nil
+}
+
+/** PRIVATE METHODS **/
+
+// burstDeadline is the deadline of a read in a burst: that of its context, or
+// sooner if requests time out sooner.
+func burstDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := deadline(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && (d.IsZero() || ctxDeadline.Before(d)) {
+		return ctxDeadline
+	}
+	return d
+}
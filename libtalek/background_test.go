@@ -0,0 +1,145 @@
+package libtalek
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// bucketLeader answers reads from buckets of the items published to it, as
+// trust domains would together.
+type bucketLeader struct {
+	mockLeader
+	config  *common.Config
+	domains []*common.TrustDomainConfig
+
+	mu      sync.Mutex
+	buckets map[uint64][]byte
+	items   uint64
+}
+
+func newBucketLeader(config *common.Config, domains []*common.TrustDomainConfig) *bucketLeader {
+	return &bucketLeader{config: config, domains: domains, buckets: make(map[uint64][]byte)}
+}
+
+// publish places the items of a message in their first buckets.
+func (b *bucketLeader) publish(t *testing.T, topic *Topic, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, part := range newMessage(data).Split(int(b.config.DataSize - PublishingOverhead)) {
+		args, err := topic.GeneratePublish(b.config, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Items fill their slot, zero padded.
+		item := make([]byte, b.config.DataSize)
+		copy(item, args.Data)
+		b.buckets[args.Bucket1] = append(b.buckets[args.Bucket1], item...)
+		b.items++
+	}
+}
+
+func (b *bucketLeader) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	pad, err := common.NewPad(b.config.PadAlgorithm)
+	if err != nil {
+		return err
+	}
+	bucketSize := b.config.BucketDepth * b.config.DataSize
+	reply.Data = make([]byte, bucketSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, td := range b.domains {
+		pir, err := args.Decode(i, td)
+		if err != nil {
+			return err
+		}
+		part := make([]byte, bucketSize)
+		for bucket := uint64(0); bucket < b.config.NumBuckets; bucket++ {
+			if pir.RequestVector[bucket/8]&(1<<(bucket%8)) == 0 {
+				continue
+			}
+			for j, v := range b.buckets[bucket] {
+				part[j] ^= v
+			}
+		}
+		if err := pad.Overlay(pir.PadSeed, part); err != nil {
+			return err
+		}
+		reply.Combine(part)
+	}
+	reply.GlobalSeqNo = common.Range{Start: 1, End: b.items + 1}
+	return nil
+}
+
+func TestPollOnce(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains: []*common.TrustDomainConfig{
+			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+		},
+	}
+	leader := newBucketLeader(config.Config, config.TrustDomains)
+	c := NewBackgroundClient("TestPollOnce", config, leader)
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	defer c.Kill()
+
+	busy, _ := NewTopic()
+	quiet, _ := NewTopic()
+	// Publishing advances the handles of the topics, so copies are read.
+	busyHandle, quietHandle := busy.Handle, quiet.Handle
+	c.Poll(&busyHandle)
+	c.Poll(&quietHandle)
+	for i := 0; i < 3; i++ {
+		leader.publish(t, busy, []byte(fmt.Sprintf("message %d", i)))
+	}
+
+	result, err := c.PollOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete || len(result.Errors) != 0 {
+		t.Fatalf("Burst did not complete: %v", result.Errors)
+	}
+	msgs := result.Messages[&busyHandle]
+	if len(msgs) != 3 || string(msgs[0]) != "message 0" || string(msgs[2]) != "message 2" {
+		t.Fatalf("Burst read %q", msgs)
+	}
+	if len(result.Messages[&quietHandle]) != 0 {
+		t.Fatal("Burst read a message of an empty topic.")
+	}
+	// Both buckets of the three positions read, and of the next of each.
+	if result.Reads != 10 {
+		t.Fatalf("Burst made %d reads rather than 10.", result.Reads)
+	}
+
+	// The next burst continues where this one stopped.
+	leader.publish(t, quiet, []byte("hello"))
+	result, _ = c.PollOnce(context.Background())
+	if msgs = result.Messages[&quietHandle]; len(msgs) != 1 || string(msgs[0]) != "hello" || len(result.Messages[&busyHandle]) != 0 {
+		t.Fatalf("Second burst read %v", result.Messages)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result, _ = c.PollOnce(ctx); result.Complete || result.Reads != 0 {
+		t.Fatal("A burst should end with its context.")
+	}
+
+	if err = c.Publish(busy, []byte("hi")); err == nil {
+		t.Fatal("Background clients should not publish.")
+	}
+	periodic := NewClient("TestPollOnce", config, &mockLeader{})
+	defer periodic.Kill()
+	if _, err = periodic.PollOnce(context.Background()); err == nil {
+		t.Fatal("Clients reading periodically should not poll in bursts.")
+	}
+}
@@ -0,0 +1,398 @@
+package libtalek
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BotHandler serves a command sent to a bot. An error is replied to the peer
+// that sent the command.
+type BotHandler func(req *BotRequest) error
+
+// BotPeer is a conversation of a bot with one peer: the peer writes commands
+// to the topic of In, and the bot replies on Out.
+type BotPeer struct {
+	In  *Handle
+	Out *Topic
+}
+
+// BotRequest is a command received by a bot.
+type BotRequest struct {
+	Bot     *Bot
+	Peer    string
+	Command string   // Lower case, without a leading "/"
+	Args    []string // Whitespace separated words after the command
+	Text    string   // Everything after the command
+}
+
+// Reply sends text to the peer that sent the command.
+func (r *BotRequest) Reply(text string) error {
+	return r.Bot.Send(r.Peer, text)
+}
+
+// Get returns a value of the state kept for the peer that sent the command.
+func (r *BotRequest) Get(key string) string {
+	return r.Bot.Get(r.Peer, key)
+}
+
+// Set changes a value of the state kept for the peer that sent the command.
+func (r *BotRequest) Set(key string, value string) error {
+	return r.Bot.Set(r.Peer, key, value)
+}
+
+// ErrUnknownPeer is returned when a bot has no conversation with a peer.
+var ErrUnknownPeer = errors.New("bot has no such peer")
+
+// Bot serves text commands, like "remind 10m tea", sent by peers over topics.
+// Commands are routed to the handler registered for their first word, and
+// handled one at a time. The conversations of the bot, their positions, and
+// the state handlers keep for each peer are saved in a Store after every
+// change, so a restarted bot continues where it stopped.
+type Bot struct {
+	// Rate and Burst limit the commands of each peer: Burst may be sent at
+	// once, and more at Rate per second. Commands over the limit are dropped
+	// unanswered, since each reply is itself a write. A zero Rate is unlimited.
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	name      string
+	store     Store
+	transport topicTransport
+	peers     map[string]*BotPeer
+	state     map[string]map[string]string
+	limits    map[string]*botLimit
+	commands  map[string]BotHandler
+	fallback  BotHandler
+	polling   map[string]chan struct{}
+	incoming  chan *botCommand
+	stop      chan struct{}
+}
+
+// NewBot creates a bot which talks through a client, restoring any
+// conversations and state previously saved in store under name.
+func NewBot(c *Client, store Store, name string) (*Bot, error) {
+	return newBot(c, store, name)
+}
+
+// Handle registers the handler of a command.
+func (b *Bot) Handle(command string, handler BotHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[strings.ToLower(strings.TrimPrefix(command, "/"))] = handler
+}
+
+// HandleDefault registers the handler of messages which aren't a registered
+// command. Without one, peers are told the command is unknown.
+func (b *Bot) HandleDefault(handler BotHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fallback = handler
+}
+
+// AddPeer starts a conversation with a peer, replacing any previous one.
+func (b *Bot) AddPeer(name string, in *Handle, out *Topic) error {
+	if name == "" || in == nil || out == nil {
+		return errors.New("peers must be named, with a handle and a topic")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopPeer(name)
+	b.peers[name] = &BotPeer{in, out}
+	if b.stop != nil {
+		b.pollPeer(name)
+	}
+	return b.save()
+}
+
+// RemovePeer ends the conversation with a peer, and forgets its state.
+func (b *Bot) RemovePeer(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopPeer(name)
+	delete(b.peers, name)
+	delete(b.state, name)
+	delete(b.limits, name)
+	return b.save()
+}
+
+// Peers returns the names of the peers of the bot.
+func (b *Bot) Peers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.peers))
+	for name := range b.peers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Send writes text to a peer. It may be called from any goroutine, for
+// instance when a timer set by a handler fires.
+func (b *Bot) Send(peer string, text string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.peers[peer]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if err := b.transport.Publish(p.Out, []byte(text)); err != nil {
+		return err
+	}
+	return b.save()
+}
+
+// Get returns a value of the state kept for a peer, or "" if it is unset.
+func (b *Bot) Get(peer string, key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state[peer][key]
+}
+
+// Set changes a value of the state kept for a peer. Setting "" removes it.
+func (b *Bot) Set(peer string, key string, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.peers[peer]; !ok {
+		return ErrUnknownPeer
+	}
+	if value == "" {
+		delete(b.state[peer], key)
+	} else {
+		if b.state[peer] == nil {
+			b.state[peer] = make(map[string]string)
+		}
+		b.state[peer][key] = value
+	}
+	return b.save()
+}
+
+// Run serves the commands of all peers until Stop is called.
+func (b *Bot) Run() {
+	b.mu.Lock()
+	if b.stop != nil {
+		b.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	b.stop = stop
+	for name := range b.peers {
+		b.pollPeer(name)
+	}
+	b.mu.Unlock()
+
+	for {
+		select {
+		case cmd := <-b.incoming:
+			b.serve(cmd)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run, and stops reading from peers.
+func (b *Bot) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop == nil {
+		return
+	}
+	for name := range b.polling {
+		b.stopPeer(name)
+	}
+	close(b.stop)
+	b.stop = nil
+}
+
+/** PRIVATE METHODS **/
+
+// botCommand is a message read from a peer.
+type botCommand struct {
+	peer string
+	in   *Handle
+	text string
+}
+
+// botLimit is the token bucket of a peer.
+type botLimit struct {
+	tokens float64
+	last   time.Time
+}
+
+type savedBot struct {
+	Peers map[string]*BotPeer
+	State map[string]map[string]string
+}
+
+func newBot(transport topicTransport, store Store, name string) (*Bot, error) {
+	b := &Bot{
+		name:      name,
+		store:     store,
+		transport: transport,
+		peers:     make(map[string]*BotPeer),
+		state:     make(map[string]map[string]string),
+		limits:    make(map[string]*botLimit),
+		commands:  make(map[string]BotHandler),
+		polling:   make(map[string]chan struct{}),
+		incoming:  make(chan *botCommand),
+	}
+	dat, err := store.Get(name)
+	if err == ErrNotFound {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved savedBot
+	if err = json.Unmarshal(dat, &saved); err != nil {
+		return nil, fmt.Errorf("invalid saved bot: %v", err)
+	}
+	for peer, p := range saved.Peers {
+		if p == nil || p.In == nil || p.Out == nil {
+			return nil, fmt.Errorf("invalid saved bot: peer %s is incomplete", peer)
+		}
+		b.peers[peer] = p
+	}
+	for peer, values := range saved.State {
+		b.state[peer] = values
+	}
+	return b, nil
+}
+
+// save writes the bot to its store. b.mu must be held. The handles of peers
+// advance as the client polls them, so they are marshaled in a snapshot.
+func (b *Bot) save() error {
+	var dat []byte
+	var err error
+	b.transport.snapshot(func() {
+		dat, err = json.Marshal(savedBot{b.peers, b.state})
+	})
+	if err != nil {
+		return err
+	}
+	return b.store.Put(b.name, dat)
+}
+
+// pollPeer starts reading the commands of a peer. b.mu must be held.
+func (b *Bot) pollPeer(name string) {
+	if _, ok := b.polling[name]; ok {
+		return
+	}
+	in := b.peers[name].In
+	msgs := b.transport.Poll(in)
+	if msgs == nil {
+		return
+	}
+	stop := make(chan struct{})
+	b.polling[name] = stop
+	go func() {
+		for {
+			var msg []byte
+			select {
+			case msg = <-msgs:
+			case <-stop:
+				return
+			}
+			select {
+			case b.incoming <- &botCommand{name, in, string(msg)}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopPeer stops reading the commands of a peer. b.mu must be held.
+func (b *Bot) stopPeer(name string) {
+	stop, ok := b.polling[name]
+	if !ok {
+		return
+	}
+	close(stop)
+	delete(b.polling, name)
+	b.transport.Done(b.peers[name].In)
+}
+
+// serve routes a command to its handler.
+func (b *Bot) serve(cmd *botCommand) {
+	b.mu.Lock()
+	p, ok := b.peers[cmd.peer]
+	if !ok || p.In != cmd.in {
+		// Read before the peer was removed or replaced.
+		b.mu.Unlock()
+		return
+	}
+	// The read position of the peer has advanced.
+	if err := b.save(); err != nil {
+		b.mu.Unlock()
+		return
+	}
+	if !b.allow(cmd.peer) {
+		b.mu.Unlock()
+		return
+	}
+	req := parseCommand(cmd.text)
+	req.Bot = b
+	req.Peer = cmd.peer
+	handler, ok := b.commands[req.Command]
+	if !ok {
+		handler = b.fallback
+	}
+	b.mu.Unlock()
+
+	if handler == nil {
+		if req.Command != "" {
+			req.Reply("unknown command: " + req.Command)
+		}
+		return
+	}
+	if err := handler(req); err != nil {
+		req.Reply("error: " + err.Error())
+	}
+}
+
+// allow takes a token from the bucket of a peer. b.mu must be held.
+func (b *Bot) allow(peer string) bool {
+	if b.Rate <= 0 {
+		return true
+	}
+	burst := float64(b.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	limit, ok := b.limits[peer]
+	if !ok {
+		limit = &botLimit{burst, now}
+		b.limits[peer] = limit
+	}
+	limit.tokens += now.Sub(limit.last).Seconds() * b.Rate
+	if limit.tokens > burst {
+		limit.tokens = burst
+	}
+	limit.last = now
+	if limit.tokens < 1 {
+		return false
+	}
+	limit.tokens--
+	return true
+}
+
+// parseCommand splits a message into its command and arguments.
+func parseCommand(text string) *BotRequest {
+	text = strings.TrimSpace(text)
+	command := text
+	rest := ""
+	if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+		command, rest = text[:i], strings.TrimSpace(text[i:])
+	}
+	return &BotRequest{
+		Command: strings.ToLower(strings.TrimPrefix(command, "/")),
+		Args:    strings.Fields(rest),
+		Text:    rest,
+	}
+}
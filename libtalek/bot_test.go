@@ -0,0 +1,139 @@
+package libtalek
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// botPeer connects a peer to a bot over the bus, returning the topic the peer
+// writes commands to and the handle it reads replies from.
+func botPeer(t *testing.T, bot *Bot, name string) (*Topic, *Handle) {
+	in, err := NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bot.AddPeer(name, laneHandle(in), out); err != nil {
+		t.Fatal(err)
+	}
+	return in, laneHandle(out)
+}
+
+func expectReply(t *testing.T, replies chan []byte, want string) {
+	select {
+	case r := <-replies:
+		if string(r) != want {
+			t.Fatalf("Expected reply %q, got %q", want, r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected reply %q.", want)
+	}
+}
+
+func TestBotCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStore(dir)
+	bus := newMemoryBus()
+
+	bot, err := newBot(bus, store, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Handle("/echo", func(req *BotRequest) error {
+		return req.Reply(req.Text)
+	})
+	bot.Handle("count", func(req *BotRequest) error {
+		n := len(req.Get("count"))
+		req.Set("count", req.Get("count")+"x")
+		return req.Reply(strings.Repeat("x", n+1))
+	})
+	bot.Handle("fail", func(req *BotRequest) error {
+		return errors.New("no " + req.Args[0])
+	})
+	cmds, replies := botPeer(t, bot, "alice")
+	go bot.Run()
+
+	msgs := bus.Poll(replies)
+	bus.Publish(cmds, []byte("ECHO  hello  there "))
+	expectReply(t, msgs, "hello  there")
+	bus.Publish(cmds, []byte("frobnicate"))
+	expectReply(t, msgs, "unknown command: frobnicate")
+	bus.Publish(cmds, []byte("fail luck"))
+	expectReply(t, msgs, "error: no luck")
+	bus.Publish(cmds, []byte("count"))
+	expectReply(t, msgs, "x")
+	bus.Done(replies)
+	bot.Stop()
+
+	// A restarted bot keeps its peers, their positions and state.
+	restarted, err := newBot(bus, store, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := restarted.Peers(); len(peers) != 1 || peers[0] != "alice" {
+		t.Fatalf("Restarted bot has peers %v", peers)
+	}
+	if restarted.Get("alice", "count") != "x" {
+		t.Fatal("Restarted bot lost state.")
+	}
+	restarted.HandleDefault(func(req *BotRequest) error {
+		return req.Reply("default " + req.Command)
+	})
+	go restarted.Run()
+	defer restarted.Stop()
+	msgs = bus.Poll(replies)
+	bus.Publish(cmds, []byte("count"))
+	expectReply(t, msgs, "default count")
+
+	if err = restarted.Send("bob", "hi"); err != ErrUnknownPeer {
+		t.Fatalf("Sending to an unknown peer should fail, got %v", err)
+	}
+}
+
+func TestBotRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStore(dir)
+	bus := newMemoryBus()
+
+	bot, _ := newBot(bus, store, "bot")
+	bot.Rate = 0.001
+	bot.Burst = 2
+	bot.Handle("ping", func(req *BotRequest) error {
+		return req.Reply("pong " + req.Text)
+	})
+	cmds, replies := botPeer(t, bot, "alice")
+	go bot.Run()
+	defer bot.Stop()
+
+	msgs := bus.Poll(replies)
+	for i := 0; i < 3; i++ {
+		bus.Publish(cmds, []byte("ping "+string('a'+rune(i))))
+	}
+	expectReply(t, msgs, "pong a")
+	expectReply(t, msgs, "pong b")
+	select {
+	case r := <-msgs:
+		t.Fatalf("Command over the limit was answered: %q", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Other peers have their own budget.
+	bobCmds, bobReplies := botPeer(t, bot, "bob")
+	bus.Publish(bobCmds, []byte("ping c"))
+	expectReply(t, bus.Poll(bobReplies), "pong c")
+}
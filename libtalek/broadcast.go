@@ -0,0 +1,35 @@
+package libtalek
+
+import (
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+)
+
+// NewBroadcastTopic creates a Topic intended to be followed by many readers.
+// Unlike a regular topic, the log positions of a broadcast topic are derived
+// from its public signing key, so they are not secret from anyone who learns
+// that key, and writes to it identify themselves as broadcasts.
+// Servers verify that placement, and pin verified broadcast items to their
+// first bucket so that the churn of regular writes does not move them.
+// Readers still use PIR to hide which broadcast they follow.
+func NewBroadcastTopic() (t *Topic, err error) {
+	t, err = NewTopic()
+	if err != nil {
+		return
+	}
+	t.Handle.Seed1, t.Handle.Seed2, err = common.BroadcastSeeds(t.Handle.SigningPublicKey[:])
+	return
+}
+
+// IsBroadcast indicates if the handle follows a broadcast topic, whose log
+// positions are publicly derivable.
+func (h *Handle) IsBroadcast() bool {
+	if h.SigningPublicKey == nil || h.Seed1 == nil || h.Seed2 == nil {
+		return false
+	}
+	s1, s2, err := common.BroadcastSeeds(h.SigningPublicKey[:])
+	if err != nil {
+		return false
+	}
+	return drbg.Equal(h.Seed1, s1) && drbg.Equal(h.Seed2, s2)
+}
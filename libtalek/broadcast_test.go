@@ -0,0 +1,64 @@
+package libtalek
+
+import (
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestBroadcastTopic(t *testing.T) {
+	config := &common.Config{NumBuckets: 100, DataSize: 1024}
+
+	topic, err := NewBroadcastTopic()
+	if err != nil {
+		t.Fatalf("Error creating broadcast topic: %v", err)
+	}
+	if !topic.IsBroadcast() {
+		t.Fatal("Broadcast topic not recognized as broadcast.")
+	}
+
+	// Positions can be derived from public information alone.
+	public := &Handle{SigningPublicKey: topic.SigningPublicKey}
+	public.Seed1, public.Seed2, _ = common.BroadcastSeeds(topic.SigningPublicKey[:])
+	b1, b2 := topic.nextBuckets(config)
+	p1, p2 := public.nextBuckets(config)
+	if b1 != p1 || b2 != p2 {
+		t.Fatal("Broadcast buckets are not publicly derivable.")
+	}
+
+	args, err := topic.GeneratePublish(config, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.VerifyBroadcast(args, config) {
+		t.Fatal("Broadcast writes should be verifiable.")
+	}
+	args.BroadcastSeqNo++
+	if common.VerifyBroadcast(args, config) {
+		t.Fatal("Misplaced broadcast writes should not verify.")
+	}
+
+	// Serialization preserves broadcast mode.
+	txt, _ := topic.MarshalText()
+	clone := Topic{}
+	if err = clone.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	if !clone.IsBroadcast() {
+		t.Fatal("Restored topic lost broadcast mode.")
+	}
+
+	regular, _ := NewTopic()
+	if regular.IsBroadcast() {
+		t.Fatal("Regular topics are not broadcasts.")
+	}
+	args, _ = regular.GeneratePublish(config, []byte("hello"))
+	if args.BroadcastKey != nil {
+		t.Fatal("Regular writes should not claim to be broadcasts.")
+	}
+	// Claiming an arbitrary key does not verify a regular write's placement.
+	args.BroadcastKey = regular.SigningPublicKey[:]
+	if common.VerifyBroadcast(args, config) {
+		t.Fatal("Regular write verified as a broadcast.")
+	}
+}
@@ -0,0 +1,79 @@
+package libtalek
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// DefaultCatchUpRate is the CatchUpRate of new clients.
+const DefaultCatchUpRate = 4
+
+// catchUpStreak is how many polls in a row must find an item of a handle for
+// it to be taken as far behind, and caught up.
+const catchUpStreak = 3
+
+// readWait is the wait before the next read of the client. While handles are
+// caught up, it is shortened to make CatchUpRate reads each ReadInterval,
+// unless the common configuration shapes the reads of clients.
+func (c *Client) readWait(conf *ClientConfig) time.Duration {
+	wait := conf.readWait(rand.Reader)
+	if c.CatchUpRate <= 1 || conf.Config.ReadSlot() > 0 {
+		return wait
+	}
+	c.handleMutex.Lock()
+	catching := len(c.catchingUp) > 0
+	c.handleMutex.Unlock()
+	if fast := conf.ReadInterval / time.Duration(c.CatchUpRate); catching && fast < wait {
+		return fast
+	}
+	return wait
+}
+
+// nextHandle rotates the handles polled alone, returning the next to read.
+// While handles are caught up, every other turn goes to them, in turn.
+// Handles whose next item the client wrote and can't yet read are passed
+// over, and nil returned if no handle can be polled. Called with handleMutex
+// held.
+func (c *Client) nextHandle() *Handle {
+	c.catchUpTurn = len(c.catchingUp) > 0 && !c.catchUpTurn
+	for i, h := range c.handles {
+		if c.unreadable(h) {
+			continue
+		}
+		if _, ok := c.catchingUp[h]; ok || !c.catchUpTurn {
+			c.handles = append(append(c.handles[:i:i], c.handles[i+1:]...), h)
+			return h
+		}
+	}
+	return nil
+}
+
+// observePoll notes whether both reads of a poll of a handle polled alone
+// found nothing, or found an item. A handle is caught up once catchUpStreak
+// polls in a row find items, until a poll finds none, and its progress is
+// reported meanwhile.
+func (c *Client) observePoll(h *Handle, found bool) {
+	if found {
+		h.streak++
+	} else {
+		h.streak = 0
+	}
+	c.handleMutex.Lock()
+	start, catching := c.catchingUp[h]
+	var e *Event
+	switch {
+	case catching && !found:
+		delete(c.catchingUp, h)
+		e = &Event{Kind: EventCaughtUp, Handle: h, Read: h.Seqno - start}
+	case catching:
+		e = &Event{Kind: EventCatchingUp, Handle: h, Read: h.Seqno - start}
+	case found && h.streak >= catchUpStreak && c.CatchUpRate > 1 && c.followed(h):
+		start = h.Seqno - uint64(h.streak)
+		c.catchingUp[h] = start
+		e = &Event{Kind: EventCatchingUp, Handle: h, Read: h.Seqno - start}
+	}
+	c.handleMutex.Unlock()
+	if e != nil {
+		c.report(e)
+	}
+}
@@ -0,0 +1,69 @@
+package libtalek
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCatchUp(t *testing.T) {
+	config := groupTestConfig()
+	c := newClient("TestCatchUp", config, &mockLeader{})
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	behind, _ := NewTopic()
+	c.Poll(&behind.Handle)
+	for i := 0; i < 2; i++ {
+		other, _ := NewTopic()
+		c.Poll(&other.Handle)
+	}
+	h := &behind.Handle
+
+	if wait := c.readWait(&config); wait != time.Second {
+		t.Fatalf("Client waited %v between reads with no handle behind.", wait)
+	}
+	for i := 0; i < catchUpStreak; i++ {
+		h.Seqno++
+		c.observePoll(h, true)
+	}
+	if e := <-c.Events(); e.Kind != EventCatchingUp || e.Handle != h || e.Read != catchUpStreak {
+		t.Fatalf("Expected the handle to be caught up, got %v of %d items.", e, e.Read)
+	}
+	if wait := c.readWait(&config); wait != time.Second/DefaultCatchUpRate {
+		t.Fatalf("Client waited %v between reads catching up.", wait)
+	}
+	// Every other turn goes to the handle caught up, and the rest rotate.
+	turns := 0
+	for i := 0; i < 10; i++ {
+		if c.nextHandle() == h {
+			turns++
+		}
+	}
+	if turns != 5 {
+		t.Fatalf("Handle caught up took %d of 10 turns.", turns)
+	}
+
+	h.Seqno++
+	c.observePoll(h, true)
+	if e := <-c.Events(); e.Kind != EventCatchingUp || e.Read != catchUpStreak+1 {
+		t.Fatalf("Expected progress of the catch up, got %v of %d items.", e, e.Read)
+	}
+	c.observePoll(h, false)
+	if e := <-c.Events(); e.Kind != EventCaughtUp || e.Read != catchUpStreak+1 {
+		t.Fatalf("Expected the handle to have caught up, got %v.", e)
+	}
+	if wait := c.readWait(&config); wait != time.Second {
+		t.Fatalf("Client waited %v between reads once caught up.", wait)
+	}
+
+	// A client without a catch up rate never reads faster.
+	c.CatchUpRate = 0
+	for i := 0; i < catchUpStreak; i++ {
+		c.observePoll(h, true)
+	}
+	select {
+	case e := <-c.Events():
+		t.Fatalf("Handle was caught up without a catch up rate: %v", e)
+	default:
+	}
+}
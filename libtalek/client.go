@@ -6,6 +6,7 @@ import (
 	"compress/flate"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"math/big"
@@ -21,7 +22,7 @@ import (
 // Client represents a connection to the Talek system. Typically created with
 // NewClient, the object manages requests, both reads an writes.
 type Client struct {
-	log    *common.Logger
+	log    *clientLogger
 	name   string
 	config atomic.Value //ClientConfig
 	dead   int32
@@ -36,54 +37,135 @@ type Client struct {
 
 	pendingReads chan request
 	handleMutex  sync.Mutex
+	groups       []*SubscriptionGroup // Guarded by handleMutex
+	turn         int                  // Of the round of reads. Used only by nextRequest
+	// Handles polled alone being caught up, with the position each began at.
+	// Guarded by handleMutex.
+	catchingUp  map[*Handle]uint64
+	catchUpTurn bool // Used only by nextRequest
+	// With ReadYourWrites, the epoch reads were last answered in, and the
+	// epochs the client's own items were written in, by the writes pending.
+	// Guarded by handleMutex.
+	readEpoch  uint64
+	ownWrites  map[ownItem]uint64
+	ownPending map[*common.WriteArgs]ownItem
+	// Held while a polled handle takes a reply and advances, so snapshots
+	// of handles see whole positions.
+	advanceMutex sync.Mutex
 
 	interestVector *bloom.Filter
+	coverTier      uint8 // Of the last cover read. Used only by nextRequest
 
-	lastSeqNo uint64
+	events  chan *Event
+	failing int32 // Use atomic
+
+	commitLock  sync.Mutex
+	commitments map[uint64]*common.EpochCommitment // Verified, by epoch
+
+	lastSeqNo uint64 // Use atomic
+	// Unspent write tokens. Used only by writePeriodic.
+	tokens []*common.Token
 	// Used to synchronize fetches of global interest vector.
 	lastInterestSN uint64
 
+	// Reads are made only by PollOnce, which holds burstLock.
+	background bool
+	burstLock  sync.Mutex
+
+	// The configuration of the previous generation while a transition
+	// crosses over, which every other read is made under.
+	previous  atomic.Value // *ClientConfig
+	crossings uint64       // Use atomic
+
+	// Latencies of reads, and of decoding their replies.
+	readLatency   common.LatencyRecorder
+	decodeLatency common.LatencyRecorder
+
+	// Most reads the client makes each ReadInterval while catching up
+	// handles far behind their logs, DefaultCatchUpRate unless changed. 0 or
+	// 1 never reads faster. Clients whose reads are shaped by the common
+	// configuration never do either.
+	CatchUpRate int
+	// Whether handles polled alone skip polls of items the client wrote
+	// itself until the epoch they were written in is sealed, making other
+	// reads meanwhile rather than polls racing the writes.
+	ReadYourWrites bool
+
 	// for debugging / testing
 	Verbose bool
 	Rand    io.Reader
 }
 
+// topicTransport is the part of a Client used by abstractions layered over topics.
+type topicTransport interface {
+	Publish(handle *Topic, data []byte) error
+	Poll(handle *Handle) chan []byte
+	Done(handle *Handle) bool
+	snapshot(fn func())
+}
+
 type request struct {
 	*common.ReadArgs
 	*Handle
+	group *SubscriptionGroup // Of the handle, if it is in one
 }
 
 // NewClient creates a Talek client for reading and writing metadata-protected messages.
 func NewClient(name string, config ClientConfig, leader common.FrontendInterface) *Client {
+	c := newClient(name, config, leader)
+	if c == nil {
+		return nil
+	}
+
+	go c.readPeriodic()
+	go c.writePeriodic()
+	go c.updatePeriodic()
+
+	return c
+}
+
+func newClient(name string, config ClientConfig, leader common.FrontendInterface) *Client {
 	c := &Client{}
-	c.log = common.NewLogger(name)
+	c.log = newClientLogger(commonLogger{common.NewLogger(name)})
 	c.name = name
 	c.config.Store(config)
 	c.leader = leader
 	if config.Config == nil && c.getConfig() != nil {
 		return nil
 	}
+	if _, err := common.NewPlacementHash(c.config.Load().(ClientConfig).PlacementHash); err != nil {
+		c.log.Log(common.LevelError, "Failed to place topics", ErrField(err))
+		return nil
+	}
+	if _, err := common.NewBucketStrategy(c.config.Load().(ClientConfig).BucketStrategy); err != nil {
+		c.log.Log(common.LevelError, "Failed to place topics", ErrField(err))
+		return nil
+	}
+	if _, err := common.NewPad(c.config.Load().(ClientConfig).PadAlgorithm); err != nil {
+		c.log.Log(common.LevelError, "Failed to unpad replies", ErrField(err))
+		return nil
+	}
 
 	//todo: should channel capacity be smarter?
 	c.pendingReads = make(chan request, 5)
 	c.pendingWrites = make(chan *common.WriteArgs, 5)
 	c.pendingUpdates = make(chan bool, 5)
+	c.events = make(chan *Event, eventBacklog)
+	c.catchingUp = make(map[*Handle]uint64)
+	c.ownWrites = make(map[ownItem]uint64)
+	c.ownPending = make(map[*common.WriteArgs]ownItem)
+	c.CatchUpRate = DefaultCatchUpRate
 
 	bfSize := math.Ceil(math.Log2(float64(config.NumBuckets)))
 	iv, err := bloom.New(rand.Reader, int(bfSize), config.BloomFalsePositive)
 	if err != nil {
-		c.log.Error.Printf("Failed to initialize interest vector: %v", err)
+		c.log.Log(common.LevelError, "Failed to initialize interest vector", ErrField(err))
 		return nil
 	}
 	c.interestVector = iv
 
 	c.writeWaiters = sync.NewCond(&c.writeMutex)
 	c.Rand = rand.Reader
-
-	go c.readPeriodic()
-	go c.writePeriodic()
-	go c.updatePeriodic()
-
 	return c
 }
 
@@ -104,7 +186,8 @@ func (c *Client) Kill() {
 	c.Flush()
 }
 
-// MaxLength returns the maximum allowed message the client can Publish.
+// MaxLength returns the maximum allowed message the client can Publish to a
+// topic of size class 0.
 // TODO: support messages spanning multiple data items.
 func (c *Client) MaxLength() uint64 {
 	config := c.config.Load().(ClientConfig)
@@ -112,35 +195,68 @@ func (c *Client) MaxLength() uint64 {
 }
 
 // Publish a new message to the end of a topic.
+// Servers may free the message after the MessageTTL of the client config.
 func (c *Client) Publish(handle *Topic, data []byte) error {
-	config := c.config.Load().(ClientConfig)
+	_, err := c.publish(handle, data, false)
+	return err
+}
+
+// publish queues the writes of a message, and returns them. With confirm, each
+// is given a ReplyChan the reply of the frontend is sent on.
+func (c *Client) publish(handle *Topic, data []byte, confirm bool) ([]*common.WriteArgs, error) {
+	if c.background {
+		return nil, errBackgroundPublish
+	}
+	base := c.config.Load().(ClientConfig)
+	config, err := base.inClass(handle.Class)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(data) > int(config.DataSize*common.MsgMaxFragments) {
-		return errors.New("message is too long")
+	partSize := int(config.DataSize) - handle.overhead()
+	if partSize <= 0 {
+		return nil, errors.New("items leave no room for messages of the topic's envelope")
+	}
+	msg, err := newPaddedMessage(data, handle.Padding, partSize, common.MsgMaxFragments)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.contents) > int(config.DataSize*common.MsgMaxFragments) {
+		return nil, errors.New("message is too long")
 	}
 
 	// First word is prepended as length of data:
-	parts := newMessage(data).Split(int(config.DataSize - PublishingOverhead))
+	parts := msg.Split(partSize)
 
+	writes := make([]*common.WriteArgs, 0, len(parts))
 	for _, part := range parts {
 		writeArgs, err := handle.GeneratePublish(config.Config, part)
+		if err != nil {
+			return writes, err
+		}
 		if c.Verbose {
-			c.log.Info.Printf("Wrote %v(%d) to %d,%d.",
-				writeArgs.Data[0:4],
-				len(writeArgs.Data),
-				writeArgs.Bucket1,
-				writeArgs.Bucket2)
+			c.log.Log(common.LevelInfo, "Wrote item",
+				HandleField(&handle.Handle),
+				SeqNoField(handle.Seqno-1),
+				LogField{"size", len(writeArgs.Data)},
+				LogField{"bucket1", writeArgs.Bucket1},
+				LogField{"bucket2", writeArgs.Bucket2})
 		}
-		if err != nil {
-			return err
+		writeArgs.TTL = config.MessageTTL
+		writeArgs.Priority = config.WritePriority
+		writeArgs.Generation = config.Generation
+		if confirm {
+			writeArgs.ReplyChan = make(chan *common.WriteReply, 1)
 		}
+		c.wrote(&handle.Handle, handle.Seqno-1, writeArgs)
 
 		c.writeMutex.Lock()
 		c.writeCount++
 		c.writeMutex.Unlock()
 		c.pendingWrites <- writeArgs
+		writes = append(writes, writeArgs)
 	}
-	return nil
+	return writes, nil
 }
 
 // Flush blocks until the the client has finished in-progress reads and writes.
@@ -153,25 +269,38 @@ func (c *Client) Flush() {
 	return
 }
 
+// ClientLatency are the latencies of the reads of a client, from submitting a
+// read to its reply, and from the reply to the message it completes.
+type ClientLatency struct {
+	Read   common.Histogram
+	Decode common.Histogram
+}
+
+// Latency reports the latencies of the client's reads so far.
+func (c *Client) Latency() ClientLatency {
+	return ClientLatency{
+		Read:   c.readLatency.Snapshot(),
+		Decode: c.decodeLatency.Snapshot(),
+	}
+}
+
 // Poll handles to updates on a given log.
 // When done reading messages, the channel can be closed via the Done
-// method.
+// method. A handle may be polled again after Done, on a new channel.
 func (c *Client) Poll(handle *Handle) chan []byte {
 	// Check if already polling.
 	c.handleMutex.Lock()
-	for x := range c.handles {
-		if c.handles[x] == handle {
-			c.handleMutex.Unlock()
-			if c.Verbose {
-				c.log.Info.Println("Ignoring request to poll, because already polling.")
-			}
-			return nil
+	if c.followed(handle) {
+		c.handleMutex.Unlock()
+		if c.Verbose {
+			c.log.Log(common.LevelInfo, "Ignoring request to poll, because already polling", HandleField(handle))
 		}
+		return nil
 	}
 	if c.Verbose {
 		handle.log = c.log
 	}
-	if handle.updates == nil {
+	if handle.updates == nil || handle.isDone() {
 		if err := initHandle(handle); err != nil {
 			return nil
 		}
@@ -189,6 +318,8 @@ func (c *Client) Done(handle *Handle) bool {
 		if c.handles[i] == handle {
 			c.handles[i] = c.handles[len(c.handles)-1]
 			c.handles = c.handles[:len(c.handles)-1]
+			delete(c.catchingUp, handle)
+			close(handle.done)
 			c.handleMutex.Unlock()
 			return true
 		}
@@ -198,6 +329,39 @@ func (c *Client) Done(handle *Handle) bool {
 }
 
 /** Private methods **/
+
+// snapshot calls fn while no polled handle advances, so it may read or
+// marshal handles being polled.
+func (c *Client) snapshot(fn func()) {
+	c.advanceMutex.Lock()
+	defer c.advanceMutex.Unlock()
+	fn()
+}
+
+// followed reports whether a handle is polled, alone or in a group. Called
+// with handleMutex held.
+func (c *Client) followed(handle *Handle) bool {
+	for _, h := range c.handles {
+		if h == handle {
+			return true
+		}
+	}
+	for _, g := range c.groups {
+		if g.contains(handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError restores the typed errors of failed writes.
+func writeError(msg string) error {
+	if msg == common.ErrBucketsFull.Error() {
+		return common.ErrBucketsFull
+	}
+	return errors.New(msg)
+}
+
 func (c *Client) getConfig() error {
 	reply := new(common.Config)
 	if err := c.leader.GetConfig(nil, reply); err != nil {
@@ -211,72 +375,273 @@ func (c *Client) getConfig() error {
 
 func (c *Client) writePeriodic() {
 	var req *common.WriteArgs
+	var retry *common.WriteArgs // A write the frontend turned away
+	var retryQueued bool
+	var puzzle *common.Puzzle // Of the frontend, while it is under load
+	var reissued bool         // Whether the retry has a token issued for it
 
 	for atomic.LoadInt32(&c.dead) == 0 {
 		reply := common.WriteReply{}
 		conf := c.config.Load().(ClientConfig)
-		select {
-		case req = <-c.pendingWrites:
+		queued := true
+		if retry != nil {
+			req, queued, retry = retry, retryQueued, nil
+		} else {
+			reissued = false
+			select {
+			case req = <-c.pendingWrites:
+				break
+			default:
+				req = c.generateRandomWrite(conf)
+				queued = false
+			}
+		}
+		if puzzle != nil {
+			puzzle.Solve(req)
+		}
+		var err error
+		if conf.TokenAccount != "" && req.Token == nil {
+			req.Token, err = c.nextToken(conf.TokenAccount)
+		}
+		if err == nil {
+			req.Deadline = deadline(conf.RequestTimeout)
+			if err = c.leader.Write(req, &reply); err == nil {
+				puzzle = reply.Puzzle
+			}
+		}
+		if err != nil {
+			reply.Err = err.Error()
+		}
+		if reply.Err == common.ErrTokenRequired.Error() && conf.TokenAccount != "" && !reissued {
+			// The key of the frontend changed since the tokens were issued.
+			// Made again with a new token in the next slot.
+			c.tokens = nil
+			req.Token = nil
+			retry, retryQueued, reissued = req, queued, true
+		} else if reply.Err == common.ErrPuzzleRequired.Error() && puzzle != nil {
+			// Solved and made again in the next slot, cover writes as well as
+			// queued ones, so the frontend can't tell them apart.
+			retry, retryQueued = req, queued
+		} else if reply.RetryAfter > 0 {
+			c.report(&Event{Kind: EventBackoff, Err: fmt.Errorf("%s, retrying after %v", reply.Err, reply.RetryAfter)})
+			if queued {
+				retry, retryQueued = req, true
+			}
+		} else if reply.Err != "" {
+			if reply.Err == common.ErrGeneration.Error() {
+				c.requestUpdate()
+			}
+			c.failed(EventWriteFailed, writeError(reply.Err), reply.FailedDomains, nil)
+		} else {
+			c.succeeded()
+			c.observeSeqNo(reply.GlobalSeqNo, conf.WindowSize())
+		}
+		if queued && retry == nil {
+			c.acknowledged(req, &reply)
 			c.writeMutex.Lock()
 			c.writeCount--
 			if c.writeCount == 0 {
 				c.writeWaiters.Broadcast()
 			}
 			c.writeMutex.Unlock()
-			break
-		default:
-			req = c.generateRandomWrite(conf)
-		}
-		err := c.leader.Write(req, &reply)
-		if err != nil {
-			reply.Err = err.Error()
 		}
-		if reply.GlobalSeqNo > c.lastSeqNo {
-			c.lastSeqNo = reply.GlobalSeqNo
-		}
-		if req.ReplyChan != nil {
+		if req.ReplyChan != nil && retry == nil {
 			req.ReplyChan <- &reply
 		}
 		//TODO: switch to poisson
-		time.Sleep(conf.WriteInterval)
+		time.Sleep(backoff(conf.writeWait(rand.Reader), reply.RetryAfter))
 	}
 }
 
+// tokenBatch is how many write tokens a client is issued at once.
+const tokenBatch = 16
+
+// nextToken takes an unspent write token, having the frontend issue more to
+// the account when there are none left.
+func (c *Client) nextToken(account string) (*common.Token, error) {
+	if len(c.tokens) == 0 {
+		if err := c.issueTokens(account); err != nil {
+			return nil, err
+		}
+	}
+	token := c.tokens[0]
+	c.tokens = c.tokens[1:]
+	return token, nil
+}
+
+// issueTokens has the frontend sign a batch of tokens blinded for its current
+// key, and unblinds them.
+func (c *Client) issueTokens(account string) error {
+	current := common.IssueTokensReply{}
+	if err := c.leader.IssueTokens(&common.IssueTokensArgs{Account: account}, &current); err != nil {
+		return err
+	}
+	if current.Err != "" {
+		return errors.New(current.Err)
+	}
+	if current.Key == nil {
+		return errors.New("frontend has no token key")
+	}
+	conf := c.config.Load().(ClientConfig)
+	if !conf.tokenKey(current.Key) {
+		return fmt.Errorf("frontend issues tokens of key %x, which is not configured", current.Key.ID())
+	}
+
+	args := &common.IssueTokensArgs{Account: account, KeyID: current.Key.ID()}
+	blind := make([]*common.BlindToken, tokenBatch)
+	for i := range blind {
+		b, err := current.Key.Blind(c.Rand)
+		if err != nil {
+			return err
+		}
+		blind[i] = b
+		args.Blinded = append(args.Blinded, b.Blinded)
+	}
+	reply := common.IssueTokensReply{}
+	if err := c.leader.IssueTokens(args, &reply); err != nil {
+		return err
+	}
+	if reply.Err != "" {
+		return errors.New(reply.Err)
+	}
+	if len(reply.Signatures) != len(blind) {
+		return fmt.Errorf("frontend signed %d of %d tokens", len(reply.Signatures), len(blind))
+	}
+	for i, b := range blind {
+		token, err := b.Unblind(reply.Signatures[i])
+		if err != nil {
+			return fmt.Errorf("frontend issued an invalid token: %v", err)
+		}
+		c.tokens = append(c.tokens, token)
+	}
+	return nil
+}
+
+// deadline is when a request made now with a timeout is abandoned, or zero for
+// no timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// backoff is the wait before the next request, shifted later if the frontend
+// asked the client to retry after longer than its interval.
+func backoff(interval time.Duration, retryAfter time.Duration) time.Duration {
+	if retryAfter > interval {
+		return retryAfter
+	}
+	return interval
+}
+
 func (c *Client) readPeriodic() {
 	var req request
 
 	for atomic.LoadInt32(&c.dead) == 0 {
-		reply := common.ReadReply{}
-		conf := c.config.Load().(ClientConfig)
+		conf := c.readConfig()
+		companion := false
 		select {
 		case req = <-c.pendingReads:
-			break
+			companion = true
+			// The companion read of a poll is answered under the generation
+			// it was made for.
+			if req.ReadArgs.Generation != conf.Generation {
+				conf = c.generationConfig(req.ReadArgs.Generation)
+			}
 		default:
 			req = c.nextRequest(&conf)
 		}
-		if c.Verbose {
-			c.log.Info.Printf("Reading bucket %d\n", req.Bucket())
+		reply, msg, err := c.read(req, &conf, deadline(conf.RequestTimeout))
+		if msg != nil && req.group != nil {
+			req.group.deliver(req.Handle, msg)
+		} else if msg != nil {
+			req.Handle.deliver(msg)
 		}
-		encreq, err := req.ReadArgs.Encode(conf.TrustDomains)
-		if err != nil {
+		// Once both reads of a poll are made, the handle has advanced if
+		// either found an item.
+		if companion && req.Handle != nil && req.group == nil && err == nil {
+			c.observePoll(req.Handle, req.Handle.Seqno > req.Handle.polled)
+		}
+		if reply.RetryAfter == 0 && reply.LastInterestSN != c.lastInterestSN {
+			c.pendingUpdates <- true
+		}
+		time.Sleep(backoff(c.readWait(&conf), reply.RetryAfter))
+	}
+}
+
+// read makes a read request, and has its handle, if any, take the reply. It
+// returns the reply, the message the reply completed, and the error reported
+// for the handle if it could not take the reply.
+func (c *Client) read(req request, conf *ClientConfig, deadline time.Time) (*common.ReadReply, []byte, error) {
+	reply := &common.ReadReply{}
+	if c.Verbose {
+		c.log.Log(common.LevelInfo, "Reading bucket", LogField{"bucket", req.Bucket()})
+	}
+	start := time.Now()
+	if streamer, ok := c.leader.(common.ReadStreamer); ok {
+		if err := streamer.ReadStream(req.ReadArgs, conf.TrustDomains, deadline, reply); err != nil {
 			reply.Err = err.Error()
-		} else {
-			err := c.leader.Read(&encreq, &reply)
-			if err != nil {
-				reply.Err = err.Error()
-			}
 		}
-		if reply.GlobalSeqNo.End > c.lastSeqNo {
-			c.lastSeqNo = reply.GlobalSeqNo.End
+	} else if encreq, err := req.ReadArgs.Encode(conf.TrustDomains); err != nil {
+		reply.Err = err.Error()
+	} else {
+		encreq.Deadline = deadline
+		if err := c.leader.Read(&encreq, reply); err != nil {
+			reply.Err = err.Error()
 		}
-		if req.Handle != nil {
-			req.Handle.OnResponse(req.ReadArgs, &reply, uint(conf.DataSize))
+	}
+	c.readLatency.RecordSince(start)
+	if reply.RetryAfter > 0 {
+		// A polled handle does not advance, so its read is made again later.
+		err := fmt.Errorf("%s, retrying after %v", reply.Err, reply.RetryAfter)
+		c.report(&Event{Kind: EventBackoff, Err: err, Handle: req.Handle})
+		return reply, nil, err
+	} else if reply.Err != "" {
+		if reply.Err == common.ErrGeneration.Error() {
+			c.requestUpdate()
 		}
-		if reply.LastInterestSN != c.lastInterestSN {
-			c.pendingUpdates <- true
+		err := errors.New(reply.Err)
+		c.failed(EventReadFailed, err, reply.FailedDomains, req.Handle)
+		return reply, nil, err
+	}
+	c.succeeded()
+	c.observeSeqNo(reply.GlobalSeqNo.End, conf.WindowSize())
+	c.observeEpoch(reply.Epoch)
+	if req.Handle == nil {
+		return reply, nil, nil
+	}
+	decoding := time.Now()
+	defer c.decodeLatency.RecordSince(decoding)
+	// The buckets and items of the reply are those of the class and tier read.
+	classConf, err := conf.forRead(req.ReadArgs)
+	if err != nil {
+		c.report(&Event{Kind: EventReadFailed, Err: err, Handle: req.Handle})
+		return reply, nil, err
+	}
+	if err := c.verifyRead(req.ReadArgs, reply, classConf); err != nil {
+		// A read skewed across an epoch is lost, and made again.
+		if skew, ok := err.(*common.BucketSkewError); ok {
+			c.report(&Event{Kind: EventReadFailed, Err: err, TrustDomains: c.domainNames(skew.TrustDomains), Handle: req.Handle})
+		} else {
+			c.report(&Event{Kind: EventUnverified, Err: err, Handle: req.Handle})
 		}
-		time.Sleep(conf.ReadInterval)
+		return reply, nil, err
+	}
+	c.advanceMutex.Lock()
+	// A handle no longer polled may have been freed.
+	if req.Handle.isDone() {
+		c.advanceMutex.Unlock()
+		return reply, nil, nil
+	}
+	msg, err := req.Handle.onResponse(req.ReadArgs, reply, conf)
+	c.advanceMutex.Unlock()
+	if err == ErrReplay {
+		c.report(&Event{Kind: EventReplay, Err: err, Handle: req.Handle})
+	} else if err != nil {
+		c.failed(EventDecodeFailed, err, nil, req.Handle)
 	}
+	return reply, msg, err
 }
 
 func (c *Client) updatePeriodic() {
@@ -291,19 +656,31 @@ func (c *Client) updatePeriodic() {
 		case <-c.pendingUpdates:
 		case <-time.After(time.Duration(conf.WriteInterval.Nanoseconds() * int64(conf.InterestMultiple))):
 			if c.Verbose {
-				c.log.Info.Printf("Fetching Global Interest Vector")
+				c.log.Log(common.LevelInfo, "Fetching global interest vector")
 			}
 		}
 
 		reply := common.GetUpdatesReply{}
-		c.leader.GetUpdates(&req, &reply)
+		if err := c.leader.GetUpdates(&req, &reply); err != nil {
+			reply.Err = err.Error()
+		}
+		if reply.Err != "" {
+			c.failed(EventUpdateFailed, errors.New(reply.Err), nil, nil)
+			continue
+		}
+		c.followTransition(&reply)
+		if len(reply.InterestVector) == 0 {
+			// No interest vector has been computed yet.
+			continue
+		}
 
 		// Decompress.
 		var decompressedInterest bytes.Buffer
 		writer := bufio.NewWriter(&decompressedInterest)
 		reader := flate.NewReader(bytes.NewReader(reply.InterestVector))
 		if _, err := io.Copy(writer, reader); err != nil {
-			c.log.Warn.Printf("Failed to decompress interest update: %v\n", err)
+			c.log.Log(common.LevelWarn, "Failed to decompress interest update", ErrField(err))
+			c.failed(EventDecodeFailed, err, nil, nil)
 			continue
 		}
 
@@ -318,6 +695,95 @@ func (c *Client) updatePeriodic() {
 	}
 }
 
+// requestUpdate has updatePeriodic fetch updates now, unless it already will.
+func (c *Client) requestUpdate() {
+	select {
+	case c.pendingUpdates <- true:
+	default:
+	}
+}
+
+// followTransition moves the client to the next generation of the
+// configuration once the epoch of the transition the frontend announced
+// begins. Until its crossover ends, every other read is still made under the
+// previous generation, so messages published under it are found.
+func (c *Client) followTransition(reply *common.GetUpdatesReply) {
+	conf := c.config.Load().(ClientConfig)
+	t := reply.Transition
+	if conf.signed {
+		c.followSigned(reply)
+		return
+	}
+	if t != nil && t.Generation == conf.Generation+1 && reply.Epoch >= t.Epoch {
+		previous := conf
+		next := t.Next
+		conf.Config = &next
+		conf.Generation = t.Generation
+		// The intervals of the next generation replace those of the client.
+		conf.WriteInterval, conf.ReadInterval = next.WriteInterval, next.ReadInterval
+		c.config.Store(conf)
+		if t.Crossing(reply.Epoch) {
+			c.previous.Store(&previous)
+		}
+		c.report(&Event{Kind: EventReconfigured})
+	} else if reply.Generation > conf.Generation {
+		// The crossover passed without the client, which can only move to
+		// the configuration in use.
+		if err := c.getConfig(); err != nil {
+			c.failed(EventUpdateFailed, err, nil, nil)
+			return
+		}
+		conf = c.config.Load().(ClientConfig)
+		conf.Generation = reply.Generation
+		conf.WriteInterval, conf.ReadInterval = conf.Config.WriteInterval, conf.Config.ReadInterval
+		c.config.Store(conf)
+		c.report(&Event{Kind: EventReconfigured})
+	}
+	if t == nil || !t.Crossing(reply.Epoch) {
+		c.previous.Store((*ClientConfig)(nil))
+	}
+}
+
+// followSigned takes up the generation in use for a client whose configuration
+// is signed by the trust domains, once it is the one the frontend uses.
+func (c *Client) followSigned(reply *common.GetUpdatesReply) {
+	conf := c.config.Load().(ClientConfig)
+	if reply.Generation == conf.Generation {
+		return
+	}
+	current := new(common.Config)
+	if err := c.leader.GetConfig(nil, current); err != nil {
+		c.failed(EventUpdateFailed, err, nil, nil)
+		return
+	}
+	if *current != *conf.Config {
+		c.failed(EventUpdateFailed, fmt.Errorf("configuration generation %d is not signed by the trust domains", reply.Generation), nil, nil)
+		return
+	}
+	conf.Generation = reply.Generation
+	c.config.Store(conf)
+	c.report(&Event{Kind: EventReconfigured})
+}
+
+// readConfig returns the configuration the next read is made under: during
+// the crossover of a transition, alternately that of the previous generation.
+func (c *Client) readConfig() ClientConfig {
+	conf := c.config.Load().(ClientConfig)
+	if previous, _ := c.previous.Load().(*ClientConfig); previous != nil && atomic.AddUint64(&c.crossings, 1)%2 == 0 {
+		return *previous
+	}
+	return conf
+}
+
+// generationConfig returns the configuration of a generation reads are made
+// under, or the current one once the previous generation is over.
+func (c *Client) generationConfig(generation uint64) ClientConfig {
+	if previous, _ := c.previous.Load().(*ClientConfig); previous != nil && previous.Generation == generation {
+		return *previous
+	}
+	return c.config.Load().(ClientConfig)
+}
+
 func (c *Client) generateRandomWrite(config ClientConfig) *common.WriteArgs {
 	args := &common.WriteArgs{}
 	var max big.Int
@@ -325,6 +791,9 @@ func (c *Client) generateRandomWrite(config ClientConfig) *common.WriteArgs {
 	b2, _ := rand.Int(c.Rand, max.SetUint64(config.NumBuckets))
 	args.Bucket1 = b1.Uint64()
 	args.Bucket2 = b2.Uint64()
+	args.TTL = config.MessageTTL
+	args.Priority = config.WritePriority
+	args.Generation = config.Generation
 	args.Data = make([]byte, config.Config.DataSize, config.Config.DataSize)
 	if _, err := c.Rand.Read(args.Data); err != nil {
 		return nil
@@ -334,18 +803,23 @@ func (c *Client) generateRandomWrite(config ClientConfig) *common.WriteArgs {
 
 func (c *Client) generateRandomRead(config *ClientConfig) *common.ReadArgs {
 	args := &common.ReadArgs{}
-	vectorSize := uint32((config.Config.NumBuckets+7)/8 + 1)
+	args.PadAlgorithm = config.PadAlgorithm
+	args.Generation = config.Generation
+	config, args.Tier = c.coverConfig(config)
+	vectors, err := common.NewCoverRequestVectors(config.Config, len(config.TrustDomains), c.Rand)
+	if err != nil {
+		c.log.fatal("Error creating random request vectors", ErrField(err))
+	}
+	args.Vectors = vectors
 	args.TD = make([]common.PirArgs, len(config.TrustDomains), len(config.TrustDomains))
 	for i := 0; i < len(args.TD); i++ {
-		args.TD[i].RequestVector = make([]byte, vectorSize, vectorSize)
-		c.Rand.Read(args.TD[i].RequestVector)
 		seed, err := drbg.NewSeed()
 		if err != nil {
-			c.log.Error.Fatalf("Error creating random seed: %v\n", err)
+			c.log.fatal("Error creating random seed", ErrField(err))
 		}
 		args.TD[i].PadSeed, err = seed.MarshalBinary()
 		if err != nil {
-			c.log.Error.Fatalf("Failed to marshal seed: %v\n", err)
+			c.log.fatal("Failed to marshal seed", ErrField(err))
 		}
 	}
 	return args
@@ -371,22 +845,42 @@ func (c *Client) prioritizeRequests() {
 func (c *Client) nextRequest(config *ClientConfig) request {
 	c.handleMutex.Lock()
 
-	if len(c.handles) > 0 {
-		nextTopic := c.handles[0]
-		c.handles = c.handles[1:]
-		c.handles = append(c.handles, nextTopic)
+	// Each group takes one turn of a round, as each handle polled alone does.
+	if total := len(c.handles) + len(c.groups); total > 0 {
+		c.turn = (c.turn + 1) % total
+	}
+	if c.turn < len(c.groups) {
+		group := c.groups[0]
+		c.groups = append(c.groups[1:], group)
+		handle, ra1, ra2, err := group.poll(config, c.pollTier)
+		if err != nil {
+			c.log.Log(common.LevelError, "Failed to poll subscription group", ErrField(err))
+		} else if handle != nil {
+			c.pendingReads <- request{ra2, handle, group}
+			c.handleMutex.Unlock()
+			return request{ra1, handle, group}
+		}
+	} else if nextTopic := c.nextHandle(); nextTopic != nil {
+		nextTopic.polled = nextTopic.Seqno
+		c.pollTier(nextTopic, config)
 
 		ra1, ra2, err := nextTopic.generatePoll(config, c.Rand)
-		if err != nil {
+		if err == common.ErrClass {
+			// The handle is of a size class the configuration lacks, and
+			// waits for one that has it, as cover reads are made.
+			c.handleMutex.Unlock()
+			c.report(&Event{Kind: EventReadFailed, Err: err, Handle: nextTopic})
+			return request{c.generateRandomRead(config), nil, nil}
+		} else if err != nil {
 			c.handleMutex.Unlock()
-			c.log.Error.Fatal(err)
-			return request{c.generateRandomRead(config), nil}
+			c.log.fatal("Failed to poll handle", HandleField(nextTopic), ErrField(err))
+			return request{c.generateRandomRead(config), nil, nil}
 		}
-		c.pendingReads <- request{ra2, nextTopic}
+		c.pendingReads <- request{ra2, nextTopic, nil}
 		c.handleMutex.Unlock()
-		return request{ra1, nextTopic}
+		return request{ra1, nextTopic, nil}
 	}
 	c.handleMutex.Unlock()
 
-	return request{c.generateRandomRead(config), nil}
+	return request{c.generateRandomRead(config), nil, nil}
 }
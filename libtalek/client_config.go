@@ -1,8 +1,13 @@
 package libtalek
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"time"
 
 	"github.com/privacylab/talek/common"
@@ -24,6 +29,163 @@ type ClientConfig struct {
 
 	// Where should the client connect?
 	FrontendAddr string
+
+	// Retention hint, in write epochs, carried by every write the client
+	// makes. Cover writes carry it too, so it does not single out real
+	// messages. 0 for no hint.
+	MessageTTL uint64
+
+	// Priority class carried by every write the client makes, e.g.
+	// common.WriteBulk for a client moving files, so its writes wait behind
+	// interactive ones at the frontend.
+	WritePriority uint8
+
+	// How long to wait for each read or write. The frontend and replicas
+	// abandon requests once the client has stopped waiting for them. 0 waits
+	// indefinitely.
+	RequestTimeout time.Duration `json:",string"`
+
+	// Account the frontend issues write tokens to, for frontends requiring
+	// them. Tokens are issued blind, and every write spends one, cover writes
+	// included. Empty for none.
+	TokenAccount string
+	// Keys the frontend issues write tokens with, as it logs them, needed
+	// with TokenAccount. Tokens are only taken of these keys, so a frontend
+	// can't tell clients apart by issuing each with a key of its own.
+	TokenKeys []*common.TokenKey
+
+	// Generation of the common configuration, which clients move on from as
+	// transitions staged at the frontend begin. 0 until the first.
+	Generation uint64
+
+	// Set for a common configuration signed by the trust domains, which the
+	// frontend alone can't transition the client from.
+	signed bool
+}
+
+// Validate checks a client configuration, with its common configuration and
+// trust domains.
+func (c *ClientConfig) Validate() error {
+	if c.Config == nil {
+		return &common.ValidationError{Field: "config", Reason: "no common configuration"}
+	}
+	// The intervals of the client are its own, shadowing those of the common
+	// configuration, unless it shapes the traffic of clients.
+	conf := *c.Config
+	if conf.ShapeWrites == 0 {
+		conf.WriteInterval = c.WriteInterval
+	}
+	if conf.ShapeReads == 0 {
+		conf.ReadInterval = c.ReadInterval
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	for class := 0; class < c.NumClasses(); class++ {
+		if classConfig, _ := c.Config.Class(uint8(class)); classConfig.DataSize <= PublishingOverhead {
+			return &common.ValidationError{Field: "data", Reason: fmt.Sprintf("items of %d bytes leave no room for messages", classConfig.DataSize)}
+		}
+	}
+	if len(c.TrustDomains) == 0 || len(c.TrustDomains) > common.MaxTrustDomains {
+		return &common.ValidationError{Field: "trust domains", Reason: fmt.Sprintf("%d configured", len(c.TrustDomains))}
+	}
+	for i, td := range c.TrustDomains {
+		// Trust domains discovered by DNS name are completed by Discover.
+		if td.DNSName != "" {
+			if td.Fingerprint == "" {
+				return &common.ValidationError{Field: "trust domains", Reason: fmt.Sprintf("%d has no fingerprint", i)}
+			}
+			continue
+		}
+		if td.Address == "" || td.PublicKey == [32]byte{} || td.SignPublicKey == [32]byte{} {
+			return &common.ValidationError{Field: "trust domains", Reason: fmt.Sprintf("%d lacks an address or keys", i)}
+		}
+	}
+	if c.TokenAccount != "" && len(c.TokenKeys) == 0 {
+		return &common.ValidationError{Field: "token keys", Reason: "needed to take tokens of the frontend"}
+	}
+	for _, key := range c.TokenKeys {
+		if err := key.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenKey is whether tokens may be taken of a key.
+func (c *ClientConfig) tokenKey(key *common.TokenKey) bool {
+	for _, k := range c.TokenKeys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// inClass returns the client configuration of a size class, whose common
+// configuration is that of the class, or common.ErrClass.
+func (c *ClientConfig) inClass(class uint8) (*ClientConfig, error) {
+	config, err := c.Config.Class(class)
+	if err != nil || class == 0 {
+		return c, err
+	}
+	conf := *c
+	conf.Config = config
+	return &conf, nil
+}
+
+// inTier returns the client configuration of a tier of the database, whose
+// common configuration is that of the tier, or common.ErrTier.
+func (c *ClientConfig) inTier(tier uint8) (*ClientConfig, error) {
+	config, err := c.Config.Tier(tier)
+	if err != nil || tier == common.TierCold {
+		return c, err
+	}
+	conf := *c
+	conf.Config = config
+	return &conf, nil
+}
+
+// forRead returns the client configuration of the size class and tier a read
+// is made of.
+func (c *ClientConfig) forRead(args *common.ReadArgs) (*ClientConfig, error) {
+	conf, err := c.inClass(args.Class)
+	if err != nil {
+		return nil, err
+	}
+	return conf.inTier(args.Tier)
+}
+
+// readWait is the wait before the next read of the client: a slot of the
+// traffic shape of the common configuration, jittered with randomness from
+// rand, if it shapes reads, or else the client's ReadInterval.
+func (c *ClientConfig) readWait(rand io.Reader) time.Duration {
+	if slot := c.Config.ReadSlot(); slot > 0 {
+		return jittered(slot, c.Config.ShapeJitter, rand)
+	}
+	return c.ReadInterval
+}
+
+// writeWait is the wait before the next write of the client, as readWait.
+func (c *ClientConfig) writeWait(rand io.Reader) time.Duration {
+	if slot := c.Config.WriteSlot(); slot > 0 {
+		return jittered(slot, c.Config.ShapeJitter, rand)
+	}
+	return c.WriteInterval
+}
+
+// jittered is a slot moved uniformly within jitter centered on it, so slots
+// keep their mean.
+func jittered(slot time.Duration, jitter time.Duration, rand io.Reader) time.Duration {
+	if jitter <= 0 {
+		return slot
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(rand, b[:]); err != nil {
+		return slot
+	}
+	offset := time.Duration(binary.LittleEndian.Uint64(b[:]) % uint64(jitter))
+	return slot - jitter/2 + offset
 }
 
 // ClientConfigFromFile restores a client configuration from on-disk form.
@@ -36,6 +198,57 @@ func ClientConfigFromFile(file string) *ClientConfig {
 	if err := json.Unmarshal(configString, config); err != nil {
 		return nil
 	}
+	if err := config.Discover(context.Background(), net.DefaultResolver); err != nil {
+		return nil
+	}
 
 	return config
 }
+
+// discoveryTimeout bounds the DNS lookups of discovering trust domains.
+const discoveryTimeout = 10 * time.Second
+
+// Discover looks up the address and keys of the trust domains configured by
+// DNS name, checking the keys against the fingerprints pinned for them.
+func (c *ClientConfig) Discover(ctx context.Context, resolver common.Resolver) error {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	for _, td := range c.TrustDomains {
+		if err := td.Discover(ctx, resolver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClientConfigFromBundle restores a client configuration whose common
+// configuration and trust domains come from a signed config bundle. The trust
+// domains of the client configuration pin the signing keys the bundle must be
+// signed with, by all of them. Intervals the client configuration leaves
+// unset are those of the bundle. Such a client follows no transition the
+// frontend announces, but takes up the generation in use once given a bundle
+// of its configuration.
+func ClientConfigFromBundle(file string, bundleFile string) (*ClientConfig, error) {
+	config := ClientConfigFromFile(file)
+	if config == nil {
+		return nil, fmt.Errorf("could not load client configuration %s", file)
+	}
+	bundle, err := common.ConfigBundleFromFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.Verify(config.TrustDomains); err != nil {
+		return nil, err
+	}
+
+	config.Config = &bundle.Config
+	config.TrustDomains = bundle.TrustDomains
+	config.signed = true
+	if config.WriteInterval == 0 {
+		config.WriteInterval = bundle.Config.WriteInterval
+	}
+	if config.ReadInterval == 0 {
+		config.ReadInterval = bundle.Config.ReadInterval
+	}
+	return config, nil
+}
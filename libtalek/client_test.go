@@ -1,6 +1,7 @@
 package libtalek
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"testing"
 	"time"
@@ -36,14 +37,19 @@ func (m *mockLeader) Read(args *common.EncodedReadArgs, reply *common.ReadReply)
 func (m *mockLeader) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpdatesReply) error {
 	return nil
 }
+func (m *mockLeader) GetCommitment(args *common.GetCommitmentArgs, reply *common.GetCommitmentReply) error {
+	return nil
+}
+func (m *mockLeader) IssueTokens(args *common.IssueTokensArgs, reply *common.IssueTokensReply) error {
+	return nil
+}
 
 func TestWrite(t *testing.T) {
 	config := ClientConfig{
-		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
-		time.Second,
-		time.Second,
-		[]*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
-		"",
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
 	}
 
 	writes := make(chan *common.WriteArgs, 1)
@@ -73,16 +79,45 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteTTL(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Millisecond,
+		ReadInterval:  time.Second,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+		MessageTTL:    3,
+	}
+
+	writes := make(chan *common.WriteArgs, 1)
+	leader := mockLeader{writes, nil}
+
+	c := NewClient("TestClient", config, &leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	handle, _ := NewTopic()
+	if err := c.Publish(handle, []byte("hello world")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	// Cover writes must carry the same hint as real ones.
+	for i := 0; i < 4; i++ {
+		if w := <-writes; w.TTL != 3 {
+			t.Fatalf("Write %d carried TTL %d rather than the configured hint.", i, w.TTL)
+		}
+	}
+	c.Kill()
+}
+
 func TestRead(t *testing.T) {
 	config := ClientConfig{
-		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
-		time.Second,
-		time.Second,
-		[]*common.TrustDomainConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains: []*common.TrustDomainConfig{
 			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
 			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
 		},
-		"",
 	}
 
 	reads := make(chan *common.EncodedReadArgs, 1)
@@ -126,3 +161,84 @@ func TestRead(t *testing.T) {
 		t.Fatalf("Read wasn't for the enqueued subscription. %v / %v / %d", rv1, rv2, bucket)
 	}
 }
+
+func TestPollAfterDone(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+	}
+	c := NewClient("TestPollAfterDone", config, &mockLeader{})
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer c.Kill()
+
+	topic, _ := NewTopic()
+	first := c.Poll(&topic.Handle)
+	if first == nil || c.Poll(&topic.Handle) != nil {
+		t.Fatal("A handle should only be polled once at a time.")
+	}
+	if !c.Done(&topic.Handle) || !topic.Handle.isDone() {
+		t.Fatal("Done should stop polling the handle.")
+	}
+	second := c.Poll(&topic.Handle)
+	if second == nil || second == first {
+		t.Fatal("A handle should be polled again on a new channel after Done.")
+	}
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	valid := func() *ClientConfig {
+		return &ClientConfig{
+			Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
+			WriteInterval: time.Second,
+			ReadInterval:  time.Second,
+			TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Valid config refused: %v", err)
+	}
+	for _, mutate := range []func(*ClientConfig){
+		func(c *ClientConfig) { c.WriteInterval = 0 },
+		func(c *ClientConfig) { c.DataSize = PublishingOverhead },
+		func(c *ClientConfig) { c.TrustDomains = nil },
+		func(c *ClientConfig) { c.TrustDomains[0].Address = "" },
+		func(c *ClientConfig) { c.TrustDomains[0] = &common.TrustDomainConfig{DNSName: "td.example"} },
+	} {
+		c := valid()
+		mutate(c)
+		if err, ok := c.Validate().(*common.ValidationError); !ok {
+			t.Fatalf("Invalid config should be refused, got %v", err)
+		}
+	}
+}
+
+func TestTrafficShape(t *testing.T) {
+	config := &ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, WriteInterval: time.Second, ReadInterval: time.Second},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+	}
+	if wait := config.readWait(rand.Reader); wait != time.Minute {
+		t.Fatalf("Unshaped client waited %v rather than its own interval.", wait)
+	}
+
+	// Shaped, the client's own intervals are ignored.
+	config.ShapeReads, config.ShapeWrites, config.ShapeJitter = 4, 2, 100*time.Millisecond
+	config.WriteInterval, config.ReadInterval = 0, 0
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Shaped client without intervals of its own refused: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if wait := config.readWait(rand.Reader); wait < 200*time.Millisecond || wait >= 300*time.Millisecond {
+			t.Fatalf("Shaped read waited %v, outside its jittered slot.", wait)
+		}
+		if wait := config.writeWait(rand.Reader); wait < 450*time.Millisecond || wait >= 550*time.Millisecond {
+			t.Fatalf("Shaped write waited %v, outside its jittered slot.", wait)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package libtalek
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// commitmentHistory is how many epochs of verified commitments a client keeps
+// to compare against those it fetches later.
+const commitmentHistory = 64
+
+// VerifyCommitment fetches the commitment to the epoch containing the write
+// with global sequence number seqNo, or to the latest epoch if seqNo is 0, and
+// checks that every trust domain signed the root the frontend committed to.
+// If write is provided, it must be the write made at seqNo, and its inclusion
+// in the epoch is checked as well. Until the epoch is committed, the error is
+// common.ErrNotCommitted.
+// Trust domains found to sign conflicting roots, in the fetched commitment or
+// compared to one fetched before, are reported as an EventEquivocation, and
+// the returned error is a *common.EquivocationError.
+func (c *Client) VerifyCommitment(seqNo uint64, write *common.WriteArgs) (*common.EpochCommitment, error) {
+	config := c.config.Load().(ClientConfig)
+	args := &common.GetCommitmentArgs{SeqNo: seqNo}
+	reply := &common.GetCommitmentReply{}
+	if err := c.leader.GetCommitment(args, reply); err != nil {
+		return nil, err
+	}
+	if reply.Err == common.ErrNotCommitted.Error() {
+		return nil, common.ErrNotCommitted
+	} else if reply.Err != "" {
+		return nil, errors.New(reply.Err)
+	}
+	commitment := &reply.Commitment
+
+	err := commitment.Verify(config.TrustDomains)
+	c.commitLock.Lock()
+	if previous, ok := c.commitments[commitment.Epoch]; ok && err == nil {
+		err = common.Equivocation(previous, commitment, config.TrustDomains)
+	} else if err == nil {
+		if c.commitments == nil {
+			c.commitments = make(map[uint64]*common.EpochCommitment)
+		}
+		c.commitments[commitment.Epoch] = commitment
+		delete(c.commitments, commitment.Epoch-commitmentHistory)
+	}
+	c.commitLock.Unlock()
+	if _, ok := err.(*common.EquivocationError); ok {
+		c.report(&Event{Kind: EventEquivocation, Err: err, TrustDomains: c.domainNames(err.(*common.EquivocationError).TrustDomains)})
+	}
+	if err != nil {
+		return commitment, err
+	}
+
+	if write != nil {
+		leafArgs := *write
+		leafArgs.GlobalSeqNo = seqNo
+		if !common.VerifyMerkleProof(common.WriteLeaf(&leafArgs), reply.Index, commitment.Size, reply.Proof, commitment.Root) {
+			return commitment, errors.New("write is not included in the commitment")
+		}
+	}
+	return commitment, nil
+}
+
+// PublishSync publishes a message to the end of a topic, as Publish does, and
+// then blocks until each write of it is in an epoch the frontend committed to
+// and every trust domain signed, for request/response applications which must
+// know a message can be read before waiting on the response. If ctx is done
+// first, it returns ctx.Err(), and the message may yet be published.
+func (c *Client) PublishSync(ctx context.Context, handle *Topic, data []byte) error {
+	writes, err := c.publish(handle, data, true)
+	if err != nil {
+		return err
+	}
+	seqNos := make([]uint64, len(writes))
+	for i, write := range writes {
+		select {
+		case reply := <-write.ReplyChan:
+			if reply.Err != "" {
+				return writeError(reply.Err)
+			}
+			seqNos[i] = reply.GlobalSeqNo
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Epochs are committed every write interval of the deployment.
+	config := c.config.Load().(ClientConfig)
+	interval := config.Config.WriteInterval
+	if interval <= 0 {
+		interval = config.WriteInterval
+	}
+	for i, write := range writes {
+		for {
+			_, err := c.VerifyCommitment(seqNos[i], write)
+			if err == nil {
+				break
+			} else if err != common.ErrNotCommitted {
+				return err
+			}
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// verifyRead checks the reply to a poll against the commitments of the trust
+// domains to their buckets, when the deployment makes them. Cover reads are
+// of no one bucket, and their replies are dropped unverified.
+func (c *Client) verifyRead(args *common.ReadArgs, reply *common.ReadReply, config *ClientConfig) error {
+	if !config.VerifyBuckets {
+		return nil
+	}
+	bucket := args.Bucket()
+	if bucket < 0 {
+		return errors.New("read is not of a single bucket")
+	}
+	pad, err := common.NewPad(args.PadAlgorithm)
+	if err != nil {
+		return err
+	}
+	// Pads are removed from copies, leaving the reply for the handle to open.
+	data := append([]byte(nil), reply.Data...)
+	proof := append([]byte(nil), reply.Proof...)
+	for i := range args.TD {
+		if err := common.PadReply(pad, args.TD[i].PadSeed, data, proof); err != nil {
+			return err
+		}
+	}
+	return common.VerifyBucket(uint64(bucket), config.NumBuckets, data, proof, reply.Buckets, config.TrustDomains)
+}
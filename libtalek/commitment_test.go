@@ -0,0 +1,157 @@
+package libtalek
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// committingLeader serves a prepared commitment for every request.
+type committingLeader struct {
+	mockLeader
+	reply common.GetCommitmentReply
+}
+
+func (l *committingLeader) GetCommitment(args *common.GetCommitmentArgs, reply *common.GetCommitmentReply) error {
+	*reply = l.reply
+	return nil
+}
+
+func signedCommitment(tds []*common.TrustDomainConfig, epoch uint64, leaves [][32]byte) common.EpochCommitment {
+	c := common.EpochCommitment{Epoch: epoch, Root: common.MerkleRoot(leaves), Size: uint64(len(leaves))}
+	c.SeqNos = common.Range{Start: 1, End: 1 + c.Size}
+	for _, td := range tds {
+		c.Replicas = append(c.Replicas, td.SignRoot(epoch, c.Root, c.Size))
+	}
+	return c
+}
+
+func TestVerifyCommitment(t *testing.T) {
+	tds := []*common.TrustDomainConfig{
+		common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+		common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+	}
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains:  tds,
+	}
+	leader := &committingLeader{}
+	c := NewClient("TestVerifyCommitment", config, leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer c.Kill()
+
+	writes := []*common.WriteArgs{{GlobalSeqNo: 1, Data: []byte("a")}, {GlobalSeqNo: 2, Data: []byte("b")}}
+	leaves := [][32]byte{common.WriteLeaf(writes[0]), common.WriteLeaf(writes[1])}
+	leader.reply.Commitment = signedCommitment(tds, 7, leaves)
+	leader.reply.Index = 1
+	leader.reply.Proof = common.MerkleProof(leaves, 1)
+
+	mine := &common.WriteArgs{Data: []byte("b")}
+	if _, err := c.VerifyCommitment(2, mine); err != nil {
+		t.Fatalf("Commitment including the write failed to verify: %v", err)
+	}
+	if _, err := c.VerifyCommitment(2, &common.WriteArgs{Data: []byte("c")}); err == nil {
+		t.Fatal("A write not in the commitment should not verify.")
+	}
+
+	// A different root for the same epoch, fetched later, proves equivocation.
+	leader.reply.Commitment = signedCommitment(tds, 7, leaves[:1])
+	leader.reply.Index = 0
+	leader.reply.Proof = nil
+	_, err := c.VerifyCommitment(1, nil)
+	if _, ok := err.(*common.EquivocationError); !ok {
+		t.Fatalf("Expected equivocation, got %v", err)
+	}
+	e := nextEvent(t, c.Events(), EventEquivocation)
+	if len(e.TrustDomains) != 2 {
+		t.Fatalf("Equivocation not attributed to the trust domains: %v", e)
+	}
+}
+
+// sequencingLeader sequences writes, and commits to those made so far in
+// epoch 1 once told to.
+type sequencingLeader struct {
+	mockLeader
+	tds       []*common.TrustDomainConfig
+	mu        sync.Mutex
+	leaves    [][32]byte
+	committed [][32]byte
+}
+
+func (l *sequencingLeader) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	write := *args
+	write.GlobalSeqNo = uint64(len(l.leaves) + 1)
+	l.leaves = append(l.leaves, common.WriteLeaf(&write))
+	reply.GlobalSeqNo = write.GlobalSeqNo
+	return nil
+}
+
+func (l *sequencingLeader) GetCommitment(args *common.GetCommitmentArgs, reply *common.GetCommitmentReply) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if args.SeqNo == 0 || args.SeqNo > uint64(len(l.committed)) {
+		reply.Err = common.ErrNotCommitted.Error()
+		return nil
+	}
+	reply.Commitment = signedCommitment(l.tds, 1, l.committed)
+	reply.Index = args.SeqNo - 1
+	reply.Proof = common.MerkleProof(l.committed, int(reply.Index))
+	return nil
+}
+
+func (l *sequencingLeader) commit() {
+	l.mu.Lock()
+	l.committed = append([][32]byte(nil), l.leaves...)
+	l.mu.Unlock()
+}
+
+func TestPublishSync(t *testing.T) {
+	tds := []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false)}
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: 10 * time.Millisecond,
+		ReadInterval:  time.Second,
+		TrustDomains:  tds,
+	}
+	leader := &sequencingLeader{tds: tds}
+	c := NewClient("TestPublishSync", config, leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer c.Kill()
+	topic, _ := NewTopic()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.PublishSync(ctx, topic, []byte("unconfirmed")); err != context.DeadlineExceeded {
+		t.Fatalf("Expected publishing to time out before its epoch is committed, got %v.", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.PublishSync(context.Background(), topic, []byte("confirmed"))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Publishing returned before its epoch was committed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	leader.commit()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Publishing failed to confirm: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing did not return once its epoch was committed.")
+	}
+}
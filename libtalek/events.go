@@ -0,0 +1,191 @@
+package libtalek
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// EventKind classifies the events a Client reports.
+type EventKind int
+
+// Kinds of client events.
+const (
+	// EventWriteFailed is reported when a write, real or cover, is not accepted.
+	EventWriteFailed EventKind = iota
+	// EventReadFailed is reported when a read is not answered. Polled handles
+	// do not advance on a failed read, so this is a lost poll, not lost data.
+	EventReadFailed
+	// EventUpdateFailed is reported when the global interest vector can't be fetched.
+	EventUpdateFailed
+	// EventDecodeFailed is reported when a response can't be decoded, such as
+	// when trust domain padding can't be removed.
+	EventDecodeFailed
+	// EventEpochSkew is reported when the frontend answers from a point in the
+	// global sequence more than a window behind what the client has already seen,
+	// as happens when talking to a lagging or restarted frontend.
+	EventEpochSkew
+	// EventRecovered is reported on the first successful request following failures.
+	EventRecovered
+	// EventReplay is a security event, reported when a server re-serves an item
+	// a polled handle already accepted at an earlier position. The item is not
+	// delivered again.
+	EventReplay
+	// EventEquivocation is a security event, reported when trust domains are
+	// found to have signed conflicting commitments to the writes of an epoch.
+	// Err is a *common.EquivocationError.
+	EventEquivocation
+	// EventBackoff is reported when the frontend is overloaded and asks the
+	// client to wait. The client shifts its schedule accordingly, and retries
+	// a turned away write, rather than reporting a failure.
+	EventBackoff
+	// EventUnverified is a security event, reported when a read doesn't match
+	// the commitments of trust domains to their buckets, as when one serves
+	// stale or fabricated buckets. The read is not delivered.
+	EventUnverified
+	// EventReconfigured is reported when the client moves to the next
+	// generation of the configuration, as a transition staged at the frontend
+	// begins.
+	EventReconfigured
+	// EventCatchingUp is reported as a handle far behind its log is caught up,
+	// with the client reading faster, and for each item read meanwhile.
+	EventCatchingUp
+	// EventCaughtUp is reported when a handle being caught up reaches the end
+	// of its log, and the client returns to its usual rate.
+	EventCaughtUp
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventWriteFailed:
+		return "write failed"
+	case EventReadFailed:
+		return "read failed"
+	case EventUpdateFailed:
+		return "update failed"
+	case EventDecodeFailed:
+		return "decode failed"
+	case EventEpochSkew:
+		return "epoch skew"
+	case EventRecovered:
+		return "recovered"
+	case EventReplay:
+		return "replay"
+	case EventEquivocation:
+		return "equivocation"
+	case EventBackoff:
+		return "backoff"
+	case EventUnverified:
+		return "unverified"
+	case EventReconfigured:
+		return "reconfigured"
+	case EventCatchingUp:
+		return "catching up"
+	case EventCaughtUp:
+		return "caught up"
+	}
+	return fmt.Sprintf("event %d", int(k))
+}
+
+// eventBacklog is how many events are kept for a slow reader before new
+// events are dropped.
+const eventBacklog = 64
+
+// Event describes a failure or change in health observed by a Client.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	Err  error
+	// Names of the trust domains the failure is attributed to, if known.
+	TrustDomains []string
+	// The handle a read was made for, if the event concerns a poll.
+	Handle *Handle
+	// For catch up events, items read of the handle since it was taken as
+	// far behind.
+	Read uint64
+}
+
+func (e *Event) String() string {
+	desc := e.Kind.String()
+	if len(e.TrustDomains) > 0 {
+		desc += fmt.Sprintf(" at %v", e.TrustDomains)
+	}
+	if e.Err != nil {
+		desc += ": " + e.Err.Error()
+	}
+	return desc
+}
+
+// Events returns the channel on which the client reports failures and
+// recovery, so applications can show the state of their connection. The
+// channel is buffered, and events are dropped rather than delaying requests
+// when it is not read.
+func (c *Client) Events() <-chan *Event {
+	return c.events
+}
+
+// Healthy reports whether the most recent request to the frontend succeeded.
+func (c *Client) Healthy() bool {
+	return atomic.LoadInt32(&c.failing) == 0
+}
+
+// report delivers an event without blocking.
+func (c *Client) report(e *Event) {
+	e.Time = time.Now()
+	if c.Verbose {
+		c.log.Log(common.LevelWarn, e.String())
+	}
+	select {
+	case c.events <- e:
+	default:
+	}
+}
+
+// failed reports a failed request and marks the client unhealthy.
+func (c *Client) failed(kind EventKind, err error, domains []int, handle *Handle) {
+	atomic.StoreInt32(&c.failing, 1)
+	c.report(&Event{Kind: kind, Err: err, TrustDomains: c.domainNames(domains), Handle: handle})
+}
+
+// succeeded notes a successful request, reporting recovery from earlier failures.
+func (c *Client) succeeded() {
+	if atomic.CompareAndSwapInt32(&c.failing, 1, 0) {
+		c.report(&Event{Kind: EventRecovered})
+	}
+}
+
+// observeSeqNo tracks the latest global sequence number seen in replies, and
+// reports replies from a point further back than the window of live items.
+func (c *Client) observeSeqNo(seqNo uint64, window uint64) {
+	for {
+		last := atomic.LoadUint64(&c.lastSeqNo)
+		if seqNo <= last {
+			if last-seqNo > window {
+				c.report(&Event{Kind: EventEpochSkew,
+					Err: fmt.Errorf("frontend at sequence %d, previously seen %d", seqNo, last)})
+			}
+			return
+		}
+		if atomic.CompareAndSwapUint64(&c.lastSeqNo, last, seqNo) {
+			return
+		}
+	}
+}
+
+func (c *Client) domainNames(domains []int) []string {
+	if len(domains) == 0 {
+		return nil
+	}
+	config := c.config.Load().(ClientConfig)
+	names := make([]string, 0, len(domains))
+	for _, i := range domains {
+		if i >= 0 && i < len(config.TrustDomains) && config.TrustDomains[i] != nil {
+			names = append(names, config.TrustDomains[i].Name)
+		} else {
+			names = append(names, fmt.Sprintf("#%d", i))
+		}
+	}
+	return names
+}
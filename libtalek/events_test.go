@@ -0,0 +1,283 @@
+package libtalek
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// flakyLeader fails writes at a trust domain until healed, and answers reads
+// from far behind in the global sequence.
+type flakyLeader struct {
+	mockLeader
+	healed int32
+}
+
+func (f *flakyLeader) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	if atomic.LoadInt32(&f.healed) == 0 {
+		reply.Err = "replica unavailable"
+		reply.FailedDomains = []int{1}
+		return nil
+	}
+	reply.GlobalSeqNo = 1000
+	return nil
+}
+
+func (f *flakyLeader) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	if atomic.LoadInt32(&f.healed) == 0 {
+		return errors.New("connection refused")
+	}
+	reply.GlobalSeqNo = common.Range{Start: 1, End: 2}
+	return nil
+}
+
+func nextEvent(t *testing.T, events <-chan *Event, kind EventKind) *Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %v event reported.", kind)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Millisecond,
+		ReadInterval:  time.Millisecond,
+		TrustDomains: []*common.TrustDomainConfig{
+			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+		},
+	}
+	leader := &flakyLeader{}
+	c := NewClient("TestEvents", config, leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer c.Kill()
+
+	write := nextEvent(t, c.Events(), EventWriteFailed)
+	if len(write.TrustDomains) != 1 || write.TrustDomains[0] != "TestTrustDomain1" {
+		t.Fatalf("Write failure not attributed to its trust domain: %v", write)
+	}
+	read := nextEvent(t, c.Events(), EventReadFailed)
+	if read.Err == nil || read.Err.Error() != "connection refused" {
+		t.Fatalf("Read failure missing its cause: %v", read)
+	}
+	if c.Healthy() {
+		t.Fatal("Client should not be healthy while requests fail.")
+	}
+
+	atomic.StoreInt32(&leader.healed, 1)
+	nextEvent(t, c.Events(), EventRecovered)
+	// Reads now answer from before the window of items the writes have seen.
+	nextEvent(t, c.Events(), EventEpochSkew)
+}
+
+// busyLeader turns away the first write it is sent.
+type busyLeader struct {
+	mockLeader
+	writes int32
+}
+
+func (b *busyLeader) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	if atomic.AddInt32(&b.writes, 1) == 1 {
+		reply.Err = "frontend is overloaded"
+		reply.RetryAfter = 50 * time.Millisecond
+		return nil
+	}
+	return b.mockLeader.Write(args, reply)
+}
+
+func TestBackoff(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Millisecond,
+		ReadInterval:  time.Millisecond,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+	}
+	writes := make(chan *common.WriteArgs, 16)
+	leader := &busyLeader{mockLeader: mockLeader{ReceivedWrites: writes}}
+	c := NewClient("TestClient", config, leader)
+	defer c.Kill()
+	events := c.Events()
+
+	handle, _ := NewTopic()
+	bucket, _ := handle.Handle.nextBuckets(config.Config)
+	if err := c.Publish(handle, []byte("hello world")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	e := nextEvent(t, events, EventBackoff)
+	if e.Err == nil {
+		t.Fatal("Backoff should carry the frontend's error.")
+	}
+
+	// Whether the turned away write was cover or the published one, no write
+	// is made before the frontend asked.
+	for w := range writes {
+		if w.Bucket1 == bucket {
+			break
+		}
+	}
+	if time.Since(e.Time) < 40*time.Millisecond {
+		t.Fatal("The write was retried before the frontend asked.")
+	}
+	c.Flush()
+	if !c.Healthy() {
+		t.Fatal("Backing off is not a failure.")
+	}
+}
+
+// puzzleLeader asks every write to solve a puzzle.
+type puzzleLeader struct {
+	mockLeader
+	puzzle   common.Puzzle
+	rejected int32
+}
+
+func (p *puzzleLeader) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	reply.Puzzle = &p.puzzle
+	if _, ok := p.puzzle.Verify(args); !ok {
+		atomic.AddInt32(&p.rejected, 1)
+		reply.Err = common.ErrPuzzleRequired.Error()
+		return nil
+	}
+	return p.mockLeader.Write(args, reply)
+}
+
+func TestPuzzle(t *testing.T) {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Millisecond,
+		ReadInterval:  time.Millisecond,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+	}
+	writes := make(chan *common.WriteArgs, 16)
+	leader := &puzzleLeader{mockLeader: mockLeader{ReceivedWrites: writes}}
+	leader.puzzle = common.Puzzle{Seed: []byte("seed"), Difficulty: 8}
+	c := NewClient("TestClient", config, leader)
+	defer c.Kill()
+
+	handle, _ := NewTopic()
+	bucket, _ := handle.Handle.nextBuckets(config.Config)
+	if err := c.Publish(handle, []byte("hello world")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	for w := range writes {
+		if w.Bucket1 == bucket {
+			break
+		}
+	}
+	c.Flush()
+	// Only the first write, made before the client knew the puzzle, is
+	// turned away.
+	if n := atomic.LoadInt32(&leader.rejected); n != 1 {
+		t.Fatalf("%d writes were turned away", n)
+	}
+	if !c.Healthy() {
+		t.Fatal("Solving puzzles is not a failure.")
+	}
+}
+
+// tokenLeader asks every write to spend a token it issued.
+type tokenLeader struct {
+	mockLeader
+	signer *common.TokenSigner
+	mu     sync.Mutex
+	spent  map[[32]byte]bool
+	issued int
+}
+
+func (l *tokenLeader) IssueTokens(args *common.IssueTokensArgs, reply *common.IssueTokensReply) error {
+	reply.Key = l.signer.Key()
+	for _, b := range args.Blinded {
+		sig, err := l.signer.SignBlinded(b)
+		if err != nil {
+			return err
+		}
+		reply.Signatures = append(reply.Signatures, sig)
+	}
+	l.mu.Lock()
+	l.issued += len(args.Blinded)
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *tokenLeader) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	l.mu.Lock()
+	ok := args.Token != nil && l.signer.Key().Verify(args.Token) && !l.spent[args.Token.Nonce]
+	if ok {
+		l.spent[args.Token.Nonce] = true
+	}
+	l.mu.Unlock()
+	if !ok {
+		reply.Err = common.ErrTokenRequired.Error()
+		return nil
+	}
+	return l.mockLeader.Write(args, reply)
+}
+
+func TestWriteTokens(t *testing.T) {
+	signer, err := common.NewTokenSigner(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Millisecond,
+		ReadInterval:  time.Second,
+		TrustDomains:  []*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+		TokenAccount:  "account",
+		TokenKeys:     []*common.TokenKey{signer.Key()},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Valid config refused: %v", err)
+	}
+	writes := make(chan *common.WriteArgs, 1)
+	leader := &tokenLeader{mockLeader: mockLeader{ReceivedWrites: writes}, signer: signer, spent: make(map[[32]byte]bool)}
+	c := NewClient("TestClient", config, leader)
+	defer c.Kill()
+
+	// Cover writes spend tokens as well as real ones, each its own.
+	handle, _ := NewTopic()
+	if err := c.Publish(handle, []byte("hello world")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	for i := 0; i < tokenBatch+2; i++ {
+		<-writes
+	}
+	c.Flush()
+	if !c.Healthy() {
+		t.Fatal("Writes with tokens failed.")
+	}
+	leader.mu.Lock()
+	if leader.issued < tokenBatch+2 || len(leader.spent) < tokenBatch+2 {
+		t.Fatalf("%d tokens issued and %d spent for %d writes", leader.issued, len(leader.spent), tokenBatch+2)
+	}
+	leader.mu.Unlock()
+
+	// Tokens of a key that is not pinned are not taken.
+	other, err := common.NewTokenSigner(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned := newClient("TestClient", config, &tokenLeader{signer: other, spent: make(map[[32]byte]bool)})
+	if err := unpinned.issueTokens("account"); err == nil || len(unpinned.tokens) != 0 {
+		t.Fatal("Tokens of a key that is not pinned were taken.")
+	}
+	config.TokenKeys = nil
+	if err := config.Validate(); err == nil {
+		t.Fatal("Token account without pinned keys was accepted.")
+	}
+}
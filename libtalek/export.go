@@ -0,0 +1,223 @@
+package libtalek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/securemem"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Kinds of exported keys, as the types of their armor. Exports are PEM blocks,
+// so they can be pasted between devices, or printed and kept offline.
+const (
+	ArmorTopic       = "TALEK TOPIC"
+	ArmorHandle      = "TALEK HANDLE"
+	ArmorTrustDomain = "TALEK TRUST DOMAIN"
+)
+
+// exportVersion is the version of the export format.
+const exportVersion = "1"
+
+// maxExportScryptN bounds the scrypt cost an export may ask of its importer.
+const maxExportScryptN = 1 << 20
+
+// ErrWrongPassphrase is returned when an export can't be authenticated,
+// either because the passphrase is wrong or the export was modified.
+var ErrWrongPassphrase = errors.New("export could not be decrypted")
+
+// SealExport encrypts key material of a kind under a passphrase, and armors
+// it. The key is derived with scrypt, and the material sealed with NaCl
+// secretbox, along with its kind, so one kind can't be passed off as another.
+func SealExport(kind string, plaintext []byte, passphrase []byte) ([]byte, error) {
+	var salt [saltLength]byte
+	var nonce [24]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key, err := exportKey(passphrase, salt[:], scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Free(key[:])
+
+	message := make([]byte, 0, len(kind)+1+len(plaintext))
+	message = append(append(append(message, kind...), 0), plaintext...)
+	defer securemem.Wipe(message)
+	block := &pem.Block{
+		Type: kind,
+		Headers: map[string]string{
+			"Version": exportVersion,
+			"Scrypt":  fmt.Sprintf("%d,%d,%d", scryptN, scryptR, scryptP),
+			"Salt":    base64.StdEncoding.EncodeToString(salt[:]),
+			"Nonce":   base64.StdEncoding.EncodeToString(nonce[:]),
+		},
+		Bytes: secretbox.Seal(nil, message, &nonce, key),
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// OpenExport decrypts armored key material with a passphrase, returning its
+// kind.
+func OpenExport(armored []byte, passphrase []byte) (string, []byte, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil {
+		return "", nil, errors.New("no armored key found")
+	}
+	if v := block.Headers["Version"]; v != exportVersion {
+		return "", nil, fmt.Errorf("unsupported export version %q", v)
+	}
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["Scrypt"], "%d,%d,%d", &n, &r, &p); err != nil {
+		return "", nil, fmt.Errorf("invalid scrypt parameters: %v", err)
+	}
+	if n <= 1 || n > maxExportScryptN || r <= 0 || p <= 0 || r*p >= 1<<30/128 {
+		return "", nil, fmt.Errorf("scrypt parameters %d,%d,%d are out of range", n, r, p)
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	nonceBytes, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonceBytes) != 24 {
+		return "", nil, errors.New("invalid nonce")
+	}
+	var nonce [24]byte
+	copy(nonce[:], nonceBytes)
+
+	key, err := exportKey(passphrase, salt, n, r, p)
+	if err != nil {
+		return "", nil, err
+	}
+	defer securemem.Free(key[:])
+	message, ok := secretbox.Open(nil, block.Bytes, &nonce, key)
+	if !ok {
+		return "", nil, ErrWrongPassphrase
+	}
+	kind := block.Type
+	if len(message) < len(kind)+1 || string(message[:len(kind)]) != kind || message[len(kind)] != 0 {
+		securemem.Wipe(message)
+		return "", nil, ErrWrongPassphrase
+	}
+	return kind, message[len(kind)+1:], nil
+}
+
+// IsExport reports whether data is armored key material.
+func IsExport(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN TALEK "))
+}
+
+// ExportTopic encrypts and armors a topic under a passphrase.
+func ExportTopic(t *Topic, passphrase []byte) ([]byte, error) {
+	txt, err := t.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(txt)
+	return SealExport(ArmorTopic, txt, passphrase)
+}
+
+// ImportTopic restores a topic exported with ExportTopic.
+func ImportTopic(armored []byte, passphrase []byte) (*Topic, error) {
+	txt, err := openKind(armored, passphrase, ArmorTopic)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(txt)
+	t := &Topic{}
+	if err := t.UnmarshalText(txt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ExportHandle encrypts and armors a handle under a passphrase.
+func ExportHandle(h *Handle, passphrase []byte) ([]byte, error) {
+	txt, err := h.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(txt)
+	return SealExport(ArmorHandle, txt, passphrase)
+}
+
+// ImportHandle restores a handle exported with ExportHandle.
+func ImportHandle(armored []byte, passphrase []byte) (*Handle, error) {
+	txt, err := openKind(armored, passphrase, ArmorHandle)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(txt)
+	h := &Handle{}
+	if err := h.UnmarshalText(txt); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ExportTrustDomain encrypts and armors a trust domain, with its private keys,
+// under a passphrase.
+func ExportTrustDomain(td *common.TrustDomainConfig, passphrase []byte) ([]byte, error) {
+	private := td.Private()
+	if private.PrivateKey == [32]byte{} || private.SignPrivateKey == [64]byte{} {
+		return nil, errors.New("trust domain has no private keys")
+	}
+	dat, err := json.Marshal(private)
+	securemem.Wipe(private.PrivateKey[:])
+	securemem.Wipe(private.SignPrivateKey[:])
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(dat)
+	return SealExport(ArmorTrustDomain, dat, passphrase)
+}
+
+// ImportTrustDomain restores a trust domain exported with ExportTrustDomain.
+func ImportTrustDomain(armored []byte, passphrase []byte) (*common.TrustDomainConfig, error) {
+	dat, err := openKind(armored, passphrase, ArmorTrustDomain)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(dat)
+	td := &common.TrustDomainConfig{}
+	if err := td.UnmarshalJSON(dat); err != nil {
+		return nil, err
+	}
+	return td, nil
+}
+
+/** PRIVATE METHODS **/
+
+// openKind opens an export, which must be of kind.
+func openKind(armored []byte, passphrase []byte, kind string) ([]byte, error) {
+	found, plaintext, err := OpenExport(armored, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if found != kind {
+		securemem.Wipe(plaintext)
+		return nil, fmt.Errorf("export is a %s, not a %s", found, kind)
+	}
+	return plaintext, nil
+}
+
+func exportKey(passphrase []byte, salt []byte, n, r, p int) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	key := securemem.Key32()
+	copy(key[:], derived)
+	securemem.Wipe(derived)
+	return key, nil
+}
@@ -0,0 +1,67 @@
+package libtalek
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestExportTopic(t *testing.T) {
+	topic, err := NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := ExportTopic(topic, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsExport(armored) || !strings.Contains(string(armored), "BEGIN "+ArmorTopic) {
+		t.Fatalf("Export is not armored: %s", armored)
+	}
+	txt, _ := topic.MarshalText()
+	if bytes.Contains(armored, txt[:16]) {
+		t.Fatal("Export carries the topic in plaintext.")
+	}
+
+	restored, err := ImportTopic(armored, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if *restored.SigningPrivateKey != *topic.SigningPrivateKey || !Equal(&restored.Handle, &topic.Handle) {
+		t.Fatal("Imported topic differs from the exported one.")
+	}
+	if _, err := ImportTopic(armored, []byte("hunter3")); err != ErrWrongPassphrase {
+		t.Fatalf("Imported with the wrong passphrase: %v", err)
+	}
+	if _, err := ImportHandle(armored, []byte("hunter2")); err == nil {
+		t.Fatal("A topic was imported as a handle.")
+	}
+
+	// The kind of an export is authenticated along with it.
+	relabeled := bytes.Replace(armored, []byte(ArmorTopic), []byte(ArmorHandle), -1)
+	if _, err := ImportHandle(relabeled, []byte("hunter2")); err != ErrWrongPassphrase {
+		t.Fatalf("A relabeled export was imported: %v", err)
+	}
+}
+
+func TestExportTrustDomain(t *testing.T) {
+	td := common.NewTrustDomainConfig("td", "localhost:9000", true, false)
+	armored, err := ExportTrustDomain(td, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ImportTrustDomain(armored, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if restored.Name != td.Name || restored.Private().SignPrivateKey != td.Private().SignPrivateKey {
+		t.Fatal("Imported trust domain differs from the exported one.")
+	}
+
+	public := &common.TrustDomainConfig{Name: "public"}
+	if _, err := ExportTrustDomain(public, []byte("hunter2")); err == nil {
+		t.Fatal("Exported a trust domain without private keys.")
+	}
+}
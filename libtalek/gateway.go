@@ -0,0 +1,375 @@
+package libtalek
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of a letter submitted to a gateway.
+const (
+	GatewayQueued    = "queued"
+	GatewayDelivered = "delivered"
+	GatewayBounced   = "bounced"
+)
+
+// Reasons a letter bounces.
+const (
+	BounceExpired = "expired in queue"
+	BounceRemoved = "recipient removed"
+	BouncePublish = "could not be published"
+)
+
+// ErrUnknownRecipient is returned when a gateway has no mailbox for a
+// recipient.
+var ErrUnknownRecipient = errors.New("gateway has no such recipient")
+
+// ErrQueueFull is returned when a recipient already has as many letters
+// queued as a gateway holds, until some are delivered.
+var ErrQueueFull = errors.New("queue of recipient is full")
+
+// ErrUnknownLetter is returned for the status of a letter a gateway doesn't
+// know, or has forgotten.
+var ErrUnknownLetter = errors.New("gateway has no such letter")
+
+// GatewayStatus is the progress of a letter submitted to a gateway.
+type GatewayStatus struct {
+	State  string
+	Reason string `json:",omitempty"` // Why the letter bounced
+	Time   time.Time
+}
+
+// GatewayBounce is the content of a LetterBounce.
+type GatewayBounce struct {
+	ID     string
+	To     string
+	Reason string
+}
+
+// Gateway stores letters for the mailboxes of recipients who may be offline,
+// and forwards them when they have room. Each recipient issues the gateway a
+// stub of their mailbox, and anyone may submit letters for them. A
+// recipient's lane is only given as many letters within a Lifetime as it can
+// hold while they are offline, so that none expire before being read, and
+// the others wait in the gateway's queue. Letters waiting longer than MaxAge
+// bounce: their sender can see so in the status of the letter, and receives
+// a LetterBounce if they submitted a stub of their own mailbox with it.
+// Recipients, queues and statuses are saved in a Store after every change,
+// so a restarted gateway continues where it stopped.
+type Gateway struct {
+	// MaxQueue is how many letters may wait for a recipient. 0 is unlimited.
+	MaxQueue int
+	// MaxAge is how long a letter may wait before it bounces. 0 waits forever.
+	MaxAge time.Duration
+	// Window letters are forwarded to a recipient within each Lifetime, which
+	// should be the MessageTTL of the client. A zero Window is unlimited.
+	Window   int
+	Lifetime time.Duration
+	// Interval is how often the queues are forwarded by Run.
+	Interval time.Duration
+
+	mu         sync.Mutex
+	name       string
+	store      Store
+	transport  topicTransport
+	recipients map[string]*MailboxStub
+	queues     map[string][]*gatewayLetter
+	sent       map[string][]time.Time
+	statuses   map[string]*GatewayStatus
+	stop       chan struct{}
+}
+
+// NewGateway creates a gateway which publishes through a client, restoring
+// any recipients and letters previously saved in store under name.
+func NewGateway(c *Client, store Store, name string) (*Gateway, error) {
+	return newGateway(c, store, name)
+}
+
+// AddRecipient gives a gateway the stub of a recipient's mailbox, replacing
+// any previous one.
+func (g *Gateway) AddRecipient(name string, stub *MailboxStub) error {
+	if name == "" || stub == nil || stub.Topic == nil || stub.Name == "" {
+		return errors.New("recipients must be named, with a contact stub")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.recipients[name] = stub
+	return g.save()
+}
+
+// RemoveRecipient forgets a recipient, bouncing the letters queued for them.
+func (g *Gateway) RemoveRecipient(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.recipients[name]; !ok {
+		return ErrUnknownRecipient
+	}
+	for _, l := range g.queues[name] {
+		g.bounce(l, BounceRemoved, time.Now())
+	}
+	delete(g.recipients, name)
+	delete(g.queues, name)
+	delete(g.sent, name)
+	return g.save()
+}
+
+// Recipients returns the names of the recipients of the gateway, sorted.
+func (g *Gateway) Recipients() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	names := make([]string, 0, len(g.recipients))
+	for name := range g.recipients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Submit queues a letter from a sender to a recipient, returning the ID its
+// status is kept under. Bounces are deposited through the optional stub.
+func (g *Gateway) Submit(to string, from string, data []byte, bounce *MailboxStub) (string, error) {
+	if len(from) > 255 {
+		return "", errors.New("sender name too long")
+	}
+	if bounce != nil && (bounce.Topic == nil || bounce.Name == "") {
+		return "", errors.New("bounces are deposited through a contact stub")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.recipients[to]; !ok {
+		return "", ErrUnknownRecipient
+	}
+	if g.MaxQueue > 0 && len(g.queues[to]) >= g.MaxQueue {
+		return "", ErrQueueFull
+	}
+	now := time.Now()
+	l := &gatewayLetter{hex.EncodeToString(id), to, from, data, now, bounce}
+	g.queues[to] = append(g.queues[to], l)
+	g.statuses[l.ID] = &GatewayStatus{State: GatewayQueued, Time: now}
+	if err := g.save(); err != nil {
+		g.queues[to] = g.queues[to][:len(g.queues[to])-1]
+		delete(g.statuses, l.ID)
+		return "", err
+	}
+	return l.ID, nil
+}
+
+// Status returns the progress of a submitted letter. Statuses of letters
+// delivered or bounced are kept for a Lifetime.
+func (g *Gateway) Status(id string) (*GatewayStatus, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status, ok := g.statuses[id]
+	if !ok {
+		return nil, ErrUnknownLetter
+	}
+	copied := *status
+	return &copied, nil
+}
+
+// Queued returns how many letters wait for a recipient.
+func (g *Gateway) Queued(to string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.queues[to])
+}
+
+// Run forwards queued letters every Interval until Stop is called.
+func (g *Gateway) Run() {
+	g.mu.Lock()
+	if g.stop != nil {
+		g.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	g.stop = stop
+	interval := g.Interval
+	g.mu.Unlock()
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g.forward(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run.
+func (g *Gateway) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stop == nil {
+		return
+	}
+	close(g.stop)
+	g.stop = nil
+}
+
+// Forwarded returns the sender and content of a LetterForwarded.
+func (l *Letter) Forwarded() (string, []byte, error) {
+	if l.Kind != LetterForwarded || len(l.Data) < 1 || len(l.Data) < 1+int(l.Data[0]) {
+		return "", nil, errors.New("not a forwarded letter")
+	}
+	return string(l.Data[1 : 1+l.Data[0]]), l.Data[1+l.Data[0]:], nil
+}
+
+// Bounce returns the content of a LetterBounce.
+func (l *Letter) Bounce() (*GatewayBounce, error) {
+	if l.Kind != LetterBounce {
+		return nil, errors.New("not a bounce")
+	}
+	bounce := &GatewayBounce{}
+	if err := json.Unmarshal(l.Data, bounce); err != nil {
+		return nil, err
+	}
+	return bounce, nil
+}
+
+/** PRIVATE METHODS **/
+
+// gatewayLetter is a letter waiting in the queue of a recipient.
+type gatewayLetter struct {
+	ID        string
+	To        string
+	From      string
+	Data      []byte
+	Submitted time.Time
+	Bounce    *MailboxStub `json:",omitempty"`
+}
+
+type savedGateway struct {
+	Recipients map[string]*MailboxStub
+	Queues     map[string][]*gatewayLetter
+	Sent       map[string][]time.Time
+	Statuses   map[string]*GatewayStatus
+}
+
+func newGateway(transport topicTransport, store Store, name string) (*Gateway, error) {
+	g := &Gateway{
+		Interval:   time.Second,
+		name:       name,
+		store:      store,
+		transport:  transport,
+		recipients: make(map[string]*MailboxStub),
+		queues:     make(map[string][]*gatewayLetter),
+		sent:       make(map[string][]time.Time),
+		statuses:   make(map[string]*GatewayStatus),
+	}
+	dat, err := store.Get(name)
+	if err == ErrNotFound {
+		return g, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved savedGateway
+	if err = json.Unmarshal(dat, &saved); err != nil {
+		return nil, fmt.Errorf("invalid saved gateway: %v", err)
+	}
+	for to, stub := range saved.Recipients {
+		if stub == nil || stub.Topic == nil {
+			return nil, fmt.Errorf("invalid saved gateway: recipient %s has no stub", to)
+		}
+		g.recipients[to] = stub
+	}
+	for to, queue := range saved.Queues {
+		g.queues[to] = queue
+	}
+	for to, sent := range saved.Sent {
+		g.sent[to] = sent
+	}
+	for id, status := range saved.Statuses {
+		g.statuses[id] = status
+	}
+	return g, nil
+}
+
+// save writes the gateway to its store. g.mu must be held.
+func (g *Gateway) save() error {
+	dat, err := json.Marshal(savedGateway{g.recipients, g.queues, g.sent, g.statuses})
+	if err != nil {
+		return err
+	}
+	return g.store.Put(g.name, dat)
+}
+
+// forward publishes the letters recipients have room for, bounces those
+// waiting too long, and forgets old statuses.
+func (g *Gateway) forward(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for to, queue := range g.queues {
+		sent := g.sent[to][:0]
+		for _, t := range g.sent[to] {
+			if g.Lifetime <= 0 || now.Sub(t) < g.Lifetime {
+				sent = append(sent, t)
+			}
+		}
+
+		var waiting []*gatewayLetter
+		for _, l := range queue {
+			if g.MaxAge > 0 && now.Sub(l.Submitted) > g.MaxAge {
+				g.bounce(l, BounceExpired, now)
+				continue
+			}
+			if g.Window > 0 && len(sent) >= g.Window {
+				waiting = append(waiting, l)
+				continue
+			}
+			letter := make([]byte, 0, 1+len(l.From)+len(l.Data))
+			letter = append(letter, byte(len(l.From)))
+			letter = append(letter, l.From...)
+			letter = append(letter, l.Data...)
+			if err := deposit(g.transport, g.recipients[to], LetterForwarded, letter); err != nil {
+				g.bounce(l, BouncePublish+": "+err.Error(), now)
+				continue
+			}
+			sent = append(sent, now)
+			g.statuses[l.ID] = &GatewayStatus{State: GatewayDelivered, Time: now}
+		}
+
+		if len(waiting) > 0 {
+			g.queues[to] = waiting
+		} else {
+			delete(g.queues, to)
+		}
+		g.sent[to] = sent
+	}
+
+	for id, status := range g.statuses {
+		if status.State != GatewayQueued && g.Lifetime > 0 && now.Sub(status.Time) > g.Lifetime {
+			delete(g.statuses, id)
+		}
+	}
+	g.save()
+}
+
+// bounce marks a letter as undeliverable, and tells its sender if they gave a
+// stub to. g.mu must be held.
+func (g *Gateway) bounce(l *gatewayLetter, reason string, now time.Time) {
+	g.statuses[l.ID] = &GatewayStatus{State: GatewayBounced, Reason: reason, Time: now}
+	if l.Bounce == nil {
+		return
+	}
+	dat, err := json.Marshal(&GatewayBounce{l.ID, l.To, reason})
+	if err == nil {
+		deposit(g.transport, l.Bounce, LetterBounce, dat)
+	}
+}
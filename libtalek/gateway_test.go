@@ -0,0 +1,135 @@
+package libtalek
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGatewayForwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekgateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStore(dir)
+	bus := newMemoryBus()
+
+	g, err := newGateway(bus, store, "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Window = 1
+	g.Lifetime = time.Hour
+	g.MaxQueue = 2
+	alice, _ := NewMailbox()
+	stub, _ := alice.NewStub("gateway")
+	if err = g.AddRecipient("alice", stub); err != nil {
+		t.Fatal(err)
+	}
+	letters := alice.poll(bus)
+
+	first, err := g.Submit("alice", "bob", []byte("hi"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := g.Submit("alice", "carol", []byte("hello"), nil)
+	if _, err = g.Submit("alice", "dave", nil, nil); err != ErrQueueFull {
+		t.Fatalf("Submitting to a full queue should fail, got %v", err)
+	}
+	if _, err = g.Submit("erin", "bob", nil, nil); err != ErrUnknownRecipient {
+		t.Fatalf("Submitting to an unknown recipient should fail, got %v", err)
+	}
+
+	// Alice's lane has room for one letter within the lifetime.
+	now := time.Now()
+	g.forward(now)
+	l := expectLetter(t, letters)
+	if from, data, err := l.Forwarded(); err != nil || l.From != "gateway" || from != "bob" || string(data) != "hi" {
+		t.Fatalf("Unexpected letter %+v: %v", l, err)
+	}
+	if status, _ := g.Status(first); status.State != GatewayDelivered {
+		t.Fatalf("Forwarded letter is %s", status.State)
+	}
+	if status, _ := g.Status(second); status.State != GatewayQueued || g.Queued("alice") != 1 {
+		t.Fatal("Letter beyond the window should stay queued.")
+	}
+
+	// A restarted gateway keeps its recipients and queues.
+	restarted, err := newGateway(bus, store, "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.Window = 1
+	restarted.Lifetime = time.Hour
+	if recipients := restarted.Recipients(); len(recipients) != 1 || restarted.Queued("alice") != 1 {
+		t.Fatalf("Restarted gateway lost state: %v", recipients)
+	}
+	restarted.forward(now.Add(time.Minute))
+	if restarted.Queued("alice") != 1 {
+		t.Fatal("Restarted gateway forgot the letters it forwarded.")
+	}
+	restarted.forward(now.Add(time.Hour + time.Minute))
+	l = expectLetter(t, letters)
+	if from, data, _ := l.Forwarded(); from != "carol" || string(data) != "hello" {
+		t.Fatalf("Unexpected letter %+v", l)
+	}
+	if status, _ := restarted.Status(second); status.State != GatewayDelivered {
+		t.Fatalf("Forwarded letter is %s", status.State)
+	}
+
+	// Statuses are forgotten after a lifetime.
+	restarted.forward(now.Add(3 * time.Hour))
+	if _, err = restarted.Status(first); err != ErrUnknownLetter {
+		t.Fatalf("Old statuses should be forgotten, got %v", err)
+	}
+}
+
+func TestGatewayBounces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekgateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewFileStore(dir)
+	bus := newMemoryBus()
+
+	g, _ := newGateway(bus, store, "gateway")
+	g.Window = 1
+	g.Lifetime = time.Hour
+	g.MaxAge = 10 * time.Minute
+	alice, _ := NewMailbox()
+	aliceStub, _ := alice.NewStub("gateway")
+	g.AddRecipient("alice", aliceStub)
+	bob, _ := NewMailbox()
+	bobStub, _ := bob.NewStub("gateway")
+	bounces := bob.poll(bus)
+
+	g.Submit("alice", "carol", []byte("first"), nil)
+	expired, _ := g.Submit("alice", "bob", []byte("second"), bobStub)
+	now := time.Now()
+	g.forward(now)
+	g.forward(now.Add(20 * time.Minute))
+
+	l := expectLetter(t, bounces)
+	bounce, err := l.Bounce()
+	if err != nil || bounce.ID != expired || bounce.To != "alice" || bounce.Reason != BounceExpired {
+		t.Fatalf("Unexpected bounce %+v: %v", bounce, err)
+	}
+	if status, _ := g.Status(expired); status.State != GatewayBounced || status.Reason != BounceExpired {
+		t.Fatalf("Expired letter is %+v", status)
+	}
+
+	removed, _ := g.Submit("alice", "bob", []byte("third"), bobStub)
+	if err = g.RemoveRecipient("alice"); err != nil {
+		t.Fatal(err)
+	}
+	l = expectLetter(t, bounces)
+	if bounce, _ = l.Bounce(); bounce.ID != removed || bounce.Reason != BounceRemoved {
+		t.Fatalf("Unexpected bounce %+v", bounce)
+	}
+	if _, err = g.Submit("alice", "bob", nil, nil); err != ErrUnknownRecipient {
+		t.Fatalf("Removed recipient should be unknown, got %v", err)
+	}
+}
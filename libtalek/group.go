@@ -0,0 +1,198 @@
+package libtalek
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+)
+
+// groupReseedPolls is how many polls the DRBG of a subscription group makes
+// before it is seeded afresh from the OS.
+const groupReseedPolls = 1024
+
+var errGroupClosed = errors.New("subscription group is closed")
+
+// GroupMessage is a message read from a handle of a subscription group.
+type GroupMessage struct {
+	Handle *Handle
+	Data   []byte
+}
+
+// SubscriptionGroup follows many handles together, for clients following
+// hundreds of low-traffic topics. Handles of a group are not prepared for
+// Poll: they share the group's DRBG, which generates their reads in place of
+// the OS, and the group's one channel of messages. The group takes a single
+// turn in the client's round of reads, as a handle polled alone does, and
+// polls its handles in turn within it, so a group shares reads fairly with
+// other handles and groups, and among its own handles.
+type SubscriptionGroup struct {
+	client   *Client
+	messages chan GroupMessage
+	done     chan struct{}
+
+	lock    sync.Mutex
+	handles []*Handle
+	next    int // Index of the handle polled in the next turn
+	rand    *drbg.HashDrbg
+	polls   int // Since rand was seeded
+}
+
+// NewSubscriptionGroup creates a group of handles the client reads together.
+func (c *Client) NewSubscriptionGroup() (*SubscriptionGroup, error) {
+	rand, err := drbg.NewHashDrbg(nil)
+	if err != nil {
+		return nil, err
+	}
+	g := &SubscriptionGroup{
+		client:   c,
+		messages: make(chan GroupMessage),
+		done:     make(chan struct{}),
+		rand:     rand,
+	}
+	c.handleMutex.Lock()
+	c.groups = append(c.groups, g)
+	c.handleMutex.Unlock()
+	return g, nil
+}
+
+// Messages returns the channel messages read from the handles of the group
+// are sent on.
+func (g *SubscriptionGroup) Messages() <-chan GroupMessage {
+	return g.messages
+}
+
+// Add has the group follow a handle. It returns false if the handle is
+// already followed, by this group or another, or polled alone.
+func (g *SubscriptionGroup) Add(handle *Handle) (bool, error) {
+	c := g.client
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	if g.closed() {
+		return false, errGroupClosed
+	}
+	if c.followed(handle) {
+		return false, nil
+	}
+	if c.Verbose {
+		handle.log = c.log
+	}
+	g.lock.Lock()
+	g.handles = append(g.handles, handle)
+	g.lock.Unlock()
+	return true, nil
+}
+
+// Remove stops the group following a handle, returning whether it was.
+func (g *SubscriptionGroup) Remove(handle *Handle) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for i, h := range g.handles {
+		if h == handle {
+			g.handles = append(g.handles[:i], g.handles[i+1:]...)
+			if g.next > i {
+				g.next--
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns how many handles the group follows.
+func (g *SubscriptionGroup) Len() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.handles)
+}
+
+// Close stops the client reading the handles of the group. Messages read
+// but not yet received from Messages are dropped.
+func (g *SubscriptionGroup) Close() {
+	c := g.client
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	for i, other := range c.groups {
+		if other == g {
+			c.groups = append(c.groups[:i], c.groups[i+1:]...)
+			close(g.done)
+			return
+		}
+	}
+}
+
+func (g *SubscriptionGroup) closed() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// contains reports whether the group follows a handle.
+func (g *SubscriptionGroup) contains(handle *Handle) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, h := range g.handles {
+		if h == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// members returns the handles the group follows.
+func (g *SubscriptionGroup) members() []*Handle {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]*Handle(nil), g.handles...)
+}
+
+// poll generates the reads of the group's turn, of the next of its handles,
+// or returns a nil handle if it follows none. tier picks the tier the handle
+// is read from.
+func (g *SubscriptionGroup) poll(config *ClientConfig, tier func(*Handle, *ClientConfig)) (*Handle, *common.ReadArgs, *common.ReadArgs, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.handles) == 0 {
+		return nil, nil, nil, nil
+	}
+	if g.next >= len(g.handles) {
+		g.next = 0
+	}
+	h := g.handles[g.next]
+	g.next++
+
+	if g.polls >= groupReseedPolls {
+		rand, err := drbg.NewHashDrbg(nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		g.rand, g.polls = rand, 0
+	}
+	g.polls++
+	tier(h, config)
+	ra1, ra2, err := h.generatePoll(config, drbgReader{g.rand})
+	return h, ra1, ra2, err
+}
+
+// deliver sends a message read from a handle of the group, unless the group
+// is closed first.
+func (g *SubscriptionGroup) deliver(h *Handle, msg []byte) {
+	select {
+	case g.messages <- GroupMessage{h, msg}:
+	case <-g.done:
+	}
+}
+
+// drbgReader reads from a DRBG.
+type drbgReader struct {
+	*drbg.HashDrbg
+}
+
+func (r drbgReader) Read(p []byte) (int, error) {
+	r.FillBytes(p)
+	return len(p), nil
+}
@@ -0,0 +1,113 @@
+package libtalek
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func groupTestConfig() ClientConfig {
+	return ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		WriteInterval: time.Second,
+		ReadInterval:  time.Second,
+		TrustDomains: []*common.TrustDomainConfig{
+			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+		},
+	}
+}
+
+func TestSubscriptionGroupTurns(t *testing.T) {
+	config := groupTestConfig()
+	c := newClient("TestSubscriptionGroupTurns", config, &mockLeader{})
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	alone, _ := NewTopic()
+	c.Poll(&alone.Handle)
+	g, err := c.NewSubscriptionGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grouped []*Handle
+	for i := 0; i < 3; i++ {
+		topic, _ := NewTopic()
+		if ok, err := g.Add(&topic.Handle); !ok || err != nil {
+			t.Fatalf("Could not add handle %d to the group: %v", i, err)
+		}
+		grouped = append(grouped, &topic.Handle)
+	}
+	if ok, _ := g.Add(grouped[0]); ok {
+		t.Fatal("A handle was added to a group twice.")
+	}
+	if ok, _ := g.Add(&alone.Handle); ok {
+		t.Fatal("A handle polled alone was added to a group.")
+	}
+	if c.Poll(grouped[0]) != nil {
+		t.Fatal("A handle of a group was polled alone.")
+	}
+
+	// The group takes one turn for each of the handle polled alone, and its
+	// handles take its turns in order.
+	turns := make(map[*Handle]int)
+	for i := 0; i < 60; i++ {
+		req := c.nextRequest(&config)
+		companion := <-c.pendingReads
+		if req.Handle == nil || companion.Handle != req.Handle || companion.group != req.group {
+			t.Fatalf("Turn %d read %v, with companion of %v.", i, req.Handle, companion.Handle)
+		}
+		if (req.group != nil) != (req.Handle != &alone.Handle) {
+			t.Fatalf("Turn %d was not read as part of its group.", i)
+		}
+		turns[req.Handle]++
+	}
+	if turns[&alone.Handle] != 30 {
+		t.Fatalf("Handle polled alone took %d of 60 turns.", turns[&alone.Handle])
+	}
+	for i, h := range grouped {
+		if turns[h] != 10 {
+			t.Fatalf("Grouped handle %d took %d of 60 turns.", i, turns[h])
+		}
+	}
+
+	go g.deliver(grouped[1], []byte("hello"))
+	msg := <-g.Messages()
+	if msg.Handle != grouped[1] || string(msg.Data) != "hello" {
+		t.Fatalf("Group delivered %q from the wrong handle.", msg.Data)
+	}
+
+	g.Close()
+	if _, err := g.Add(grouped[0]); err != errGroupClosed {
+		t.Fatalf("Expected adding to a closed group to fail, got %v.", err)
+	}
+	if req := c.nextRequest(&config); req.group != nil {
+		t.Fatal("A closed group was read.")
+	}
+}
+
+func TestSubscriptionGroupPollOnce(t *testing.T) {
+	config := groupTestConfig()
+	leader := newBucketLeader(config.Config, config.TrustDomains)
+	c := NewBackgroundClient("TestSubscriptionGroupPollOnce", config, leader)
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	defer c.Kill()
+
+	topic, _ := NewTopic()
+	handle := topic.Handle
+	g, _ := c.NewSubscriptionGroup()
+	g.Add(&handle)
+	leader.publish(t, topic, []byte("grouped"))
+
+	result, err := c.PollOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := result.Messages[&handle]; len(msgs) != 1 || string(msgs[0]) != "grouped" {
+		t.Fatalf("Burst read %q from the grouped handle.", msgs)
+	}
+}
@@ -2,6 +2,8 @@ package libtalek
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -10,10 +12,9 @@ import (
 	"io"
 
 	"github.com/agl/ed25519"
-	"github.com/dchest/siphash"
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/drbg"
-	"github.com/privacylab/talek/pir/pirclient"
+	"github.com/privacylab/talek/securemem"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -34,22 +35,99 @@ type Handle struct {
 	SharedSecret     *[32]byte
 	SigningPublicKey *[32]byte
 
+	// For deniable topics, the key from which the keys of items from
+	// ChainSeqno on are derived, forward only. Nil for signed topics.
+	ChainKey   *[32]byte
+	ChainSeqno uint64
+
 	// Current log position
 	Seqno uint64
 
+	// Format the items of the topic are sealed in.
+	Envelope Envelope `json:",omitempty"`
+
+	// Size class of the topic, whose bucket space its items are in, bound as
+	// the topic is created.
+	Class uint8 `json:",omitempty"`
+
 	// partially read message
 	partialMessage message
 
+	// Seqno the last poll of the handle was made for, and how many polls in
+	// a row found items. Used only by the reads of a client.
+	polled uint64
+	streak int
+	// Tier the next poll of the handle reads, and whether the last poll of an
+	// item the interest vector didn't hold read the cold tier.
+	tier     uint8
+	coldTurn bool
+
 	// Notifications of new messages
 	updates chan []byte
+	// Closed when the handle is no longer polled
+	done chan struct{}
 
 	// Hash function for interest vectors.
 	hasher hash.Hash
 
+	// Digests of recently accepted items, with the position each was accepted at.
+	accepted      map[[32]byte]uint64
+	acceptedOrder [][32]byte
+
 	// log for messages
-	log *common.Logger
+	log Logger
 }
 
+// Envelope is the format a topic seals its items in, identified by a version
+// byte. Items of every envelope are DataSize bytes, indistinguishable to
+// servers, so the envelope is carried by handles rather than items.
+type Envelope byte
+
+const (
+	// EnvelopeSigned items are sealed under the shared secret of the topic,
+	// and signed with its signing key, so readers of the topic can't forge
+	// them.
+	EnvelopeSigned Envelope = iota
+	// EnvelopeSymmetric items are only sealed, and authenticated by the MAC of
+	// the seal under the shared secret. Each carries ed25519.SignatureSize
+	// more bytes of its message, but any reader can forge them, so they suit
+	// only topics strictly between a pair.
+	EnvelopeSymmetric
+	// EnvelopeNonced items are signed as EnvelopeSigned ones are, and carry
+	// the nonce they are sealed with ahead of their seal: the position of the
+	// item as its writer counted it, random bytes, and the envelope. Readers
+	// whose count of the log has drifted from the writer's, and those of
+	// topics several writers share, still open them, and the envelope in the
+	// signed nonce keeps them from being taken for items of another.
+	EnvelopeNonced
+)
+
+// explicitNonceSize is how many bytes of an EnvelopeNonced item its nonce
+// takes.
+const explicitNonceSize = 24
+
+// replayWindow is how many accepted items a handle remembers to detect replays.
+const replayWindow = 256
+
+// ErrReplay is returned when a response re-serves an item that was already
+// accepted at an earlier position of the log, and holds none for the current
+// position.
+var ErrReplay = errors.New("replayed item")
+
+// errEnvelope refuses an item whose nonce names an envelope other than that
+// of the handle reading it.
+var errEnvelope = errors.New("item of another envelope")
+
+// errKeyErased is returned for a deniable item before the position the chain
+// key of a handle has ratcheted to.
+var errKeyErased = errors.New("key of the item was erased")
+
+// Labels deriving the keys of deniable items from a chain key.
+var (
+	itemKeyLabel  = []byte("talek item key")
+	chainKeyLabel = []byte("talek chain key")
+)
+
 //NewHandle creates a new topic handle, without attachment to a specific topic.
 func NewHandle() (h *Handle, err error) {
 	h = &Handle{}
@@ -59,28 +137,29 @@ func NewHandle() (h *Handle, err error) {
 
 func initHandle(h *Handle) (err error) {
 	h.updates = make(chan []byte)
+	h.done = make(chan struct{})
 	h.hasher = sha256.New()
 
 	h.drbg, err = drbg.NewHashDrbg(nil)
 	return
 }
 
+// isDone indicates if polling of the handle has been stopped with Client.Done.
+func (h *Handle) isDone() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // nextBuckets returns the pair of buckets that will be used in the next poll or publish of this
 // topic given the current sequence number of the handle.
 // The buckets returned by this method must still be wrapped by the NumBuckets config
 // parameter of talek instance it is requested against.
 func (h *Handle) nextBuckets(conf *common.Config) (uint64, uint64) {
-	seqNoBytes := make([]byte, 24)
-	_ = binary.PutUvarint(seqNoBytes, h.Seqno)
-
-	k0, k1 := h.Seed1.KeyUint128()
-	b1 := siphash.Hash(k0, k1, seqNoBytes)
-	k0, k1 = h.Seed2.KeyUint128()
-	b2 := siphash.Hash(k0, k1, seqNoBytes)
-	b1 = b1 % conf.NumBuckets
-	b2 = b2 % conf.NumBuckets
-
-	return b1, b2
+	return common.ItemBuckets(conf, h.Seed1, h.Seed2, h.Seqno)
 }
 
 // nextInterestVector returns the bytes that will be used to set the bloom filter location
@@ -92,19 +171,24 @@ func (h *Handle) nextInterestVector() []byte {
 	return h.hasher.Sum(interestKey)
 }
 
-func makeReadArg(config *ClientConfig, bucket uint64, rand io.Reader) *common.ReadArgs {
+func makeReadArg(config *ClientConfig, class uint8, tier uint8, bucket uint64, rand io.Reader) *common.ReadArgs {
 	arg := &common.ReadArgs{}
 	num := len(config.TrustDomains)
 	arg.TD = make([]common.PirArgs, num)
-
-	pirClient := pirclient.NewClient("pirclient")
-	reqVec, err := pirClient.GenerateRequestVectors(bucket, uint64(num), config.Config.NumBuckets)
+	arg.PadAlgorithm = config.PadAlgorithm
+	arg.Generation = config.Generation
+	arg.Class = class
+	arg.Tier = tier
+
+	// Request vectors are generated as the read is encoded, rather than held
+	// while it waits to be made.
+	vectors, err := common.NewRequestVectors(bucket, config.Config, num, rand)
 	if err != nil {
 		return nil
 	}
+	arg.Vectors = vectors
 
 	for i := 0; i < num; i++ {
-		arg.TD[i].RequestVector = reqVec[i]
 		arg.TD[i].PadSeed = make([]byte, drbg.SeedLength)
 		if _, err := rand.Read(arg.TD[i].PadSeed); err != nil {
 			return nil
@@ -120,35 +204,69 @@ func (h *Handle) generatePoll(config *ClientConfig, rand io.Reader) (*common.Rea
 		return nil, nil, errors.New("Subscription not fully initialized")
 	}
 
+	config, err := config.inClass(h.Class)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	args := make([]*common.ReadArgs, 2)
 	bucket1, bucket2 := h.nextBuckets(config.Config)
+	if h.tier != common.TierCold {
+		if config, err = config.inTier(h.tier); err != nil {
+			return nil, nil, err
+		}
+		bucket1, bucket2 = config.HotBucket(bucket1), config.HotBucket(bucket2)
+	}
 
-	args[0] = makeReadArg(config, bucket1, rand)
-	args[1] = makeReadArg(config, bucket2, rand)
+	args[0] = makeReadArg(config, h.Class, h.tier, bucket1, rand)
+	args[1] = makeReadArg(config, h.Class, h.tier, bucket2, rand)
 
 	return args[0], args[1], nil
 }
 
 // Decrypt attempts decryption of a message for a topic using a specific nonce.
+// Items of EnvelopeNonced are opened with the nonce they carry instead.
 func (h *Handle) Decrypt(cyphertext []byte, nonce *[24]byte) ([]byte, error) {
+	message, err := h.verify(cyphertext)
+	if err != nil {
+		return nil, err
+	}
+	return h.openAt(message, nonce)
+}
+
+// verify checks the signature of a cyphertext, returning the signed message.
+// Symmetric cyphertexts are returned whole, to be authenticated as opened.
+func (h *Handle) verify(cyphertext []byte) ([]byte, error) {
 	if h.SharedSecret == nil || h.SigningPublicKey == nil {
 		return nil, errors.New("Handle improperly initialized")
 	}
+	switch h.Envelope {
+	case EnvelopeSigned, EnvelopeNonced:
+	case EnvelopeSymmetric:
+		if len(cyphertext) < box.Overhead {
+			return nil, errors.New("Invalid cyphertext")
+		}
+		return cyphertext, nil
+	default:
+		return nil, fmt.Errorf("unknown envelope %d", h.Envelope)
+	}
 	cypherlen := len(cyphertext)
-	if cypherlen < ed25519.SignatureSize {
+	if cypherlen < ed25519.SignatureSize+box.Overhead {
 		return nil, errors.New("Invalid cyphertext")
 	}
 
-	//verify signature
 	message := cyphertext[0 : cypherlen-ed25519.SignatureSize]
 	var sig [ed25519.SignatureSize]byte
 	copy(sig[:], cyphertext[cypherlen-ed25519.SignatureSize:])
 	if !ed25519.Verify(h.SigningPublicKey, message, &sig) {
 		return nil, errors.New("Invalid Signature")
 	}
+	return message, nil
+}
 
-	//decrypt
-	plaintext := make([]byte, 0, cypherlen-box.Overhead-ed25519.SignatureSize)
+// open decrypts a signed message.
+func (h *Handle) open(message []byte, nonce *[24]byte) ([]byte, error) {
+	plaintext := make([]byte, 0, len(message)-box.Overhead)
 	_, ok := box.OpenAfterPrecomputation(plaintext, message, nonce, h.SharedSecret)
 	if !ok {
 		return nil, errors.New("Failed to decrypt")
@@ -156,32 +274,217 @@ func (h *Handle) Decrypt(cyphertext []byte, nonce *[24]byte) ([]byte, error) {
 	return plaintext[0:cap(plaintext)], nil
 }
 
-// OnResponse processes a response for a request generated by generatePoll,
-// sending it to the handle's updates channel if valid.
-func (h *Handle) OnResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) {
-	msg := h.retrieveResponse(args, reply, dataSize)
-	if msg != nil {
-		h.Seqno++
+// openAt opens a message sealed with the nonce of its position, unless the
+// envelope of the handle carries its own.
+func (h *Handle) openAt(message []byte, nonce *[24]byte) ([]byte, error) {
+	if h.Envelope == EnvelopeNonced {
+		return h.openNonced(message)
+	}
+	return h.open(message, nonce)
+}
 
-		if h.partialMessage.Join(msg) {
-			if h.updates != nil {
-				h.updates <- h.partialMessage.Retrieve()
-			}
-			h.partialMessage = message{}
+// openNonced opens a message of EnvelopeNonced with the nonce it carries,
+// whatever position it names, so readers and writers whose counts of the log
+// differ still agree on items. Nonces naming another envelope are refused.
+// Items opened before are refused by their digest as they are read, rather
+// than by their position.
+func (h *Handle) openNonced(message []byte) ([]byte, error) {
+	if len(message) < explicitNonceSize+box.Overhead {
+		return nil, errors.New("Invalid cyphertext")
+	}
+	var nonce [24]byte
+	copy(nonce[:], message)
+	if Envelope(nonce[explicitNonceSize-1]) != EnvelopeNonced {
+		return nil, errEnvelope
+	}
+	return h.open(message[explicitNonceSize:], &nonce)
+}
+
+// overhead is how many bytes of each item the envelope of the handle takes.
+// Deniable items are padded to the length of signed ones.
+func (h *Handle) overhead() int {
+	if h.Envelope == EnvelopeSymmetric && !h.IsDeniable() {
+		return box.Overhead
+	}
+	if h.Envelope == EnvelopeNonced && !h.IsDeniable() {
+		return PublishingOverhead + explicitNonceSize
+	}
+	return PublishingOverhead
+}
+
+// IsDeniable indicates if the handle reads a deniable topic.
+func (h *Handle) IsDeniable() bool {
+	return h.ChainKey != nil
+}
+
+func deriveKey(key *[32]byte, label []byte) [32]byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(label)
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// itemKey derives the key of the deniable item at seqno.
+func (h *Handle) itemKey(seqno uint64) (*[32]byte, error) {
+	if seqno < h.ChainSeqno {
+		return nil, errKeyErased
+	}
+	chain := *h.ChainKey
+	for i := h.ChainSeqno; i < seqno; i++ {
+		chain = deriveKey(&chain, chainKeyLabel)
+	}
+	key := deriveKey(&chain, itemKeyLabel)
+	return &key, nil
+}
+
+// eraseKeys ratchets the chain key forward to seqno, so the keys of earlier
+// items can no longer be derived. Copies of a handle share its keys, so the
+// chain key is replaced rather than overwritten.
+func (h *Handle) eraseKeys(seqno uint64) {
+	if h.ChainKey == nil || seqno <= h.ChainSeqno {
+		return
+	}
+	chain := *h.ChainKey
+	for i := h.ChainSeqno; i < seqno; i++ {
+		chain = deriveKey(&chain, chainKeyLabel)
+	}
+	h.ChainKey = &chain
+	h.ChainSeqno = seqno
+}
+
+// sealItem seals a deniable item at seqno. It is padded with random bytes to
+// the length of a signed item, so it is random to anyone without its key.
+func (h *Handle) sealItem(plaintext []byte, seqno uint64) ([]byte, error) {
+	key, err := h.itemKey(seqno)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	_ = binary.PutUvarint(nonce[:], seqno)
+	buf := box.SealAfterPrecomputation(make([]byte, 0, len(plaintext)+PublishingOverhead), plaintext, &nonce, key)
+	padding := buf[len(buf) : len(buf)+ed25519.SignatureSize]
+	if _, err := rand.Read(padding); err != nil {
+		return nil, err
+	}
+	return buf[:cap(buf)], nil
+}
+
+// openItem opens a deniable item at seqno.
+func (h *Handle) openItem(item []byte, seqno uint64) ([]byte, error) {
+	if len(item) < PublishingOverhead {
+		return nil, errors.New("Invalid cyphertext")
+	}
+	key, err := h.itemKey(seqno)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	_ = binary.PutUvarint(nonce[:], seqno)
+	plaintext, ok := box.OpenAfterPrecomputation(nil, item[:len(item)-ed25519.SignatureSize], &nonce, key)
+	if !ok {
+		return nil, errors.New("Failed to decrypt")
+	}
+	return plaintext, nil
+}
+
+// accept remembers an item accepted at the current position.
+func (h *Handle) accept(digest [32]byte) {
+	if h.accepted == nil {
+		h.accepted = make(map[[32]byte]uint64)
+	}
+	if _, ok := h.accepted[digest]; !ok {
+		h.acceptedOrder = append(h.acceptedOrder, digest)
+	}
+	h.accepted[digest] = h.Seqno
+	if len(h.acceptedOrder) > replayWindow {
+		delete(h.accepted, h.acceptedOrder[0])
+		h.acceptedOrder = h.acceptedOrder[1:]
+	}
+}
+
+// placed reports whether an item of position seqno is placed in the bucket a
+// read was made of. An item accepted before stays in the buckets of its
+// position, which a later position may share, and is seen again through them;
+// only one served from another bucket was re-served.
+func (h *Handle) placed(args *common.ReadArgs, config *ClientConfig, seqno uint64) bool {
+	class, err := config.inClass(args.Class)
+	if err != nil {
+		return false
+	}
+	bucket1, bucket2 := common.ItemBuckets(class.Config, h.Seed1, h.Seed2, seqno)
+	if args.Tier != common.TierCold {
+		tier, err := class.inTier(args.Tier)
+		if err != nil {
+			return false
 		}
+		bucket1, bucket2 = tier.HotBucket(bucket1), tier.HotBucket(bucket2)
+	}
+	bucket := uint64(args.Bucket())
+	return bucket == bucket1 || bucket == bucket2
+}
+
+// OnResponse processes a response for a request generated by generatePoll
+// with config, sending it to the handle's updates channel if valid. An error
+// is returned if the response could not be decoded, or ErrReplay if it
+// re-served an item already accepted from a bucket the item isn't placed in.
+func (h *Handle) OnResponse(args *common.ReadArgs, reply *common.ReadReply, config *ClientConfig) error {
+	msg, err := h.onResponse(args, reply, config)
+	if msg != nil {
+		h.deliver(msg)
 	}
+	return err
 }
 
-func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) []byte {
+// onResponse processes a response like OnResponse, returning the message it
+// completed, if any, rather than sending it.
+func (h *Handle) onResponse(args *common.ReadArgs, reply *common.ReadReply, config *ClientConfig) ([]byte, error) {
+	item, err := h.retrieveResponse(args, reply, config)
+	if item == nil {
+		return nil, err
+	}
+	h.Seqno++
+	h.eraseKeys(h.Seqno)
+
+	var msg []byte
+	if h.partialMessage.Join(item) {
+		msg, err = h.partialMessage.Unpadded()
+		h.partialMessage = message{}
+	}
+	return msg, err
+}
+
+// deliver sends a message to the updates channel of the handle.
+func (h *Handle) deliver(msg []byte) {
+	if h.updates == nil {
+		return
+	}
+	// Once polling is done, nothing may be reading updates.
+	select {
+	case h.updates <- msg:
+	case <-h.done:
+	}
+}
+
+func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply, config *ClientConfig) ([]byte, error) {
+	conf, err := config.forRead(args)
+	if err != nil {
+		return nil, err
+	}
+	dataSize := uint(conf.DataSize)
 	data := reply.Data
 
 	// strip out the padding injected by trust domains.
+	pad, err := common.NewPad(args.PadAlgorithm)
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < len(args.TD); i++ {
-		if err := drbg.Overlay(args.TD[i].PadSeed, data); err != nil {
+		if err := pad.Overlay(args.TD[i].PadSeed, data); err != nil {
 			if h.log != nil {
-				h.log.Info.Printf("Failed to remove pad on returned read: %v\n", err)
+				h.log.Log(common.LevelInfo, "Failed to remove pad on returned read", HandleField(h), ErrField(err))
 			}
-			return nil
+			return nil, err
 		}
 	}
 
@@ -189,28 +492,62 @@ func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply
 	_ = binary.PutUvarint(seqNoBytes[:], h.Seqno)
 
 	// A 'bucket' likely has multiple messages in it. See if any of them are ours.
+	// Items are bound to their position by the nonce, so an old item re-served
+	// at a later position will not open; remembering accepted items lets that
+	// be reported rather than ignored, when the item was served from a bucket
+	// its position doesn't place it in. A re-served item may sit alongside the
+	// item of the current position, so the rest of the bucket is still read,
+	// and the replay reported only if nothing else opens.
+	replayed := false
 	for i := uint(0); i < uint(len(data)); i += dataSize {
-		plaintext, err := h.Decrypt(data[i:i+dataSize], &seqNoBytes)
+		item := data[i : i+dataSize]
+		// Deniable items carry no signature, and open only at their position.
+		if h.IsDeniable() {
+			if plaintext, err := h.openItem(item, h.Seqno); err == nil {
+				return plaintext, nil
+			}
+			continue
+		}
+		message, err := h.verify(item)
 		if err == nil {
-			if h.log != nil {
-				h.log.Trace.Printf("Successful Decryption.\n")
+			digest := sha256.Sum256(item)
+			if pos, ok := h.accepted[digest]; ok {
+				if !h.placed(args, config, pos) {
+					if h.log != nil {
+						h.log.Log(common.LevelWarn, "Item re-served", HandleField(h), SeqNoField(h.Seqno), LogField{"accepted", pos})
+					}
+					replayed = true
+				}
+				continue
+			}
+			var plaintext []byte
+			if plaintext, err = h.openAt(message, &seqNoBytes); err == nil {
+				if h.log != nil {
+					h.log.Log(common.LevelTrace, "Successful decryption", HandleField(h), SeqNoField(h.Seqno))
+				}
+				h.accept(digest)
+				return plaintext, nil
 			}
-			return plaintext
 		}
 
 		if h.log != nil {
-			h.log.Trace.Printf("decryption failed for read %d of bucket %d [%v](%d): %v\n",
-				i/dataSize,
-				args.Bucket(),
-				data[i:i+4],
-				len(data[i:i+dataSize]),
-				err)
+			h.log.Log(common.LevelTrace, "Decryption failed",
+				HandleField(h),
+				SeqNoField(h.Seqno),
+				LogField{"item", i / dataSize},
+				LogField{"bucket", args.Bucket()},
+				ErrField(err))
 		}
 	}
-	return nil
+	if replayed {
+		return nil, ErrReplay
+	}
+	return nil, nil
 }
 
-// MarshalText is a compact textual representation of a handle
+// MarshalText is a compact textual representation of a handle. It includes
+// the state of the handle's generator of PIR requests, which the handle then
+// forks away from, so the handle and its restored copy don't repeat requests.
 func (h *Handle) MarshalText() ([]byte, error) {
 	s1, err := h.Seed1.MarshalBinary()
 	if err != nil {
@@ -221,20 +558,72 @@ func (h *Handle) MarshalText() ([]byte, error) {
 		return nil, err
 	}
 	txt := fmt.Sprintf("%x.%x.%x.%x.%d", s1, s2, *h.SharedSecret, *h.SigningPublicKey, h.Seqno)
+	if h.drbg != nil {
+		state, err := h.drbg.ExportState()
+		if err != nil {
+			return nil, err
+		}
+		txt += fmt.Sprintf(".%x", state)
+	} else if h.ChainKey != nil {
+		return nil, errors.New("deniable handle has no generator state")
+	}
+	if h.ChainKey != nil {
+		txt += fmt.Sprintf(".%x.%d", *h.ChainKey, h.ChainSeqno)
+	}
+	// Handles of envelopes other than signed begin with its version byte,
+	// and those of size classes other than 0 with their class before it.
+	if h.Envelope != EnvelopeSigned {
+		txt = fmt.Sprintf("%02x:", byte(h.Envelope)) + txt
+	}
+	if h.Class != 0 {
+		txt = fmt.Sprintf("%d/", h.Class) + txt
+	}
 	return []byte(txt), nil
 }
 
 // UnmarshalText restores a handle from its compact textual representation
 func (h *Handle) UnmarshalText(text []byte) error {
-	var s1, s2, ss, pk []byte
-	if n, err := fmt.Sscanf(string(text), "%x.%x.%x.%x.%d", &s1, &s2, &ss, &pk, &h.Seqno); n < 5 || err != nil {
+	var s1, s2, ss, pk, state, ck []byte
+	// Handles serialized without the state of their generator have only five
+	// fields, and start a new one. Those of deniable topics have eight, ending
+	// with their chain key.
+	h.ChainKey = nil
+	h.Envelope = EnvelopeSigned
+	h.Class = 0
+	if i := bytes.IndexByte(text, '/'); i > 0 && i <= 3 {
+		if _, err := fmt.Sscanf(string(text[:i]), "%d", &h.Class); err != nil {
+			return errors.New("invalid size class")
+		}
+		text = text[i+1:]
+	}
+	if len(text) > 3 && text[2] == ':' {
+		var version byte
+		if _, err := fmt.Sscanf(string(text[:2]), "%02x", &version); err != nil {
+			return errors.New("invalid envelope")
+		}
+		h.Envelope = Envelope(version)
+		text = text[3:]
+	}
+	n, err := fmt.Sscanf(string(text), "%x.%x.%x.%x.%d.%x.%x.%d", &s1, &s2, &ss, &pk, &h.Seqno, &state, &ck, &h.ChainSeqno)
+	if n < 5 || n == 7 {
 		if err != nil {
 			return err
 		}
 		return errors.New("invalid handle")
 	}
-	h.SharedSecret = new([32]byte)
+	if n < 8 && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n == 8 {
+		if len(ck) != 32 {
+			return errors.New("invalid chain key")
+		}
+		h.ChainKey = new([32]byte)
+		copy(h.ChainKey[:], ck)
+	}
+	h.SharedSecret = securemem.Key32()
 	copy(h.SharedSecret[:], ss)
+	securemem.Wipe(ss)
 	h.SigningPublicKey = new([32]byte)
 	copy(h.SigningPublicKey[:], pk)
 	h.Seed1 = &drbg.Seed{}
@@ -248,18 +637,39 @@ func (h *Handle) UnmarshalText(text []byte) error {
 	if err := initHandle(h); err != nil {
 		return err
 	}
+	if n >= 6 {
+		if h.drbg, err = drbg.NewHashDrbgFromState(state); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Free wipes the keys of the handle, returning those kept in secure memory.
+// The handle must not be used afterwards, nor be polled as it is freed.
+func (h *Handle) Free() {
+	if h.SharedSecret != nil {
+		securemem.Free(h.SharedSecret[:])
+		h.SharedSecret = nil
+	}
+	if h.ChainKey != nil {
+		securemem.Wipe(h.ChainKey[:])
+		h.ChainKey = nil
+	}
+}
+
 // Equal tests equality of two handles
 func Equal(a, b *Handle) bool {
-	if a.Seqno != b.Seqno {
+	if a.Seqno != b.Seqno || a.Envelope != b.Envelope || a.Class != b.Class {
 		return false
 	}
 	if !bytes.Equal(a.SharedSecret[:], b.SharedSecret[:]) ||
 		!bytes.Equal(a.SigningPublicKey[:], b.SigningPublicKey[:]) {
 		return false
 	}
+	if (a.ChainKey == nil) != (b.ChainKey == nil) || (a.ChainKey != nil && (*a.ChainKey != *b.ChainKey || a.ChainSeqno != b.ChainSeqno)) {
+		return false
+	}
 	if (drbg.Equal(a.Seed1, b.Seed1) && drbg.Equal(a.Seed2, b.Seed2)) || (drbg.Equal(a.Seed1, b.Seed2) && drbg.Equal(a.Seed2, b.Seed1)) {
 		return true
 	}
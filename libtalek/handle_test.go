@@ -1,16 +1,18 @@
 package libtalek
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"testing"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
 )
 
 func TestGeneratePoll(t *testing.T) {
 	fmt.Printf("TestGeneratePoll:\n")
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
 	config.Config.NumBuckets = 1000000
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 
@@ -30,11 +32,18 @@ func TestGeneratePoll(t *testing.T) {
 		t.Fatalf("Error creating ReadArgs: %v\n", err)
 	}
 
-	if uint64(len(args0.TD[0].RequestVector)) != config.Config.NumBuckets/8 {
-		t.Fatalf("Length of request was incorrect. %d vs %d", len(args0.TD[0].RequestVector), config.Config.NumBuckets/8)
+	if uint64(args0.Vectors.Length) != config.Config.NumBuckets/8 {
+		t.Fatalf("Length of request was incorrect. %d vs %d", args0.Vectors.Length, config.Config.NumBuckets/8)
+	}
+	// Request vectors are only generated as the read is encoded.
+	if args0.TD[0].RequestVector != nil {
+		t.Fatalf("Request vectors were held by the read.")
+	}
+	if args0.Bucket() < 0 || uint64(args0.Bucket()) >= config.Config.NumBuckets {
+		t.Fatalf("Read of bucket %d", args0.Bucket())
 	}
 
-	fmt.Printf("len(args0)=%v; \n", 3*(len(args0.TD[0].RequestVector)+len(args0.TD[0].PadSeed)))
+	fmt.Printf("len(args0)=%v; \n", 3*(len(args0.Vectors.Seeds[1])+len(args0.TD[0].PadSeed)))
 
 	fmt.Printf("... done \n")
 }
@@ -57,6 +66,23 @@ func TestSerialization(t *testing.T) {
 	if !Equal(&h, h2) {
 		t.Fatalf("Serialization lost info!")
 	}
+
+	// The restored handle continues the sequence of PIR requests, which the
+	// original forked away from.
+	restored := h2.drbg.RandomUint64()
+	if h.drbg.RandomUint64() == restored {
+		t.Fatalf("Original and restored handle repeat requests")
+	}
+
+	// Handles serialized before their generator's state still restore.
+	old := txt[:bytes.LastIndexByte(txt, '.')]
+	h3, _ := NewHandle()
+	if err = h3.UnmarshalText(old); err != nil || !Equal(&h, h3) {
+		t.Fatalf("Could not deserialize handle without state: %v\n", err)
+	}
+	if err = h3.UnmarshalText(append(old, ".zz"...)); err == nil {
+		t.Fatalf("Deserialized handle with invalid state")
+	}
 }
 
 func BenchmarkGeneratePollN10K(b *testing.B) {
@@ -70,7 +96,7 @@ func BenchmarkGeneratePollN1M(b *testing.B) {
 }
 
 func HelperBenchmarkGeneratePoll(b *testing.B, NumBuckets uint64) {
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 	config.Config.NumBuckets = NumBuckets
 
@@ -88,9 +114,10 @@ func HelperBenchmarkGeneratePoll(b *testing.B, NumBuckets uint64) {
 }
 
 func BenchmarkRetrieveResponse(b *testing.B) {
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 	config.Config.NumBuckets = 10
+	config.Config.DataSize = 1024
 
 	topic, err := NewTopic()
 	h := topic.Handle
@@ -106,7 +133,79 @@ func BenchmarkRetrieveResponse(b *testing.B) {
 	// Start timing
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = h.retrieveResponse(args, reply, 1024)
+		_, _ = h.retrieveResponse(args, reply, config)
 	}
 
 }
+
+// servedReply builds the reply to a read, as a frontend would return it.
+func servedReply(args *common.ReadArgs, items ...[]byte) *common.ReadReply {
+	reply := &common.ReadReply{}
+	for _, item := range items {
+		reply.Data = append(reply.Data, item...)
+	}
+	for _, td := range args.TD {
+		drbg.Overlay(td.PadSeed, reply.Data)
+	}
+	return reply
+}
+
+func TestReplay(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
+	config.Config.NumBuckets = 10
+	config.Config.DataSize = 256
+	config.TrustDomains = make([]*common.TrustDomainConfig, 2)
+
+	topic, _ := NewTopic()
+	first, _ := topic.GeneratePublish(config.Config, make([]byte, 256-PublishingOverhead))
+	second, _ := topic.GeneratePublish(config.Config, make([]byte, 256-PublishingOverhead))
+
+	reader, _ := NewHandle()
+	reader.Seed1 = topic.Seed1
+	reader.Seed2 = topic.Seed2
+	reader.SharedSecret = topic.SharedSecret
+	reader.SigningPublicKey = topic.SigningPublicKey
+	reader.updates = nil
+
+	args, companion, _ := reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, first.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("First item not accepted: %v", err)
+	}
+	// The other bucket of the same poll may hold the same item.
+	if err := reader.OnResponse(companion, servedReply(companion, first.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("Companion read treated as new or as a replay: %v", err)
+	}
+
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, second.Data), config); err != nil || reader.Seqno != 2 {
+		t.Fatalf("Second item not accepted: %v", err)
+	}
+
+	// The first item stays in the buckets of its position, which a later
+	// position may share. Seen through one, it is neither new nor a replay.
+	bucket1, bucket2 := common.ItemBuckets(config.Config, reader.Seed1, reader.Seed2, 0)
+	collision := makeReadArg(config, 0, common.TierCold, bucket1, rand.Reader)
+	if err := reader.OnResponse(collision, servedReply(collision, first.Data), config); err != nil || reader.Seqno != 2 {
+		t.Fatalf("Item seen again through a bucket of its position treated as new or as a replay: %v", err)
+	}
+
+	// Re-serving the first item from another bucket is reported, not delivered.
+	other := uint64(0)
+	for other == bucket1 || other == bucket2 {
+		other++
+	}
+	replay := makeReadArg(config, 0, common.TierCold, other, rand.Reader)
+	if err := reader.OnResponse(replay, servedReply(replay, make([]byte, 256), first.Data), config); err != ErrReplay {
+		t.Fatalf("Expected replay to be detected, got %v", err)
+	}
+	if reader.Seqno != 2 {
+		t.Fatal("A replayed item advanced the handle.")
+	}
+
+	// Alongside the item of the current position, a re-served one is skipped.
+	third, _ := topic.GeneratePublish(config.Config, make([]byte, 256-PublishingOverhead))
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, first.Data, third.Data), config); err != nil || reader.Seqno != 3 {
+		t.Fatalf("Item served after a replayed one not accepted: %v", err)
+	}
+}
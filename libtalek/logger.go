@@ -0,0 +1,126 @@
+package libtalek
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/privacylab/talek/common"
+)
+
+// Logger is the logging of a client, and of the handles it polls.
+// Applications supply their own with Client.SetLogger, such as an adapter to
+// zap or slog. Fields never carry secrets: handles are logged by ID, which
+// reveals none of their keys or seeds.
+type Logger interface {
+	// Log logs a message at a level, with structured fields.
+	Log(level common.Level, msg string, fields ...LogField)
+}
+
+// LogField is a structured field of a log message.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// HandleField logs a handle by its ID.
+func HandleField(h *Handle) LogField {
+	return LogField{"handle", h.ID()}
+}
+
+// SeqNoField logs a sequence number of a handle.
+func SeqNoField(seqno uint64) LogField {
+	return LogField{"seqno", seqno}
+}
+
+// ErrField logs an error.
+func ErrField(err error) LogField {
+	return LogField{"err", err}
+}
+
+// handleIDContext domain separates the IDs of handles.
+const handleIDContext = "talek handle id"
+
+// ID identifies a handle in logs. It is a digest of the handle's signing
+// public key, so it reveals nothing needed to read the handle.
+func (h *Handle) ID() string {
+	if h.SigningPublicKey == nil {
+		return ""
+	}
+	d := sha256.New()
+	d.Write([]byte(handleIDContext))
+	d.Write(h.SigningPublicKey[:])
+	return hex.EncodeToString(d.Sum(nil)[:8])
+}
+
+// commonLogger logs with a common.Logger, appending fields to messages.
+type commonLogger struct {
+	*common.Logger
+}
+
+func (l commonLogger) Log(level common.Level, msg string, fields ...LogField) {
+	var out *log.Logger
+	switch level {
+	case common.LevelTrace:
+		out = l.Trace
+	case common.LevelInfo:
+		out = l.Info
+	case common.LevelWarn:
+		out = l.Warn
+	default:
+		out = l.Error
+	}
+	// Called through a clientLogger, the call logged is three frames up.
+	out.Output(3, formatLog(msg, fields))
+}
+
+// formatLog appends fields to a message as key=value pairs.
+func formatLog(msg string, fields []LogField) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	return b.String()
+}
+
+// clientLogger is the logger of a client, which may be replaced while the
+// client and its handles use it.
+type clientLogger struct {
+	logger atomic.Value // Logger, in a loggerBox
+}
+
+// loggerBox holds loggers of different types in an atomic.Value.
+type loggerBox struct {
+	Logger
+}
+
+func newClientLogger(l Logger) *clientLogger {
+	c := &clientLogger{}
+	c.set(l)
+	return c
+}
+
+func (c *clientLogger) set(l Logger) {
+	c.logger.Store(loggerBox{l})
+}
+
+func (c *clientLogger) Log(level common.Level, msg string, fields ...LogField) {
+	c.logger.Load().(loggerBox).Log(level, msg, fields...)
+}
+
+// fatal logs an error, and exits.
+func (c *clientLogger) fatal(msg string, fields ...LogField) {
+	c.Log(common.LevelError, msg, fields...)
+	os.Exit(1)
+}
+
+// SetLogger has the client, and the handles it polls, log with l rather than
+// the common.Logger named for the client.
+func (c *Client) SetLogger(l Logger) {
+	c.log.set(l)
+}
@@ -0,0 +1,53 @@
+package libtalek
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+// recordingLogger records the messages logged to it.
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (r *recordingLogger) Log(level common.Level, msg string, fields ...LogField) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, level.String()+" "+formatLog(msg, fields))
+}
+
+func TestSetLogger(t *testing.T) {
+	c := newClient("TestSetLogger", groupTestConfig(), &mockLeader{})
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	c.Verbose = true
+	logger := &recordingLogger{}
+	c.SetLogger(logger)
+
+	topic, _ := NewTopic()
+	c.Poll(&topic.Handle)
+	c.Poll(&topic.Handle)
+	c.report(&Event{Kind: EventBackoff})
+
+	if len(logger.logs) != 2 {
+		t.Fatalf("Expected 2 messages logged, got %q.", logger.logs)
+	}
+	id := topic.Handle.ID()
+	if len(id) != 16 || !strings.HasPrefix(logger.logs[0], "info Ignoring") || !strings.Contains(logger.logs[0], "handle="+id) {
+		t.Fatalf("Handle was not logged by its ID: %q", logger.logs[0])
+	}
+	for _, secret := range [][]byte{topic.Handle.SharedSecret[:], topic.Handle.SigningPublicKey[:]} {
+		if strings.Contains(id, fmt.Sprintf("%x", secret[:8])) {
+			t.Fatal("Handle ID reveals its keys.")
+		}
+	}
+	if !strings.HasPrefix(logger.logs[1], "warn ") {
+		t.Fatalf("Event was not logged as a warning: %q", logger.logs[1])
+	}
+}
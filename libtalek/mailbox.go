@@ -0,0 +1,367 @@
+package libtalek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/agl/ed25519"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/securemem"
+)
+
+// Letter kinds deposited into a mailbox.
+const (
+	// LetterIntroduction is a first contact, typically carrying a way to reply.
+	LetterIntroduction byte = 1
+	// LetterMessage is a regular message from a known contact.
+	LetterMessage byte = 2
+	// LetterForwarded is a message a Gateway forwards on behalf of its
+	// sender, who is named in the letter.
+	LetterForwarded byte = 3
+	// LetterBounce tells the sender of a message submitted to a Gateway that
+	// it could not be delivered.
+	LetterBounce byte = 4
+)
+
+// intakeLabel derives the shared intake lane of a mailbox.
+const intakeLabel = "intake"
+
+// Letter is a message received through a Mailbox, tagged with its sender.
+// The sender of an introduction is the name claimed by the introducer, while
+// other letters are from the contact whose lane they arrived on.
+type Letter struct {
+	From string
+	Kind byte
+	Data []byte
+}
+
+// Mailbox is a long-lived, addressable inbox built from topics.
+// Because a topic only supports a single writer, each contact of the mailbox
+// is given their own write stub (a Topic) derived from the mailbox secret.
+// Strangers use a shared intake stub to introduce themselves. The owner polls
+// all lanes, and receives letters demultiplexed by sender.
+type Mailbox struct {
+	// Secret from which all lanes are derived.
+	Secret []byte
+
+	// Read handles of each contact lane, by contact name.
+	Lanes map[string]*Handle
+
+	// Generation of each contact's lane, advanced when the contact is revoked
+	// so that stubs issued before then stay dead.
+	Generations map[string]uint32
+
+	// Read handle of the shared intake lane.
+	Intake *Handle
+
+	mu        sync.Mutex
+	transport topicTransport
+	polling   map[*Handle]chan struct{}
+	updates   chan *Letter
+}
+
+// MailboxStub is the write capability given to a contact of a mailbox.
+// The intake stub has no Name.
+type MailboxStub struct {
+	Name  string
+	Topic *Topic
+}
+
+// NewMailbox creates a new, empty mailbox.
+func NewMailbox() (*Mailbox, error) {
+	mb := &Mailbox{}
+	mb.Secret = make([]byte, 32)
+	if _, err := rand.Read(mb.Secret); err != nil {
+		return nil, err
+	}
+	mb.Lanes = make(map[string]*Handle)
+	mb.Generations = make(map[string]uint32)
+	intake, err := deriveLane(mb.Secret, intakeLabel)
+	if err != nil {
+		return nil, err
+	}
+	mb.Intake = laneHandle(intake)
+	intake.Free()
+	return mb, nil
+}
+
+// NewStub issues the write stub for a contact. Issuing a stub for the same
+// contact again returns the same capability, positioned at the next letter
+// the owner will read, so stubs can be re-sent.
+func (mb *Mailbox) NewStub(contact string) (*MailboxStub, error) {
+	if contact == "" {
+		return nil, errors.New("contacts must be named")
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	t, err := deriveLane(mb.Secret, contactLabel(contact, mb.Generations[contact]))
+	if err != nil {
+		return nil, err
+	}
+	lane, ok := mb.Lanes[contact]
+	if !ok {
+		lane = laneHandle(t)
+		mb.Lanes[contact] = lane
+	}
+	t.Seqno = lane.Seqno
+	return &MailboxStub{contact, t}, nil
+}
+
+// IntakeStub issues the shared stub through which anyone may deposit an
+// introduction with Client.Introduce. Introducers share a single log, so
+// concurrent introductions may land in the same slot, in which case the owner
+// receives only one of them. Introductions are therefore best effort: an
+// introducer should retry if it gets no reply, and fetch a fresh stub, which
+// starts at the next letter the owner will read.
+func (mb *Mailbox) IntakeStub() (*MailboxStub, error) {
+	t, err := deriveLane(mb.Secret, intakeLabel)
+	if err != nil {
+		return nil, err
+	}
+	mb.mu.Lock()
+	t.Seqno = mb.Intake.Seqno
+	mb.mu.Unlock()
+	return &MailboxStub{"", t}, nil
+}
+
+// Revoke stops receiving letters from a contact. Stubs issued to the contact
+// so far are no longer read, and a stub issued to them afterwards is a new
+// capability.
+func (mb *Mailbox) Revoke(contact string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	lane, ok := mb.Lanes[contact]
+	if !ok {
+		return
+	}
+	delete(mb.Lanes, contact)
+	mb.Generations[contact]++
+	mb.stopLane(lane)
+	// A read of the lane made before it was stopped may still be answered.
+	if mb.transport != nil {
+		mb.transport.snapshot(lane.Free)
+	} else {
+		lane.Free()
+	}
+}
+
+type mailbox struct {
+	Secret      []byte
+	Lanes       map[string]*Handle
+	Generations map[string]uint32
+	Intake      *Handle
+}
+
+// MarshalText serializes a mailbox, including the position of each lane.
+func (mb *Mailbox) MarshalText() ([]byte, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return json.Marshal(mailbox{mb.Secret, mb.Lanes, mb.Generations, mb.Intake})
+}
+
+// UnmarshalText restores a mailbox from its serialized form.
+func (mb *Mailbox) UnmarshalText(text []byte) error {
+	var m mailbox
+	if err := json.Unmarshal(text, &m); err != nil {
+		return err
+	}
+	if len(m.Secret) != 32 || m.Intake == nil {
+		return errors.New("invalid mailbox")
+	}
+	mb.Secret = m.Secret
+	mb.Lanes = m.Lanes
+	if mb.Lanes == nil {
+		mb.Lanes = make(map[string]*Handle)
+	}
+	mb.Generations = m.Generations
+	if mb.Generations == nil {
+		mb.Generations = make(map[string]uint32)
+	}
+	mb.Intake = m.Intake
+	return nil
+}
+
+// PollMailbox begins reading all lanes of a mailbox, returning a channel of
+// letters tagged with their sender. Calling PollMailbox again after issuing
+// new stubs starts polling the new lanes on the same channel.
+func (c *Client) PollMailbox(mb *Mailbox) chan *Letter {
+	return mb.poll(c)
+}
+
+// DoneMailbox stops polling all lanes of a mailbox.
+func (c *Client) DoneMailbox(mb *Mailbox) {
+	mb.done()
+}
+
+// Deposit writes a letter into a mailbox using a stub issued by its owner.
+func (c *Client) Deposit(stub *MailboxStub, kind byte, data []byte) error {
+	return deposit(c, stub, kind, data)
+}
+
+// Introduce deposits an introduction into a mailbox through its intake stub,
+// naming the introducer.
+func (c *Client) Introduce(stub *MailboxStub, from string, data []byte) error {
+	return introduce(c, stub, from, data)
+}
+
+func deposit(transport topicTransport, stub *MailboxStub, kind byte, data []byte) error {
+	if stub.Name == "" {
+		return errors.New("the intake stub only carries introductions")
+	}
+	return transport.Publish(stub.Topic, append([]byte{kind}, data...))
+}
+
+func introduce(transport topicTransport, stub *MailboxStub, from string, data []byte) error {
+	if stub.Name != "" {
+		return errors.New("introductions are made through the intake stub")
+	}
+	if len(from) > 255 {
+		return errors.New("introducer name too long")
+	}
+	letter := make([]byte, 0, 2+len(from)+len(data))
+	letter = append(letter, LetterIntroduction, byte(len(from)))
+	letter = append(letter, from...)
+	letter = append(letter, data...)
+	return transport.Publish(stub.Topic, letter)
+}
+
+func (mb *Mailbox) poll(transport topicTransport) chan *Letter {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.updates == nil {
+		mb.updates = make(chan *Letter)
+		mb.polling = make(map[*Handle]chan struct{})
+	}
+	mb.transport = transport
+	mb.pollLane("", mb.Intake)
+	for contact, lane := range mb.Lanes {
+		mb.pollLane(contact, lane)
+	}
+	return mb.updates
+}
+
+// pollLane starts reading a lane, unless it is already read. mb.mu must be held.
+func (mb *Mailbox) pollLane(contact string, lane *Handle) {
+	if lane == nil {
+		return
+	}
+	if _, ok := mb.polling[lane]; ok {
+		return
+	}
+	msgs := mb.transport.Poll(lane)
+	if msgs == nil {
+		return
+	}
+	stop := make(chan struct{})
+	mb.polling[lane] = stop
+	go demuxLane(mb.updates, contact, msgs, stop)
+}
+
+// stopLane stops reading a lane. mb.mu must be held.
+func (mb *Mailbox) stopLane(lane *Handle) {
+	stop, ok := mb.polling[lane]
+	if !ok {
+		return
+	}
+	close(stop)
+	delete(mb.polling, lane)
+	mb.transport.Done(lane)
+}
+
+func (mb *Mailbox) done() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for lane := range mb.polling {
+		mb.stopLane(lane)
+	}
+}
+
+// demuxLane forwards letters from a lane until stopped. Letters on the intake
+// lane, read for contact "", must be introductions naming their sender.
+func demuxLane(updates chan *Letter, contact string, msgs chan []byte, stop chan struct{}) {
+	for {
+		var msg []byte
+		select {
+		case msg = <-msgs:
+		case <-stop:
+			return
+		}
+
+		var letter *Letter
+		if contact != "" && len(msg) >= 1 {
+			letter = &Letter{From: contact, Kind: msg[0], Data: msg[1:]}
+		} else if contact == "" && len(msg) >= 2 && msg[0] == LetterIntroduction && len(msg) >= 2+int(msg[1]) {
+			letter = &Letter{From: string(msg[2 : 2+msg[1]]), Kind: LetterIntroduction, Data: msg[2+msg[1]:]}
+		}
+		if letter == nil {
+			continue
+		}
+
+		select {
+		case updates <- letter:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// contactLabel derives the lane of a contact at a generation.
+func contactLabel(contact string, generation uint32) string {
+	var gen [4]byte
+	binary.BigEndian.PutUint32(gen[:], generation)
+	return "contact" + string(gen[:]) + contact
+}
+
+// laneHandle creates the owner's read handle for a lane.
+func laneHandle(t *Topic) *Handle {
+	h := t.Handle
+	// Do not share notification channels or keys with the writer's copy, so
+	// each can be freed alone.
+	h.updates = nil
+	h.done = nil
+	h.SharedSecret = securemem.Key32()
+	*h.SharedSecret = *t.Handle.SharedSecret
+	return &h
+}
+
+// deriveLane deterministically creates the topic of a lane of a mailbox.
+func deriveLane(secret []byte, lane string) (*Topic, error) {
+	derive := func(label string) []byte {
+		hash := sha256.New()
+		hash.Write(secret)
+		hash.Write([]byte(label))
+		hash.Write([]byte{0})
+		hash.Write([]byte(lane))
+		return hash.Sum(nil)
+	}
+
+	t := &Topic{}
+	t.Handle.Seed1 = &drbg.Seed{}
+	if err := t.Handle.Seed1.UnmarshalBinary(derive("seed1")[0:drbg.SeedLength]); err != nil {
+		return nil, err
+	}
+	t.Handle.Seed2 = &drbg.Seed{}
+	if err := t.Handle.Seed2.UnmarshalBinary(derive("seed2")[0:drbg.SeedLength]); err != nil {
+		return nil, err
+	}
+	if err := initHandle(&t.Handle); err != nil {
+		return nil, err
+	}
+
+	t.Handle.SharedSecret = securemem.Key32()
+	copy(t.Handle.SharedSecret[:], derive("shared"))
+
+	var signingKey *[64]byte
+	var err error
+	t.Handle.SigningPublicKey, signingKey, err = ed25519.GenerateKey(bytes.NewReader(derive("signing")))
+	if err != nil {
+		return nil, err
+	}
+	t.SigningPrivateKey = secureSigningKey(signingKey)
+	return t, nil
+}
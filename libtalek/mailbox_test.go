@@ -0,0 +1,142 @@
+package libtalek
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMailboxStubs(t *testing.T) {
+	mb, err := NewMailbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := mb.NewStub("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := mb.NewStub("alice")
+	if !Equal(&alice.Topic.Handle, &again.Topic.Handle) ||
+		!bytes.Equal(alice.Topic.SigningPrivateKey[:], again.Topic.SigningPrivateKey[:]) {
+		t.Fatal("Re-issued stubs should be identical.")
+	}
+	bob, _ := mb.NewStub("bob")
+	if Equal(&alice.Topic.Handle, &bob.Topic.Handle) {
+		t.Fatal("Contacts should have distinct lanes.")
+	}
+
+	// A stub's messages are readable through the owner's lane.
+	var nonce [24]byte
+	ciphertext, _ := alice.Topic.encrypt([]byte("hi"), &nonce)
+	if _, err = mb.Lanes["alice"].Decrypt(ciphertext, &nonce); err != nil {
+		t.Fatalf("Owner could not read lane: %v", err)
+	}
+
+	txt, err := mb.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := &Mailbox{}
+	if err = clone.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	if len(clone.Lanes) != 2 || !Equal(clone.Lanes["bob"], mb.Lanes["bob"]) {
+		t.Fatal("Mailbox serialization lost lanes.")
+	}
+
+	lane := mb.Lanes["bob"]
+	mb.Revoke("bob")
+	if _, ok := mb.Lanes["bob"]; ok {
+		t.Fatal("Revoked lane still present.")
+	}
+	if lane.SharedSecret != nil || bob.Topic.SharedSecret == nil {
+		t.Fatal("Revoking a lane should free its keys, and only its own.")
+	}
+	reissued, _ := mb.NewStub("bob")
+	if Equal(&reissued.Topic.Handle, &bob.Topic.Handle) {
+		t.Fatal("Stub issued after revocation should be a new capability.")
+	}
+
+	if _, err = mb.NewStub(""); err == nil {
+		t.Fatal("Contacts should be named.")
+	}
+}
+
+func expectLetter(t *testing.T, letters chan *Letter) *Letter {
+	select {
+	case l := <-letters:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a letter.")
+	}
+	return nil
+}
+
+func TestMailboxDelivery(t *testing.T) {
+	bus := newMemoryBus()
+	mb, _ := NewMailbox()
+	alice, _ := mb.NewStub("alice")
+	letters := mb.poll(bus)
+
+	if err := deposit(bus, alice, LetterMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	l := expectLetter(t, letters)
+	if l.From != "alice" || l.Kind != LetterMessage || string(l.Data) != "hi" {
+		t.Fatalf("Unexpected letter %v", l)
+	}
+
+	// Strangers introduce themselves through the intake stub.
+	intake, _ := mb.IntakeStub()
+	if err := deposit(bus, intake, LetterMessage, []byte("hi")); err == nil {
+		t.Fatal("Intake stub should only carry introductions.")
+	}
+	if err := introduce(bus, intake, "carol", []byte("reply handle")); err != nil {
+		t.Fatal(err)
+	}
+	l = expectLetter(t, letters)
+	if l.From != "carol" || l.Kind != LetterIntroduction || string(l.Data) != "reply handle" {
+		t.Fatalf("Unexpected introduction %v", l)
+	}
+
+	// A re-sent stub starts at the owner's read position.
+	again, _ := mb.NewStub("alice")
+	if again.Topic.Seqno != 1 {
+		t.Fatalf("Re-sent stub should continue after read letters, was at %d", again.Topic.Seqno)
+	}
+
+	// Polling again does not duplicate delivery.
+	mb.poll(bus)
+	deposit(bus, again, LetterMessage, []byte("once"))
+	if l = expectLetter(t, letters); string(l.Data) != "once" {
+		t.Fatalf("Unexpected letter %v", l)
+	}
+	select {
+	case l = <-letters:
+		t.Fatalf("Letter delivered twice: %v", l)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Nothing arrives from a revoked contact.
+	mb.Revoke("alice")
+	deposit(bus, again, LetterMessage, []byte("revoked"))
+	select {
+	case l = <-letters:
+		t.Fatalf("Received letter after revocation: %v", l)
+	case <-time.After(100 * time.Millisecond):
+	}
+	bus.mu.Lock()
+	polled := len(bus.polls)
+	bus.mu.Unlock()
+	if polled != 1 {
+		t.Fatalf("Only the intake lane should still be polled, found %d lanes", polled)
+	}
+
+	mb.done()
+	bus.mu.Lock()
+	polled = len(bus.polls)
+	bus.mu.Unlock()
+	if polled != 0 {
+		t.Fatal("Lanes still polled after DoneMailbox.")
+	}
+}
@@ -7,6 +7,8 @@ import "encoding/binary"
 // being sent to the application.
 type message struct {
 	contents []byte
+	// Scheme the contents are padded with
+	padding Padding
 
 	// TODO: there's a cute data structure for efficiently tracking out of order
 	// receipt of messages. This is not that.
@@ -16,6 +18,10 @@ type message struct {
 // fragmentHeaderLength encodes the length of a message fragment header
 const fragmentHeaderLength = 5
 
+// fragmentPaddingShift is the shift of the padding scheme of a message in the
+// flag of its first fragment.
+const fragmentPaddingShift = 1
+
 // fragmentHeader encodes the header of each wire fragment a message is split into.
 type fragmentHeader struct {
 	flag byte
@@ -38,11 +44,16 @@ func (f *fragmentHeader) IsNewMessage() bool {
 	return (f.flag & 1) == 1
 }
 
-func newFragment(firstFragment bool, remainingLength uint32) *fragmentHeader {
+// Padding is the padding scheme of the message a first fragment begins.
+func (f *fragmentHeader) Padding() Padding {
+	return Padding(f.flag >> fragmentPaddingShift)
+}
+
+func newFragment(firstFragment bool, remainingLength uint32, padding Padding) *fragmentHeader {
 	f := new(fragmentHeader)
 	f.left = remainingLength
 	if firstFragment {
-		f.flag |= 1
+		f.flag |= 1 | byte(padding)<<fragmentPaddingShift
 	}
 	return f
 }
@@ -61,20 +72,27 @@ func newMessage(msg []byte) *message {
 	return m
 }
 
+// newPaddedMessage creates a message from an underlying byte slice, padded
+// with a scheme to be split into at most maxParts parts of partSize.
+func newPaddedMessage(msg []byte, padding Padding, partSize int, maxParts int) (*message, error) {
+	padded, err := padding.pad(msg, partSize, maxParts)
+	if err != nil {
+		return nil, err
+	}
+	m := newMessage(padded)
+	m.padding = padding
+	return m, nil
+}
+
 // Split divides a full message into a set of parts no larger than partSize.
 func (m *message) Split(partSize int) [][]byte {
-	denom := (partSize - fragmentHeaderLength)
-	numMsgs := len(m.contents) / denom
-	if len(m.contents)%denom != 0 {
-		numMsgs++
-	}
-	messages := make([][]byte, numMsgs)
+	messages := make([][]byte, m.parts(partSize))
 
 	contentLength := len(m.contents)
 	remaining := len(m.contents)
 	for i := 0; i < len(messages); i++ {
 		part := make([]byte, partSize)
-		header := newFragment(i == 0, uint32(remaining))
+		header := newFragment(i == 0, uint32(remaining), m.padding)
 		header.ToBytes(part)
 		remaining -= copy(part[fragmentHeaderLength:], m.contents[contentLength-remaining:])
 
@@ -84,6 +102,16 @@ func (m *message) Split(partSize int) [][]byte {
 	return messages
 }
 
+// parts returns how many parts of partSize the message is split into.
+func (m *message) parts(partSize int) int {
+	denom := (partSize - fragmentHeaderLength)
+	numMsgs := len(m.contents) / denom
+	if len(m.contents)%denom != 0 {
+		numMsgs++
+	}
+	return numMsgs
+}
+
 // Join Adds a newly received part to a partially reconstructed message
 func (m *message) Join(part []byte) bool {
 	header := fromBytes(part)
@@ -92,6 +120,7 @@ func (m *message) Join(part []byte) bool {
 	}
 	if header.IsNewMessage() && m.receivedEnd == 0 {
 		m.contents = make([]byte, header.left)
+		m.padding = header.Padding()
 	}
 	if len(m.contents)-int(m.receivedEnd) != int(header.left) {
 		return false
@@ -108,3 +137,13 @@ func (m *message) Retrieve() []byte {
 	}
 	return nil
 }
+
+// Unpadded provides the bytes of a message when known, with its padding
+// removed.
+func (m *message) Unpadded() ([]byte, error) {
+	contents := m.Retrieve()
+	if contents == nil {
+		return nil, nil
+	}
+	return m.padding.unpad(contents)
+}
@@ -0,0 +1,124 @@
+package libtalek
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Padding is a scheme padding the messages published to a topic. Every item
+// is DataSize bytes, so only the number of items a message is split into
+// leaks its length; padding decides how much. The scheme is carried in the
+// header of a message's first item, so readers remove it without knowing
+// which a topic uses.
+type Padding byte
+
+const (
+	// PadZero fills the last item of a message with zeros, so the number of
+	// items reveals the length of the message to within an item.
+	PadZero Padding = iota
+	// PadISO7816 ends a message with a 0x80 byte, and fills its last item
+	// with zeros, as ISO/IEC 7816-4 pads blocks.
+	PadISO7816
+	// PadPADME pads the length of a message as PADMÉ does, to one with few
+	// significant bits, before padding it as PadISO7816. A fragmented
+	// message reveals little more than the magnitude of its length, for at
+	// most 12% more items.
+	PadPADME
+
+	numPaddings
+)
+
+// paddingMarker ends the content of messages padded as ISO/IEC 7816-4.
+const paddingMarker = 0x80
+
+var errMalformedPadding = errors.New("malformed padding")
+
+// String returns the name of a padding scheme.
+func (p Padding) String() string {
+	switch p {
+	case PadZero:
+		return "zero"
+	case PadISO7816:
+		return "iso7816"
+	case PadPADME:
+		return "padme"
+	}
+	return fmt.Sprintf("padding(%d)", byte(p))
+}
+
+// MarshalText encodes a padding scheme by its name.
+func (p Padding) MarshalText() ([]byte, error) {
+	if p >= numPaddings {
+		return nil, fmt.Errorf("unknown padding %d", byte(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes a padding scheme by its name.
+func (p *Padding) UnmarshalText(text []byte) error {
+	for q := PadZero; q < numPaddings; q++ {
+		if q.String() == string(text) {
+			*p = q
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown padding %q", text)
+}
+
+// pad pads a message to be split into parts of partSize, of which it may take
+// at most maxParts.
+func (p Padding) pad(msg []byte, partSize int, maxParts int) ([]byte, error) {
+	switch p {
+	case PadZero:
+		return msg, nil
+	case PadISO7816, PadPADME:
+	default:
+		return nil, fmt.Errorf("unknown padding %d", byte(p))
+	}
+	denom := partSize - fragmentHeaderLength
+	length := len(msg) + 1
+	if p == PadPADME {
+		length = padme(length)
+		if max := denom * maxParts; length > max && len(msg) < max {
+			length = max
+		}
+	}
+	if rem := length % denom; rem != 0 {
+		length += denom - rem
+	}
+	padded := make([]byte, length)
+	copy(padded, msg)
+	padded[len(msg)] = paddingMarker
+	return padded, nil
+}
+
+// unpad removes the padding of a reassembled message.
+func (p Padding) unpad(msg []byte) ([]byte, error) {
+	switch p {
+	case PadZero:
+		return msg, nil
+	case PadISO7816, PadPADME:
+		for i := len(msg) - 1; i >= 0; i-- {
+			if msg[i] == paddingMarker {
+				return msg[:i], nil
+			} else if msg[i] != 0 {
+				break
+			}
+		}
+		return nil, errMalformedPadding
+	}
+	return nil, fmt.Errorf("unknown padding %d", byte(p))
+}
+
+// padme rounds a length up as PADMÉ does, clearing all but the
+// log2(log2(length))+1 most significant bits.
+func padme(length int) int {
+	if length < 2 {
+		return length
+	}
+	e := bits.Len(uint(length)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<uint(e-s) - 1
+	return (length + mask) &^ mask
+}
@@ -0,0 +1,62 @@
+package libtalek
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+	const partSize = 64
+	for p := PadZero; p < numPaddings; p++ {
+		for _, length := range []int{0, 1, 58, 59, 200, 1000} {
+			data := bytes.Repeat([]byte{0}, length)
+			msg, err := newPaddedMessage(data, p, partSize, 64)
+			if err != nil {
+				t.Fatalf("Could not pad %d bytes with %v: %v", length, p, err)
+			}
+			recon := message{}
+			for i, part := range msg.Split(partSize) {
+				if len(part) != partSize {
+					t.Fatalf("Part %d of %d bytes with %v is %d bytes.", i, length, p, len(part))
+				}
+				recon.Join(part)
+			}
+			unpadded, err := recon.Unpadded()
+			if err != nil || !bytes.Equal(unpadded, data) {
+				t.Fatalf("%d bytes padded with %v were read as %d: %v", length, p, len(unpadded), err)
+			}
+		}
+	}
+}
+
+func TestPaddingItems(t *testing.T) {
+	const partSize = 69 // Parts carrying 64 bytes
+	items := func(p Padding, length int, maxParts int) int {
+		msg, err := newPaddedMessage(make([]byte, length), p, partSize, maxParts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.parts(partSize)
+	}
+	if n := items(PadZero, 64, 128); n != 1 {
+		t.Fatalf("Zero padded full item took %d items.", n)
+	}
+	if n := items(PadISO7816, 64, 128); n != 2 {
+		t.Fatalf("ISO 7816 padded full item took %d items, without room for its marker.", n)
+	}
+	// PADMÉ pads messages of 65 to 68 items alike.
+	if a, b := items(PadPADME, 65*64-1, 128), items(PadPADME, 67*64-1, 128); a != 68 || b != 68 {
+		t.Fatalf("PADMÉ padded messages of 65 and 67 items to %d and %d.", a, b)
+	}
+	if n := items(PadPADME, 4400, 70); n != 70 {
+		t.Fatalf("PADMÉ padded a message past the most items allowed, to %d.", n)
+	}
+
+	var p Padding
+	if err := p.UnmarshalText([]byte("padme")); err != nil || p != PadPADME {
+		t.Fatalf("Could not parse padding: %v", err)
+	}
+	if _, err := PadISO7816.unpad([]byte{1, 0, 0}); err == nil {
+		t.Fatal("Padding without a marker was removed.")
+	}
+}
@@ -0,0 +1,77 @@
+package libtalek
+
+import (
+	"math"
+
+	"github.com/privacylab/talek/common"
+)
+
+// unacknowledged is the epoch of an item written by the client before the
+// frontend has acknowledged the write.
+const unacknowledged = math.MaxUint64
+
+// ownItem is an item the client wrote, by the ID of its topic and its
+// sequence number.
+type ownItem struct {
+	id    string
+	seqno uint64
+}
+
+// wrote notes an item the client is writing, with ReadYourWrites, so its
+// topic isn't polled for it before it can be read.
+func (c *Client) wrote(h *Handle, seqno uint64, args *common.WriteArgs) {
+	id := h.ID()
+	if !c.ReadYourWrites || id == "" {
+		return
+	}
+	c.handleMutex.Lock()
+	item := ownItem{id, seqno}
+	c.ownWrites[item] = unacknowledged
+	c.ownPending[args] = item
+	c.handleMutex.Unlock()
+}
+
+// acknowledged notes the final reply to a write of the client. An item
+// written can be read once an epoch after the one it was written in is read
+// from, while one whose write failed never will be.
+func (c *Client) acknowledged(args *common.WriteArgs, reply *common.WriteReply) {
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	item, ok := c.ownPending[args]
+	if !ok {
+		return
+	}
+	delete(c.ownPending, args)
+	if reply.Err != "" {
+		delete(c.ownWrites, item)
+	} else {
+		c.ownWrites[item] = reply.Epoch
+	}
+}
+
+// observeEpoch notes the epoch a read was answered in, forgetting the items
+// of the client which can now be read.
+func (c *Client) observeEpoch(epoch uint64) {
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	if epoch <= c.readEpoch {
+		return
+	}
+	c.readEpoch = epoch
+	for item, written := range c.ownWrites {
+		if written < epoch {
+			delete(c.ownWrites, item)
+		}
+	}
+}
+
+// unreadable reports whether the next item of a handle was written by the
+// client in an epoch not yet read from, so polling it now would find nothing.
+// Called with handleMutex held.
+func (c *Client) unreadable(h *Handle) bool {
+	if len(c.ownWrites) == 0 {
+		return false
+	}
+	written, ok := c.ownWrites[ownItem{h.ID(), h.Seqno}]
+	return ok && written >= c.readEpoch
+}
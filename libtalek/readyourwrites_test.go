@@ -0,0 +1,58 @@
+package libtalek
+
+import (
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	c := newClient("TestReadYourWrites", groupTestConfig(), &mockLeader{})
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	c.ReadYourWrites = true
+	topic, _ := NewTopic()
+	txt, _ := topic.Handle.MarshalText()
+	reader, _ := NewHandle()
+	if err := reader.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewTopic()
+	c.Poll(reader)
+	c.Poll(&other.Handle)
+
+	polls := func() (n int) {
+		c.handleMutex.Lock()
+		defer c.handleMutex.Unlock()
+		for i := 0; i < 4; i++ {
+			if c.nextHandle() == reader {
+				n++
+			}
+		}
+		return n
+	}
+	writes, err := c.publish(topic, []byte("hello"), false)
+	if err != nil || len(writes) != 1 {
+		t.Fatalf("Could not publish: %v", err)
+	}
+	if n := polls(); n != 0 {
+		t.Fatalf("Item written was polled %d times before it was acknowledged.", n)
+	}
+	c.acknowledged(writes[0], &common.WriteReply{Epoch: 2})
+	c.observeEpoch(2)
+	if n := polls(); n != 0 {
+		t.Fatalf("Item written was polled %d times before its epoch was sealed.", n)
+	}
+	c.observeEpoch(3)
+	if n := polls(); n != 2 {
+		t.Fatalf("Item written was polled %d of 4 times once readable.", n)
+	}
+
+	// Items whose writes fail are not waited for.
+	writes, _ = c.publish(topic, []byte("again"), false)
+	c.acknowledged(writes[0], &common.WriteReply{Err: "failed"})
+	if len(c.ownWrites) != 0 || len(c.ownPending) != 0 {
+		t.Fatalf("Failed write is still waited for: %v", c.ownWrites)
+	}
+}
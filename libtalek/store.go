@@ -0,0 +1,298 @@
+package libtalek
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/privacylab/talek/securemem"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Store is the persistence interface used by clients to keep serialized
+// Topics and Handles between runs. Values are opaque byte strings, keyed by
+// a name chosen by the application.
+type Store interface {
+	Get(name string) ([]byte, error)
+	Put(name string, value []byte) error
+	Delete(name string) error
+}
+
+// ErrNotFound is returned by a Store when no value exists for a name.
+var ErrNotFound = errors.New("no stored value with that name")
+
+// ErrWrongKey is returned by an EncryptedStore when a value cannot be
+// authenticated, either because the key is wrong or the value was modified.
+var ErrWrongKey = errors.New("stored value could not be decrypted")
+
+// SaveTopic serializes a topic into a store.
+func SaveTopic(s Store, name string, t *Topic) error {
+	txt, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.Put(name, txt)
+}
+
+// LoadTopic restores a topic previously saved with SaveTopic.
+func LoadTopic(s Store, name string) (*Topic, error) {
+	txt, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	t := &Topic{}
+	if err = t.UnmarshalText(txt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SaveHandle serializes a handle into a store.
+func SaveHandle(s Store, name string, h *Handle) error {
+	txt, err := h.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.Put(name, txt)
+}
+
+// LoadHandle restores a handle previously saved with SaveHandle.
+func LoadHandle(s Store, name string) (*Handle, error) {
+	txt, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handle{}
+	if err = h.UnmarshalText(txt); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+/********************
+ * File backed store
+ ********************/
+
+// FileStore is a Store keeping one file per name in a directory.
+// Values are written in the clear; wrap a FileStore in an EncryptedStore
+// to protect them at rest.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a FileStore rooted at dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir}, nil
+}
+
+func (f *FileStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return "", errors.New("invalid store name")
+	}
+	return filepath.Join(f.dir, name), nil
+}
+
+// Get reads the value stored under name.
+func (f *FileStore) Get(name string) ([]byte, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return dat, err
+}
+
+// Put replaces the value stored under name.
+func (f *FileStore) Put(name string, value []byte) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a torn value.
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, value, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Delete removes the value stored under name.
+func (f *FileStore) Delete(name string) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+/********************
+ * Encrypted store
+ ********************/
+
+// Sealed values begin with a version byte identifying how their key is found.
+const (
+	// sealedWithKey values are sealed directly with the store key.
+	sealedWithKey = 1
+	// sealedWithPassphrase values carry the scrypt salt their key is derived with.
+	sealedWithPassphrase = 2
+)
+
+// saltLength is the size of the scrypt salt in passphrase sealed values.
+const saltLength = 32
+
+// scrypt parameters for passphrase derived keys.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// EncryptedStore wraps another Store, sealing each value with
+// NaCl secretbox so that topics and handles are not kept on disk as plaintext
+// capabilities. The name of each value is authenticated along with it, so
+// values cannot be swapped between names.
+type EncryptedStore struct {
+	backing Store
+	key     [32]byte
+
+	// Set for passphrase stores. Each sealed value carries its own salt, so
+	// values remain readable when copied without the rest of the store.
+	passphrase []byte
+	salt       []byte
+	keyMutex   sync.Mutex
+	keys       map[string]*[32]byte
+}
+
+// NewEncryptedStore wraps backing using a caller provided 32 byte key, e.g. one
+// retrieved from an OS keychain.
+func NewEncryptedStore(backing Store, key *[32]byte) *EncryptedStore {
+	e := &EncryptedStore{backing: backing}
+	copy(e.key[:], key[:])
+	return e
+}
+
+// NewPassphraseStore wraps backing using keys derived from passphrase with
+// scrypt. Values are written with a fresh random salt, stored in their header.
+func NewPassphraseStore(backing Store, passphrase []byte) (*EncryptedStore, error) {
+	e := &EncryptedStore{backing: backing}
+	e.passphrase = append([]byte{}, passphrase...)
+	e.keys = make(map[string]*[32]byte)
+	e.salt = make([]byte, saltLength)
+	if _, err := rand.Read(e.salt); err != nil {
+		return nil, err
+	}
+	key, err := e.saltedKey(e.salt)
+	if err != nil {
+		return nil, err
+	}
+	copy(e.key[:], key[:])
+	return e, nil
+}
+
+// IsEncrypted reports whether a stored value was sealed by an EncryptedStore.
+// Serialized topics and handles are text, and never begin with a version byte.
+func IsEncrypted(value []byte) bool {
+	return len(value) > 0 && (value[0] == sealedWithKey || value[0] == sealedWithPassphrase)
+}
+
+// saltedKey derives the key for a salt, caching derivations since scrypt is slow.
+func (e *EncryptedStore) saltedKey(salt []byte) (*[32]byte, error) {
+	e.keyMutex.Lock()
+	defer e.keyMutex.Unlock()
+	if k, ok := e.keys[string(salt)]; ok {
+		return k, nil
+	}
+	key, err := scrypt.Key(e.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	k := securemem.Key32()
+	copy(k[:], key)
+	securemem.Wipe(key)
+	e.keys[string(salt)] = k
+	return k, nil
+}
+
+// Get retrieves and decrypts the value stored under name.
+func (e *EncryptedStore) Get(name string) ([]byte, error) {
+	sealed, err := e.backing.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1 {
+		return nil, ErrWrongKey
+	}
+
+	key := &e.key
+	body := sealed[1:]
+	switch {
+	case sealed[0] == sealedWithKey && e.passphrase == nil:
+	case sealed[0] == sealedWithPassphrase && e.passphrase != nil:
+		if len(body) < saltLength {
+			return nil, ErrWrongKey
+		}
+		if key, err = e.saltedKey(body[:saltLength]); err != nil {
+			return nil, err
+		}
+		body = body[saltLength:]
+	default:
+		return nil, ErrWrongKey
+	}
+
+	if len(body) < 24+secretbox.Overhead {
+		return nil, ErrWrongKey
+	}
+	var nonce [24]byte
+	copy(nonce[:], body[0:24])
+	opened, ok := secretbox.Open(nil, body[24:], &nonce, key)
+	if !ok {
+		return nil, ErrWrongKey
+	}
+	// The plaintext is prefixed with the name it was stored under.
+	if len(opened) < len(name)+1 || string(opened[:len(name)]) != name || opened[len(name)] != 0 {
+		return nil, ErrWrongKey
+	}
+	return opened[len(name)+1:], nil
+}
+
+// Put encrypts and stores value under name.
+func (e *EncryptedStore) Put(name string, value []byte) error {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	plaintext := make([]byte, 0, len(name)+1+len(value))
+	plaintext = append(plaintext, name...)
+	plaintext = append(plaintext, 0)
+	plaintext = append(plaintext, value...)
+
+	sealed := make([]byte, 0, 1+saltLength+len(nonce)+len(plaintext)+secretbox.Overhead)
+	if e.passphrase != nil {
+		sealed = append(sealed, sealedWithPassphrase)
+		sealed = append(sealed, e.salt...)
+	} else {
+		sealed = append(sealed, sealedWithKey)
+	}
+	sealed = append(sealed, nonce[:]...)
+	sealed = secretbox.Seal(sealed, plaintext, &nonce, &e.key)
+	return e.backing.Put(name, sealed)
+}
+
+// Delete removes the value stored under name.
+func (e *EncryptedStore) Delete(name string) error {
+	return e.backing.Delete(name)
+}
@@ -0,0 +1,82 @@
+package libtalek
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPassphraseStore(fs, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic, _ := NewTopic()
+	if err = SaveTopic(store, "topic", topic); err != nil {
+		t.Fatalf("Failed to save topic: %v", err)
+	}
+
+	// The capability should not be visible on disk.
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, "topic"))
+	txt, _ := topic.MarshalText()
+	if bytes.Contains(raw, txt[0:32]) {
+		t.Fatalf("Topic was stored in the clear.")
+	}
+
+	clone, err := LoadTopic(store, "topic")
+	if err != nil {
+		t.Fatalf("Failed to load topic: %v", err)
+	}
+	if !bytes.Equal(topic.SigningPrivateKey[:], clone.SigningPrivateKey[:]) || !Equal(&topic.Handle, &clone.Handle) {
+		t.Fatalf("Store lost info!")
+	}
+
+	wrong, err := NewPassphraseStore(fs, []byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadTopic(wrong, "topic"); err != ErrWrongKey {
+		t.Fatalf("Wrong passphrase should not decrypt: %v", err)
+	}
+
+	// Values are bound to their name.
+	raw, _ = fs.Get("topic")
+	fs.Put("other", raw)
+	if _, err = store.Get("other"); err != ErrWrongKey {
+		t.Fatalf("Renamed value should not decrypt: %v", err)
+	}
+
+	if !IsEncrypted(raw) || IsEncrypted(txt) {
+		t.Fatalf("Sealed values should be distinguishable from plaintext.")
+	}
+
+	// Values remain readable when copied away from the rest of the store.
+	moved, err := ioutil.TempDir("", "talekstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	mfs, _ := NewFileStore(moved)
+	mfs.Put("topic", raw)
+	reopened, _ := NewPassphraseStore(mfs, []byte("correct horse"))
+	if _, err = LoadTopic(reopened, "topic"); err != nil {
+		t.Fatalf("Moved value could not be decrypted: %v", err)
+	}
+
+	if _, err = store.Get("missing"); err != ErrNotFound {
+		t.Fatalf("Expected missing value: %v", err)
+	}
+}
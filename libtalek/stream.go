@@ -0,0 +1,414 @@
+package libtalek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Segment flags
+const (
+	segData byte = 1 << iota
+	segFin
+)
+
+// segmentHeaderLength is the size of the header prefixed to stream segments:
+// flags (1), seq (4), ack (4), next slot (8)
+const segmentHeaderLength = 17
+
+// StreamWindow is the number of unacknowledged segments a Stream will have in flight.
+const StreamWindow = 8
+
+// streamTimeoutMultiple is how many write intervals pass without progress
+// before a stream retransmits or probes its peer.
+const streamTimeoutMultiple = 8
+
+// ErrStreamClosed is returned when using a Stream after it has been closed.
+var ErrStreamClosed = errors.New("stream closed")
+
+type streamTimeout struct{}
+
+func (streamTimeout) Error() string   { return "stream deadline exceeded" }
+func (streamTimeout) Timeout() bool   { return true }
+func (streamTimeout) Temporary() bool { return true }
+
+// streamAddr identifies a topic by a digest of its signing key.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "talek" }
+func (a streamAddr) String() string  { return string(a) }
+
+func handleAddr(h *Handle) streamAddr {
+	if h.SigningPublicKey == nil {
+		return streamAddr("")
+	}
+	digest := sha256.Sum256(h.SigningPublicKey[:])
+	return streamAddr(fmt.Sprintf("%x", digest[0:8]))
+}
+
+type segment struct {
+	flags   byte
+	seq     uint32
+	ack     uint32
+	next    uint64
+	payload []byte
+}
+
+func (s *segment) encode() []byte {
+	buf := make([]byte, segmentHeaderLength+len(s.payload))
+	buf[0] = s.flags
+	binary.LittleEndian.PutUint32(buf[1:5], s.seq)
+	binary.LittleEndian.PutUint32(buf[5:9], s.ack)
+	binary.LittleEndian.PutUint64(buf[9:17], s.next)
+	copy(buf[segmentHeaderLength:], s.payload)
+	return buf
+}
+
+func decodeSegment(buf []byte) *segment {
+	if len(buf) < segmentHeaderLength {
+		return nil
+	}
+	return &segment{
+		flags:   buf[0],
+		seq:     binary.LittleEndian.Uint32(buf[1:5]),
+		ack:     binary.LittleEndian.Uint32(buf[5:9]),
+		next:    binary.LittleEndian.Uint64(buf[9:17]),
+		payload: buf[segmentHeaderLength:],
+	}
+}
+
+// Stream is an ordered, reliable byte stream layered over a pair of topics:
+// one written by each end. It implements net.Conn, so request / response
+// protocols can run over Talek without their own framing.
+//
+// A slot lost on either topic would stall its reader, so each segment
+// carries the position its sender is reading from, and a writer whose peer
+// stops making progress re-publishes the segment in the slot the peer is
+// stuck on.
+type Stream struct {
+	transport  topicTransport
+	maxPayload int
+	timeout    time.Duration
+	out        *Topic
+	in         *Handle
+	incoming   chan []byte
+
+	// Held for the duration of a publish, ordering use of out.Seqno.
+	sendMu sync.Mutex
+	// Held across a Write so its segments are contiguous.
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Sending state
+	nextSeq uint32            // Sequence number of the next data segment
+	acked   uint32            // Data segments below this are acknowledged
+	history map[uint64][]byte // Published segments by slot, since the peer's position
+
+	// Receiving state
+	inNext       uint64 // Next slot of the incoming topic
+	expected     uint32 // Next data segment expected from the peer
+	readBuf      bytes.Buffer
+	peerNext     uint64 // Next slot of our topic the peer is reading
+	lastProgress time.Time
+	lastHeard    time.Time
+
+	closed        bool
+	peerClosed    bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	done          chan struct{}
+}
+
+// NewStream creates a stream writing to out and reading from in.
+// The other end of the stream should be created with a handle of out, and the
+// topic of in. Both topics must only be written through the stream.
+func NewStream(c *Client, out *Topic, in *Handle) (*Stream, error) {
+	base := c.config.Load().(ClientConfig)
+	config, err := base.inClass(out.Class)
+	if err != nil {
+		return nil, err
+	}
+	maxPayload := int(config.DataSize) - out.overhead() - fragmentHeaderLength - segmentHeaderLength
+	return newStream(c, maxPayload, config.WriteInterval*streamTimeoutMultiple, out, in)
+}
+
+func newStream(transport topicTransport, maxPayload int, timeout time.Duration, out *Topic, in *Handle) (*Stream, error) {
+	if maxPayload <= 0 {
+		return nil, errors.New("data size too small for stream segments")
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	s := &Stream{transport: transport, maxPayload: maxPayload, timeout: timeout, out: out, in: in}
+	s.cond = sync.NewCond(&s.mu)
+	s.history = make(map[uint64][]byte)
+	s.inNext = in.Seqno
+	s.peerNext = out.Seqno
+	s.lastProgress = time.Now()
+	s.lastHeard = time.Now()
+	s.done = make(chan struct{})
+
+	s.incoming = transport.Poll(in)
+	if s.incoming == nil {
+		return nil, errors.New("handle is already being polled")
+	}
+	go s.receive()
+	go s.maintain()
+	return s, nil
+}
+
+// send publishes a segment in the next slot of the outgoing topic.
+// s.mu must not be held, since publishing blocks while the client is backed up.
+func (s *Stream) send(seg *segment) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	seg.ack = s.expected
+	seg.next = s.inNext
+	s.mu.Unlock()
+
+	raw := seg.encode()
+	slot := s.out.Seqno
+	if err := s.transport.Publish(s.out, raw); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if slot >= s.peerNext {
+		s.history[slot] = raw
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Write sends b over the stream, blocking while the send window is full.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		for !s.closed && s.nextSeq-s.acked >= StreamWindow {
+			if !s.writeDeadline.IsZero() && time.Now().After(s.writeDeadline) {
+				s.mu.Unlock()
+				return written, streamTimeout{}
+			}
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		seq := s.nextSeq
+		s.nextSeq++
+		s.mu.Unlock()
+
+		end := written + s.maxPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := s.send(&segment{flags: segData, seq: seq, payload: b[written:end]}); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Read reads received stream data, blocking until some is available.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.readBuf.Len() == 0 {
+		if s.peerClosed {
+			return 0, io.EOF
+		}
+		if s.closed {
+			return 0, ErrStreamClosed
+		}
+		if !s.readDeadline.IsZero() && time.Now().After(s.readDeadline) {
+			return 0, streamTimeout{}
+		}
+		s.cond.Wait()
+	}
+	return s.readBuf.Read(b)
+}
+
+// Close ends the stream, notifying the peer. Segments still in flight are not
+// retransmitted once the stream is closed.
+func (s *Stream) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	fin := &segment{flags: segFin, seq: s.nextSeq}
+	s.mu.Unlock()
+	err := s.send(fin)
+
+	s.mu.Lock()
+	s.closed = true
+	close(s.done)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.transport.Done(s.in)
+	return err
+}
+
+// LocalAddr identifies the topic written by this end of the stream.
+func (s *Stream) LocalAddr() net.Addr {
+	return handleAddr(&s.out.Handle)
+}
+
+// RemoteAddr identifies the topic written by the other end of the stream.
+func (s *Stream) RemoteAddr() net.Addr {
+	return handleAddr(s.in)
+}
+
+// SetDeadline sets both read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets when pending and future reads time out.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+// SetWriteDeadline sets when pending and future writes time out.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes blocked readers and writers at t so they can observe deadlines.
+func (s *Stream) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+// receive processes segments arriving from the peer.
+func (s *Stream) receive() {
+	for {
+		select {
+		case msg, ok := <-s.incoming:
+			if !ok {
+				return
+			}
+			if s.onSegment(decodeSegment(msg)) {
+				s.send(&segment{})
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// onSegment applies a segment from the peer, returning whether it should be acknowledged.
+func (s *Stream) onSegment(seg *segment) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every message occupies one slot of the incoming topic, even if malformed.
+	s.inNext++
+	s.lastHeard = time.Now()
+	if seg == nil {
+		return false
+	}
+
+	if seg.next > s.peerNext {
+		s.peerNext = seg.next
+		s.lastProgress = time.Now()
+		for slot := range s.history {
+			if slot < s.peerNext {
+				delete(s.history, slot)
+			}
+		}
+	}
+	if seg.ack > s.acked && seg.ack <= s.nextSeq {
+		s.acked = seg.ack
+	}
+
+	needsAck := false
+	if seg.flags&segData != 0 {
+		needsAck = true
+		if seg.seq == s.expected {
+			s.readBuf.Write(seg.payload)
+			s.expected++
+		}
+	}
+	if seg.flags&segFin != 0 && seg.seq == s.expected {
+		s.peerClosed = true
+	}
+	s.cond.Broadcast()
+	return needsAck && !s.closed
+}
+
+// maintain re-publishes segments in slots the peer is stuck on, and probes a
+// silent peer so that it reports its position.
+func (s *Stream) maintain() {
+	ticker := time.NewTicker(s.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.sendMu.Lock()
+		s.mu.Lock()
+		now := time.Now()
+		var retry []byte
+		if s.peerNext < s.out.Seqno && now.Sub(s.lastProgress) > s.timeout {
+			retry = s.history[s.peerNext]
+			s.lastProgress = now
+		}
+		slot := s.peerNext
+		probe := now.Sub(s.lastHeard) > s.timeout
+		if probe {
+			s.lastHeard = now
+		}
+		s.mu.Unlock()
+		if retry != nil {
+			again := *s.out
+			again.Seqno = slot
+			s.transport.Publish(&again, retry)
+		}
+		s.sendMu.Unlock()
+
+		if probe {
+			s.send(&segment{})
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package libtalek
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/drbg"
+)
+
+// seedKey identifies a topic on the bus by its seed, shared by all its copies.
+func seedKey(seed *drbg.Seed) string {
+	b, _ := seed.MarshalBinary()
+	return string(b)
+}
+
+// memoryBus carries topic messages in memory, slot by slot, in place of a Client.
+type memoryBus struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	slots  map[string]map[uint64][]byte
+	lose   map[string]map[uint64]bool
+	polls  map[*Handle]chan struct{}
+	paused map[string]bool
+}
+
+func newMemoryBus() *memoryBus {
+	b := &memoryBus{
+		slots:  make(map[string]map[uint64][]byte),
+		lose:   make(map[string]map[uint64]bool),
+		polls:  make(map[*Handle]chan struct{}),
+		paused: make(map[string]bool),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// loseOnce drops the first write of a slot of a topic.
+func (b *memoryBus) loseOnce(t *Topic, slot uint64) {
+	b.mu.Lock()
+	if b.lose[seedKey(t.Seed1)] == nil {
+		b.lose[seedKey(t.Seed1)] = make(map[uint64]bool)
+	}
+	b.lose[seedKey(t.Seed1)][slot] = true
+	b.mu.Unlock()
+}
+
+// pause stops delivery of a topic's messages to readers.
+func (b *memoryBus) pause(t *Topic) {
+	b.mu.Lock()
+	b.paused[seedKey(t.Seed1)] = true
+	b.mu.Unlock()
+}
+
+func (b *memoryBus) Publish(t *Topic, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	slot := t.Seqno
+	t.Seqno++
+	if b.lose[seedKey(t.Seed1)][slot] {
+		delete(b.lose[seedKey(t.Seed1)], slot)
+		return nil
+	}
+	if b.slots[seedKey(t.Seed1)] == nil {
+		b.slots[seedKey(t.Seed1)] = make(map[uint64][]byte)
+	}
+	if _, ok := b.slots[seedKey(t.Seed1)][slot]; !ok {
+		b.slots[seedKey(t.Seed1)][slot] = append([]byte{}, data...)
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *memoryBus) Poll(h *Handle) chan []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.polls[h]; ok {
+		return nil
+	}
+	done := make(chan struct{})
+	b.polls[h] = done
+	updates := make(chan []byte)
+	go func() {
+		for pos := h.Seqno; ; pos++ {
+			b.mu.Lock()
+			var msg []byte
+			for {
+				select {
+				case <-done:
+					b.mu.Unlock()
+					return
+				default:
+				}
+				var ok bool
+				if msg, ok = b.slots[seedKey(h.Seed1)][pos]; ok && !b.paused[seedKey(h.Seed1)] {
+					break
+				}
+				b.cond.Wait()
+			}
+			// Like a client, advance the handle before delivering the message.
+			h.Seqno = pos + 1
+			b.mu.Unlock()
+			select {
+			case updates <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+func (b *memoryBus) Done(h *Handle) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	done, ok := b.polls[h]
+	if ok {
+		close(done)
+		delete(b.polls, h)
+		b.cond.Broadcast()
+	}
+	return ok
+}
+
+func (b *memoryBus) snapshot(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn()
+}
+
+// streamPair connects two streams over the bus.
+func streamPair(t *testing.T, bus *memoryBus, maxPayload int) (*Stream, *Stream, *Topic, *Topic) {
+	ab, _ := NewTopic()
+	ba, _ := NewTopic()
+	abHandle := ab.Handle
+	baHandle := ba.Handle
+	a, err := newStream(bus, maxPayload, 50*time.Millisecond, ab, &baHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newStream(bus, maxPayload, 50*time.Millisecond, ba, &abHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, ab, ba
+}
+
+func TestStreamExchange(t *testing.T) {
+	bus := newMemoryBus()
+	a, b, _, _ := streamPair(t, bus, 16)
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+	b.SetDeadline(time.Now().Add(10 * time.Second))
+
+	request := bytes.Repeat([]byte("request "), 20)
+	go func() {
+		a.Write(request)
+	}()
+	got := make([]byte, len(request))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+	if !bytes.Equal(got, request) {
+		t.Fatalf("Request corrupted: %s", got)
+	}
+
+	if _, err := b.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	reply, err := ioutil.ReadAll(a)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(reply) != "response" {
+		t.Fatalf("Unexpected response: %s", reply)
+	}
+	a.Close()
+
+	if a.LocalAddr().String() != b.RemoteAddr().String() || a.LocalAddr().String() == a.RemoteAddr().String() {
+		t.Fatal("Stream addresses should identify topics.")
+	}
+}
+
+func TestStreamLostSlot(t *testing.T) {
+	bus := newMemoryBus()
+	a, b, ab, _ := streamPair(t, bus, 16)
+	defer a.Close()
+	defer b.Close()
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// Lose the first data segment; the reader stalls on its slot until it is re-published.
+	bus.loseOnce(ab, ab.Seqno)
+	if _, err := a.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 11)
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("Lost slot was not recovered: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("Unexpected data: %s", got)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	bus := newMemoryBus()
+	a, b, _, ba := streamPair(t, bus, 4)
+	defer a.Close()
+	defer b.Close()
+
+	// Without acknowledgements, the writer stops after a window of segments.
+	bus.pause(ba)
+	a.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := a.Write(make([]byte, 4*(StreamWindow+2)))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected write timeout, got %v", err)
+	}
+	if n != 4*StreamWindow {
+		t.Fatalf("Expected a window of %d bytes written, got %d", 4*StreamWindow, n)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	bus := newMemoryBus()
+	a, b, _, _ := streamPair(t, bus, 16)
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := b.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected read timeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Read deadline not enforced promptly.")
+	}
+}
+
+func TestStreamDoublePoll(t *testing.T) {
+	bus := newMemoryBus()
+	topic, _ := NewTopic()
+	other, _ := NewTopic()
+	h := other.Handle
+	s, err := newStream(bus, 16, time.Second, topic, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = newStream(bus, 16, time.Second, topic, &h); err == nil {
+		t.Fatal("Stream should not share an already polled handle.")
+	}
+}
@@ -0,0 +1,41 @@
+package libtalek
+
+import (
+	"github.com/privacylab/talek/common"
+)
+
+// pollTier picks the tier the next poll of a handle reads. An item the
+// interest vector holds is recent, and read from the hot tier. Others are
+// read from the hot and cold tiers in turn, as an item may be recent but not
+// yet in the interest vector the client has. Handles of size classes other
+// than 0, and deployments without tiers, read the cold tier, which holds
+// every item. Called with handleMutex held.
+func (c *Client) pollTier(h *Handle, config *ClientConfig) {
+	h.tier = common.TierCold
+	if config.HotBuckets == 0 || h.Class != 0 {
+		return
+	}
+	if c.interestVector.Test(h.nextInterestVector()) {
+		h.tier = common.TierHot
+		return
+	}
+	h.coldTurn = !h.coldTurn
+	if !h.coldTurn {
+		h.tier = common.TierHot
+	}
+}
+
+// coverConfig returns the configuration of the tier the next cover read is
+// made of. With tiers, cover reads alternate between them, as the polls of
+// handles do. Used only by nextRequest.
+func (c *Client) coverConfig(config *ClientConfig) (*ClientConfig, uint8) {
+	if config.HotBuckets == 0 {
+		return config, common.TierCold
+	}
+	c.coverTier = common.TierHot - c.coverTier
+	conf, err := config.inTier(c.coverTier)
+	if err != nil {
+		return config, common.TierCold
+	}
+	return conf, c.coverTier
+}
@@ -0,0 +1,64 @@
+package libtalek
+
+import (
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestPollTiers(t *testing.T) {
+	config := groupTestConfig()
+	config.HotBuckets = 8
+	config.HotEpochs = 4
+	c := newClient("TestPollTiers", config, &mockLeader{})
+	if c == nil {
+		t.Fatal("Error creating client")
+	}
+	topic, _ := NewTopic()
+	h := &topic.Handle
+	bucket, _ := h.nextBuckets(config.Config)
+
+	// Items the interest vector lacks are polled from each tier in turn.
+	var tiers []uint8
+	for i := 0; i < 4; i++ {
+		c.pollTier(h, &config)
+		tiers = append(tiers, h.tier)
+	}
+	if tiers[0] == tiers[1] || tiers[0] != tiers[2] || tiers[1] != tiers[3] {
+		t.Fatalf("Polls did not alternate between tiers: %v.", tiers)
+	}
+
+	h.tier = common.TierHot
+	args, _, err := h.generatePoll(&config, c.Rand)
+	if err != nil {
+		t.Fatalf("Error polling the hot tier: %v", err)
+	}
+	if args.Tier != common.TierHot || args.Vectors.Length != 1 {
+		t.Fatalf("Poll of tier %d read %d bytes of buckets.", args.Tier, args.Vectors.Length)
+	}
+	if uint64(args.Bucket()) != bucket%8 {
+		t.Fatalf("Hot poll read bucket %d of item in bucket %d.", args.Bucket(), bucket)
+	}
+	conf, err := config.forRead(args)
+	if err != nil || conf.NumBuckets != 8 {
+		t.Fatalf("Reply to a hot poll is not read in the hot tier: %v.", err)
+	}
+
+	// Handles of other size classes read the cold tier.
+	h.Class = 1
+	c.pollTier(h, &config)
+	if h.tier != common.TierCold {
+		t.Fatal("Handle of class 1 polled the hot tier.")
+	}
+
+	// Cover reads alternate between tiers too.
+	first, second := c.generateRandomRead(&config), c.generateRandomRead(&config)
+	if first.Tier == second.Tier {
+		t.Fatalf("Cover reads were both of tier %d.", first.Tier)
+	}
+	for _, cover := range []*common.ReadArgs{first, second} {
+		if cover.Tier == common.TierHot && cover.Vectors.Length != 1 {
+			t.Fatalf("Hot cover read of %d bytes of buckets.", cover.Vectors.Length)
+		}
+	}
+}
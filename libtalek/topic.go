@@ -6,10 +6,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/agl/ed25519"
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/securemem"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -26,6 +29,10 @@ type Topic struct {
 	// TODO: this should ratchet.
 	SigningPrivateKey *[64]byte `json:",omitempty"`
 
+	// Scheme messages published to the topic are padded with. It is not
+	// part of the compact textual representation of the topic.
+	Padding Padding `json:",omitempty"`
+
 	Handle
 }
 
@@ -35,8 +42,6 @@ const PublishingOverhead = box.Overhead + ed25519.SignatureSize
 // NewTopic creates a new Topic, or fails if the system randomness isn't
 // appropriately configured.
 func NewTopic() (t *Topic, err error) {
-	t = &Topic{}
-
 	// Random values
 	id := make([]byte, 8)
 	if _, err = rand.Read(id); err != nil {
@@ -50,7 +55,82 @@ func NewTopic() (t *Topic, err error) {
 	if err != nil {
 		return
 	}
+	return newTopic(id, seed1, seed2, rand.Reader)
+}
+
+// NewDeniableTopic creates a new Topic whose items carry no signature, and are
+// sealed with keys that ratchet forward as it is written and read. An item is
+// indistinguishable from random to anyone without its key, which the topic
+// and its handles erase once the item is written or read, so holding them
+// later reveals nothing of earlier items. Deniable topics can't be derived
+// from a seed, which would derive the erased keys again.
+func NewDeniableTopic() (*Topic, error) {
+	t, err := NewTopic()
+	if err != nil {
+		return nil, err
+	}
+	t.Handle.ChainKey = new([32]byte)
+	if _, err = rand.Read(t.Handle.ChainKey[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewSymmetricTopic creates a new Topic whose items are in EnvelopeSymmetric,
+// carrying more of each message by leaving them unsigned. Its handle must be
+// given to one reader only, who could otherwise forge items for others.
+func NewSymmetricTopic() (*Topic, error) {
+	t, err := NewTopic()
+	if err != nil {
+		return nil, err
+	}
+	t.Handle.Envelope = EnvelopeSymmetric
+	return t, nil
+}
 
+// NewNoncedTopic creates a new Topic whose items are in EnvelopeNonced,
+// carrying the nonce each is sealed with. Its handles open items whatever
+// position their writer counted, so they keep reading after drifting from
+// the writer, and several writers holding the topic can write it.
+func NewNoncedTopic() (*Topic, error) {
+	t, err := NewTopic()
+	if err != nil {
+		return nil, err
+	}
+	t.Handle.Envelope = EnvelopeNonced
+	return t, nil
+}
+
+// NewTopicInClass creates a new Topic bound to a size class of the
+// configuration, whose items are of the DataSize of the class. Topics of
+// large messages are put in a class of larger items, so as not to split
+// messages over many, and those of short ones kept in one of smaller items.
+func NewTopicInClass(class uint8) (*Topic, error) {
+	if class >= common.MaxSizeClasses {
+		return nil, common.ErrClass
+	}
+	t, err := NewTopic()
+	if err != nil {
+		return nil, err
+	}
+	t.Handle.Class = class
+	return t, nil
+}
+
+// NewTopicFromSeed deterministically derives the topic at index below a
+// master seed. A device backing up only the master seed can re-derive each of
+// its topics, with the same ID, seeds and keys, from the same index.
+func NewTopicFromSeed(master *drbg.Seed, index uint32) (*Topic, error) {
+	child := master.Child(index)
+	id := child.ChildKey(0)
+	keys := append(child.ChildKey(1)[:], child.ChildKey(2)[:]...)
+	return newTopic(id[0:8], child.Child(0), child.Child(1), bytes.NewReader(keys))
+}
+
+// newTopic creates a topic of an ID and seeds, generating its keys from the
+// randomness of keyRand.
+func newTopic(id []byte, seed1, seed2 *drbg.Seed, keyRand io.Reader) (t *Topic, err error) {
+	t = &Topic{}
 	t.ID, _ = binary.Uvarint(id[0:8])
 	t.Handle.Seed1 = seed1
 	t.Handle.Seed2 = seed2
@@ -59,35 +139,74 @@ func NewTopic() (t *Topic, err error) {
 	}
 
 	// Create shared secret
-	pub, priv, err := box.GenerateKey(rand.Reader)
-	if err != nil {
+	var pub [32]byte
+	priv := securemem.Key32()
+	defer securemem.Free(priv[:])
+	if _, err = io.ReadFull(keyRand, priv[:]); err != nil {
 		return
 	}
-	var sharedKey [32]byte
-	box.Precompute(&sharedKey, pub, priv)
-
-	t.Handle.SharedSecret = &sharedKey
+	curve25519.ScalarBaseMult(&pub, priv)
+	t.Handle.SharedSecret = securemem.Key32()
+	box.Precompute(t.Handle.SharedSecret, &pub, priv)
 
 	// Create signing secrets
-	t.Handle.SigningPublicKey, t.SigningPrivateKey, err = ed25519.GenerateKey(rand.Reader)
+	var signingKey *[64]byte
+	t.Handle.SigningPublicKey, signingKey, err = ed25519.GenerateKey(keyRand)
+	if err != nil {
+		return
+	}
+	t.SigningPrivateKey = secureSigningKey(signingKey)
 
 	return
 }
 
+// secureSigningKey moves a signing private key to secure memory, wiping the
+// original.
+func secureSigningKey(key *[64]byte) *[64]byte {
+	secure := securemem.Key64()
+	copy(secure[:], key[:])
+	securemem.Wipe(key[:])
+	return secure
+}
+
+// Free wipes the keys of the topic and its handle, returning those kept in
+// secure memory. The topic must not be used afterwards.
+func (t *Topic) Free() {
+	if t.SigningPrivateKey != nil {
+		securemem.Free(t.SigningPrivateKey[:])
+		t.SigningPrivateKey = nil
+	}
+	t.Handle.Free()
+}
+
 // GeneratePublish creates a set of write args for writing message as the next
-// entry in this topic log.
+// entry in this topic log. commonConfig is that of the size class of the topic.
 func (t *Topic) GeneratePublish(commonConfig *common.Config, message []byte) (*common.WriteArgs, error) {
 	args := &common.WriteArgs{}
 	bucket1, bucket2 := t.Handle.nextBuckets(commonConfig)
 	args.Bucket1 = bucket1
 	args.Bucket2 = bucket2
-	var seqNoBytes [24]byte
-	_ = binary.PutUvarint(seqNoBytes[:], t.Seqno)
+	args.Class = t.Handle.Class
 
 	args.InterestVector = t.Handle.nextInterestVector()
+	if t.Handle.IsBroadcast() {
+		args.BroadcastKey = t.Handle.SigningPublicKey[:]
+		args.BroadcastSeqNo = t.Seqno
+	}
 
+	position := t.Handle.Seqno
 	t.Handle.Seqno++
-	ciphertext, err := t.encrypt(message, &seqNoBytes)
+	var ciphertext []byte
+	var err error
+	if t.Handle.IsDeniable() {
+		ciphertext, err = t.Handle.sealItem(message, position)
+		t.Handle.eraseKeys(position + 1)
+	} else {
+		var nonce *[24]byte
+		if nonce, err = t.nonce(position); err == nil {
+			ciphertext, err = t.encrypt(message, nonce)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,14 +225,72 @@ func (t *Topic) GeneratePublish(commonConfig *common.Config, message []byte) (*c
 	return args, nil
 }
 
+// Check verifies the keys of a topic are consistent: its signing private key
+// is that of the public key of its handle, and an item it seals opens with
+// its handle.
+func (t *Topic) Check() error {
+	if t.SigningPrivateKey == nil || t.Handle.SigningPublicKey == nil || t.Handle.SharedSecret == nil {
+		return errors.New("topic lacks keys")
+	}
+	if !bytes.Equal(t.SigningPrivateKey[32:], t.Handle.SigningPublicKey[:]) {
+		return errors.New("signing private key is not that of the handle's public key")
+	}
+	probe := []byte("talek topic check")
+	if t.Handle.IsDeniable() {
+		sealed, err := t.Handle.sealItem(probe, t.Handle.Seqno)
+		if err != nil {
+			return err
+		}
+		if opened, err := t.Handle.openItem(sealed, t.Handle.Seqno); err != nil || !bytes.Equal(opened, probe) {
+			return fmt.Errorf("items sealed by the topic do not open with its handle: %v", err)
+		}
+		return nil
+	}
+	nonce, err := t.nonce(t.Handle.Seqno)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := t.encrypt(probe, nonce)
+	if err != nil {
+		return err
+	}
+	if opened, err := t.Handle.Decrypt(ciphertext, nonce); err != nil || !bytes.Equal(opened, probe) {
+		return fmt.Errorf("items sealed by the topic do not open with its handle: %v", err)
+	}
+	return nil
+}
+
+// nonce returns the nonce the item at a position is sealed with. For
+// EnvelopeNonced, random bytes follow the position, as writers sharing the
+// topic may seal items of the same position, and the envelope takes the last
+// byte, which the position alone never reaches.
+func (t *Topic) nonce(position uint64) (*[24]byte, error) {
+	nonce := new([24]byte)
+	if t.Handle.Envelope != EnvelopeNonced {
+		_ = binary.PutUvarint(nonce[:], position)
+		return nonce, nil
+	}
+	binary.BigEndian.PutUint64(nonce[:8], position)
+	if _, err := rand.Read(nonce[8 : explicitNonceSize-1]); err != nil {
+		return nil, err
+	}
+	nonce[explicitNonceSize-1] = byte(EnvelopeNonced)
+	return nonce, nil
+}
+
 // @TODO: long-term, keys should ratchet, so that messages outside of the
 // active range become refutable. perhaps this could alternatively be done with
 // a server managed primitive, with releases of a rachet update as each DB epoch
 // advances.
 func (t *Topic) encrypt(plaintext []byte, nonce *[24]byte) ([]byte, error) {
-	buf := make([]byte, 0, len(plaintext)+box.Overhead)
-	_ = box.SealAfterPrecomputation(buf, plaintext, nonce, t.Handle.SharedSecret)
-	buf = buf[0:cap(buf)]
+	buf := make([]byte, 0, len(plaintext)+t.Handle.overhead())
+	if t.Handle.Envelope == EnvelopeNonced {
+		buf = append(buf, nonce[:]...)
+	}
+	buf = box.SealAfterPrecomputation(buf, plaintext, nonce, t.Handle.SharedSecret)
+	if t.Handle.Envelope == EnvelopeSymmetric {
+		return buf, nil
+	}
 	digest := ed25519.Sign(t.SigningPrivateKey, buf)
 	return append(buf, digest[:]...), nil
 }
@@ -134,9 +311,10 @@ func (t *Topic) UnmarshalText(text []byte) error {
 	if len(parts) != 2 {
 		return errors.New("unparsable topic representation")
 	}
-	t.SigningPrivateKey = new([64]byte)
+	t.SigningPrivateKey = securemem.Key64()
 	var spk []byte
 	_, err := fmt.Sscanf(string(parts[0]), "%x", &spk)
+	defer securemem.Wipe(spk)
 	if err != nil {
 		return err
 	}
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -80,6 +81,39 @@ func TestSerializeRestore(t *testing.T) {
 	}
 }
 
+func TestTopicFromSeed(t *testing.T) {
+	master, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("Error creating seed: %v\n", err)
+	}
+	topic, err := NewTopicFromSeed(master, 1)
+	if err != nil {
+		t.Fatalf("Error deriving topic: %v\n", err)
+	}
+
+	// A device restoring the master seed from backup derives the same topic.
+	backup, _ := master.MarshalText()
+	restored := &drbg.Seed{}
+	if err = restored.UnmarshalText(backup); err != nil {
+		t.Fatalf("Error restoring seed: %v\n", err)
+	}
+	clone, err := NewTopicFromSeed(restored, 1)
+	if err != nil {
+		t.Fatalf("Error deriving topic: %v\n", err)
+	}
+	if topic.ID != clone.ID || *topic.SigningPrivateKey != *clone.SigningPrivateKey || !Equal(&topic.Handle, &clone.Handle) {
+		t.Fatalf("restored seed derived a different topic")
+	}
+
+	other, err := NewTopicFromSeed(master, 2)
+	if err != nil {
+		t.Fatalf("Error deriving topic: %v\n", err)
+	}
+	if drbg.Equal(topic.Seed1, other.Seed1) || *topic.SharedSecret == *other.SharedSecret {
+		t.Fatalf("topics at different indices share secrets")
+	}
+}
+
 func TestGeneratePublish(t *testing.T) {
 	fmt.Printf("TestGeneratePublish:\n")
 	config := &common.Config{}
@@ -196,3 +230,231 @@ func HelperBenchmarkGeneratePublish(b *testing.B, BucketDepth int) {
 		_, _ = th.GeneratePublish(config, plaintext)
 	}
 }
+
+func TestTopicCheck(t *testing.T) {
+	topic, err := NewTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	if err = topic.Check(); err != nil {
+		t.Fatalf("Consistent topic failed its check: %v\n", err)
+	}
+	other, _ := NewTopic()
+	mixed := *topic
+	mixed.SigningPrivateKey = other.SigningPrivateKey
+	if mixed.Check() == nil {
+		t.Fatalf("Topic with another's signing key passed its check")
+	}
+}
+
+func TestDeniableTopic(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
+	config.Config.NumBuckets = 10
+	config.Config.DataSize = 256
+	config.TrustDomains = make([]*common.TrustDomainConfig, 2)
+
+	topic, err := NewDeniableTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	if err = topic.Check(); err != nil {
+		t.Fatalf("Consistent topic failed its check: %v\n", err)
+	}
+	txt, _ := topic.Handle.MarshalText()
+	reader := &Handle{}
+	if err = reader.UnmarshalText(txt); err != nil || !Equal(reader, &topic.Handle) {
+		t.Fatalf("Deniable handle did not restore: %v\n", err)
+	}
+	reader.updates = nil
+
+	item := func(content string) []byte {
+		part := make([]byte, 256-PublishingOverhead)
+		copy(part, content)
+		return part
+	}
+	first, _ := topic.GeneratePublish(config.Config, item("first"))
+	second, _ := topic.GeneratePublish(config.Config, item("second"))
+	if len(first.Data) != 256 {
+		t.Fatalf("Deniable item is %d bytes rather than a signed item's.", len(first.Data))
+	}
+
+	// The topic can no longer open what it wrote.
+	if _, err := topic.Handle.openItem(first.Data, 0); err != errKeyErased {
+		t.Fatalf("Topic kept the key of an item it wrote: %v", err)
+	}
+
+	// Items open only at their position, and once read, their keys are erased
+	// from the reader as well.
+	args, _, _ := reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, second.Data), config); err != nil || reader.Seqno != 0 {
+		t.Fatalf("Item opened at another position: %v", err)
+	}
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, first.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("First item not accepted: %v", err)
+	}
+	captured, _ := reader.MarshalText()
+	seized := &Handle{}
+	seized.UnmarshalText(captured)
+	if _, err := seized.openItem(first.Data, 0); err != errKeyErased {
+		t.Fatalf("A handle captured after reading kept the key of an item it read: %v", err)
+	}
+	if plaintext, err := seized.openItem(second.Data, 1); err != nil || !bytes.Equal(plaintext, item("second")) {
+		t.Fatalf("Captured handle should read on: %v", err)
+	}
+}
+
+func TestSymmetricTopic(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
+	config.Config.NumBuckets = 10
+	config.Config.DataSize = 256
+	config.TrustDomains = make([]*common.TrustDomainConfig, 2)
+
+	topic, err := NewSymmetricTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	if err = topic.Check(); err != nil {
+		t.Fatalf("Consistent topic failed its check: %v\n", err)
+	}
+	txt, _ := topic.Handle.MarshalText()
+	reader := &Handle{}
+	if err = reader.UnmarshalText(txt); err != nil || !Equal(reader, &topic.Handle) || reader.Envelope != EnvelopeSymmetric {
+		t.Fatalf("Symmetric handle did not restore: %v\n", err)
+	}
+	reader.updates = nil
+
+	// Items carry the bytes of a signature more of their message.
+	part := newMessage([]byte("unsigned")).Split(256 - topic.overhead())[0]
+	if len(part) != 256-PublishingOverhead+64 {
+		t.Fatalf("Symmetric items carry %d bytes.", len(part))
+	}
+	item, _ := topic.GeneratePublish(config.Config, part)
+	if len(item.Data) != 256 {
+		t.Fatalf("Symmetric item is %d bytes rather than a signed item's.", len(item.Data))
+	}
+
+	// A handle expecting signed items refuses it.
+	signed := *reader
+	signed.Envelope = EnvelopeSigned
+	args, _, _ := signed.generatePoll(config, rand.Reader)
+	if err := signed.OnResponse(args, servedReply(args, item.Data), config); err != nil || signed.Seqno != 0 {
+		t.Fatalf("Handle of signed items accepted a symmetric one: %v", err)
+	}
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, item.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("Symmetric item not accepted: %v", err)
+	}
+}
+
+func TestNoncedTopic(t *testing.T) {
+	config := &ClientConfig{
+		Config:       &common.Config{NumBuckets: 10, DataSize: 256},
+		TrustDomains: make([]*common.TrustDomainConfig, 2),
+	}
+
+	topic, err := NewNoncedTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	if err = topic.Check(); err != nil {
+		t.Fatalf("Consistent topic failed its check: %v\n", err)
+	}
+	txt, _ := topic.Handle.MarshalText()
+	reader := &Handle{}
+	if err = reader.UnmarshalText(txt); err != nil || !Equal(reader, &topic.Handle) || reader.Envelope != EnvelopeNonced {
+		t.Fatalf("Nonced handle did not restore: %v\n", err)
+	}
+	reader.updates = nil
+
+	// The writer's count of the log has drifted ahead of the reader's.
+	topic.Seqno = 5
+	part := newMessage([]byte("nonced")).Split(256 - topic.overhead())[0]
+	item, _ := topic.GeneratePublish(config.Config, part)
+	if len(item.Data) != 256 {
+		t.Fatalf("Nonced item is %d bytes rather than an item's.", len(item.Data))
+	}
+
+	// A handle expecting signed items refuses it, even at its position.
+	signed := *reader
+	signed.Envelope = EnvelopeSigned
+	signed.Seqno = 5
+	args, _, _ := signed.generatePoll(config, rand.Reader)
+	if err := signed.OnResponse(args, servedReply(args, item.Data), config); err != nil || signed.Seqno != 5 {
+		t.Fatalf("Handle of signed items accepted a nonced one: %v", err)
+	}
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, item.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("Item of a writer whose count drifted not accepted: %v", err)
+	}
+
+	// Nor is a signed item of the topic taken for a nonced one.
+	downgraded := *topic
+	downgraded.Envelope = EnvelopeSigned
+	downgraded.Seqno = 1
+	old, _ := downgraded.GeneratePublish(config.Config, newMessage([]byte("signed")).Split(256 - downgraded.overhead())[0])
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, old.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("Handle of nonced items accepted a signed one: %v", err)
+	}
+
+	// An item naming a position far behind the handle still opens, while an
+	// item accepted before is refused by its digest, however far behind.
+	topic.Seqno = 0
+	behind, _ := topic.GeneratePublish(config.Config, part)
+	reader.Seqno = replayWindow + 1
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, behind.Data), config); err != nil || reader.Seqno != replayWindow+2 {
+		t.Fatalf("Item of a writer whose count is far behind not accepted: %v", err)
+	}
+	args, _, _ = reader.generatePoll(config, rand.Reader)
+	if err := reader.OnResponse(args, servedReply(args, item.Data), config); reader.Seqno != replayWindow+2 {
+		t.Fatalf("Item accepted before was accepted again: %v", err)
+	}
+}
+
+func TestClassTopic(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{}, WriteInterval: 0, ReadInterval: 0, TrustDomains: nil}
+	config.Config.NumBuckets = 1000
+	config.Config.DataSize = 256
+	config.Config.Classes[0] = common.SizeClass{NumBuckets: 16, BucketDepth: 2, DataSize: 4096}
+	config.TrustDomains = make([]*common.TrustDomainConfig, 2)
+
+	if _, err := NewTopicInClass(common.MaxSizeClasses); err != common.ErrClass {
+		t.Fatalf("Topic created in a class past the last: %v", err)
+	}
+	topic, err := NewTopicInClass(1)
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	txt, _ := topic.Handle.MarshalText()
+	reader := &Handle{}
+	if err = reader.UnmarshalText(txt); err != nil || !Equal(reader, &topic.Handle) || reader.Class != 1 {
+		t.Fatalf("Handle of size class 1 did not restore: %v\n", err)
+	}
+	reader.updates = nil
+
+	// Items of the topic are of the size and buckets of its class.
+	large, _ := config.inClass(1)
+	part := newMessage(make([]byte, 2000)).Split(4096 - topic.overhead())[0]
+	item, _ := topic.GeneratePublish(large.Config, part)
+	if len(item.Data) != 4096 || item.Class != 1 || item.Bucket1 >= 16 || item.Bucket2 >= 16 {
+		t.Fatalf("Write of size class 1 was of %d bytes of class %d in buckets %d and %d.", len(item.Data), item.Class, item.Bucket1, item.Bucket2)
+	}
+	args, _, err := reader.generatePoll(config, rand.Reader)
+	if err != nil {
+		t.Fatalf("Error polling a handle of size class 1: %v", err)
+	}
+	if args.Class != 1 || args.Vectors.Length != 2 || args.Bucket() >= 16 {
+		t.Fatalf("Poll of size class 1 was of class %d with a vector of %d bytes.", args.Class, args.Vectors.Length)
+	}
+	if err := reader.OnResponse(args, servedReply(args, item.Data), config); err != nil || reader.Seqno != 1 {
+		t.Fatalf("Item of size class 1 not accepted: %v", err)
+	}
+
+	// A configuration without the class can't poll it.
+	config.Config.Classes[0] = common.SizeClass{}
+	if _, _, err := reader.generatePoll(config, rand.Reader); err != common.ErrClass {
+		t.Fatalf("Poll of a class the configuration lacks made: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package libtalek
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/privacylab/talek/common"
+)
+
+// Codec encodes the values published to a TypedTopic, and decodes those read
+// from a TypedHandle. Codecs other than those provided, such as for CBOR,
+// are plugged in by implementing it.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs provided.
+var (
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob. Each message carries the
+	// description of its type, so it suits large values more than small.
+	GobCodec Codec = gobCodec{}
+	// ProtoCodec encodes values which marshal themselves, as the protocol
+	// buffer messages generated by gogo/protobuf do with Marshal and
+	// Unmarshal methods, or with encoding.BinaryMarshaler.
+	ProtoCodec Codec = protoCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// protoMessage is implemented by protocol buffer messages generated with
+// marshaling methods.
+type protoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case protoMessage:
+		return m.Marshal()
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	}
+	return nil, fmt.Errorf("%T does not marshal itself", v)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case protoMessage:
+		return m.Unmarshal(data)
+	case encoding.BinaryUnmarshaler:
+		return m.UnmarshalBinary(data)
+	}
+	return fmt.Errorf("%T does not unmarshal itself", v)
+}
+
+// SizeError is returned for a value whose encoding takes more items of the
+// database than a typed topic allows.
+type SizeError struct {
+	Size     int // Of the encoding
+	Items    int // It would be written as
+	MaxItems int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("encoding of %d bytes takes %d items, more than %d", e.Size, e.Items, e.MaxItems)
+}
+
+// TypedTopic publishes values to a topic, encoded by a codec, rather than
+// byte slices.
+type TypedTopic struct {
+	*Topic
+	Codec Codec
+	// Most items of the database an encoded value may take. Values taking
+	// more are refused before being written. 0 for common.MsgMaxFragments.
+	MaxItems int
+}
+
+// NewTypedTopic publishes values to a topic encoded by codec.
+func NewTypedTopic(topic *Topic, codec Codec) *TypedTopic {
+	return &TypedTopic{Topic: topic, Codec: codec}
+}
+
+// Encode encodes a value, checking its encoding fits in the items allowed of
+// the DataSize of the size class of the topic in a configuration.
+func (t *TypedTopic) Encode(config *ClientConfig, v interface{}) ([]byte, error) {
+	data, err := t.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	max := t.MaxItems
+	if max <= 0 || max > common.MsgMaxFragments {
+		max = common.MsgMaxFragments
+	}
+	config, err = config.inClass(t.Class)
+	if err != nil {
+		return nil, err
+	}
+	partSize := int(config.DataSize) - t.overhead()
+	if partSize <= fragmentHeaderLength {
+		return nil, fmt.Errorf("items of %d bytes can't hold a message", config.DataSize)
+	}
+	msg, err := newPaddedMessage(data, t.Padding, partSize, max)
+	if err != nil {
+		return nil, err
+	}
+	if items := msg.parts(partSize); items > max {
+		return nil, &SizeError{Size: len(data), Items: items, MaxItems: max}
+	}
+	return data, nil
+}
+
+// Publish encodes a value, and publishes it to the end of the topic.
+func (t *TypedTopic) Publish(c *Client, v interface{}) error {
+	config := c.config.Load().(ClientConfig)
+	data, err := t.Encode(&config, v)
+	if err != nil {
+		return err
+	}
+	return c.Publish(t.Topic, data)
+}
+
+// TypedHandle reads values from a handle, decoded by a codec.
+type TypedHandle struct {
+	*Handle
+	Codec Codec
+	// New returns the value a message is decoded into, such as a pointer to
+	// a new struct.
+	New func() interface{}
+}
+
+// NewTypedHandle reads values from a handle decoded by codec into those
+// returned by newValue.
+func NewTypedHandle(handle *Handle, codec Codec, newValue func() interface{}) *TypedHandle {
+	return &TypedHandle{Handle: handle, Codec: codec, New: newValue}
+}
+
+// Decode decodes a message read from the handle.
+func (h *TypedHandle) Decode(msg []byte) (interface{}, error) {
+	v := h.New()
+	if err := h.Codec.Unmarshal(msg, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Poll polls the handle with a client, as Client.Poll does, sending the
+// values decoded from its messages on the channel returned. Messages which
+// fail to decode are dropped, and reported as an EventDecodeFailed.
+func (h *TypedHandle) Poll(c *Client) <-chan interface{} {
+	msgs := c.Poll(h.Handle)
+	if msgs == nil {
+		return nil
+	}
+	done := h.Handle.done
+	values := make(chan interface{})
+	go func() {
+		for {
+			var msg []byte
+			select {
+			case msg = <-msgs:
+			case <-done:
+				return
+			}
+			v, err := h.Decode(msg)
+			if err != nil {
+				c.report(&Event{Kind: EventDecodeFailed, Err: err, Handle: h.Handle})
+				continue
+			}
+			select {
+			case values <- v:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return values
+}
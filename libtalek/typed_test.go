@@ -0,0 +1,80 @@
+package libtalek
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+type typedNote struct {
+	From string
+	Body string
+}
+
+// binaryNote marshals itself.
+type binaryNote struct {
+	Body string
+}
+
+func (n *binaryNote) MarshalBinary() ([]byte, error) {
+	return []byte(n.Body), nil
+}
+
+func (n *binaryNote) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty note")
+	}
+	n.Body = string(data)
+	return nil
+}
+
+func TestTypedCodecs(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{DataSize: 256}}
+	topic, _ := NewTopic()
+	for name, codec := range map[string]Codec{"json": JSONCodec, "gob": GobCodec} {
+		data, err := NewTypedTopic(topic, codec).Encode(config, &typedNote{"alice", "hello"})
+		if err != nil {
+			t.Fatalf("Could not encode with %s: %v", name, err)
+		}
+		v, err := NewTypedHandle(&topic.Handle, codec, func() interface{} { return new(typedNote) }).Decode(data)
+		if err != nil {
+			t.Fatalf("Could not decode with %s: %v", name, err)
+		}
+		if note := v.(*typedNote); note.From != "alice" || note.Body != "hello" {
+			t.Fatalf("Decoded %+v with %s.", note, name)
+		}
+	}
+
+	data, err := NewTypedTopic(topic, ProtoCodec).Encode(config, &binaryNote{"self-marshaled"})
+	if err != nil || string(data) != "self-marshaled" {
+		t.Fatalf("Value marshaling itself encoded as %q: %v", data, err)
+	}
+	if _, err := NewTypedTopic(topic, ProtoCodec).Encode(config, typedNote{}); err == nil {
+		t.Fatal("A value which doesn't marshal itself was encoded.")
+	}
+	handle := NewTypedHandle(&topic.Handle, ProtoCodec, func() interface{} { return new(binaryNote) })
+	if _, err := handle.Decode(nil); err == nil {
+		t.Fatal("A malformed message was decoded.")
+	}
+}
+
+func TestTypedTopicSize(t *testing.T) {
+	config := &ClientConfig{Config: &common.Config{DataSize: 256}}
+	topic, _ := NewTopic()
+	typed := NewTypedTopic(topic, JSONCodec)
+	typed.MaxItems = 1
+
+	if _, err := typed.Encode(config, &typedNote{Body: "short"}); err != nil {
+		t.Fatalf("A value fitting in an item was refused: %v", err)
+	}
+	_, err := typed.Encode(config, &typedNote{Body: strings.Repeat("x", 256)})
+	if size, ok := err.(*SizeError); !ok || size.Items != 2 || size.MaxItems != 1 {
+		t.Fatalf("Expected a value of two items to be refused, got %v.", err)
+	}
+	typed.MaxItems = 0
+	if _, err := typed.Encode(config, &typedNote{Body: strings.Repeat("x", 256)}); err != nil {
+		t.Fatalf("A value of two items was refused without a limit: %v", err)
+	}
+}
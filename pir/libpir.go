@@ -2,6 +2,7 @@ package pir
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/privacylab/talek/pir/pirinterface"
 )
@@ -25,14 +26,22 @@ type Server struct {
 	CellCount  int
 	BatchSize  int
 	DB         *DB
+
+	// Launch parameters applied to each shard created for a DB.
+	launch pirinterface.LaunchParams
 }
 
-// NewServer creates a Server for communication
+// NewServer creates a Server for communication, once the backing has passed
+// a self-test.
 func NewServer(backing string) (*Server, error) {
 	server := new(Server)
 	server.backing = backing
 
 	if cons := pirinterface.GetBacking(backing); cons != nil {
+		// Refuse to serve from a backend which can't answer correctly.
+		if err := pirinterface.SelfTest(cons, backing); err != nil {
+			return nil, err
+		}
 		server.newshard = cons
 		return server, nil
 	}
@@ -54,8 +63,8 @@ func (s *Server) Configure(celllength int, cellcount int, batchsize int) error {
 	s.CellCount = cellcount
 	s.CellLength = celllength
 
-	if s.CellCount%8 != 0 || s.CellLength%8 != 0 {
-		return errors.New("invalid sizing of database; everything needs to be multiples of 8 bytes")
+	if s.CellCount <= 0 || s.CellLength <= 0 || s.BatchSize <= 0 {
+		return errors.New("invalid sizing of database; cells and batches must not be empty")
 	}
 
 	return nil
@@ -85,10 +94,65 @@ func (s *Server) SetDB(db *DB) error {
 	if db.shard == nil {
 		return errors.New("Couldn't set DB")
 	}
+	if s.launch != (pirinterface.LaunchParams{}) {
+		tunable, ok := db.shard.(pirinterface.Tunable)
+		if !ok {
+			db.Free()
+			return fmt.Errorf("backing %s has no launch parameters", s.backing)
+		}
+		if err := tunable.SetLaunchParams(s.launch); err != nil {
+			db.Free()
+			return err
+		}
+	}
 	s.DB = db
 	return nil
 }
 
+// GetBacking returns the backing the Server reads with.
+func (s *Server) GetBacking() string {
+	return s.backing
+}
+
+// Devices reports on the devices the backing computes reads on.
+func (s *Server) Devices() []pirinterface.DeviceInfo {
+	if s.DB == nil || s.DB.shard == nil {
+		return nil
+	}
+	if describer, ok := s.DB.shard.(pirinterface.Describer); ok {
+		return describer.Devices()
+	}
+	return nil
+}
+
+// GetLaunchParams returns the parameters the backing launches kernels with.
+func (s *Server) GetLaunchParams() (pirinterface.LaunchParams, error) {
+	if s.DB == nil || s.DB.shard == nil {
+		return s.launch, nil
+	}
+	tunable, ok := s.DB.shard.(pirinterface.Tunable)
+	if !ok {
+		return pirinterface.LaunchParams{}, fmt.Errorf("backing %s has no launch parameters", s.backing)
+	}
+	return tunable.GetLaunchParams(), nil
+}
+
+// SetLaunchParams changes the parameters the backing launches kernels with,
+// for the current DB and those set later.
+func (s *Server) SetLaunchParams(params pirinterface.LaunchParams) error {
+	if s.DB != nil && s.DB.shard != nil {
+		tunable, ok := s.DB.shard.(pirinterface.Tunable)
+		if !ok {
+			return fmt.Errorf("backing %s has no launch parameters", s.backing)
+		}
+		if err := tunable.SetLaunchParams(params); err != nil {
+			return err
+		}
+	}
+	s.launch = params
+	return nil
+}
+
 // Free releases memory for a DB instance
 func (db *DB) Free() error {
 	if db.shard != nil {
@@ -104,11 +168,13 @@ func (s *Server) Read(masks []byte, responseChan chan []byte) error {
 		return errors.New("db not configured")
 	}
 
-	if len(masks) != (s.CellCount*s.BatchSize)/8 {
+	// Each mask has a bit per cell, rounded up to whole bytes.
+	maskLength := (s.CellCount + 7) / 8
+	if len(masks) != maskLength*s.BatchSize {
 		return errors.New("wrong mask length")
 	}
 
-	responses, err := s.DB.shard.Read(masks, s.CellCount/8)
+	responses, err := s.DB.shard.Read(masks, maskLength)
 	if err != nil {
 		return err
 	}
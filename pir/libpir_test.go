@@ -1,11 +1,13 @@
 package pir
 
 import (
+	"bytes"
 	"errors"
 	"math/rand"
 	"strconv"
 
-	_ "github.com/privacylab/talek/pir/pircpu"
+	"github.com/privacylab/talek/pir/pircpu"
+	"github.com/privacylab/talek/pir/pirinterface"
 )
 
 import "os"
@@ -23,6 +25,34 @@ func TestServer(t *testing.T) {
 	pirServer.Disconnect()
 }
 
+// corruptShard flips a bit of the responses of the CPU shard it wraps, as a
+// miscompiled kernel might.
+type corruptShard struct {
+	pirinterface.Shard
+}
+
+func (c *corruptShard) Read(reqs []byte, reqLength int) ([]byte, error) {
+	response, err := c.Shard.Read(reqs, reqLength)
+	if len(response) > 0 {
+		response[len(response)-1] ^= 0x04
+	}
+	return response, err
+}
+
+func TestServerSelfTest(t *testing.T) {
+	pirinterface.Register("corrupt", func(bucketSize int, data []byte, userdata string) pirinterface.Shard {
+		return &corruptShard{pircpu.NewShard(bucketSize, data, "cpu.0")}
+	})
+	if _, err := NewServer("corrupt"); err == nil {
+		t.Error("Server should refuse a backing failing its self-test.")
+	}
+	for _, backing := range []string{"cpu.0", "cpu.1", "cpu.2"} {
+		if err := pirinterface.SelfTest(pirinterface.GetBacking(backing), backing); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestPir(t *testing.T) {
 
 	pirServer, err := NewServer("cpu.1")
@@ -67,6 +97,52 @@ func TestPir(t *testing.T) {
 	pirServer.Disconnect()
 }
 
+func TestPirUnaligned(t *testing.T) {
+	// Neither the cells nor the cell count are a multiple of 8.
+	cellLength, cellCount, batchSize := 21, 13, 3
+	for _, backing := range []string{"cpu.0", "cpu.1", "cpu.3", "cpu.0.2"} {
+		pirServer, err := NewServer(backing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pirServer.Configure(cellLength, cellCount, batchSize); err != nil {
+			t.Fatal(err)
+		}
+		db, err := pirServer.GetDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rand.New(rand.NewSource(1)).Read(db.DB)
+		if err := pirServer.SetDB(db); err != nil {
+			t.Fatal(err)
+		}
+
+		maskLength := (cellCount + 7) / 8
+		masks := make([]byte, maskLength*batchSize)
+		rand.New(rand.NewSource(2)).Read(masks)
+		responseChan := make(chan []byte, 1)
+		if err := pirServer.Read(masks, responseChan); err != nil {
+			t.Fatal(err)
+		}
+		response := <-responseChan
+
+		for req := 0; req < batchSize; req++ {
+			expected := make([]byte, cellLength)
+			for cell := 0; cell < cellCount; cell++ {
+				if masks[req*maskLength+cell/8]&(1<<uint(cell%8)) != 0 {
+					for i := range expected {
+						expected[i] ^= db.DB[cell*cellLength+i]
+					}
+				}
+			}
+			if !bytes.Equal(response[req*cellLength:(req+1)*cellLength], expected) {
+				t.Fatalf("%s: response %d is incorrect", backing, req)
+			}
+		}
+		pirServer.Disconnect()
+	}
+}
+
 func BenchmarkPir(b *testing.B) {
 	cellLength := 1024
 	cellCount := 2048
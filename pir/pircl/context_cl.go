@@ -29,11 +29,21 @@ type ContextCL struct {
 	program        cl.Program
 	Kernel         cl.Kernel
 	groupSize      int
+	deviceName     string
+	deviceMemory   uint64
 }
 
-// NewContextCL creates a new OpenCL context with a given kernel source.
+// NewContextCL creates a new OpenCL context with a given kernel source, on the
+// first GPU of the first platform.
 // New ShardCL instances will share the same kernel
 func NewContextCL(name string, kernelSource string, kernelDataSize int, gpuScratchSize int) (*ContextCL, error) {
+	return NewContextCLOnDevice(name, kernelSource, kernelDataSize, gpuScratchSize, nil)
+}
+
+// NewContextCLOnDevice creates a new OpenCL context with a given kernel source
+// on a selected device, or with a nil device, the first GPU of the first
+// platform.
+func NewContextCLOnDevice(name string, kernelSource string, kernelDataSize int, gpuScratchSize int, selected *Device) (*ContextCL, error) {
 	c := &ContextCL{}
 	c.log = common.NewLogger(name)
 	c.name = name
@@ -52,18 +62,47 @@ func NewContextCL(name string, kernelSource string, kernelDataSize int, gpuScrat
 		c.log.Error.Printf("NewContextCL(%v) error: %v\n", c.name, rErr)
 		return nil, rErr
 	}
-	c.platformID = ids[0]
+	platform := 0
+	if selected != nil {
+		platform = selected.Platform
+	}
+	if platform >= int(count) {
+		c.Free()
+		rErr := fmt.Errorf("NewContextCl: no OpenCL platform %d, of %d", platform, count)
+		c.log.Error.Printf("NewContextCL(%v) error: %v\n", c.name, rErr)
+		return nil, rErr
+	}
+	c.platformID = ids[platform]
 
 	// Get Device
 	var device cl.DeviceId
-	err = cl.GetDeviceIDs(c.platformID, cl.DEVICE_TYPE_GPU, 1, &device, &count)
+	if selected == nil {
+		err = cl.GetDeviceIDs(c.platformID, cl.DEVICE_TYPE_GPU, 1, &device, &count)
+	} else {
+		devices := make([]cl.DeviceId, 100)
+		err = cl.GetDeviceIDs(c.platformID, cl.DEVICE_TYPE_ALL, uint32(len(devices)), &devices[0], &count)
+		if err == cl.SUCCESS && selected.Device < int(count) {
+			device = devices[selected.Device]
+		} else {
+			count = 0
+		}
+	}
 	if err != cl.SUCCESS || count < 1 {
 		c.Free()
 		rErr := fmt.Errorf("NewContextCl: failed to create OpenCL device group")
+		if selected != nil {
+			rErr = fmt.Errorf("NewContextCl: no OpenCL device %v", selected)
+		}
 		c.log.Error.Printf("NewContextCL(%v) error: %v\n", c.name, rErr)
 		return nil, rErr
 	}
 	c.deviceID = device
+	info := make([]byte, 1024)
+	size := uint64(0)
+	if cl.GetDeviceInfo(device, cl.DEVICE_NAME, uint64(len(info)), unsafe.Pointer(&info[0]), &size) == cl.SUCCESS && size > 0 {
+		c.deviceName = strings.TrimRight(string(info[:size]), "\x00")
+	}
+	cl.GetDeviceInfo(device, cl.DEVICE_GLOBAL_MEM_SIZE, 8, unsafe.Pointer(&c.deviceMemory), nil)
 
 	//Create Computer Context
 	var errptr *cl.ErrorCode
@@ -150,6 +189,16 @@ func (c *ContextCL) GetGroupSize() int {
 	return c.groupSize
 }
 
+// GetDeviceName returns the name of the device of this context
+func (c *ContextCL) GetDeviceName() string {
+	return c.deviceName
+}
+
+// GetDeviceMemory returns the global memory (in bytes) of the device of this context
+func (c *ContextCL) GetDeviceMemory() uint64 {
+	return c.deviceMemory
+}
+
 // GetKernelDataSize returns the size (in bytes) of a single data item in the kernel
 func (c *ContextCL) GetKernelDataSize() int {
 	return c.kernelDataSize
@@ -0,0 +1,45 @@
+package pircl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Device selects an OpenCL device by the index of its platform, and its index
+// among all devices of that platform, in the order clinfo lists them.
+type Device struct {
+	Platform int
+	Device   int
+}
+
+func (d Device) String() string {
+	return fmt.Sprintf("%d:%d", d.Platform, d.Device)
+}
+
+// ParseDevices parses a comma separated list of devices, each given as
+// [platform]:[device], e.g. "0:1" or "0:0,1:0".
+func ParseDevices(spec string) ([]Device, error) {
+	var devices []Device
+	for _, d := range strings.Split(spec, ",") {
+		parts := strings.Split(d, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid device %q. Should be [platform]:[device]", d)
+		}
+		platform, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q. Should be numeric", parts[0])
+		}
+		device, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device %q. Should be numeric", parts[1])
+		}
+		for _, seen := range devices {
+			if seen.Platform == int(platform) && seen.Device == int(device) {
+				return nil, fmt.Errorf("device %q listed twice", d)
+			}
+		}
+		devices = append(devices, Device{int(platform), int(device)})
+	}
+	return devices, nil
+}
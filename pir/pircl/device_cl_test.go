@@ -0,0 +1,25 @@
+package pircl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDevices(t *testing.T) {
+	devices, err := ParseDevices("0:1")
+	if err != nil || !reflect.DeepEqual(devices, []Device{{0, 1}}) {
+		t.Fatalf("single device parsed as %v, %v", devices, err)
+	}
+	devices, err = ParseDevices("0:0,1:2")
+	if err != nil || !reflect.DeepEqual(devices, []Device{{0, 0}, {1, 2}}) {
+		t.Fatalf("device list parsed as %v, %v", devices, err)
+	}
+	if devices[1].String() != "1:2" {
+		t.Fatalf("device printed as %s", devices[1])
+	}
+	for _, spec := range []string{"", "0", "0:x", "-1:0", "0:0:0", "0:1,0:1"} {
+		if _, err := ParseDevices(spec); err == nil {
+			t.Fatalf("invalid device list %q parsed", spec)
+		}
+	}
+}
@@ -7,10 +7,10 @@ package pircl
 // output: batch of responses ([resp0, resp1, ...]) where each resp is bucketSize bytes
 // scratch: L2 scratchpad of GPUScratchSize bytes
 // batchSize: number of requests per batch
-// reqLength: length of a request in bytes (numBuckets/8)
+// reqLength: length of a request in bytes (numBuckets/8, rounded up)
 // numBuckets: number of buckets in the shard
-// bucketSize: length of a bucket in units of DATA_TYPE
-// globalSize: number of threads globally (size of db if Kernel0, size of output if Kernel1)
+// bucketSize: length of a bucket in units of DATA_TYPE, after padding
+// globalSize: number of threads globally, by which Kernel1 and Kernel2 stride
 // scratchSize: length of scratch in units of DATA_TYPE
 
 const kernelCLPrefix = `
@@ -44,104 +44,93 @@ const kernelCLPostfix = `
 }
 ` + "\x00"
 
+// Kernels compute in units of DATA_TYPE, so buckets are padded to whole
+// units. Each strides over the work it splits between threads, so it covers
+// any number of buckets with any number of threads, and output is zeroed
+// before it runs.
+
 // KernelCL0 : 1 workgroup == 1 PIR request
 // Workgroup items split up the scan over the database
-// Cache the working result
+// Cache the working result, a chunk of scratchSize at a time for buckets
+// larger than the scratch
 const KernelCL0 = kernelCLPrefix + `
   uint32_cl workgroup_size = get_local_size(0);
   uint32_cl workgroup_index = get_local_id(0);
-  uint32_cl workgroup_num = get_group_id(0);	  // request index
-
-  // zero scratch
-  for (uint32_cl offset = workgroup_index; offset < bucketSize; offset += workgroup_size) {
-      scratch[offset] = 0;
-  }
-  barrier(CLK_LOCAL_MEM_FENCE);
-
-  // Accumulate in parallel.
-  uint32_cl dbSize = numBuckets * bucketSize;
-  uint32_cl reqIndex = workgroup_num * reqLength;
-  uint32_cl bucketId;
-  uint32_cl depthOffset;
-  uint8_cl reqBit;
-  for (uint32_cl offset = workgroup_index; offset < dbSize; offset += workgroup_size) {
-    bucketId = offset / bucketSize;
-    depthOffset = offset % bucketSize;
-    reqBit = reqs[reqIndex + (bucketId/8)] & (1 << (bucketId%8));
-    //current_mask = (current_mask >> bitshift) * -1;
-    //scratch[depthOffset] ^= current_mask & db[offset];
-    if (reqBit != 0) {
-      //scratch[depthOffset] ^= db[offset];
-      atom_xor(&scratch[depthOffset], db[offset]);
+  uint32_cl workgroup_count = get_num_groups(0);
+
+  for (uint32_cl request = get_group_id(0); request < batchSize; request += workgroup_count) {
+    uint32_cl reqIndex = request * reqLength;
+    uint32_cl respIndex = request * bucketSize;
+    for (uint32_cl chunk = 0; chunk < bucketSize; chunk += scratchSize) {
+      uint32_cl chunkSize = min(scratchSize, bucketSize - chunk);
+
+      // zero scratch
+      for (uint32_cl offset = workgroup_index; offset < chunkSize; offset += workgroup_size) {
+        scratch[offset] = 0;
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+
+      // Accumulate in parallel.
+      uint32_cl scanSize = numBuckets * chunkSize;
+      uint32_cl bucketId;
+      uint32_cl depthOffset;
+      uint8_cl reqBit;
+      for (uint32_cl offset = workgroup_index; offset < scanSize; offset += workgroup_size) {
+        bucketId = offset / chunkSize;
+        depthOffset = offset % chunkSize;
+        reqBit = reqs[reqIndex + (bucketId/8)] & (1 << (bucketId%8));
+        if (reqBit != 0) {
+          atom_xor(&scratch[depthOffset], db[bucketId*bucketSize + chunk + depthOffset]);
+        }
+      }
+
+      // send to output.
+      barrier(CLK_LOCAL_MEM_FENCE);
+      for (uint32_cl offset = workgroup_index; offset < chunkSize; offset += workgroup_size) {
+        output[respIndex + chunk + offset] = scratch[offset];
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
     }
   }
-
-  // send to output.
-  barrier(CLK_LOCAL_MEM_FENCE);
-  uint32_cl respIndex = workgroup_num * bucketSize;
-  for (uint32_cl offset = workgroup_index; offset < bucketSize; offset += workgroup_size) {
-    output[respIndex + offset] = scratch[offset];
-  }
 ` + kernelCLPostfix
 
 // KernelCL1 : index => output
 // Cache the request
 const KernelCL1 = kernelCLPrefix + `
-  uint32_cl globalIndex = get_global_id(0);
-
-  if (globalIndex >= globalSize) {
-    return;
-  }
+  uint32_cl outputSize = batchSize * bucketSize;
 
-  //barrier(CLK_LOCAL_MEM_FENCE);
-  
-  // Iterate over all buckets, xor data into my result
-  DATA_TYPE result = 0;
-  uint32_cl reqIndex = (globalIndex / bucketSize) * reqLength;
-  uint32_cl offset = globalIndex % bucketSize;
-  uint8_cl reqBit;
-  for (uint32_cl i = 0; i < numBuckets; i++) {
-    reqBit = reqs[reqIndex + (i/8)] & (1 << (i%8));
-    if (reqBit > 0) {
-      result ^= db[i*bucketSize+offset];
+  for (uint32_cl globalIndex = get_global_id(0); globalIndex < outputSize; globalIndex += globalSize) {
+    // Iterate over all buckets, xor data into my result
+    DATA_TYPE result = 0;
+    uint32_cl reqIndex = (globalIndex / bucketSize) * reqLength;
+    uint32_cl offset = globalIndex % bucketSize;
+    uint8_cl reqBit;
+    for (uint32_cl i = 0; i < numBuckets; i++) {
+      reqBit = reqs[reqIndex + (i/8)] & (1 << (i%8));
+      if (reqBit > 0) {
+        result ^= db[i*bucketSize+offset];
+      }
     }
+    output[globalIndex] = result;
   }
-  output[globalIndex] = result;
 ` + kernelCLPostfix
 
 // KernelCL2 : index => db
 // Cache portion of the database
 const KernelCL2 = kernelCLPrefix + `
-  uint32_cl globalIndex = get_global_id(0);
-
-  if (globalIndex >= globalSize) {
-    return;
-  }
-
-  uint32_cl outputSize = batchSize * bucketSize;
-
-  // Zero output first
-  if (globalSize >= outputSize && globalIndex < outputSize) {
-    output[globalIndex] = 0;
-  } else if (globalSize < outputSize) {
-    uint32_cl multiplier = outputSize / globalSize + 1;
-    uint32_cl start = globalIndex * multiplier;
-    uint32_cl end = start + multiplier;
-    for (uint32_cl i = start; i < end && i < outputSize; i++) {
-      output[i] = 0;
-    }
-  }
-  barrier(CLK_GLOBAL_MEM_FENCE);
+  uint32_cl dbSize = numBuckets * bucketSize;
 
-  // Iterate over requests in a batch, atomic_xor my data into output
-  DATA_TYPE data = db[globalIndex];
-  uint32_cl bucketId = globalIndex / bucketSize;
-  uint32_cl depthOffset = globalIndex % bucketSize;
-  uint8_cl reqBit;
-  for (uint32_cl i = 0; i < batchSize; i++) {
-    reqBit = reqs[(i*reqLength) + (bucketId/8)] & (1 << (bucketId%8));
-    if (reqBit > 0) {
-      atom_xor(&output[(i*bucketSize)+depthOffset], data);
+  for (uint32_cl globalIndex = get_global_id(0); globalIndex < dbSize; globalIndex += globalSize) {
+    // Iterate over requests in a batch, atomic_xor my data into output
+    DATA_TYPE data = db[globalIndex];
+    uint32_cl bucketId = globalIndex / bucketSize;
+    uint32_cl depthOffset = globalIndex % bucketSize;
+    uint8_cl reqBit;
+    for (uint32_cl i = 0; i < batchSize; i++) {
+      reqBit = reqs[(i*reqLength) + (bucketId/8)] & (1 << (bucketId%8));
+      if (reqBit > 0) {
+        atom_xor(&output[(i*bucketSize)+depthOffset], data);
+      }
     }
   }
 ` + kernelCLPostfix
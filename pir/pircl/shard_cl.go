@@ -7,10 +7,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/go-gl/cl/v1.2/cl"
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirhybrid"
 	"github.com/privacylab/talek/pir/pirinterface"
 )
 
@@ -25,16 +27,45 @@ type ShardCL struct {
 	data       []byte
 	numThreads int
 	clData     cl.Mem
+	// Size of buckets on the device, padded to whole kernel data items
+	paddedSize int
+
+	launchLock sync.Mutex
+	launch     pirinterface.LaunchParams
 }
 
-// NewShard creates a new cuda shard conforming to the common interface
+// NewShard creates a new OpenCL shard conforming to the common interface.
+// The userdata cl.[source].[datasize].[scratchsize].[threads] may be followed
+// by .[devices], a comma separated list of [platform]:[device] to compute on
+// rather than the first GPU. Each of several devices holds all the data, and
+// read batches are split between them by their throughput.
 func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 	parts := strings.Split(userdata, ".")
-	if len(parts) < 6 {
-		fmt.Fprintf(os.Stderr, "Invalid cl specification: %s. Should be cl.[source].[datasize].[scratchsize].[threads]", parts)
+	if len(parts) < 5 {
+		fmt.Fprintf(os.Stderr, "Invalid cl specification: %s. Should be cl.[source].[datasize].[scratchsize].[threads](.[devices])", parts)
 		return nil
 	}
 
+	var devices []Device
+	if len(parts) > 5 {
+		var err error
+		if devices, err = ParseDevices(parts[5]); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid devices: %v", err)
+			return nil
+		}
+	}
+	if len(devices) > 1 {
+		spec := "hybrid"
+		for _, device := range devices {
+			spec += "+" + strings.Join(parts[:5], ".") + "." + device.String()
+		}
+		return pirhybrid.NewShard(bucketSize, data, spec)
+	}
+	var selected *Device
+	if len(devices) == 1 {
+		selected = &devices[0]
+	}
+
 	dataSize, err := strconv.ParseInt(parts[2], 10, 32)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid datasize: %s. Should be numeric", parts[2])
@@ -45,6 +76,11 @@ func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 		fmt.Fprintf(os.Stderr, "Invalid scratch size: %s. Should be numeric", parts[3])
 		return nil
 	}
+	threads, err := strconv.ParseInt(parts[4], 10, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid threads: %s. Should be numeric", parts[4])
+		return nil
+	}
 
 	source := KernelCL0
 	if parts[1] == "1" {
@@ -53,16 +89,12 @@ func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 		source = KernelCL2
 	}
 
-	context, err := NewContextCL("contextcl", source, int(dataSize), int(scratchSize))
+	context, err := NewContextCLOnDevice("contextcl", source, int(dataSize), int(scratchSize), selected)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cannot create new ContextCL: error=%v\n", err)
-	}
-
-	threads, err := strconv.ParseInt(parts[4], 10, 32)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid threads: %s. Should be numeric", parts[4])
 		return nil
 	}
+
 	shard, err := NewShardCL("CL Shard ("+userdata+")", context, bucketSize, data, int(threads))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not create CL shard: %v", err)
@@ -99,18 +131,20 @@ func NewShardCL(name string, context *ContextCL, bucketSize int, data []byte, nu
 	s.numBuckets = (len(data) / bucketSize)
 	s.data = data
 	s.numThreads = numThreads
+	s.paddedSize = pirinterface.PaddedBucketSize(bucketSize, context.GetKernelDataSize())
+	deviceData := pirinterface.PadBuckets(data, bucketSize, s.paddedSize)
 
 	/** OpenCL **/
 	//  Create buffers
 	var errptr *cl.ErrorCode
-	s.clData = cl.CreateBuffer(s.context.Context, cl.MEM_READ_ONLY, uint64(len(data)), nil, errptr)
+	s.clData = cl.CreateBuffer(s.context.Context, cl.MEM_READ_ONLY, uint64(len(deviceData)), nil, errptr)
 	if errptr != nil && cl.ErrorCode(*errptr) != cl.SUCCESS {
 		rErr := fmt.Errorf("NewShardCL(%v) failed: couldnt create OpenCL buffer", name)
 		s.log.Error.Printf("%v\n", rErr)
 		return nil, rErr
 	}
 	//Write shard data to GPU
-	err := cl.EnqueueWriteBuffer(s.context.CommandQueue, s.clData, cl.TRUE, 0, uint64(len(data)), unsafe.Pointer(&data[0]), 0, nil, nil)
+	err := cl.EnqueueWriteBuffer(s.context.CommandQueue, s.clData, cl.TRUE, 0, uint64(len(deviceData)), unsafe.Pointer(&deviceData[0]), 0, nil, nil)
 	if err != cl.SUCCESS {
 		rErr := fmt.Errorf("NewShardCL(%v) failed: cannot write shard to GPU (OpenCL buffer)", name)
 		s.log.Error.Printf("%v\n", rErr)
@@ -168,9 +202,81 @@ func (s *ShardCL) Read(reqs []byte, reqLength int) ([]byte, error) {
 		return nil, rErr
 	}
 
+	launch := s.GetLaunchParams()
+	batch := len(reqs) / reqLength
+	if launch.BatchSize == 0 || batch <= launch.BatchSize {
+		return s.read(reqs, reqLength, launch)
+	}
+	responses := make([]byte, 0, batch*s.bucketSize)
+	for start := 0; start < batch; start += launch.BatchSize {
+		end := start + launch.BatchSize
+		if end > batch {
+			end = batch
+		}
+		response, err := s.read(reqs[start*reqLength:end*reqLength], reqLength, launch)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response...)
+	}
+	s.log.Trace.Printf("%v.Read: end\n", s.name)
+	return responses, nil
+}
+
+// Devices reports the device the shard reads on, and the batch size it
+// computes in one kernel launch.
+func (s *ShardCL) Devices() []pirinterface.DeviceInfo {
+	return []pirinterface.DeviceInfo{{
+		Backing:      "cl",
+		Name:         s.context.GetDeviceName(),
+		Memory:       s.context.GetDeviceMemory(),
+		MaxBatchSize: s.GetLaunchParams().BatchSize,
+	}}
+}
+
+// GetLaunchParams returns the parameters kernels are launched with.
+func (s *ShardCL) GetLaunchParams() pirinterface.LaunchParams {
+	s.launchLock.Lock()
+	defer s.launchLock.Unlock()
+	launch := s.launch
+	if launch.Threads == 0 {
+		launch.Threads = s.numThreads
+	}
+	if launch.GroupSize == 0 {
+		launch.GroupSize = s.context.GetGroupSize()
+	}
+	return launch
+}
+
+// SetLaunchParams changes the parameters later reads launch kernels with.
+func (s *ShardCL) SetLaunchParams(params pirinterface.LaunchParams) error {
+	if err := params.Validate(s.context.GetGroupSize()); err != nil {
+		return err
+	}
+	s.launchLock.Lock()
+	s.launch = params
+	s.launchLock.Unlock()
+	s.log.Info.Printf("%v.SetLaunchParams: %+v\n", s.name, params)
+	return nil
+}
+
+/*********************************************
+ * PRIVATE METHODS
+ *********************************************/
+
+// read computes a batch of requests in one kernel launch.
+func (s *ShardCL) read(reqs []byte, reqLength int, launch pirinterface.LaunchParams) ([]byte, error) {
+	scratchSize := s.context.GetGPUScratchSize() / s.context.GetKernelDataSize()
+	if s.context.kernelSource == KernelCL0 && scratchSize == 0 {
+		rErr := fmt.Errorf("scratch of %d bytes holds no data items", s.context.GetGPUScratchSize())
+		s.log.Error.Printf("%v.Read error: %v\n", s.name, rErr)
+		return nil, rErr
+	}
+
 	inputSize := len(reqs)
 	batchSize := inputSize / reqLength
-	outputSize := batchSize * s.bucketSize
+	// Responses are computed in padded buckets, starting zeroed.
+	outputSize := batchSize * s.paddedSize
 	responses := make([]byte, outputSize)
 	context := s.context.Context
 	var err cl.ErrorCode
@@ -185,7 +291,7 @@ func (s *ShardCL) Read(reqs []byte, reqLength int) ([]byte, error) {
 	}
 	defer cl.ReleaseMemObject(input)
 
-	output := cl.CreateBuffer(context, cl.MEM_WRITE_ONLY, uint64(outputSize), nil, errptr)
+	output := cl.CreateBuffer(context, cl.MEM_READ_WRITE, uint64(outputSize), nil, errptr)
 	if errptr != nil && cl.ErrorCode(*errptr) != cl.SUCCESS {
 		rErr := fmt.Errorf("couldnt create output buffer")
 		s.log.Error.Printf("%v.Read error: %v\n", s.name, rErr)
@@ -200,21 +306,29 @@ func (s *ShardCL) Read(reqs []byte, reqLength int) ([]byte, error) {
 		s.log.Error.Printf("%v.Read error: %v\n", s.name, rErr)
 		return nil, rErr
 	}
+	err = cl.EnqueueWriteBuffer(s.context.CommandQueue, output, cl.TRUE, 0, uint64(outputSize), unsafe.Pointer(&responses[0]), 0, nil, nil)
+	if err != cl.SUCCESS {
+		rErr := fmt.Errorf("Failed to zero output responses (OpenCL buffer)")
+		s.log.Error.Printf("%v.Read error: %v\n", s.name, rErr)
+		return nil, rErr
+	}
 
 	//Set kernel args
 	data := s.clData
 	batchSize32 := uint32(batchSize)
 	reqLength32 := uint32(reqLength)
 	numBuckets32 := uint32(s.numBuckets)
-	bucketSize32 := uint32(s.bucketSize / s.context.GetKernelDataSize())
-	//global := local
-	local := uint64(s.context.GetGroupSize())
-	global := uint64(s.numThreads)
+	bucketSize32 := uint32(s.paddedSize / s.context.GetKernelDataSize())
+	// Kernels stride over whatever they compute, so any number of threads
+	// covers it. OpenCL needs whole work groups, so threads are rounded up.
+	local := uint64(launch.GroupSize)
+	global := uint64(launch.Threads)
 	if global < local {
 		local = global
 	}
+	global = (global + local - 1) / local * local
 	global32 := uint32(global)
-	scratchSize32 := uint32(s.context.GetGPUScratchSize() / s.context.GetKernelDataSize())
+	scratchSize32 := uint32(scratchSize)
 	argSizes := []uint64{8, 8, 8, uint64(s.context.GetGPUScratchSize()), 4, 4, 4, 4, 4, 4}
 	args := []unsafe.Pointer{
 		unsafe.Pointer(&data),
@@ -264,5 +378,5 @@ func (s *ShardCL) Read(reqs []byte, reqLength int) ([]byte, error) {
 	}
 
 	s.log.Trace.Printf("%v.Read: end\n", s.name)
-	return responses, nil
+	return pirinterface.UnpadBuckets(responses, s.paddedSize, s.bucketSize), nil
 }
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package pircpu
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// pin restricts the calling thread to a single core. Failure is not fatal, as
+// the scan is still correct, only less cache friendly.
+func pin(core int) {
+	var mask [1024 / 64]uint64
+	if core >= len(mask)*64 {
+		return
+	}
+	mask[core/64] = 1 << uint(core%64)
+	syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+}
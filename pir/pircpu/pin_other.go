@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package pircpu
+
+// pin is unsupported off linux, so workers are left to the scheduler.
+func pin(core int) {}
@@ -0,0 +1,84 @@
+package pircpu
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/privacylab/talek/pir/xor"
+)
+
+// scanFunc xors the buckets [lo, hi) selected by each of a batch of requests
+// into the corresponding responses.
+type scanFunc func(reqs []byte, reqLength int, responses []byte, lo int, hi int)
+
+// scanPool is a set of workers splitting database scans between them. Each
+// worker holds its own OS thread, pinned to a core where supported, so scans
+// of its part of the database stay in that core's cache.
+type scanPool struct {
+	size int
+	jobs []chan *scanJob // By worker
+}
+
+type scanJob struct {
+	fn        scanFunc
+	reqs      []byte
+	reqLength int
+	lo, hi    int
+	responses []byte
+	done      *sync.WaitGroup
+}
+
+func newScanPool(size int) *scanPool {
+	p := &scanPool{size: size}
+	p.jobs = make([]chan *scanJob, size)
+	for i := range p.jobs {
+		p.jobs[i] = make(chan *scanJob)
+		go p.work(i, p.jobs[i])
+	}
+	return p
+}
+
+func (p *scanPool) work(core int, jobs chan *scanJob) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	pin(core % runtime.NumCPU())
+
+	for job := range jobs {
+		job.fn(job.reqs, job.reqLength, job.responses, job.lo, job.hi)
+		job.done.Done()
+	}
+}
+
+// scan splits the buckets of a scan into contiguous ranges, one per worker,
+// and merges their partial responses. Ranges are aligned to whole bytes of
+// the request vectors, and start on multiples of align.
+func (p *scanPool) scan(reqs []byte, reqLength int, responseLength int, numBuckets int, align int, fn scanFunc) []byte {
+	per := (numBuckets + p.size - 1) / p.size
+	per = (per + 8*align - 1) / (8 * align) * (8 * align)
+
+	var done sync.WaitGroup
+	var partials [][]byte
+	for lo := 0; lo < numBuckets; lo += per {
+		hi := lo + per
+		if hi > numBuckets {
+			hi = numBuckets
+		}
+		partial := make([]byte, responseLength)
+		partials = append(partials, partial)
+		done.Add(1)
+		p.jobs[len(partials)-1] <- &scanJob{fn, reqs, reqLength, lo, hi, partial, &done}
+	}
+	done.Wait()
+
+	responses := partials[0]
+	for _, partial := range partials[1:] {
+		xor.Bytes(responses, responses, partial)
+	}
+	return responses
+}
+
+func (p *scanPool) close() {
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+}
@@ -3,6 +3,7 @@ package pircpu
 import (
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -21,21 +22,57 @@ type ShardCPU struct {
 	numBuckets  int
 	data        []byte
 	readVersion int
+	workers     *scanPool // nil to scan on the calling goroutine
+
+	// With readVersion 3, the xor of each subset of each group of groupBits
+	// buckets, indexed by group*2^groupBits + subset.
+	groupBits int
+	groups    []byte
 }
 
+// Read version 3 arranges the buckets as a tree of xors: leaves are groups of
+// k buckets, each holding the xor of every subset of its group, precomputed
+// when the shard is created. A read of n buckets takes the k bits selecting a
+// subset of each group, and xors the one leaf they name per group: n/k bucket
+// xors, rather than one per selected bucket. The leaves cost 2^k/k times the
+// shard's memory: 4 times for the default k of 4, 32 times for 8.
+const (
+	// DefaultGroupBits is the k of read version 3 unless one is specified.
+	DefaultGroupBits = 4
+	// MaxGroupBits bounds k, beyond which the leaves take 4096 times the
+	// shard's memory.
+	MaxGroupBits = 16
+)
+
 // NewShard creates a new cpu shard conforming to the common interface
 func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 	parts := strings.Split(userdata, ".")
-	if len(parts) < 2 {
-		fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-2]", parts)
+	if len(parts) < 2 || len(parts) > 4 {
+		fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-3][.workers[.k]]", parts)
 		return nil
 	}
 	readVersion, err := strconv.ParseInt(parts[1], 10, 32)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-2]", parts)
+		fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-3][.workers[.k]]", parts)
 		return nil
 	}
-	shard, err := NewShardCPU("CPU Shard ("+userdata+")", bucketSize, data, int(readVersion))
+	workers := int64(1)
+	if len(parts) >= 3 {
+		// 0 workers for one per core.
+		if workers, err = strconv.ParseInt(parts[2], 10, 32); err != nil || workers < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-3][.workers[.k]]", parts)
+			return nil
+		}
+	}
+	groupBits := int64(DefaultGroupBits)
+	if len(parts) == 4 {
+		// The group size of the xor tree of read version 3.
+		if groupBits, err = strconv.ParseInt(parts[3], 10, 32); err != nil || readVersion != 3 {
+			fmt.Fprintf(os.Stderr, "Invalid cpu specification: %s. Should be CPU.[0-3][.workers[.k]]", parts)
+			return nil
+		}
+	}
+	shard, err := newShardCPU("CPU Shard ("+userdata+")", bucketSize, data, int(readVersion), int(workers), int(groupBits))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not create CPU shard: %v", err)
 		return nil
@@ -53,6 +90,24 @@ func init() {
 // - len(data) must be a multiple of bucketSize
 // Returns: the shard, or an error if mismatched size
 func NewShardCPU(name string, bucketSize int, data []byte, readVersion int) (*ShardCPU, error) {
+	return NewParallelShardCPU(name, bucketSize, data, readVersion, 1)
+}
+
+// NewParallelShardCPU creates a new CPU-backed shard which splits the scan of
+// each read between a number of workers, each pinned to its own core where
+// supported. 0 workers starts one per core.
+func NewParallelShardCPU(name string, bucketSize int, data []byte, readVersion int, workers int) (*ShardCPU, error) {
+	return newShardCPU(name, bucketSize, data, readVersion, workers, DefaultGroupBits)
+}
+
+// NewTreeShardCPU creates a new CPU-backed shard reading with version 3, its
+// xor tree grouping buckets by groupBits. Each read xors numBuckets/groupBits
+// buckets, and the tree takes 2^groupBits/groupBits times the memory of data.
+func NewTreeShardCPU(name string, bucketSize int, data []byte, workers int, groupBits int) (*ShardCPU, error) {
+	return newShardCPU(name, bucketSize, data, 3, workers, groupBits)
+}
+
+func newShardCPU(name string, bucketSize int, data []byte, readVersion int, workers int, groupBits int) (*ShardCPU, error) {
 	s := &ShardCPU{}
 	s.log = common.NewLogger(name)
 	s.name = name
@@ -64,21 +119,38 @@ func NewShardCPU(name string, bucketSize int, data []byte, readVersion int) (*Sh
 		return nil, fmt.Errorf("NewShardCPU(%v) failed: data(len=%v) not multiple of bucketSize=%v", name, len(data), bucketSize)
 	}
 
-	if readVersion < 0 || readVersion > 2 {
-		return nil, fmt.Errorf("NewShardCPU(%v) failed: readVersion=%v must be 0, 1, or 2", name, readVersion)
+	if readVersion < 0 || readVersion > 3 {
+		return nil, fmt.Errorf("NewShardCPU(%v) failed: readVersion=%v must be 0, 1, 2 or 3", name, readVersion)
+	}
+
+	if groupBits < 1 || groupBits > MaxGroupBits {
+		return nil, fmt.Errorf("NewShardCPU(%v) failed: groupBits=%v must be between 1 and %v", name, groupBits, MaxGroupBits)
 	}
 
 	s.bucketSize = bucketSize
 	s.numBuckets = (len(data) / bucketSize)
 	s.data = data
 	s.readVersion = readVersion
+	if readVersion == 3 {
+		s.groupBits = groupBits
+		s.precompute()
+	}
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > 1 {
+		s.workers = newScanPool(workers)
+	}
 
 	s.log.Info.Printf("NewShardCPU(%v) finished\n", s.name)
 	return s, nil
 }
 
-// Free currently does nothing. ShardCPU waits for the go garbage collector
+// Free stops the shard's workers. ShardCPU otherwise waits for the go garbage collector
 func (s *ShardCPU) Free() error {
+	if s.workers != nil {
+		s.workers.close()
+	}
 	s.log.Info.Printf("%v.Free finished\n", s.name)
 	return nil
 }
@@ -98,6 +170,19 @@ func (s *ShardCPU) GetData() []byte {
 	return s.data[:]
 }
 
+// Devices reports the processor the shard reads on, which does so in host
+// memory, with any batch size.
+func (s *ShardCPU) Devices() []pirinterface.DeviceInfo {
+	workers := 1
+	if s.workers != nil {
+		workers = s.workers.size
+	}
+	return []pirinterface.DeviceInfo{{
+		Backing: "cpu",
+		Name:    fmt.Sprintf("%s CPU (%d workers, %s xor)", runtime.GOARCH, workers, xor.Kernel()),
+	}}
+}
+
 // Insert copies the given byte array into the specified bucket at a given offset
 // Returns the number of bytes copied. This will be <len(toCopy) if toCopy is
 // Note: This function will only output a warning if it overwrites into the next bucket
@@ -124,6 +209,8 @@ func (s *ShardCPU) Read(reqs []byte, reqLength int) ([]byte, error) {
 		return s.read1(reqs, reqLength)
 	} else if s.readVersion == 2 {
 		return s.read2(reqs, reqLength)
+	} else if s.readVersion == 3 {
+		return s.read3(reqs, reqLength)
 	}
 
 	// Default to version 0
@@ -132,14 +219,81 @@ func (s *ShardCPU) Read(reqs []byte, reqLength int) ([]byte, error) {
 
 func (s *ShardCPU) read0(reqs []byte, reqLength int) ([]byte, error) {
 	s.log.Trace.Printf("%v.read0: start\n", s.name)
+	responses := s.scan(reqs, reqLength, s.scan0)
+	s.log.Trace.Printf("%v.read0: end\n", s.name)
+	return responses, nil
+}
+
+func (s *ShardCPU) read1(reqs []byte, reqLength int) ([]byte, error) {
+	s.log.Trace.Printf("%v.read1: start\n", s.name)
+	responses := s.scan(reqs, reqLength, s.scan1)
+	s.log.Trace.Printf("%v.read1: end\n", s.name)
+	return responses, nil
+}
+
+func (s *ShardCPU) read2(reqs []byte, reqLength int) ([]byte, error) {
+	s.log.Trace.Printf("%v.read2: start\n", s.name)
+	responses := s.scan(reqs, reqLength, s.scan2)
+	s.log.Trace.Printf("%v.read2: end\n", s.name)
+	return responses, nil
+}
+
+func (s *ShardCPU) read3(reqs []byte, reqLength int) ([]byte, error) {
+	s.log.Trace.Printf("%v.read3: start\n", s.name)
+	responses := s.scan(reqs, reqLength, s.scan3)
+	s.log.Trace.Printf("%v.read3: end\n", s.name)
+	return responses, nil
+}
+
+// precompute builds the xor of each subset of each group of buckets, each from
+// that of the subset without its lowest bucket.
+func (s *ShardCPU) precompute() {
+	groupSubsets := 1 << uint(s.groupBits)
+	numGroups := (s.numBuckets + s.groupBits - 1) / s.groupBits
+	s.groups = make([]byte, numGroups*groupSubsets*s.bucketSize)
+	for group := 0; group < numGroups; group++ {
+		base := group * groupSubsets
+		for subset := 1; subset < groupSubsets; subset++ {
+			lowest := 0
+			for subset&(1<<uint(lowest)) == 0 {
+				lowest++
+			}
+			entry := s.groups[(base+subset)*s.bucketSize : (base+subset+1)*s.bucketSize]
+			rest := base + subset&(subset-1)
+			copy(entry, s.groups[rest*s.bucketSize:(rest+1)*s.bucketSize])
+			if bucketIndex := group*s.groupBits + lowest; bucketIndex < s.numBuckets {
+				xor.Words(entry, entry, s.data[bucketIndex*s.bucketSize:(bucketIndex+1)*s.bucketSize])
+			}
+		}
+	}
+}
+
+// scan computes the responses to a batch of requests with a scan function,
+// splitting the buckets between the shard's workers if it has them.
+func (s *ShardCPU) scan(reqs []byte, reqLength int, fn scanFunc) []byte {
+	numReqs := len(reqs) / reqLength
+	if s.workers == nil {
+		responses := make([]byte, numReqs*s.bucketSize)
+		fn(reqs, reqLength, responses, 0, s.numBuckets)
+		return responses
+	}
+	// Ranges of read version 3 start on whole groups.
+	align := 1
+	if s.readVersion == 3 {
+		align = s.groupBits
+	}
+	return s.workers.scan(reqs, reqLength, numReqs*s.bucketSize, s.numBuckets, align, fn)
+}
+
+// scan0 xors buckets [lo, hi) selected by each request into its response.
+func (s *ShardCPU) scan0(reqs []byte, reqLength int, responses []byte, lo int, hi int) {
 	numReqs := len(reqs) / reqLength
-	responses := make([]byte, numReqs*s.bucketSize)
 
 	// calculate PIR
 	for reqIndex := 0; reqIndex < numReqs; reqIndex++ {
 		reqOffset := reqIndex * reqLength
 		respOffset := reqIndex * s.bucketSize
-		for bucketIndex := 0; bucketIndex < s.numBuckets; bucketIndex++ {
+		for bucketIndex := lo; bucketIndex < hi; bucketIndex++ {
 			reqByte := reqs[reqOffset+(bucketIndex/8)]
 			if reqByte&(byte(1)<<uint(bucketIndex%8)) != 0 {
 				bucketOffset := bucketIndex * s.bucketSize
@@ -149,21 +303,16 @@ func (s *ShardCPU) read0(reqs []byte, reqLength int) ([]byte, error) {
 			}
 		}
 	}
-
-	s.log.Trace.Printf("%v.read0: end\n", s.name)
-	return responses, nil
 }
 
-func (s *ShardCPU) read1(reqs []byte, reqLength int) ([]byte, error) {
-	s.log.Trace.Printf("%v.read1: start\n", s.name)
+func (s *ShardCPU) scan1(reqs []byte, reqLength int, responses []byte, lo int, hi int) {
 	numReqs := len(reqs) / reqLength
-	responses := make([]byte, numReqs*s.bucketSize)
 
 	// calculate PIR
 	for reqIndex := 0; reqIndex < numReqs; reqIndex++ {
 		reqOffset := reqIndex * reqLength
 		respOffset := reqIndex * s.bucketSize
-		for bucketIndex := 0; bucketIndex < s.numBuckets; bucketIndex++ {
+		for bucketIndex := lo; bucketIndex < hi; bucketIndex++ {
 			reqByte := reqs[reqOffset+(bucketIndex/8)]
 			if reqByte&(byte(1)<<uint(bucketIndex%8)) != 0 {
 				bucketOffset := bucketIndex * s.bucketSize
@@ -173,20 +322,15 @@ func (s *ShardCPU) read1(reqs []byte, reqLength int) ([]byte, error) {
 			}
 		}
 	}
-
-	s.log.Trace.Printf("%v.read1: end\n", s.name)
-	return responses, nil
 }
 
-func (s *ShardCPU) read2(reqs []byte, reqLength int) ([]byte, error) {
-	s.log.Trace.Printf("%v.read2: start\n", s.name)
+func (s *ShardCPU) scan2(reqs []byte, reqLength int, responses []byte, lo int, hi int) {
 	numReqs := len(reqs) / reqLength
-	responses := make([]byte, numReqs*s.bucketSize)
 
 	// calculate PIR
 	// Note: Much better for outer loop to be reqIndex, not bucketIndex
 	for reqIndex := 0; reqIndex < numReqs; reqIndex++ {
-		for bucketIndex := 0; bucketIndex < s.numBuckets; bucketIndex++ {
+		for bucketIndex := lo; bucketIndex < hi; bucketIndex++ {
 			reqByte := reqs[reqIndex*reqLength+(bucketIndex/8)]
 			if reqByte&(byte(1)<<uint(bucketIndex%8)) != 0 {
 				bucket := s.data[(bucketIndex * s.bucketSize):]
@@ -197,7 +341,37 @@ func (s *ShardCPU) read2(reqs []byte, reqLength int) ([]byte, error) {
 			}
 		}
 	}
+}
 
-	s.log.Trace.Printf("%v.read2: end\n", s.name)
-	return responses, nil
+// scan3 xors the precomputed subset of each group of buckets in [lo, hi)
+// selected by each request into its response. lo starts a group.
+func (s *ShardCPU) scan3(reqs []byte, reqLength int, responses []byte, lo int, hi int) {
+	numReqs := len(reqs) / reqLength
+
+	for reqIndex := 0; reqIndex < numReqs; reqIndex++ {
+		req := reqs[(reqIndex * reqLength):((reqIndex + 1) * reqLength)]
+		response := responses[(reqIndex * s.bucketSize):((reqIndex + 1) * s.bucketSize)]
+		for first := lo; first < hi; first += s.groupBits {
+			width := s.groupBits
+			if hi-first < width {
+				width = hi - first
+			}
+			if subset := requestBits(req, first, width); subset != 0 {
+				entry := ((first/s.groupBits)<<uint(s.groupBits) + subset) * s.bucketSize
+				xor.Words(response, response, s.groups[entry:entry+s.bucketSize])
+			}
+		}
+	}
+}
+
+// requestBits returns the n bits of a request vector from bucket first on, the
+// lowest bit selecting bucket first.
+func requestBits(req []byte, first int, n int) int {
+	bits := 0
+	for got := 0; got < n; {
+		bucket := first + got
+		bits |= int(req[bucket/8]>>uint(bucket%8)) << uint(got)
+		got += 8 - bucket%8
+	}
+	return bits & (1<<uint(n) - 1)
 }
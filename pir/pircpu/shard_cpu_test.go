@@ -1,7 +1,9 @@
 package pircpu
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/privacylab/talek/common"
@@ -109,6 +111,71 @@ func TestShardCPUReadv2(t *testing.T) {
 	fmt.Printf("... done \n")
 }
 
+func TestShardCPUReadv3(t *testing.T) {
+	fmt.Printf("TestShardCPUReadv3: ...\n")
+	beforeEach()
+	shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), "cpu.3")
+	if shard == nil {
+		t.Fatalf("cannot create new ShardCPU v3\n")
+	}
+	pt.HelperTestShardRead(t, shard)
+	pt.HelperTestClientRead(t, shard)
+	pt.AfterEach(t, shard, nil)
+	fmt.Printf("... done \n")
+}
+
+func TestShardCPUReadv3Groups(t *testing.T) {
+	fmt.Printf("TestShardCPUReadv3Groups: ...\n")
+	beforeEach()
+	// 21 buckets leaves a partial group, and request bits beyond the last bucket.
+	bucketSize := pt.TestMessageSize
+	data := pt.GenerateData(21 * bucketSize)
+	reqLength := 3
+	reqs := make([]byte, reqLength*pt.TestBatchSize*4)
+	rand.New(rand.NewSource(1)).Read(reqs)
+	scan, err := NewShardCPU("shardcpuv0", bucketSize, data, 0)
+	if err != nil {
+		t.Fatalf("cannot create new ShardCPU v0: %v\n", err)
+	}
+	expected, _ := scan.Read(reqs, reqLength)
+	// Groups of 3 and 11 straddle bytes of the request vectors.
+	for _, groupBits := range []int{1, 3, 4, 8, 11} {
+		for _, workers := range []int{1, 2} {
+			shard, err := NewTreeShardCPU("shardcpuv3", bucketSize, data, workers, groupBits)
+			if err != nil {
+				t.Fatalf("cannot create new ShardCPU v3: %v\n", err)
+			}
+			response, err := shard.Read(reqs, reqLength)
+			if err != nil || !bytes.Equal(response, expected) {
+				t.Fatalf("v3 read with k=%d and %d workers differs from a scan: %v\n", groupBits, workers, err)
+			}
+			pt.AfterEach(t, shard, nil)
+		}
+	}
+	if _, err = NewTreeShardCPU("shardcpuv3", bucketSize, data, 1, MaxGroupBits+1); err == nil {
+		t.Fatalf("created a ShardCPU v3 with k beyond %d\n", MaxGroupBits)
+	}
+	pt.AfterEach(t, scan, nil)
+	fmt.Printf("... done \n")
+}
+
+func TestShardCPUReadParallel(t *testing.T) {
+	fmt.Printf("TestShardCPUReadParallel: ...\n")
+	beforeEach()
+	for _, spec := range []string{"cpu.0.4", "cpu.1.3", "cpu.2.0", "cpu.3.2", "cpu.3.3.6"} {
+		shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), spec)
+		if shard == nil {
+			t.Fatalf("cannot create new ShardCPU %s\n", spec)
+		}
+		pt.HelperTestShardRead(t, shard)
+		pt.AfterEach(t, shard, nil)
+	}
+	if NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), "cpu.0.x") != nil {
+		t.Fatalf("new ShardCPU should have failed with invalid workers, but returned a shard")
+	}
+	fmt.Printf("... done \n")
+}
+
 func BenchmarkShardCPUReadv0(b *testing.B) {
 	//fmt.Printf("BenchmarkShardCPUReadv0 began with N=%d... \n", b.N)
 	beforeEach()
@@ -141,3 +208,23 @@ func BenchmarkShardCPUReadv2(b *testing.B) {
 	pt.HelperBenchmarkShardRead(b, shard, pt.BenchBatchSize)
 	pt.AfterEach(b, shard, nil)
 }
+
+func BenchmarkShardCPUReadv3(b *testing.B) {
+	beforeEach()
+	shard := NewShard(pt.BenchDepth*pt.BenchMessageSize, pt.GenerateData(pt.BenchNumMessages*pt.BenchMessageSize), "cpu.3")
+	if shard == nil {
+		b.Fatalf("cannot create new ShardCPU v3\n")
+	}
+	pt.HelperBenchmarkShardRead(b, shard, pt.BenchBatchSize)
+	pt.AfterEach(b, shard, nil)
+}
+
+func BenchmarkShardCPUReadParallel(b *testing.B) {
+	beforeEach()
+	shard := NewShard(pt.BenchDepth*pt.BenchMessageSize, pt.GenerateData(pt.BenchNumMessages*pt.BenchMessageSize), "cpu.0.0")
+	if shard == nil {
+		b.Fatalf("cannot create new parallel ShardCPU\n")
+	}
+	pt.HelperBenchmarkShardRead(b, shard, pt.BenchBatchSize)
+	pt.AfterEach(b, shard, nil)
+}
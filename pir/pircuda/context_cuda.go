@@ -3,6 +3,7 @@
 package pircuda
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/barnex/cuda5/cu"
@@ -10,7 +11,7 @@ import (
 )
 
 const (
-	// CudaDeviceID is the hardcoded GPU device we'll use
+	// CudaDeviceID is the GPU device used unless another is selected
 	CudaDeviceID = 0
 )
 
@@ -32,6 +33,12 @@ type ContextCUDA struct {
 
 // NewContextCUDA creates a new CUDA context, shared among ShardCUDA instances
 func NewContextCUDA(name string, kernelSource string, kernelDataSize int) (*ContextCUDA, error) {
+	return NewContextCUDAOnDevice(name, kernelSource, kernelDataSize, CudaDeviceID)
+}
+
+// NewContextCUDAOnDevice creates a new CUDA context like NewContextCUDA, on
+// the device of an index.
+func NewContextCUDAOnDevice(name string, kernelSource string, kernelDataSize int, device int) (*ContextCUDA, error) {
 	c := &ContextCUDA{}
 	c.log = common.NewLogger(name)
 	c.name = name
@@ -40,7 +47,10 @@ func NewContextCUDA(name string, kernelSource string, kernelDataSize int) (*Cont
 	c.kernelDataSize = kernelDataSize
 
 	cu.Init(0)
-	c.device = cu.DeviceGet(CudaDeviceID)
+	if device < 0 || device >= cu.DeviceGetCount() {
+		return nil, fmt.Errorf("NewContextCUDA: no CUDA device %d", device)
+	}
+	c.device = cu.DeviceGet(device)
 	c.groupSize = c.device.Attribute(cu.MAX_THREADS_PER_BLOCK)
 	c.Ctx = cu.CtxCreate(cu.CTX_SCHED_AUTO, c.device)
 	c.Ctx.SetCurrent()
@@ -70,6 +80,16 @@ func (c *ContextCUDA) GetGroupSize() int {
 	return c.groupSize
 }
 
+// GetDeviceName returns the name of the device of this context
+func (c *ContextCUDA) GetDeviceName() string {
+	return c.device.Name()
+}
+
+// GetDeviceMemory returns the global memory (in bytes) of the device of this context
+func (c *ContextCUDA) GetDeviceMemory() uint64 {
+	return uint64(c.device.TotalMem())
+}
+
 // GetKernelDataSize returns the size (in bytes) of a single data item in the kernel
 func (c *ContextCUDA) GetKernelDataSize() int {
 	return c.kernelDataSize
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/barnex/cuda5/cu"
@@ -25,15 +26,30 @@ type ShardCUDA struct {
 	data       []byte
 	numThreads int
 	cudaData   cu.DevicePtr
+	// Size of buckets on the device, padded to whole kernel data items
+	paddedSize int
+
+	launchLock sync.Mutex
+	launch     pirinterface.LaunchParams
 }
 
-// NewShard creates a new cuda shard conforming to the common interface
+// NewShard creates a new cuda shard conforming to the common interface.
+// The userdata cuda.[context].[contextdatasize].[threads] may be followed by
+// .[device], the index of the device to compute on rather than CudaDeviceID.
 func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 	parts := strings.Split(userdata, ".")
 	if len(parts) < 4 {
-		fmt.Fprintf(os.Stderr, "Invalid cuda specification: %s. Should be cuda.[context].[contextdatasize].[threads]", parts)
+		fmt.Fprintf(os.Stderr, "Invalid cuda specification: %s. Should be cuda.[context].[contextdatasize].[threads](.[device])", parts)
 		return nil
 	}
+	device := int64(CudaDeviceID)
+	if len(parts) > 4 {
+		var err error
+		if device, err = strconv.ParseInt(parts[4], 10, 32); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid device: %s. Should be numeric", parts[4])
+			return nil
+		}
+	}
 
 	contextDataSize, err := strconv.ParseInt(parts[2], 10, 32)
 	if err != nil {
@@ -41,9 +57,10 @@ func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
 		return nil
 	}
 
-	context, err := NewContextCUDA("contextcuda", parts[1], int(contextDataSize))
+	context, err := NewContextCUDAOnDevice("contextcuda", parts[1], int(contextDataSize), int(device))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cannot create new ContextCUDA: error=%v\n", err)
+		return nil
 	}
 
 	threads, err := strconv.ParseInt(parts[3], 10, 32)
@@ -94,8 +111,10 @@ func NewShardCUDA(name string, context *ContextCUDA, bucketSize int, data []byte
 		s.context.Ctx.SetCurrent()
 	}
 	//  Create buffers
-	s.cudaData = cu.MemAlloc(int64(len(data)))
-	cu.MemcpyHtoD(s.cudaData, unsafe.Pointer(&data[0]), int64(len(data)))
+	s.paddedSize = pirinterface.PaddedBucketSize(bucketSize, context.GetKernelDataSize())
+	deviceData := pirinterface.PadBuckets(data, bucketSize, s.paddedSize)
+	s.cudaData = cu.MemAlloc(int64(len(deviceData)))
+	cu.MemcpyHtoD(s.cudaData, unsafe.Pointer(&deviceData[0]), int64(len(deviceData)))
 
 	s.log.Info.Printf("NewShardCUDA(%v) finished\n", s.name)
 	return s, nil
@@ -141,9 +160,74 @@ func (s *ShardCUDA) Read(reqs []byte, reqLength int) ([]byte, error) {
 		return nil, rErr
 	}
 
+	launch := s.GetLaunchParams()
+	batch := len(reqs) / reqLength
+	if launch.BatchSize == 0 || batch <= launch.BatchSize {
+		return s.read(reqs, reqLength, launch)
+	}
+	responses := make([]byte, 0, batch*s.bucketSize)
+	for start := 0; start < batch; start += launch.BatchSize {
+		end := start + launch.BatchSize
+		if end > batch {
+			end = batch
+		}
+		response, err := s.read(reqs[start*reqLength:end*reqLength], reqLength, launch)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response...)
+	}
+	s.log.Trace.Printf("%v.Read: end\n", s.name)
+	return responses, nil
+}
+
+// Devices reports the device the shard reads on, and the batch size it
+// computes in one kernel launch.
+func (s *ShardCUDA) Devices() []pirinterface.DeviceInfo {
+	return []pirinterface.DeviceInfo{{
+		Backing:      "cuda",
+		Name:         s.context.GetDeviceName(),
+		Memory:       s.context.GetDeviceMemory(),
+		MaxBatchSize: s.GetLaunchParams().BatchSize,
+	}}
+}
+
+// GetLaunchParams returns the parameters kernels are launched with.
+func (s *ShardCUDA) GetLaunchParams() pirinterface.LaunchParams {
+	s.launchLock.Lock()
+	defer s.launchLock.Unlock()
+	launch := s.launch
+	if launch.Threads == 0 {
+		launch.Threads = s.numThreads
+	}
+	if launch.GroupSize == 0 {
+		launch.GroupSize = s.context.GetGroupSize()
+	}
+	return launch
+}
+
+// SetLaunchParams changes the parameters later reads launch kernels with.
+func (s *ShardCUDA) SetLaunchParams(params pirinterface.LaunchParams) error {
+	if err := params.Validate(s.context.GetGroupSize()); err != nil {
+		return err
+	}
+	s.launchLock.Lock()
+	s.launch = params
+	s.launchLock.Unlock()
+	s.log.Info.Printf("%v.SetLaunchParams: %+v\n", s.name, params)
+	return nil
+}
+
+/*********************************************
+ * PRIVATE METHODS
+ *********************************************/
+
+// read computes a batch of requests in one kernel launch.
+func (s *ShardCUDA) read(reqs []byte, reqLength int, launch pirinterface.LaunchParams) ([]byte, error) {
 	inputSize := int64(len(reqs))
 	batchSize := inputSize / int64(reqLength)
-	outputSize := batchSize * int64(s.bucketSize)
+	// Responses are computed in padded buckets.
+	outputSize := batchSize * int64(s.paddedSize)
 	responses := make([]byte, outputSize)
 
 	// Weird context hack
@@ -169,34 +253,46 @@ func (s *ShardCUDA) Read(reqs []byte, reqLength int) ([]byte, error) {
 	//cu.MemcpyHtoD(output, unsafe.Pointer(&responses[0]), outputSize)
 	cu.MemsetD8(output, 0, outputSize)
 
-	//Set kernel args
-	data := s.cudaData
+	// The kernel xors one data item per thread into the responses, so the
+	// database is swept in passes covering as many buckets as there are
+	// threads for. Passes start on whole bytes of the request vectors.
 	batchSize32 := int32(batchSize)
 	reqLength32 := int32(reqLength)
-	numBuckets32 := int32(s.numBuckets)
-	bucketSize32 := int32(s.bucketSize / s.context.GetKernelDataSize())
-	local := s.context.GetGroupSize()
-	global := s.numThreads
+	bucketSize32 := int32(s.paddedSize / s.context.GetKernelDataSize())
+	local := launch.GroupSize
+	global := launch.Threads
 	if global < local {
 		local = global
 	}
-	global32 := int32(global)
-	args := []unsafe.Pointer{
-		unsafe.Pointer(&data),
-		unsafe.Pointer(&input),
-		unsafe.Pointer(&output),
-		unsafe.Pointer(&batchSize32),
-		unsafe.Pointer(&reqLength32),
-		unsafe.Pointer(&numBuckets32),
-		unsafe.Pointer(&bucketSize32),
-		unsafe.Pointer(&global32),
+	perPass := (global / int(bucketSize32)) &^ 7
+	if perPass == 0 {
+		perPass = 8
 	}
 
 	/** START LOCK REGION **/
 	//s.context.KernelMutex.Lock()
 
-	//cu.LaunchKernel(s.context.ZeroFn, (global-1)/local+1, 1, 1, local, 1, 1, 0, 0, args)
-	cu.LaunchKernel(s.context.PIRFn, (global-1)/local+1, 1, 1, local, 1, 1, 0, 0, args)
+	for first := 0; first < s.numBuckets; first += perPass {
+		last := first + perPass
+		if last > s.numBuckets {
+			last = s.numBuckets
+		}
+		data := s.cudaData + cu.DevicePtr(first*s.paddedSize)
+		passReqs := input + cu.DevicePtr(first/8)
+		numBuckets32 := int32(last - first)
+		global32 := int32(last-first) * bucketSize32
+		args := []unsafe.Pointer{
+			unsafe.Pointer(&data),
+			unsafe.Pointer(&passReqs),
+			unsafe.Pointer(&output),
+			unsafe.Pointer(&batchSize32),
+			unsafe.Pointer(&reqLength32),
+			unsafe.Pointer(&numBuckets32),
+			unsafe.Pointer(&bucketSize32),
+			unsafe.Pointer(&global32),
+		}
+		cu.LaunchKernel(s.context.PIRFn, (int(global32)-1)/local+1, 1, 1, local, 1, 1, 0, 0, args)
+	}
 	cu.CtxSynchronize()
 
 	//s.context.KernelMutex.Unlock()
@@ -206,5 +302,5 @@ func (s *ShardCUDA) Read(reqs []byte, reqLength int) ([]byte, error) {
 	cu.MemcpyDtoH(unsafe.Pointer(&responses[0]), output, outputSize)
 
 	s.log.Trace.Printf("%v.Read: end \n", s.name)
-	return responses, nil
+	return pirinterface.UnpadBuckets(responses, s.paddedSize, s.bucketSize), nil
 }
@@ -0,0 +1,134 @@
+package pirext
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// maxPathLength bounds the path an OpAttach may carry.
+const maxPathLength = 4096
+
+// Engine is a reference implementation of the engine side of the protocol,
+// which reads with one of the registered backings. It serves as a model for
+// hardware engines, and to test the protocol against.
+type Engine struct {
+	log     *common.Logger
+	name    string
+	backing string
+	cons    func(int, []byte, string) pirinterface.Shard
+}
+
+// NewEngine creates an engine reading with the given backing, e.g. "cpu.0".
+func NewEngine(name string, backing string) (*Engine, error) {
+	e := &Engine{}
+	e.log = common.NewLogger(name)
+	e.name = name
+	e.backing = backing
+	e.cons = pirinterface.GetBacking(backing)
+	if e.cons == nil {
+		return nil, fmt.Errorf("NewEngine(%v) failed: no backing %v", name, backing)
+	}
+	return e, nil
+}
+
+// Serve attaches shards connecting on a listener, until it is closed.
+func (e *Engine) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go e.handle(conn)
+	}
+}
+
+// handle serves a single shard. Reads are computed in the order they arrive.
+func (e *Engine) handle(conn net.Conn) {
+	defer conn.Close()
+
+	header, mem, shard, err := e.attach(conn)
+	if err != nil {
+		e.log.Warn.Printf("%v: could not attach: %v\n", e.name, err)
+		WriteMessage(conn, Message{Op: OpAttach, Arg: StatusInvalid})
+		return
+	}
+	defer unmapFile(mem)
+	defer shard.Free()
+	if err = WriteMessage(conn, Message{Op: OpAttach, Arg: StatusOK}); err != nil {
+		return
+	}
+
+	for {
+		m, err := ReadMessage(conn)
+		if err != nil || m.Op == OpDetach {
+			return
+		}
+		if m.Op != OpRead {
+			e.log.Warn.Printf("%v: unexpected op %d\n", e.name, m.Op)
+			continue
+		}
+		status := StatusOK
+		if m.Slot >= header.Slots || m.Arg == 0 || m.Arg > uint64(header.SlotBatch) {
+			status = StatusInvalid
+		} else {
+			n := int(m.Arg)
+			responses, err := shard.Read(header.Requests(mem, int(m.Slot), n), int(header.ReqLength))
+			if err != nil {
+				e.log.Warn.Printf("%v: read of slot %d failed: %v\n", e.name, m.Slot, err)
+				status = StatusFailed
+			} else {
+				copy(header.Responses(mem, int(m.Slot), n), responses)
+			}
+		}
+		if err = WriteMessage(conn, Message{Op: OpDone, Slot: m.Slot, Arg: status}); err != nil {
+			return
+		}
+	}
+}
+
+// attach maps the shared file named by an OpAttach, and creates a shard over
+// the database within it.
+func (e *Engine) attach(conn net.Conn) (Header, []byte, pirinterface.Shard, error) {
+	m, err := ReadMessage(conn)
+	if err != nil {
+		return Header{}, nil, nil, err
+	}
+	if m.Op != OpAttach || m.Arg == 0 || m.Arg > maxPathLength {
+		return Header{}, nil, nil, fmt.Errorf("expected attach, got op %d", m.Op)
+	}
+	path := make([]byte, m.Arg)
+	if _, err = io.ReadFull(conn, path); err != nil {
+		return Header{}, nil, nil, err
+	}
+
+	f, err := os.OpenFile(string(path), os.O_RDWR, 0)
+	if err != nil {
+		return Header{}, nil, nil, err
+	}
+	// The mapping outlives the file descriptor.
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Header{}, nil, nil, err
+	}
+	mem, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return Header{}, nil, nil, err
+	}
+	header, err := UnmarshalHeader(mem)
+	if err != nil {
+		unmapFile(mem)
+		return Header{}, nil, nil, err
+	}
+	shard := e.cons(int(header.BucketSize), header.Data(mem), e.backing)
+	if shard == nil {
+		unmapFile(mem)
+		return Header{}, nil, nil, fmt.Errorf("could not create backing %v", e.backing)
+	}
+	return header, mem, shard, nil
+}
@@ -0,0 +1,193 @@
+// Package pirext reads from PIR engines outside the process, such as FPGAs or
+// SmartNICs, over a stable protocol, so that they plug in as a backing without
+// changes to the shard.
+//
+// The shard and engine share a memory mapped file, which holds a header, the
+// database, and a ring of slots for batches of requests and their responses.
+// All integers are little endian.
+//
+//	Header (HeaderSize bytes at offset 0)
+//	  0  [8]byte Magic
+//	  8  uint32  Version
+//	  12 uint32  bucket size, in bytes
+//	  16 uint32  number of buckets
+//	  20 uint32  request length, in bytes: (number of buckets + 7) / 8
+//	  24 uint32  number of slots
+//	  28 uint32  most requests held in a slot
+//	  32 uint64  offset of the database
+//	  40 uint64  offset of the ring
+//	  48 uint64  size of a slot, in bytes
+//
+// Slot i starts at ring offset + i * slot size. Its requests come first,
+// followed by room for a response of bucket size bytes to each, starting at
+// most requests * request length bytes into the slot. Offsets are aligned to
+// Alignment bytes.
+//
+// The shard controls the engine over a unix stream socket with messages of
+// MessageSize bytes: a uint32 op, a uint32 slot and a uint64 argument.
+//
+//	OpAttach  shard -> engine: argument is the length of the path of the shared
+//	          file, which follows the message. The engine maps it, and answers
+//	          with OpAttach, whose argument is a Status.
+//	OpRead    shard -> engine: the slot holds argument requests. The engine
+//	          writes their responses to the slot, and answers with OpDone.
+//	OpDone    engine -> shard: the slot is read, with a Status as argument.
+//	          Slots may be read concurrently and answered in any order.
+//	OpDetach  shard -> engine: no reads are outstanding, and the engine should
+//	          unmap the shared file. Closing the socket has the same effect.
+package pirext
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Protocol constants
+const (
+	Magic       = "TALEKPIR"
+	Version     = 1
+	HeaderSize  = 64
+	MessageSize = 16
+	Alignment   = 4096
+)
+
+// Control socket operations
+const (
+	OpAttach uint32 = iota + 1
+	OpRead
+	OpDone
+	OpDetach
+)
+
+// Status answers an OpAttach or OpRead
+const (
+	StatusOK uint64 = iota
+	StatusFailed
+	StatusInvalid
+)
+
+// Header describes the layout of the shared file.
+type Header struct {
+	BucketSize uint32
+	NumBuckets uint32
+	ReqLength  uint32
+	Slots      uint32
+	SlotBatch  uint32
+	DataOffset uint64
+	RingOffset uint64
+	SlotSize   uint64
+}
+
+// NewHeader lays out a shared file for a database and ring of the given sizes.
+func NewHeader(bucketSize, numBuckets, slots, slotBatch int) Header {
+	h := Header{
+		BucketSize: uint32(bucketSize),
+		NumBuckets: uint32(numBuckets),
+		ReqLength:  uint32((numBuckets + 7) / 8),
+		Slots:      uint32(slots),
+		SlotBatch:  uint32(slotBatch),
+		DataOffset: Alignment,
+	}
+	h.RingOffset = align(h.DataOffset + uint64(bucketSize)*uint64(numBuckets))
+	h.SlotSize = align(uint64(slotBatch) * (uint64(h.ReqLength) + uint64(bucketSize)))
+	return h
+}
+
+// Size returns the length of the shared file.
+func (h Header) Size() int {
+	return int(h.RingOffset + uint64(h.Slots)*h.SlotSize)
+}
+
+// Data returns the database within the mapped shared file.
+func (h Header) Data(mem []byte) []byte {
+	return mem[h.DataOffset : h.DataOffset+uint64(h.BucketSize)*uint64(h.NumBuckets)]
+}
+
+// Requests returns the n requests in a slot within the mapped shared file.
+func (h Header) Requests(mem []byte, slot int, n int) []byte {
+	start := h.RingOffset + uint64(slot)*h.SlotSize
+	return mem[start : start+uint64(n)*uint64(h.ReqLength)]
+}
+
+// Responses returns the responses to n requests in a slot within the mapped
+// shared file.
+func (h Header) Responses(mem []byte, slot int, n int) []byte {
+	start := h.RingOffset + uint64(slot)*h.SlotSize + uint64(h.SlotBatch)*uint64(h.ReqLength)
+	return mem[start : start+uint64(n)*uint64(h.BucketSize)]
+}
+
+// Marshal writes the header to the start of the mapped shared file.
+func (h Header) Marshal(mem []byte) {
+	copy(mem[0:8], Magic)
+	binary.LittleEndian.PutUint32(mem[8:], Version)
+	binary.LittleEndian.PutUint32(mem[12:], h.BucketSize)
+	binary.LittleEndian.PutUint32(mem[16:], h.NumBuckets)
+	binary.LittleEndian.PutUint32(mem[20:], h.ReqLength)
+	binary.LittleEndian.PutUint32(mem[24:], h.Slots)
+	binary.LittleEndian.PutUint32(mem[28:], h.SlotBatch)
+	binary.LittleEndian.PutUint64(mem[32:], h.DataOffset)
+	binary.LittleEndian.PutUint64(mem[40:], h.RingOffset)
+	binary.LittleEndian.PutUint64(mem[48:], h.SlotSize)
+}
+
+// UnmarshalHeader reads and checks the header of a mapped shared file.
+func UnmarshalHeader(mem []byte) (Header, error) {
+	h := Header{}
+	if len(mem) < HeaderSize || string(mem[0:8]) != Magic {
+		return h, fmt.Errorf("not a talek PIR shared file")
+	}
+	if v := binary.LittleEndian.Uint32(mem[8:]); v != Version {
+		return h, fmt.Errorf("unsupported protocol version %d", v)
+	}
+	h.BucketSize = binary.LittleEndian.Uint32(mem[12:])
+	h.NumBuckets = binary.LittleEndian.Uint32(mem[16:])
+	h.ReqLength = binary.LittleEndian.Uint32(mem[20:])
+	h.Slots = binary.LittleEndian.Uint32(mem[24:])
+	h.SlotBatch = binary.LittleEndian.Uint32(mem[28:])
+	h.DataOffset = binary.LittleEndian.Uint64(mem[32:])
+	h.RingOffset = binary.LittleEndian.Uint64(mem[40:])
+	h.SlotSize = binary.LittleEndian.Uint64(mem[48:])
+
+	if h.ReqLength != (h.NumBuckets+7)/8 || h.Slots == 0 || h.SlotBatch == 0 ||
+		h.DataOffset < HeaderSize || h.RingOffset < h.DataOffset+uint64(h.BucketSize)*uint64(h.NumBuckets) ||
+		h.SlotSize < uint64(h.SlotBatch)*(uint64(h.ReqLength)+uint64(h.BucketSize)) ||
+		uint64(len(mem)) < h.RingOffset+uint64(h.Slots)*h.SlotSize {
+		return h, fmt.Errorf("inconsistent shared file layout")
+	}
+	return h, nil
+}
+
+// Message is a control socket message.
+type Message struct {
+	Op   uint32
+	Slot uint32
+	Arg  uint64
+}
+
+// WriteMessage sends a message over the control socket.
+func WriteMessage(w io.Writer, m Message) error {
+	var buf [MessageSize]byte
+	binary.LittleEndian.PutUint32(buf[0:], m.Op)
+	binary.LittleEndian.PutUint32(buf[4:], m.Slot)
+	binary.LittleEndian.PutUint64(buf[8:], m.Arg)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadMessage receives a message from the control socket.
+func ReadMessage(r io.Reader) (Message, error) {
+	var buf [MessageSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Op:   binary.LittleEndian.Uint32(buf[0:]),
+		Slot: binary.LittleEndian.Uint32(buf[4:]),
+		Arg:  binary.LittleEndian.Uint64(buf[8:]),
+	}, nil
+}
+
+func align(n uint64) uint64 {
+	return (n + Alignment - 1) / Alignment * Alignment
+}
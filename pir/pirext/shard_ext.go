@@ -0,0 +1,319 @@
+package pirext
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// ShardExt represents a read-only shard of the database
+// read by an external PIR engine
+type ShardExt struct {
+	// Private State
+	log        *common.Logger
+	name       string
+	bucketSize int
+	numBuckets int
+	data       []byte
+	socket     string
+
+	header Header
+	file   *os.File
+	mem    []byte
+	conn   net.Conn
+	slots  chan int // Free slots of the ring
+	done   chan struct{}
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	pending   map[uint32]chan uint64
+	err       error // Set once the engine can no longer be reached
+}
+
+// NewShard creates a new external shard conforming to the common interface.
+// The specification is ext.[slots].[batch].[socket], with a ring of slots
+// holding up to batch requests each, shared with the engine listening on the
+// unix socket.
+func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
+	parts := strings.SplitN(userdata, ".", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		fmt.Fprintf(os.Stderr, "Invalid ext specification: %s. Should be ext.[slots].[batch].[socket]", userdata)
+		return nil
+	}
+	slots, err := strconv.Atoi(parts[1])
+	if err != nil || slots <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid ext specification: %s. Should be ext.[slots].[batch].[socket]", userdata)
+		return nil
+	}
+	batch, err := strconv.Atoi(parts[2])
+	if err != nil || batch <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid ext specification: %s. Should be ext.[slots].[batch].[socket]", userdata)
+		return nil
+	}
+	shard, err := NewShardExt("Ext Shard ("+userdata+")", bucketSize, data, parts[3], slots, batch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create ext shard: %v", err)
+		return nil
+	}
+	return pirinterface.Shard(shard)
+}
+
+func init() {
+	pirinterface.Register("ext", NewShard)
+}
+
+// NewShardExt shares data with the engine listening on a unix socket, in a
+// file with a ring of slots for requests, each holding up to slotBatch.
+func NewShardExt(name string, bucketSize int, data []byte, socket string, slots int, slotBatch int) (*ShardExt, error) {
+	s := &ShardExt{}
+	s.log = common.NewLogger(name)
+	s.name = name
+
+	if bucketSize <= 0 || len(data)%bucketSize != 0 {
+		return nil, fmt.Errorf("NewShardExt(%v) failed: data(len=%v) not multiple of bucketSize=%v", name, len(data), bucketSize)
+	}
+	s.bucketSize = bucketSize
+	s.numBuckets = len(data) / bucketSize
+	s.data = data
+	s.socket = socket
+	s.header = NewHeader(bucketSize, s.numBuckets, slots, slotBatch)
+
+	// Prefer a memory backed file system for the shared file.
+	dir := ""
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		dir = "/dev/shm"
+	}
+	var err error
+	if s.file, err = ioutil.TempFile(dir, "talek-pir-"); err != nil {
+		return nil, fmt.Errorf("NewShardExt(%v) failed: %v", name, err)
+	}
+	// The file is unlinked once the engine has mapped it, or on failure.
+	defer os.Remove(s.file.Name())
+	if err = s.file.Truncate(int64(s.header.Size())); err != nil {
+		s.Free()
+		return nil, fmt.Errorf("NewShardExt(%v) failed: %v", name, err)
+	}
+	if s.mem, err = mapFile(s.file, s.header.Size()); err != nil {
+		s.Free()
+		return nil, fmt.Errorf("NewShardExt(%v) failed: %v", name, err)
+	}
+	s.header.Marshal(s.mem)
+	copy(s.header.Data(s.mem), data)
+
+	if err = s.attach(); err != nil {
+		s.Free()
+		return nil, fmt.Errorf("NewShardExt(%v) failed: %v", name, err)
+	}
+
+	s.slots = make(chan int, slots)
+	for i := 0; i < slots; i++ {
+		s.slots <- i
+	}
+	s.pending = make(map[uint32]chan uint64)
+	s.done = make(chan struct{})
+	go s.receive()
+
+	s.log.Info.Printf("NewShardExt(%v) finished\n", s.name)
+	return s, nil
+}
+
+/*********************************************
+ * PUBLIC METHODS
+ *********************************************/
+
+// Free detaches from the engine and unmaps the shared file.
+func (s *ShardExt) Free() error {
+	var err error
+	if s.conn != nil {
+		s.writeLock.Lock()
+		WriteMessage(s.conn, Message{Op: OpDetach})
+		s.writeLock.Unlock()
+		err = s.conn.Close()
+		if s.done != nil {
+			<-s.done
+		}
+		s.conn = nil
+	}
+	if s.mem != nil {
+		if e := unmapFile(s.mem); e != nil {
+			err = e
+		}
+		s.mem = nil
+	}
+	if s.file != nil {
+		if e := s.file.Close(); e != nil {
+			err = e
+		}
+		s.file = nil
+	}
+	return err
+}
+
+// GetBucketSize returns the size (in bytes) of a bucket
+func (s *ShardExt) GetBucketSize() int {
+	return s.bucketSize
+}
+
+// GetNumBuckets returns the number of buckets in the shard
+func (s *ShardExt) GetNumBuckets() int {
+	return s.numBuckets
+}
+
+// GetData returns a slice of the data
+func (s *ShardExt) GetData() []byte {
+	return s.data
+}
+
+// Devices reports the engine, which computes reads of up to a slot at a time.
+func (s *ShardExt) Devices() []pirinterface.DeviceInfo {
+	return []pirinterface.DeviceInfo{{
+		Backing:      "ext",
+		Name:         "external engine at " + s.socket,
+		MaxBatchSize: int(s.header.SlotBatch),
+	}}
+}
+
+// Read handles a batch read, passing it to the engine a slot at a time.
+// Slots are read concurrently, so batches larger than a slot are pipelined.
+func (s *ShardExt) Read(reqs []byte, reqLength int) ([]byte, error) {
+	if reqLength != int(s.header.ReqLength) {
+		return nil, fmt.Errorf("%v.Read: requests must be %d bytes, not %d", s.name, s.header.ReqLength, reqLength)
+	}
+	if len(reqs)%reqLength != 0 {
+		return nil, fmt.Errorf("%v.Read: requests of %d bytes are not a whole batch of %d byte requests", s.name, len(reqs), reqLength)
+	}
+	batchSize := len(reqs) / reqLength
+	responses := make([]byte, batchSize*s.bucketSize)
+	slotBatch := int(s.header.SlotBatch)
+
+	errs := make(chan error, (batchSize+slotBatch-1)/slotBatch)
+	var wg sync.WaitGroup
+	for start := 0; start < batchSize; start += slotBatch {
+		end := start + slotBatch
+		if end > batchSize {
+			end = batchSize
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			if err := s.readSlot(reqs[start*reqLength:end*reqLength], responses[start*s.bucketSize:end*s.bucketSize], end-start); err != nil {
+				errs <- err
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+/*********************************************
+ * PRIVATE METHODS
+ *********************************************/
+
+// attach hands the shared file to the engine, and waits for it to be mapped.
+func (s *ShardExt) attach() error {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	path := s.file.Name()
+	if err = WriteMessage(conn, Message{Op: OpAttach, Arg: uint64(len(path))}); err != nil {
+		return err
+	}
+	if _, err = conn.Write([]byte(path)); err != nil {
+		return err
+	}
+	reply, err := ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Op != OpAttach || reply.Arg != StatusOK {
+		return fmt.Errorf("engine at %v refused to attach (op %d, status %d)", s.socket, reply.Op, reply.Arg)
+	}
+	return nil
+}
+
+// readSlot reads n requests through a free slot of the ring.
+func (s *ShardExt) readSlot(reqs []byte, responses []byte, n int) error {
+	slot := <-s.slots
+	defer func() { s.slots <- slot }()
+
+	copy(s.header.Requests(s.mem, slot, n), reqs)
+	status := make(chan uint64, 1)
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return s.err
+	}
+	s.pending[uint32(slot)] = status
+	s.lock.Unlock()
+
+	s.writeLock.Lock()
+	err := WriteMessage(s.conn, Message{Op: OpRead, Slot: uint32(slot), Arg: uint64(n)})
+	s.writeLock.Unlock()
+	if err != nil {
+		s.fail(err)
+	}
+
+	result, ok := <-status
+	if !ok {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return fmt.Errorf("%v.Read: %v", s.name, s.err)
+	}
+	if result != StatusOK {
+		return fmt.Errorf("%v.Read: engine failed to read slot %d (status %d)", s.name, slot, result)
+	}
+	copy(responses, s.header.Responses(s.mem, slot, n))
+	return nil
+}
+
+// receive dispatches completions from the engine to the reads waiting on
+// them, until the socket closes.
+func (s *ShardExt) receive() {
+	defer close(s.done)
+	for {
+		m, err := ReadMessage(s.conn)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if m.Op != OpDone {
+			s.log.Warn.Printf("%v: unexpected op %d from engine\n", s.name, m.Op)
+			continue
+		}
+		s.lock.Lock()
+		status, ok := s.pending[m.Slot]
+		delete(s.pending, m.Slot)
+		s.lock.Unlock()
+		if !ok {
+			s.log.Warn.Printf("%v: completion for idle slot %d\n", s.name, m.Slot)
+			continue
+		}
+		status <- m.Arg
+	}
+}
+
+// fail abandons outstanding reads once the engine can't be reached.
+func (s *ShardExt) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("engine at %v unreachable: %v", s.socket, err)
+	}
+	for slot, status := range s.pending {
+		close(status)
+		delete(s.pending, slot)
+	}
+}
@@ -0,0 +1,187 @@
+package pirext
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pircpu"
+	pt "github.com/privacylab/talek/pir/pirtest"
+)
+
+func beforeEach() {
+	common.SilenceLoggers()
+}
+
+// startEngine serves a reference engine reading with backing on a fresh unix
+// socket, returning its path and a function to stop it.
+func startEngine(t *testing.T, backing string) (string, func()) {
+	dir, err := ioutil.TempDir("", "talek-pirext")
+	if err != nil {
+		t.Fatalf("cannot create socket directory: %v\n", err)
+	}
+	socket := filepath.Join(dir, "engine.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen on %v: %v\n", socket, err)
+	}
+	engine, err := NewEngine("test", backing)
+	if err != nil {
+		t.Fatalf("cannot create engine: %v\n", err)
+	}
+	go engine.Serve(listener)
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	fmt.Printf("TestHeader: ...\n")
+	h := NewHeader(24, 13, 3, 5)
+	if h.ReqLength != 2 || h.DataOffset%Alignment != 0 || h.RingOffset%Alignment != 0 || h.SlotSize%Alignment != 0 {
+		t.Fatalf("unaligned or wrong layout: %+v\n", h)
+	}
+	mem := make([]byte, h.Size())
+	h.Marshal(mem)
+	parsed, err := UnmarshalHeader(mem)
+	if err != nil || parsed != h {
+		t.Fatalf("header did not round trip: %+v -> %+v, %v\n", h, parsed, err)
+	}
+	if _, err = UnmarshalHeader(mem[:h.Size()-1]); err == nil {
+		t.Fatalf("truncated shared file should be rejected\n")
+	}
+	mem[8] = Version + 1
+	if _, err = UnmarshalHeader(mem); err == nil {
+		t.Fatalf("unknown version should be rejected\n")
+	}
+	fmt.Printf("... done \n")
+}
+
+func TestNewShardInvalidUserData(t *testing.T) {
+	fmt.Printf("TestNewShardInvalidUserData: ...\n")
+	beforeEach()
+	socket, stop := startEngine(t, "cpu.0")
+	defer stop()
+	for _, spec := range []string{"ext", "ext.2.2", "ext.2.2.", "ext.0.2." + socket, "ext.2.x." + socket, "ext.2.2." + socket + ".missing"} {
+		shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), spec)
+		if shard != nil {
+			t.Fatalf("new ShardExt should have failed with invalid user data %s, but returned a shard", spec)
+		}
+	}
+	fmt.Printf("... done \n")
+}
+
+func TestShardExtRead(t *testing.T) {
+	fmt.Printf("TestShardExtRead: ...\n")
+	beforeEach()
+	socket, stop := startEngine(t, "cpu.0")
+	defer stop()
+	// Slots of 2 requests split the test batches of 3.
+	shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), "ext.2.2."+socket)
+	if shard == nil {
+		t.Fatalf("cannot create new ShardExt\n")
+	}
+	pt.HelperTestShardRead(t, shard)
+	pt.HelperTestClientRead(t, shard)
+	pt.AfterEach(t, shard, nil)
+	fmt.Printf("... done \n")
+}
+
+func TestShardExtConcurrentReads(t *testing.T) {
+	fmt.Printf("TestShardExtConcurrentReads: ...\n")
+	beforeEach()
+	socket, stop := startEngine(t, "cpu.1")
+	defer stop()
+	// 13 buckets of 21 bytes do not fill whole words or request bytes.
+	bucketSize, numBuckets, batchSize := 21, 13, 7
+	data := pt.GenerateData(bucketSize * numBuckets)
+	shard, err := NewShardExt("test", bucketSize, data, socket, 2, 3)
+	if err != nil {
+		t.Fatalf("cannot create new ShardExt: %v\n", err)
+	}
+	defer shard.Free()
+	reference, err := pircpu.NewShardCPU("reference", bucketSize, data, 0)
+	if err != nil {
+		t.Fatalf("cannot create reference shard: %v\n", err)
+	}
+
+	reqLength := (numBuckets + 7) / 8
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 10; i++ {
+				reqs := make([]byte, batchSize*reqLength)
+				rng.Read(reqs)
+				for r := 0; r < batchSize; r++ {
+					reqs[r*reqLength+reqLength-1] &= 1<<uint(numBuckets%8) - 1
+				}
+				expected, _ := reference.Read(reqs, reqLength)
+				response, err := shard.Read(reqs, reqLength)
+				if err != nil {
+					t.Errorf("error calling shard.Read: %v\n", err)
+					return
+				}
+				if !bytes.Equal(response, expected) {
+					t.Errorf("response mismatch: got %v, expected %v\n", response, expected)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	fmt.Printf("... done \n")
+}
+
+func TestShardExtEngineGone(t *testing.T) {
+	fmt.Printf("TestShardExtEngineGone: ...\n")
+	beforeEach()
+	dir, err := ioutil.TempDir("", "talek-pirext")
+	if err != nil {
+		t.Fatalf("cannot create socket directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "engine.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen on %v: %v\n", socket, err)
+	}
+	defer listener.Close()
+	// An engine which attaches, then disconnects on the first read.
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		m, _ := ReadMessage(conn)
+		io.CopyN(ioutil.Discard, conn, int64(m.Arg))
+		WriteMessage(conn, Message{Op: OpAttach, Arg: StatusOK})
+		ReadMessage(conn)
+	}()
+
+	shard, err := NewShardExt("test", pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), socket, 1, 4)
+	if err != nil {
+		t.Fatalf("cannot create new ShardExt: %v\n", err)
+	}
+	defer shard.Free()
+	reqLength := pt.TestNumMessages / 8
+	if _, err = shard.Read(make([]byte, 2*reqLength), reqLength); err == nil {
+		t.Fatalf("read should fail once the engine disconnects\n")
+	}
+	if _, err = shard.Read(make([]byte, 2*reqLength), reqLength); err == nil {
+		t.Fatalf("reads should keep failing once the engine disconnects\n")
+	}
+	fmt.Printf("... done \n")
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package pirext
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is unsupported on windows, which has no unix domain sockets to
+// control an engine over either.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("shared memory is unsupported on this platform")
+}
+
+func unmapFile(mem []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package pirext
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps a file shared with other processes into memory.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func unmapFile(mem []byte) error {
+	return syscall.Munmap(mem)
+}
@@ -0,0 +1,6 @@
+package pir
+
+import (
+	// Trigger a dependency when the build tags are satisfied for `go install`
+	_ "github.com/privacylab/talek/pir/pirhybrid"
+)
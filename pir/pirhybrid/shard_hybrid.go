@@ -0,0 +1,241 @@
+package pirhybrid
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// rateWeight is the weight of the latest measurement of a backend's throughput
+// against those before it.
+const rateWeight = 0.2
+
+// ShardHybrid splits each batch of reads between several backends over the
+// same data, such as a CPU and a GPU, in proportion to the throughput measured
+// of each, so that none sits idle while another computes the batch.
+type ShardHybrid struct {
+	// Private State
+	log   *common.Logger
+	name  string
+	parts []pirinterface.Shard
+
+	lock  sync.Mutex
+	rates []float64 // Requests per second read by each part
+}
+
+// NewShard creates a new hybrid shard conforming to the common interface. The
+// backings it combines follow "hybrid", separated by '+', e.g.
+// "hybrid+cpu.0+cl.0.8.4096.256".
+func NewShard(bucketSize int, data []byte, userdata string) pirinterface.Shard {
+	parts := strings.Split(userdata, "+")
+	if len(parts) < 3 || parts[0] != "hybrid" {
+		fmt.Fprintf(os.Stderr, "Invalid hybrid specification: %s. Should be hybrid+[backing]+[backing]...", userdata)
+		return nil
+	}
+	shard, err := NewShardHybrid("Hybrid Shard ("+userdata+")", bucketSize, data, parts[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create hybrid shard: %v", err)
+		return nil
+	}
+	return pirinterface.Shard(shard)
+}
+
+func init() {
+	pirinterface.Register("hybrid", NewShard)
+}
+
+// NewShardHybrid creates a shard reading from each of a set of registered
+// backings over the same data.
+func NewShardHybrid(name string, bucketSize int, data []byte, backings []string) (*ShardHybrid, error) {
+	s := &ShardHybrid{}
+	s.log = common.NewLogger(name)
+	s.name = name
+
+	for _, backing := range backings {
+		cons := pirinterface.GetBacking(backing)
+		var part pirinterface.Shard
+		if cons != nil {
+			part = cons(bucketSize, data, backing)
+		}
+		if part == nil {
+			s.Free()
+			return nil, fmt.Errorf("NewShardHybrid(%v) failed: could not create backing %v", name, backing)
+		}
+		s.parts = append(s.parts, part)
+		s.rates = append(s.rates, 1)
+	}
+
+	s.log.Info.Printf("NewShardHybrid(%v) finished\n", s.name)
+	return s, nil
+}
+
+// Free releases each of the backends.
+func (s *ShardHybrid) Free() error {
+	var err error
+	for _, part := range s.parts {
+		if e := part.Free(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// GetBucketSize returns the size (in bytes) of a bucket
+func (s *ShardHybrid) GetBucketSize() int {
+	return s.parts[0].GetBucketSize()
+}
+
+// GetNumBuckets returns the number of buckets in the shard
+func (s *ShardHybrid) GetNumBuckets() int {
+	return s.parts[0].GetNumBuckets()
+}
+
+// GetData returns a slice of the data
+func (s *ShardHybrid) GetData() []byte {
+	return s.parts[0].GetData()
+}
+
+// Rates returns the throughput, in requests per second, measured of each
+// backend.
+func (s *ShardHybrid) Rates() []float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]float64{}, s.rates...)
+}
+
+// Read handles a batch read, splitting its requests between the backends and
+// joining their responses in order.
+func (s *ShardHybrid) Read(reqs []byte, reqLength int) ([]byte, error) {
+	if reqLength <= 0 || len(reqs)%reqLength != 0 {
+		return nil, fmt.Errorf("%v.Read: requests of %d bytes are not a whole batch of %d byte requests", s.name, len(reqs), reqLength)
+	}
+	counts := s.split(len(reqs) / reqLength)
+
+	responses := make([][]byte, len(s.parts))
+	errs := make([]error, len(s.parts))
+	elapsed := make([]time.Duration, len(s.parts))
+	var wg sync.WaitGroup
+	start := 0
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, batch []byte) {
+			defer wg.Done()
+			began := time.Now()
+			responses[i], errs[i] = s.parts[i].Read(batch, reqLength)
+			elapsed[i] = time.Since(began)
+		}(i, reqs[start*reqLength:(start+count)*reqLength])
+		start += count
+	}
+	wg.Wait()
+
+	response := make([]byte, 0, (len(reqs)/reqLength)*s.GetBucketSize())
+	for i := range s.parts {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		response = append(response, responses[i]...)
+	}
+	s.observe(counts, elapsed)
+	return response, nil
+}
+
+// Devices reports on the devices of each backend.
+func (s *ShardHybrid) Devices() []pirinterface.DeviceInfo {
+	var devices []pirinterface.DeviceInfo
+	for _, part := range s.parts {
+		if describer, ok := part.(pirinterface.Describer); ok {
+			devices = append(devices, describer.Devices()...)
+		}
+	}
+	return devices
+}
+
+// GetLaunchParams returns the launch parameters of the first backend which
+// launches kernels.
+func (s *ShardHybrid) GetLaunchParams() pirinterface.LaunchParams {
+	for _, part := range s.parts {
+		if tunable, ok := part.(pirinterface.Tunable); ok {
+			return tunable.GetLaunchParams()
+		}
+	}
+	return pirinterface.LaunchParams{}
+}
+
+// SetLaunchParams changes the launch parameters of each backend which
+// launches kernels.
+func (s *ShardHybrid) SetLaunchParams(params pirinterface.LaunchParams) error {
+	tuned := false
+	for _, part := range s.parts {
+		if tunable, ok := part.(pirinterface.Tunable); ok {
+			if err := tunable.SetLaunchParams(params); err != nil {
+				return err
+			}
+			tuned = true
+		}
+	}
+	if !tuned {
+		return fmt.Errorf("%v has no backends with launch parameters", s.name)
+	}
+	return nil
+}
+
+// split divides n requests between the backends in proportion to their rates.
+// While there are enough requests, each backend gets at least one, so changes
+// in its throughput continue to be measured.
+func (s *ShardHybrid) split(n int) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	total := 0.0
+	for _, rate := range s.rates {
+		total += rate
+	}
+	counts := make([]int, len(s.rates))
+	sum := 0
+	fastest := 0
+	for i, rate := range s.rates {
+		counts[i] = int(float64(n) * rate / total)
+		if counts[i] == 0 && n >= len(counts) {
+			counts[i] = 1
+		}
+		sum += counts[i]
+		if rate > s.rates[fastest] {
+			fastest = i
+		}
+	}
+	// Rounding leaves requests over, or minimums take too many.
+	for ; sum < n; sum++ {
+		counts[fastest]++
+	}
+	for sum > n {
+		largest := 0
+		for i := range counts {
+			if counts[i] > counts[largest] {
+				largest = i
+			}
+		}
+		counts[largest]--
+		sum--
+	}
+	return counts
+}
+
+func (s *ShardHybrid) observe(counts []int, elapsed []time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, count := range counts {
+		if count == 0 || elapsed[i] <= 0 {
+			continue
+		}
+		rate := float64(count) / elapsed[i].Seconds()
+		s.rates[i] = (1-rateWeight)*s.rates[i] + rateWeight*rate
+	}
+}
@@ -0,0 +1,91 @@
+package pirhybrid
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pircpu"
+	"github.com/privacylab/talek/pir/pirinterface"
+	pt "github.com/privacylab/talek/pir/pirtest"
+)
+
+// slowShard delays each read of the CPU shard it wraps.
+type slowShard struct {
+	pirinterface.Shard
+}
+
+func (s *slowShard) Read(reqs []byte, reqLength int) ([]byte, error) {
+	time.Sleep(time.Duration(len(reqs)/reqLength) * 5 * time.Millisecond)
+	return s.Shard.Read(reqs, reqLength)
+}
+
+func init() {
+	pirinterface.Register("slow", func(bucketSize int, data []byte, userdata string) pirinterface.Shard {
+		shard := pircpu.NewShard(bucketSize, data, "cpu.0")
+		if shard == nil {
+			return nil
+		}
+		return &slowShard{shard}
+	})
+}
+
+func beforeEach() {
+	common.SilenceLoggers()
+}
+
+func TestNewShardInvalidUserData(t *testing.T) {
+	fmt.Printf("TestNewShardInvalidUserData: ...\n")
+	beforeEach()
+	for _, spec := range []string{"hybrid", "hybrid+cpu.0", "hybrid+cpu.0+nope.0", "cpu.0+cpu.1"} {
+		shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), spec)
+		if shard != nil {
+			t.Fatalf("new ShardHybrid should have failed with invalid user data %s, but returned a shard", spec)
+		}
+	}
+	fmt.Printf("... done \n")
+}
+
+func TestShardHybridRead(t *testing.T) {
+	fmt.Printf("TestShardHybridRead: ...\n")
+	beforeEach()
+	shard := NewShard(pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), "hybrid+cpu.0+cpu.1")
+	if shard == nil {
+		t.Fatalf("cannot create new ShardHybrid\n")
+	}
+	pt.HelperTestShardRead(t, shard)
+	pt.HelperTestClientRead(t, shard)
+	pt.AfterEach(t, shard, nil)
+	fmt.Printf("... done \n")
+}
+
+func TestShardHybridSplit(t *testing.T) {
+	fmt.Printf("TestShardHybridSplit: ...\n")
+	beforeEach()
+	shard, err := NewShardHybrid("test", pt.TestDepth*pt.TestMessageSize, pt.GenerateData(pt.TestNumMessages*pt.TestMessageSize), []string{"slow", "cpu.0"})
+	if err != nil {
+		t.Fatalf("cannot create new ShardHybrid: %v\n", err)
+	}
+	defer shard.Free()
+
+	reqLength := shard.GetNumBuckets() / 8
+	reqs := make([]byte, reqLength*16)
+	for i := 0; i < 10; i++ {
+		if _, err := shard.Read(reqs, reqLength); err != nil {
+			t.Fatalf("error calling shard.Read: %v\n", err)
+		}
+	}
+	rates := shard.Rates()
+	if rates[0] >= rates[1] {
+		t.Fatalf("slow backend measured faster than the CPU: %v", rates)
+	}
+	counts := shard.split(16)
+	if counts[0] < 1 || counts[0] >= counts[1] || counts[0]+counts[1] != 16 {
+		t.Fatalf("batch split %v despite rates %v", counts, rates)
+	}
+	if counts := shard.split(1); counts[0]+counts[1] != 1 {
+		t.Fatalf("single request split as %v", counts)
+	}
+	fmt.Printf("... done \n")
+}
@@ -0,0 +1,15 @@
+package pirinterface
+
+// DeviceInfo describes a device a shard computes reads on.
+type DeviceInfo struct {
+	Backing      string // Registered prefix of the backing, e.g. "cpu" or "cl"
+	Name         string // Device name, as reported by its driver
+	Memory       uint64 // Bytes of device memory. 0 when reads run in host memory
+	MaxBatchSize int    // Most requests computed in one pass. 0 for no limit
+}
+
+// Describer is implemented by shards which report on the devices they compute
+// reads on.
+type Describer interface {
+	Devices() []DeviceInfo
+}
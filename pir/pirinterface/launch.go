@@ -0,0 +1,33 @@
+package pirinterface
+
+import "fmt"
+
+// LaunchParams are the parameters GPU shards launch their kernels with, which
+// suit GPUs and database shapes very differently.
+// Zero values leave the backing's default in place.
+type LaunchParams struct {
+	// Most requests computed in one kernel launch. Larger batches are split.
+	BatchSize int
+	// Threads launched in total, and in each work group.
+	Threads   int
+	GroupSize int
+}
+
+// Validate checks that the parameters are usable with a device whose work
+// groups can hold up to maxGroupSize threads.
+func (p LaunchParams) Validate(maxGroupSize int) error {
+	if p.BatchSize < 0 || p.Threads < 0 || p.GroupSize < 0 {
+		return fmt.Errorf("launch parameters must not be negative: %+v", p)
+	}
+	if p.GroupSize > maxGroupSize {
+		return fmt.Errorf("group size %d exceeds the device limit of %d", p.GroupSize, maxGroupSize)
+	}
+	return nil
+}
+
+// Tunable is implemented by shards whose launch parameters can be adjusted
+// while they serve reads.
+type Tunable interface {
+	GetLaunchParams() LaunchParams
+	SetLaunchParams(params LaunchParams) error
+}
@@ -0,0 +1,36 @@
+package pirinterface
+
+// PaddedBucketSize rounds a bucket size up to whole words of wordSize bytes,
+// the unit GPU kernels compute in.
+func PaddedBucketSize(bucketSize int, wordSize int) int {
+	return (bucketSize + wordSize - 1) / wordSize * wordSize
+}
+
+// PadBuckets lays out data of buckets of bucketSize bytes as buckets of
+// paddedSize bytes, each zero filled after its data. Data already laid out
+// so is returned as is.
+func PadBuckets(data []byte, bucketSize int, paddedSize int) []byte {
+	if bucketSize == paddedSize {
+		return data
+	}
+	numBuckets := len(data) / bucketSize
+	padded := make([]byte, numBuckets*paddedSize)
+	for i := 0; i < numBuckets; i++ {
+		copy(padded[i*paddedSize:], data[i*bucketSize:(i+1)*bucketSize])
+	}
+	return padded
+}
+
+// UnpadBuckets is the inverse of PadBuckets, dropping the padding after each
+// bucket.
+func UnpadBuckets(padded []byte, paddedSize int, bucketSize int) []byte {
+	if bucketSize == paddedSize {
+		return padded
+	}
+	numBuckets := len(padded) / paddedSize
+	data := make([]byte, numBuckets*bucketSize)
+	for i := 0; i < numBuckets; i++ {
+		copy(data[i*bucketSize:(i+1)*bucketSize], padded[i*paddedSize:])
+	}
+	return data
+}
@@ -0,0 +1,24 @@
+package pirinterface
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadBuckets(t *testing.T) {
+	if PaddedBucketSize(12, 8) != 16 || PaddedBucketSize(16, 8) != 16 || PaddedBucketSize(1, 8) != 8 {
+		t.Fatal("Bucket sizes not rounded up to whole words.")
+	}
+
+	data := []byte{1, 2, 3, 4, 5, 6}
+	padded := PadBuckets(data, 3, 8)
+	if !bytes.Equal(padded, []byte{1, 2, 3, 0, 0, 0, 0, 0, 4, 5, 6, 0, 0, 0, 0, 0}) {
+		t.Fatalf("Buckets padded as %v", padded)
+	}
+	if unpadded := UnpadBuckets(padded, 8, 3); !bytes.Equal(unpadded, data) {
+		t.Fatalf("Buckets unpadded as %v", unpadded)
+	}
+	if aligned := PadBuckets(padded, 8, 8); &aligned[0] != &padded[0] {
+		t.Fatal("Aligned buckets should not be copied.")
+	}
+}
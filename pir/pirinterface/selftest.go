@@ -0,0 +1,66 @@
+package pirinterface
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// Dimensions of the synthetic database backings are tested against.
+const (
+	selfTestBucketSize = 16
+	selfTestNumBuckets = 64
+	selfTestBatchSize  = 8
+)
+
+// SelfTest runs known-answer queries against a small synthetic database on a
+// backing, returning an error if any response is wrong. This catches a
+// backend which computes wrongly, e.g. from a miscompiled kernel or a faulty
+// driver, before it serves corrupted reads to clients.
+func SelfTest(cons func(int, []byte, string) Shard, userdata string) error {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, selfTestBucketSize*selfTestNumBuckets)
+	rng.Read(data)
+	shard := cons(selfTestBucketSize, data, userdata)
+	if shard == nil {
+		return fmt.Errorf("self-test of %s: could not create shard", userdata)
+	}
+	defer shard.Free()
+
+	// Queries select no bucket, the first, the last, all, and random sets.
+	reqLength := selfTestNumBuckets / 8
+	reqs := make([]byte, reqLength*selfTestBatchSize)
+	reqs[reqLength] = 0x01
+	reqs[3*reqLength-1] = 0x80
+	for i := 3 * reqLength; i < 4*reqLength; i++ {
+		reqs[i] = 0xff
+	}
+	rng.Read(reqs[4*reqLength:])
+
+	expected := make([]byte, selfTestBucketSize*selfTestBatchSize)
+	for q := 0; q < selfTestBatchSize; q++ {
+		for b := 0; b < selfTestNumBuckets; b++ {
+			if reqs[q*reqLength+b/8]&(1<<uint(b%8)) == 0 {
+				continue
+			}
+			for i := 0; i < selfTestBucketSize; i++ {
+				expected[q*selfTestBucketSize+i] ^= data[b*selfTestBucketSize+i]
+			}
+		}
+	}
+
+	response, err := shard.Read(reqs, reqLength)
+	if err != nil {
+		return fmt.Errorf("self-test of %s: %v", userdata, err)
+	}
+	if len(response) != len(expected) {
+		return fmt.Errorf("self-test of %s: response of %d bytes, not %d", userdata, len(response), len(expected))
+	}
+	for q := 0; q < selfTestBatchSize; q++ {
+		start := q * selfTestBucketSize
+		if !bytes.Equal(response[start:start+selfTestBucketSize], expected[start:start+selfTestBucketSize]) {
+			return fmt.Errorf("self-test of %s: wrong response to query %d", userdata, q)
+		}
+	}
+	return nil
+}
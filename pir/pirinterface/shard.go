@@ -1,6 +1,9 @@
 package pirinterface
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 // Shard abstracts out the common interface for ShardCPU, ShardCUDA, and ShardOpenCL.
 // A Shard represents an immutable range of data for PIR operations
@@ -40,3 +43,13 @@ func GetBacking(prefix string) func(int, []byte, string) Shard {
 	}
 	return nil
 }
+
+// Backings lists the prefixes of the registered PIR implementations.
+func Backings() []string {
+	prefixes := make([]string, 0, len(backings))
+	for k := range backings {
+		prefixes = append(prefixes, k)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
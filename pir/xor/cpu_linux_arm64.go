@@ -0,0 +1,28 @@
+package xor
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+)
+
+// Auxiliary vector entries of the hardware capabilities linux reports.
+const (
+	atHWCap    = 16
+	hwCapASIMD = 1 << 1
+)
+
+// detectNEON reads the hardware capabilities linux passes the process. If
+// they can't be read, the portable kernel is used.
+func detectNEON() bool {
+	auxv, err := ioutil.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return false
+	}
+	for i := 0; i+16 <= len(auxv); i += 16 {
+		tag := binary.LittleEndian.Uint64(auxv[i:])
+		if tag == atHWCap {
+			return binary.LittleEndian.Uint64(auxv[i+8:])&hwCapASIMD != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build arm64 && !linux
+// +build arm64,!linux
+
+package xor
+
+// detectNEON assumes NEON off linux: every arm64 processor darwin, ios and
+// windows run on has it.
+func detectNEON() bool {
+	return true
+}
@@ -51,6 +51,9 @@ func safeXORBytes(dst, a, b []byte) int {
 // Bytes xors the bytes in a and b. The destination is assumed to have enough
 // space. Returns the number of bytes xor'd.
 func Bytes(dst, a, b []byte) int {
+	if hasNEON {
+		return neonXORBytes(dst, a, b)
+	}
 	if supportsUnaligned {
 		return fastXORBytes(dst, a, b)
 	}
@@ -74,11 +77,28 @@ func fastXORWords(dst, a, b []byte) {
 	}
 }
 
-// Words uses fastXORWords
+// Words uses fastXORWords, xoring any bytes after the last whole word singly.
 func Words(dst, a, b []byte) {
-	if supportsUnaligned {
+	if hasNEON {
+		neonXORBytes(dst, a, b)
+	} else if supportsUnaligned {
 		fastXORWords(dst, a, b)
+		for i := len(b) - len(b)%wordSize; i < len(b); i++ {
+			dst[i] = a[i] ^ b[i]
+		}
 	} else {
 		safeXORBytes(dst, a, b)
 	}
 }
+
+// Kernel names the implementation Bytes and Words use on this processor:
+// "neon" for the arm64 NEON kernel, "word" where words may be read unaligned,
+// and "byte" otherwise.
+func Kernel() string {
+	if hasNEON {
+		return "neon"
+	} else if supportsUnaligned {
+		return "word"
+	}
+	return "byte"
+}
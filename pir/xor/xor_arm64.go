@@ -0,0 +1,30 @@
+package xor
+
+// hasNEON is whether the processor has the Advanced SIMD (NEON) instructions
+// of the arm64 kernel. They are part of ARMv8-A, but optional in its cores
+// for embedded use, so their presence is checked at start.
+var hasNEON = detectNEON()
+
+// xorNEON xors n bytes of a and b into dst, 64 or 16 bytes at a time. n must
+// be a multiple of 16.
+//
+//go:noescape
+func xorNEON(dst, a, b *byte, n int)
+
+// neonXORBytes xors the whole blocks of a and b with NEON, and the bytes
+// after them singly.
+func neonXORBytes(dst, a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	blocks := n &^ 15
+	if blocks > 0 {
+		_ = dst[n-1]
+		xorNEON(&dst[0], &a[0], &b[0], blocks)
+	}
+	for i := blocks; i < n; i++ {
+		dst[i] = a[i] ^ b[i]
+	}
+	return n
+}
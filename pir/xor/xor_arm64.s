@@ -0,0 +1,33 @@
+#include "textflag.h"
+
+// func xorNEON(dst, a, b *byte, n int)
+TEXT ·xorNEON(SB), NOSPLIT, $0-32
+	MOVD dst+0(FP), R0
+	MOVD a+8(FP), R1
+	MOVD b+16(FP), R2
+	MOVD n+24(FP), R3
+
+loop64:
+	CMP  $64, R3
+	BLT  loop16
+	VLD1.P 64(R1), [V0.B16, V1.B16, V2.B16, V3.B16]
+	VLD1.P 64(R2), [V4.B16, V5.B16, V6.B16, V7.B16]
+	VEOR V4.B16, V0.B16, V0.B16
+	VEOR V5.B16, V1.B16, V1.B16
+	VEOR V6.B16, V2.B16, V2.B16
+	VEOR V7.B16, V3.B16, V3.B16
+	VST1.P [V0.B16, V1.B16, V2.B16, V3.B16], 64(R0)
+	SUB  $64, R3
+	B    loop64
+
+loop16:
+	CBZ  R3, done
+	VLD1.P 16(R1), [V0.B16]
+	VLD1.P 16(R2), [V4.B16]
+	VEOR V4.B16, V0.B16, V0.B16
+	VST1.P [V0.B16], 16(R0)
+	SUB  $16, R3
+	B    loop16
+
+done:
+	RET
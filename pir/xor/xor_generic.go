@@ -0,0 +1,11 @@
+//go:build !arm64
+// +build !arm64
+
+package xor
+
+// hasNEON is false off arm64.
+const hasNEON = false
+
+func neonXORBytes(dst, a, b []byte) int {
+	return safeXORBytes(dst, a, b)
+}
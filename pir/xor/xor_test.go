@@ -0,0 +1,51 @@
+package xor
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestKernel checks the kernel of the processor against the portable one, on
+// lengths and alignments around its blocks.
+func TestKernel(t *testing.T) {
+	buf := make([]byte, 3*300)
+	rand.Read(buf)
+	for offset := 0; offset < 8; offset++ {
+		for n := 0; n < 200; n++ {
+			a := buf[offset : offset+n]
+			b := buf[300+offset : 300+offset+n]
+			expected := make([]byte, n)
+			safeXORBytes(expected, a, b)
+
+			dst := buf[600+offset : 600+offset+n]
+			if Bytes(dst, a, b) != n || !bytes.Equal(dst, expected) {
+				t.Fatalf("%s Bytes differ for %d bytes at offset %d", Kernel(), n, offset)
+			}
+			for i := range dst {
+				dst[i] = 0
+			}
+			Words(dst, a, b)
+			if !bytes.Equal(dst, expected) {
+				t.Fatalf("%s Words differ for %d bytes at offset %d", Kernel(), n, offset)
+			}
+		}
+	}
+
+	// xoring in place, as scans do.
+	a := append([]byte{}, buf[:256]...)
+	Words(a, a, buf[300:556])
+	safeXORBytes(buf[:256], buf[:256], buf[300:556])
+	if !bytes.Equal(a, buf[:256]) {
+		t.Fatalf("%s in place xor differs", Kernel())
+	}
+}
+
+func BenchmarkWords(b *testing.B) {
+	dst := make([]byte, 1<<16)
+	src := make([]byte, 1<<16)
+	b.SetBytes(int64(len(src)))
+	for i := 0; i < b.N; i++ {
+		Words(dst, dst, src)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package securemem
+
+import "syscall"
+
+// madvDontDump excludes pages from core dumps. It is missing from syscall.
+const madvDontDump = 0x10
+
+// mapLocked maps n bytes of memory which are locked, so they never reach
+// swap, and excluded from core dumps.
+func mapLocked(n int) ([]byte, error) {
+	b, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Mlock(b); err == nil {
+		if err = syscall.Madvise(b, madvDontDump); err != nil {
+			syscall.Munlock(b)
+		}
+	}
+	if err != nil {
+		syscall.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// unmapLocked unlocks and unmaps memory of mapLocked.
+func unmapLocked(b []byte) {
+	syscall.Munlock(b)
+	syscall.Munmap(b)
+}
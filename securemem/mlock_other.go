@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package securemem
+
+// mapLocked is unsupported off linux, so secrets stay on the heap.
+func mapLocked(n int) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+func unmapLocked(b []byte) {}
@@ -0,0 +1,206 @@
+// Package securemem allocates memory for secrets, such as keys and seeds,
+// which is kept out of swap and core dumps. It is off until Enable is called,
+// and secrets are allocated from the Go heap until then.
+package securemem
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"unsafe"
+)
+
+// MaxSize is the largest secret kept in locked memory. Larger ones are
+// allocated from the heap.
+const MaxSize = 64
+
+// arenaSize is how much memory is locked at a time, carved into secrets of
+// MaxSize. Locked memory is limited per process, often to 64KiB, so it is
+// taken in small steps.
+const arenaSize = 4096
+
+// errUnsupported is returned by Enable off linux.
+var errUnsupported = errors.New("secure memory is not supported on this platform")
+
+var (
+	mu      sync.Mutex
+	enabled bool
+	arenas  []*arena                   // Locked, the first kept for good
+	free    [][]byte                   // Unused chunks of the arenas
+	owned   = make(map[uintptr]*arena) // Arenas, by the address of each chunk
+	// Whether a fallback to the heap has been logged, for secrets too large,
+	// and for secrets beyond the memory which can be locked.
+	warnedSize, warnedLimit bool
+)
+
+// arena is locked memory carved into chunks of MaxSize.
+type arena struct {
+	mem  []byte
+	used [arenaSize / MaxSize]bool
+	n    int // Chunks in use
+}
+
+// Enable has secrets allocated from then on kept in locked memory. It fails
+// if no memory can be locked, e.g. when the limit of the process is too low.
+func Enable() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if enabled {
+		return nil
+	}
+	if err := grow(); err != nil {
+		return err
+	}
+	enabled = true
+	return nil
+}
+
+// Enabled reports whether secrets are allocated in locked memory.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// Alloc returns n zeroed bytes for a secret. With secure memory enabled, they
+// are locked in memory, and excluded from core dumps, unless the secret is
+// larger than MaxSize or no more memory can be locked, which is logged the
+// first time. They stay allocated until passed to Free.
+func Alloc(n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return make([]byte, n)
+	}
+	if n > MaxSize {
+		if !warnedSize {
+			warnedSize = true
+			log.Printf("securemem: secrets of more than %d bytes, such as one of %d, are allocated from the heap", MaxSize, n)
+		}
+		return make([]byte, n)
+	}
+	if len(free) == 0 {
+		if err := grow(); err != nil {
+			if !warnedLimit {
+				warnedLimit = true
+				log.Printf("securemem: no more memory can be locked, allocating secrets from the heap: %v", err)
+			}
+			return make([]byte, n)
+		}
+	}
+	chunk := free[len(free)-1]
+	free = free[:len(free)-1]
+	a := owned[address(chunk)]
+	a.used[a.index(chunk)] = true
+	a.n++
+	return chunk[:n:n]
+}
+
+// Locked reports whether a secret was allocated in locked memory.
+func Locked(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := owned[address(b)]
+	return ok
+}
+
+// Free wipes a secret, and returns it to locked memory if it came from there.
+// It must not be used afterwards. Arenas all of whose secrets are freed are
+// unlocked and released, but for the first.
+func Free(b []byte) {
+	Wipe(b)
+	if len(b) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	a, ok := owned[address(b)]
+	if !ok {
+		return
+	}
+	i := a.index(b)
+	if !a.used[i] {
+		return
+	}
+	a.used[i] = false
+	a.n--
+	free = append(free, a.chunk(i))
+	if a.n == 0 && a != arenas[0] {
+		release(a)
+	}
+}
+
+// Wipe overwrites a secret with zeros.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Key32 allocates a 32 byte key, as Alloc does.
+func Key32() *[32]byte {
+	return (*[32]byte)(unsafe.Pointer(&Alloc(32)[0]))
+}
+
+// Key64 allocates a 64 byte key, as Alloc does.
+func Key64() *[64]byte {
+	return (*[64]byte)(unsafe.Pointer(&Alloc(64)[0]))
+}
+
+func address(b []byte) uintptr {
+	return uintptr(unsafe.Pointer(&b[0]))
+}
+
+// grow locks another arena, and carves it into chunks. Must be called with
+// the lock held.
+func grow() error {
+	mem, err := mapLocked(arenaSize)
+	if err != nil {
+		return err
+	}
+	a := &arena{mem: mem}
+	arenas = append(arenas, a)
+	for i := range a.used {
+		chunk := a.chunk(i)
+		owned[address(chunk)] = a
+		free = append(free, chunk)
+	}
+	return nil
+}
+
+// release unlocks and unmaps an arena none of whose chunks are in use. Must
+// be called with the lock held.
+func release(a *arena) {
+	kept := free[:0]
+	for _, chunk := range free {
+		if owned[address(chunk)] != a {
+			kept = append(kept, chunk)
+		}
+	}
+	free = kept
+	for i := range a.used {
+		delete(owned, address(a.chunk(i)))
+	}
+	for i := range arenas {
+		if arenas[i] == a {
+			arenas = append(arenas[:i], arenas[i+1:]...)
+			break
+		}
+	}
+	unmapLocked(a.mem)
+}
+
+func (a *arena) chunk(i int) []byte {
+	return a.mem[i*MaxSize : (i+1)*MaxSize : (i+1)*MaxSize]
+}
+
+// index is that of the chunk b starts.
+func (a *arena) index(b []byte) int {
+	return int(address(b)-address(a.mem)) / MaxSize
+}
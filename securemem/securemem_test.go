@@ -0,0 +1,48 @@
+package securemem
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestAlloc(t *testing.T) {
+	if err := Enable(); err != nil {
+		if runtime.GOOS == "linux" {
+			t.Logf("Memory could not be locked: %v", err)
+		}
+		t.Skip("secure memory unavailable")
+	}
+	key := Key32()
+	if !Locked(key[:]) {
+		t.Fatal("Key was not allocated in locked memory.")
+	}
+	key[0] = 1
+	Free(key[:])
+	if key[0] != 0 {
+		t.Fatal("Freed key was not wiped.")
+	}
+	if Locked(make([]byte, 32)) || Locked(Alloc(MaxSize+1)) {
+		t.Fatal("Heap memory reported as locked.")
+	}
+
+	// Freed chunks are reused, and more are locked as needed.
+	secrets := make([][]byte, 2*arenaSize/MaxSize)
+	for i := range secrets {
+		secrets[i] = Alloc(MaxSize)
+		if len(secrets[i]) != MaxSize || !Locked(secrets[i]) {
+			t.Fatalf("Allocation %d was not locked.", i)
+		}
+	}
+
+	// Arenas are released once all their secrets are freed, but for the
+	// first.
+	for _, b := range secrets {
+		Free(b)
+	}
+	Free(secrets[0])
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arenas) != 1 || len(free) != arenaSize/MaxSize || len(owned) != arenaSize/MaxSize {
+		t.Fatalf("Freed arenas were not released: %d arenas, %d free chunks", len(arenas), len(free))
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// Kinds of alerts servers send.
+const (
+	// AlertReplicaUnreachable is sent by a frontend when the replica of a
+	// trust domain fails to commit UnreachableEpochs epochs in a row.
+	AlertReplicaUnreachable = "replica-unreachable"
+	// AlertWriteQueueOverflow is sent by a frontend turning away writes past
+	// MaxPendingWrites, and by a replica whose standby fell too far behind.
+	AlertWriteQueueOverflow = "write-queue-overflow"
+	// AlertPIRSelfTest is sent by a replica whose PIR backend fails its
+	// self-test.
+	AlertPIRSelfTest = "pir-self-test"
+)
+
+// defaultUnreachableEpochs is how many epochs in a row a replica fails to
+// commit before it is reported unreachable, when the configuration doesn't
+// say.
+const defaultUnreachableEpochs = 3
+
+// defaultAlertRepeat is how long an alert is held back after being sent, when
+// the configuration doesn't say.
+const defaultAlertRepeat = time.Hour
+
+// alertBacklog is how many alerts may wait to be delivered before more are
+// dropped.
+const alertBacklog = 64
+
+// alertTimeout bounds the delivery of an alert to a webhook.
+const alertTimeout = 10 * time.Second
+
+// AlertConfig configures webhooks servers notify of events an operator should
+// act on, for deployments without a metrics stack to alert from. Each alert
+// is POSTed to every webhook as a JSON Alert.
+type AlertConfig struct {
+	// URLs of the webhooks.
+	Webhooks []string
+	// How many epochs in a row the replica of a trust domain must fail to
+	// commit before a frontend alerts. 0 for defaultUnreachableEpochs.
+	UnreachableEpochs int
+	// How often a replica runs the self-test of its PIR backend again. 0 to
+	// run it only at start.
+	SelfTestInterval time.Duration `json:",string"`
+	// How long an alert of the same kind and subject is held back after one
+	// is sent. 0 for defaultAlertRepeat.
+	Repeat time.Duration `json:",string"`
+}
+
+// Validate checks an alert configuration.
+func (c *AlertConfig) Validate() error {
+	if len(c.Webhooks) == 0 {
+		return &common.ValidationError{Field: "alert webhooks", Reason: "none given"}
+	}
+	for _, url := range c.Webhooks {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return &common.ValidationError{Field: "alert webhooks", Reason: fmt.Sprintf("%q is not a URL", url)}
+		}
+	}
+	if c.UnreachableEpochs < 0 || c.SelfTestInterval < 0 || c.Repeat < 0 {
+		return &common.ValidationError{Field: "alerts", Reason: "thresholds and intervals can't be negative"}
+	}
+	return nil
+}
+
+// Alert is the body of a webhook notification.
+type Alert struct {
+	Kind    string
+	Server  string // Name of the server sending it
+	Subject string // What it concerns, such as a trust domain
+	Message string
+	Time    time.Time
+	// Resolved alerts tell of the condition of an earlier one clearing.
+	Resolved bool
+}
+
+// alerter delivers alerts to webhooks in the background, holding back those
+// repeating one sent recently. A nil alerter drops alerts.
+type alerter struct {
+	log     *common.Logger
+	server  string
+	config  AlertConfig
+	client  *http.Client
+	pending chan *Alert
+	done    chan struct{}
+
+	lock   sync.Mutex
+	sent   map[string]time.Time // By kind and subject
+	active map[string]bool      // Alerts sent and not yet resolved
+}
+
+func newAlerter(server string, config AlertConfig) *alerter {
+	if config.UnreachableEpochs == 0 {
+		config.UnreachableEpochs = defaultUnreachableEpochs
+	}
+	if config.Repeat == 0 {
+		config.Repeat = defaultAlertRepeat
+	}
+	a := &alerter{
+		log:     common.NewLogger("Alerts:" + server),
+		server:  server,
+		config:  config,
+		client:  &http.Client{Timeout: alertTimeout},
+		pending: make(chan *Alert, alertBacklog),
+		done:    make(chan struct{}),
+		sent:    make(map[string]time.Time),
+		active:  make(map[string]bool),
+	}
+	go a.deliver()
+	return a
+}
+
+// alert raises an alert, unless one of the same kind and subject was sent
+// within the repeat interval.
+func (a *alerter) alert(kind string, subject string, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	key := kind + "/" + subject
+	a.lock.Lock()
+	if last, ok := a.sent[key]; ok && time.Since(last) < a.config.Repeat {
+		a.lock.Unlock()
+		return
+	}
+	a.sent[key] = time.Now()
+	a.active[key] = true
+	a.lock.Unlock()
+	a.send(&Alert{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...)})
+}
+
+// resolve tells of the condition of an alert clearing, if one was raised. The
+// alert is still held back for the rest of its repeat interval, so a flapping
+// condition doesn't page repeatedly.
+func (a *alerter) resolve(kind string, subject string, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	key := kind + "/" + subject
+	a.lock.Lock()
+	active := a.active[key]
+	delete(a.active, key)
+	a.lock.Unlock()
+	if active {
+		a.send(&Alert{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...), Resolved: true})
+	}
+}
+
+func (a *alerter) send(alert *Alert) {
+	alert.Server = a.server
+	alert.Time = time.Now()
+	a.log.Warn.Printf("Alert %s for %s: %s\n", alert.Kind, alert.Subject, alert.Message)
+	select {
+	case a.pending <- alert:
+	default:
+		a.log.Error.Printf("Dropped alert %s for %s, as %d wait to be delivered.\n", alert.Kind, alert.Subject, alertBacklog)
+	}
+}
+
+// deliver posts alerts to every webhook until closed.
+func (a *alerter) deliver() {
+	for {
+		select {
+		case alert := <-a.pending:
+			body, err := json.Marshal(alert)
+			if err != nil {
+				a.log.Error.Printf("Could not encode alert: %v\n", err)
+				continue
+			}
+			for _, url := range a.config.Webhooks {
+				if err := a.post(url, body); err != nil {
+					a.log.Error.Printf("Could not deliver alert %s to %s: %v\n", alert.Kind, url, err)
+				}
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *alerter) post(url string, body []byte) error {
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+func (a *alerter) close() {
+	if a != nil {
+		close(a.done)
+	}
+}
+
+// selfTest runs the self-test of the replica's PIR backend every interval
+// until the replica is closed, alerting while it fails.
+func (r *Replica) selfTest(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.alerts.done:
+			return
+		}
+		cons := pirinterface.GetBacking(r.backing)
+		if cons == nil {
+			continue
+		}
+		if err := pirinterface.SelfTest(cons, r.backing); err != nil {
+			r.alerts.alert(AlertPIRSelfTest, r.backing, "PIR backend %s failed its self-test, and may serve corrupted reads: %v", r.backing, err)
+		} else {
+			r.alerts.resolve(AlertPIRSelfTest, r.backing, "PIR backend %s passes its self-test again.", r.backing)
+		}
+	}
+}
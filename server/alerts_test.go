@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// webhook collects the alerts posted to it.
+type webhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func newWebhook() *webhook {
+	w := &webhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.mu.Lock()
+		w.alerts = append(w.alerts, alert)
+		w.mu.Unlock()
+	}))
+	return w
+}
+
+func (w *webhook) received() []Alert {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Alert(nil), w.alerts...)
+}
+
+// waitFor waits for the webhook to have received n alerts.
+func (w *webhook) waitFor(t *testing.T, n int) []Alert {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.received()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Webhook received %d of %d alerts.", len(w.received()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return w.received()
+}
+
+// downReplica fails to apply writes while down.
+type downReplica struct {
+	mockReplica
+	mu   sync.Mutex
+	down bool
+}
+
+func (d *downReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func (d *downReplica) setDown(down bool) {
+	d.mu.Lock()
+	d.down = down
+	d.mu.Unlock()
+}
+
+func TestAlerterRepeat(t *testing.T) {
+	hook := newWebhook()
+	defer hook.Close()
+	a := newAlerter("testing", AlertConfig{Webhooks: []string{hook.URL}})
+	defer a.close()
+
+	a.alert(AlertWriteQueueOverflow, "frontend", "overflow %d", 1)
+	a.alert(AlertWriteQueueOverflow, "frontend", "overflow %d", 2)
+	a.alert(AlertWriteQueueOverflow, "standby", "overflow %d", 3)
+	a.resolve(AlertWriteQueueOverflow, "frontend", "resolved")
+	a.resolve(AlertWriteQueueOverflow, "frontend", "resolved again")
+	a.resolve(AlertPIRSelfTest, "cpu", "never raised")
+	alerts := hook.waitFor(t, 3)
+	time.Sleep(50 * time.Millisecond)
+	if alerts = hook.received(); len(alerts) != 3 {
+		t.Fatalf("Expected 3 alerts, got %+v.", alerts)
+	}
+	if alerts[0].Message != "overflow 1" || alerts[0].Server != "testing" || alerts[1].Subject != "standby" {
+		t.Fatalf("Alerts were not held back by kind and subject: %+v", alerts)
+	}
+	if !alerts[2].Resolved || alerts[2].Subject != "frontend" {
+		t.Fatalf("Expected the frontend alert to be resolved once, got %+v.", alerts[2])
+	}
+}
+
+func TestAlertReplicaUnreachable(t *testing.T) {
+	hook := newWebhook()
+	defer hook.Close()
+	down := &downReplica{down: true}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: 20 * time.Millisecond,
+		ReadInterval:  time.Minute,
+		Alerts:        &AlertConfig{Webhooks: []string{hook.URL}, UnreachableEpochs: 2},
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{new(mockReplica), down})
+	defer f.Close()
+
+	alerts := hook.waitFor(t, 1)
+	if alerts[0].Kind != AlertReplicaUnreachable || alerts[0].Subject != "trust domain 1" || alerts[0].Resolved {
+		t.Fatalf("Unexpected alert: %+v", alerts[0])
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(hook.received()); n != 1 {
+		t.Fatalf("Alert was repeated %d times.", n)
+	}
+
+	down.setDown(false)
+	alerts = hook.waitFor(t, 2)
+	if alerts[1].Kind != AlertReplicaUnreachable || !alerts[1].Resolved {
+		t.Fatalf("Expected the alert to be resolved, got %+v.", alerts[1])
+	}
+}
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/securemem"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// defaultSegmentWrites is how many applied writes are archived together when
+// an archive doesn't say.
+const defaultSegmentWrites = 1024
+
+// archiveBacklog is how many segments of the write log may wait to be
+// uploaded before the oldest are dropped, leaving a gap in the log until the
+// next snapshot.
+const archiveBacklog = 256
+
+// archiveRetry is how long to wait before retrying a failed upload.
+const archiveRetry = 5 * time.Second
+
+var errNoObject = errors.New("no such object")
+
+// ObjectStore is a bucket of an object storage service, such as S3 or GCS,
+// which the state of replicas is archived in.
+type ObjectStore interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+	// List returns the names of objects starting with prefix, in lexical
+	// order.
+	List(prefix string) ([]string, error)
+}
+
+// ArchiveConfig configures the archive of a replica's state in object
+// storage, so it can be recovered when its disks are lost. Snapshots of the
+// state are archived periodically, along with the writes applied between
+// them. Objects are encrypted, so the storage service learns only their
+// sizes and timing.
+type ArchiveConfig struct {
+	// Endpoint is the base URL of an S3 compatible service, such as
+	// https://s3.us-east-1.amazonaws.com, or https://storage.googleapis.com
+	// with HMAC keys for GCS. Objects are addressed by path.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix of the names of archived objects, so replicas can share a bucket.
+	Prefix string
+	// Key objects are encrypted with, as 64 hex digits.
+	Key string
+
+	// How often a snapshot is archived. Writes are archived regardless.
+	SnapshotInterval time.Duration `json:",string"`
+	// How many applied writes are archived together. Epoch commits archive
+	// those pending too. 0 for defaultSegmentWrites.
+	SegmentWrites int
+	// How many snapshots are kept. Older ones, and the writes only they
+	// need, are deleted. 0 keeps everything.
+	KeepSnapshots int
+	// How many writes may be archived after the latest snapshot before the
+	// log is compacted into a snapshot archived early. A snapshot holds only
+	// the items still in the database, so writes since overwritten or
+	// expired take no space once the log it replaces is pruned. 0 compacts
+	// only every SnapshotInterval.
+	CompactWrites int
+	// Should the replica restore its state from the archive when started?
+	Recover bool
+}
+
+// Validate checks an archive configuration.
+func (c *ArchiveConfig) Validate() error {
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		return &common.ValidationError{Field: "archive endpoint", Reason: fmt.Sprintf("%q is not a URL", c.Endpoint)}
+	}
+	if c.Bucket == "" {
+		return &common.ValidationError{Field: "archive bucket", Reason: "not set"}
+	}
+	if key, err := hex.DecodeString(c.Key); err != nil || len(key) != 32 {
+		return &common.ValidationError{Field: "archive key", Reason: "must be 64 hex digits"}
+	}
+	if c.SnapshotInterval <= 0 {
+		return &common.ValidationError{Field: "archive snapshot interval", Reason: fmt.Sprintf("%v is not positive", c.SnapshotInterval)}
+	}
+	if c.SegmentWrites < 0 || c.KeepSnapshots < 0 || c.CompactWrites < 0 {
+		return &common.ValidationError{Field: "archive", Reason: "segment writes, kept snapshots and compacted writes can't be negative"}
+	}
+	return nil
+}
+
+// NewObjectStore connects to the object store of an archive configuration.
+func (c *ArchiveConfig) NewObjectStore() ObjectStore {
+	return NewS3Store(c.Endpoint, c.Region, c.Bucket, c.AccessKey, c.SecretKey)
+}
+
+// ArchiveTo archives the state of the replica in an object store from now on.
+func (r *Replica) ArchiveTo(store ObjectStore, config ArchiveConfig) error {
+	a, err := newArchiver(r.log, store, config)
+	if err != nil {
+		return err
+	}
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	if r.archiver != nil {
+		return errors.New("replica is already archived")
+	}
+	a.from = atomic.LoadUint64(&r.committedSeqNo)
+	r.archiver = a
+	go a.upload()
+	go a.snapshot(r)
+	return nil
+}
+
+// RecoverFrom restores the replica from the latest snapshot archived in an
+// object store, and then applies the writes archived after it. Should the
+// log of writes have a gap, the replica recovers up to it. The replica
+// refuses writes until recovered.
+func (r *Replica) RecoverFrom(store ObjectStore, config ArchiveConfig) error {
+	a, err := newArchiver(r.log, store, config)
+	if err != nil {
+		return err
+	}
+	defer a.free()
+	atomic.StoreInt32(&r.joining, 1)
+	defer atomic.StoreInt32(&r.joining, 0)
+
+	snapshots, err := store.List(a.prefix + "snapshots/")
+	if err != nil {
+		return err
+	}
+	var base uint64
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		state, err := a.get(latest)
+		if err != nil {
+			return err
+		}
+		if err = r.restore(state); err != nil {
+			return err
+		}
+		base = atomic.LoadUint64(&r.committedSeqNo)
+	}
+
+	segments, err := store.List(a.prefix + "log/")
+	if err != nil {
+		return err
+	}
+	covered := base
+	for _, name := range segments {
+		from, to, ok := a.segmentRange(name)
+		if !ok || to < base {
+			continue
+		}
+		if from > covered {
+			r.log.Warn.Printf("Archived writes %d to %d are missing, recovering up to write %d.\n", covered+1, from, covered)
+			break
+		}
+		dat, err := a.get(name)
+		if err != nil {
+			return err
+		}
+		var writes []common.ReplicaWriteArgs
+		if err = gob.NewDecoder(bytes.NewReader(dat)).Decode(&writes); err != nil {
+			return fmt.Errorf("archived writes %s: %v", name, err)
+		}
+		for i := range writes {
+			writes[i].Replay = true
+			var reply common.ReplicaWriteReply
+			r.apply(&writes[i], &reply)
+		}
+		if to > covered {
+			covered = to
+		}
+	}
+	r.log.Info.Printf("Recovered from the archive as of write %d.\n", atomic.LoadUint64(&r.committedSeqNo))
+	return nil
+}
+
+/** PRIVATE METHODS **/
+
+// archive records an applied write. Must be called with the apply lock held.
+func (r *Replica) archive(args *common.ReplicaWriteArgs) {
+	if r.archiver != nil {
+		r.archiver.record(args, atomic.LoadUint64(&r.committedSeqNo))
+	}
+}
+
+// archiver uploads snapshots and segments of the write log of a replica.
+type archiver struct {
+	log    *common.Logger
+	store  ObjectStore
+	key    *[32]byte
+	prefix string
+	config ArchiveConfig
+
+	// Writes applied since the last segment was cut, after write from. Used
+	// with the apply lock of the replica held.
+	pending []common.ReplicaWriteArgs
+	from    uint64
+	// Writes archived since the last snapshot. Use atomic.
+	logged int64
+	// Signaled once CompactWrites are logged.
+	compact chan struct{}
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	uploads []archiveObject
+	closed  bool
+	done    chan struct{}
+}
+
+// archiveObject is an object waiting to be uploaded.
+type archiveObject struct {
+	name string
+	data []byte
+}
+
+func newArchiver(log *common.Logger, store ObjectStore, config ArchiveConfig) (*archiver, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	a := &archiver{log: log, store: store, prefix: config.Prefix, config: config, done: make(chan struct{})}
+	a.compact = make(chan struct{}, 1)
+	a.wake = sync.NewCond(&a.mu)
+	if a.config.SegmentWrites == 0 {
+		a.config.SegmentWrites = defaultSegmentWrites
+	}
+	key, _ := hex.DecodeString(config.Key)
+	a.key = securemem.Key32()
+	copy(a.key[:], key)
+	securemem.Wipe(key)
+	return a, nil
+}
+
+// record adds an applied write to the log, cutting a segment when it is full
+// or an epoch is committed.
+func (a *archiver) record(args *common.ReplicaWriteArgs, committed uint64) {
+	a.pending = append(a.pending, *args)
+	if a.config.CompactWrites > 0 && atomic.AddInt64(&a.logged, 1) >= int64(a.config.CompactWrites) {
+		select {
+		case a.compact <- struct{}{}:
+		default:
+		}
+	}
+	if !args.EpochFlag && len(a.pending) < a.config.SegmentWrites {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(a.pending); err != nil {
+		a.log.Error.Printf("Could not encode writes to archive: %v\n", err)
+		return
+	}
+	name := fmt.Sprintf("%slog/%020d-%020d-%020d", a.prefix, a.from, committed, time.Now().UnixNano())
+	a.pending = nil
+	a.from = committed
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.uploads) >= archiveBacklog {
+		a.log.Error.Printf("Archive is %d segments behind, dropping %s until the next snapshot.\n", archiveBacklog, a.uploads[0].name)
+		a.uploads = a.uploads[1:]
+	}
+	a.uploads = append(a.uploads, archiveObject{name, buf.Bytes()})
+	a.wake.Signal()
+}
+
+// upload puts queued segments in the store, in order, until closed.
+func (a *archiver) upload() {
+	for {
+		a.mu.Lock()
+		for len(a.uploads) == 0 && !a.closed {
+			a.wake.Wait()
+		}
+		if a.closed {
+			a.mu.Unlock()
+			return
+		}
+		next := a.uploads[0]
+		a.mu.Unlock()
+
+		if err := a.put(next.name, next.data); err != nil {
+			a.log.Warn.Printf("Archiving %s failed: %v\n", next.name, err)
+			select {
+			case <-time.After(archiveRetry):
+			case <-a.done:
+				return
+			}
+			continue
+		}
+		a.mu.Lock()
+		if len(a.uploads) > 0 && a.uploads[0].name == next.name {
+			a.uploads = a.uploads[1:]
+		}
+		a.mu.Unlock()
+	}
+}
+
+// snapshot archives snapshots of a replica periodically, and when the log
+// is to be compacted, until closed.
+func (a *archiver) snapshot(r *Replica) {
+	ticker := time.NewTicker(a.config.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.compact:
+		case <-a.done:
+			return
+		}
+		atomic.StoreInt64(&a.logged, 0)
+		if err := a.archiveSnapshot(r); err != nil {
+			a.log.Warn.Printf("Archiving a snapshot failed: %v\n", err)
+			continue
+		}
+		if err := a.prune(); err != nil {
+			a.log.Warn.Printf("Pruning the archive failed: %v\n", err)
+		}
+	}
+}
+
+// archiveSnapshot puts a snapshot of a replica in the store.
+func (a *archiver) archiveSnapshot(r *Replica) error {
+	state, seqNo, err := r.serializeState()
+	if err != nil {
+		return err
+	}
+	return a.put(fmt.Sprintf("%ssnapshots/%020d-%020d", a.prefix, seqNo, time.Now().UnixNano()), state)
+}
+
+// prune deletes the snapshots beyond those kept, and the segments of the log
+// before the oldest kept.
+func (a *archiver) prune() error {
+	if a.config.KeepSnapshots == 0 {
+		return nil
+	}
+	snapshots, err := a.store.List(a.prefix + "snapshots/")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var expired []string
+	if len(snapshots) > a.config.KeepSnapshots {
+		expired = snapshots[:len(snapshots)-a.config.KeepSnapshots]
+	}
+	for _, name := range expired {
+		if err = a.store.Delete(name); err != nil {
+			return err
+		}
+	}
+	var oldest uint64
+	kept := strings.TrimPrefix(snapshots[len(expired)], a.prefix+"snapshots/")
+	if _, err = fmt.Sscanf(kept, "%d-", &oldest); err != nil {
+		return err
+	}
+	segments, err := a.store.List(a.prefix + "log/")
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if _, to, ok := a.segmentRange(name); ok && to < oldest {
+			if err = a.store.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// segmentRange parses the writes a segment of the log covers: those after
+// from, up to to.
+func (a *archiver) segmentRange(name string) (from uint64, to uint64, ok bool) {
+	var nanos int64
+	n, _ := fmt.Sscanf(strings.TrimPrefix(name, a.prefix+"log/"), "%d-%d-%d", &from, &to, &nanos)
+	return from, to, n == 3 && from <= to
+}
+
+// put encrypts and stores an object.
+func (a *archiver) put(name string, data []byte) error {
+	sealed, err := sealObject(a.key, name, data)
+	if err != nil {
+		return err
+	}
+	return a.store.Put(name, sealed)
+}
+
+// get fetches and decrypts an object.
+func (a *archiver) get(name string) ([]byte, error) {
+	sealed, err := a.store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openObject(a.key, name, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("archived %v", err)
+	}
+	return data, nil
+}
+
+// sealObject encrypts an object of a store. Its name is sealed with it, so
+// objects can't be swapped for one another.
+func sealObject(key *[32]byte, name string, data []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, 0, len(name)+1+len(data))
+	message = append(append(append(message, name...), 0), data...)
+	return secretbox.Seal(nonce[:], message, &nonce, key), nil
+}
+
+// openObject decrypts an object sealed by sealObject under the same name.
+func openObject(key *[32]byte, name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < 24 {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	message, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+	if !ok || len(message) < len(name)+1 || string(message[:len(name)]) != name || message[len(name)] != 0 {
+		return nil, fmt.Errorf("%s could not be decrypted", name)
+	}
+	return message[len(name)+1:], nil
+}
+
+func (a *archiver) close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.done)
+		a.wake.Broadcast()
+	}
+	a.mu.Unlock()
+}
+
+func (a *archiver) free() {
+	securemem.Free(a.key[:])
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// memoryStore is an ObjectStore held in memory.
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string][]byte)}
+}
+
+func (m *memoryStore) Get(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dat, ok := m.objects[name]
+	if !ok {
+		return nil, errNoObject
+	}
+	return dat, nil
+}
+
+func (m *memoryStore) Put(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memoryStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *memoryStore) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func testArchiveConfig() ArchiveConfig {
+	return ArchiveConfig{
+		Endpoint:         "http://localhost",
+		Bucket:           "talek",
+		Prefix:           "td/",
+		Key:              strings.Repeat("2a", 32),
+		SnapshotInterval: time.Hour,
+		SegmentWrites:    2,
+		KeepSnapshots:    1,
+	}
+}
+
+// waitForUploads waits until the archiver of a replica has uploaded all
+// segments of its log.
+func waitForUploads(t *testing.T, r *Replica) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.archiver.mu.Lock()
+		pending := len(r.archiver.uploads)
+		r.archiver.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Archive did not upload the log.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicaArchive(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	source := NewReplica("source", "cpu.0", conf)
+	defer source.Close()
+	store := newMemoryStore()
+	archive := testArchiveConfig()
+	if err := source.ArchiveTo(store, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	var leaves [][32]byte
+	write := func(id uint64) {
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			Bucket1:     id,
+			Bucket2:     id + 1,
+			Data:        make([]byte, conf.Config.DataSize),
+			GlobalSeqNo: id,
+		}}
+		args.Data[0] = byte(id)
+		leaves = append(leaves, common.WriteLeaf(&args.WriteArgs))
+		source.Write(args, &common.ReplicaWriteReply{})
+	}
+	commit := func(epoch uint64) {
+		var reply common.ReplicaWriteReply
+		source.Write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: epoch, EpochRoot: common.MerkleRoot(leaves)}, &reply)
+		if reply.Err != "" {
+			t.Fatalf("Epoch failed to commit: %s", reply.Err)
+		}
+		leaves = nil
+	}
+	for id := uint64(1); id <= 3; id++ {
+		write(id)
+	}
+	commit(0)
+	waitForUploads(t, source)
+	if err := source.archiver.archiveSnapshot(source); err != nil {
+		t.Fatal(err)
+	}
+	write(4)
+	write(5)
+	commit(1)
+	waitForUploads(t, source)
+
+	// A replica recovers the snapshot, and the writes archived after it.
+	recovered := NewReplica("recovered", "cpu.0", conf)
+	defer recovered.Close()
+	if err := recovered.RecoverFrom(store, archive); err != nil {
+		t.Fatal(err)
+	}
+	args := &common.ChecksumArgs{BucketsPerRange: 64, Key: []byte("key")}
+	if seqNo := recovered.currentShard().Checksums(args).SeqNo; seqNo != 5 {
+		t.Fatalf("Recovered replica is at write %d, not 5.", seqNo)
+	}
+	diverged, err := source.currentShard().Checksums(args).Diverged(recovered.currentShard().Checksums(args))
+	if err != nil || len(diverged) != 0 {
+		t.Fatalf("Recovered replica diverged from the source in %v: %v", diverged, err)
+	}
+	if recovered.epochs != source.epochs || recovered.lastCommitted != source.lastCommitted {
+		t.Fatal("Recovered replica lost the epoch state.")
+	}
+
+	// Later snapshots expire older ones, and the log only they need.
+	if err = source.archiver.archiveSnapshot(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = source.archiver.prune(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, _ := store.List("td/snapshots/")
+	segments, _ := store.List("td/log/")
+	if len(snapshots) != 1 || len(segments) != 2 || !strings.HasPrefix(snapshots[0], "td/snapshots/00000000000000000005-") {
+		t.Fatalf("Archive was not pruned: %v %v", snapshots, segments)
+	}
+}
+
+func TestArchiveCompaction(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	source := NewReplica("source", "cpu.0", conf)
+	defer source.Close()
+	store := newMemoryStore()
+	archive := testArchiveConfig()
+	archive.CompactWrites = 4
+	if err := source.ArchiveTo(store, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := uint64(1); id <= 6; id++ {
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			Bucket1:     id,
+			Bucket2:     id + 1,
+			Data:        make([]byte, conf.Config.DataSize),
+			GlobalSeqNo: id,
+		}}
+		source.Write(args, &common.ReplicaWriteReply{})
+		waitForUploads(t, source)
+	}
+
+	// Once enough writes are logged, a snapshot is archived without waiting
+	// for its interval, and the log it holds is pruned.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshots, _ := store.List("td/snapshots/")
+		segments, _ := store.List("td/log/")
+		if len(snapshots) == 1 && len(segments) < 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Log was not compacted: %v %v", snapshots, segments)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recovered := NewReplica("recovered", "cpu.0", conf)
+	defer recovered.Close()
+	if err := recovered.RecoverFrom(store, archive); err != nil {
+		t.Fatal(err)
+	}
+	args := &common.ChecksumArgs{BucketsPerRange: 64, Key: []byte("key")}
+	diverged, err := source.currentShard().Checksums(args).Diverged(recovered.currentShard().Checksums(args))
+	if err != nil || len(diverged) != 0 {
+		t.Fatalf("Replica recovered from the compacted log diverged in %v: %v", diverged, err)
+	}
+}
+
+func TestArchiveEncryption(t *testing.T) {
+	store := newMemoryStore()
+	config := testArchiveConfig()
+	a, err := newArchiver(common.NewLogger("test"), store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.free()
+
+	if err = a.put("td/one", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if dat, err := a.get("td/one"); err != nil || string(dat) != "secret" {
+		t.Fatalf("Archived object did not round trip: %q %v", dat, err)
+	}
+	sealed, _ := store.Get("td/one")
+	if strings.Contains(string(sealed), "secret") {
+		t.Fatal("Archived object is not encrypted.")
+	}
+
+	// Objects can't be swapped for one another.
+	store.Put("td/two", sealed)
+	if _, err = a.get("td/two"); err == nil {
+		t.Fatal("Object under another name should not decrypt.")
+	}
+
+	config.Key = strings.Repeat("17", 32)
+	other, err := newArchiver(common.NewLogger("test"), store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.free()
+	if _, err = other.get("td/one"); err == nil {
+		t.Fatal("Object should not decrypt under another key.")
+	}
+
+	config.Key = "short"
+	if _, err = newArchiver(common.NewLogger("test"), store, config); err == nil {
+		t.Fatal("Archive with an invalid key should be refused.")
+	}
+}
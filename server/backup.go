@@ -0,0 +1,367 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// Bounds of the chunks a backup divides the state of a replica into. Chunk
+// boundaries are found from the content of the state, so a region of it that
+// is unchanged since an earlier backup, even if it moved, is divided into the
+// same chunks, which are stored once.
+const (
+	backupMinChunk = 256 << 10
+	backupMaxChunk = 4 << 20
+	// Cuts a chunk on average every 1MiB after backupMinChunk.
+	backupChunkMask = uint64(1<<20-1) << 44
+)
+
+// backupRetries is how many times fetching a snapshot restarts when the
+// replica replaces it, as it does when a replica joins the trust domain.
+const backupRetries = 5
+
+var errNoBackup = errors.New("no backup")
+
+// backupGear are the random values of bytes the rolling hash of chunking
+// sums, fixed so backups are chunked the same by every version.
+var backupGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'t', 'a', 'l', 'e', 'k', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:])
+	}
+	return
+}()
+
+// BackupManifest describes a backup of a replica: the configuration holding
+// the keys of its trust domain, and the chunks of its state. Manifests and
+// chunks are encrypted, and chunks are named by a MAC of their content, so a
+// backup can't be altered, or its chunks swapped, without restoring failing.
+type BackupManifest struct {
+	Name    string
+	Created time.Time
+	// The configuration file of the replica, with its private keys.
+	Config []byte
+	// Of the state of the replica, and its SHA-256.
+	Size   uint64
+	Digest [32]byte
+	// The chunks of the state, in order.
+	Chunks []string
+	// How many of the chunks this backup stored, rather than shared with
+	// backups before it.
+	Stored int
+}
+
+// SnapshotSource is a replica whose state can be backed up.
+type SnapshotSource interface {
+	Snapshot(args *interface{}, reply *common.StateReply) error
+	GetState(args *common.StateArgs, reply *common.StateReply) error
+}
+
+// FetchSnapshot transfers a snapshot of the state of a replica.
+func FetchSnapshot(source SnapshotSource) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		var reply common.StateReply
+		if err := source.Snapshot(nil, &reply); err != nil {
+			return nil, err
+		} else if reply.Err != "" {
+			return nil, errors.New(reply.Err)
+		}
+		state := append([]byte{}, reply.Chunk...)
+		for uint64(len(state)) < reply.Size {
+			var next common.StateReply
+			if err := source.GetState(&common.StateArgs{SnapshotID: reply.SnapshotID, Offset: uint64(len(state))}, &next); err != nil {
+				return nil, err
+			} else if next.Err != "" {
+				break
+			}
+			state = append(state, next.Chunk...)
+		}
+		if uint64(len(state)) == reply.Size && sha256.Sum256(state) == reply.Digest {
+			return state, nil
+		}
+		// The snapshot was replaced, so the transfer starts over.
+		if attempt == backupRetries {
+			return nil, errSnapshotExpired
+		}
+	}
+}
+
+// WriteBackup stores an encrypted backup of the state and configuration of a
+// replica in a store. Backups are incremental: chunks of the state already
+// stored by earlier backups in the store are not stored again.
+func WriteBackup(store ObjectStore, key *[32]byte, state []byte, config []byte) (*BackupManifest, error) {
+	names, err := store.List("chunks/")
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(names))
+	for _, name := range names {
+		stored[strings.TrimPrefix(name, "chunks/")] = true
+	}
+
+	created := time.Now()
+	m := &BackupManifest{
+		Name:    fmt.Sprintf("backups/%020d", created.UnixNano()),
+		Created: created,
+		Config:  config,
+		Size:    uint64(len(state)),
+		Digest:  sha256.Sum256(state),
+	}
+	for _, chunk := range chunkState(state) {
+		id := chunkID(key, chunk)
+		m.Chunks = append(m.Chunks, id)
+		if stored[id] {
+			continue
+		}
+		sealed, err := sealObject(key, "chunks/"+id, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if err = store.Put("chunks/"+id, sealed); err != nil {
+			return nil, err
+		}
+		stored[id] = true
+		m.Stored++
+	}
+
+	dat, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealObject(key, m.Name, dat)
+	if err != nil {
+		return nil, err
+	}
+	return m, store.Put(m.Name, sealed)
+}
+
+// ListBackups returns the names of the backups in a store, oldest first.
+func ListBackups(store ObjectStore) ([]string, error) {
+	return store.List("backups/")
+}
+
+// ReadBackup restores a backup from a store, verifying it: the latest if
+// name is empty. It returns the manifest of the backup, and the state of the
+// replica it holds.
+func ReadBackup(store ObjectStore, key *[32]byte, name string) (*BackupManifest, []byte, error) {
+	m, err := readManifest(store, key, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := make([]byte, 0, m.Size)
+	for _, id := range m.Chunks {
+		sealed, err := store.Get("chunks/" + id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("chunk %s: %v", id, err)
+		}
+		chunk, err := openObject(key, "chunks/"+id, sealed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hmac.Equal([]byte(chunkID(key, chunk)), []byte(id)) {
+			return nil, nil, fmt.Errorf("chunk %s does not match its MAC", id)
+		}
+		state = append(state, chunk...)
+	}
+	if uint64(len(state)) != m.Size || sha256.Sum256(state) != m.Digest {
+		return nil, nil, fmt.Errorf("state of %s does not match its digest", m.Name)
+	}
+	return m, state, nil
+}
+
+// PruneBackups deletes all but the latest keep backups in a store, and the
+// chunks only they used.
+func PruneBackups(store ObjectStore, key *[32]byte, keep int) error {
+	names, err := ListBackups(store)
+	if err != nil || keep <= 0 || len(names) <= keep {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, name := range names[len(names)-keep:] {
+		m, err := readManifest(store, key, name)
+		if err != nil {
+			return err
+		}
+		for _, id := range m.Chunks {
+			used[id] = true
+		}
+	}
+	for _, name := range names[:len(names)-keep] {
+		if err = store.Delete(name); err != nil {
+			return err
+		}
+	}
+	chunks, err := store.List("chunks/")
+	if err != nil {
+		return err
+	}
+	for _, name := range chunks {
+		if !used[strings.TrimPrefix(name, "chunks/")] {
+			if err = store.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readManifest fetches and decrypts the manifest of a backup, the latest if
+// name is empty.
+func readManifest(store ObjectStore, key *[32]byte, name string) (*BackupManifest, error) {
+	if name == "" {
+		names, err := ListBackups(store)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, errNoBackup
+		}
+		name = names[len(names)-1]
+	}
+	sealed, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	dat, err := openObject(key, name, sealed)
+	if err != nil {
+		return nil, err
+	}
+	m := new(BackupManifest)
+	if err = json.Unmarshal(dat, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if m.Name != name {
+		return nil, fmt.Errorf("%s holds the manifest of %s", name, m.Name)
+	}
+	return m, nil
+}
+
+// chunkID names a chunk by a MAC of its content, so the store learns which
+// chunks backups share, but not what they hold.
+func chunkID(key *[32]byte, chunk []byte) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("talek backup chunk"))
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkState divides state into chunks, cutting where a rolling hash of the
+// last 64 bytes has its top bits clear.
+func chunkState(state []byte) [][]byte {
+	var chunks [][]byte
+	for len(state) > 0 {
+		n := len(state)
+		if n > backupMaxChunk {
+			n = backupMaxChunk
+		}
+		var h uint64
+		for i := 0; i < n; i++ {
+			h = h<<1 + backupGear[state[i]]
+			if i >= backupMinChunk && h&backupChunkMask == 0 {
+				n = i + 1
+				break
+			}
+		}
+		chunks = append(chunks, state[:n])
+		state = state[n:]
+	}
+	return chunks
+}
+
+// DirStore is an ObjectStore of a local directory, holding each object in a
+// file of its name.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore creates a store of a directory, creating it if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir}, nil
+}
+
+// Get reads an object.
+func (d *DirStore) Get(name string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(d.path(name))
+	if os.IsNotExist(err) {
+		return nil, errNoObject
+	}
+	return dat, err
+}
+
+// Put writes an object, replacing any of the same name. The object is
+// written aside and renamed into place, so it is never seen partly written.
+func (d *DirStore) Put(name string, data []byte) error {
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".put")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Delete removes an object.
+func (d *DirStore) Delete(name string) error {
+	err := os.Remove(d.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the names of objects starting with prefix, in lexical order.
+func (d *DirStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".put") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (d *DirStore) path(name string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(name))
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestBackupIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := new([32]byte)
+	key[0] = 42
+	config := []byte(`{"TrustDomain":{"PrivateKey":"secret"}}`)
+
+	state := make([]byte, 6<<20)
+	rand.New(rand.NewSource(1)).Read(state)
+	first, err := WriteBackup(store, key, state, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Stored != len(first.Chunks) || len(first.Chunks) < 2 {
+		t.Fatalf("First backup stored %d of %d chunks.", first.Stored, len(first.Chunks))
+	}
+	if names, _ := store.List(""); len(names) != first.Stored+1 {
+		t.Fatalf("Store holds %d objects rather than %d.", len(names), first.Stored+1)
+	}
+
+	// Bytes changed and inserted part way through share the chunks around them.
+	changed := append(append(append([]byte{}, state[:3<<20]...), "inserted"...), state[3<<20:]...)
+	changed[4<<20] ^= 1
+	second, err := WriteBackup(store, key, changed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Stored == 0 || second.Stored > 3 {
+		t.Fatalf("Incremental backup stored %d of %d chunks.", second.Stored, len(second.Chunks))
+	}
+
+	for _, c := range []struct {
+		name  string
+		state []byte
+	}{{first.Name, state}, {"", changed}} {
+		m, restored, err := ReadBackup(store, key, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, c.state) || !bytes.Equal(m.Config, config) {
+			t.Fatalf("Backup %q restored a different state.", c.name)
+		}
+	}
+
+	wrong := new([32]byte)
+	if _, _, err := ReadBackup(store, wrong, ""); err == nil {
+		t.Fatal("Backup restored with the wrong key.")
+	}
+
+	// Only chunks of kept backups survive pruning.
+	if err := PruneBackups(store, key, 1); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ListBackups(store); len(names) != 1 || names[0] != second.Name {
+		t.Fatalf("Pruning kept backups %v.", names)
+	}
+	if _, _, err := ReadBackup(store, key, ""); err != nil {
+		t.Fatalf("Kept backup lost chunks to pruning: %v", err)
+	}
+	if chunks, _ := store.List("chunks/"); len(chunks) != len(second.Chunks) {
+		t.Fatalf("Pruning kept %d chunks rather than %d.", len(chunks), len(second.Chunks))
+	}
+
+	// A chunk swapped for another is detected.
+	a := filepath.Join(dir, "chunks", second.Chunks[0])
+	b := filepath.Join(dir, "chunks", second.Chunks[1])
+	dat, _ := ioutil.ReadFile(b)
+	ioutil.WriteFile(a, dat, 0600)
+	if _, _, err := ReadBackup(store, key, ""); err == nil {
+		t.Fatal("Backup with a swapped chunk restored.")
+	}
+}
+
+func TestReplicaBackup(t *testing.T) {
+	conf := testConf()
+	source := NewReplica("source", "cpu.0", conf)
+	defer source.Close()
+	args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+		Bucket1:     1,
+		Bucket2:     2,
+		Data:        make([]byte, conf.Config.DataSize),
+		GlobalSeqNo: 1,
+	}}
+	source.Write(args, &common.ReplicaWriteReply{})
+	state, err := FetchSnapshot(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewReplica("restored", "cpu.0", conf)
+	defer restored.Close()
+	if err := restored.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	if restored.committedSeqNo != 1 {
+		t.Fatalf("Restored replica committed write %d rather than 1.", restored.committedSeqNo)
+	}
+}
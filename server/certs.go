@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// defaultCertReload is how often a TLS listener checks its certificate and
+// key files for renewal when its configuration doesn't say.
+const defaultCertReload = time.Minute
+
+// certExpiryWarning is how long before its certificate expires a listener
+// starts warning, daily, that it hasn't been renewed.
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// certReloader serves the certificate of a TLS listener, reloading it when
+// its files change, as when a tool such as certbot or cert-manager renews it.
+// Connections already established keep the certificate they were made with,
+// and new handshakes are given the renewed one, so renewing a certificate
+// drops no connections.
+type certReloader struct {
+	log      *common.Logger
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+
+	warned time.Time // Used only by watch
+
+	done chan struct{}
+	once sync.Once
+}
+
+// newCertReloader loads a certificate, and checks its files for renewal
+// every interval until closed.
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	c := &certReloader{
+		log:      common.NewLogger("Certificates:" + certFile),
+		certFile: certFile,
+		keyFile:  keyFile,
+		done:     make(chan struct{}),
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = defaultCertReload
+	}
+	go c.watch(interval)
+	return c, nil
+}
+
+// GetCertificate gives a TLS handshake the current certificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// reload loads the certificate again if either of its files changed since it
+// was last loaded, reporting whether it did. A renewal which fails to load,
+// as when only one of the files has been replaced yet, keeps the certificate
+// in use, and is tried again the next time.
+func (c *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)
+	c.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, err
+	}
+	c.lock.Lock()
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	c.lock.Unlock()
+	return true, nil
+}
+
+// watch reloads the certificate every interval until closed.
+func (c *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		reloaded, err := c.reload()
+		if err != nil {
+			c.log.Warn.Printf("Could not reload the certificate, keeping the one in use: %v\n", err)
+		} else if reloaded {
+			c.log.Info.Printf("Reloaded the certificate, valid until %v.\n", c.expiry())
+		}
+		if until := time.Until(c.expiry()); until < certExpiryWarning && time.Since(c.warned) > certExpiryWarning/7 {
+			c.log.Warn.Printf("The certificate expires in %v, and has not been renewed.\n", until.Round(time.Minute))
+			c.warned = time.Now()
+		}
+	}
+}
+
+func (c *certReloader) expiry() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+func (c *certReloader) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// certListener is a TLS listener, which stops reloading its certificate once
+// closed.
+type certListener struct {
+	net.Listener
+	certs *certReloader
+}
+
+func (l *certListener) Close() error {
+	l.certs.close()
+	return l.Listener.Close()
+}
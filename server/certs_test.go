@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate for 127.0.0.1 with a serial
+// number, and its key, to the files of a listener.
+func writeCert(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	// Renewals are told apart by the times files were modified.
+	modified := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(keyFile, modified, modified)
+	os.Chtimes(certFile, modified, modified)
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talekcerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	listeners, err := Listen(handler, []ListenerConfig{{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, CertReload: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+	address := listeners[0].Addr().String()
+	dial := func() (*tls.Conn, int64) {
+		conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	established, serial := dial()
+	defer established.Close()
+	if serial != 1 {
+		t.Fatalf("Served certificate %d rather than 1.", serial)
+	}
+
+	writeCert(t, certFile, keyFile, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, serial := dial()
+		conn.Close()
+		if serial == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Renewed certificate was not served.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connection made before the renewal is still served.
+	if _, err := established.Write([]byte("GET / HTTP/1.1\r\nHost: talek\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(established), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Connection made before the renewal was dropped: %v", err)
+	}
+
+	// A renewal which can't be loaded leaves the certificate in use.
+	ioutil.WriteFile(keyFile, []byte("partly written"), 0600)
+	if _, err := listeners[0].(*certListener).certs.reload(); err == nil {
+		t.Fatal("Renewal with a broken key was loaded.")
+	}
+	if conn, serial := dial(); serial != 2 {
+		t.Fatalf("Served certificate %d after a broken renewal, rather than 2.", serial)
+	} else {
+		conn.Close()
+	}
+}
@@ -2,10 +2,23 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"time"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/pir/pirinterface"
+)
+
+// Policies for writes whose buckets are both full.
+const (
+	// OverflowStash moves items along the cuckoo eviction chain to make room,
+	// stashing any left over.
+	OverflowStash = "stash"
+	// OverflowEvictOldest frees the slot of the oldest item of the buckets.
+	OverflowEvictOldest = "evict-oldest"
+	// OverflowReject refuses the write, with common.ErrBucketsFull.
+	OverflowReject = "reject"
 )
 
 // Config represents the configuration needed to start a Talek server.
@@ -25,6 +38,192 @@ type Config struct {
 	TrustDomain *common.TrustDomainConfig
 	// In client read requests, which index is relevant for this server.
 	TrustDomainIndex int
+
+	// The trust domain of the frontend forwarding writes and reads to this
+	// replica. When set, the replica applies only those signed with its key,
+	// as frontends sign what they forward with the key of their TrustDomain.
+	Frontend *common.TrustDomainConfig
+
+	// Should writes carrying a TTL hint be freed once it expires?
+	HonorTTL bool
+
+	// What to do with a write whose buckets are both full. One of
+	// OverflowStash, the default, OverflowEvictOldest or OverflowReject.
+	Overflow string
+
+	// How many items may be moved to even out bucket occupancy at the end of
+	// each epoch? 0 to not rebalance. Replicas of all trust domains must agree,
+	// as it changes where items are placed.
+	RebalanceMoves int
+
+	// How many client writes may the frontend forward per write interval?
+	// 0 for no limit.
+	WriteBudget int
+	// How many interactive writes are forwarded ahead of each waiting bulk write?
+	// 0 always prefers interactive writes.
+	InteractiveWeight int
+
+	// How many writes and reads may wait at the frontend before clients are
+	// told to back off? 0 for no limit.
+	MaxPendingWrites int
+	MaxPendingReads  int
+
+	// Quotas of the reads and writes the frontend forwards to the replica of
+	// each trust domain, by trust domain index. Missing ones don't bound.
+	Quotas []TrustDomainQuota
+
+	// Addresses of the frontends of this trust domain replicating the sequence
+	// of writes, including this one at index RaftID. Empty for a lone frontend.
+	// Peers call each other on the Raft service, signing calls with the key of
+	// TrustDomain, which they share. Each frontend serves the Raft service
+	// alone at its own address, apart from the listeners of its clients.
+	RaftPeers []string
+	RaftID    int
+	// File the raft term and vote of this frontend are kept in, so it never
+	// votes twice in a term across restarts. Needed with RaftPeers.
+	RaftStateFile string
+
+	// Addresses to serve RPCs on, each exposing some or all methods. When
+	// empty, servers listen on the single address they are run with.
+	Listeners []ListenerConfig
+
+	// How many read batches may a replica queue behind the one being computed?
+	// 0 for defaultReadQueueDepth.
+	ReadQueueDepth int
+
+	// Addresses of standby replicas of this trust domain, which a replica
+	// streams the writes it applies to.
+	Standbys []string
+
+	// Address of a replica of this trust domain a new replica transfers the
+	// current state from, rather than starting empty.
+	JoinFrom string
+
+	// Batch size and kernel launch parameters of CUDA and OpenCL backends,
+	// which can also be adjusted while running with SetLaunchParams.
+	GPULaunch pirinterface.LaunchParams
+
+	// CPUs, memory and GPUs the replica is confined to, so that replicas on
+	// one machine don't contend for them. Nil to not confine.
+	Resources *ResourceConfig
+
+	// Difficulty, in leading zero bits, of the proof of work the frontend asks
+	// of writes once PuzzleThreshold writes are pending. It grows by a bit
+	// each time the pending writes double. 0 for no puzzles.
+	PuzzleDifficulty uint8
+	PuzzleThreshold  int
+
+	// Accounts, by the secret clients name them with, and how many write
+	// tokens each is issued per token period. When set, every write must
+	// spend a token, issued blind so the frontend can't link it to the
+	// account or to other writes.
+	TokenAccounts map[string]int
+	// PEM files of the RSA keys tokens are signed with, needed with
+	// TokenAccounts. Tokens are issued with the first, and those of any are
+	// accepted. Clients pin the public keys, so a frontend can't tell them
+	// apart by issuing each with its own. A token is good only while its key
+	// is configured, so operators replace keys from time to time, keeping
+	// the previous one until its tokens are spent.
+	TokenKeyFiles []string
+	// Directory the nonces spent with each token key are kept in across
+	// restarts, needed with TokenAccounts. Those of a key are removed once it
+	// is no longer configured.
+	TokenSpentDir string
+
+	// Object storage the state of a replica is archived in, and recovered
+	// from. Nil to not archive.
+	Archive *ArchiveConfig
+
+	// Webhooks notified of events an operator should act on. Nil to not
+	// alert.
+	Alerts *AlertConfig
+
+	// Differential privacy budget spent on the statistics of each epoch the
+	// frontend reports, and below how many writes or active clients they are
+	// withheld. Smaller budgets add more noise. 0 for defaultStatsEpsilon and
+	// defaultStatsThreshold.
+	StatsEpsilon   float64
+	StatsThreshold int
+}
+
+// Validate checks a server configuration, with its common configuration.
+func (c *Config) Validate() error {
+	if c.Config == nil {
+		return &common.ValidationError{Field: "config", Reason: "no common configuration"}
+	}
+	// The intervals of the server are its own, shadowing those of the common
+	// configuration.
+	conf := *c.Config
+	conf.WriteInterval = c.WriteInterval
+	conf.ReadInterval = c.ReadInterval
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if c.ReadBatch <= 0 {
+		return &common.ValidationError{Field: "read batch", Reason: fmt.Sprintf("%d is not positive", c.ReadBatch)}
+	}
+	switch c.Overflow {
+	case "", OverflowStash, OverflowEvictOldest, OverflowReject:
+	default:
+		return &common.ValidationError{Field: "overflow", Reason: fmt.Sprintf("unknown policy %q", c.Overflow)}
+	}
+	if c.TrustDomainIndex < 0 || c.TrustDomainIndex >= common.MaxTrustDomains {
+		return &common.ValidationError{Field: "trust domain index", Reason: fmt.Sprintf("%d is out of range", c.TrustDomainIndex)}
+	}
+	if c.PuzzleDifficulty > common.MaxPuzzleDifficulty || c.PuzzleThreshold < 0 {
+		return &common.ValidationError{Field: "puzzle", Reason: fmt.Sprintf("difficulty %d from %d pending writes is out of range", c.PuzzleDifficulty, c.PuzzleThreshold)}
+	}
+	for account, budget := range c.TokenAccounts {
+		if account == "" || budget <= 0 {
+			return &common.ValidationError{Field: "token accounts", Reason: fmt.Sprintf("%q is issued %d tokens", account, budget)}
+		}
+	}
+	if len(c.TokenAccounts) > 0 && len(c.TokenKeyFiles) == 0 {
+		return &common.ValidationError{Field: "token key files", Reason: "needed to issue tokens to accounts"}
+	}
+	if len(c.TokenAccounts) > 0 && c.TokenSpentDir == "" {
+		return &common.ValidationError{Field: "token spent dir", Reason: "needed to keep the tokens spent across restarts"}
+	}
+	if c.Resources != nil {
+		if err := c.Resources.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Archive != nil {
+		if err := c.Archive.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Alerts != nil {
+		if err := c.Alerts.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(c.Quotas) > common.MaxTrustDomains {
+		return &common.ValidationError{Field: "quotas", Reason: fmt.Sprintf("%d trust domains exceed %d", len(c.Quotas), common.MaxTrustDomains)}
+	}
+	batch := newQuotas(c.Quotas, len(c.Quotas)).readBatch(c.ReadBatch)
+	for i, q := range c.Quotas {
+		if q.MaxReadBatch < 0 || q.MaxReadsInFlight < 0 || q.MaxWriteBytes < 0 {
+			return &common.ValidationError{Field: "quotas", Reason: fmt.Sprintf("quota of trust domain %d is negative", i)}
+		}
+		if q.MaxReadsInFlight > 0 && q.MaxReadsInFlight < batch {
+			return &common.ValidationError{Field: "quotas", Reason: fmt.Sprintf("trust domain %d can't have a batch of %d reads in flight", i, batch)}
+		}
+	}
+	if c.StatsEpsilon < 0 || c.StatsThreshold < 0 {
+		return &common.ValidationError{Field: "stats privacy", Reason: fmt.Sprintf("budget %v and threshold %d must not be negative", c.StatsEpsilon, c.StatsThreshold)}
+	}
+	if len(c.RaftPeers) > 0 && (c.RaftID < 0 || c.RaftID >= len(c.RaftPeers)) {
+		return &common.ValidationError{Field: "raft id", Reason: fmt.Sprintf("%d is not one of %d peers", c.RaftID, len(c.RaftPeers))}
+	}
+	if len(c.RaftPeers) > 0 && c.RaftStateFile == "" {
+		return &common.ValidationError{Field: "raft state file", Reason: "needed to keep the term and vote of a replicated frontend"}
+	}
+	if len(c.RaftPeers) > 0 && (c.TrustDomain == nil || !c.TrustDomain.CanSign()) {
+		return &common.ValidationError{Field: "trust domain", Reason: "its private key is needed to sign raft RPCs to peers"}
+	}
+	return nil
 }
 
 // ConfigFromFile restores a json cofig. returns the config on success or nil if
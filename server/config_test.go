@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestConfigValidate(t *testing.T) {
+	conf := testConf()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Valid config refused: %v", err)
+	}
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.Config = nil },
+		func(c *Config) { c.ReadBatch = 0 },
+		func(c *Config) { c.ReadInterval = 0 },
+		func(c *Config) { c.Overflow = "drop" },
+		func(c *Config) { c.TrustDomainIndex = -1 },
+		func(c *Config) { c.RaftPeers = []string{"a", "b"}; c.RaftID = 2 },
+		func(c *Config) { c.StatsEpsilon = -1 },
+	} {
+		c := testConf()
+		mutate(&c)
+		if err, ok := c.Validate().(*common.ValidationError); !ok {
+			t.Fatalf("Invalid config should be refused, got %v", err)
+		}
+	}
+}
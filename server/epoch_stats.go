@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+)
+
+const (
+	// defaultStatsEpsilon is the privacy budget spent on the statistics of
+	// each epoch, when the config doesn't set one.
+	defaultStatsEpsilon = 1.0
+	// defaultStatsThreshold is below how many clients or writes the
+	// statistics of an epoch are withheld, when the config doesn't set it.
+	defaultStatsThreshold = 10
+	// statsHistory is how many epochs of statistics the frontend reports.
+	statsHistory = 16
+)
+
+// epochStats counts the reads and writes of each epoch at the frontend, and
+// keeps them with Laplace noise added, so that exporting them doesn't reveal
+// whether any one client was active. Each epoch is noised once, when it ends,
+// so repeatedly asking for its statistics can't average the noise away.
+type epochStats struct {
+	epsilon   float64
+	threshold uint64
+	// Reads a client makes in an epoch, by which its reads are scaled to the
+	// number of clients.
+	readsPerEpoch uint64
+
+	lock    sync.Mutex
+	reads   uint64
+	history []common.EpochStats // Oldest first
+}
+
+func newEpochStats(config *Config) *epochStats {
+	s := &epochStats{
+		epsilon:       config.StatsEpsilon,
+		threshold:     uint64(config.StatsThreshold),
+		readsPerEpoch: 1,
+	}
+	if s.epsilon == 0 {
+		s.epsilon = defaultStatsEpsilon
+	}
+	if config.StatsThreshold == 0 {
+		s.threshold = defaultStatsThreshold
+	}
+	// Epochs last a write interval, in which clients write once, and read
+	// once per read interval.
+	if config.ReadInterval > 0 && config.WriteInterval > config.ReadInterval {
+		s.readsPerEpoch = uint64((config.WriteInterval + config.ReadInterval - 1) / config.ReadInterval)
+	}
+	return s
+}
+
+// read counts a read of the epoch in progress.
+func (s *epochStats) read() {
+	s.lock.Lock()
+	s.reads++
+	s.lock.Unlock()
+}
+
+// end records the noised statistics of an epoch ending with writes applied.
+// The budget is split between the writes and reads, which a client changes by
+// at most 1 and readsPerEpoch. Active clients are estimated from the noised
+// reads, which costs nothing further.
+func (s *epochStats) end(epoch uint64, writes uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reads := s.reads
+	s.reads = 0
+
+	stats := common.EpochStats{Epoch: epoch}
+	stats.Writes = s.suppress(noised(writes, 2/s.epsilon))
+	noisyReads := noised(reads, 2*float64(s.readsPerEpoch)/s.epsilon)
+	if clients := s.suppress(noisyReads / s.readsPerEpoch); clients > 0 {
+		stats.ActiveClients = clients
+		stats.Reads = noisyReads
+	}
+
+	s.history = append(s.history, stats)
+	if len(s.history) > statsHistory {
+		s.history = s.history[1:]
+	}
+}
+
+// suppress withholds counts below the threshold, as 0.
+func (s *epochStats) suppress(count uint64) uint64 {
+	if count < s.threshold {
+		return 0
+	}
+	return count
+}
+
+// recent returns the statistics of the latest epochs, oldest first.
+func (s *epochStats) recent() []common.EpochStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]common.EpochStats(nil), s.history...)
+}
+
+// noised adds Laplace noise of a scale to a count, rounded and clamped to be
+// non-negative.
+func noised(count uint64, scale float64) uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Without noise, nothing is reported.
+		return 0
+	}
+	// u is uniform in (-0.5, 0.5).
+	u := (float64(binary.LittleEndian.Uint64(b[:])>>11)+0.5)/(1<<53) - 0.5
+	noise := -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+	value := math.Round(float64(count) + noise)
+	if value < 0 {
+		return 0
+	}
+	return uint64(value)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEpochStatsNoise(t *testing.T) {
+	s := newEpochStats(&Config{WriteInterval: time.Second, ReadInterval: 250 * time.Millisecond})
+	if s.readsPerEpoch != 4 || s.epsilon != defaultStatsEpsilon || s.threshold != defaultStatsThreshold {
+		t.Fatalf("Unexpected defaults %+v", s)
+	}
+
+	// Large counts are reported close to their value, and noised.
+	exact := 0
+	for epoch := uint64(0); epoch < statsHistory+4; epoch++ {
+		for i := 0; i < 4000; i++ {
+			s.read()
+		}
+		s.end(epoch, 1000)
+	}
+	recent := s.recent()
+	if len(recent) != statsHistory || recent[0].Epoch != 4 {
+		t.Fatalf("Kept %d epochs from %d", len(recent), recent[0].Epoch)
+	}
+	for _, e := range recent {
+		if math.Abs(float64(e.Writes)-1000) > 50 || math.Abs(float64(e.ActiveClients)-1000) > 50 {
+			t.Fatalf("Epoch %d is too far from 1000 writes and clients: %+v", e.Epoch, e)
+		}
+		if e.Writes == 1000 {
+			exact++
+		}
+	}
+	if exact == len(recent) {
+		t.Fatal("Writes were reported without noise.")
+	}
+
+	// Each epoch is noised once.
+	if again := s.recent(); again[0] != recent[0] {
+		t.Fatal("Statistics of an epoch changed once reported.")
+	}
+}
+
+func TestEpochStatsThreshold(t *testing.T) {
+	s := newEpochStats(&Config{StatsEpsilon: 1, StatsThreshold: 100})
+	for i := 0; i < 3; i++ {
+		s.read()
+	}
+	s.end(0, 2)
+	if e := s.recent()[0]; e.Writes != 0 || e.Reads != 0 || e.ActiveClients != 0 {
+		t.Fatalf("Small populations should be withheld, got %+v", e)
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,17 +21,71 @@ import (
 // It is the point of global serialization, and establishes sequence numbers.
 type Frontend struct {
 	// Private State
-	log  *log.Logger
-	name string
+	log     *log.Logger
+	name    string
+	started time.Time
 	*Config
 
 	proposedSeqNo   uint64 // Use atomic.AddUint64, atomic.LoadUint64
 	currentInterest *globalInterest
 	readChan        chan *readRequest
+	writeChans      [2]chan *writeRequest // By priority class
+	pendingWrites   int32                 // Use atomic
+	pendingReads    int32                 // Use atomic
+
+	// Calls by idempotency key, so retries of them are not made again.
+	writeCalls *idempotencyCache
+	readCalls  *idempotencyCache
+	// Writes of the epoch by writeContentKey, so duplicates are dropped.
+	writeContents   *idempotencyCache
+	duplicateWrites uint64 // Dropped. Use atomic
+
+	// Proof of work asked of writes under load.
+	puzzles *puzzles
+	// Write tokens of accounts, nil if writes need none.
+	tokens *tokens
+	// Noised counts of the activity of recent epochs.
+	epochStats *epochStats
+	// Configurations requests are accepted under, as transitions change it.
+	generations *generations
+	// Quotas of what is forwarded to each trust domain.
+	quotas *quotas
+	// Latencies of the stages of reads.
+	batchLatency   common.LatencyRecorder
+	replicaLatency []common.LatencyRecorder // By trust domain index
+	readLatency    common.LatencyRecorder
+	// Webhooks notified of problems, or nil.
+	alerts *alerter
+
+	// Leaves of the writes of the current epoch, and commitments to recent
+	// epochs. Writes and epochs advance only in scheduleWrites.
+	commitLock  sync.Mutex
+	epoch       uint64
+	epochStart  uint64 // GlobalSeqNo of the first write of the epoch
+	epochLeaves [][32]byte
+	commitments []*epochRecord
+	unreachable []int // Epochs each replica has failed to commit in a row
+
+	// Batches of reads hold barrier for reading while at replicas, and epochs
+	// are sealed holding it for writing, so every replica reads a batch from
+	// the database sealed at the end of the same epoch. Replicas which failed
+	// to seal the last epoch, or sealed other writes, are unsealed.
+	barrier  sync.RWMutex
+	unsealed []bool
 
 	replicas []common.ReplicaInterface
 	dead     int32
 
+	// The replica of a trust domain being moved to another host, if any, and
+	// how to reach a replica of a trust domain by its address.
+	migrationLock sync.Mutex
+	migration     *migration
+	dial          func(index int, address string) common.ReplicaInterface
+
+	// With Replicate, the frontends of the trust domain replicate the sequence
+	// of writes, and only their leader sequences new ones.
+	raft atomic.Value //*Raft
+
 	Verbose bool
 }
 
@@ -43,35 +98,144 @@ type globalInterest struct {
 // readRequest is the grouped request and reply memory used for batching
 // incoming reads onto a single thread.
 type readRequest struct {
-	Args  *common.EncodedReadArgs
-	Reply *common.ReadReply
+	Args   *common.EncodedReadArgs
+	Reply  *common.ReadReply
+	Done   chan bool
+	Queued time.Time
+}
+
+// errOverloaded turns away requests beyond the pending limits of the frontend.
+var errOverloaded = errors.New("frontend is overloaded")
+
+// commitmentHistory is how many past epoch commitments the frontend serves.
+const commitmentHistory = 64
+
+// epochRecord is a published commitment, with the leaves to prove inclusion in it.
+type epochRecord struct {
+	common.EpochCommitment
+	leaves [][32]byte
+}
+
+// writeRequest is a client write waiting in the queue of its priority class.
+type writeRequest struct {
+	Args  *common.WriteArgs
+	Reply *common.WriteReply
 	Done  chan bool
 }
 
 // NewFrontend creates a new Frontend for a provided configuration.
 func NewFrontend(name string, config *Config, replicas []common.ReplicaInterface) *Frontend {
 	fe := &Frontend{}
-	fe.log = log.New(os.Stdout, "[Frontend:"+name+"] ", log.Ldate|log.Ltime|log.Lshortfile)
+	fe.log = common.NewLogger("Frontend:" + name).Info
 	fe.name = name
+	fe.started = time.Now()
 	fe.Config = config
 	fe.replicas = replicas
+	fe.replicaLatency = make([]common.LatencyRecorder, len(replicas))
 	fe.readChan = make(chan *readRequest, 10)
+	fe.writeCalls = newIdempotencyCache(idempotencyWindow)
+	fe.readCalls = newIdempotencyCache(0)
+	fe.writeContents = newIdempotencyCache(duplicateWindow)
+	fe.puzzles = newPuzzles(config.PuzzleDifficulty, config.PuzzleThreshold)
+	fe.epochStats = newEpochStats(config)
+	fe.generations = newGenerations(config.Config)
+	fe.quotas = newQuotas(config.Quotas, len(replicas))
+	fe.unreachable = make([]int, len(replicas))
+	fe.unsealed = make([]bool, len(replicas))
+	if config.Alerts != nil {
+		fe.alerts = newAlerter("Frontend:"+name, *config.Alerts)
+	}
+	if len(config.TokenAccounts) > 0 {
+		signers := make([]*common.TokenSigner, len(config.TokenKeyFiles))
+		for i, file := range config.TokenKeyFiles {
+			signer, err := common.LoadTokenSigner(file)
+			if err != nil {
+				fe.log.Fatalf("Could not load the token key %s: %v", file, err)
+			}
+			signers[i] = signer
+			// Logged for clients to pin in their configuration.
+			key, _ := json.Marshal(signer.Key())
+			fe.log.Printf("Accepting tokens of key %s.", key)
+		}
+		tokens, err := newTokens(config.TokenAccounts, signers, config.TokenSpentDir)
+		if err != nil {
+			fe.log.Fatalf("Could not issue tokens: %v", err)
+		}
+		fe.tokens = tokens
+	}
+	for i := range fe.writeChans {
+		fe.writeChans[i] = make(chan *writeRequest, 10)
+	}
 	nextInterest := new(globalInterest)
 	fe.currentInterest = nextInterest
+	fe.epochStart = 1
 
-	// Periodically serialize database epoch advances.
-	go fe.periodicWrite()
 	// Batch incoming reads into combined requests to replicas.
 	go fe.batchReads()
+	// Forward queued writes to replicas by priority, serialized with
+	// periodic database epoch advances.
+	go fe.scheduleWrites()
 
 	return fe
 }
 
+// signWrite signs a write forwarded to replicas with the key of the trust
+// domain of the frontend, when it has one, so replicas apply only writes of
+// their frontend.
+func (fe *Frontend) signWrite(args *common.ReplicaWriteArgs) {
+	if td := fe.Config.TrustDomain; td != nil && td.CanSign() {
+		td.SignWrite(args)
+	}
+}
+
+// signBatch signs a batch of reads forwarded to replicas likewise.
+func (fe *Frontend) signBatch(args *common.BatchReadRequest) {
+	if td := fe.Config.TrustDomain; td != nil && td.CanSign() {
+		td.SignBatch(args)
+	}
+}
+
 /** PUBLIC METHODS (threadsafe) **/
 
 // Close goroutines associated with this object.
 func (fe *Frontend) Close() {
 	atomic.StoreInt32(&fe.dead, 1)
+	fe.alerts.close()
+	if fe.tokens != nil {
+		fe.tokens.mu.Lock()
+		fe.tokens.close()
+		fe.tokens.mu.Unlock()
+	}
+	for _, r := range fe.replicas {
+		if rpc, ok := r.(*common.ReplicaRPC); ok {
+			rpc.Close()
+		}
+	}
+	if r := fe.replication(); r != nil {
+		r.Close()
+		for _, p := range r.peers {
+			if rpc, ok := p.(*common.RaftRPC); ok {
+				rpc.Close()
+			}
+		}
+	}
+}
+
+// Replicate makes the frontend member id of a group of frontends replicating
+// the sequence of writes, with peers indexed by member id. Only the elected
+// leader accepts writes, and a standby takes over if it fails. The term and
+// vote of the frontend are kept in stateFile across restarts.
+func (fe *Frontend) Replicate(id int, peers []common.RaftPeer, stateFile string) error {
+	return fe.replicate(id, peers, stateFile, raftHeartbeat)
+}
+
+func (fe *Frontend) replicate(id int, peers []common.RaftPeer, stateFile string, heartbeat time.Duration) error {
+	r, err := newRaft(fe.name, id, peers, stateFile, fe.followCommit, fe.followSnapshot, heartbeat)
+	if err != nil {
+		return err
+	}
+	fe.raft.Store(r)
+	return nil
 }
 
 // GetName exports the name of the server.
@@ -82,72 +246,563 @@ func (fe *Frontend) GetName(args *interface{}, reply *string) error {
 
 // GetConfig returns the current common configuration from the server.
 func (fe *Frontend) GetConfig(args *interface{}, reply *common.Config) error {
-	config := *fe.Config.Config
-	*reply = config
+	_, config, _ := fe.generations.current()
+	*reply = *config
+	return nil
+}
+
+// GetStats reports the progress and queues of the frontend, and collects the
+// statistics of the shard of each replica.
+func (fe *Frontend) GetStats(args *interface{}, reply *common.FrontendStats) error {
+	fe.commitLock.Lock()
+	reply.Epoch = fe.epoch
+	fe.commitLock.Unlock()
+	reply.SeqNo = atomic.LoadUint64(&fe.proposedSeqNo)
+	reply.PendingWrites = int(atomic.LoadInt32(&fe.pendingWrites))
+	reply.DuplicateWrites = atomic.LoadUint64(&fe.duplicateWrites)
+	reply.PendingReads = int(atomic.LoadInt32(&fe.pendingReads))
+	reply.Generation, _, _ = fe.generations.current()
+	if r := fe.replication(); r != nil {
+		reply.Standby = !r.Leading()
+	}
+	reply.Epochs = fe.epochStats.recent()
+	reply.BatchLatency = fe.batchLatency.Snapshot()
+	reply.ReplicaLatency = make([]common.Histogram, len(fe.replicaLatency))
+	for i := range fe.replicaLatency {
+		reply.ReplicaLatency[i] = fe.replicaLatency[i].Snapshot()
+	}
+	reply.ReadLatency = fe.readLatency.Snapshot()
+	reply.Quotas = fe.quotas.report()
+
+	reply.Replicas = make([]common.ShardStats, len(fe.replicas))
+	var wg sync.WaitGroup
+	for i, r := range fe.replicas {
+		wg.Add(1)
+		go func(i int, r common.ReplicaInterface) {
+			defer wg.Done()
+			if err := r.GetStats(nil, &reply.Replicas[i]); err != nil {
+				reply.Replicas[i].Err = err.Error()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	return nil
+}
+
+// SetLogLevel changes the level of the loggers of a component of the frontend
+// process at runtime, and reports the level of each.
+func (fe *Frontend) SetLogLevel(args *common.LogLevelArgs, reply *common.LogReply) error {
+	common.ServeLogLevel(args, reply)
+	if args.Level != "" && reply.Err == "" {
+		fe.log.Printf("Log level of %q set to %s.", args.Component, args.Level)
+	}
+	return nil
+}
+
+// RotateLogs rotates the log file of the frontend process now.
+func (fe *Frontend) RotateLogs(args *interface{}, reply *common.LogReply) error {
+	if err := common.RotateLogs(); err != nil {
+		reply.Err = err.Error()
+	}
+	reply.Levels = common.LogLevels()
 	return nil
 }
 
+// Write queues a client write by its priority class, and returns once it has
+// been forwarded to replicas. A retry of a write with the same idempotency
+// key gets the reply of the first, which is made only once, as does a write
+// of the same buckets and data as another of the epoch.
 func (fe *Frontend) Write(args *common.WriteArgs, reply *common.WriteReply) error {
-	seqNo := atomic.AddUint64(&fe.proposedSeqNo, 1)
-	args.GlobalSeqNo = seqNo
+	// Invalid writes are refused before they are looked for among those
+	// made, so they neither take nor get the reply of a valid one.
+	if err := fe.validateWrite(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	if args.IdempotencyKey != 0 {
+		call, first := fe.writeCalls.begin(args.IdempotencyKey)
+		if !first {
+			<-call.done
+			*reply = call.reply.(common.WriteReply)
+			return nil
+		}
+		// Writes which were turned away may be tried again.
+		defer func() {
+			fe.writeCalls.finish(args.IdempotencyKey, call, *reply, reply.RetryAfter == 0 && !turnedAway(reply.Err))
+		}()
+	}
+	return fe.writeOnce(args, reply)
+}
 
-	replicaWrite := &common.ReplicaWriteArgs{
-		WriteArgs: *args,
+// writeOnce makes a write, unless an identical one was made in the epoch or is
+// in progress, whose reply it gets instead. Duplicates don't take the write
+// capacity of the epoch again.
+func (fe *Frontend) writeOnce(args *common.WriteArgs, reply *common.WriteReply) error {
+	key := writeContentKey(args)
+	call, first := fe.writeContents.begin(key)
+	if !first {
+		<-call.done
+		*reply = call.reply.(common.WriteReply)
+		atomic.AddUint64(&fe.duplicateWrites, 1)
+		return nil
 	}
-	replicaReply := common.ReplicaWriteReply{}
-	if fe.Verbose {
-		fe.log.Printf("write to %d,%d serialized.\n", args.Bucket1, args.Bucket2)
+	defer func() {
+		fe.writeContents.finish(key, call, *reply, reply.RetryAfter == 0 && !turnedAway(reply.Err))
+	}()
+	return fe.write(args, reply)
+}
+
+// turnedAway reports whether a write failed without being sequenced.
+func turnedAway(err string) bool {
+	return err == errNotLeader.Error() || err == common.ErrDeadlineExceeded.Error() || err == common.ErrPuzzleRequired.Error() || err == common.ErrTokenRequired.Error() || err == common.ErrGeneration.Error()
+}
+
+// validateWrite checks a write can be made at this frontend, under the
+// configuration of its generation and size class.
+func (fe *Frontend) validateWrite(args *common.WriteArgs) error {
+	if r := fe.replication(); r != nil && !r.Leading() {
+		return errNotLeader
 	}
-	//@todo writes in parallel
-	for i, r := range fe.replicas {
-		err := r.Write(replicaWrite, &replicaReply)
-		if err != nil {
-			reply.Err = err.Error()
-			fe.log.Printf("Error writing to replica %d: %v", i, err)
-		} else if len(replicaReply.Err) > 0 {
-			reply.Err = replicaReply.Err
+	if int(args.Priority) >= len(fe.writeChans) {
+		return fmt.Errorf("unknown write priority %d", args.Priority)
+	}
+	config, err := fe.generations.lookup(args.Generation)
+	if err == nil {
+		config, err = config.Class(args.Class)
+	}
+	if err == nil {
+		err = args.Validate(config)
+	}
+	return err
+}
+
+func (fe *Frontend) write(args *common.WriteArgs, reply *common.WriteReply) error {
+	// Under load, writes must come with proof of work, and their replies
+	// carry the puzzle for the next.
+	if difficulty := fe.puzzles.difficulty(int(atomic.LoadInt32(&fe.pendingWrites))); difficulty > 0 {
+		reply.Puzzle = fe.puzzles.current(difficulty)
+		if !fe.puzzles.solved(args, difficulty) {
+			reply.Err = common.ErrPuzzleRequired.Error()
+			return nil
 		}
 	}
-	reply.GlobalSeqNo = args.GlobalSeqNo
+	pending := atomic.AddInt32(&fe.pendingWrites, 1)
+	defer atomic.AddInt32(&fe.pendingWrites, -1)
+	if fe.Config.MaxPendingWrites > 0 && int(pending) > fe.Config.MaxPendingWrites {
+		reply.Err = errOverloaded.Error()
+		reply.RetryAfter = backlog(int(pending), fe.Config.WriteBudget, fe.Config.WriteInterval)
+		fe.alerts.alert(AlertWriteQueueOverflow, "frontend", "%d writes are pending, past the limit of %d, and writes are being turned away.", pending, fe.Config.MaxPendingWrites)
+		return nil
+	}
+	// The token is spent only once the write is queued, so a write turned
+	// away may be tried again with it.
+	if fe.tokens != nil && !fe.tokens.spend(args.Token) {
+		reply.Err = common.ErrTokenRequired.Error()
+		return nil
+	}
+	done := make(chan bool, 1)
+	fe.writeChans[args.Priority] <- &writeRequest{Args: args, Reply: reply, Done: done}
+	<-done
 
 	return nil
 }
 
+// Read queues a client read for the next batch. A retry of a read with the
+// same idempotency key, made while it is still in progress, joins it.
 func (fe *Frontend) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	if args.IdempotencyKey != 0 {
+		call, first := fe.readCalls.begin(args.IdempotencyKey)
+		if !first {
+			<-call.done
+			*reply = call.reply.(common.ReadReply)
+			return nil
+		}
+		defer func() { fe.readCalls.finish(args.IdempotencyKey, call, *reply, false) }()
+	}
+	return fe.read(args, reply)
+}
+
+func (fe *Frontend) read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	if common.Expired(args.Deadline) {
+		reply.Err = common.ErrDeadlineExceeded.Error()
+		return nil
+	}
+	config, err := fe.generations.lookup(args.Generation)
+	if err == nil {
+		config, err = config.Class(args.Class)
+	}
+	if err == nil {
+		config, err = config.Tier(args.Tier)
+	}
+	if err == nil {
+		err = args.Validate(config, len(fe.replicas))
+	}
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	fe.epochStats.read()
+	pending := atomic.AddInt32(&fe.pendingReads, 1)
+	defer atomic.AddInt32(&fe.pendingReads, -1)
+	if fe.Config.MaxPendingReads > 0 && int(pending) > fe.Config.MaxPendingReads {
+		reply.Err = errOverloaded.Error()
+		reply.RetryAfter = backlog(int(pending), fe.Config.ReadBatch, fe.Config.ReadInterval)
+		return nil
+	}
 	ready := make(chan bool, 1)
-	fe.readChan <- &readRequest{Args: args, Reply: reply, Done: ready}
+	queued := time.Now()
+	fe.readChan <- &readRequest{Args: args, Reply: reply, Done: ready, Queued: queued}
 	<-ready
+	fe.readLatency.RecordSince(queued)
 
 	return nil
 }
 
-// GetUpdates provides the most recent global interest vector deltas.
+// GetUpdates provides the most recent global interest vector deltas, and
+// announces the transition of the configuration staged, if any.
 func (fe *Frontend) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpdatesReply) error {
 	intr := fe.currentInterest
 	reply.InterestVector = intr.CompressedVector
 	reply.Signature = intr.Signatures
+	fe.commitLock.Lock()
+	reply.Epoch = fe.epoch
+	fe.commitLock.Unlock()
+	reply.Generation, _, reply.Transition = fe.generations.current()
 	return nil
 }
 
-// periodicWrite runs until the dead flag is set, and periodically send a write
-// request to all replicas telling them to advance their write epoch.
-func (fe *Frontend) periodicWrite() {
-	for atomic.LoadInt32(&fe.dead) == 0 {
-		tick := time.After(fe.WriteInterval)
-		select {
-		case <-tick:
-			args := &common.ReplicaWriteArgs{
-				EpochFlag: true,
-			}
-			var rep common.ReplicaWriteReply
-			if fe.Verbose {
-				fe.log.Printf("Periodic update of database sent to replicas.\n")
-			}
-			for _, r := range fe.replicas {
-				r.Write(args, &rep)
+// StageTransition stages a transition of the common configuration at a
+// future epoch. Clients learn of it from GetUpdates, which they call every
+// InterestMultiple epochs, so it must be staged at least that far ahead.
+// Replicas learn of it with the end of each epoch until it is over.
+func (fe *Frontend) StageTransition(args *common.ConfigTransition, reply *common.TransitionReply) error {
+	*reply = common.TransitionReply{}
+	if r := fe.replication(); r != nil && !r.Leading() {
+		reply.Err = errNotLeader.Error()
+		return nil
+	}
+	generation, config, _ := fe.generations.current()
+	if err := args.Validate(config, generation); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	fe.commitLock.Lock()
+	epoch := fe.epoch
+	fe.commitLock.Unlock()
+	if args.Epoch <= epoch+config.InterestMultiple {
+		reply.Err = fmt.Sprintf("epoch %d is too soon for clients to learn of the transition, which must be after epoch %d", args.Epoch, epoch+config.InterestMultiple)
+		return nil
+	}
+	index, err := fe.propose(common.RaftEntry{Transition: args})
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	err = fe.generations.stage(args)
+	fe.forwarded(index)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	fe.log.Printf("Staged transition to %v.", args)
+	return nil
+}
+
+// IssueTokens signs the blinded write tokens of an account, within its budget.
+func (fe *Frontend) IssueTokens(args *common.IssueTokensArgs, reply *common.IssueTokensReply) error {
+	if fe.tokens == nil {
+		reply.Err = errNoTokens.Error()
+		return nil
+	}
+	if err := fe.tokens.issue(args, reply); err != nil {
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+// GetCommitment provides the commitment to the epoch containing a write, with
+// the proof that the write is included in it.
+func (fe *Frontend) GetCommitment(args *common.GetCommitmentArgs, reply *common.GetCommitmentReply) error {
+	fe.commitLock.Lock()
+	defer fe.commitLock.Unlock()
+
+	if len(fe.commitments) == 0 {
+		reply.Err = common.ErrNotCommitted.Error()
+		return nil
+	}
+	if args.SeqNo == 0 {
+		reply.Commitment = fe.commitments[len(fe.commitments)-1].EpochCommitment
+		return nil
+	}
+	if args.SeqNo >= fe.epochStart {
+		reply.Err = common.ErrNotCommitted.Error()
+		return nil
+	}
+	for _, record := range fe.commitments {
+		if record.SeqNos.Contains(args.SeqNo) {
+			reply.Commitment = record.EpochCommitment
+			reply.Index = args.SeqNo - record.SeqNos.Start
+			reply.Proof = common.MerkleProof(record.leaves, int(reply.Index))
+			return nil
+		}
+	}
+	reply.Err = "epoch no longer available"
+	return nil
+}
+
+/** PRIVATE METHODS **/
+
+// backlog estimates how long pending requests take to drain, when perInterval
+// are served every interval, or one interval if that rate is unknown.
+func backlog(pending int, perInterval int, interval time.Duration) time.Duration {
+	if perInterval <= 0 {
+		return interval
+	}
+	return interval * time.Duration((pending+perInterval-1)/perInterval)
+}
+
+func (fe *Frontend) replication() *Raft {
+	r, _ := fe.raft.Load().(*Raft)
+	return r
+}
+
+// propose replicates an entry before it is acted on, if the frontend is replicated.
+func (fe *Frontend) propose(entry common.RaftEntry) (uint64, error) {
+	if r := fe.replication(); r != nil {
+		return r.Propose(entry)
+	}
+	return 0, nil
+}
+
+// forwarded records that a replicated entry has been sent to replicas.
+func (fe *Frontend) forwarded(index uint64) {
+	if r := fe.replication(); r != nil {
+		r.Forwarded(index)
+	}
+}
+
+// followCommit tracks the writes sequenced by the leader while following, so
+// reads can be served from the same window.
+func (fe *Frontend) followCommit(entry common.RaftEntry) {
+	if entry.Write != nil {
+		atomic.StoreUint64(&fe.proposedSeqNo, entry.Write.GlobalSeqNo)
+	}
+	if entry.Transition != nil {
+		fe.stageReplicated(entry.Transition)
+	}
+}
+
+// followSnapshot catches up with the leader from a snapshot of the log, in
+// place of the entries compacted into it.
+func (fe *Frontend) followSnapshot(snapshot common.RaftSnapshot) {
+	atomic.StoreUint64(&fe.proposedSeqNo, snapshot.SeqNo)
+	fe.stageSnapshot(snapshot)
+}
+
+// stageSnapshot moves to the generations of the epoch a snapshot of the log
+// ends at, staging its transition if it is yet to begin.
+func (fe *Frontend) stageSnapshot(snapshot common.RaftSnapshot) {
+	fe.generations.begin(snapshot.Epoch)
+	if t := snapshot.Transition; t != nil {
+		if generation, _, _ := fe.generations.current(); generation < t.Generation {
+			fe.stageReplicated(t)
+			fe.generations.begin(snapshot.Epoch)
+		}
+	}
+}
+
+// stageReplicated stages a transition from the replicated log.
+func (fe *Frontend) stageReplicated(t *common.ConfigTransition) {
+	if err := fe.generations.stage(t); err != nil {
+		fe.log.Printf("Failed to stage replicated transition to %v: %v", t, err)
+	}
+}
+
+// leading reports whether the frontend sequences writes. The first time it
+// finds itself elected in a term, it takes over from the previous leader, and
+// records the term.
+func (fe *Frontend) leading(term *uint64) bool {
+	r := fe.replication()
+	if r == nil {
+		return true
+	}
+	current, ok := r.Term()
+	if !ok {
+		return false
+	}
+	if current == *term {
+		return true
+	}
+	if err := fe.takeOver(r); err != nil {
+		fe.log.Printf("Failed to take over sequencing: %v", err)
+		return false
+	}
+	*term = current
+	return true
+}
+
+// takeOver continues the sequence of writes of the previous leader. Once the
+// inherited log is committed, the epoch state is rebuilt from its snapshot
+// and the entries following it, and writes and epoch advances the previous
+// leader may not have forwarded are replayed to replicas, which skip those
+// they already have.
+func (fe *Frontend) takeOver(r *Raft) error {
+	if _, err := r.Propose(common.RaftEntry{}); err != nil {
+		return err
+	}
+	snapshot, entries, forwarded := r.Committed()
+
+	fe.commitLock.Lock()
+	fe.epoch = snapshot.Epoch
+	fe.epochStart = 1 + snapshot.Writes
+	fe.epochLeaves = nil
+	fe.commitLock.Unlock()
+	atomic.StoreUint64(&fe.proposedSeqNo, snapshot.SeqNo)
+	fe.stageSnapshot(snapshot)
+	for i, entry := range entries {
+		replay := snapshot.Index+uint64(i+1) > forwarded
+		if entry.Write != nil {
+			atomic.StoreUint64(&fe.proposedSeqNo, entry.Write.GlobalSeqNo)
+			fe.appendLeaf(entry.Write)
+			if replay {
+				fe.sendWrite(entry.Write, &common.WriteReply{}, true)
 			}
+		} else if entry.Transition != nil {
+			fe.stageReplicated(entry.Transition)
+		} else if entry.EpochEnd && replay {
+			fe.endEpoch(true)
+		} else if entry.EpochEnd {
+			fe.commitLock.Lock()
+			fe.epoch++
+			fe.epochStart += uint64(len(fe.epochLeaves))
+			fe.epochLeaves = nil
+			fe.generations.begin(fe.epoch)
+			fe.commitLock.Unlock()
 		}
 	}
+	r.Forwarded(snapshot.Index + uint64(len(entries)))
+	fe.log.Printf("Took over sequencing after write %d.", atomic.LoadUint64(&fe.proposedSeqNo))
+	return nil
+}
+
+// advanceEpoch ends the current write epoch.
+func (fe *Frontend) advanceEpoch() {
+	index, err := fe.propose(common.RaftEntry{EpochEnd: true})
+	if err != nil {
+		return
+	}
+	fe.endEpoch(false)
+	fe.forwarded(index)
+}
+
+// endEpoch tells all replicas to advance their write epoch, and publishes
+// the commitment to the writes of the epoch ending, signed by each replica.
+// No reads are in flight while replicas seal the epoch, and those which
+// don't seal it with the writes of the frontend are read from no more.
+func (fe *Frontend) endEpoch(replay bool) {
+	fe.barrier.Lock()
+	defer fe.barrier.Unlock()
+
+	fe.commitLock.Lock()
+	record := &epochRecord{leaves: fe.epochLeaves}
+	record.Epoch = fe.epoch
+	record.SeqNos = common.Range{Start: fe.epochStart, End: fe.epochStart + uint64(len(fe.epochLeaves))}
+	record.Root = common.MerkleRoot(record.leaves)
+	record.Size = uint64(len(record.leaves))
+	fe.commitLock.Unlock()
+
+	_, _, transition := fe.generations.current()
+	args := &common.ReplicaWriteArgs{
+		EpochFlag:  true,
+		Epoch:      record.Epoch,
+		EpochRoot:  record.Root,
+		Replay:     replay,
+		Transition: transition,
+	}
+	fe.signWrite(args)
+	if fe.Verbose {
+		fe.log.Printf("Periodic update of database sent to replicas.\n")
+	}
+	record.Replicas = make([]common.SignedRoot, len(fe.replicas))
+	failures := make([]error, len(fe.replicas))
+	for i, r := range fe.replicas {
+		var rep common.ReplicaWriteReply
+		if err := r.Write(args, &rep); err != nil {
+			fe.log.Printf("Error advancing epoch %d at replica %d: %v", record.Epoch, i, err)
+			failures[i] = err
+		} else if rep.Err != "" {
+			fe.log.Printf("Replica %d disagrees on epoch %d: %v", i, record.Epoch, rep.Err)
+		}
+		record.Replicas[i] = rep.Committed
+		fe.unsealed[i] = failures[i] != nil || rep.Err != ""
+	}
+	if m := fe.migrating(record.Epoch); m != nil {
+		fe.cutover(m, args, record)
+	}
+	fe.alertUnreachable(failures)
+	if fe.Config.MaxPendingWrites > 0 && int(atomic.LoadInt32(&fe.pendingWrites)) < fe.Config.MaxPendingWrites {
+		fe.alerts.resolve(AlertWriteQueueOverflow, "frontend", "Pending writes are back under the limit of %d.", fe.Config.MaxPendingWrites)
+	}
+
+	fe.epochStats.end(record.Epoch, record.Size)
+
+	fe.commitLock.Lock()
+	fe.commitments = append(fe.commitments, record)
+	if len(fe.commitments) > commitmentHistory {
+		fe.commitments = fe.commitments[1:]
+	}
+	fe.epoch++
+	fe.epochStart = record.SeqNos.End
+	fe.epochLeaves = nil
+	fe.writeContents.forget()
+	if fe.generations.begin(fe.epoch) {
+		generation, _, _ := fe.generations.current()
+		fe.log.Printf("Configuration generation %d in use from epoch %d.", generation, fe.epoch)
+	}
+	fe.commitLock.Unlock()
+}
+
+// alertUnreachable counts the epochs in a row each replica failed to commit,
+// alerting once a replica reaches the threshold, and again once it recovers.
+func (fe *Frontend) alertUnreachable(failures []error) {
+	if fe.alerts == nil {
+		return
+	}
+	threshold := fe.alerts.config.UnreachableEpochs
+	fe.commitLock.Lock()
+	counts := make([]int, len(failures))
+	for i, err := range failures {
+		recovered := err == nil && fe.unreachable[i] >= threshold
+		if err != nil {
+			fe.unreachable[i]++
+		} else {
+			fe.unreachable[i] = 0
+		}
+		counts[i] = fe.unreachable[i]
+		if recovered {
+			counts[i] = -1
+		}
+	}
+	fe.commitLock.Unlock()
+
+	for i, n := range counts {
+		subject := fmt.Sprintf("trust domain %d", i)
+		if n >= threshold {
+			fe.alerts.alert(AlertReplicaUnreachable, subject, "The replica of trust domain %d has failed to commit %d epochs in a row: %v", i, n, failures[i])
+		} else if n < 0 {
+			fe.alerts.resolve(AlertReplicaUnreachable, subject, "The replica of trust domain %d commits epochs again.", i)
+		}
+	}
+}
+
+// intervals returns how often the frontend advances epochs and reads. Its own
+// intervals are used until a transition brings those of the common
+// configuration into use.
+func (fe *Frontend) intervals() (time.Duration, time.Duration) {
+	if generation, config, _ := fe.generations.current(); generation > 0 {
+		return config.WriteInterval, config.ReadInterval
+	}
+	return fe.Config.WriteInterval, fe.Config.ReadInterval
 }
 
 func (fe *Frontend) periodicUpdate() {
@@ -159,6 +814,7 @@ func (fe *Frontend) periodicUpdate() {
 			args := &common.ReplicaWriteArgs{
 				InterestFlag: true,
 			}
+			fe.signWrite(args)
 			resp := make([]common.ReplicaWriteReply, len(fe.replicas))
 			if fe.Verbose {
 				fe.log.Printf("Periodic update of global interest vector to replicas.\n")
@@ -211,13 +867,162 @@ func (fe *Frontend) generateInterestVector(partials []common.ReplicaWriteReply)
 	fe.currentInterest = nextInterest
 }
 
+// scheduleWrites forwards queued writes to replicas, within the write budget of
+// each write interval, and advances the epoch every write interval. Interactive writes go ahead of bulk ones, but a waiting
+// bulk write is taken after every InteractiveWeight interactive writes so
+// bulk transfers still make progress.
+func (fe *Frontend) scheduleWrites() {
+	interactive := fe.writeChans[common.WriteInteractive]
+	bulk := fe.writeChans[common.WriteBulk]
+	interval, _ := fe.intervals()
+	epoch := time.NewTicker(interval)
+	defer func() { epoch.Stop() }()
+	// Epochs take the write interval of a transition from its first epoch.
+	advance := func() {
+		fe.advanceEpoch()
+		if next, _ := fe.intervals(); next != interval {
+			interval = next
+			epoch.Stop()
+			epoch = time.NewTicker(interval)
+		}
+	}
+
+	sent := 0       // Writes forwarded this interval
+	sentBytes := 0  // Of the data of writes forwarded this interval
+	streak := 0     // Interactive writes forwarded since the last bulk one
+	var term uint64 // Term in which a replicated frontend took over
+	for atomic.LoadInt32(&fe.dead) == 0 {
+		// Standbys take no part in advancing epochs, and turn away writes
+		// queued before they lost leadership, as forwardWrite fails to propose.
+		fe.leading(&term)
+
+		// Epochs advance on time, however busy the queues are.
+		select {
+		case <-epoch.C:
+			advance()
+			sent, sentBytes = 0, 0
+		default:
+		}
+		overQuota := false
+		if limit := fe.quotas.writeBytes(); limit > 0 && sentBytes >= limit {
+			fe.quotas.throttled(sentBytes)
+			overQuota = true
+		}
+		if overQuota || (fe.Config.WriteBudget > 0 && sent >= fe.Config.WriteBudget) {
+			<-epoch.C
+			advance()
+			sent, sentBytes = 0, 0
+			continue
+		}
+
+		var req *writeRequest
+		first, second := interactive, bulk
+		if fe.Config.InteractiveWeight > 0 && streak >= fe.Config.InteractiveWeight {
+			first, second = bulk, interactive
+		}
+		select {
+		case req = <-first:
+		default:
+			select {
+			case req = <-first:
+			case req = <-second:
+			case <-epoch.C:
+				advance()
+				sent, sentBytes = 0, 0
+				continue
+			}
+		}
+
+		fe.leading(&term)
+		// A write whose caller has given up is dropped before it is sequenced,
+		// and takes none of the interval's budget.
+		if common.Expired(req.Args.Deadline) {
+			req.Reply.Err = common.ErrDeadlineExceeded.Error()
+			req.Done <- true
+			continue
+		}
+		if req.Args.Priority == common.WriteBulk {
+			streak = 0
+		} else {
+			streak++
+		}
+		sent++
+		sentBytes += len(req.Args.Data)
+		fe.forwardWrite(req.Args, req.Reply)
+		req.Done <- true
+	}
+}
+
+// forwardWrite assigns a write its place in the global sequence and sends it to
+// all replicas. A replicated frontend first commits the write to its log.
+func (fe *Frontend) forwardWrite(args *common.WriteArgs, reply *common.WriteReply) {
+	args.GlobalSeqNo = atomic.LoadUint64(&fe.proposedSeqNo) + 1
+	index, err := fe.propose(common.RaftEntry{Write: args})
+	if err != nil {
+		reply.Err = err.Error()
+		return
+	}
+	atomic.StoreUint64(&fe.proposedSeqNo, args.GlobalSeqNo)
+
+	reply.Epoch = fe.appendLeaf(args)
+	fe.sendWrite(args, reply, false)
+	fe.quotas.wrote(args)
+	fe.forwarded(index)
+}
+
+// appendLeaf adds a write to the commitment of the epoch, returning the epoch.
+func (fe *Frontend) appendLeaf(args *common.WriteArgs) uint64 {
+	fe.commitLock.Lock()
+	defer fe.commitLock.Unlock()
+	fe.epochLeaves = append(fe.epochLeaves, common.WriteLeaf(args))
+	return fe.epoch
+}
+
+func (fe *Frontend) sendWrite(args *common.WriteArgs, reply *common.WriteReply, replay bool) {
+	replicaWrite := &common.ReplicaWriteArgs{
+		WriteArgs: *args,
+		Replay:    replay,
+	}
+	fe.signWrite(replicaWrite)
+	replicaReply := common.ReplicaWriteReply{}
+	if fe.Verbose {
+		fe.log.Printf("write to %d,%d serialized.\n", args.Bucket1, args.Bucket2)
+	}
+	//@todo writes in parallel
+	for i, r := range fe.replicas {
+		err := r.Write(replicaWrite, &replicaReply)
+		if err != nil {
+			reply.Err = err.Error()
+			reply.FailedDomains = append(reply.FailedDomains, i)
+			fe.log.Printf("Error writing to replica %d: %v", i, err)
+		} else if len(replicaReply.Err) > 0 {
+			reply.Err = replicaReply.Err
+			reply.FailedDomains = append(reply.FailedDomains, i)
+		}
+	}
+	reply.GlobalSeqNo = args.GlobalSeqNo
+}
+
 func (fe *Frontend) batchReads() {
 	batch := make([]*readRequest, 0, fe.Config.ReadBatch)
+	// Reads of the cold tier of class 0, while there are tiers, are held for
+	// batches of their own, made every ColdReadMultiple read intervals.
+	cold := make([]*readRequest, 0, fe.Config.ReadBatch)
+	var ticks uint64
 	var readReq *readRequest
-	tick := time.After(fe.Config.ReadInterval)
+	_, interval := fe.intervals()
+	tick := time.After(interval)
 	for atomic.LoadInt32(&fe.dead) == 0 {
 		select {
 		case readReq = <-fe.readChan:
+			if multiple := fe.coldReadMultiple(); multiple > 1 && readReq.Args != nil && readReq.Args.Class == 0 && readReq.Args.Tier == common.TierCold {
+				cold = append(cold, readReq)
+				if len(cold) >= fe.Config.ReadBatch {
+					go fe.triggerBatchRead(cold)
+					cold = make([]*readRequest, 0, fe.Config.ReadBatch)
+				}
+				continue
+			}
 			batch = append(batch, readReq)
 			if len(batch) >= fe.Config.ReadBatch {
 				go fe.triggerBatchRead(batch)
@@ -231,73 +1036,227 @@ func (fe *Frontend) batchReads() {
 				go fe.triggerBatchRead(batch)
 				batch = make([]*readRequest, 0, fe.Config.ReadBatch)
 			}
-			tick = time.After(fe.Config.ReadInterval)
+			ticks++
+			if len(cold) > 0 && ticks%fe.coldReadMultiple() == 0 {
+				go fe.triggerBatchRead(cold)
+				cold = make([]*readRequest, 0, fe.Config.ReadBatch)
+			}
+			_, interval = fe.intervals()
+			tick = time.After(interval)
 			continue
 		}
 	}
 }
 
+// coldReadMultiple is how many read intervals batches of the cold tier are
+// made every: ColdReadMultiple of the configuration in use, while it has
+// tiers, or else 1.
+func (fe *Frontend) coldReadMultiple() uint64 {
+	_, config, _ := fe.generations.current()
+	if config.HotBuckets == 0 || config.ColdReadMultiple == 0 {
+		return 1
+	}
+	return config.ColdReadMultiple
+}
+
 func (fe *Frontend) triggerBatchRead(batch []*readRequest) error {
-	args := &common.BatchReadRequest{}
+	// Reads whose callers have given up waiting are answered without being
+	// sent to replicas.
+	live := batch[:0]
+	for _, val := range batch {
+		if val.Args != nil && common.Expired(val.Args.Deadline) {
+			val.Reply.Err = common.ErrDeadlineExceeded.Error()
+			val.Done <- true
+			continue
+		}
+		live = append(live, val)
+	}
+	batch = live
+	if len(batch) == 0 {
+		return nil
+	}
+	// Reads are made of the database of their generation, size class and
+	// tier, so those of each generation crossing over, and of each class and
+	// tier, are batched apart.
+	current, _, _ := fe.generations.current()
+	generation, class, tier, others := splitBatch(batch, current)
+	if len(others) > 0 {
+		go fe.triggerBatchRead(others)
+		batch = batch[:len(batch)-len(others)]
+	}
+	config, err := fe.generations.lookup(generation)
+	if err != nil {
+		for _, val := range batch {
+			val.Reply.Err = err.Error()
+			val.Done <- true
+		}
+		return nil
+	}
+	// Batches are cut to the size every trust domain takes, and shed while
+	// any has its quota of reads in flight, so a trust domain short of
+	// capacity turns reads away early rather than timing out.
+	if limit := fe.quotas.readBatch(len(batch)); limit < len(batch) {
+		go fe.triggerBatchRead(append([]*readRequest(nil), batch[limit:]...))
+		batch = batch[:limit]
+	}
+	if !fe.quotas.admitReads(len(batch)) {
+		_, interval := fe.intervals()
+		for _, val := range batch {
+			val.Reply.Err = errOverloaded.Error()
+			val.Reply.RetryAfter = interval
+			val.Done <- true
+		}
+		return nil
+	}
+	defer fe.quotas.readsDone(len(batch))
+
+	args := &common.BatchReadRequest{Generation: generation, Class: class, Tier: tier}
 	// Copy args
 	args.Args = make([]common.EncodedReadArgs, len(batch), len(batch))
+	deadlines := make([]time.Time, len(batch))
+	sent := time.Now()
 	for i, val := range batch {
+		if !val.Queued.IsZero() {
+			fe.batchLatency.Record(sent.Sub(val.Queued))
+		}
 		if val.Args != nil {
 			args.Args[i] = *val.Args
+			deadlines[i] = val.Args.Deadline
 		}
 	}
+	args.Deadline = common.LatestDeadline(deadlines...)
 	if fe.Verbose {
 		fe.log.Printf("Batch read with %d items sent to replicas.\n", len(batch))
 	}
 
 	// Choose a SeqNoRange
 	currSeqNo := atomic.LoadUint64(&fe.proposedSeqNo) + 1
-	if currSeqNo <= uint64(fe.Config.WindowSize()) {
+	if currSeqNo <= uint64(config.WindowSize()) {
 		args.SeqNoRange.Start = 1 // Minimum of 1
 	} else {
-		args.SeqNoRange.Start = currSeqNo - uint64(fe.Config.WindowSize()) // Inclusive
+		args.SeqNoRange.Start = currSeqNo - uint64(config.WindowSize()) // Inclusive
 	}
 	args.SeqNoRange.End = currSeqNo // Exclusive
 	args.SeqNoRange.Aborted = make([]uint64, 0, 0)
 
-	// Start computation
-	// @todo reads in parallel
+	// Hold off sealing the next epoch until the batch is read.
+	fe.barrier.RLock()
+	fe.commitLock.Lock()
+	args.Epoch = fe.epoch
+	sealedSeqNo := fe.epochStart - 1
+	fe.commitLock.Unlock()
+	fe.signBatch(args)
+
+	// Start computation on all replicas at once, so a batch takes as long as
+	// the slowest replica rather than their sum.
 	var replicaErr error
+	var failedReplicas []int
 	replies := make([]common.BatchReadReply, len(fe.replicas))
+	errs := make([]error, len(fe.replicas))
+	var wg sync.WaitGroup
 	for i, r := range fe.replicas {
-		err := r.BatchRead(args, &replies[i])
+		if fe.unsealed[i] {
+			errs[i] = common.ErrNotSealed
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r common.ReplicaInterface) {
+			defer wg.Done()
+			errs[i] = r.BatchRead(args, &replies[i])
+			fe.replicaLatency[i].RecordSince(sent)
+		}(i, r)
+	}
+	// The replica a trust domain is migrating to is read alongside the old.
+	m := fe.migrating(args.Epoch)
+	var shadow common.BatchReadReply
+	var shadowErr error
+	if m != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shadowErr = m.target.BatchRead(args, &shadow)
+		}()
+	}
+	wg.Wait()
+	fe.barrier.RUnlock()
+	if m != nil {
+		m.compare(&replies[m.index], errs[m.index], &shadow, shadowErr)
+	}
+	for i, err := range errs {
 		if err != nil || replies[i].Err != "" {
-			replicaErr = err
 			fe.log.Printf("Error making read to replica %d: %v%v", i, err, replies[i].Err)
-			break
-		}
-		if len(replies[i].Replies) != len(batch) {
-			replicaErr = errors.New("failure from Replica " + fmt.Sprintf("%d", i))
+			if err == nil {
+				err = errors.New(replies[i].Err)
+			}
+		} else if len(replies[i].Replies) != len(batch) {
 			fe.log.Printf("Replica %d gave the wrong number of replies (%d instead of %d)", i, len(replies[i].Replies), len(batch))
-			break
+			err = errors.New("failure from Replica " + fmt.Sprintf("%d", i))
+		}
+		if err != nil {
+			if replicaErr == nil {
+				replicaErr = err
+			}
+			failedReplicas = append(failedReplicas, i)
 		}
 	}
 
 	// Respond to clients
-	// @todo propagate errors back to clients.
 	lastInterestSN := fe.currentInterest.ID
 	for i, val := range batch {
 		// any error from any replica invalidates the response
 		if replicaErr != nil {
 			val.Reply.Err = replicaErr.Error()
+			val.Reply.FailedDomains = failedReplicas
 			val.Done <- true
-			break
+			continue
 		}
 
-		replyLength := len(replies[i].Replies[i].Data)
+		replyLength := len(replies[0].Replies[i].Data)
 		val.Reply.Data = make([]byte, replyLength)
 		for _, rp := range replies {
 			val.Reply.Combine(rp.Replies[i].Data)
 		}
+		if fe.Config.VerifyBuckets {
+			val.Reply.Proof = make([]byte, len(replies[0].Replies[i].Proof))
+			val.Reply.Buckets = make([]common.BucketCommitment, len(replies))
+			for j, rp := range replies {
+				val.Reply.CombineProof(rp.Replies[i].Proof)
+				val.Reply.Buckets[j] = rp.Buckets
+			}
+		}
 		val.Reply.GlobalSeqNo = args.SeqNoRange
 		val.Reply.LastInterestSN = lastInterestSN
+		val.Reply.Epoch = args.Epoch
+		val.Reply.SealedSeqNo = sealedSeqNo
 		val.Done <- true
 	}
 
 	return nil
 }
+
+// splitBatch orders a batch with the reads of the generation, size class and
+// tier of its first read ahead of the others, which it returns, and returns
+// that generation, class and tier. Pad requests, without args, go with the
+// first read, or the current generation, class 0 and the cold tier if there
+// are only pad requests.
+func splitBatch(batch []*readRequest, current uint64) (uint64, uint8, uint8, []*readRequest) {
+	generation, class, tier := current, uint8(0), common.TierCold
+	for _, val := range batch {
+		if val.Args != nil {
+			generation, class, tier = val.Args.Generation, val.Args.Class, val.Args.Tier
+			break
+		}
+	}
+	same := make([]*readRequest, 0, len(batch))
+	var others []*readRequest
+	for _, val := range batch {
+		if val.Args != nil && (val.Args.Generation != generation || val.Args.Class != class || val.Args.Tier != tier) {
+			others = append(others, val)
+		} else {
+			same = append(same, val)
+		}
+	}
+	copy(batch, same)
+	copy(batch[len(same):], others)
+	return generation, class, tier, batch[len(same):]
+}
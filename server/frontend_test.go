@@ -1,7 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,13 +32,23 @@ func (m *mockReplica) BatchRead(args *common.BatchReadRequest, reply *common.Bat
 	reply.Replies = make([]common.ReadReply, len(args.Args))
 	return nil
 }
+func (m *mockReplica) GetStats(args *interface{}, reply *common.ShardStats) error {
+	reply.Items = uint64(len(m.calls))
+	return nil
+}
 func (m *mockReplica) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpdatesReply) error {
 	return nil
 }
 
+// testDB is the database of the frontends and replicas of tests.
+func testDB() *common.Config {
+	return &common.Config{NumBuckets: 64, DataSize: 16}
+}
+
 func TestFrontendWrite(t *testing.T) {
 	back := new(mockReplica)
 	serverConfig := &Config{
+		Config:        testDB(),
 		WriteInterval: time.Millisecond * 100,
 		ReadInterval:  time.Minute,
 	}
@@ -67,14 +82,14 @@ func TestFrontendWrite(t *testing.T) {
 func TestFrontendRead(t *testing.T) {
 	back := new(mockReplica)
 	serverConfig := &Config{
-		Config:        &common.Config{},
+		Config:        testDB(),
 		ReadInterval:  time.Millisecond * 100,
 		WriteInterval: time.Minute,
 	}
 
 	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
 
-	args := &common.EncodedReadArgs{}
+	args := &common.EncodedReadArgs{PirArgs: make([][]byte, 1)}
 	reply := &common.ReadReply{}
 	go f.Read(args, reply)
 
@@ -90,3 +105,540 @@ func TestFrontendRead(t *testing.T) {
 
 	f.Close()
 }
+
+func TestFrontendWriteIdempotent(t *testing.T) {
+	back := new(orderReplica)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	first, retry := &common.WriteReply{}, &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: 7, IdempotencyKey: 42}, first)
+	f.Write(&common.WriteArgs{Bucket1: 7, IdempotencyKey: 42}, retry)
+	if first.Err != "" || !reflect.DeepEqual(retry, first) {
+		t.Fatalf("Retry should get the first write's reply: %+v, %+v", first, retry)
+	}
+	other := &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: 8, IdempotencyKey: 43}, other)
+	if other.GlobalSeqNo == first.GlobalSeqNo {
+		t.Fatal("Writes with other keys should be made.")
+	}
+	if written := back.written(); !reflect.DeepEqual(written, []uint64{7, 8}) {
+		t.Fatalf("Retried write should be made once, replicas got %v", written)
+	}
+}
+
+func TestFrontendWriteDuplicates(t *testing.T) {
+	back := new(orderReplica)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	write := func(bucket uint64, data string) *common.WriteReply {
+		reply := &common.WriteReply{}
+		f.Write(&common.WriteArgs{Bucket1: bucket, Data: []byte(data)}, reply)
+		return reply
+	}
+	first, duplicate := write(7, "hello"), write(7, "hello")
+	if first.Err != "" || !reflect.DeepEqual(duplicate, first) {
+		t.Fatalf("Duplicate should get the first write's reply: %+v, %+v", first, duplicate)
+	}
+	if other := write(7, "other"); other.GlobalSeqNo == first.GlobalSeqNo {
+		t.Fatal("Writes of other data should be made.")
+	}
+	stats := &common.FrontendStats{}
+	if f.GetStats(nil, stats); stats.DuplicateWrites != 1 {
+		t.Fatalf("Expected 1 duplicate write dropped, got %d.", stats.DuplicateWrites)
+	}
+
+	// Duplicates are of writes of the same epoch only.
+	f.advanceEpoch()
+	if again := write(7, "hello"); again.GlobalSeqNo == first.GlobalSeqNo {
+		t.Fatal("Write of a previous epoch should be made again.")
+	}
+	if written := back.written(); !reflect.DeepEqual(written, []uint64{7, 7, 7}) {
+		t.Fatalf("Duplicate write should be dropped, replicas got %v", written)
+	}
+}
+
+func TestFrontendValidation(t *testing.T) {
+	back := new(orderReplica)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	reply := &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: testDB().NumBuckets}, reply)
+	if !strings.HasPrefix(reply.Err, "invalid buckets") {
+		t.Fatalf("Write outside the database should be refused, got %q", reply.Err)
+	}
+	readReply := &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 2)}, readReply)
+	if !strings.HasPrefix(readReply.Err, "invalid read") {
+		t.Fatalf("Read for other trust domains should be refused, got %q", readReply.Err)
+	}
+	if written := back.written(); len(written) != 0 {
+		t.Fatalf("Refused writes should not be forwarded, replicas got %v", written)
+	}
+}
+
+// countingReplica counts the batch reads it is sent.
+type countingReplica struct {
+	mockReplica
+	reads int32 // Use atomic
+}
+
+func (c *countingReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	atomic.AddInt32(&c.reads, 1)
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	return nil
+}
+
+func TestFrontendReadDeadline(t *testing.T) {
+	back := new(countingReplica)
+	serverConfig := &Config{
+		Config:        testDB(),
+		ReadInterval:  time.Millisecond * 100,
+		WriteInterval: time.Minute,
+		ReadBatch:     8,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	// A read whose caller has already given up is answered immediately.
+	reply := &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{Deadline: time.Now().Add(-time.Second)}, reply)
+	if reply.Err != common.ErrDeadlineExceeded.Error() {
+		t.Fatalf("Expired read should fail, got %q", reply.Err)
+	}
+
+	// One whose deadline passes while it waits for its batch is never sent.
+	reply = &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1), Deadline: time.Now().Add(10 * time.Millisecond)}, reply)
+	if reply.Err != common.ErrDeadlineExceeded.Error() {
+		t.Fatalf("Read expiring in its batch should fail, got %q", reply.Err)
+	}
+	if n := atomic.LoadInt32(&back.reads); n != 0 {
+		t.Fatalf("Expired reads should not reach replicas, %d batches did", n)
+	}
+
+	reply = &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1), Deadline: time.Now().Add(time.Minute)}, reply)
+	if reply.Err != "" || atomic.LoadInt32(&back.reads) != 1 {
+		t.Fatalf("Read within its deadline failed: %q", reply.Err)
+	}
+}
+
+// orderReplica records the order client writes arrive in, by Bucket1, holding
+// the first one until released.
+type orderReplica struct {
+	mockReplica
+	mu      sync.Mutex
+	order   []uint64
+	release chan bool
+}
+
+func (o *orderReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag || args.InterestFlag {
+		return nil
+	}
+	o.mu.Lock()
+	o.order = append(o.order, args.Bucket1)
+	first := len(o.order) == 1
+	o.mu.Unlock()
+	if first && o.release != nil {
+		<-o.release
+	}
+	return nil
+}
+
+func (o *orderReplica) written() []uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]uint64{}, o.order...)
+}
+
+// queueWrite issues a write, returning once it is queued at the frontend.
+func queueWrite(f *Frontend, bucket uint64, priority uint8, wg *sync.WaitGroup) {
+	queue := f.writeChans[priority]
+	queued := len(queue)
+	wg.Add(1)
+	go func() {
+		f.Write(&common.WriteArgs{Bucket1: bucket, Priority: priority}, &common.WriteReply{})
+		wg.Done()
+	}()
+	for len(queue) == queued {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFrontendWritePriority(t *testing.T) {
+	back := &orderReplica{release: make(chan bool)}
+	serverConfig := &Config{
+		Config:            testDB(),
+		WriteInterval:     time.Minute,
+		ReadInterval:      time.Minute,
+		InteractiveWeight: 1,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	// Hold the scheduler on a first write while the queues fill.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		f.Write(&common.WriteArgs{Bucket1: 0, Priority: common.WriteBulk}, &common.WriteReply{})
+		wg.Done()
+	}()
+	for len(back.written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queueWrite(f, 1, common.WriteBulk, &wg)
+	queueWrite(f, 2, common.WriteBulk, &wg)
+	queueWrite(f, 3, common.WriteInteractive, &wg)
+	queueWrite(f, 4, common.WriteInteractive, &wg)
+	queueWrite(f, 5, common.WriteInteractive, &wg)
+	close(back.release)
+	wg.Wait()
+
+	expected := []uint64{0, 3, 1, 4, 2, 5}
+	if order := back.written(); !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Writes forwarded as %v, expected %v", order, expected)
+	}
+
+	reply := &common.WriteReply{}
+	if f.Write(&common.WriteArgs{Priority: 7}, reply); reply.Err == "" {
+		t.Fatal("Writes of unknown priority should be refused.")
+	}
+}
+
+func TestFrontendWriteBudget(t *testing.T) {
+	back := &orderReplica{}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		WriteBudget:   2,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	for i := uint64(0); i < 3; i++ {
+		go f.Write(&common.WriteArgs{Bucket1: i}, &common.WriteReply{})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(back.written()); n != 2 {
+		t.Fatalf("Expected a budget of 2 writes per interval, %d were forwarded.", n)
+	}
+}
+
+func TestFrontendOverload(t *testing.T) {
+	back := &orderReplica{}
+	serverConfig := &Config{
+		Config:           testDB(),
+		WriteInterval:    time.Minute,
+		ReadInterval:     time.Minute,
+		WriteBudget:      1,
+		MaxPendingWrites: 1,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	reply := &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: 1}, reply)
+	if reply.Err != "" || reply.RetryAfter != 0 {
+		t.Fatalf("A write within the limits should be accepted, got %v", reply.Err)
+	}
+	// Over budget, the next write waits for the following interval.
+	go f.Write(&common.WriteArgs{Bucket1: 2}, &common.WriteReply{})
+	for atomic.LoadInt32(&f.pendingWrites) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	reply = &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: 3}, reply)
+	if reply.Err != errOverloaded.Error() {
+		t.Fatalf("A write beyond the pending limit should be turned away, got %q", reply.Err)
+	}
+	if reply.RetryAfter != 2*time.Minute {
+		t.Fatalf("Expected to retry after the backlog drains, got %v", reply.RetryAfter)
+	}
+	if n := len(back.written()); n != 1 {
+		t.Fatalf("Only the first write should be forwarded, %d were.", n)
+	}
+}
+
+// failingReplica fails all its calls.
+type failingReplica struct {
+	mockReplica
+}
+
+func (f *failingReplica) GetStats(args *interface{}, reply *common.ShardStats) error {
+	return errors.New("unavailable")
+}
+
+func TestFrontendStats(t *testing.T) {
+	back := &mockReplica{calls: []string{"write-1"}}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back, new(failingReplica)})
+	defer f.Close()
+
+	var stats common.FrontendStats
+	if err := f.GetStats(nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Replicas) != 2 || stats.Replicas[0].Items != 1 || stats.Replicas[0].Err != "" {
+		t.Fatalf("Unexpected replica stats %+v", stats.Replicas)
+	}
+	if stats.Replicas[1].Err != "unavailable" {
+		t.Fatalf("A failed replica should be reported, got %+v", stats.Replicas[1])
+	}
+	if stats.SeqNo != 0 || stats.PendingWrites != 0 || stats.PendingReads != 0 || stats.Standby {
+		t.Fatalf("Unexpected frontend stats %+v", stats)
+	}
+	if len(stats.ReplicaLatency) != 2 || stats.ReadLatency.Total != 0 {
+		t.Fatalf("Unexpected read latencies %+v", stats.ReplicaLatency)
+	}
+
+	f.Write(&common.WriteArgs{Bucket1: 1, Bucket2: 2}, &common.WriteReply{})
+	stats = common.FrontendStats{}
+	f.GetStats(nil, &stats)
+	if stats.SeqNo != 1 {
+		t.Fatalf("Frontend should report the write it sequenced, got %d", stats.SeqNo)
+	}
+}
+
+// commitReplica applies writes only to its commitment, optionally dropping one.
+type commitReplica struct {
+	mockReplica
+	*Replica
+	drop uint64
+}
+
+func newCommitReplica(td *common.TrustDomainConfig, drop uint64) *commitReplica {
+	r := &Replica{log: common.NewLogger("commit")}
+	r.config.Store(Config{Config: testDB(), TrustDomain: td})
+	return &commitReplica{Replica: r, drop: drop}
+}
+
+func (c *commitReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag {
+		c.commitEpoch(args, reply)
+	} else if args.GlobalSeqNo != c.drop {
+		c.epochLock.Lock()
+		c.epochLeaves = append(c.epochLeaves, common.WriteLeaf(&args.WriteArgs))
+		c.epochLock.Unlock()
+	}
+	return nil
+}
+
+func (c *commitReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	return c.mockReplica.BatchRead(args, reply)
+}
+
+func (c *commitReplica) GetStats(args *interface{}, reply *common.ShardStats) error {
+	return c.mockReplica.GetStats(args, reply)
+}
+
+func TestFrontendCommitment(t *testing.T) {
+	tds := []*common.TrustDomainConfig{
+		common.NewTrustDomainConfig("td0", "", true, false),
+		common.NewTrustDomainConfig("td1", "", true, false),
+	}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: 50 * time.Millisecond,
+		ReadInterval:  time.Minute,
+	}
+	// The second replica loses the second write.
+	replicas := []common.ReplicaInterface{newCommitReplica(tds[0], 0), newCommitReplica(tds[1], 2)}
+	f := NewFrontend("testing", serverConfig, replicas)
+	defer f.Close()
+
+	writes := make([]*common.WriteArgs, 3)
+	for i := range writes {
+		writes[i] = &common.WriteArgs{Bucket1: uint64(i), Data: []byte{byte(i)}}
+		reply := &common.WriteReply{}
+		f.Write(writes[i], reply)
+		if reply.GlobalSeqNo != uint64(i+1) {
+			t.Fatalf("Write %d was sequenced at %d", i, reply.GlobalSeqNo)
+		}
+	}
+
+	for i, write := range writes {
+		seqNo := uint64(i + 1)
+		reply := &common.GetCommitmentReply{}
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			reply = &common.GetCommitmentReply{}
+			if f.GetCommitment(&common.GetCommitmentArgs{SeqNo: seqNo}, reply); reply.Err == "" {
+				break
+			}
+		}
+		if reply.Err != "" {
+			t.Fatalf("Epoch of write %d was not committed: %s", seqNo, reply.Err)
+		}
+		c := reply.Commitment
+		if !common.VerifyMerkleProof(common.WriteLeaf(write), reply.Index, c.Size, reply.Proof, c.Root) {
+			t.Fatalf("Write %d was not proven to be in the commitment.", seqNo)
+		}
+
+		// Only the epoch with the lost write is disputed.
+		err := c.Verify(tds)
+		if !c.SeqNos.Contains(2) && err != nil {
+			t.Fatalf("Commitment to epoch %d failed to verify: %v", c.Epoch, err)
+		}
+		if e, ok := err.(*common.EquivocationError); c.SeqNos.Contains(2) && (!ok || len(e.TrustDomains) != 1 || e.TrustDomains[0] != 1) {
+			t.Fatalf("Expected the replica which lost a write to disagree, got %v", err)
+		}
+	}
+}
+
+// sealReplica records the epochs of batches it reads, and can fail to seal
+// epochs.
+type sealReplica struct {
+	mockReplica
+	mu       sync.Mutex
+	epochs   []uint64
+	unsealed bool
+}
+
+func (s *sealReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag && s.unsealed {
+		reply.Err = "applied other writes"
+	}
+	return nil
+}
+
+func (s *sealReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	s.mu.Lock()
+	s.epochs = append(s.epochs, args.Epoch)
+	s.mu.Unlock()
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	return nil
+}
+
+func (s *sealReplica) read() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64{}, s.epochs...)
+}
+
+func TestFrontendEpochBarrier(t *testing.T) {
+	sealed, unsealed := &sealReplica{}, &sealReplica{unsealed: true}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: 200 * time.Millisecond,
+		ReadInterval:  10 * time.Millisecond,
+		ReadBatch:     1,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{sealed, unsealed})
+	defer f.Close()
+
+	reply := &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 2)}, reply)
+	if reply.Err != "" {
+		t.Fatalf("Read before any epoch was sealed failed: %q", reply.Err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		f.commitLock.Lock()
+		epoch := f.epoch
+		f.commitLock.Unlock()
+		if epoch > 0 {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("No epoch was sealed.")
+		}
+	}
+
+	// Once a replica fails to seal an epoch like the others, reads are made
+	// of it no more, and fail for want of its trust domain.
+	reply = &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 2)}, reply)
+	if reply.Err != common.ErrNotSealed.Error() || len(reply.FailedDomains) != 1 || reply.FailedDomains[0] != 1 {
+		t.Fatalf("Read of a replica which did not seal the epoch should fail, got %q %v", reply.Err, reply.FailedDomains)
+	}
+	if n := len(unsealed.read()); n != 1 {
+		t.Fatalf("Replica which did not seal the epoch read %d batches.", n)
+	}
+	epochs := sealed.read()
+	if len(epochs) != 2 || epochs[0] != 0 || epochs[1] == 0 {
+		t.Fatalf("Batches were not read from the epochs sealed: %v", epochs)
+	}
+}
+
+// tierReplica records the tier of each batch it reads.
+type tierReplica struct {
+	mockReplica
+	lock  sync.Mutex
+	tiers []uint8
+}
+
+func (r *tierReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	r.lock.Lock()
+	r.tiers = append(r.tiers, args.Tier)
+	r.lock.Unlock()
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	return nil
+}
+
+func TestFrontendColdReads(t *testing.T) {
+	back := new(tierReplica)
+	db := testDB()
+	db.HotBuckets, db.HotEpochs, db.ColdReadMultiple = 8, 1, 5
+	serverConfig := &Config{
+		Config:        db,
+		ReadInterval:  50 * time.Millisecond,
+		WriteInterval: time.Minute,
+		ReadBatch:     8,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	cold := make(chan *common.ReadReply)
+	go func() {
+		reply := &common.ReadReply{}
+		f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1)}, reply)
+		cold <- reply
+	}()
+	reply := &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1), Tier: common.TierHot}, reply)
+	if reply.Err != "" {
+		t.Fatalf("Read of the hot tier failed: %q", reply.Err)
+	}
+	select {
+	case <-cold:
+		t.Fatal("Read of the cold tier was made with the reads of the hot tier.")
+	default:
+	}
+	if reply = <-cold; reply.Err != "" {
+		t.Fatalf("Read of the cold tier failed: %q", reply.Err)
+	}
+	back.lock.Lock()
+	defer back.lock.Unlock()
+	if len(back.tiers) != 2 || back.tiers[0] != common.TierHot || back.tiers[1] != common.TierCold {
+		t.Fatalf("Tiers were read in batches %v.", back.tiers)
+	}
+
+	// Reads of a tier the configuration lacks are refused.
+	reply = &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1), Tier: 7}, reply)
+	if reply.Err != common.ErrTier.Error() {
+		t.Fatalf("Read of an unknown tier should be refused, got %q", reply.Err)
+	}
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	gojson "encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"os"
 
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
@@ -18,12 +22,14 @@ type FrontendServer struct {
 
 	Frontend *Frontend
 	*rpc.Server
+	// Serves the Raft service alone to peers, nil for a lone frontend.
+	raft *rpc.Server
 }
 
 // NewFrontendServer creates a new Frontend implementing HTTP.Handler.
 func NewFrontendServer(name string, serverConfig *Config, replicas []*common.TrustDomainConfig) *FrontendServer {
 	fe := &FrontendServer{}
-	fe.log = log.New(os.Stdout, "[FrontendServer:"+name+"] ", log.Ldate|log.Ltime|log.Lshortfile)
+	fe.log = common.NewLogger("FrontendServer:" + name).Info
 	fe.name = name
 
 	rpcs := make([]common.ReplicaInterface, len(replicas))
@@ -32,32 +38,184 @@ func NewFrontendServer(name string, serverConfig *Config, replicas []*common.Tru
 	}
 
 	fe.Frontend = NewFrontend(name, serverConfig, rpcs)
+	fe.Frontend.dial = func(index int, address string) common.ReplicaInterface {
+		td := *replicas[index]
+		td.Address = address
+		return common.NewReplicaRPC(td.Name, &td)
+	}
+	if len(serverConfig.RaftPeers) > 0 {
+		peers := make([]common.RaftPeer, len(serverConfig.RaftPeers))
+		for i, addr := range serverConfig.RaftPeers {
+			if i != serverConfig.RaftID {
+				peers[i] = common.NewRaftRPC(fmt.Sprintf("%s-peer%d", name, i), addr, i, serverConfig.TrustDomain)
+			}
+		}
+		if err := fe.Frontend.Replicate(serverConfig.RaftID, peers, serverConfig.RaftStateFile); err != nil {
+			fe.log.Fatalf("Could not restore the raft state: %v", err)
+		}
+	}
 
 	// Set up the RPC server component.
 	fe.Server = rpc.NewServer()
 	fe.Server.RegisterCodec(&json.Codec{}, "application/json")
 	fe.Server.RegisterTCPService(fe.Frontend, "Frontend")
+	fe.registerRaft()
 
 	return fe
 }
 
-// Run begins an HTTP server for the server at a specific address
+// registerRaft sets up the RPC server peers call, apart from the one clients
+// call, if the frontend is replicated.
+func (fe *FrontendServer) registerRaft() {
+	if len(fe.Frontend.Config.RaftPeers) > 0 && fe.raft == nil {
+		fe.raft = rpc.NewServer()
+		fe.raft.RegisterCodec(json.NewCodec(), "application/json")
+		fe.raft.RegisterTCPService(NewRaftService(fe.Frontend), "Raft")
+	}
+}
+
+// listenRaft serves the Raft service alone at the address of the frontend
+// among RaftPeers, so that peers are served on a listener of their own, which
+// clients can't reach the Raft service on, nor peers the Frontend service.
+func (fe *FrontendServer) listenRaft() (net.Listener, error) {
+	config := fe.Frontend.Config
+	lc := &ListenerConfig{Address: config.RaftPeers[config.RaftID]}
+	l, err := lc.listen(fe.raft)
+	if err != nil {
+		return nil, err
+	}
+	go serveHTTP(l, &compressedHandler{fe.raft, nil, fe.maxRaftSize})
+	return l, nil
+}
+
+// maxMethodPrefix bounds the start of a request read for its method.
+const maxMethodPrefix = 256
+
+// ServeHTTP serves an RPC to the frontend. Writes and reads, which carry
+// fully untrusted input, are parsed by the streaming decoders of common,
+// which refuse oversized fields before allocating them, rather than by the
+// JSON-RPC server. Requests not naming their method before their params, as
+// clients do, are refused. The RPCs of other methods reach the JSON-RPC server
+// only within the size of a client's largest write or read.
+func (fe *FrontendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limits := fe.Frontend.generations.limits()
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRPCSize())
+	if r.Method != "POST" {
+		fe.Server.ServeHTTP(w, r)
+		return
+	}
+	body := bufio.NewReader(r.Body)
+	prefix, _ := body.Peek(maxMethodPrefix)
+	method, err := common.ReadRPCMethod(bytes.NewReader(prefix))
+	if err != nil {
+		http.Error(w, "request names no method before its params", http.StatusBadRequest)
+		return
+	}
+
+	switch method {
+	case "Frontend.Write":
+		var args common.WriteArgs
+		var reply common.WriteReply
+		id, err := common.DecodeWriteRPC(body, limits, &args)
+		if err == nil {
+			err = fe.Frontend.Write(&args, &reply)
+		}
+		writeRPCReply(w, id, &reply, err)
+	case "Frontend.Read":
+		var args common.EncodedReadArgs
+		var reply common.ReadReply
+		id, err := common.DecodeReadRPC(body, limits, &args)
+		if err == nil {
+			err = fe.Frontend.Read(&args, &reply)
+		}
+		writeRPCReply(w, id, &reply, err)
+	default:
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		fe.Server.ServeHTTP(w, r)
+	}
+}
+
+func (fe *FrontendServer) maxRPCSize() int64 {
+	return fe.Frontend.generations.limits().MaxRPCSize()
+}
+
+// maxRaftSize bounds the calls of peers, which carry at most raftMaxEntries
+// entries, each no larger than the write of a client.
+func (fe *FrontendServer) maxRaftSize() int64 {
+	return raftMaxEntries * fe.maxRPCSize()
+}
+
+// writeRPCReply writes the reply to an RPC as the JSON-RPC server would.
+func writeRPCReply(w http.ResponseWriter, id gojson.RawMessage, reply interface{}, err error) {
+	if id == nil {
+		id = gojson.RawMessage("null")
+	}
+	response := map[string]interface{}{"result": reply, "error": nil, "id": &id}
+	if err != nil {
+		response["result"], response["error"] = nil, err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	gojson.NewEncoder(w).Encode(response)
+}
+
+// Listen serves the frontend on each of a set of listeners, and a replicated
+// frontend's peers on a listener of their own.
+func (fe *FrontendServer) Listen(listeners []ListenerConfig) ([]net.Listener, error) {
+	opened, err := Listen(fe, listeners)
+	if err != nil || fe.raft == nil {
+		return opened, err
+	}
+	l, err := fe.listenRaft()
+	if err != nil {
+		for _, o := range opened {
+			o.Close()
+		}
+		return nil, err
+	}
+	return append(opened, l), nil
+}
+
+// Run begins an HTTP server for the server at a specific address, accepting
+// connections over IPv4 and IPv6. Administrative methods are not served. A
+// replicated frontend's peers are served on a listener of their own, closed
+// with the one returned.
 func (fe *FrontendServer) Run(address string) (net.Listener, error) {
 	if fe.Server == nil {
 		fe.Server = rpc.NewServer()
 		fe.Server.RegisterCodec(json.NewCodec(), "application/json")
 		fe.Server.RegisterTCPService(fe.Frontend, "Frontend")
+		fe.registerRaft()
 	}
 
-	bindAddr, err := net.ResolveTCPAddr("tcp4", address)
+	lc := &ListenerConfig{Address: address}
+	listener, err := lc.listen(fe)
 	if err != nil {
 		return nil, err
 	}
-	listener, err := net.ListenTCP("tcp4", bindAddr)
-	if err != nil {
-		return nil, err
+	if fe.raft != nil {
+		peers, err := fe.listenRaft()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = &pairedListener{listener, peers}
 	}
-	go http.Serve(listener, fe)
+	go serveHTTP(listener, &compressedHandler{lc.expose(fe), nil, fe.maxRPCSize})
 
 	return listener, nil
 }
+
+// pairedListener closes the listener serving the peers of a frontend with the
+// one serving its clients.
+type pairedListener struct {
+	net.Listener
+	peers net.Listener
+}
+
+func (p *pairedListener) Close() error {
+	p.peers.Close()
+	return p.Listener.Close()
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestFrontendServerArgs(t *testing.T) {
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 8, BucketDepth: 1, DataSize: 16},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+
+	call := func(body string) (int, string, json.RawMessage) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		f.ServeHTTP(w, r)
+		var reply struct {
+			Result json.RawMessage
+			Error  string
+		}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return w.Code, reply.Error, reply.Result
+	}
+
+	oversized := `{"method":"Frontend.Write","params":[{"Data":"` + strings.Repeat("A", 40) + `"}],"id":1}`
+	if _, err, _ := call(oversized); !strings.Contains(err, "invalid data") {
+		t.Fatalf("Oversized write was not refused: %q", err)
+	}
+	unknown := `{"method":"Frontend.Read","params":[{"Version":2}],"id":2}`
+	if _, err, _ := call(unknown); err != common.ErrArgsVersion.Error() {
+		t.Fatalf("Read of an unknown version was not refused: %q", err)
+	}
+	if code, _, _ := call(`{"params":[{}],"method":"Frontend.Write","id":3}`); code != http.StatusBadRequest {
+		t.Fatalf("Request with params before its method was answered with %d.", code)
+	}
+
+	// Other methods are served by the JSON-RPC server, within the size of
+	// the largest write or read.
+	if _, err, name := call(`{"id":4,"method":"Frontend.GetName","params":[null]}`); err != "" || string(name) != `"testing"` {
+		t.Fatalf("Method was not passed on: %s, %q", name, err)
+	}
+	oversized = `{"id":5,"method":"Frontend.GetName","params":[null]` + strings.Repeat(" ", int(f.maxRPCSize())) + `}`
+	if _, err, name := call(oversized); name != nil && string(name) != "null" {
+		t.Fatalf("Oversized call was passed on: %s, %q", name, err)
+	}
+}
+
+func TestFrontendServerRaftApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talek-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 8, BucketDepth: 1, DataSize: 16},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		TrustDomain:   common.NewTrustDomainConfig("td", "", true, false),
+		RaftPeers:     []string{"127.0.0.1:0"},
+		RaftStateFile: filepath.Join(dir, "raft"),
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+
+	// Peers are served apart from clients, and clients apart from peers.
+	request := `{"method":"Raft.RequestVote","params":[{}],"id":1}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(request))
+	r.Header.Set("Content-Type", "application/json")
+	f.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "can't find service") {
+		t.Fatalf("Raft service was served to clients: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"method":"Frontend.GetName","params":[null],"id":2}`))
+	r.Header.Set("Content-Type", "application/json")
+	f.raft.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "can't find service") {
+		t.Fatalf("Frontend service was served to peers: %s", w.Body.String())
+	}
+}
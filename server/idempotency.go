@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+)
+
+// idempotencyWindow is how many completed calls a frontend remembers the
+// replies of, for retries arriving after the call was made.
+const idempotencyWindow = 4096
+
+// duplicateWindow is how many writes of an epoch a frontend remembers the
+// contents of, to drop duplicates of them.
+const duplicateWindow = 1 << 16
+
+// idempotentCall is a call made under an idempotency key, whose reply is
+// shared with retries of it.
+type idempotentCall struct {
+	done  chan struct{}
+	reply interface{}
+}
+
+// idempotencyCache tracks calls by idempotency key, so a retry of a call in
+// progress waits for it, and a retry of a completed one gets its reply,
+// rather than either being made again.
+type idempotencyCache struct {
+	lock      sync.Mutex
+	calls     map[uint64]*idempotentCall
+	completed []uint64 // Keys of completed calls kept, oldest first
+	window    int
+}
+
+func newIdempotencyCache(window int) *idempotencyCache {
+	return &idempotencyCache{calls: make(map[uint64]*idempotentCall), window: window}
+}
+
+// begin returns the call of a key, and whether the caller is the first with
+// it, and so must make the call and finish it.
+func (c *idempotencyCache) begin(key uint64) (*idempotentCall, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call := &idempotentCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish records the reply of a call and releases its retries. Unless kept,
+// the key is forgotten, so a later retry makes the call again.
+func (c *idempotencyCache) finish(key uint64, call *idempotentCall, reply interface{}, keep bool) {
+	c.lock.Lock()
+	call.reply = reply
+	close(call.done)
+	if !keep || c.window == 0 {
+		delete(c.calls, key)
+		c.lock.Unlock()
+		return
+	}
+	c.completed = append(c.completed, key)
+	if len(c.completed) > c.window {
+		delete(c.calls, c.completed[0])
+		c.completed = c.completed[1:]
+	}
+	c.lock.Unlock()
+}
+
+// forget forgets the completed calls, so they may be made again. Calls in
+// progress are still joined by their retries.
+func (c *idempotencyCache) forget() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range c.completed {
+		delete(c.calls, key)
+	}
+	c.completed = nil
+}
+
+// writeContentKey identifies a write by all it carries but its deadline and
+// idempotency key, so an identical write, as a client retries after the reply
+// of the first is lost, is known without an idempotency key, while writes
+// differing in any way, as in their priority or token, are not taken for one
+// another.
+func writeContentKey(args *common.WriteArgs) uint64 {
+	h := sha256.New()
+	var b [8]byte
+	putUint := func(v uint64) {
+		binary.BigEndian.PutUint64(b[:], v)
+		h.Write(b[:])
+	}
+	putBytes := func(data []byte) {
+		putUint(uint64(len(data)))
+		h.Write(data)
+	}
+	putUint(args.Bucket1)
+	putUint(args.Bucket2)
+	putUint(args.Generation)
+	putUint(uint64(args.Class))
+	putUint(uint64(args.Priority))
+	putUint(args.TTL)
+	putBytes(args.Data)
+	putBytes(args.InterestVector)
+	putBytes(args.BroadcastKey)
+	putUint(args.BroadcastSeqNo)
+	putBytes(args.PuzzleSeed)
+	putUint(args.PuzzleNonce)
+	if args.Token != nil {
+		putUint(1)
+		h.Write(args.Token.KeyID[:])
+		h.Write(args.Token.Nonce[:])
+		putBytes(args.Token.Signature)
+	} else {
+		putUint(0)
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
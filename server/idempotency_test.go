@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(2)
+
+	call, first := c.begin(1)
+	if !first {
+		t.Fatal("First call of a key should be made.")
+	}
+	retry, first := c.begin(1)
+	if first || retry != call {
+		t.Fatal("Retry of a call in progress should join it.")
+	}
+	c.finish(1, call, "one", true)
+	<-retry.done
+	if retry.reply != "one" {
+		t.Fatalf("Retry should get the call's reply, got %v", retry.reply)
+	}
+	if again, first := c.begin(1); first || again.reply != "one" {
+		t.Fatal("Retry of a completed call should get its reply.")
+	}
+
+	// Calls not kept are forgotten once complete.
+	call, _ = c.begin(2)
+	c.finish(2, call, "two", false)
+	if _, first := c.begin(2); !first {
+		t.Fatal("Call which was not kept should be made again.")
+	}
+
+	// Only the most recent completed calls are kept.
+	for key := uint64(3); key < 6; key++ {
+		call, _ = c.begin(key)
+		c.finish(key, call, key, true)
+	}
+	if _, first := c.begin(1); !first {
+		t.Fatal("Oldest completed call should be forgotten.")
+	}
+	if call, first := c.begin(5); first || call.reply != uint64(5) {
+		t.Fatal("Recent completed call should be kept.")
+	}
+}
+
+func TestWriteContentKey(t *testing.T) {
+	write := common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello")}
+	key := writeContentKey(&write)
+	retry := write
+	retry.Deadline, retry.IdempotencyKey = time.Now(), 3
+	if writeContentKey(&retry) != key {
+		t.Fatal("Retry of a write should be known as it.")
+	}
+	for _, mutate := range []func(*common.WriteArgs){
+		func(w *common.WriteArgs) { w.Priority = common.WriteBulk },
+		func(w *common.WriteArgs) { w.TTL = 4 },
+		func(w *common.WriteArgs) { w.BroadcastKey = []byte{5} },
+		func(w *common.WriteArgs) { w.BroadcastSeqNo = 6 },
+		func(w *common.WriteArgs) { w.Token = &common.Token{} },
+		func(w *common.WriteArgs) { w.PuzzleNonce = 7 },
+		func(w *common.WriteArgs) { w.Data, w.InterestVector = []byte("hell"), []byte("o") },
+	} {
+		other := write
+		mutate(&other)
+		if writeContentKey(&other) == key {
+			t.Fatalf("Different write taken for the same: %+v", other)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// joinChunkSize bounds the state sent to a joining replica in one reply.
+const joinChunkSize = 1 << 20
+
+// joinRetries is how many failed requests a joining replica makes before it
+// gives up on a transfer. A transfer resumes from the last chunk received.
+const joinRetries = 10
+
+// maxStandbys bounds the standbys a replica streams writes to, so requests to
+// join can't have it stream to ever more addresses.
+const maxStandbys = 8
+
+var errJoining = errors.New("replica is joining the trust domain")
+var errTooManyStandbys = errors.New("replica streams to as many standbys as it may")
+var errSnapshotExpired = errors.New("snapshot is no longer served")
+
+// StateSource is a replica of the trust domain a joining replica transfers
+// its state from.
+type StateSource interface {
+	Join(args *common.JoinArgs, reply *common.StateReply) error
+	GetState(args *common.StateArgs, reply *common.StateReply) error
+}
+
+// replicaState is the serialized state of a replica.
+type replicaState struct {
+	CommittedSeqNo uint64
+	Epochs         uint64
+	LastCommitted  common.SignedRoot
+	EpochLeaves    [][32]byte
+	Shard          []byte
+	// The shards past that of the cold tier of class 0, as shardSet.all
+	// orders them.
+	Others [][]byte
+}
+
+type replicaSnapshot struct {
+	id     uint64
+	state  []byte
+	digest [32]byte
+}
+
+// Join streams the writes the replica applies to a replica joining the trust
+// domain at args.Address, and snapshots the state those writes follow. The
+// reply is the first chunk of the snapshot, with the rest served by GetState.
+// Requests must be signed by the trust domain, or by its frontend.
+func (r *Replica) Join(args *common.JoinArgs, reply *common.StateReply) error {
+	config := r.config.Load().(Config)
+	if config.TrustDomain == nil {
+		reply.Err = "replica has no trust domain to join"
+		return nil
+	}
+	if !config.TrustDomain.VerifyJoin(args) && (config.Frontend == nil || !config.Frontend.VerifyJoin(args)) {
+		return common.ErrUnauthenticated
+	}
+
+	r.standbyLock.Lock()
+	streaming := false
+	var stale *standby
+	for _, s := range r.standbys {
+		if s.name == args.Address {
+			if atomic.LoadInt32(&s.behind) == 0 {
+				streaming = true
+			} else {
+				stale = s
+			}
+		}
+	}
+	if !streaming {
+		// A standby fallen behind is replaced by the one joining from a new
+		// snapshot.
+		if stale != nil {
+			r.removeStandby(stale)
+		}
+		if len(r.standbys) >= maxStandbys {
+			r.standbyLock.Unlock()
+			reply.Err = errTooManyStandbys.Error()
+			return nil
+		}
+		td := *config.TrustDomain
+		td.Address = args.Address
+		r.standbys = append(r.standbys, newStandby(args.Address, common.NewReplicaRPC(args.Address, &td), r.alerts))
+	}
+	r.standbyLock.Unlock()
+
+	snap, err := r.takeSnapshot()
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	return r.GetState(&common.StateArgs{SnapshotID: snap.id}, reply)
+}
+
+// GetState serves a chunk of the replica's latest snapshot.
+func (r *Replica) GetState(args *common.StateArgs, reply *common.StateReply) error {
+	r.snapshotLock.Lock()
+	snap := r.snapshot
+	r.snapshotLock.Unlock()
+	if snap == nil || snap.id != args.SnapshotID {
+		reply.Err = errSnapshotExpired.Error()
+		return nil
+	}
+	size := uint64(len(snap.state))
+	if args.Offset > size {
+		reply.Err = fmt.Sprintf("offset %d beyond snapshot of %d bytes", args.Offset, size)
+		return nil
+	}
+	end := args.Offset + joinChunkSize
+	if end > size {
+		end = size
+	}
+	reply.SnapshotID = snap.id
+	reply.Size = size
+	reply.Digest = snap.digest
+	reply.Chunk = snap.state[args.Offset:end]
+	return nil
+}
+
+// Snapshot snapshots the state of the replica to be backed up. Unlike Join,
+// no writes are streamed anywhere. The reply is the first chunk of the
+// snapshot, with the rest served by GetState.
+func (r *Replica) Snapshot(args *interface{}, reply *common.StateReply) error {
+	snap, err := r.takeSnapshot()
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	return r.GetState(&common.StateArgs{SnapshotID: snap.id}, reply)
+}
+
+// Restore replaces the state of the replica with one backed up. The replica
+// refuses writes until restored.
+func (r *Replica) Restore(state []byte) error {
+	atomic.StoreInt32(&r.joining, 1)
+	defer atomic.StoreInt32(&r.joining, 0)
+	return r.restore(state)
+}
+
+// JoinFrom transfers the state of an existing replica of the trust domain to
+// this one, which then applies the writes streamed to it from the snapshot
+// on. The replica refuses writes until the transfer completes.
+func (r *Replica) JoinFrom(source StateSource, address string) error {
+	atomic.StoreInt32(&r.joining, 1)
+	defer atomic.StoreInt32(&r.joining, 0)
+
+	failures := 0
+	fail := func(err error) error {
+		failures++
+		r.log.Warn.Printf("State transfer failed: %v\n", err)
+		if failures >= joinRetries {
+			return fmt.Errorf("giving up on state transfer: %v", err)
+		}
+		time.Sleep(standbyRetry)
+		return nil
+	}
+
+	td := r.config.Load().(Config).TrustDomain
+	if td == nil || !td.CanSign() {
+		return errors.New("replica can't sign a request to join its trust domain")
+	}
+	for {
+		var reply common.StateReply
+		args := &common.JoinArgs{Address: address, Issued: time.Now()}
+		td.SignJoin(args)
+		if err := source.Join(args, &reply); err != nil || reply.Err != "" {
+			if err == nil {
+				err = errors.New(reply.Err)
+			}
+			if err = fail(err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		state := append([]byte{}, reply.Chunk...)
+		restart := false
+		for uint64(len(state)) < reply.Size && !restart {
+			var next common.StateReply
+			err := source.GetState(&common.StateArgs{SnapshotID: reply.SnapshotID, Offset: uint64(len(state))}, &next)
+			if err == nil && next.Err != "" {
+				// The snapshot was replaced, so the transfer starts over.
+				err = errors.New(next.Err)
+				restart = true
+			}
+			if err != nil {
+				if err = fail(err); err != nil {
+					return err
+				}
+				continue
+			}
+			state = append(state, next.Chunk...)
+		}
+		if restart {
+			continue
+		}
+		if sha256.Sum256(state) != reply.Digest {
+			if err := fail(errors.New("snapshot digest mismatch")); err != nil {
+				return err
+			}
+			continue
+		}
+		return r.restore(state)
+	}
+}
+
+// removeStandby stops streaming writes to a standby. The standbyLock must be
+// held.
+func (r *Replica) removeStandby(s *standby) {
+	for i := range r.standbys {
+		if r.standbys[i] == s {
+			r.standbys = append(r.standbys[:i], r.standbys[i+1:]...)
+			break
+		}
+	}
+	s.close()
+	if rpc, ok := s.target.(*common.ReplicaRPC); ok {
+		rpc.Close()
+	}
+}
+
+func (r *Replica) takeSnapshot() (*replicaSnapshot, error) {
+	state, _, err := r.serializeState()
+	if err != nil {
+		return nil, err
+	}
+	r.snapshotLock.Lock()
+	defer r.snapshotLock.Unlock()
+	r.snapshots++
+	r.snapshot = &replicaSnapshot{r.snapshots, state, sha256.Sum256(state)}
+	return r.snapshot, nil
+}
+
+// serializeState encodes the state of the replica, as of the write it
+// returns the sequence number of.
+func (r *Replica) serializeState() ([]byte, uint64, error) {
+	r.applyLock.Lock()
+	state := replicaState{CommittedSeqNo: atomic.LoadUint64(&r.committedSeqNo)}
+	r.epochLock.Lock()
+	state.Epochs = r.epochs
+	state.LastCommitted = r.lastCommitted
+	state.EpochLeaves = append([][32]byte{}, r.epochLeaves...)
+	r.epochLock.Unlock()
+	all := r.shards.all()
+	shards := make([][]byte, len(all))
+	var err error
+	for i, shard := range all {
+		if shards[i], err = shard.Snapshot(); err != nil {
+			break
+		}
+	}
+	r.applyLock.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	state.Shard, state.Others = shards[0], shards[1:]
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), state.CommittedSeqNo, nil
+}
+
+func (r *Replica) restore(data []byte) error {
+	var state replicaState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	all := r.shards.all()
+	if len(state.Others) != len(all)-1 {
+		return fmt.Errorf("state of %d shards rather than %d", len(state.Others)+1, len(all))
+	}
+	for i, shard := range all {
+		data := state.Shard
+		if i > 0 {
+			data = state.Others[i-1]
+		}
+		if err := shard.Restore(data); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&r.committedSeqNo, state.CommittedSeqNo)
+	r.epochLock.Lock()
+	r.epochs = state.Epochs
+	atomic.StoreUint64(&r.sealed, state.Epochs)
+	r.lastCommitted = state.LastCommitted
+	r.epochLeaves = state.EpochLeaves
+	r.epochLock.Unlock()
+	r.log.Info.Printf("Restored the state of the trust domain as of write %d, epoch %d.\n", state.CommittedSeqNo, state.Epochs)
+	return nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// flakySource fails a transfer's first chunk request, and has a write applied
+// by the source after its snapshot is taken.
+type flakySource struct {
+	*Replica
+	write  func(uint64)
+	failed bool
+}
+
+func (f *flakySource) Join(args *common.JoinArgs, reply *common.StateReply) error {
+	err := f.Replica.Join(args, reply)
+	f.write(10)
+	return err
+}
+
+func (f *flakySource) GetState(args *common.StateArgs, reply *common.StateReply) error {
+	if !f.failed {
+		f.failed = true
+		return errors.New("connection reset")
+	}
+	return f.Replica.GetState(args, reply)
+}
+
+func TestReplicaJoin(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	source := NewReplica("source", "cpu.0", conf)
+	defer source.Close()
+	joiner := NewReplica("joiner", "cpu.0", conf)
+	defer joiner.Close()
+
+	var leaves [][32]byte
+	write := func(id uint64) {
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			Bucket1:     id,
+			Bucket2:     id + 1,
+			Data:        make([]byte, conf.Config.DataSize),
+			GlobalSeqNo: id,
+		}}
+		args.Data[0] = byte(id)
+		leaves = append(leaves, common.WriteLeaf(&args.WriteArgs))
+		source.Write(args, &common.ReplicaWriteReply{})
+	}
+	for id := uint64(1); id <= 3; id++ {
+		write(id)
+	}
+	source.Write(&common.ReplicaWriteArgs{EpochFlag: true, EpochRoot: common.MerkleRoot(leaves)}, &common.ReplicaWriteReply{})
+	leaves = nil
+	write(4)
+
+	// Writes reach the joining replica as a standby of the source.
+	source.AddStandby("joiner:9000", joiner)
+	if err := joiner.JoinFrom(&flakySource{Replica: source, write: write}, "joiner:9000"); err != nil {
+		t.Fatal(err)
+	}
+	if len(source.Standbys()) != 1 {
+		t.Fatal("Joining should reuse the standby streaming to the joining replica.")
+	}
+	write(11)
+
+	args := &common.ChecksumArgs{BucketsPerRange: 64, Key: []byte("key")}
+	deadline := time.Now().Add(5 * time.Second)
+	for joiner.currentShard().Checksums(args).SeqNo != 11 {
+		if time.Now().After(deadline) {
+			t.Fatal("Joined replica did not catch up with the source.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	diverged, err := source.currentShard().Checksums(args).Diverged(joiner.currentShard().Checksums(args))
+	if err != nil || len(diverged) != 0 {
+		t.Fatalf("Joined replica diverged from the source in %v: %v", diverged, err)
+	}
+
+	// Epoch state carries over, so both commit the next epoch alike.
+	var reply common.ReplicaWriteReply
+	source.Write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 1, EpochRoot: common.MerkleRoot(leaves)}, &reply)
+	if reply.Err != "" {
+		t.Fatalf("Epoch failed to commit: %s", reply.Err)
+	}
+	for {
+		joiner.epochLock.Lock()
+		epochs, committed := joiner.epochs, joiner.lastCommitted
+		joiner.epochLock.Unlock()
+		if epochs == 2 {
+			if committed != reply.Committed {
+				t.Fatal("Replicas committed the epoch differently.")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Joined replica did not commit the epoch.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var state common.StateReply
+	source.GetState(&common.StateArgs{SnapshotID: 99}, &state)
+	if state.Err != errSnapshotExpired.Error() {
+		t.Fatalf("Unknown snapshots should not be served, got %q", state.Err)
+	}
+}
+
+func TestReplicaJoinAuth(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	source := NewReplica("source", "cpu.0", conf)
+	defer source.Close()
+
+	other := common.NewTrustDomainConfig("other", "", true, false)
+	args := &common.JoinArgs{Address: "joiner:9000", Issued: time.Now()}
+	other.SignJoin(args)
+	if err := source.Join(args, &common.StateReply{}); err != common.ErrUnauthenticated {
+		t.Fatalf("Join signed by another trust domain was not refused: %v", err)
+	}
+	args = &common.JoinArgs{Address: "joiner:9000", Issued: time.Now().Add(-2 * common.JoinWindow)}
+	conf.TrustDomain.SignJoin(args)
+	if err := source.Join(args, &common.StateReply{}); err != common.ErrUnauthenticated {
+		t.Fatalf("Stale join was not refused: %v", err)
+	}
+	if len(source.Standbys()) != 0 {
+		t.Fatal("Refused joins added standbys.")
+	}
+
+	for i := 0; i <= maxStandbys; i++ {
+		args = &common.JoinArgs{Address: fmt.Sprintf("joiner%d:9000", i), Issued: time.Now()}
+		conf.TrustDomain.SignJoin(args)
+		var reply common.StateReply
+		if err := source.Join(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if i == maxStandbys && reply.Err != errTooManyStandbys.Error() {
+			t.Fatalf("Join past the standbys a replica may have was answered with %q.", reply.Err)
+		}
+	}
+	if n := len(source.Standbys()); n != maxStandbys {
+		t.Fatalf("Replica streams to %d standbys.", n)
+	}
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ListenerConfig is an address a server accepts RPCs on, and the methods it
+// exposes there, so that for example administrative methods can be kept to a
+// unix socket while clients are served over TLS.
+type ListenerConfig struct {
+	// Network is "tcp" to accept connections over IPv4 and IPv6, "tcp4" or
+	// "tcp6" for a single address family, "unix", or the name of another
+	// transport registered with common.RegisterTransport. Defaults to "tcp".
+	Network string
+	Address string
+	// Methods served on this listener, either as "Service.Method" or a whole
+	// "Service". Empty to serve all methods but administrative ones, which are
+	// served only where named as "Service.Method", or on unix sockets exposing
+	// all methods.
+	Expose []string
+	// With a certificate and key, the listener serves TLS. The files are
+	// checked for renewal every CertReload, 0 for defaultCertReload, and a
+	// renewed certificate is used for new connections without dropping
+	// those already made.
+	CertFile   string
+	KeyFile    string
+	CertReload time.Duration `json:",string"`
+
+	// Addresses or CIDR ranges connections are accepted from, when not empty,
+	// and those they are refused from. Deny takes precedence.
+	Allow []string
+	Deny  []string
+	// How many connections a single address may hold open. 0 for no limit.
+	MaxConnsPerIP int
+	// Protocol is the framing of RPCs: empty to serve JSON RPCs over HTTP, or
+	// "batch" to serve only BatchRead over the binary batch transport, for
+	// frontends given the listener as a replica's BatchAddress. Batch
+	// listeners do not serve TLS.
+	Protocol common.Framing
+	// Codecs payloads may be compressed with, of "snappy", "zstd" and "none",
+	// most preferred first. Each connection uses the first its client also
+	// supports. Empty to not compress.
+	Compression []string
+	// ZeroCopy sends the replies of a batch listener over TCP with
+	// MSG_ZEROCOPY, where the kernel supports it, sparing a copy of the
+	// buckets read at the cost of pinning their pages until acknowledged.
+	ZeroCopy bool
+}
+
+// batchReader is implemented by servers which answer BatchRead calls over the
+// batch transport.
+type batchReader interface {
+	BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error
+	// maxBatchFrame bounds the frames of the batches the server is
+	// configured to read.
+	maxBatchFrame() uint64
+}
+
+// sizedHandler is implemented by servers which bound the RPCs they are sent.
+type sizedHandler interface {
+	// maxRPCSize bounds the body of an RPC, after decompression.
+	maxRPCSize() int64
+}
+
+// defaultMaxRPCSize bounds the RPCs of servers which don't bound them.
+const defaultMaxRPCSize = 1 << 20
+
+// rpcLimit is the bound on the RPCs a handler is sent.
+func rpcLimit(handler http.Handler) func() int64 {
+	if sized, ok := handler.(sizedHandler); ok {
+		return sized.maxRPCSize
+	}
+	return func() int64 { return defaultMaxRPCSize }
+}
+
+// Listen opens all listeners of a server, serving handler on each. If any
+// can't be opened, those already open are closed again.
+func Listen(handler http.Handler, listeners []ListenerConfig) ([]net.Listener, error) {
+	opened := make([]net.Listener, 0, len(listeners))
+	for _, lc := range listeners {
+		accept, err := common.ParseCompression(lc.Compression)
+		var l net.Listener
+		if err == nil {
+			l, err = lc.listen(handler)
+		}
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return nil, err
+		}
+		opened = append(opened, l)
+
+		if lc.Protocol == common.FramingBatch {
+			go serveBatches(l, accept, lc.ZeroCopy, handler.(batchReader))
+		} else {
+			go serveHTTP(l, &compressedHandler{lc.expose(handler), accept, rpcLimit(handler)})
+		}
+	}
+	return opened, nil
+}
+
+func (lc *ListenerConfig) listen(handler http.Handler) (net.Listener, error) {
+	switch lc.Protocol {
+	case common.FramingHTTP:
+	case common.FramingBatch:
+		if _, ok := handler.(batchReader); !ok {
+			return nil, fmt.Errorf("%s does not serve batch reads", lc.Address)
+		}
+		if lc.CertFile != "" || lc.KeyFile != "" {
+			return nil, fmt.Errorf("batch listener %s cannot serve TLS", lc.Address)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q for listener %s", lc.Protocol, lc.Address)
+	}
+
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	l, err := common.ListenTransport(network, lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if len(lc.Allow) > 0 || len(lc.Deny) > 0 || lc.MaxConnsPerIP > 0 {
+		if l, err = guard(l, lc); err != nil {
+			return nil, err
+		}
+	}
+	if lc.CertFile == "" && lc.KeyFile == "" {
+		return l, nil
+	}
+
+	certs, err := newCertReloader(lc.CertFile, lc.KeyFile, lc.CertReload)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &certListener{tls.NewListener(l, &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}), certs}, nil
+}
+
+// serveHTTP serves RPCs over HTTP/1.1 or HTTP/2, including cleartext HTTP/2
+// from clients which multiplex their calls over a single connection.
+func serveHTTP(l net.Listener, handler http.Handler) error {
+	return http.Serve(l, h2c.NewHandler(handler, &http2.Server{}))
+}
+
+// serveBatches answers BatchRead calls on each connection to a batch listener.
+func serveBatches(l net.Listener, accept []common.Compression, zeroCopy bool, reader batchReader) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go common.ServeBatches(conn, accept, zeroCopy, reader.maxBatchFrame, reader.BatchRead)
+	}
+}
+
+// compressedHandler decompresses the bodies of requests, and compresses those
+// of replies with the codec negotiated with the client. Bodies are refused
+// past the limit of the server.
+type compressedHandler struct {
+	handler http.Handler
+	accept  []common.Compression
+	limit   func() int64
+}
+
+func (c *compressedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, c.limit())
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		codec := common.Compression(encoding)
+		if common.NegotiateCompression(c.accept, []common.Compression{codec}) != codec {
+			http.Error(w, "unsupported compression "+encoding, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := codec.Decompress(r.Body, c.limit())
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = int64(len(body))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// Codecs this server doesn't know are ignored, rather than refused.
+	var offered []common.Compression
+	for _, name := range strings.Split(r.Header.Get(common.CompressionOfferHeader), ",") {
+		offered = append(offered, common.Compression(strings.TrimSpace(name)))
+	}
+	codec := common.NegotiateCompression(c.accept, offered)
+	w.Header().Set(common.CompressionChosenHeader, string(codec))
+	if codec == common.CompressionNone {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	reply := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	c.handler.ServeHTTP(reply, r)
+	body, encoding := codec.Compress(reply.body.Bytes())
+	if encoding != common.CompressionNone {
+		w.Header().Set("Content-Encoding", string(encoding))
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(reply.status)
+	w.Write(body)
+}
+
+// bufferedResponse holds a reply, to be compressed once complete.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// adminMethods administer a server, or hand out its state, rather than serve
+// its clients or peers.
+var adminMethods = map[string]bool{
+	"Frontend.StageTransition": true,
+	"Frontend.Migrate":         true,
+	"Frontend.SetLogLevel":     true,
+	"Frontend.RotateLogs":      true,
+	"Replica.SetLogLevel":      true,
+	"Replica.RotateLogs":       true,
+	"Replica.Join":             true,
+	"Replica.GetState":         true,
+	"Replica.Snapshot":         true,
+	"Replica.SetLaunchParams":  true,
+}
+
+// expose wraps a handler to serve only the methods exposed on the listener.
+func (lc *ListenerConfig) expose(handler http.Handler) http.Handler {
+	if len(lc.Expose) == 0 && lc.Network == "unix" {
+		return handler
+	}
+	return &exposedHandler{handler, lc.Expose}
+}
+
+// exposedHandler refuses RPCs to methods not exposed on a listener.
+type exposedHandler struct {
+	handler http.Handler
+	expose  []string
+}
+
+var errNotExposed = errors.New("method not exposed on this listener")
+
+func (e *exposedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		e.handler.ServeHTTP(w, r)
+		return
+	}
+	// Only the start of the request is read for its method, leaving the rest
+	// to the handler.
+	body := bufio.NewReader(r.Body)
+	prefix, _ := body.Peek(maxMethodPrefix)
+	method, err := common.ReadRPCMethod(bytes.NewReader(prefix))
+	if err != nil {
+		http.Error(w, "request names no method before its params", http.StatusBadRequest)
+		return
+	}
+	if !e.exposed(method) {
+		writeRPCReply(w, nil, nil, errNotExposed)
+		return
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	e.handler.ServeHTTP(w, r)
+}
+
+func (e *exposedHandler) exposed(method string) bool {
+	if len(e.expose) == 0 {
+		return !adminMethods[method]
+	}
+	for _, m := range e.expose {
+		if m == method || (!adminMethods[method] && strings.HasPrefix(method, m+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardedListener drops connections from addresses which aren't allowed, or
+// which already hold as many connections as they may, before any request is
+// read from them.
+type guardedListener struct {
+	net.Listener
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	maxConn int
+
+	lock  sync.Mutex
+	conns map[string]int
+}
+
+func guard(l net.Listener, lc *ListenerConfig) (net.Listener, error) {
+	g := &guardedListener{Listener: l, maxConn: lc.MaxConnsPerIP, conns: make(map[string]int)}
+	var err error
+	if g.allow, err = parseNets(lc.Allow); err == nil {
+		g.deny, err = parseNets(lc.Deny)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// parseNets parses CIDR ranges, taking a plain address as a range of one.
+func parseNets(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", a)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection which passes the listener's rules.
+func (g *guardedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := g.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			// Only IP connections are subject to the rules.
+			return conn, nil
+		}
+		if contains(g.deny, addr.IP) || (len(g.allow) > 0 && !contains(g.allow, addr.IP)) {
+			conn.Close()
+			continue
+		}
+
+		key := addr.IP.String()
+		g.lock.Lock()
+		if g.maxConn > 0 && g.conns[key] >= g.maxConn {
+			g.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		g.conns[key]++
+		g.lock.Unlock()
+		return &guardedConn{Conn: conn, listener: g, key: key}, nil
+	}
+}
+
+// guardedConn releases its address's share of connections when closed.
+type guardedConn struct {
+	net.Conn
+	listener *guardedListener
+	key      string
+	once     sync.Once
+}
+
+func (c *guardedConn) Close() error {
+	c.once.Do(func() {
+		g := c.listener
+		g.lock.Lock()
+		g.conns[c.key]--
+		if g.conns[c.key] <= 0 {
+			delete(g.conns, c.key)
+		}
+		g.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
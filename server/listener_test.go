@@ -0,0 +1,451 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "admin.sock")
+
+	serverConfig := &Config{
+		Config:        &common.Config{},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+	listeners, err := f.Listen([]ListenerConfig{
+		{Address: "127.0.0.1:0", Expose: []string{"Frontend.GetName"}},
+		{Network: "unix", Address: socket},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	public := common.NewRPCPool("http://"+listeners[0].Addr().String(), 1, time.Second, 0)
+	defer public.Close()
+	var name string
+	if err := public.Call("Frontend.GetName", nil, &name); err != nil || name != "testing" {
+		t.Fatalf("Exposed method failed: %q, %v", name, err)
+	}
+	var config common.Config
+	if err := public.Call("Frontend.GetConfig", nil, &config); err == nil || err.Error() != errNotExposed.Error() {
+		t.Fatalf("Method should not be exposed on a restricted listener, got %v", err)
+	}
+
+	// Clients may also multiplex calls over cleartext HTTP/2.
+	multiplexed := common.NewMultiplexedRPCPool("http://"+listeners[0].Addr().String(), time.Second, 0)
+	defer multiplexed.Close()
+	name = ""
+	if err := multiplexed.Call("Frontend.GetName", nil, &name); err != nil || name != "testing" {
+		t.Fatalf("Exposed method failed over HTTP/2: %q, %v", name, err)
+	}
+
+	// Everything is served on the unix socket.
+	admin := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	body, _ := json.Marshal(map[string]interface{}{"method": "Frontend.GetConfig", "params": []interface{}{nil}, "id": 1})
+	resp, err := admin.Post("http://unix/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to call over unix socket: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Result *json.RawMessage
+		Error  interface{}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil || reply.Error != nil || reply.Result == nil {
+		t.Fatalf("Unrestricted listener refused a call: %v %v", err, reply.Error)
+	}
+
+	if _, err := f.Listen([]ListenerConfig{{Address: listeners[0].Addr().String()}}); err == nil {
+		t.Fatal("Listening on an address in use should fail.")
+	}
+}
+
+func TestExposedAdminMethods(t *testing.T) {
+	for expose, methods := range map[string]map[string]bool{
+		"":         {"Frontend.Write": true, "Frontend.StageTransition": false},
+		"Frontend": {"Frontend.Write": true, "Frontend.StageTransition": false, "Frontend.SetLogLevel": false, "Frontend.Migrate": false},
+		"Replica":  {"Replica.Write": true, "Replica.RotateLogs": false, "Replica.SetLaunchParams": false, "Replica.GetLaunchParams": true},
+		"Frontend.GetName,Frontend.StageTransition": {"Frontend.Write": false, "Frontend.StageTransition": true},
+	} {
+		e := &exposedHandler{}
+		if expose != "" {
+			e.expose = strings.Split(expose, ",")
+		}
+		for method, exposed := range methods {
+			if e.exposed(method) != exposed {
+				t.Fatalf("%s exposed on a listener exposing %q: %v", method, expose, !exposed)
+			}
+		}
+	}
+
+	// Unix sockets exposing all methods serve administrative ones too.
+	if _, ok := (&ListenerConfig{Network: "unix"}).expose(http.NotFoundHandler()).(*exposedHandler); ok {
+		t.Fatal("Unix socket exposing all methods was restricted.")
+	}
+	if _, ok := (&ListenerConfig{}).expose(http.NotFoundHandler()).(*exposedHandler); !ok {
+		t.Fatal("TCP listener exposing all methods serves administrative ones.")
+	}
+}
+
+func TestCompressedHandler(t *testing.T) {
+	// The handler echoes the parameter of each call.
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": req.Params[0], "error": nil, "id": 0})
+	})
+	var lock sync.Mutex
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		lock.Unlock()
+		(&compressedHandler{echo, []common.Compression{common.CompressionZstd}, func() int64 { return 1 << 20 }}).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// Replies are compressed with the negotiated codec.
+	body := `{"method":"Echo","params":["` + strings.Repeat("a", 4096) + `"],"id":0}`
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+	req.Header.Set(common.CompressionOfferHeader, "lzma, zstd")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "zstd" || resp.Header.Get(common.CompressionChosenHeader) != "zstd" {
+		t.Fatalf("Reply should be compressed with zstd, got %v", resp.Header)
+	}
+	// Requests must be compressed with a codec the server accepts.
+	req, _ = http.NewRequest("POST", server.URL, strings.NewReader(body))
+	req.Header.Set("Content-Encoding", "snappy")
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Request with an unaccepted codec should be refused, got %v", err)
+	}
+	resp.Body.Close()
+	// Requests decompressing past the limit of the server are refused.
+	bomb, _ := common.CompressionZstd.Compress(make([]byte, 4<<20))
+	req, _ = http.NewRequest("POST", server.URL, bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "zstd")
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Request decompressing past the limit should be refused, got %v", err)
+	}
+	resp.Body.Close()
+
+	// Clients compress requests once the codec is negotiated.
+	pool := common.NewRPCPool(server.URL, 1, time.Second, 0)
+	defer pool.Close()
+	arg := strings.Repeat("b", 4096)
+	for i := 0; i < 2; i++ {
+		var reply string
+		if err := pool.Call("Echo", arg, &reply); err != nil || reply != arg {
+			t.Fatalf("Compressed call failed: %v", err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if encodings[len(encodings)-2] != "" || encodings[len(encodings)-1] != "zstd" {
+		t.Fatalf("Only requests after negotiation should be compressed, got %v", encodings)
+	}
+}
+
+func TestListenerFamilies(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available.")
+	} else {
+		l.Close()
+	}
+	serverConfig := &Config{
+		Config:        &common.Config{},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+
+	if _, err := f.Listen([]ListenerConfig{{Network: "tcp4", Address: "[::1]:0"}}); err == nil {
+		t.Fatal("IPv4 listener should not take an IPv6 address.")
+	}
+	listeners, err := f.Listen([]ListenerConfig{
+		{Address: "[::1]:0"},
+		{Network: "tcp6", Address: "[::1]:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := f.Run("[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners = append(listeners, run)
+	for _, l := range listeners {
+		defer l.Close()
+		pool := common.NewRPCPool("http://"+l.Addr().String(), 1, time.Second, 0)
+		var name string
+		if err := pool.Call("Frontend.GetName", nil, &name); err != nil || name != "testing" {
+			t.Fatalf("Call over IPv6 to %s failed: %q, %v", l.Addr(), name, err)
+		}
+		pool.Close()
+	}
+}
+
+// refused reports whether a connection to address is closed by the server
+// without a request being sent.
+func refused(address string) bool {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestListenerRules(t *testing.T) {
+	serverConfig := &Config{
+		Config:        &common.Config{},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+
+	if _, err := f.Listen([]ListenerConfig{{Address: "127.0.0.1:0", Allow: []string{"not an address"}}}); err == nil {
+		t.Fatal("Invalid rules should fail to listen.")
+	}
+
+	listeners, err := f.Listen([]ListenerConfig{
+		{Address: "127.0.0.1:0", Deny: []string{"127.0.0.0/8"}},
+		{Address: "127.0.0.1:0", Allow: []string{"10.0.0.0/8"}},
+		{Address: "127.0.0.1:0", Allow: []string{"127.0.0.1"}, Deny: []string{"10.0.0.1"}, MaxConnsPerIP: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if !refused(listeners[0].Addr().String()) {
+		t.Fatal("Denied address was served.")
+	}
+	if !refused(listeners[1].Addr().String()) {
+		t.Fatal("Address not allowed was served.")
+	}
+
+	capped := listeners[2].Addr().String()
+	held, err := net.Dial("tcp", capped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refused(capped) {
+		held.Close()
+		t.Fatal("Connections beyond the cap were served.")
+	}
+	held.Close()
+	// The server notices the close on its next read of the connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for refused(capped) {
+		if time.Now().After(deadline) {
+			t.Fatal("Closed connections should not count towards the cap.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoBatches answers each batch read with the number of reads in it.
+type echoBatches struct {
+	http.Handler
+}
+
+func (e *echoBatches) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	for i := range reply.Replies {
+		reply.Replies[i].Data = []byte{byte(len(args.Args))}
+	}
+	return nil
+}
+
+func (e *echoBatches) maxBatchFrame() uint64 {
+	return common.MaxBatchFrame(testDB(), 4)
+}
+
+func TestBatchListener(t *testing.T) {
+	serverConfig := &Config{
+		Config:        &common.Config{},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+	if _, err := f.Listen([]ListenerConfig{{Address: "127.0.0.1:0", Protocol: "batch"}}); err == nil {
+		t.Fatal("A server without batch reads should not listen for them.")
+	}
+
+	handler := &echoBatches{http.NotFoundHandler()}
+	for _, lc := range []ListenerConfig{
+		{Address: "127.0.0.1:0", Protocol: "carrier pigeon"},
+		{Address: "127.0.0.1:0", Protocol: "batch", CertFile: "cert.pem", KeyFile: "key.pem"},
+	} {
+		if _, err := Listen(handler, []ListenerConfig{lc}); err == nil {
+			t.Fatalf("Listener %+v should be refused.", lc)
+		}
+	}
+
+	listeners, err := Listen(handler, []ListenerConfig{{Address: "127.0.0.1:0", Protocol: "batch"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+	client := common.NewBatchClient(listeners[0].Addr().String(), 1, time.Second)
+	defer client.Close()
+	reply := &common.BatchReadReply{}
+	if err := client.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 3)}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Replies) != 3 || !bytes.Equal(reply.Replies[2].Data, []byte{3}) {
+		t.Fatalf("Unexpected batch reply %+v", reply)
+	}
+}
+
+// pipeTransport connects in memory, standing in for an overlay network.
+type pipeTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type pipeListener struct {
+	addr  pipeAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (p *pipeTransport) Listen(address string) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := &pipeListener{pipeAddr(address), make(chan net.Conn), make(chan struct{}), sync.Once{}}
+	p.listeners[address] = l
+	return l, nil
+}
+
+func (p *pipeTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	p.mu.Lock()
+	l, ok := p.listeners[address]
+	p.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, os.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, os.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+func TestTransportListener(t *testing.T) {
+	common.RegisterTransport("pipe", &pipeTransport{listeners: make(map[string]*pipeListener)})
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 64},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontendServer("testing", serverConfig, nil)
+	defer f.Frontend.Close()
+	listeners, err := f.Listen([]ListenerConfig{{Network: "pipe", Address: "frontend"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+
+	// Clients reach the frontend by the transport's name and its address on it.
+	rpc := common.NewFrontendRPC("testing", "pipe:frontend")
+	var config common.Config
+	if err = rpc.GetConfig(nil, &config); err != nil || config.NumBuckets != 64 {
+		t.Fatalf("Call over a registered transport failed: %v, %v", config, err)
+	}
+
+	// As are batch listeners.
+	handler := &echoBatches{http.NotFoundHandler()}
+	batches, err := Listen(handler, []ListenerConfig{{Network: "pipe", Address: "batches", Protocol: common.FramingBatch}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batches[0].Close()
+	client := common.NewBatchClient("pipe:batches", 1, time.Second)
+	defer client.Close()
+	reply := &common.BatchReadReply{}
+	if err = client.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 2)}, reply); err != nil || len(reply.Replies) != 2 {
+		t.Fatalf("Batch read over a registered transport failed: %v", err)
+	}
+
+	if _, err = f.Listen([]ListenerConfig{{Network: "carrier pigeon", Address: "coop"}}); err == nil {
+		t.Fatal("Listening on an unknown transport should fail.")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/privacylab/talek/common"
+)
+
+// metric is a histogram exported under a name and set of labels.
+type metric struct {
+	labels    string
+	histogram common.Histogram
+}
+
+// writeMetrics writes histograms of a metric in the Prometheus text format.
+func writeMetrics(w *bytes.Buffer, name string, help string, metrics ...metric) {
+	common.WriteMetricHeader(w, name, help)
+	for _, m := range metrics {
+		m.histogram.WriteMetric(w, name, m.labels)
+	}
+}
+
+// serveMetrics writes a buffer of metrics as the reply to a scrape.
+func serveMetrics(w http.ResponseWriter, buf *bytes.Buffer) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// ServeMetrics serves the latency histograms of the frontend's reads in the
+// Prometheus text format.
+func (fe *Frontend) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, "talek_frontend_read_seconds", "Latency of the stages of reads at the frontend.",
+		metric{`stage="batch"`, fe.batchLatency.Snapshot()},
+		metric{`stage="total"`, fe.readLatency.Snapshot()})
+	replicas := make([]metric, len(fe.replicaLatency))
+	for i := range fe.replicaLatency {
+		replicas[i] = metric{fmt.Sprintf(`trust_domain="%d"`, i), fe.replicaLatency[i].Snapshot()}
+	}
+	writeMetrics(&buf, "talek_frontend_replica_read_seconds", "Latency of batches of reads at the replica of each trust domain, as seen by the frontend.", replicas...)
+	serveMetrics(w, &buf)
+}
+
+// ServeMetrics serves the latency histograms of the read pipeline of the
+// replica's shard in the Prometheus text format.
+func (r *Replica) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	stats := r.ReadStats()
+	var buf bytes.Buffer
+	writeMetrics(&buf, "talek_replica_read_seconds", "Latency of the stages of batches of reads at the replica.",
+		metric{`stage="queue"`, stats.QueueLatency},
+		metric{`stage="pir"`, stats.ReadLatency})
+	serveMetrics(w, &buf)
+}
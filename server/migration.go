@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// migrationPoll is how often the frontend asks the replica a trust domain is
+// migrating to whether it has committed the epoch it was run alongside in.
+const migrationPoll = 20 * time.Millisecond
+
+// migrationCatchUp bounds how long the frontend waits, as the epoch the new
+// replica is run alongside in ends, for the writes streamed to it to be
+// applied. Writes and reads wait meanwhile.
+const migrationCatchUp = 10 * time.Second
+
+var errMigrating = errors.New("a migration is already in progress")
+
+// migration is the move of the replica of a trust domain to another host.
+// The new replica first joins the trust domain from the old one, which then
+// streams it the writes it applies. For one epoch, the new replica is run
+// alongside the old: every batch of reads is made of both, and their replies
+// compared. As the epoch ends, once the new replica has committed it with the
+// root of the frontend, the frontend cuts over to it, forwarding writes and
+// reads to it rather than to the old replica.
+type migration struct {
+	index  int
+	target common.ReplicaInterface
+	epoch  uint64 // Run alongside the old replica in
+	done   chan error
+
+	lock sync.Mutex
+	err  error // The first disagreement of the replicas
+}
+
+// Migrate moves the replica of a trust domain to the host of args.Address,
+// which must have joined the trust domain from it. The reply is sent once the
+// frontend has cut over to the new replica, or given up on it.
+func (fe *Frontend) Migrate(args *common.MigrateArgs, reply *common.MigrateReply) error {
+	if r := fe.replication(); r != nil && !r.Leading() {
+		reply.Err = errNotLeader.Error()
+		return nil
+	}
+	if args.TrustDomain < 0 || args.TrustDomain >= len(fe.replicas) {
+		reply.Err = fmt.Sprintf("no trust domain %d", args.TrustDomain)
+		return nil
+	}
+	if fe.dial == nil {
+		reply.Err = "frontend can't reach replicas by address"
+		return nil
+	}
+	target := fe.dial(args.TrustDomain, args.Address)
+	epoch, err := fe.migrate(args.TrustDomain, target)
+	if err != nil {
+		reply.Err = err.Error()
+		if closer, ok := target.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+	reply.Epoch = epoch
+	return nil
+}
+
+// migrate moves the replica of a trust domain to target, returning the first
+// epoch target serves.
+func (fe *Frontend) migrate(index int, target common.ReplicaInterface) (uint64, error) {
+	status := replicaStatus(target)
+	if status.Err != "" {
+		return 0, fmt.Errorf("new replica is unreachable: %s", status.Err)
+	} else if status.Joining {
+		return 0, errors.New("new replica is still joining the trust domain")
+	}
+
+	fe.commitLock.Lock()
+	epoch := fe.epoch + 1
+	fe.commitLock.Unlock()
+	m := &migration{index: index, target: target, epoch: epoch, done: make(chan error, 1)}
+	fe.migrationLock.Lock()
+	if fe.migration != nil {
+		fe.migrationLock.Unlock()
+		return 0, errMigrating
+	}
+	fe.migration = m
+	fe.migrationLock.Unlock()
+	fe.log.Printf("Migrating trust domain %d, running its new replica alongside the old in epoch %d.", index, epoch)
+
+	// A frontend losing the lead stops ending epochs, so the migration is
+	// given up on once its epoch should have ended.
+	interval, _ := fe.intervals()
+	timeout := time.NewTimer(3*interval + migrationCatchUp)
+	defer timeout.Stop()
+	select {
+	case err := <-m.done:
+		return epoch + 1, err
+	case <-timeout.C:
+	}
+	fe.migrationLock.Lock()
+	abandoned := fe.migration == m
+	if abandoned {
+		fe.migration = nil
+	}
+	fe.migrationLock.Unlock()
+	if abandoned {
+		return 0, fmt.Errorf("epoch %d did not end", epoch)
+	}
+	// The cut over is under way.
+	return epoch + 1, <-m.done
+}
+
+// migrating returns the migration whose new replica is run alongside the old
+// in an epoch, if any.
+func (fe *Frontend) migrating(epoch uint64) *migration {
+	fe.migrationLock.Lock()
+	defer fe.migrationLock.Unlock()
+	if m := fe.migration; m != nil && m.epoch == epoch {
+		return m
+	}
+	return nil
+}
+
+// compare checks the replies of the new replica to a batch of reads against
+// those of the old. Failed reads are not compared, as the new replica may
+// not yet have sealed the epoch streamed to it.
+func (m *migration) compare(old *common.BatchReadReply, oldErr error, shadow *common.BatchReadReply, shadowErr error) {
+	if oldErr != nil || old.Err != "" || shadowErr != nil || shadow.Err != "" {
+		return
+	}
+	var err error
+	if len(old.Replies) != len(shadow.Replies) {
+		err = fmt.Errorf("new replica gave %d replies rather than %d", len(shadow.Replies), len(old.Replies))
+	}
+	for i := 0; err == nil && i < len(old.Replies); i++ {
+		if !bytes.Equal(old.Replies[i].Data, shadow.Replies[i].Data) {
+			err = fmt.Errorf("new replica answered read %d of a batch of epoch %d differently", i, m.epoch)
+		}
+	}
+	m.lock.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.lock.Unlock()
+}
+
+// cutover ends a migration as the epoch its new replica was run alongside in
+// ends, cutting over to the new replica if it agreed with the old, and
+// committed the epoch with the root of the frontend. Called from endEpoch,
+// with no reads in flight.
+func (fe *Frontend) cutover(m *migration, args *common.ReplicaWriteArgs, record *epochRecord) {
+	fe.migrationLock.Lock()
+	if fe.migration != m {
+		// Given up on already.
+		fe.migrationLock.Unlock()
+		return
+	}
+	fe.migration = nil
+	fe.migrationLock.Unlock()
+
+	m.lock.Lock()
+	err := m.err
+	m.lock.Unlock()
+	if err == nil {
+		err = m.awaitCommit(record.Epoch)
+	}
+	if err == nil {
+		// The new replica committed the epoch streamed to it, and returns the
+		// root it committed to the epoch replayed.
+		replay := *args
+		replay.Replay = true
+		fe.signWrite(&replay)
+		var rep common.ReplicaWriteReply
+		if err = m.target.Write(&replay, &rep); err == nil && rep.Err != "" {
+			err = errors.New(rep.Err)
+		} else if err == nil && (rep.Committed.Root != record.Root || rep.Committed.Size != record.Size) {
+			err = fmt.Errorf("new replica committed epoch %d with a different root", record.Epoch)
+		}
+	}
+	if err != nil {
+		fe.log.Printf("Migration of trust domain %d given up: %v", m.index, err)
+		m.done <- err
+		return
+	}
+
+	replicas := append([]common.ReplicaInterface(nil), fe.replicas...)
+	replicas[m.index] = m.target
+	fe.replicas = replicas
+	fe.unsealed[m.index] = false
+	fe.log.Printf("Cut over trust domain %d to its new replica from epoch %d.", m.index, record.Epoch+1)
+	m.done <- nil
+}
+
+// awaitCommit waits for the new replica to commit an epoch streamed to it.
+func (m *migration) awaitCommit(epoch uint64) error {
+	deadline := time.Now().Add(migrationCatchUp)
+	for {
+		status := replicaStatus(m.target)
+		if status.Err == "" && status.Version == "" {
+			return errors.New("new replica can't report its progress")
+		} else if status.Err == "" && status.Epochs > epoch {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("new replica did not commit epoch %d within %v", epoch, migrationCatchUp)
+		}
+		time.Sleep(migrationPoll)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestFrontendMigrate(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	old := NewReplica("old", "cpu.0", conf)
+	defer old.Close()
+	moved := NewReplica("moved", "cpu.0", conf)
+	defer moved.Close()
+	serverConfig := &Config{
+		Config:        conf.Config,
+		ReadBatch:     conf.ReadBatch,
+		WriteInterval: 50 * time.Millisecond,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{old})
+	defer f.Close()
+
+	write := func(id uint64) {
+		args := &common.WriteArgs{Bucket1: id, Bucket2: id + 1, Data: make([]byte, conf.Config.DataSize)}
+		args.Data[0] = byte(id)
+		reply := &common.WriteReply{}
+		if f.Write(args, reply); reply.Err != "" {
+			t.Fatalf("Write %d failed: %s", id, reply.Err)
+		}
+	}
+	write(1)
+	write(2)
+
+	// The new replica joins the trust domain from the old one first.
+	old.AddStandby("moved:9000", moved)
+	if err := moved.JoinFrom(old, "moved:9000"); err != nil {
+		t.Fatal(err)
+	}
+	joining := NewReplica("joining", "cpu.0", conf)
+	defer joining.Close()
+	atomic.StoreInt32(&joining.joining, 1)
+	if _, err := f.migrate(0, joining); err == nil {
+		t.Fatal("Migration to a replica still joining the trust domain was made.")
+	}
+	epoch, err := f.migrate(0, moved)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if f.replicas[0] != moved || epoch == 0 {
+		t.Fatalf("Frontend did not cut over to the new replica, from epoch %d.", epoch)
+	}
+
+	// Writes from then on reach the new replica alone.
+	write(3)
+	if seqNo := atomic.LoadUint64(&moved.committedSeqNo); seqNo != 3 {
+		t.Fatalf("New replica applied writes up to %d.", seqNo)
+	}
+	if seqNo := atomic.LoadUint64(&old.committedSeqNo); seqNo != 2 {
+		t.Fatalf("Old replica applied writes up to %d after the cut over.", seqNo)
+	}
+}
+
+func TestMigrationCompare(t *testing.T) {
+	m := &migration{epoch: 4}
+	reply := func(data ...byte) *common.BatchReadReply {
+		return &common.BatchReadReply{Replies: []common.ReadReply{{Data: data}}}
+	}
+	m.compare(reply(1), nil, &common.BatchReadReply{Err: common.ErrNotSealed.Error()}, nil)
+	m.compare(reply(1), nil, reply(1), nil)
+	if m.err != nil {
+		t.Fatalf("Replicas agreeing were taken to disagree: %v", m.err)
+	}
+	m.compare(reply(1), nil, reply(2), nil)
+	if m.err == nil {
+		t.Fatal("Replicas answering a read differently were taken to agree.")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// puzzlePeriod is how long a seed of the frontend's puzzles is current.
+// Solutions to the previous seed are accepted too, so writes solved just
+// before it changes are not turned away.
+const puzzlePeriod = time.Minute
+
+// puzzles sets the puzzles of a frontend, at a difficulty tuned to its load,
+// and recognizes solutions which have already been used.
+type puzzles struct {
+	base      uint8
+	threshold int
+
+	mu      sync.Mutex
+	seeds   [2][]byte // Current and previous
+	seen    [2]map[[32]byte]bool
+	rotated time.Time
+}
+
+func newPuzzles(base uint8, threshold int) *puzzles {
+	p := &puzzles{base: base, threshold: threshold}
+	p.rotate()
+	p.rotate()
+	return p
+}
+
+// difficulty of the puzzle for a write arriving with pending writes waiting,
+// or 0 if none is needed. From the threshold, it is the base difficulty, and
+// one bit more each time the pending writes double.
+func (p *puzzles) difficulty(pending int) uint8 {
+	if p.base == 0 || pending < p.threshold {
+		return 0
+	}
+	d := int(p.base)
+	if p.threshold > 0 {
+		for n := pending / p.threshold; n > 1; n /= 2 {
+			d++
+		}
+	}
+	if d > common.MaxPuzzleDifficulty {
+		d = common.MaxPuzzleDifficulty
+	}
+	return uint8(d)
+}
+
+// current is the puzzle writes must solve at a difficulty.
+func (p *puzzles) current(difficulty uint8) *common.Puzzle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maybeRotate()
+	return &common.Puzzle{Seed: p.seeds[0], Difficulty: difficulty}
+}
+
+// solved checks a write solves a current puzzle of at least a difficulty,
+// with a solution not used before.
+func (p *puzzles) solved(w *common.WriteArgs, difficulty uint8) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maybeRotate()
+	for i, seed := range p.seeds {
+		puzzle := common.Puzzle{Seed: seed, Difficulty: difficulty}
+		hash, ok := puzzle.Verify(w)
+		if !ok {
+			continue
+		}
+		if p.seen[i][hash] {
+			return false
+		}
+		p.seen[i][hash] = true
+		return true
+	}
+	return false
+}
+
+// maybeRotate replaces the seed once its period is over. Must be called with
+// the lock held.
+func (p *puzzles) maybeRotate() {
+	if time.Since(p.rotated) >= puzzlePeriod {
+		p.rotate()
+	}
+}
+
+func (p *puzzles) rotate() {
+	seed := make([]byte, common.MaxPuzzleSeed)
+	rand.Read(seed)
+	p.seeds[1], p.seeds[0] = p.seeds[0], seed
+	p.seen[1], p.seen[0] = p.seen[0], make(map[[32]byte]bool)
+	p.rotated = time.Now()
+}
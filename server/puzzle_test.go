@@ -0,0 +1,72 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestPuzzleDifficulty(t *testing.T) {
+	p := newPuzzles(8, 100)
+	for _, c := range []struct {
+		pending int
+		want    uint8
+	}{{0, 0}, {99, 0}, {100, 8}, {199, 8}, {200, 9}, {400, 10}, {math.MaxInt32, common.MaxPuzzleDifficulty}} {
+		if d := p.difficulty(c.pending); d != c.want {
+			t.Fatalf("Difficulty with %d pending is %d, not %d", c.pending, d, c.want)
+		}
+	}
+	if d := newPuzzles(0, 0).difficulty(1000); d != 0 {
+		t.Fatalf("Puzzles set with no difficulty configured: %d", d)
+	}
+}
+
+func TestFrontendPuzzle(t *testing.T) {
+	serverConfig := &Config{
+		Config:           testDB(),
+		WriteInterval:    time.Minute,
+		ReadInterval:     time.Minute,
+		PuzzleDifficulty: 6,
+	}
+	back := &mockReplica{}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	args := &common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello")}
+	reply := &common.WriteReply{}
+	f.Write(args, reply)
+	if reply.Err != common.ErrPuzzleRequired.Error() || reply.Puzzle == nil || reply.Puzzle.Difficulty != 6 {
+		t.Fatalf("Unsolved write should be turned away with a puzzle, got %+v", reply)
+	}
+	if len(back.calls) != 0 {
+		t.Fatalf("Unsolved write was forwarded: %v", back.calls)
+	}
+
+	reply.Puzzle.Solve(args)
+	solved := *args
+	reply = &common.WriteReply{}
+	f.Write(args, reply)
+	if reply.Err != "" || reply.GlobalSeqNo != 1 {
+		t.Fatalf("Solved write failed: %+v", reply)
+	}
+	if reply.Puzzle == nil {
+		t.Fatal("Replies under puzzles should carry the next puzzle.")
+	}
+
+	// A replay of the write in its epoch is dropped as a duplicate, and in
+	// later epochs, a solution is good for one write.
+	calls := len(back.calls)
+	duplicate := &common.WriteReply{}
+	f.Write(&solved, duplicate)
+	if duplicate.GlobalSeqNo != 1 || len(back.calls) != calls {
+		t.Fatalf("Duplicate write was made again: %+v", duplicate)
+	}
+	f.writeContents.forget()
+	reply = &common.WriteReply{}
+	f.Write(&solved, reply)
+	if reply.Err != common.ErrPuzzleRequired.Error() {
+		t.Fatalf("Replayed solution was accepted: %+v", reply)
+	}
+}
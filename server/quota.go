@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/privacylab/talek/common"
+)
+
+// TrustDomainQuota bounds the reads and writes a frontend forwards to the
+// replica of a trust domain, so a trust domain with less capacity than the
+// others is sent smaller batches, and sheds reads early, rather than timing
+// out whole batches of reads. Zero fields don't bound.
+type TrustDomainQuota struct {
+	// Most reads sent to the replica in one batch. Larger batches are split.
+	MaxReadBatch int
+	// Most reads the replica may be answering at once. Batches beyond it are
+	// turned away with errOverloaded, and a time to retry after.
+	MaxReadsInFlight int
+	// Bytes of write data forwarded to the replica per write interval. As
+	// every replica applies every write, writes wait for the next interval
+	// once any trust domain has had its quota.
+	MaxWriteBytes int
+}
+
+// quotas enforce the quotas of each trust domain, and account for what was
+// forwarded to it against them.
+type quotas struct {
+	limits []TrustDomainQuota // By trust domain index, or empty
+	usage  []quotaUsage
+}
+
+// quotaUsage counts what was forwarded to a trust domain. Use atomic.
+type quotaUsage struct {
+	readsForwarded  uint64
+	readBatches     uint64
+	readsShed       uint64
+	readsInFlight   int64
+	writesForwarded uint64
+	writeBytes      uint64
+	writeThrottled  uint64
+}
+
+func newQuotas(limits []TrustDomainQuota, trustDomains int) *quotas {
+	q := &quotas{usage: make([]quotaUsage, trustDomains)}
+	if len(limits) > 0 {
+		q.limits = make([]TrustDomainQuota, trustDomains)
+		copy(q.limits, limits)
+	}
+	return q
+}
+
+// readBatch returns how many reads of a batch of n can be sent together.
+func (q *quotas) readBatch(n int) int {
+	for _, l := range q.limits {
+		if l.MaxReadBatch > 0 && l.MaxReadBatch < n {
+			n = l.MaxReadBatch
+		}
+	}
+	return n
+}
+
+// admitReads counts a batch of n reads in flight to every trust domain,
+// unless that would take one past its quota, when the batch is shed.
+func (q *quotas) admitReads(n int) bool {
+	for i := range q.usage {
+		inFlight := atomic.AddInt64(&q.usage[i].readsInFlight, int64(n))
+		if i < len(q.limits) && q.limits[i].MaxReadsInFlight > 0 && inFlight > int64(q.limits[i].MaxReadsInFlight) {
+			atomic.AddUint64(&q.usage[i].readsShed, uint64(n))
+			for j := 0; j <= i; j++ {
+				atomic.AddInt64(&q.usage[j].readsInFlight, -int64(n))
+			}
+			return false
+		}
+	}
+	for i := range q.usage {
+		atomic.AddUint64(&q.usage[i].readsForwarded, uint64(n))
+		atomic.AddUint64(&q.usage[i].readBatches, 1)
+	}
+	return true
+}
+
+// readsDone counts a batch of n admitted reads as answered.
+func (q *quotas) readsDone(n int) {
+	for i := range q.usage {
+		atomic.AddInt64(&q.usage[i].readsInFlight, -int64(n))
+	}
+}
+
+// writeBytes returns the bytes of writes which may be forwarded per write
+// interval, or 0 for no limit: the least quota of any trust domain.
+func (q *quotas) writeBytes() int {
+	limit := 0
+	for _, l := range q.limits {
+		if l.MaxWriteBytes > 0 && (limit == 0 || l.MaxWriteBytes < limit) {
+			limit = l.MaxWriteBytes
+		}
+	}
+	return limit
+}
+
+// wrote counts a write forwarded to every trust domain.
+func (q *quotas) wrote(args *common.WriteArgs) {
+	for i := range q.usage {
+		atomic.AddUint64(&q.usage[i].writesForwarded, 1)
+		atomic.AddUint64(&q.usage[i].writeBytes, uint64(len(args.Data)))
+	}
+}
+
+// throttled counts a write interval cut short, against the trust domains
+// whose quota the bytes sent in it reached.
+func (q *quotas) throttled(sent int) {
+	for i, l := range q.limits {
+		if l.MaxWriteBytes > 0 && sent >= l.MaxWriteBytes {
+			atomic.AddUint64(&q.usage[i].writeThrottled, 1)
+		}
+	}
+}
+
+// report returns the usage of each trust domain, with its quota.
+func (q *quotas) report() []common.TrustDomainUsage {
+	report := make([]common.TrustDomainUsage, len(q.usage))
+	for i := range q.usage {
+		u := &q.usage[i]
+		report[i] = common.TrustDomainUsage{
+			ReadsForwarded:  atomic.LoadUint64(&u.readsForwarded),
+			ReadBatches:     atomic.LoadUint64(&u.readBatches),
+			ReadsShed:       atomic.LoadUint64(&u.readsShed),
+			ReadsInFlight:   int(atomic.LoadInt64(&u.readsInFlight)),
+			WritesForwarded: atomic.LoadUint64(&u.writesForwarded),
+			WriteBytes:      atomic.LoadUint64(&u.writeBytes),
+			WriteThrottled:  atomic.LoadUint64(&u.writeThrottled),
+		}
+		if i < len(q.limits) {
+			l := q.limits[i]
+			report[i].MaxReadBatch, report[i].MaxReadsInFlight, report[i].MaxWriteBytes = l.MaxReadBatch, l.MaxReadsInFlight, l.MaxWriteBytes
+		}
+	}
+	return report
+}
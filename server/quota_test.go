@@ -0,0 +1,142 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// batchReplica records the sizes of the batches of reads it is sent, holding
+// each until released, if it has a release channel.
+type batchReplica struct {
+	mockReplica
+	mu      sync.Mutex
+	batches []int
+	release chan bool
+}
+
+func (b *batchReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	b.mu.Lock()
+	b.batches = append(b.batches, len(args.Args))
+	b.mu.Unlock()
+	if b.release != nil {
+		<-b.release
+	}
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	return nil
+}
+
+func (b *batchReplica) sizes() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int{}, b.batches...)
+}
+
+func TestQuotaWriteBytes(t *testing.T) {
+	back := &orderReplica{}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		Quotas:        []TrustDomainQuota{{MaxWriteBytes: 20}},
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	for i := uint64(0); i < 3; i++ {
+		go f.Write(&common.WriteArgs{Bucket1: i, Data: make([]byte, 16)}, &common.WriteReply{})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(back.written()); n != 2 {
+		t.Fatalf("Expected writes to stop once past 20 bytes, %d were forwarded.", n)
+	}
+	var stats common.FrontendStats
+	f.GetStats(nil, &stats)
+	if u := stats.Quotas[0]; u.WritesForwarded != 2 || u.WriteBytes != 32 || u.WriteThrottled != 1 {
+		t.Fatalf("Write usage accounted as %+v.", u)
+	}
+}
+
+func TestQuotaReadBatch(t *testing.T) {
+	small, large := &batchReplica{}, &batchReplica{}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  50 * time.Millisecond,
+		ReadBatch:     8,
+		Quotas:        []TrustDomainQuota{{MaxReadBatch: 2}},
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{small, large})
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := &common.ReadReply{}
+			f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 2)}, reply)
+			if reply.Err != "" {
+				t.Errorf("Read failed: %s", reply.Err)
+			}
+		}()
+	}
+	wg.Wait()
+	total := 0
+	for _, n := range large.sizes() {
+		if n > 2 {
+			t.Fatalf("A batch of %d reads exceeded the quota of 2.", n)
+		}
+		total += n
+	}
+	if total != 5 {
+		t.Fatalf("%d of 5 reads were sent.", total)
+	}
+	var stats common.FrontendStats
+	f.GetStats(nil, &stats)
+	if u := stats.Quotas[1]; u.ReadsForwarded != 5 || int(u.ReadBatches) != len(large.sizes()) {
+		t.Fatalf("Read usage accounted as %+v.", u)
+	}
+}
+
+func TestQuotaReadsInFlight(t *testing.T) {
+	back := &batchReplica{release: make(chan bool)}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		ReadBatch:     1,
+		Quotas:        []TrustDomainQuota{{MaxReadsInFlight: 1}},
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	held := &common.ReadReply{}
+	done := make(chan bool)
+	go func() {
+		f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1)}, held)
+		done <- true
+	}()
+	for len(back.sizes()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// With the replica answering one read, the next is shed at once.
+	reply := &common.ReadReply{}
+	f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1)}, reply)
+	if reply.Err != errOverloaded.Error() || reply.RetryAfter != time.Minute {
+		t.Fatalf("Read beyond the quota in flight got %q, retrying after %v.", reply.Err, reply.RetryAfter)
+	}
+	close(back.release)
+	<-done
+	if held.Err != "" {
+		t.Fatalf("Read within the quota failed: %s", held.Err)
+	}
+	var stats common.FrontendStats
+	f.GetStats(nil, &stats)
+	if u := stats.Quotas[0]; u.ReadsShed != 1 || u.ReadsForwarded != 1 {
+		t.Fatalf("Read usage accounted as %+v.", u)
+	}
+}
@@ -0,0 +1,724 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// Raft roles
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// raftHeartbeat is how often a leader replicates its log. Followers start an
+// election after hearing nothing for between raftElectionMultiple and twice
+// that many heartbeats.
+const (
+	raftHeartbeat        = 100 * time.Millisecond
+	raftElectionMultiple = 10
+)
+
+// raftMaxEntries bounds the entries a leader replicates in one call, so that
+// peers can bound the size of the calls they accept. A peer further behind
+// catches up over several heartbeats.
+const raftMaxEntries = 64
+
+var (
+	errNotLeader     = errors.New("not the leader")
+	errNotReplicated = errors.New("frontend is not replicated")
+	errRaftReplay    = errors.New("raft call addressed to another member, or replayed")
+)
+
+// Raft replicates the sequence of writes accepted by the frontends of a trust
+// domain. The leader sequences writes, and only forwards a write to replicas
+// once a majority of frontends hold it, so a standby taking over after the
+// leader fails continues the same ordering. Once an epoch has ended and been
+// forwarded, its entries are compacted into a snapshot of what a leader
+// rebuilds its state from, so the log holds little more than an epoch.
+type Raft struct {
+	log   *common.Logger
+	id    int
+	peers []common.RaftPeer // By member id, nil for this member
+
+	mu          sync.Mutex
+	cond        *sync.Cond // Signalled when commitIndex or the role changes
+	role        int
+	term        uint64
+	votedFor    int
+	leader      int
+	snapshot    common.RaftSnapshot // Of the entries compacted away
+	entries     []common.RaftEntry  // From snapshot.Index, entries[0] standing in for it
+	commitIndex uint64
+	forwarded   uint64 // Last entry forwarded to replicas
+	nextIndex   []uint64
+	matchIndex  []uint64
+	lastAck     []time.Time // When each peer last answered the leader
+	lastContact time.Time
+	timeout     time.Duration
+
+	heartbeat time.Duration
+	// Where the term and vote are kept across restarts, nil for nowhere.
+	store     *DirStore
+	stateName string
+	// Called with each entry committed while following, and each snapshot
+	// installed in place of entries.
+	onCommit   func(common.RaftEntry)
+	onSnapshot func(common.RaftSnapshot)
+
+	dead int32
+}
+
+// raftState is what a member keeps across restarts, so that it never votes
+// twice in a term.
+type raftState struct {
+	Term     uint64
+	VotedFor int
+}
+
+// NewRaft creates member id of a replicated log among peers, and starts
+// following. The term and vote of the member are kept in stateFile, and
+// restored from it when the member restarts.
+func NewRaft(name string, id int, peers []common.RaftPeer, stateFile string, onCommit func(common.RaftEntry), onSnapshot func(common.RaftSnapshot)) (*Raft, error) {
+	return newRaft(name, id, peers, stateFile, onCommit, onSnapshot, raftHeartbeat)
+}
+
+func newRaft(name string, id int, peers []common.RaftPeer, stateFile string, onCommit func(common.RaftEntry), onSnapshot func(common.RaftSnapshot), heartbeat time.Duration) (*Raft, error) {
+	r := &Raft{}
+	r.log = common.NewLogger(name)
+	r.id = id
+	r.peers = peers
+	r.cond = sync.NewCond(&r.mu)
+	r.role = raftFollower
+	r.votedFor = -1
+	r.leader = -1
+	r.entries = make([]common.RaftEntry, 1)
+	r.heartbeat = heartbeat
+	r.onCommit = onCommit
+	r.onSnapshot = onSnapshot
+	if stateFile != "" {
+		if err := r.restore(stateFile); err != nil {
+			return nil, err
+		}
+	}
+	r.lastContact = time.Now()
+	r.resetTimeout()
+
+	go r.run()
+	return r, nil
+}
+
+// restore reads the term and vote kept in a state file, if it exists yet.
+func (r *Raft) restore(stateFile string) error {
+	store, err := NewDirStore(filepath.Dir(stateFile))
+	if err != nil {
+		return err
+	}
+	r.store, r.stateName = store, filepath.Base(stateFile)
+	data, err := store.Get(r.stateName)
+	if err == errNoObject {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state raftState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	r.term, r.votedFor = state.Term, state.VotedFor
+	return nil
+}
+
+// persist keeps the term and vote, before they are acted on. r.mu must be held.
+func (r *Raft) persist() error {
+	if r.store == nil {
+		return nil
+	}
+	data, err := json.Marshal(&raftState{r.term, r.votedFor})
+	if err != nil {
+		return err
+	}
+	return r.store.Put(r.stateName, data)
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// Close stops participating in the replicated log.
+func (r *Raft) Close() {
+	atomic.StoreInt32(&r.dead, 1)
+	r.mu.Lock()
+	r.role = raftFollower
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+// Leading reports whether this member is the leader.
+func (r *Raft) Leading() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == raftLeader
+}
+
+// Term returns the current term, and whether this member leads in it.
+func (r *Raft) Term() (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.term, r.role == raftLeader
+}
+
+// Leader returns the id of the last known leader, or -1.
+func (r *Raft) Leader() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Propose appends an entry to the log as leader, returning its index once a
+// majority of members hold it. An empty entry commits the entries of earlier
+// terms. errNotLeader is returned if leadership is lost first.
+func (r *Raft) Propose(entry common.RaftEntry) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != raftLeader {
+		return 0, errNotLeader
+	}
+	term := r.term
+	entry.Term = term
+	r.entries = append(r.entries, entry)
+	index := r.lastIndex()
+	r.advanceCommit()
+	r.broadcast()
+
+	for r.commitIndex < index && r.role == raftLeader && r.term == term {
+		r.cond.Wait()
+	}
+	if r.commitIndex < index {
+		return 0, errNotLeader
+	}
+	// Entries forwarded since may be compacted away. A leader's own entries
+	// are only replaced once it has lost its term.
+	if index < r.snapshot.Index {
+		if r.term != term {
+			return 0, errNotLeader
+		}
+		return index, nil
+	}
+	if r.entry(index).Term != term {
+		return 0, errNotLeader
+	}
+	return index, nil
+}
+
+// Committed returns the snapshot of the compacted log, the committed entries
+// following it, and the index of the last entry known to have been forwarded
+// to replicas.
+func (r *Raft) Committed() (common.RaftSnapshot, []common.RaftEntry, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	committed := make([]common.RaftEntry, r.commitIndex-r.snapshot.Index)
+	copy(committed, r.entries[1:])
+	return r.snapshot, committed, r.forwarded
+}
+
+// Forwarded records that entries up to index have been forwarded to replicas.
+func (r *Raft) Forwarded(index uint64) {
+	r.mu.Lock()
+	if index > r.forwarded {
+		r.compact(r.forwarded, index)
+		r.forwarded = index
+	}
+	r.mu.Unlock()
+}
+
+// RequestVote handles a candidate asking for this member's vote.
+func (r *Raft) RequestVote(args *common.RequestVoteArgs, reply *common.RequestVoteReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	lastIndex, lastTerm := r.lastEntry()
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if args.Term == r.term && (r.votedFor == -1 || r.votedFor == args.Candidate) && upToDate {
+		r.votedFor = args.Candidate
+		if err := r.persist(); err != nil {
+			r.log.Error.Printf("Failed to keep vote in term %d: %v\n", r.term, err)
+			r.votedFor = -1
+			return nil
+		}
+		r.lastContact = time.Now()
+		reply.Granted = true
+	}
+	return nil
+}
+
+// AppendEntries handles replication of the leader's log.
+func (r *Raft) AppendEntries(args *common.AppendEntriesArgs, reply *common.AppendEntriesReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	if args.Term > r.term || r.role != raftFollower {
+		r.stepDown(args.Term)
+		reply.Term = r.term
+	}
+	r.leader = args.Leader
+	r.lastContact = time.Now()
+
+	// Entries this member has compacted are committed, and so the leader's.
+	prev, entries := args.PrevLogIndex, args.Entries
+	if prev < r.snapshot.Index {
+		skip := r.snapshot.Index - prev
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prev, entries = prev+skip, entries[skip:]
+		if prev < r.snapshot.Index {
+			reply.Success = true
+			reply.LastIndex = r.lastIndex()
+			return nil
+		}
+	} else if prev > r.lastIndex() || r.entry(prev).Term != args.PrevLogTerm {
+		reply.LastIndex = r.lastIndex()
+		if prev <= reply.LastIndex {
+			reply.LastIndex = prev - 1
+		}
+		return nil
+	}
+	for i, e := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.entry(index).Term == e.Term {
+				continue
+			}
+			// Committed entries never conflict, so this only drops uncommitted ones.
+			r.entries = r.entries[:index-r.snapshot.Index]
+		}
+		r.entries = append(r.entries, e)
+	}
+
+	last := prev + uint64(len(entries))
+	commit := args.LeaderCommit
+	if commit > last {
+		commit = last
+	}
+	for r.commitIndex < commit {
+		r.commitIndex++
+		if r.onCommit != nil {
+			r.onCommit(*r.entry(r.commitIndex))
+		}
+	}
+	r.follow(args.Forwarded)
+	reply.Success = true
+	reply.LastIndex = r.lastIndex()
+	return nil
+}
+
+// InstallSnapshot handles a leader replacing the log of this member, which is
+// behind the leader's compacted log. Entries following the snapshot are kept
+// if they agree with it.
+func (r *Raft) InstallSnapshot(args *common.InstallSnapshotArgs, reply *common.InstallSnapshotReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	if args.Term > r.term || r.role != raftFollower {
+		r.stepDown(args.Term)
+		reply.Term = r.term
+	}
+	r.leader = args.Leader
+	r.lastContact = time.Now()
+
+	s := args.Snapshot
+	if s.Index <= r.commitIndex {
+		r.follow(args.Forwarded)
+		return nil
+	}
+	entries := []common.RaftEntry{{Term: s.Term}}
+	if s.Index <= r.lastIndex() && r.entry(s.Index).Term == s.Term {
+		entries = append(entries, r.entries[s.Index-r.snapshot.Index+1:]...)
+	}
+	r.snapshot, r.entries = s, entries
+	r.commitIndex = s.Index
+	if r.forwarded < s.Index {
+		r.forwarded = s.Index
+	}
+	if r.onSnapshot != nil {
+		r.onSnapshot(s)
+	}
+	r.follow(args.Forwarded)
+	return nil
+}
+
+// RaftService serves the raft RPCs of a frontend to its peers. It is served
+// apart from the Frontend service clients call, and only handles calls signed
+// with the key of the trust domain the peers share, addressed to this member
+// and sent later than any call before them from the same peer.
+type RaftService struct {
+	fe *Frontend
+
+	lock sync.Mutex
+	last map[int]time.Time // Of the latest call from each peer
+}
+
+// NewRaftService serves the raft RPCs of a frontend.
+func NewRaftService(fe *Frontend) *RaftService {
+	return &RaftService{fe: fe, last: make(map[int]time.Time)}
+}
+
+// RequestVote handles a peer frontend standing for leader.
+func (s *RaftService) RequestVote(args *common.RequestVoteArgs, reply *common.RequestVoteReply) error {
+	r, err := s.replication(args)
+	if err != nil {
+		return err
+	}
+	return r.RequestVote(args, reply)
+}
+
+// AppendEntries handles replication of the sequence of writes from the leader.
+func (s *RaftService) AppendEntries(args *common.AppendEntriesArgs, reply *common.AppendEntriesReply) error {
+	r, err := s.replication(args)
+	if err != nil {
+		return err
+	}
+	return r.AppendEntries(args, reply)
+}
+
+// InstallSnapshot handles the leader replacing the sequence of writes of a
+// frontend behind its compacted log.
+func (s *RaftService) InstallSnapshot(args *common.InstallSnapshotArgs, reply *common.InstallSnapshotReply) error {
+	r, err := s.replication(args)
+	if err != nil {
+		return err
+	}
+	return r.InstallSnapshot(args, reply)
+}
+
+// replication returns the raft of the frontend if args are signed by a peer.
+func (s *RaftService) replication(args common.RaftArgs) (*Raft, error) {
+	if td := s.fe.Config.TrustDomain; td == nil || !td.VerifyRaft(args) {
+		return nil, common.ErrUnauthenticated
+	}
+	r := s.fe.replication()
+	if r == nil {
+		return nil, errNotReplicated
+	}
+	if !s.fresh(r, args) {
+		return nil, errRaftReplay
+	}
+	return r, nil
+}
+
+// fresh is whether a call is addressed to this member from another, and sent
+// within RaftCallWindow of now, after the last call from the same member.
+func (s *RaftService) fresh(r *Raft, args common.RaftArgs) bool {
+	call, sender := args.RaftCall(), args.Sender()
+	if call.To != r.id || sender == r.id || sender < 0 || sender >= len(r.peers) {
+		return false
+	}
+	if age := time.Since(call.Sent); age > common.RaftCallWindow || age < -common.RaftCallWindow {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !call.Sent.After(s.last[sender]) {
+		return false
+	}
+	s.last[sender] = call.Sent
+	return true
+}
+
+/** PRIVATE METHODS **/
+
+func (r *Raft) run() {
+	for atomic.LoadInt32(&r.dead) == 0 {
+		r.mu.Lock()
+		if r.role == raftLeader && !r.quorate() {
+			// Stop accepting writes which can no longer commit.
+			r.stepDown(r.term)
+		} else if r.role == raftLeader {
+			r.broadcast()
+		} else if time.Since(r.lastContact) > r.timeout {
+			r.startElection()
+		}
+		r.mu.Unlock()
+		time.Sleep(r.heartbeat)
+	}
+}
+
+// lastIndex returns the index of the last entry of the log. r.mu must be held.
+func (r *Raft) lastIndex() uint64 {
+	return r.snapshot.Index + uint64(len(r.entries)-1)
+}
+
+// entry returns the entry at index, which must not be compacted away, the
+// last compacted entry standing in for the snapshot. r.mu must be held.
+func (r *Raft) entry(index uint64) *common.RaftEntry {
+	return &r.entries[index-r.snapshot.Index]
+}
+
+// lastEntry returns the index and term of the last entry of the log. r.mu must be held.
+func (r *Raft) lastEntry() (uint64, uint64) {
+	last := r.lastIndex()
+	return last, r.entry(last).Term
+}
+
+// follow records the entries the leader has forwarded to replicas, which this
+// member holds. r.mu must be held.
+func (r *Raft) follow(forwarded uint64) {
+	if forwarded > r.commitIndex {
+		forwarded = r.commitIndex
+	}
+	if forwarded > r.forwarded {
+		r.compact(r.forwarded, forwarded)
+		r.forwarded = forwarded
+	}
+}
+
+// compact folds entries into the snapshot up to the last epoch end among
+// those newly forwarded, after from and up to to. r.mu must be held.
+func (r *Raft) compact(from uint64, to uint64) {
+	if from < r.snapshot.Index {
+		from = r.snapshot.Index
+	}
+	end := uint64(0)
+	for i := to; i > from; i-- {
+		if r.entry(i).EpochEnd {
+			end = i
+			break
+		}
+	}
+	if end == 0 {
+		return
+	}
+	s := r.snapshot
+	for i := s.Index + 1; i <= end; i++ {
+		e := r.entry(i)
+		if e.Write != nil {
+			s.Writes++
+			s.SeqNo = e.Write.GlobalSeqNo
+		} else if e.Transition != nil {
+			s.Transition = e.Transition
+		} else if e.EpochEnd {
+			s.Epoch++
+		}
+	}
+	s.Index, s.Term = end, r.entry(end).Term
+	r.entries = append([]common.RaftEntry{{Term: s.Term}}, r.entries[end-r.snapshot.Index+1:]...)
+	r.snapshot = s
+}
+
+func (r *Raft) resetTimeout() {
+	base := r.heartbeat * raftElectionMultiple
+	r.timeout = base + time.Duration(rand.Int63n(int64(base)))
+}
+
+// stepDown follows at a term. r.mu must be held.
+func (r *Raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = -1
+		if err := r.persist(); err != nil {
+			r.log.Error.Printf("Failed to keep term %d: %v\n", r.term, err)
+		}
+	}
+	if r.role == raftLeader {
+		r.log.Info.Printf("Stepping down as leader in term %d.\n", r.term)
+	}
+	r.role = raftFollower
+	r.cond.Broadcast()
+}
+
+// startElection stands for leader at the next term. r.mu must be held.
+func (r *Raft) startElection() {
+	r.term++
+	r.role = raftCandidate
+	r.votedFor = r.id
+	r.leader = -1
+	r.lastContact = time.Now()
+	r.resetTimeout()
+	if err := r.persist(); err != nil {
+		// Votes can't be asked for in a term this member may forget it stood in.
+		r.log.Error.Printf("Failed to keep term %d: %v\n", r.term, err)
+		r.role = raftFollower
+		return
+	}
+
+	lastIndex, lastTerm := r.lastEntry()
+	args := &common.RequestVoteArgs{Term: r.term, Candidate: r.id, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	votes := 1
+	if votes > len(r.peers)/2 {
+		r.becomeLeader()
+		return
+	}
+	for i, peer := range r.peers {
+		if i == r.id || peer == nil {
+			continue
+		}
+		go func(peer common.RaftPeer) {
+			reply := &common.RequestVoteReply{}
+			if err := peer.RequestVote(args, reply); err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+				return
+			}
+			if r.role != raftCandidate || r.term != args.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes > len(r.peers)/2 {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over replication of the log. r.mu must be held.
+func (r *Raft) becomeLeader() {
+	r.log.Info.Printf("Leading in term %d.\n", r.term)
+	r.role = raftLeader
+	r.leader = r.id
+	r.nextIndex = make([]uint64, len(r.peers))
+	r.matchIndex = make([]uint64, len(r.peers))
+	r.lastAck = make([]time.Time, len(r.peers))
+	for i := range r.nextIndex {
+		r.nextIndex[i] = r.lastIndex() + 1
+		r.lastAck[i] = time.Now()
+	}
+	r.cond.Broadcast()
+	r.broadcast()
+}
+
+// broadcast replicates the log to all peers, sending the snapshot to those
+// behind it. r.mu must be held.
+func (r *Raft) broadcast() {
+	for i, peer := range r.peers {
+		if i == r.id || peer == nil {
+			continue
+		}
+		if r.nextIndex[i] <= r.snapshot.Index {
+			args := &common.InstallSnapshotArgs{
+				Term:      r.term,
+				Leader:    r.id,
+				Snapshot:  r.snapshot,
+				Forwarded: r.forwarded,
+			}
+			go r.install(i, peer, args)
+			continue
+		}
+		prev := r.nextIndex[i] - 1
+		entries := r.entries[prev+1-r.snapshot.Index:]
+		if len(entries) > raftMaxEntries {
+			entries = entries[:raftMaxEntries]
+		}
+		args := &common.AppendEntriesArgs{
+			Term:         r.term,
+			Leader:       r.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  r.entry(prev).Term,
+			Entries:      append([]common.RaftEntry{}, entries...),
+			LeaderCommit: r.commitIndex,
+			Forwarded:    r.forwarded,
+		}
+		go r.replicate(i, peer, args)
+	}
+}
+
+func (r *Raft) replicate(i int, peer common.RaftPeer, args *common.AppendEntriesArgs) {
+	reply := &common.AppendEntriesReply{}
+	if err := peer.AppendEntries(args, reply); err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+	if r.role != raftLeader || r.term != args.Term {
+		return
+	}
+	r.lastAck[i] = time.Now()
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > r.matchIndex[i] {
+			r.matchIndex[i] = match
+			r.nextIndex[i] = match + 1
+			r.advanceCommit()
+		}
+	} else if reply.LastIndex+1 < r.nextIndex[i] {
+		r.nextIndex[i] = reply.LastIndex + 1
+	} else if r.nextIndex[i] > 1 {
+		r.nextIndex[i]--
+	}
+}
+
+func (r *Raft) install(i int, peer common.RaftPeer, args *common.InstallSnapshotArgs) {
+	reply := &common.InstallSnapshotReply{}
+	if err := peer.InstallSnapshot(args, reply); err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+	if r.role != raftLeader || r.term != args.Term {
+		return
+	}
+	r.lastAck[i] = time.Now()
+	if match := args.Snapshot.Index; match > r.matchIndex[i] {
+		r.matchIndex[i] = match
+		r.nextIndex[i] = match + 1
+	}
+}
+
+// quorate reports whether a majority of members have answered the leader within
+// an election timeout. r.mu must be held.
+func (r *Raft) quorate() bool {
+	count := 1
+	for i, ack := range r.lastAck {
+		if i != r.id && time.Since(ack) < r.heartbeat*raftElectionMultiple {
+			count++
+		}
+	}
+	return count > len(r.peers)/2
+}
+
+// advanceCommit commits entries of the current term held by a majority. r.mu must be held.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.entry(n).Term != r.term {
+			break
+		}
+		count := 1
+		for i, match := range r.matchIndex {
+			if i != r.id && match >= n {
+				count++
+			}
+		}
+		if count > len(r.peers)/2 {
+			r.commitIndex = n
+			r.cond.Broadcast()
+			return
+		}
+	}
+}
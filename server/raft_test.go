@@ -0,0 +1,406 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+const testHeartbeat = 10 * time.Millisecond
+
+var errPartitioned = errors.New("partitioned")
+
+// raftNet connects members in memory, any of which can be cut off. Calls are
+// signed with the key of its trust domain, if it has one.
+type raftNet struct {
+	members []common.RaftPeer
+	down    []int32
+	td      *common.TrustDomainConfig
+}
+
+type raftLink struct {
+	net      *raftNet
+	from, to int
+	calls    common.RaftCalls
+}
+
+func (l *raftLink) up() bool {
+	return atomic.LoadInt32(&l.net.down[l.from]) == 0 && atomic.LoadInt32(&l.net.down[l.to]) == 0
+}
+
+func (l *raftLink) RequestVote(args *common.RequestVoteArgs, reply *common.RequestVoteReply) error {
+	if !l.up() {
+		return errPartitioned
+	}
+	if l.net.td != nil {
+		signed := *args
+		l.calls.Sign(l.net.td, &signed)
+		args = &signed
+	}
+	return l.net.members[l.to].RequestVote(args, reply)
+}
+
+func (l *raftLink) AppendEntries(args *common.AppendEntriesArgs, reply *common.AppendEntriesReply) error {
+	if !l.up() {
+		return errPartitioned
+	}
+	if l.net.td != nil {
+		signed := *args
+		l.calls.Sign(l.net.td, &signed)
+		args = &signed
+	}
+	return l.net.members[l.to].AppendEntries(args, reply)
+}
+
+func (l *raftLink) InstallSnapshot(args *common.InstallSnapshotArgs, reply *common.InstallSnapshotReply) error {
+	if !l.up() {
+		return errPartitioned
+	}
+	if l.net.td != nil {
+		signed := *args
+		l.calls.Sign(l.net.td, &signed)
+		args = &signed
+	}
+	return l.net.members[l.to].InstallSnapshot(args, reply)
+}
+
+func newRaftNet(n int) *raftNet {
+	return &raftNet{members: make([]common.RaftPeer, n), down: make([]int32, n)}
+}
+
+// peersOf is the view of the network from member id.
+func (n *raftNet) peersOf(id int) []common.RaftPeer {
+	peers := make([]common.RaftPeer, len(n.members))
+	for i := range peers {
+		if i != id {
+			peers[i] = &raftLink{net: n, from: id, to: i, calls: common.RaftCalls{To: i}}
+		}
+	}
+	return peers
+}
+
+func (n *raftNet) cut(id int) {
+	atomic.StoreInt32(&n.down[id], 1)
+}
+
+// awaitLeader waits for a single member still connected to lead.
+func awaitLeader(t *testing.T, n *raftNet, members []*Raft) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := -1
+		for i, m := range members {
+			if atomic.LoadInt32(&n.down[i]) == 0 && m.Leading() {
+				if leader != -1 {
+					leader = -2
+					break
+				}
+				leader = i
+			}
+		}
+		if leader >= 0 {
+			return leader
+		}
+		time.Sleep(testHeartbeat)
+	}
+	t.Fatal("No leader was elected.")
+	return -1
+}
+
+func awaitCommitted(t *testing.T, m *Raft, n int) []common.RaftEntry {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, entries, _ := m.Committed(); len(entries) >= n {
+			return entries
+		}
+		time.Sleep(testHeartbeat)
+	}
+	t.Fatalf("Fewer than %d entries were committed.", n)
+	return nil
+}
+
+func TestRaftFailover(t *testing.T) {
+	n := newRaftNet(3)
+	members := make([]*Raft, 3)
+	for i := range members {
+		members[i], _ = newRaft("raft", i, n.peersOf(i), "", nil, nil, testHeartbeat)
+		n.members[i] = members[i]
+	}
+	defer func() {
+		for _, m := range members {
+			m.Close()
+		}
+	}()
+
+	leader := awaitLeader(t, n, members)
+	for seqNo := uint64(1); seqNo <= 3; seqNo++ {
+		if _, err := members[leader].Propose(common.RaftEntry{Write: &common.WriteArgs{GlobalSeqNo: seqNo}}); err != nil {
+			t.Fatalf("Failed to propose write %d: %v", seqNo, err)
+		}
+	}
+	for i, m := range members {
+		if i != leader && m.Leading() {
+			t.Fatalf("Member %d leads alongside %d.", i, leader)
+		}
+	}
+
+	n.cut(leader)
+	next := awaitLeader(t, n, members)
+	if next == leader {
+		t.Fatal("A cut off member should not remain leader.")
+	}
+	if _, err := members[next].Propose(common.RaftEntry{Write: &common.WriteArgs{GlobalSeqNo: 4}}); err != nil {
+		t.Fatalf("Failed to propose after failover: %v", err)
+	}
+
+	// Writes committed by the failed leader keep their place.
+	for i, m := range members {
+		if i == leader {
+			continue
+		}
+		var seqNos []uint64
+		for _, e := range awaitCommitted(t, m, 4) {
+			if e.Write != nil {
+				seqNos = append(seqNos, e.Write.GlobalSeqNo)
+			}
+		}
+		if len(seqNos) != 4 || seqNos[0] != 1 || seqNos[1] != 2 || seqNos[2] != 3 || seqNos[3] != 4 {
+			t.Fatalf("Member %d committed writes %v after failover", i, seqNos)
+		}
+	}
+
+	if _, err := members[leader].Propose(common.RaftEntry{}); err == nil {
+		t.Fatal("A deposed leader should not commit entries.")
+	}
+}
+
+func TestRaftCompaction(t *testing.T) {
+	n := newRaftNet(3)
+	members := make([]*Raft, 3)
+	installed := make([]int32, 3)
+	for i := range members {
+		i := i
+		members[i], _ = newRaft("raft", i, n.peersOf(i), "", nil, func(common.RaftSnapshot) { atomic.AddInt32(&installed[i], 1) }, testHeartbeat)
+		n.members[i] = members[i]
+	}
+	defer func() {
+		for _, m := range members {
+			m.Close()
+		}
+	}()
+
+	leader := awaitLeader(t, n, members)
+	behind := (leader + 1) % 3
+	n.cut(behind)
+	propose := func(entry common.RaftEntry) {
+		index, err := members[leader].Propose(entry)
+		if err != nil {
+			t.Fatalf("Failed to propose: %v", err)
+		}
+		members[leader].Forwarded(index)
+	}
+	for epoch := uint64(1); epoch <= 2; epoch++ {
+		propose(common.RaftEntry{Write: &common.WriteArgs{GlobalSeqNo: epoch}})
+		propose(common.RaftEntry{EpochEnd: true})
+	}
+	propose(common.RaftEntry{Write: &common.WriteArgs{GlobalSeqNo: 3}})
+
+	// The log is compacted to the last epoch forwarded.
+	snapshot, entries, _ := members[leader].Committed()
+	if snapshot.Epoch != 2 || snapshot.Writes != 2 || snapshot.SeqNo != 2 || len(entries) != 1 || entries[0].Write.GlobalSeqNo != 3 {
+		t.Fatalf("Log compacted to %+v, followed by %d entries", snapshot, len(entries))
+	}
+
+	// A member cut off throughout is caught up from the snapshot.
+	atomic.StoreInt32(&n.down[behind], 0)
+	entries = awaitCommitted(t, members[behind], 1)
+	if got, _, _ := members[behind].Committed(); got != snapshot || atomic.LoadInt32(&installed[behind]) == 0 {
+		t.Fatalf("Snapshot installed as %+v, expected %+v", got, snapshot)
+	}
+	if entries[0].Write.GlobalSeqNo != 3 {
+		t.Fatalf("Entry after the snapshot committed as %+v", entries[0])
+	}
+}
+
+func TestRaftState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "raft.json")
+
+	// A lone member votes for itself as it stands.
+	n := newRaftNet(1)
+	m, err := newRaft("raft", 0, n.peersOf(0), state, nil, nil, testHeartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.members[0] = m
+	awaitLeader(t, n, []*Raft{m})
+	m.Close()
+	term, _ := m.Term()
+
+	// Restarted, it remembers its term and vote.
+	m, err = newRaft("raft", 0, newRaftNet(1).peersOf(0), state, nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if restored, _ := m.Term(); restored != term {
+		t.Fatalf("Term restored as %d, expected %d.", restored, term)
+	}
+	reply := &common.RequestVoteReply{}
+	if m.RequestVote(&common.RequestVoteArgs{Term: term, Candidate: 1}, reply); reply.Granted {
+		t.Fatal("A second vote was granted in a term.")
+	}
+}
+
+// seqReplica records the writes applied, skipping replays as replicas do.
+type seqReplica struct {
+	mockReplica
+	mu     sync.Mutex
+	seqNos []uint64
+}
+
+func (s *seqReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag || args.InterestFlag {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if args.Replay && len(s.seqNos) > 0 && args.GlobalSeqNo <= s.seqNos[len(s.seqNos)-1] {
+		return nil
+	}
+	s.seqNos = append(s.seqNos, args.GlobalSeqNo)
+	return nil
+}
+
+func TestFrontendFailover(t *testing.T) {
+	back := new(seqReplica)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Millisecond * 50,
+		ReadInterval:  time.Minute,
+		TrustDomain:   common.NewTrustDomainConfig("td", "", true, false),
+	}
+	n := newRaftNet(3)
+	n.td = serverConfig.TrustDomain
+	frontends := make([]*Frontend, 3)
+	members := make([]*Raft, 3)
+	for i := range frontends {
+		frontends[i] = NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+		frontends[i].replicate(i, n.peersOf(i), "", testHeartbeat)
+		n.members[i] = NewRaftService(frontends[i])
+		members[i] = frontends[i].replication()
+	}
+	defer func() {
+		for _, f := range frontends {
+			f.Close()
+		}
+	}()
+
+	leader := awaitLeader(t, n, members)
+	for i := 0; i < 3; i++ {
+		reply := &common.WriteReply{}
+		frontends[leader].Write(&common.WriteArgs{Bucket1: uint64(i)}, reply)
+		if reply.Err != "" {
+			t.Fatalf("Write to leader failed: %v", reply.Err)
+		}
+	}
+	standby := (leader + 1) % 3
+	if members[standby].Leading() {
+		standby = (leader + 2) % 3
+	}
+	reply := &common.WriteReply{}
+	frontends[standby].Write(&common.WriteArgs{}, reply)
+	if reply.Err != errNotLeader.Error() {
+		t.Fatalf("A standby should refuse writes, got %q", reply.Err)
+	}
+
+	n.cut(leader)
+	frontends[leader].Close()
+	next := awaitLeader(t, n, members)
+	reply = &common.WriteReply{}
+	frontends[next].Write(&common.WriteArgs{}, reply)
+	if reply.Err != "" || reply.GlobalSeqNo != 4 {
+		t.Fatalf("Write after failover was sequenced at %d: %v", reply.GlobalSeqNo, reply.Err)
+	}
+
+	back.mu.Lock()
+	defer back.mu.Unlock()
+	for i, seqNo := range back.seqNos {
+		if seqNo != uint64(i+1) {
+			t.Fatalf("Replica applied writes %v", back.seqNos)
+		}
+	}
+	if len(back.seqNos) != 4 {
+		t.Fatalf("Replica applied writes %v", back.seqNos)
+	}
+}
+
+func TestRaftServiceAuth(t *testing.T) {
+	td := common.NewTrustDomainConfig("td", "", true, false)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		TrustDomain:   td,
+	}
+	fe := NewFrontend("testing", serverConfig, nil)
+	defer fe.Close()
+	s := NewRaftService(fe)
+
+	calls := &common.RaftCalls{To: 0}
+	args := &common.RequestVoteArgs{Term: 1, Candidate: 1}
+	calls.Sign(td, args)
+	if err := s.RequestVote(args, &common.RequestVoteReply{}); err != errNotReplicated {
+		t.Fatalf("Vote requested of a lone frontend answered with %v.", err)
+	}
+	fe.replicate(0, []common.RaftPeer{nil, nil, nil}, "", time.Hour)
+
+	reply := &common.RequestVoteReply{}
+	if err := s.RequestVote(args, reply); err != nil || !reply.Granted {
+		t.Fatalf("Signed vote was not granted: %+v, %v", reply, err)
+	}
+	if err := s.RequestVote(&common.RequestVoteArgs{Term: 2, Candidate: 2}, reply); err != common.ErrUnauthenticated {
+		t.Fatalf("Unsigned vote should be refused, got %v", err)
+	}
+	other := &common.AppendEntriesArgs{Term: 2, Leader: 2}
+	common.NewTrustDomainConfig("other", "", true, false).SignRaft(other)
+	if err := s.AppendEntries(other, &common.AppendEntriesReply{}); err != common.ErrUnauthenticated {
+		t.Fatalf("Entries signed by another trust domain should be refused, got %v", err)
+	}
+	args.Term = 3
+	if err := s.RequestVote(args, reply); err != common.ErrUnauthenticated {
+		t.Fatalf("Altered vote should be refused, got %v", err)
+	}
+
+	// Signed calls are refused again, or by members they weren't sent to.
+	args.Term = 1
+	td.SignRaft(args)
+	if err := s.RequestVote(args, reply); err != errRaftReplay {
+		t.Fatalf("Replayed vote should be refused, got %v", err)
+	}
+	elsewhere := &common.AppendEntriesArgs{Term: 1, Leader: 1}
+	(&common.RaftCalls{To: 2}).Sign(td, elsewhere)
+	if err := s.AppendEntries(elsewhere, &common.AppendEntriesReply{}); err != errRaftReplay {
+		t.Fatalf("Entries sent to another member should be refused, got %v", err)
+	}
+	stale := &common.AppendEntriesArgs{Term: 1, Leader: 1, Call: common.RaftCall{To: 0, Sent: time.Now().Add(-2 * common.RaftCallWindow)}}
+	td.SignRaft(stale)
+	if err := s.AppendEntries(stale, &common.AppendEntriesReply{}); err != errRaftReplay {
+		t.Fatalf("Entries sent long ago should be refused, got %v", err)
+	}
+	next := &common.AppendEntriesArgs{Term: 1, Leader: 1}
+	calls.Sign(td, next)
+	if err := s.AppendEntries(next, &common.AppendEntriesReply{}); err != nil {
+		t.Fatalf("Entries sent after the vote were refused: %v", err)
+	}
+}
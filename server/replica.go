@@ -1,9 +1,13 @@
 package server
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/drbg"
@@ -15,15 +19,55 @@ import (
 type Replica struct {
 	/** Private State **/
 	// Static
-	log    *common.Logger
-	name   string
-	status chan int
+	log     *common.Logger
+	name    string
+	backing string
+	status  chan int
+	started time.Time
 
 	// Thread-safe
 	config         atomic.Value //Config
-	shard          *Shard
-	committedSeqNo uint64 // Use atomic.AddUint64, atomic.LoadUint64
+	shards         *shardSet    // Of the generation in use
+	committedSeqNo uint64       // Use atomic.AddUint64, atomic.LoadUint64
 	interestVector *bloom.Filter
+	entropy        *drbg.EntropyPool
+
+	// Leaves of the writes applied in the current epoch, and the root signed
+	// for the last epoch.
+	epochLock     sync.Mutex
+	epochLeaves   [][32]byte
+	epochs        uint64 // Epochs committed
+	lastCommitted common.SignedRoot
+	// Epochs the database read from is sealed after, once the write thread of
+	// the shard has applied them. Use atomic.
+	sealed uint64
+
+	// Serializes applying writes with taking snapshots.
+	applyLock sync.Mutex
+	joining   int32 // Use atomic
+
+	// The configurations of the generations writes and reads are accepted
+	// under, and the shards of the previous one while a transition crosses
+	// over. The shards are changed with applyLock held too.
+	generationLock sync.Mutex
+	generations    *generations
+	previous       *shardSet
+	previousConfig Config
+
+	// The latest snapshot of the replica, served to joining replicas.
+	snapshotLock sync.Mutex
+	snapshot     *replicaSnapshot
+	snapshots    uint64
+
+	// Copies of this replica the writes it applies are streamed to.
+	standbyLock sync.Mutex
+	standbys    []*standby
+
+	// Archive of the replica's state in object storage, or nil.
+	archiver *archiver
+
+	// Webhooks notified of problems, or nil.
+	alerts *alerter
 
 	// Channels
 	ReadBatch []*common.ReadRequest
@@ -32,11 +76,17 @@ type Replica struct {
 	closeChan chan int
 }
 
+// entropyInterval is how often OS entropy is mixed into the pad seeds of a
+// replica.
+const entropyInterval = time.Second
+
 // NewReplica creates a new Replica server.
 func NewReplica(name string, backing string, config Config) *Replica {
 	r := &Replica{}
 	r.log = common.NewLogger(name)
 	r.name = name
+	r.backing = backing
+	r.started = time.Now()
 
 	bfSize := math.Ceil(math.Log2(float64(config.NumBuckets)))
 	rand := rand.New(rand.NewSource(config.InterestSeed))
@@ -47,17 +97,77 @@ func NewReplica(name string, backing string, config Config) *Replica {
 	}
 	r.interestVector = iv
 
+	// Pad seeds come from an accumulator of entropy, so that a compromise of
+	// the RNG doesn't persist for the lifetime of the replica.
+	r.entropy, err = drbg.NewEntropyPool(entropyInterval)
+	if err != nil {
+		r.log.Error.Printf("Failed to initialize entropy pool: %v", err)
+		return nil
+	}
+
 	r.config.Store(config)
+	r.generations = newGenerations(config.Config)
 
-	r.shard = NewShard(name, backing, config)
+	r.shards = newShardSet(name, backing, config)
+
+	if config.Alerts != nil {
+		r.alerts = newAlerter(name, *config.Alerts)
+		if config.Alerts.SelfTestInterval > 0 {
+			go r.selfTest(config.Alerts.SelfTestInterval)
+		}
+	}
 
 	return r
 }
 
 // Close shuts down active reading and writing threads of the server.
 func (r *Replica) Close() {
-	// Stop the shard.
-	r.shard.Close()
+	// Stop the shards.
+	r.generationLock.Lock()
+	r.shards.close()
+	r.previous.close()
+	r.generationLock.Unlock()
+	r.entropy.Close()
+
+	r.standbyLock.Lock()
+	for _, s := range r.standbys {
+		s.close()
+		if rpc, ok := s.target.(*common.ReplicaRPC); ok {
+			rpc.Close()
+		}
+	}
+	r.standbys = nil
+	r.standbyLock.Unlock()
+
+	if r.archiver != nil {
+		r.archiver.close()
+	}
+	r.alerts.close()
+}
+
+// AddStandby streams writes applied from now on to a standby copy of the
+// replica in the same trust domain.
+func (r *Replica) AddStandby(name string, target common.ReplicaInterface) {
+	r.standbyLock.Lock()
+	r.standbys = append(r.standbys, newStandby(name, target, r.alerts))
+	r.standbyLock.Unlock()
+}
+
+// Standbys reports on the standby copies of the replica.
+func (r *Replica) Standbys() []common.StandbyStatus {
+	r.standbyLock.Lock()
+	defer r.standbyLock.Unlock()
+	status := make([]common.StandbyStatus, len(r.standbys))
+	for i, s := range r.standbys {
+		status[i] = s.status()
+	}
+	return status
+}
+
+// frontend is the trust domain whose frontend's signatures the replica
+// requires of writes and reads, or nil to accept them unsigned.
+func (r *Replica) frontend() *common.TrustDomainConfig {
+	return r.config.Load().(Config).Frontend
 }
 
 /** PUBLIC METHODS (threadsafe) **/
@@ -65,9 +175,14 @@ func (r *Replica) Close() {
 // process only in order - in case conn between leader and replica needs restart.
 func (r *Replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
 	r.log.Trace.Println("Write: enter")
+	r.entropy.AddTiming(drbg.SourceNetwork, time.Now())
 	tr := trace.New("replica.write", "Write")
 	defer tr.Finish()
 
+	if td := r.frontend(); td != nil && !td.VerifyWrite(args) {
+		return common.ErrUnauthenticated
+	}
+
 	// update new global interest vector.
 	if args.InterestFlag {
 		reply.InterestVec = r.interestVector.Delta()
@@ -76,12 +191,286 @@ func (r *Replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWrit
 		return nil
 	}
 
-	r.shard.Write(args)
+	// A joining replica has writes resent once it has the state they follow.
+	if atomic.LoadInt32(&r.joining) != 0 {
+		return errJoining
+	}
+	r.apply(args, reply)
+	return nil
+}
+
+// apply applies a write, or commits an epoch.
+func (r *Replica) apply(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	if args.EpochFlag {
+		if r.commitEpoch(args, reply) {
+			r.shards.seal(args)
+			r.previous.seal(args)
+			r.beginEpoch(args)
+			atomic.StoreUint64(&r.sealed, args.Epoch+1)
+			r.streamToStandbys(args)
+			r.archive(args)
+		}
+		r.log.Trace.Println("Write-Epoch exit")
+		return
+	}
+
+	// A new frontend leader replays writes its predecessor may have forwarded.
+	if args.Replay && args.GlobalSeqNo <= atomic.LoadUint64(&r.committedSeqNo) {
+		reply.GlobalSeqNo = args.GlobalSeqNo
+		r.log.Trace.Println("Write-Replay exit")
+		return
+	}
+
+	// Frontends validate writes before sequencing them, so a replica refusing
+	// one here shows as its epoch root disagreeing with the frontend's.
+	shards, config, err := r.generationShards(args.Generation)
+	if err == nil {
+		config.Config, err = config.Class(args.Class)
+	}
+	if err == nil {
+		err = args.WriteArgs.Validate(config.Config)
+	}
+	if err != nil {
+		reply.Err = err.Error()
+		return
+	}
+	r.epochLock.Lock()
+	r.epochLeaves = append(r.epochLeaves, common.WriteLeaf(&args.WriteArgs))
+	r.epochLock.Unlock()
+	if err := shards.write(args, config.Config); err != nil {
+		reply.Err = err.Error()
+	}
 	r.interestVector.TestAndSet(args.InterestVector)
+	r.streamToStandbys(args)
 
 	atomic.StoreUint64(&r.committedSeqNo, args.GlobalSeqNo)
+	r.archive(args)
 	reply.GlobalSeqNo = args.GlobalSeqNo
 	r.log.Trace.Println("Write: exit")
+}
+
+// beginEpoch stages the transition the frontend sent with the end of an epoch,
+// and moves to the generations of the epoch beginning. A transition's first
+// epoch begins with empty shards for its generation, and the shards of the
+// previous one are kept for reads and writes of it until the crossover ends.
+// Called with applyLock held.
+func (r *Replica) beginEpoch(args *common.ReplicaWriteArgs) {
+	if args.Transition != nil {
+		if err := r.generations.stage(args.Transition); err != nil {
+			r.log.Warn.Printf("Transition to %v not staged: %v\n", args.Transition, err)
+		}
+	}
+	if !r.generations.begin(args.Epoch + 1) {
+		r.generationLock.Lock()
+		if r.previous != nil {
+			if _, _, t := r.generations.current(); t == nil {
+				r.previous.close()
+				r.previous = nil
+				r.log.Info.Printf("Crossover ended with epoch %d.\n", args.Epoch)
+			}
+		}
+		r.generationLock.Unlock()
+		return
+	}
+
+	generation, next, t := r.generations.current()
+	config := r.config.Load().(Config)
+	nextConfig := config
+	nextConfig.Config = next
+	shards := newShardSet(r.name, r.backing, nextConfig)
+
+	r.generationLock.Lock()
+	r.previous.close()
+	r.previous, r.previousConfig = r.shards, config
+	r.shards = shards
+	r.config.Store(nextConfig)
+	if t == nil {
+		// The transition had no crossover.
+		r.previous.close()
+		r.previous = nil
+	}
+	r.generationLock.Unlock()
+	r.log.Info.Printf("Configuration generation %d in use from epoch %d.\n", generation, args.Epoch+1)
+}
+
+// currentShard returns the shard of the cold tier of class 0 of the generation
+// in use.
+func (r *Replica) currentShard() *Shard {
+	r.generationLock.Lock()
+	defer r.generationLock.Unlock()
+	return r.shards.classes[0]
+}
+
+// generationShards returns the shards and configuration of a generation writes
+// and reads are accepted under, or common.ErrGeneration.
+func (r *Replica) generationShards(generation uint64) (*shardSet, Config, error) {
+	r.generationLock.Lock()
+	defer r.generationLock.Unlock()
+	config := r.config.Load().(Config)
+	if current, _, _ := r.generations.current(); generation == current {
+		return r.shards, config, nil
+	} else if r.previous != nil && generation+1 == current {
+		return r.previous, r.previousConfig, nil
+	}
+	return nil, config, common.ErrGeneration
+}
+
+// maxBatchFrame bounds the frames of batches of reads of the generations
+// accepted.
+func (r *Replica) maxBatchFrame() uint64 {
+	r.generationLock.Lock()
+	defer r.generationLock.Unlock()
+	config := r.config.Load().(Config)
+	limit := common.MaxBatchFrame(config.Config, config.ReadBatch)
+	if r.previous != nil {
+		if previous := common.MaxBatchFrame(r.previousConfig.Config, r.previousConfig.ReadBatch); previous > limit {
+			limit = previous
+		}
+	}
+	return limit
+}
+
+// readShard returns the shard a batch of reads is made of, with the
+// configuration of its size class and tier, or common.ErrGeneration,
+// common.ErrClass or common.ErrTier.
+func (r *Replica) readShard(args *common.BatchReadRequest) (*Shard, Config, error) {
+	shards, config, err := r.generationShards(args.Generation)
+	if err == nil {
+		config.Config, err = config.Class(args.Class)
+	}
+	if err == nil {
+		config.Config, err = config.Tier(args.Tier)
+	}
+	if err != nil {
+		return nil, config, err
+	}
+	if args.Tier == common.TierHot {
+		return shards.hot, config, nil
+	}
+	return shards.classes[args.Class], config, nil
+}
+
+func (r *Replica) streamToStandbys(args *common.ReplicaWriteArgs) {
+	r.standbyLock.Lock()
+	for _, s := range r.standbys {
+		s.send(args)
+	}
+	r.standbyLock.Unlock()
+}
+
+// commitEpoch signs the root of the writes applied in the epoch ending, so the
+// frontend can publish it. A root differing from the one the frontend computed
+// is reported, but signed all the same, as evidence of the disagreement.
+// Returns false for a replayed epoch which was already committed.
+func (r *Replica) commitEpoch(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) bool {
+	config := r.config.Load().(Config)
+
+	r.epochLock.Lock()
+	defer r.epochLock.Unlock()
+	if args.Replay && args.Epoch < r.epochs {
+		if args.Epoch+1 == r.epochs {
+			reply.Committed = r.lastCommitted
+		} else {
+			reply.Err = fmt.Sprintf("epoch %d already committed", args.Epoch)
+		}
+		return false
+	}
+	leaves := r.epochLeaves
+	r.epochLeaves = nil
+
+	root := common.MerkleRoot(leaves)
+	if root != args.EpochRoot {
+		reply.Err = fmt.Sprintf("applied %d writes in epoch %d with a different root", len(leaves), args.Epoch)
+		r.log.Warn.Printf("Epoch %d: %s\n", args.Epoch, reply.Err)
+	}
+	if config.TrustDomain != nil {
+		reply.Committed = config.TrustDomain.SignRoot(args.Epoch, root, uint64(len(leaves)))
+	}
+	r.epochs = args.Epoch + 1
+	r.lastCommitted = reply.Committed
+	return true
+}
+
+// GetChecksums returns keyed checksums of ranges of the database, so replicas
+// of a trust domain can be compared without revealing their contents.
+func (r *Replica) GetChecksums(args *common.ChecksumArgs, reply *common.ChecksumReply) error {
+	*reply = *r.currentShard().Checksums(args)
+	return nil
+}
+
+// ReadStats reports on the read pipeline of the replica's shard.
+func (r *Replica) ReadStats() common.ReadQueueStats {
+	return r.currentShard().ReadStats()
+}
+
+// GetStats reports on the table and read pipeline of the replica's shard.
+func (r *Replica) GetStats(args *interface{}, reply *common.ShardStats) error {
+	*reply = *r.currentShard().Stats()
+	return nil
+}
+
+// GetStatus reports the version the replica runs, how far it has applied
+// writes, and the state of its standbys and PIR backend.
+func (r *Replica) GetStatus(args *interface{}, reply *common.ReplicaStatus) error {
+	reply.Name = r.name
+	reply.Version = common.Version
+	reply.GoVersion = runtime.Version()
+	reply.Started = r.started
+	r.epochLock.Lock()
+	reply.Epochs = r.epochs
+	r.epochLock.Unlock()
+	reply.CommittedSeqNo = atomic.LoadUint64(&r.committedSeqNo)
+	reply.Generation, _, _ = r.generations.current()
+	reply.Joining = atomic.LoadInt32(&r.joining) != 0
+	reply.Standbys = r.Standbys()
+	reply.PIR = r.currentShard().Stats().PIR
+	return nil
+}
+
+// GetLaunchParams reports the kernel launch parameters of the replica's PIR
+// backend.
+func (r *Replica) GetLaunchParams(args *interface{}, reply *common.LaunchReply) error {
+	params, err := r.currentShard().GetLaunchParams()
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	reply.Params = params
+	return nil
+}
+
+// SetLaunchParams adjusts the kernel launch parameters of the replica's PIR
+// backend, taking effect from the next read batch.
+func (r *Replica) SetLaunchParams(args *common.LaunchArgs, reply *common.LaunchReply) error {
+	params, err := r.currentShard().SetLaunchParams(args.Params)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	r.log.Info.Printf("Launch parameters set to %+v\n", params)
+	reply.Params = params
+	return nil
+}
+
+// SetLogLevel changes the level of the loggers of a component of the replica
+// process at runtime, and reports the level of each.
+func (r *Replica) SetLogLevel(args *common.LogLevelArgs, reply *common.LogReply) error {
+	common.ServeLogLevel(args, reply)
+	if args.Level != "" && reply.Err == "" {
+		r.log.Info.Printf("Log level of %q set to %s\n", args.Component, args.Level)
+	}
+	return nil
+}
+
+// RotateLogs rotates the log file of the replica process now.
+func (r *Replica) RotateLogs(args *interface{}, reply *common.LogReply) error {
+	if err := common.RotateLogs(); err != nil {
+		reply.Err = err.Error()
+	}
+	reply.Levels = common.LogLevels()
 	return nil
 }
 
@@ -89,38 +478,79 @@ func (r *Replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWrit
 // BatchRead is replicated to followers with a batching determined by the leader.
 func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
 	r.log.Trace.Println("BatchRead: enter")
+	r.entropy.AddTiming(drbg.SourceRequest, time.Now())
 	tr := trace.New("replica.batchread", "BatchRead")
 	defer tr.Finish()
-	// Start local computation
-	config := r.config.Load().(Config)
+	if td := r.frontend(); td != nil && !td.VerifyBatch(args) {
+		return common.ErrUnauthenticated
+	}
+	if common.Expired(args.Deadline) {
+		reply.Err = common.ErrDeadlineExceeded.Error()
+		return nil
+	}
+	// Reads are answered only from the epoch every replica sealed for them.
+	if sealed := atomic.LoadUint64(&r.sealed); sealed != args.Epoch {
+		r.log.Info.Printf("Batch of epoch %d refused with %d epochs sealed.\n", args.Epoch, sealed)
+		reply.Err = common.ErrNotSealed.Error()
+		return nil
+	}
+	// Start local computation, on the shard of the generation, size class and
+	// tier of the batch
+	shard, config, err := r.readShard(args)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
 
 	localArgs := new(DecodedBatchReadRequest)
 	localArgs.ReplyChan = make(chan *common.BatchReadReply)
+	localArgs.Deadline = args.Deadline
+	if err := args.Validate(config.Config, config.ReadBatch, config.TrustDomainIndex); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
 	localArgs.Args = make([]common.PirArgs, config.ReadBatch)
+	// Reads which fail to decode are made as pad requests, and answered with
+	// their error, rather than failing the batch of other clients' reads.
+	failed := make([]error, len(args.Args))
 	for i, val := range args.Args {
-		//Handle pad requests.
-		if len(val.PirArgs) == 0 {
-			localArgs.Args[i].PadSeed = make([]byte, drbg.SeedLength)
-			localArgs.Args[i].RequestVector = make([]byte, config.NumBuckets/8)
-			continue
+		var pir common.PirArgs
+		var err error
+		if len(val.PirArgs) > 0 {
+			if pir, err = val.Decode(config.TrustDomainIndex, config.TrustDomain); err == nil {
+				err = pir.Validate(config.Config)
+			}
 		}
-		pir, err := val.Decode(config.TrustDomainIndex, config.TrustDomain)
-		if err != nil {
-			reply.Err = err.Error()
-			r.log.Error.Fatalf("Failed to decode part of batch read %v [at index %d]", err, i)
-			return err
+		//Handle pad requests.
+		if len(val.PirArgs) == 0 || err != nil {
+			failed[i] = err
+			pir.PadSeed = r.padSeed()
+			pir.RequestVector = make([]byte, common.RequestVectorLength(config.Config))
 		}
 		localArgs.Args[i] = pir
 	}
-	r.shard.BatchRead(localArgs)
+	for i := len(args.Args); i < config.ReadBatch; i++ {
+		localArgs.Args[i].PadSeed = r.padSeed()
+		localArgs.Args[i].RequestVector = make([]byte, common.RequestVectorLength(config.Config))
+	}
+	shard.BatchRead(localArgs)
 
 	// wait for results
 	myReply := <-localArgs.ReplyChan
+	if myReply.Err != "" {
+		reply.Err = myReply.Err
+		return nil
+	}
 
 	// Mutate results
+	pad, err := common.NewPad(config.PadAlgorithm)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
 	for i, val := range localArgs.Args {
 		if myReply.Replies[i].Err == "" {
-			if err := drbg.Overlay(val.PadSeed, myReply.Replies[i].Data); err != nil {
+			if err := common.PadReply(pad, val.PadSeed, myReply.Replies[i].Data, myReply.Replies[i].Proof); err != nil {
 				myReply.Replies[i].Err = err.Error()
 			}
 		}
@@ -131,6 +561,19 @@ func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchRe
 		return nil
 	}
 	reply.Replies = myReply.Replies[0:len(args.Args)]
+	reply.Buckets = myReply.Buckets
+	for i, err := range failed {
+		if err != nil {
+			reply.Replies[i] = common.ReadReply{Err: err.Error()}
+		}
+	}
 	r.log.Trace.Println("BatchRead: exit")
 	return nil
 }
+
+// padSeed draws the seed of a pad request from the replica's entropy pool.
+func (r *Replica) padSeed() []byte {
+	seed := make([]byte, drbg.SeedLength)
+	r.entropy.Read(seed)
+	return seed
+}
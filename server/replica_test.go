@@ -2,9 +2,11 @@ package server
 
 import (
 	"crypto/rand"
+	"strings"
 	"testing"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
 	"github.com/privacylab/talek/libtalek"
 )
 
@@ -35,7 +37,7 @@ func BenchmarkWrite(b *testing.B) {
 	}
 
 	var reply common.ReplicaWriteReply
-	t0 := NewReplica("t0", "cpu.0", Config{&config, 1, 0, 0, nil, 0})
+	t0 := NewReplica("t0", "cpu.0", Config{Config: &config, ReadBatch: 1})
 
 	// Start timing
 	b.ResetTimer()
@@ -44,3 +46,199 @@ func BenchmarkWrite(b *testing.B) {
 	}
 
 }
+
+func TestReplicaBatchReadValidation(t *testing.T) {
+	conf := testConf()
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+
+	encode := func(vector int) common.EncodedReadArgs {
+		read := &common.ReadArgs{TD: []common.PirArgs{{
+			RequestVector: make([]byte, vector),
+			PadSeed:       make([]byte, drbg.SeedLength),
+		}}}
+		encoded, err := read.Encode([]*common.TrustDomainConfig{conf.TrustDomain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	args := &common.BatchReadRequest{Args: []common.EncodedReadArgs{
+		encode(common.RequestVectorLength(conf.Config)),
+		encode(1),
+		{PirArgs: [][]byte{make([]byte, 64)}},
+	}}
+
+	// Malformed reads are answered with their error, without failing the
+	// rest of the batch.
+	reply := &common.BatchReadReply{}
+	if err := r.BatchRead(args, reply); err != nil || reply.Err != "" || len(reply.Replies) != 3 {
+		t.Fatalf("Batch should be read: %v %q", err, reply.Err)
+	}
+	if reply.Replies[0].Err != "" || len(reply.Replies[0].Data) == 0 {
+		t.Fatalf("Valid read failed: %q", reply.Replies[0].Err)
+	}
+	if !strings.HasPrefix(reply.Replies[1].Err, "invalid request vector") {
+		t.Fatalf("Read of a short request vector should be refused, got %q", reply.Replies[1].Err)
+	}
+	if reply.Replies[2].Err == "" {
+		t.Fatal("Read which fails to decrypt should be refused.")
+	}
+
+	// Batches are bounded.
+	reply = &common.BatchReadReply{}
+	r.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, conf.ReadBatch+1)}, reply)
+	if !strings.HasPrefix(reply.Err, "invalid batch") {
+		t.Fatalf("Oversized batch should be refused, got %q", reply.Err)
+	}
+}
+
+func TestReplicaAuthenticatesFrontend(t *testing.T) {
+	conf := testConf()
+	frontend := common.NewTrustDomainConfig("frontend", "", true, false)
+	conf.Frontend = &common.TrustDomainConfig{SignPublicKey: frontend.SignPublicKey}
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+
+	write := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+		Bucket1:        1,
+		Bucket2:        2,
+		Data:           make([]byte, conf.DataSize),
+		InterestVector: make([]byte, 32),
+		GlobalSeqNo:    1,
+	}}
+	reply := &common.ReplicaWriteReply{}
+	if err := r.Write(write, reply); err != common.ErrUnauthenticated {
+		t.Fatalf("Unsigned write should be refused, got %v", err)
+	}
+	common.NewTrustDomainConfig("other", "", true, false).SignWrite(write)
+	if err := r.Write(write, reply); err != common.ErrUnauthenticated {
+		t.Fatalf("Write signed by another trust domain should be refused, got %v", err)
+	}
+	frontend.SignWrite(write)
+	if err := r.Write(write, reply); err != nil || reply.Err != "" || reply.GlobalSeqNo != 1 {
+		t.Fatalf("Write of the frontend should be applied: %v %q", err, reply.Err)
+	}
+
+	batch := &common.BatchReadRequest{}
+	if err := r.BatchRead(batch, &common.BatchReadReply{}); err != common.ErrUnauthenticated {
+		t.Fatalf("Unsigned batch should be refused, got %v", err)
+	}
+	frontend.SignBatch(batch)
+	if err := r.BatchRead(batch, &common.BatchReadReply{}); err != nil {
+		t.Fatalf("Batch of the frontend should be read: %v", err)
+	}
+}
+
+func TestReplicaEpochBarrier(t *testing.T) {
+	conf := testConf()
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+
+	read := func(epoch uint64) string {
+		reply := &common.BatchReadReply{}
+		r.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 1), Epoch: epoch}, reply)
+		return reply.Err
+	}
+	if err := read(1); err != common.ErrNotSealed.Error() {
+		t.Fatalf("Batch of an epoch not sealed should be refused, got %q", err)
+	}
+	if err := read(0); err != "" {
+		t.Fatalf("Batch of the first epoch failed: %q", err)
+	}
+
+	reply := &common.ReplicaWriteReply{}
+	r.Write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 0, EpochRoot: common.MerkleRoot(nil)}, reply)
+	if err := read(0); err != common.ErrNotSealed.Error() {
+		t.Fatalf("Batch of an epoch sealed over should be refused, got %q", err)
+	}
+	if err := read(1); err != "" {
+		t.Fatalf("Batch of the epoch sealed failed: %q", err)
+	}
+}
+
+func TestReplicaSizeClasses(t *testing.T) {
+	conf := testConf()
+	conf.Classes[0] = common.SizeClass{NumBuckets: 16, BucketDepth: 2, DataSize: 2048}
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+	if len(r.shards.classes) != 2 || r.shards.hot != nil {
+		t.Fatalf("Replica of 2 size classes has %d shards.", len(r.shards.all()))
+	}
+
+	write := func(args *common.ReplicaWriteArgs) string {
+		reply := &common.ReplicaWriteReply{}
+		r.Write(args, reply)
+		return reply.Err
+	}
+	large := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 3, Bucket2: 15, Data: make([]byte, 2048), Class: 1, GlobalSeqNo: 1}}
+	if err := write(large); err != "" {
+		t.Fatalf("Write of size class 1 failed: %q", err)
+	}
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 16, Class: 1, GlobalSeqNo: 2}}); !strings.HasPrefix(err, "invalid buckets") {
+		t.Fatalf("Write past the buckets of its class should be refused, got %q", err)
+	}
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Class: 2, GlobalSeqNo: 3}}); err != common.ErrClass.Error() {
+		t.Fatalf("Write of a class not configured should be refused, got %q", err)
+	}
+	root := common.MerkleRoot([][32]byte{common.WriteLeaf(&large.WriteArgs)})
+	if err := write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 0, EpochRoot: root}); err != "" {
+		t.Fatalf("Epoch was not committed: %q", err)
+	}
+
+	read := func(class uint8) *common.BatchReadReply {
+		reply := &common.BatchReadReply{}
+		r.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 1), Epoch: 1, Class: class}, reply)
+		return reply
+	}
+	if reply := read(1); reply.Err != "" || len(reply.Replies) != 1 || len(reply.Replies[0].Data) != 2*2048 {
+		t.Fatalf("Batch of size class 1 was not read from its buckets: %q", reply.Err)
+	}
+	if reply := read(0); reply.Err != "" || len(reply.Replies[0].Data) != int(conf.BucketDepth*conf.DataSize) {
+		t.Fatalf("Batch of size class 0 was not read from its buckets: %q", reply.Err)
+	}
+	if reply := read(2); reply.Err != common.ErrClass.Error() {
+		t.Fatalf("Batch of a class not configured should be refused, got %q", reply.Err)
+	}
+}
+
+func TestReplicaTiers(t *testing.T) {
+	conf := testConf()
+	conf.HotBuckets, conf.HotEpochs = 8, 2
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+	if r.shards.hot == nil {
+		t.Fatal("Replica with tiers has no hot tier.")
+	}
+
+	write := func(args *common.ReplicaWriteArgs) string {
+		reply := &common.ReplicaWriteReply{}
+		r.Write(args, reply)
+		return reply.Err
+	}
+	item := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 13, Bucket2: 300, Data: make([]byte, conf.DataSize), GlobalSeqNo: 1}}
+	if err := write(item); err != "" {
+		t.Fatalf("Write failed: %q", err)
+	}
+	root := common.MerkleRoot([][32]byte{common.WriteLeaf(&item.WriteArgs)})
+	write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 0, EpochRoot: root})
+	if hot := r.shards.hot.Stats(); hot.Items != 1 {
+		t.Fatalf("Hot tier holds %d items written in the last epoch.", hot.Items)
+	}
+
+	reply := &common.BatchReadReply{}
+	r.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 1), Epoch: 1, Tier: common.TierHot}, reply)
+	if reply.Err != "" || len(reply.Replies) != 1 || len(reply.Replies[0].Data) != int(conf.BucketDepth*conf.DataSize) {
+		t.Fatalf("Batch of the hot tier was not read: %q", reply.Err)
+	}
+
+	// Items leave the hot tier after HotEpochs, but stay in the cold one.
+	write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 1, EpochRoot: common.MerkleRoot(nil)})
+	if hot := r.shards.hot.Stats(); hot.Items != 0 || hot.Expired != 1 {
+		t.Fatalf("Hot tier holds %d items past their epochs, having freed %d.", hot.Items, hot.Expired)
+	}
+	if cold := r.currentShard().Stats(); cold.Items != 1 {
+		t.Fatalf("Cold tier holds %d items.", cold.Items)
+	}
+}
@@ -1,13 +1,13 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"net"
-	"net/http"
-	"os"
 
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
+	"github.com/privacylab/talek/common"
 )
 
 // ReplicaServer is an RPC server for a Replica
@@ -22,10 +22,45 @@ type ReplicaServer struct {
 // NewReplicaServer creates a new Replica served over HTTP
 func NewReplicaServer(name string, backing string, serverConfig Config) *ReplicaServer {
 	r := &ReplicaServer{}
-	r.log = log.New(os.Stdout, "[ReplicaServer:"+name+"] ", log.Ldate|log.Ltime|log.Lshortfile)
+	r.log = common.NewLogger("ReplicaServer:" + name).Info
 	r.name = name
 
 	r.Replica = NewReplica(name, backing, serverConfig)
+	for i, addr := range serverConfig.Standbys {
+		standby := *serverConfig.TrustDomain
+		standby.Address = addr
+		standbyName := fmt.Sprintf("%s-standby%d", name, i)
+		r.Replica.AddStandby(standbyName, common.NewReplicaRPC(standbyName, &standby))
+	}
+	if serverConfig.JoinFrom != "" || serverConfig.Archive != nil {
+		go func() {
+			// A replica joining the trust domain is given its state, rather
+			// than recovering it.
+			if serverConfig.JoinFrom != "" {
+				source := *serverConfig.TrustDomain
+				source.Address = serverConfig.JoinFrom
+				rpc := common.NewReplicaRPC(name+"-join", &source)
+				err := r.Replica.JoinFrom(rpc, serverConfig.TrustDomain.Address)
+				rpc.Close()
+				if err != nil {
+					r.log.Fatalf("Could not join the trust domain: %v", err)
+				}
+			}
+			if serverConfig.Archive == nil {
+				return
+			}
+			archive := *serverConfig.Archive
+			store := archive.NewObjectStore()
+			if archive.Recover && serverConfig.JoinFrom == "" {
+				if err := r.Replica.RecoverFrom(store, archive); err != nil {
+					r.log.Fatalf("Could not recover from the archive: %v", err)
+				}
+			}
+			if err := r.Replica.ArchiveTo(store, archive); err != nil {
+				r.log.Fatalf("Could not archive the replica: %v", err)
+			}
+		}()
+	}
 
 	// Set up the RPC server component.
 	r.Server = rpc.NewServer()
@@ -35,7 +70,28 @@ func NewReplicaServer(name string, backing string, serverConfig Config) *Replica
 	return r
 }
 
-// Run begins an HTTP server for the server at a specific address
+// Listen serves the replica on each of a set of listeners.
+func (r *ReplicaServer) Listen(listeners []ListenerConfig) ([]net.Listener, error) {
+	return Listen(r, listeners)
+}
+
+// BatchRead answers reads arriving on batch transport listeners.
+func (r *ReplicaServer) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	return r.Replica.BatchRead(args, reply)
+}
+
+func (r *ReplicaServer) maxBatchFrame() uint64 {
+	return r.Replica.maxBatchFrame()
+}
+
+// maxRPCSize bounds RPCs by the largest a batch of reads is, base64 and the
+// rest of its JSON encoding at most doubling its frame.
+func (r *ReplicaServer) maxRPCSize() int64 {
+	return 2 * int64(r.Replica.maxBatchFrame())
+}
+
+// Run begins an HTTP server for the server at a specific address, accepting
+// connections over IPv4 and IPv6. Administrative methods are not served.
 func (r *ReplicaServer) Run(address string) (net.Listener, error) {
 	if r.Server == nil {
 		r.Server = rpc.NewServer()
@@ -43,15 +99,12 @@ func (r *ReplicaServer) Run(address string) (net.Listener, error) {
 		r.Server.RegisterTCPService(r.Replica, "Replica")
 	}
 
-	bindAddr, err := net.ResolveTCPAddr("tcp4", address)
-	if err != nil {
-		return nil, err
-	}
-	listener, err := net.ListenTCP("tcp4", bindAddr)
+	lc := &ListenerConfig{Address: address}
+	listener, err := lc.listen(r)
 	if err != nil {
 		return nil, err
 	}
-	go http.Serve(listener, r)
+	go serveHTTP(listener, &compressedHandler{lc.expose(r), nil, r.maxRPCSize})
 
 	return listener, nil
 }
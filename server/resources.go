@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/privacylab/talek/common"
+)
+
+// maxCPU bounds the CPU indices a replica can be confined to, those of the
+// affinity mask passed to the kernel.
+const maxCPU = 1024
+
+// ResourceConfig confines a replica to part of the machine it runs on, so
+// that several sharing one don't contend for CPUs, memory and GPUs
+// unpredictably. Each shard applies it as it starts.
+type ResourceConfig struct {
+	// CPUs the threads of the replica run on, by index. Empty to run on any.
+	CPUs []int
+	// Most threads running Go code at once. 0 for one per CPU of CPUs, or the
+	// Go default without CPUs.
+	GOMAXPROCS int
+	// Most bytes of memory the replica may use: the memory limit of Cgroup,
+	// and a bound on the database of each shard, checked as it is allocated.
+	// 0 for no limit.
+	MaxMemory uint64
+	// GPUs shards compute reads on, appended to a backing which selects none:
+	// a comma separated list of [platform]:[device] with OpenCL backings, the
+	// index of the device with CUDA ones. Empty for the backing's default.
+	GPUDevices string
+	// Absolute path of a cgroup v2 directory the replica moves into, whose
+	// cpuset and memory limit are set from CPUs and MaxMemory. Empty to stay
+	// in the cgroup the replica was started in.
+	Cgroup string
+}
+
+// Validate checks a resource configuration.
+func (c *ResourceConfig) Validate() error {
+	seen := make(map[int]bool, len(c.CPUs))
+	for _, cpu := range c.CPUs {
+		if cpu < 0 || cpu >= maxCPU || seen[cpu] {
+			return &common.ValidationError{Field: "resources cpus", Reason: fmt.Sprintf("%d is out of range or listed twice", cpu)}
+		}
+		seen[cpu] = true
+	}
+	if c.GOMAXPROCS < 0 {
+		return &common.ValidationError{Field: "resources gomaxprocs", Reason: fmt.Sprintf("%d is negative", c.GOMAXPROCS)}
+	}
+	if strings.ContainsAny(c.GPUDevices, ". ") {
+		return &common.ValidationError{Field: "resources gpu devices", Reason: fmt.Sprintf("%q is not a list of devices", c.GPUDevices)}
+	}
+	if c.Cgroup != "" && !filepath.IsAbs(c.Cgroup) {
+		return &common.ValidationError{Field: "resources cgroup", Reason: fmt.Sprintf("%q is not an absolute path", c.Cgroup)}
+	}
+	return nil
+}
+
+// apply confines the process to the resources of the configuration. It may
+// be applied again, as each shard of a replica starts.
+func (c *ResourceConfig) apply() error {
+	if c.Cgroup != "" {
+		if err := c.joinCgroup(); err != nil {
+			return err
+		}
+	}
+	if len(c.CPUs) > 0 {
+		if err := setAffinity(c.CPUs); err != nil {
+			return fmt.Errorf("could not set CPU affinity: %v", err)
+		}
+	}
+	if procs := c.procs(); procs > 0 {
+		runtime.GOMAXPROCS(procs)
+	}
+	return nil
+}
+
+// procs is the GOMAXPROCS of the configuration, or 0 to leave it be.
+func (c *ResourceConfig) procs() int {
+	if c.GOMAXPROCS > 0 {
+		return c.GOMAXPROCS
+	}
+	return len(c.CPUs)
+}
+
+// joinCgroup sets the limits of Cgroup, then moves the process into it.
+func (c *ResourceConfig) joinCgroup() error {
+	var settings [][2]string
+	if len(c.CPUs) > 0 {
+		cpus := make([]string, len(c.CPUs))
+		for i, cpu := range c.CPUs {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		settings = append(settings, [2]string{"cpuset.cpus", strings.Join(cpus, ",")})
+	}
+	if c.MaxMemory > 0 {
+		settings = append(settings, [2]string{"memory.max", strconv.FormatUint(c.MaxMemory, 10)})
+	}
+	settings = append(settings, [2]string{"cgroup.procs", strconv.Itoa(os.Getpid())})
+	for _, s := range settings {
+		if err := ioutil.WriteFile(filepath.Join(c.Cgroup, s[0]), []byte(s[1]), 0644); err != nil {
+			return fmt.Errorf("could not set %s of cgroup: %v", s[0], err)
+		}
+	}
+	return nil
+}
+
+// backing returns the PIR backing of a shard, on GPUDevices if set. Backings
+// which select their own devices, or can't select any, are refused.
+func (c *ResourceConfig) backing(backing string) (string, error) {
+	if c.GPUDevices == "" {
+		return backing, nil
+	}
+	// The devices follow the other fields of the backing's specification.
+	fields := map[string]int{"cl": 5, "cuda": 4}
+	parts := strings.Split(backing, ".")
+	n, ok := fields[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("backing %q computes on no GPU", backing)
+	} else if len(parts) != n {
+		return "", fmt.Errorf("backing %q selects its own devices, or is incomplete", backing)
+	}
+	return backing + "." + c.GPUDevices, nil
+}
+
+// fits checks that a database of a size fits within MaxMemory.
+func (c *ResourceConfig) fits(bytes uint64) error {
+	if c.MaxMemory > 0 && bytes > c.MaxMemory {
+		return fmt.Errorf("database of %d bytes exceeds the memory limit of %d", bytes, c.MaxMemory)
+	}
+	return nil
+}
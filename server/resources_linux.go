@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// setAffinity confines every thread of the process to a set of CPUs. Threads
+// started later inherit the affinity of the thread starting them.
+func setAffinity(cpus []int) error {
+	var mask [maxCPU / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+		// Threads may exit while the affinity of others is set.
+		if errno != 0 && errno != syscall.ESRCH {
+			return errno
+		}
+	}
+	return nil
+}
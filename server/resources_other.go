@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+)
+
+// setAffinity is only supported on Linux.
+func setAffinity(cpus []int) error {
+	return errors.New("CPU affinity is only supported on Linux")
+}
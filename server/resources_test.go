@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestResourceConfig(t *testing.T) {
+	for _, c := range []ResourceConfig{
+		{CPUs: []int{-1}},
+		{CPUs: []int{2, 2}},
+		{CPUs: []int{maxCPU}},
+		{GOMAXPROCS: -1},
+		{GPUDevices: "0.1"},
+		{Cgroup: "talek"},
+	} {
+		if c.Validate() == nil {
+			t.Fatalf("Invalid resources %+v were accepted.", c)
+		}
+	}
+	c := ResourceConfig{CPUs: []int{0, 3}, MaxMemory: 1 << 20, GPUDevices: "0:1,1:0"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Valid resources were refused: %v", err)
+	}
+	if c.procs() != 2 {
+		t.Fatalf("Replica on 2 CPUs ran %d threads at once.", c.procs())
+	}
+
+	if backing, err := c.backing("cl.0.8.2048.128"); err != nil || backing != "cl.0.8.2048.128.0:1,1:0" {
+		t.Fatalf("GPUs were not selected: %q, %v.", backing, err)
+	}
+	for _, backing := range []string{"cpu.0", "cl.0.8.2048.128.0:0", "cuda.pir.8.128.1"} {
+		if _, err := c.backing(backing); err == nil {
+			t.Fatalf("GPUs were selected of backing %q.", backing)
+		}
+	}
+	if err := c.fits(1<<20 + 1); err == nil {
+		t.Fatal("Database past the memory limit fit.")
+	}
+}
+
+func TestResourceCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := ResourceConfig{CPUs: []int{1, 2}, MaxMemory: 4096, Cgroup: dir}
+	if err := c.joinCgroup(); err != nil {
+		t.Fatalf("Could not join cgroup: %v", err)
+	}
+	for file, expected := range map[string]string{
+		"cpuset.cpus":  "1,2",
+		"memory.max":   "4096",
+		"cgroup.procs": strconv.Itoa(os.Getpid()),
+	} {
+		if value, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(value) != expected {
+			t.Fatalf("Cgroup %s was set to %q.", file, value)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
 	"fmt"
+	"math"
+	"runtime"
+	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/cuckoo"
 	"github.com/privacylab/talek/pir"
+	"github.com/privacylab/talek/pir/pirinterface"
 )
 
 // Shard represents a single shard of the PIR database.
@@ -25,17 +34,107 @@ type Shard struct {
 	Entries []cuckoo.Item
 	*cuckoo.Table
 
+	// With VerifyBuckets, the commitment to the database reads are answered
+	// from. Kept by the read thread.
+	buckets *bucketCommit
+
+	// Retention of items written with a TTL hint
+	epoch   uint64
+	expires map[uint64]uint64 // Item ID -> epoch at which it is freed
+
 	config atomic.Value // Config
 
 	// Channels
-	writeChan        chan *common.ReplicaWriteArgs
-	readChan         chan *DecodedBatchReadRequest
-	outstandingReads chan chan *common.BatchReadReply
-	readReplies      chan []byte
-	syncChan         chan int
+	writeChan   chan *common.ReplicaWriteArgs
+	readChan    chan *queuedRead
+	readReplies chan *queuedRead
+	writeErrs   chan error // With OverflowReject, the outcome of each write, and epoch seals
+	syncChan    chan int
+	commitChan  chan *bucketCommit
+	statsChan   chan chan *common.ShardStats
+	sumChan     chan *checksumRequest
+	stateChan   chan *stateRequest
+	launchChan  chan *launchRequest
+	devicesChan chan chan []pirinterface.DeviceInfo
+
+	// Read pipeline metrics. Use atomic, except for the latency recorders
+	readsQueued    int64
+	readsCompleted uint64
+	readStalls     uint64
+	readsAbandoned uint64
+	queueLatency   common.LatencyRecorder
+	readLatency    common.LatencyRecorder
+
+	// Table metrics, kept by the write thread.
+	inserts        uint64
+	insertFailures uint64
+	evictions      uint64
+	expired        uint64
+	rejected       uint64
+	rebalanced     uint64
+	lastSeqNo      uint64
+}
+
+// defaultReadQueueDepth is how many read batches a shard queues behind the one
+// being computed, unless configured otherwise.
+const defaultReadQueueDepth = 4
+
+// queuedRead is a read batch with its request vectors assembled, waiting for
+// the PIR backend, and then for its response to be split into replies.
+type queuedRead struct {
+	vector    []byte
+	response  []byte
+	buckets   *bucketCommit
+	replyChan chan *common.BatchReadReply
+	queued    time.Time
+	deadline  time.Time
+}
+
+// bucketCommit is a tree over the buckets of the database and its signed root,
+// handed by the write thread to the read thread along with the database.
+type bucketCommit struct {
+	tree       *common.BucketTree
+	commitment common.BucketCommitment
+	synced     chan struct{}
+}
+
+// checksumRequest asks the write thread for checksums of the database.
+type checksumRequest struct {
+	args  *common.ChecksumArgs
+	reply chan *common.ChecksumReply
+}
+
+// stateRequest asks the write thread for a snapshot of the shard, or with
+// state set, to restore one.
+type stateRequest struct {
+	state []byte
+	reply chan stateResult
+}
+
+// launchRequest asks the read thread for the launch parameters of the PIR
+// backend, or with params set, to change them.
+type launchRequest struct {
+	params *pirinterface.LaunchParams
+	reply  chan launchResult
+}
+
+type launchResult struct {
+	params pirinterface.LaunchParams
+	err    error
+}
+
+type stateResult struct {
+	state []byte
+	err   error
+}
 
-	sinceFlip        int
-	outstandingLimit int
+// shardState is the serialized state of a shard.
+type shardState struct {
+	Epoch     uint64
+	LastSeqNo uint64
+	Entries   []cuckoo.Item
+	Expires   map[uint64]uint64
+	Table     []byte
 }
 
 // DecodedBatchReadRequest represents a set of PIR args from clients.
@@ -44,6 +143,7 @@ type Shard struct {
 type DecodedBatchReadRequest struct {
 	Args      []common.PirArgs
 	ReplyChan chan *common.BatchReadReply
+	Deadline  time.Time // Abandon the batch if not read by then. Zero for none.
 }
 
 // NewShard creates an interface to a PIR daemon at socket, using a given
@@ -55,10 +155,36 @@ func NewShard(name string, backing string, config Config) *Shard {
 
 	s.config.Store(config)
 	s.writeChan = make(chan *common.ReplicaWriteArgs)
-	s.readChan = make(chan *DecodedBatchReadRequest)
+	depth := config.ReadQueueDepth
+	if depth <= 0 {
+		depth = defaultReadQueueDepth
+	}
+	s.readChan = make(chan *queuedRead, depth)
+	s.writeErrs = make(chan error)
 	s.syncChan = make(chan int)
-	s.outstandingReads = make(chan chan *common.BatchReadReply, 5)
-	s.readReplies = make(chan []byte)
+	s.commitChan = make(chan *bucketCommit)
+	s.statsChan = make(chan chan *common.ShardStats)
+	s.sumChan = make(chan *checksumRequest)
+	s.stateChan = make(chan *stateRequest)
+	s.launchChan = make(chan *launchRequest)
+	s.devicesChan = make(chan chan []pirinterface.DeviceInfo)
+	s.readReplies = make(chan *queuedRead, depth)
+
+	if res := config.Resources; res != nil {
+		if err := res.apply(); err != nil {
+			s.log.Error.Fatalf("Could not confine shard to its resources: %v", err)
+			return nil
+		}
+		var err error
+		if backing, err = res.backing(backing); err != nil {
+			s.log.Error.Fatalf("Could not select GPUs: %v", err)
+			return nil
+		}
+		if err := res.fits(config.Config.DataSize * config.Config.BucketDepth * config.Config.NumBuckets); err != nil {
+			s.log.Error.Fatalf("Could not allocate DB region: %v", err)
+			return nil
+		}
+	}
 
 	// TODO: per-server config of where the local PIR socket is.
 	pirServer, err := pir.NewServer(backing)
@@ -67,6 +193,25 @@ func NewShard(name string, backing string, config Config) *Shard {
 		return nil
 	}
 	s.Server = pirServer
+	if _, err := common.NewPlacementHash(config.Config.PlacementHash); err != nil {
+		s.log.Error.Fatalf("Could not place items: %v", err)
+		return nil
+	}
+	strategy, err := common.NewBucketStrategy(config.Config.BucketStrategy)
+	if err != nil {
+		s.log.Error.Fatalf("Could not place items: %v", err)
+		return nil
+	}
+	if _, err := common.NewPad(config.Config.PadAlgorithm); err != nil {
+		s.log.Error.Fatalf("Could not pad replies: %v", err)
+		return nil
+	}
+	switch config.Overflow {
+	case "", OverflowStash, OverflowEvictOldest, OverflowReject:
+	default:
+		s.log.Error.Fatalf("Unknown overflow policy %q", config.Overflow)
+		return nil
+	}
 	err = s.Server.Configure(int(config.Config.DataSize*config.Config.BucketDepth), int(config.Config.NumBuckets), config.ReadBatch)
 	if err != nil {
 		s.log.Error.Fatalf("Could not start PIR back end with correct parameters: %v", err)
@@ -81,13 +226,21 @@ func NewShard(name string, backing string, config Config) *Shard {
 	s.DB = db
 	//Set initial DB
 	s.Server.SetDB(s.DB)
+	if config.GPULaunch != (pirinterface.LaunchParams{}) {
+		if err := s.Server.SetLaunchParams(config.GPULaunch); err != nil {
+			s.log.Error.Fatalf("Could not set PIR launch parameters: %v", err)
+			return nil
+		}
+	}
 
 	// TODO: rand seed
 	s.Table = cuckoo.NewTable(name+"-Table", config.Config.NumBuckets, config.Config.BucketDepth, config.Config.DataSize, db.DB, 0)
+	s.Table.SetStrategy(strategy)
 	s.Entries = make([]cuckoo.Item, 0, config.Config.NumBuckets*config.Config.BucketDepth)
-
-	//TODO: should be a parameter in globalconfig
-	s.outstandingLimit = int(float32(config.Config.NumBuckets*uint64(config.Config.BucketDepth)) * 0.50)
+	s.expires = make(map[uint64]uint64)
+	if config.VerifyBuckets {
+		s.buckets = s.commitBuckets(config)
+	}
 
 	go s.processReads()
 	go s.processReplies()
@@ -97,15 +250,126 @@ func NewShard(name string, backing string, config Config) *Shard {
 
 /** PUBLIC METHODS (threadsafe) **/
 
+// Write applies a write to the database. With OverflowReject, it waits for
+// the write to be placed, returning common.ErrBucketsFull if it was refused.
+// The end of an epoch waits for the database to be sealed: reads queued from
+// then on are answered from it.
 func (s *Shard) Write(args *common.ReplicaWriteArgs) error {
 	s.log.Trace.Println("Write: ")
 	s.writeChan <- args
+	if args.EpochFlag || s.config.Load().(Config).Overflow == OverflowReject {
+		return <-s.writeErrs
+	}
 	return nil
 }
 
 // BatchRead performs a read of a set of client requests against the database.
+// The batch is queued behind those already waiting, blocking only while the
+// queue is full, and answered on its ReplyChan.
 func (s *Shard) BatchRead(args *DecodedBatchReadRequest) {
-	s.readChan <- args
+	conf := s.config.Load().(Config)
+	if len(args.Args) != conf.ReadBatch {
+		s.log.Info.Printf("Read operation failed: incorrect number of reads.")
+		go func() {
+			args.ReplyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Invalid batch size.")}
+		}()
+		return
+	}
+
+	// Assemble the PIR vector while earlier batches are computed.
+	reqlength := int(conf.Config.NumBuckets+7) / 8
+	read := &queuedRead{vector: make([]byte, reqlength*conf.ReadBatch), replyChan: args.ReplyChan, deadline: args.Deadline}
+	for i := 0; i < conf.ReadBatch; i++ {
+		copy(read.vector[reqlength*i:reqlength*(i+1)], args.Args[i].RequestVector)
+	}
+
+	read.queued = time.Now()
+	atomic.AddInt64(&s.readsQueued, 1)
+	select {
+	case s.readChan <- read:
+	default:
+		atomic.AddUint64(&s.readStalls, 1)
+		s.readChan <- read
+	}
+}
+
+// ReadStats reports on the read pipeline of the shard.
+func (s *Shard) ReadStats() common.ReadQueueStats {
+	return common.ReadQueueStats{
+		Queued:       int(atomic.LoadInt64(&s.readsQueued)),
+		Capacity:     cap(s.readChan),
+		Completed:    atomic.LoadUint64(&s.readsCompleted),
+		Stalls:       atomic.LoadUint64(&s.readStalls),
+		Abandoned:    atomic.LoadUint64(&s.readsAbandoned),
+		QueueLatency: s.queueLatency.Snapshot(),
+		ReadLatency:  s.readLatency.Snapshot(),
+	}
+}
+
+// Stats reports on the table and read pipeline of the shard.
+func (s *Shard) Stats() *common.ShardStats {
+	reply := make(chan *common.ShardStats)
+	s.statsChan <- reply
+	stats := <-reply
+	stats.Reads = s.ReadStats()
+	stats.DBBytes = uint64(len(s.DB.DB))
+	devices := make(chan []pirinterface.DeviceInfo)
+	s.devicesChan <- devices
+	stats.PIR = common.PIRStats{
+		Backing:   s.Server.GetBacking(),
+		Available: pirinterface.Backings(),
+		Devices:   <-devices,
+	}
+	if stats.Reads.ReadLatency.Sum > 0 {
+		requests := float64(stats.Reads.Completed) * float64(s.config.Load().(Config).ReadBatch)
+		stats.PIR.Throughput = requests / stats.Reads.ReadLatency.Sum.Seconds()
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapAlloc
+	return stats
+}
+
+// Checksums computes keyed checksums of ranges of buckets of the database, as
+// of the last write applied.
+func (s *Shard) Checksums(args *common.ChecksumArgs) *common.ChecksumReply {
+	req := &checksumRequest{args, make(chan *common.ChecksumReply)}
+	s.sumChan <- req
+	return <-req.reply
+}
+
+// Snapshot serializes the state of the shard, as of the last write applied.
+func (s *Shard) Snapshot() ([]byte, error) {
+	req := &stateRequest{reply: make(chan stateResult)}
+	s.stateChan <- req
+	result := <-req.reply
+	return result.state, result.err
+}
+
+// Restore replaces the state of the shard with a snapshot of a shard of the
+// same configuration.
+func (s *Shard) Restore(state []byte) error {
+	req := &stateRequest{state: state, reply: make(chan stateResult)}
+	s.stateChan <- req
+	return (<-req.reply).err
+}
+
+// GetLaunchParams returns the parameters the PIR backend launches kernels
+// with, or an error if it doesn't launch kernels.
+func (s *Shard) GetLaunchParams() (pirinterface.LaunchParams, error) {
+	req := &launchRequest{reply: make(chan launchResult)}
+	s.launchChan <- req
+	result := <-req.reply
+	return result.params, result.err
+}
+
+// SetLaunchParams changes the parameters the PIR backend launches kernels
+// with, from the next read on.
+func (s *Shard) SetLaunchParams(params pirinterface.LaunchParams) (pirinterface.LaunchParams, error) {
+	req := &launchRequest{params: &params, reply: make(chan launchResult)}
+	s.launchChan <- req
+	result := <-req.reply
+	return result.params, result.err
 }
 
 // Close shuts down the database.
@@ -124,51 +388,69 @@ func (s *Shard) Close() {
 /** PRIVATE METHODS (singlethreaded) **/
 func (s *Shard) processReads() {
 	// The read thread searializs all access to the underlying DB
-	var batchReadReq *DecodedBatchReadRequest
+	var read *queuedRead
 
 	defer s.DB.Free()
 	defer s.Server.Disconnect()
-	conf := s.config.Load().(Config)
 	for {
 		select {
-		case batchReadReq = <-s.readChan:
-			if batchReadReq == nil {
+		case read = <-s.readChan:
+			if read == nil {
 				s.log.Info.Printf("Read loop closed.")
+				close(s.readReplies)
 				s.syncChan <- 0
 				return
 			}
-			s.batchRead(batchReadReq, conf)
+			s.batchRead(read)
 			continue
 		case <-s.syncChan:
 			s.Server.SetDB(s.DB)
+		case commit := <-s.commitChan:
+			s.Server.SetDB(s.DB)
+			s.buckets = commit
+			close(commit.synced)
+		case req := <-s.launchChan:
+			var result launchResult
+			if req.params != nil {
+				result.err = s.Server.SetLaunchParams(*req.params)
+			}
+			if result.err == nil {
+				result.params, result.err = s.Server.GetLaunchParams()
+			}
+			req.reply <- result
+		case reply := <-s.devicesChan:
+			reply <- s.Server.Devices()
 		}
 	}
 }
 
+// processReplies splits PIR responses into replies, while the read thread
+// moves on to the next batch.
 func (s *Shard) processReplies() {
-	var outputChannel chan *common.BatchReadReply
 	conf := s.config.Load().(Config)
 	itemLength := int(conf.DataSize * conf.BucketDepth)
 
-	for {
-		select {
-		case reply := <-s.readReplies:
-			// get the corresponding read request.
-			outputChannel = <-s.outstandingReads
-
-			response := &common.BatchReadReply{Err: "", Replies: make([]common.ReadReply, conf.ReadBatch)}
+	for read := range s.readReplies {
+		reply := read.response
+		response := &common.BatchReadReply{Err: "", Replies: make([]common.ReadReply, conf.ReadBatch)}
 
-			if len(reply) < conf.ReadBatch*itemLength {
-				s.log.Error.Printf("PIR Response was of length %d, not %d * %d\n", len(reply), conf.ReadBatch, itemLength)
-				outputChannel <- response
-				continue
-			}
+		if len(reply) < conf.ReadBatch*itemLength {
+			s.log.Error.Printf("PIR Response was of length %d, not %d * %d\n", len(reply), conf.ReadBatch, itemLength)
+			read.replyChan <- response
+			continue
+		}
+		for i := 0; i < conf.ReadBatch; i++ {
+			response.Replies[i].Data = reply[i*itemLength : (i+1)*itemLength]
+			//TODO: reply.GlobalSeqNo
+		}
+		if read.buckets != nil {
+			response.Buckets = read.buckets.commitment
+			reqLength := len(read.vector) / conf.ReadBatch
 			for i := 0; i < conf.ReadBatch; i++ {
-				response.Replies[i].Data = reply[i*itemLength : (i+1)*itemLength]
-				//TODO: reply.GlobalSeqNo
+				response.Replies[i].Proof = read.buckets.tree.ProofShare(read.vector[i*reqLength : (i+1)*reqLength])
 			}
-			outputChannel <- response
 		}
+		read.replyChan <- response
 	}
 }
 
@@ -181,39 +463,195 @@ func (s *Shard) processWrites() {
 			if writeReq == nil {
 				return
 			} else if writeReq.EpochFlag {
+				s.epoch++
+				s.expireItems()
+				// Epochs end at the same point of the writes on every replica, so
+				// they rebalance alike.
+				if conf.RebalanceMoves > 0 {
+					s.rebalanced += uint64(s.Table.Rebalance(conf.RebalanceMoves))
+				}
 				s.applyWrites()
+				s.writeErrs <- nil
 				continue
 			}
-
-			itm := asCuckooItem(&writeReq.WriteArgs)
-			s.Entries = append(s.Entries, *itm)
-			ok, evicted := s.Table.Insert(itm)
-			// No longer need this pointer.
-			itm.Data = nil
-			if !ok || len(s.Entries) > int(float64(conf.Config.NumBuckets*conf.Config.BucketDepth)*conf.Config.MaxLoadFactor) {
-				s.evictOldItems()
+			err := s.insert(writeReq, conf)
+			if conf.Overflow == OverflowReject {
+				s.writeErrs <- err
 			}
-			if evicted != nil {
-				ok, evicted = s.Table.Insert(evicted)
-				if !ok || evicted != nil {
-					s.log.Error.Fatalf("Consistency violation: lost an in-window DB item.")
-				}
+		case req := <-s.stateChan:
+			if req.state == nil {
+				state, err := s.snapshot()
+				req.reply <- stateResult{state, err}
+			} else {
+				req.reply <- stateResult{nil, s.restore(req.state)}
 			}
-			s.sinceFlip++
+		case req := <-s.sumChan:
+			req.reply <- s.checksums(req.args, conf)
+		case reply := <-s.statsChan:
+			reply <- &common.ShardStats{
+				Items:          s.Table.GetNumElements(),
+				Stashed:        uint64(s.Table.Stashed()),
+				Capacity:       s.Table.GetCapacity(),
+				Occupancy:      s.Table.Occupancy(),
+				Inserts:        s.inserts,
+				InsertFailures: s.insertFailures,
+				Evictions:      s.evictions,
+				Expired:        s.expired,
+				Rejected:       s.rejected,
+				Rebalanced:     s.rebalanced,
+			}
+		}
+	}
+}
 
-			// Trigger to swap to next DB.
-			if s.sinceFlip > s.outstandingLimit {
-				s.applyWrites()
+// insert places a written item in the table, making room for it as the
+// overflow policy says if its buckets are full.
+func (s *Shard) insert(writeReq *common.ReplicaWriteArgs, conf Config) error {
+	itm := asCuckooItem(&writeReq.WriteArgs)
+	// Only broadcasts placed where their public derivation puts them are
+	// pinned, so clients cannot choose buckets to pin their items into.
+	pinned := common.VerifyBroadcast(&writeReq.WriteArgs, conf.Config)
+	if !pinned && s.Table.Full(itm) {
+		switch conf.Overflow {
+		case OverflowReject:
+			s.rejected++
+			return common.ErrBucketsFull
+		case OverflowEvictOldest:
+			if old := s.Table.EvictOldest(itm); old != nil {
+				s.forget(old.ID)
+				s.evictions++
 			}
 		}
 	}
+	s.inserts++
+	s.lastSeqNo = itm.ID
+
+	s.Entries = append(s.Entries, *itm)
+	if expiry, ok := expiryEpoch(s.epoch, writeReq.TTL); conf.HonorTTL && ok {
+		s.expires[itm.ID] = expiry
+	}
+	var ok bool
+	var evicted *cuckoo.Item
+	if pinned {
+		ok, evicted = s.Table.InsertPinned(itm)
+	} else {
+		ok, evicted = s.Table.Insert(itm)
+	}
+	// No longer need this pointer.
+	itm.Data = nil
+	if !ok {
+		s.insertFailures++
+	}
+	if !ok || len(s.Entries) > int(float64(conf.Config.NumBuckets*conf.Config.BucketDepth)*conf.Config.MaxLoadFactor) {
+		s.evictOldItems()
+	}
+	// Pinned items are never evicted, so the leftover item is a regular one.
+	if evicted != nil {
+		ok, evicted = s.Table.Insert(evicted)
+		if !ok || evicted != nil {
+			s.log.Error.Fatalf("Consistency violation: lost an in-window DB item.")
+		}
+	}
+	return nil
+}
+
+func (s *Shard) checksums(args *common.ChecksumArgs, conf Config) *common.ChecksumReply {
+	reply := &common.ChecksumReply{SeqNo: s.lastSeqNo, BucketsPerRange: args.BucketsPerRange}
+	numBuckets := conf.Config.NumBuckets
+	if reply.BucketsPerRange == 0 || reply.BucketsPerRange > numBuckets {
+		reply.BucketsPerRange = numBuckets
+	}
+	bucketSize := conf.Config.BucketDepth * conf.Config.DataSize
+	for start := uint64(0); start < numBuckets; start += reply.BucketsPerRange {
+		end := start + reply.BucketsPerRange
+		if end > numBuckets {
+			end = numBuckets
+		}
+		mac := hmac.New(sha256.New, args.Key)
+		mac.Write(s.DB.DB[start*bucketSize : end*bucketSize])
+		var sum [32]byte
+		copy(sum[:], mac.Sum(nil))
+		reply.Checksums = append(reply.Checksums, sum)
+	}
+	return reply
+}
+
+func (s *Shard) snapshot() ([]byte, error) {
+	state := shardState{Epoch: s.epoch, LastSeqNo: s.lastSeqNo, Expires: s.expires}
+	state.Entries = make([]cuckoo.Item, len(s.Entries))
+	for i, e := range s.Entries {
+		// Entries are matched by ID and buckets; their data is in the table.
+		e.Data = nil
+		state.Entries[i] = e
+	}
+	var err error
+	if state.Table, err = s.Table.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Shard) restore(data []byte) error {
+	var state shardState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	if err := s.Table.UnmarshalBinary(state.Table); err != nil {
+		return err
+	}
+	s.epoch = state.Epoch
+	s.lastSeqNo = state.LastSeqNo
+	s.Entries = state.Entries
+	s.expires = state.Expires
+	if s.expires == nil {
+		s.expires = make(map[uint64]uint64)
+	}
+	s.applyWrites()
+	return nil
+}
+
+// forget drops the entry of an item evicted from the table. Entries are in
+// order of ID, as written.
+func (s *Shard) forget(id uint64) {
+	i := sort.Search(len(s.Entries), func(i int) bool { return s.Entries[i].ID >= id })
+	if i < len(s.Entries) && s.Entries[i].ID == id {
+		s.Entries = append(s.Entries[:i], s.Entries[i+1:]...)
+	}
+	delete(s.expires, id)
 }
 
 // applyWrites will enque a command to apply any outstanding writes to the
-// database to be seen by subsequent reads.
+// database to be seen by subsequent reads. Writes are applied only at the end
+// of an epoch, so replicas of every trust domain read from the same writes.
 func (s *Shard) applyWrites() {
-	s.syncChan <- 1
-	s.sinceFlip = 0
+	if conf := s.config.Load().(Config); conf.VerifyBuckets {
+		// Wait for the read thread to take its copy of the database, so the
+		// buckets committed to are exactly those reads are answered from.
+		commit := s.commitBuckets(conf)
+		s.commitChan <- commit
+		<-commit.synced
+	} else {
+		s.syncChan <- 1
+	}
+}
+
+// commitBuckets computes the tree over the buckets of the database as it is,
+// and signs its root as of the last write applied.
+func (s *Shard) commitBuckets(conf Config) *bucketCommit {
+	tree := common.NewBucketTree(s.DB.DB, conf.NumBuckets, int(conf.DataSize*conf.BucketDepth))
+	commit := &bucketCommit{tree: tree, synced: make(chan struct{})}
+	if conf.TrustDomain != nil {
+		commit.commitment = conf.TrustDomain.SignBuckets(s.epoch, s.lastSeqNo, tree.Root(), tree.Size())
+	} else {
+		commit.commitment = common.BucketCommitment{Epoch: s.epoch, SeqNo: s.lastSeqNo}
+		commit.commitment.Root = tree.Root()
+		commit.commitment.Size = tree.Size()
+	}
+	return commit
 }
 
 func (s *Shard) evictOldItems() {
@@ -224,8 +662,44 @@ func (s *Shard) evictOldItems() {
 	}
 	for i := 0; i < toRemove; i++ {
 		s.Table.Remove(&s.Entries[i])
+		delete(s.expires, s.Entries[i].ID)
 	}
 	s.Entries = s.Entries[toRemove:]
+	s.evictions += uint64(toRemove)
+}
+
+// expiryEpoch is the epoch at which an item written with a TTL hint is freed.
+// No TTL, or one that would overflow the epoch counter, is treated as no hint.
+func expiryEpoch(epoch uint64, ttl uint64) (uint64, bool) {
+	if ttl == 0 || ttl > math.MaxUint64-epoch {
+		return 0, false
+	}
+	return epoch + ttl, true
+}
+
+// expireItems frees items whose requested TTL has passed as of the current epoch.
+func (s *Shard) expireItems() {
+	due := false
+	for _, expiry := range s.expires {
+		if expiry <= s.epoch {
+			due = true
+			break
+		}
+	}
+	if !due {
+		return
+	}
+	kept := s.Entries[:0]
+	for i := range s.Entries {
+		if expiry, ok := s.expires[s.Entries[i].ID]; ok && expiry <= s.epoch {
+			s.Table.Remove(&s.Entries[i])
+			delete(s.expires, s.Entries[i].ID)
+			s.expired++
+			continue
+		}
+		kept = append(kept, s.Entries[i])
+	}
+	s.Entries = kept
 }
 
 func asCuckooItem(wa *common.WriteArgs) *cuckoo.Item {
@@ -233,30 +707,32 @@ func asCuckooItem(wa *common.WriteArgs) *cuckoo.Item {
 	return &cuckoo.Item{ID: wa.GlobalSeqNo, Data: wa.Data, Bucket1: wa.Bucket1, Bucket2: wa.Bucket2}
 }
 
-func (s *Shard) batchRead(req *DecodedBatchReadRequest, conf Config) {
+func (s *Shard) batchRead(read *queuedRead) {
 	s.log.Trace.Printf("batchRead: enter\n")
-
-	// Run PIR
-	reqlength := int(conf.Config.NumBuckets) / 8
-	pirvector := make([]byte, reqlength*conf.ReadBatch)
-
-	if len(req.Args) != conf.ReadBatch {
-		s.log.Info.Printf("Read operation failed: incorrect number of reads.")
-		req.ReplyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Invalid batch size.")}
+	start := time.Now()
+	atomic.AddInt64(&s.readsQueued, -1)
+	s.queueLatency.Record(start.Sub(read.queued))
+
+	// Don't spend the PIR backend on a batch nobody is waiting for.
+	if common.Expired(read.deadline) {
+		atomic.AddUint64(&s.readsAbandoned, 1)
+		read.replyChan <- &common.BatchReadReply{Err: common.ErrDeadlineExceeded.Error()}
 		return
 	}
 
-	for i := 0; i < conf.ReadBatch; i++ {
-		reqVector := req.Args[i].RequestVector
-		copy(pirvector[reqlength*i:reqlength*(i+1)], reqVector)
-	}
-	err := s.Server.Read(pirvector, s.readReplies)
+	// Run PIR
+	responses := make(chan []byte, 1)
+	err := s.Server.Read(read.vector, responses)
 	if err != nil {
 		s.log.Error.Fatalf("Reading from PIR Server failed: %v", err)
-		req.ReplyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Failed to read: %v", err)}
+		read.replyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Failed to read: %v", err)}
 		return
 	}
-	s.outstandingReads <- req.ReplyChan
+	read.response = <-responses
+	read.buckets = s.buckets
+	s.readLatency.RecordSince(start)
+	atomic.AddUint64(&s.readsCompleted, 1)
+	s.readReplies <- read
 
 	s.log.Trace.Printf("batchRead: exit\n")
 }
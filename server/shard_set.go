@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/privacylab/talek/common"
+)
+
+// shardSet is the shards of a generation: one of each size class, and with
+// tiers, one of the hot tier of class 0.
+type shardSet struct {
+	classes []*Shard
+	hot     *Shard // Or nil
+}
+
+// newShardSet creates the shards of a configuration. Those other than the
+// cold tier of class 0 are named for their class or tier.
+func newShardSet(name string, backing string, config Config) *shardSet {
+	s := &shardSet{classes: make([]*Shard, config.NumClasses())}
+	for class := range s.classes {
+		classConfig := config
+		classConfig.Config, _ = config.Class(uint8(class))
+		shardName := name
+		if class > 0 {
+			shardName = fmt.Sprintf("%s-class%d", name, class)
+		}
+		s.classes[class] = NewShard(shardName, backing, classConfig)
+	}
+	if hot, err := config.Tier(common.TierHot); err == nil {
+		// The hot tier frees items once they are no longer hot, and its
+		// oldest ones should it fill before then.
+		hotConfig := config
+		hotConfig.Config = hot
+		hotConfig.HonorTTL = true
+		hotConfig.Overflow = OverflowEvictOldest
+		s.hot = NewShard(name+"-hot", backing, hotConfig)
+	}
+	return s
+}
+
+// write applies a write to the shard of its size class, and one of class 0 to
+// the hot tier too. conf is the configuration of the class.
+func (s *shardSet) write(args *common.ReplicaWriteArgs, conf *common.Config) error {
+	if err := s.classes[args.Class].Write(args); err != nil {
+		return err
+	}
+	if s.hot != nil && args.Class == 0 {
+		// An item the hot tier can't take is still read from the cold one.
+		s.hot.Write(hotWrite(args, conf))
+	}
+	return nil
+}
+
+// hotWrite is the write of an item to the hot tier: to the buckets of the
+// tier holding its buckets, and freed after HotEpochs, or its own TTL if
+// sooner.
+func hotWrite(args *common.ReplicaWriteArgs, conf *common.Config) *common.ReplicaWriteArgs {
+	hot := *args
+	hot.Bucket1, hot.Bucket2 = conf.HotBucket(args.Bucket1), conf.HotBucket(args.Bucket2)
+	if hot.TTL == 0 || hot.TTL > conf.HotEpochs {
+		hot.TTL = conf.HotEpochs
+	}
+	return &hot
+}
+
+// seal ends an epoch at every shard of the set, if any.
+func (s *shardSet) seal(args *common.ReplicaWriteArgs) {
+	for _, shard := range s.all() {
+		shard.Write(args)
+	}
+}
+
+// all returns the shards of the set, those of the size classes in order, then
+// that of the hot tier, if any.
+func (s *shardSet) all() []*Shard {
+	if s == nil {
+		return nil
+	}
+	if s.hot == nil {
+		return s.classes
+	}
+	return append(append([]*Shard(nil), s.classes...), s.hot)
+}
+
+func (s *shardSet) close() {
+	for _, shard := range s.all() {
+		shard.Close()
+	}
+}
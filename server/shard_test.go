@@ -3,13 +3,16 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/privacylab/talek/common"
-	_ "github.com/privacylab/talek/pir/pircpu"
+	"github.com/privacylab/talek/cuckoo"
+	"github.com/privacylab/talek/pir/pircpu"
+	"github.com/privacylab/talek/pir/pirinterface"
 )
 
 import "testing"
@@ -86,6 +89,426 @@ func TestShardSanity(t *testing.T) {
 	shard.Close()
 }
 
+func TestShardReadPipeline(t *testing.T) {
+	conf := testConf()
+	conf.ReadQueueDepth = 2
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+	defer shard.Close()
+
+	reqs := make([]common.PirArgs, conf.ReadBatch)
+	for i := range reqs {
+		reqs[i] = common.PirArgs{RequestVector: make([]byte, conf.NumBuckets/8)}
+	}
+	// Batches are accepted while earlier ones are computed, and all answered
+	// in the order they were queued.
+	const batches = 8
+	replyChans := make([]chan *common.BatchReadReply, batches)
+	for i := range replyChans {
+		replyChans[i] = make(chan *common.BatchReadReply, 1)
+		shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replyChans[i]})
+	}
+	for i, c := range replyChans {
+		if reply := <-c; reply.Err != "" || len(reply.Replies) != conf.ReadBatch {
+			t.Fatalf("Batch %d failed: %v", i, reply.Err)
+		}
+	}
+
+	stats := shard.ReadStats()
+	if stats.Completed != batches || stats.Queued != 0 || stats.Capacity != 2 {
+		t.Fatalf("Unexpected read pipeline stats %+v", stats)
+	}
+
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs[1:], ReplyChan: replyChans[0]})
+	if reply := <-replyChans[0]; reply.Err == "" {
+		t.Fatal("A batch of the wrong size should fail.")
+	}
+}
+
+func TestShardReadDeadline(t *testing.T) {
+	conf := testConf()
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+	defer shard.Close()
+
+	reqs := make([]common.PirArgs, conf.ReadBatch)
+	for i := range reqs {
+		reqs[i] = common.PirArgs{RequestVector: make([]byte, conf.NumBuckets/8)}
+	}
+	replies := make(chan *common.BatchReadReply, 1)
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replies, Deadline: time.Now().Add(-time.Second)})
+	if reply := <-replies; reply.Err != common.ErrDeadlineExceeded.Error() {
+		t.Fatalf("Expired batch should be abandoned, got %q", reply.Err)
+	}
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replies, Deadline: time.Now().Add(time.Minute)})
+	if reply := <-replies; reply.Err != "" {
+		t.Fatalf("Batch within its deadline failed: %q", reply.Err)
+	}
+
+	stats := shard.ReadStats()
+	if stats.Abandoned != 1 || stats.Completed != 1 {
+		t.Fatalf("Unexpected read pipeline stats %+v", stats)
+	}
+}
+
+func TestShardTTL(t *testing.T) {
+	conf := testConf()
+	conf.HonorTTL = true
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+
+	write := func(id uint64, ttl uint64) *common.ReplicaWriteArgs {
+		args := &common.ReplicaWriteArgs{
+			WriteArgs: common.WriteArgs{
+				Bucket1:     id,
+				Bucket2:     id + 1,
+				Data:        make([]byte, conf.Config.DataSize),
+				GlobalSeqNo: id,
+				TTL:         ttl,
+			},
+		}
+		shard.Write(args)
+		return args
+	}
+	epoch := func() {
+		shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	}
+
+	short := asCuckooItem(&write(1, 1).WriteArgs)
+	long := asCuckooItem(&write(2, 0).WriteArgs)
+	huge := asCuckooItem(&write(3, math.MaxUint64).WriteArgs)
+	epoch()
+	// The write loop only accepts a request once the previous one is fully
+	// processed, so a further epoch marks completion of the first. With no TTLs
+	// due, that epoch does not modify the table.
+	epoch()
+
+	if shard.Table.Contains(short) {
+		t.Fatal("Item with expired TTL was not freed.")
+	}
+	if !shard.Table.Contains(long) {
+		t.Fatal("Item without a TTL should be retained.")
+	}
+	if !shard.Table.Contains(huge) {
+		t.Fatal("Item with a distant TTL should be retained.")
+	}
+	if len(shard.Entries) != 2 {
+		t.Fatalf("Expected 2 retained entries, found %d", len(shard.Entries))
+	}
+
+	shard.Close()
+
+	if _, ok := expiryEpoch(2, math.MaxUint64); ok {
+		t.Fatal("A TTL overflowing the epoch counter must not wrap into an early expiry.")
+	}
+	if expiry, ok := expiryEpoch(2, 3); !ok || expiry != 5 {
+		t.Fatalf("Unexpected expiry %d", expiry)
+	}
+}
+
+func TestShardStats(t *testing.T) {
+	conf := testConf()
+	conf.HonorTTL = true
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+	defer shard.Close()
+
+	for id := uint64(1); id <= 3; id++ {
+		shard.Write(&common.ReplicaWriteArgs{
+			WriteArgs: common.WriteArgs{
+				Bucket1:     id,
+				Bucket2:     id + 1,
+				Data:        make([]byte, conf.Config.DataSize),
+				GlobalSeqNo: id,
+				TTL:         id % 2,
+			},
+		})
+	}
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+
+	stats := shard.Stats()
+	if stats.Inserts != 3 || stats.Expired != 2 || stats.Items != 1 || stats.InsertFailures != 0 {
+		t.Fatalf("Unexpected table stats %+v", stats)
+	}
+	var buckets, items uint64
+	for load, n := range stats.Occupancy {
+		buckets += n
+		items += uint64(load) * n
+	}
+	if buckets != conf.Config.NumBuckets || items+stats.Stashed != stats.Items || stats.Capacity != conf.Config.NumBuckets*conf.Config.BucketDepth {
+		t.Fatalf("Occupancy histogram %v does not match the table", stats.Occupancy)
+	}
+	if stats.DBBytes != stats.Capacity*conf.Config.DataSize || stats.HeapBytes == 0 || stats.Reads.Capacity != defaultReadQueueDepth {
+		t.Fatalf("Unexpected shard stats %+v", stats)
+	}
+
+	pirStats := stats.PIR
+	if pirStats.Backing != "cpu.0" || len(pirStats.Devices) != 1 || pirStats.Devices[0].Backing != "cpu" || pirStats.Throughput != 0 {
+		t.Fatalf("Unexpected PIR stats %+v", pirStats)
+	}
+	available := false
+	for _, backing := range pirStats.Available {
+		available = available || backing == "cpu"
+	}
+	if !available {
+		t.Fatalf("CPU backing not listed among %v", pirStats.Available)
+	}
+
+	replies := make(chan *common.BatchReadReply)
+	reqs := make([]common.PirArgs, conf.ReadBatch)
+	for i := range reqs {
+		reqs[i].RequestVector = make([]byte, conf.Config.NumBuckets/8)
+	}
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replies})
+	<-replies
+	if throughput := shard.Stats().PIR.Throughput; throughput <= 0 {
+		t.Fatalf("Read throughput not measured: %v", throughput)
+	}
+}
+
+func TestShardOverflow(t *testing.T) {
+	for _, policy := range []string{OverflowStash, OverflowEvictOldest, OverflowReject} {
+		conf := testConf()
+		conf.Overflow = policy
+		shard := NewShard("Test Shard", "cpu.0", conf)
+		if shard == nil {
+			t.Fatal("Failed to create shard.")
+		}
+
+		// Items all placed in buckets 0 and 1 fill them, then overflow.
+		capacity := 2 * conf.Config.BucketDepth
+		var errs []error
+		for id := uint64(1); id <= capacity+1; id++ {
+			errs = append(errs, shard.Write(&common.ReplicaWriteArgs{
+				WriteArgs: common.WriteArgs{
+					Bucket1:     0,
+					Bucket2:     1,
+					Data:        make([]byte, conf.Config.DataSize),
+					GlobalSeqNo: id,
+				},
+			}))
+		}
+		stats := shard.Stats()
+		last := &cuckoo.Item{ID: capacity + 1, Bucket1: 0, Bucket2: 1}
+		first := &cuckoo.Item{ID: 1, Bucket1: 0, Bucket2: 1}
+
+		switch policy {
+		case OverflowStash:
+			if errs[capacity] != nil || stats.Stashed != 1 || !shard.Table.Contains(last) {
+				t.Fatalf("The overflowing item should be stashed: %v %+v", errs[capacity], stats)
+			}
+		case OverflowEvictOldest:
+			if errs[capacity] != nil || shard.Table.Contains(first) || !shard.Table.Contains(last) || stats.Evictions != 1 {
+				t.Fatalf("The oldest item should make room: %v %+v", errs[capacity], stats)
+			}
+			if len(shard.Entries) != int(capacity) || shard.Entries[0].ID != 2 {
+				t.Fatalf("Evicted item was not forgotten.")
+			}
+		case OverflowReject:
+			if errs[capacity] != common.ErrBucketsFull || shard.Table.Contains(last) || stats.Rejected != 1 {
+				t.Fatalf("The overflowing write should be rejected: %v %+v", errs[capacity], stats)
+			}
+			if len(shard.Entries) != int(capacity) {
+				t.Fatalf("Rejected item should not be retained.")
+			}
+		}
+		for _, err := range errs[:capacity] {
+			if err != nil {
+				t.Fatalf("Write with room failed: %v", err)
+			}
+		}
+		shard.Close()
+	}
+}
+
+func TestShardChecksums(t *testing.T) {
+	conf := testConf()
+	shards := []*Shard{NewShard("Shard A", "cpu.0", conf), NewShard("Shard B", "cpu.0", conf)}
+	for _, shard := range shards {
+		if shard == nil {
+			t.Fatal("Failed to create shard.")
+		}
+		defer shard.Close()
+	}
+	write := func(shard *Shard, id uint64, bucket uint64, content byte) {
+		data := make([]byte, conf.Config.DataSize)
+		data[0] = content
+		shard.Write(&common.ReplicaWriteArgs{
+			WriteArgs: common.WriteArgs{Bucket1: bucket, Bucket2: bucket, Data: data, GlobalSeqNo: id},
+		})
+	}
+	for id := uint64(1); id <= 4; id++ {
+		write(shards[0], id, id*100, 1)
+		write(shards[1], id, id*100, 1)
+	}
+
+	args := &common.ChecksumArgs{BucketsPerRange: 64, Key: []byte("key")}
+	a, b := shards[0].Checksums(args), shards[1].Checksums(args)
+	if len(a.Checksums) != int(conf.Config.NumBuckets/64) || a.SeqNo != 4 {
+		t.Fatalf("Unexpected checksums of %d ranges at %d", len(a.Checksums), a.SeqNo)
+	}
+	if diverged, err := a.Diverged(b); err != nil || len(diverged) != 0 {
+		t.Fatalf("Identical replicas diverged in %v: %v", diverged, err)
+	}
+	if other := shards[0].Checksums(&common.ChecksumArgs{BucketsPerRange: 64, Key: []byte("other")}); other.Checksums[0] == a.Checksums[0] {
+		t.Fatal("Checksums should depend on their key.")
+	}
+
+	// A write differing in content shows up in its range only.
+	write(shards[0], 5, 300, 1)
+	write(shards[1], 5, 300, 2)
+	a, b = shards[0].Checksums(args), shards[1].Checksums(args)
+	if diverged, err := a.Diverged(b); err != nil || len(diverged) != 1 || diverged[0] != 300/64 {
+		t.Fatalf("Expected divergence in range %d, got %v: %v", 300/64, diverged, err)
+	}
+	write(shards[0], 6, 0, 1)
+	if _, err := shards[0].Checksums(args).Diverged(b); err == nil {
+		t.Fatal("Checksums at different writes should not be compared.")
+	}
+}
+
+func TestShardBucketCommitment(t *testing.T) {
+	conf := testConf()
+	conf.VerifyBuckets = true
+	conf.TrustDomain = common.NewTrustDomainConfig("td", "", true, false)
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+	defer shard.Close()
+
+	data := make([]byte, conf.Config.DataSize)
+	copy(data, "Magic")
+	shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 3, Bucket2: 3, Data: data, GlobalSeqNo: 1}})
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	// The write thread answers once the epoch is committed to.
+	shard.Checksums(&common.ChecksumArgs{})
+
+	// Read bucket 3 as two trust domains would, with request vectors
+	// differing only in it.
+	const bucket = 3
+	reqs := make([]common.PirArgs, conf.ReadBatch)
+	for i := range reqs {
+		reqs[i].RequestVector = make([]byte, conf.NumBuckets/8)
+	}
+	rand.Read(reqs[0].RequestVector)
+	copy(reqs[1].RequestVector, reqs[0].RequestVector)
+	reqs[1].RequestVector[bucket/8] ^= 1 << (bucket % 8)
+	replyChan := make(chan *common.BatchReadReply)
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replyChan})
+	reply := <-replyChan
+	if reply.Err != "" {
+		t.Fatal(reply.Err)
+	}
+	if reply.Buckets.Epoch != 1 || !conf.TrustDomain.VerifyBuckets(&reply.Buckets) {
+		t.Fatalf("Unexpected commitment to the buckets of epoch %d.", reply.Buckets.Epoch)
+	}
+
+	combined := common.ReadReply{Data: reply.Replies[0].Data, Proof: reply.Replies[0].Proof}
+	combined.Combine(reply.Replies[1].Data)
+	combined.CombineProof(reply.Replies[1].Proof)
+	if !bytes.HasPrefix(combined.Data, data) {
+		t.Fatal("Failed to round-trip a write.")
+	}
+	tds := []*common.TrustDomainConfig{conf.TrustDomain, conf.TrustDomain}
+	commitments := []common.BucketCommitment{reply.Buckets, reply.Buckets}
+	if err := common.VerifyBucket(bucket, conf.NumBuckets, combined.Data, combined.Proof, commitments, tds); err != nil {
+		t.Fatalf("Read failed to verify: %v", err)
+	}
+
+	// The next epoch commits to the buckets as changed.
+	shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 3, Bucket2: 3, Data: data, GlobalSeqNo: 2}})
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	shard.Checksums(&common.ChecksumArgs{})
+	shard.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replyChan})
+	next := <-replyChan
+	if next.Buckets.Epoch != 2 || next.Buckets.Root == reply.Buckets.Root {
+		t.Fatal("Expected a new commitment for the next epoch.")
+	}
+}
+
+func TestShardRebalance(t *testing.T) {
+	conf := testConf()
+	conf.RebalanceMoves = 16
+	shards := []*Shard{NewShard("Shard A", "cpu.0", conf), NewShard("Shard B", "cpu.0", conf)}
+	for _, shard := range shards {
+		if shard == nil {
+			t.Fatal("Failed to create shard.")
+		}
+		defer shard.Close()
+		for id := uint64(1); id <= 8; id++ {
+			shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+				Bucket1:     0,
+				Bucket2:     id,
+				Data:        make([]byte, conf.Config.DataSize),
+				GlobalSeqNo: id,
+			}})
+		}
+		shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	}
+
+	stats := shards[0].Stats()
+	if stats.Rebalanced == 0 || stats.Occupancy[0] != conf.Config.NumBuckets-8 {
+		t.Fatalf("Expected items to be spread over their buckets: %+v", stats)
+	}
+	args := &common.ChecksumArgs{Key: []byte("key")}
+	if diverged, err := shards[0].Checksums(args).Diverged(shards[1].Checksums(args)); err != nil || len(diverged) != 0 {
+		t.Fatalf("Replicas rebalanced differently: %v %v", diverged, err)
+	}
+}
+
+func TestShardBroadcast(t *testing.T) {
+	conf := testConf()
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if shard == nil {
+		t.Fatal("Failed to create shard.")
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	s1, s2, _ := common.BroadcastSeeds(key)
+	b1, b2 := common.ItemBuckets(conf.Config, s1, s2, 0)
+
+	write := func(id uint64, seqNo uint64) *cuckoo.Item {
+		args := &common.ReplicaWriteArgs{
+			WriteArgs: common.WriteArgs{
+				Bucket1:        b1,
+				Bucket2:        b2,
+				Data:           make([]byte, conf.Config.DataSize),
+				BroadcastKey:   key,
+				BroadcastSeqNo: seqNo,
+				GlobalSeqNo:    id,
+			},
+		}
+		shard.Write(args)
+		return asCuckooItem(&args.WriteArgs)
+	}
+
+	verified := write(1, 0)
+	// Claims a broadcast position that does not match its buckets.
+	forged := write(2, 1)
+	// See TestShardTTL; a second epoch marks completion of the first.
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+
+	if !shard.Table.Pinned(verified) {
+		t.Fatal("Verified broadcast item should be pinned.")
+	}
+	if shard.Table.Pinned(forged) || !shard.Table.Contains(forged) {
+		t.Fatal("Unverified broadcast item should be stored as a regular item.")
+	}
+
+	shard.Close()
+}
+
 func BenchmarkShard(b *testing.B) {
 	fmt.Printf("Benchmark began with N=%d\n", b.N)
 	readsPerWrite := fromEnvOrDefault("READS_PER_WRITE", 20)
@@ -121,7 +544,7 @@ func BenchmarkShard(b *testing.B) {
 	for i := 0; i < conf.ReadBatch; i++ {
 		reqs[i] = req
 	}
-	stdRead := &DecodedBatchReadRequest{reqs, replychan}
+	stdRead := &DecodedBatchReadRequest{reqs, replychan, time.Time{}}
 
 	b.ResetTimer()
 
@@ -141,6 +564,66 @@ func BenchmarkShard(b *testing.B) {
 		b.SetBytes(int64(1))
 	}
 
+	b.StopTimer()
+	stats := shard.Stats()
+	if stats.Reads.Completed > 0 {
+		fmt.Printf("Shard held %d/%d items with occupancy %v after %d evictions; PIR batches took %v on average\n",
+			stats.Items, stats.Capacity, stats.Occupancy, stats.Evictions, stats.Reads.ReadLatency.Mean())
+	}
 	fmt.Printf("Benchmark called close w N=%d\n", b.N)
 	shard.Close()
 }
+
+// tunableShard is a CPU shard with launch parameters, standing in for a GPU.
+type tunableShard struct {
+	pirinterface.Shard
+	params pirinterface.LaunchParams
+}
+
+func (t *tunableShard) GetLaunchParams() pirinterface.LaunchParams {
+	return t.params
+}
+
+func (t *tunableShard) SetLaunchParams(params pirinterface.LaunchParams) error {
+	if err := params.Validate(256); err != nil {
+		return err
+	}
+	t.params = params
+	return nil
+}
+
+func init() {
+	pirinterface.Register("tunable", func(bucketSize int, data []byte, userdata string) pirinterface.Shard {
+		return &tunableShard{Shard: pircpu.NewShard(bucketSize, data, "cpu.0")}
+	})
+}
+
+func TestShardLaunchParams(t *testing.T) {
+	conf := testConf()
+	shard := NewShard("Test Shard", "cpu.0", conf)
+	if _, err := shard.GetLaunchParams(); err == nil {
+		t.Fatal("CPU backend should have no launch parameters.")
+	}
+	shard.Close()
+
+	conf.GPULaunch = pirinterface.LaunchParams{BatchSize: 2, Threads: 1024}
+	shard = NewShard("Test Shard", "tunable", conf)
+	defer shard.Close()
+	if params, err := shard.GetLaunchParams(); err != nil || params != conf.GPULaunch {
+		t.Fatalf("Configured launch parameters not applied: %+v, %v", params, err)
+	}
+	if _, err := shard.SetLaunchParams(pirinterface.LaunchParams{GroupSize: 512}); err == nil {
+		t.Fatal("Launch parameters beyond the device limits should be refused.")
+	}
+	adjusted := pirinterface.LaunchParams{BatchSize: 4, Threads: 2048, GroupSize: 128}
+	if params, err := shard.SetLaunchParams(adjusted); err != nil || params != adjusted {
+		t.Fatalf("Launch parameters not adjusted: %+v, %v", params, err)
+	}
+
+	// Parameters carry over to the backend of each new version of the DB.
+	shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: 0, Bucket2: 1, Data: make([]byte, conf.Config.DataSize)}})
+	shard.syncChan <- 1
+	if params, err := shard.GetLaunchParams(); err != nil || params != adjusted {
+		t.Fatalf("Launch parameters lost with new DB: %+v, %v", params, err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// standbyBacklog is how many applied writes may wait to be streamed to a
+// standby before it is given up on as out of sync.
+const standbyBacklog = 4096
+
+// standbyRetry is how long to wait before resending a write a standby failed
+// to apply.
+const standbyRetry = 100 * time.Millisecond
+
+// standby streams the writes applied by an active replica to a standby copy in
+// the same trust domain, in the order they were applied, so it can take over
+// with a full database if the active replica is lost.
+type standby struct {
+	log    *common.Logger
+	name   string
+	target common.ReplicaInterface
+	alerts *alerter
+	writes chan *common.ReplicaWriteArgs
+	behind int32 // Use atomic
+	done   chan struct{}
+}
+
+func newStandby(name string, target common.ReplicaInterface, alerts *alerter) *standby {
+	s := &standby{}
+	s.log = common.NewLogger(name)
+	s.name = name
+	s.target = target
+	s.alerts = alerts
+	s.writes = make(chan *common.ReplicaWriteArgs, standbyBacklog)
+	s.done = make(chan struct{})
+	go s.stream()
+	return s
+}
+
+// send queues an applied write. Writes are marked as replays, so a standby
+// which already has them, or which is promoted and then sent them by a new
+// frontend leader, skips them.
+func (s *standby) send(args *common.ReplicaWriteArgs) {
+	if atomic.LoadInt32(&s.behind) != 0 {
+		return
+	}
+	write := *args
+	write.Replay = true
+	select {
+	case s.writes <- &write:
+	default:
+		atomic.StoreInt32(&s.behind, 1)
+		s.log.Error.Printf("Standby %s fell %d writes behind, and must be resynchronized.\n", s.name, standbyBacklog)
+		s.alerts.alert(AlertWriteQueueOverflow, "standby "+s.name, "Standby %s fell %d writes behind, and must be resynchronized.", s.name, standbyBacklog)
+	}
+}
+
+func (s *standby) status() common.StandbyStatus {
+	return common.StandbyStatus{Name: s.name, Pending: len(s.writes), InSync: atomic.LoadInt32(&s.behind) == 0}
+}
+
+func (s *standby) close() {
+	close(s.done)
+}
+
+func (s *standby) stream() {
+	for {
+		var write *common.ReplicaWriteArgs
+		select {
+		case write = <-s.writes:
+		case <-s.done:
+			return
+		}
+
+		// A write is retried until delivered, as later ones depend on it. One
+		// the standby refuses would be refused again, so is only reported.
+		for {
+			var reply common.ReplicaWriteReply
+			err := s.target.Write(write, &reply)
+			if err == nil {
+				if reply.Err != "" {
+					s.log.Warn.Printf("Standby %s refused write %d: %s\n", s.name, write.GlobalSeqNo, reply.Err)
+				}
+				break
+			}
+			s.log.Warn.Printf("Streaming write %d to standby %s failed: %v\n", write.GlobalSeqNo, s.name, err)
+			select {
+			case <-time.After(standbyRetry):
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// standbyReplica records the writes streamed to it, failing the first.
+type standbyReplica struct {
+	mockReplica
+	mu     sync.Mutex
+	failed bool
+	writes []common.ReplicaWriteArgs
+}
+
+func (s *standbyReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failed {
+		s.failed = true
+		return errors.New("unavailable")
+	}
+	s.writes = append(s.writes, *args)
+	return nil
+}
+
+func (s *standbyReplica) received() []common.ReplicaWriteArgs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]common.ReplicaWriteArgs(nil), s.writes...)
+}
+
+func TestStandbyStreaming(t *testing.T) {
+	r := NewReplica("active", "cpu.0", testConf())
+	defer r.Close()
+	standby := new(standbyReplica)
+	r.AddStandby("standby", standby)
+
+	var leaves [][32]byte
+	for i := uint64(1); i <= 3; i++ {
+		args := &common.ReplicaWriteArgs{
+			WriteArgs: common.WriteArgs{Bucket1: i, Bucket2: i + 1, Data: make([]byte, testConf().DataSize), GlobalSeqNo: i},
+		}
+		leaves = append(leaves, common.WriteLeaf(&args.WriteArgs))
+		r.Write(args, &common.ReplicaWriteReply{})
+	}
+	r.Write(&common.ReplicaWriteArgs{InterestFlag: true}, &common.ReplicaWriteReply{})
+	reply := &common.ReplicaWriteReply{}
+	r.Write(&common.ReplicaWriteArgs{EpochFlag: true, EpochRoot: common.MerkleRoot(leaves)}, reply)
+	if reply.Err != "" {
+		t.Fatalf("Epoch failed to commit: %s", reply.Err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(standby.received()) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Standby received %d of 4 writes.", len(standby.received()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writes := standby.received()
+	for i, w := range writes {
+		if !w.Replay {
+			t.Fatalf("Write %d was not streamed as a replay.", i)
+		}
+		if i < 3 && (w.EpochFlag || w.GlobalSeqNo != uint64(i+1)) {
+			t.Fatalf("Write %d streamed out of order: %+v", i, w)
+		}
+	}
+	if !writes[3].EpochFlag {
+		t.Fatal("Epoch was not streamed after its writes.")
+	}
+
+	status := r.Standbys()
+	if len(status) != 1 || !status[0].InSync || status[0].Pending != 0 {
+		t.Fatalf("Unexpected standby status: %+v", status)
+	}
+}
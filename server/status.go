@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// statusTimeout is how long a frontend waits for a replica to report its
+// status before reporting it as unresponsive.
+const statusTimeout = 5 * time.Second
+
+// statusMaxEpochLag is how many epochs a replica may be behind the frontend
+// before it is reported unhealthy. A replica is normally one behind while
+// the frontend commits an epoch.
+const statusMaxEpochLag = 1
+
+// statusSource is implemented by replicas which can report their status.
+// Others are asked for the statistics of their shard instead.
+type statusSource interface {
+	GetStatus(args *interface{}, reply *common.ReplicaStatus) error
+}
+
+// GetStatus reports the health of the frontend, and asks the replica of each
+// trust domain for its status in parallel, for how far each lags behind.
+func (fe *Frontend) GetStatus(args *interface{}, reply *common.ClusterStatus) error {
+	reply.Name = fe.name
+	reply.Version = common.Version
+	reply.GoVersion = runtime.Version()
+	reply.Started = fe.started
+	fe.commitLock.Lock()
+	reply.Epoch = fe.epoch
+	fe.commitLock.Unlock()
+	reply.SeqNo = atomic.LoadUint64(&fe.proposedSeqNo)
+	reply.Generation, _, _ = fe.generations.current()
+	if r := fe.replication(); r != nil {
+		reply.Standby = !r.Leading()
+	}
+
+	statuses := make([]chan common.ReplicaStatus, len(fe.replicas))
+	for i, r := range fe.replicas {
+		statuses[i] = make(chan common.ReplicaStatus, 1)
+		go func(r common.ReplicaInterface, status chan common.ReplicaStatus) {
+			status <- replicaStatus(r)
+		}(r, statuses[i])
+	}
+	timeout := time.NewTimer(statusTimeout)
+	defer timeout.Stop()
+	reply.Replicas = make([]common.ReplicaStatus, len(fe.replicas))
+	for i := range statuses {
+		select {
+		case reply.Replicas[i] = <-statuses[i]:
+		case <-timeout.C:
+			reply.Replicas[i].Err = fmt.Sprintf("no status within %v", statusTimeout)
+			// Replicas yet to report have had as long.
+			timeout.Reset(0)
+		}
+	}
+
+	for i := range reply.Replicas {
+		status := &reply.Replicas[i]
+		if status.Err != "" {
+			reply.Problems = append(reply.Problems, fmt.Sprintf("trust domain %d: %s", i, status.Err))
+			continue
+		}
+		if status.Version == "" {
+			// Its progress is unknown.
+			continue
+		}
+		if reply.SeqNo > status.CommittedSeqNo {
+			status.WriteLag = reply.SeqNo - status.CommittedSeqNo
+		}
+		if reply.Epoch > status.Epochs {
+			status.EpochLag = reply.Epoch - status.Epochs
+		}
+		if status.EpochLag > statusMaxEpochLag {
+			reply.Problems = append(reply.Problems, fmt.Sprintf("trust domain %d: %d epochs behind", i, status.EpochLag))
+		}
+		if status.Joining {
+			reply.Problems = append(reply.Problems, fmt.Sprintf("trust domain %d: joining", i))
+		}
+		for _, s := range status.Standbys {
+			if !s.InSync {
+				reply.Problems = append(reply.Problems, fmt.Sprintf("trust domain %d: standby %s out of sync", i, s.Name))
+			}
+		}
+	}
+	reply.Healthy = len(reply.Problems) == 0
+	return nil
+}
+
+// replicaStatus asks a replica for its status, or, if it can't report one,
+// for the PIR backend of its shard.
+func replicaStatus(r common.ReplicaInterface) common.ReplicaStatus {
+	var status common.ReplicaStatus
+	if source, ok := r.(statusSource); ok {
+		if err := source.GetStatus(nil, &status); err != nil {
+			status.Err = err.Error()
+		}
+		return status
+	}
+	var stats common.ShardStats
+	if err := r.GetStats(nil, &stats); err != nil {
+		status.Err = err.Error()
+	} else if stats.Err != "" {
+		status.Err = stats.Err
+	}
+	status.PIR = stats.PIR
+	return status
+}
+
+// ServeHealth serves the status of the frontend and its replicas as JSON,
+// with status 200 when healthy and 503 otherwise, for load balancers and
+// health checks.
+func (fe *Frontend) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	var status common.ClusterStatus
+	fe.GetStatus(nil, &status)
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&status)
+}
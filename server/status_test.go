@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// statusReplica reports a fixed status.
+type statusReplica struct {
+	mockReplica
+	status common.ReplicaStatus
+}
+
+func (s *statusReplica) GetStatus(args *interface{}, reply *common.ReplicaStatus) error {
+	*reply = s.status
+	return nil
+}
+
+func TestReplicaStatus(t *testing.T) {
+	r := NewReplica("status", "cpu.0", testConf())
+	defer r.Close()
+	r.AddStandby("standby", new(mockReplica))
+
+	var status common.ReplicaStatus
+	r.GetStatus(nil, &status)
+	if status.Name != "status" || status.Version != common.Version || status.Started.IsZero() {
+		t.Fatalf("Replica misreported itself: %+v", status)
+	}
+	if len(status.Standbys) != 1 || !status.Standbys[0].InSync {
+		t.Fatalf("Replica misreported its standbys: %+v", status.Standbys)
+	}
+	if status.PIR.Backing == "" {
+		t.Fatal("Replica did not report its PIR backend.")
+	}
+}
+
+func TestFrontendStatus(t *testing.T) {
+	current := &statusReplica{status: common.ReplicaStatus{Version: "v1", Epochs: 5, CommittedSeqNo: 40}}
+	lagging := &statusReplica{status: common.ReplicaStatus{Version: "v1", Epochs: 2, CommittedSeqNo: 10}}
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{current, lagging, new(mockReplica)})
+	defer f.Close()
+	f.commitLock.Lock()
+	f.epoch = 5
+	f.commitLock.Unlock()
+	atomic.StoreUint64(&f.proposedSeqNo, 42)
+
+	var status common.ClusterStatus
+	f.GetStatus(nil, &status)
+	if status.Healthy || len(status.Problems) != 1 || !strings.HasPrefix(status.Problems[0], "trust domain 1:") {
+		t.Fatalf("Expected only the lagging replica to be a problem, got %v.", status.Problems)
+	}
+	if r := status.Replicas[0]; r.EpochLag != 0 || r.WriteLag != 2 {
+		t.Fatalf("Replica up to date reported lagging by %d epochs and %d writes.", r.EpochLag, r.WriteLag)
+	}
+	if r := status.Replicas[1]; r.EpochLag != 3 || r.WriteLag != 32 {
+		t.Fatalf("Lagging replica reported lagging by %d epochs and %d writes.", r.EpochLag, r.WriteLag)
+	}
+
+	w := httptest.NewRecorder()
+	f.ServeHealth(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Unhealthy deployment served status %d.", w.Code)
+	}
+
+	lagging.status.Epochs = 5
+	w = httptest.NewRecorder()
+	f.ServeHealth(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Healthy deployment served status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// benchmarkReadDepth is how many batches of reads a benchmark keeps queued at
+// the shard, so batches are assembled while earlier ones are computed.
+const benchmarkReadDepth = 2
+
+// ShardThroughput is the throughput a shard sustained under synthetic load.
+type ShardThroughput struct {
+	Writes    uint64
+	WriteTime time.Duration
+	Reads     uint64 // Individual reads, made in batches of ReadBatch
+	ReadTime  time.Duration
+}
+
+// WritesPerSecond is the rate writes were applied at.
+func (b *ShardThroughput) WritesPerSecond() float64 {
+	return float64(b.Writes) / b.WriteTime.Seconds()
+}
+
+// ReadsPerSecond is the rate individual reads were answered at.
+func (b *ShardThroughput) ReadsPerSecond() float64 {
+	return float64(b.Reads) / b.ReadTime.Seconds()
+}
+
+func (b *ShardThroughput) String() string {
+	return fmt.Sprintf("%d writes in %v (%.0f/s), %d reads in %v (%.0f/s)",
+		b.Writes, b.WriteTime, b.WritesPerSecond(), b.Reads, b.ReadTime, b.ReadsPerSecond())
+}
+
+// MeasureShard measures the writes and reads per second a shard of config
+// sustains on a PIR backing, for capacity planning. Synthetic writes, then
+// batches of reads, are made directly against the shard for about duration
+// each, bypassing the network and the decryption of reads.
+func MeasureShard(name string, backing string, config Config, duration time.Duration) (*ShardThroughput, error) {
+	if config.Config == nil || config.ReadBatch <= 0 {
+		return nil, errors.New("benchmark needs a database and read batch size")
+	}
+	s := NewShard(name, backing, config)
+	if s == nil {
+		return nil, errors.New("could not create shard")
+	}
+	defer s.Close()
+	result := &ShardThroughput{}
+
+	// Writes are queued to the shard, and applied once it reports them.
+	start := time.Now()
+	var seqNo uint64
+	for time.Since(start) < duration {
+		for i := 0; i < 100; i++ {
+			seqNo++
+			s.Write(benchmarkWrite(config.Config, seqNo))
+		}
+	}
+	for {
+		stats := s.Stats()
+		if stats.Inserts+stats.Rejected >= seqNo {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	result.Writes = seqNo
+	result.WriteTime = time.Since(start)
+
+	replies := make(chan *common.BatchReadReply, benchmarkReadDepth)
+	queue := func() {
+		args := &DecodedBatchReadRequest{ReplyChan: replies}
+		args.Args = make([]common.PirArgs, config.ReadBatch)
+		for i := range args.Args {
+			args.Args[i].RequestVector = make([]byte, common.RequestVectorLength(config.Config))
+			rand.Read(args.Args[i].RequestVector)
+		}
+		s.BatchRead(args)
+	}
+	start = time.Now()
+	for i := 0; i < benchmarkReadDepth; i++ {
+		queue()
+	}
+	outstanding := benchmarkReadDepth
+	for outstanding > 0 {
+		reply := <-replies
+		outstanding--
+		if reply.Err != "" {
+			return nil, errors.New(reply.Err)
+		}
+		result.Reads += uint64(config.ReadBatch)
+		if time.Since(start) < duration {
+			queue()
+			outstanding++
+		}
+	}
+	result.ReadTime = time.Since(start)
+	return result, nil
+}
+
+// benchmarkWrite is a write of random data to random buckets.
+func benchmarkWrite(conf *common.Config, seqNo uint64) *common.ReplicaWriteArgs {
+	w := &common.ReplicaWriteArgs{}
+	var buckets [16]byte
+	rand.Read(buckets[:])
+	for i := 0; i < 8; i++ {
+		w.Bucket1 = w.Bucket1<<8 | uint64(buckets[i])
+		w.Bucket2 = w.Bucket2<<8 | uint64(buckets[8+i])
+	}
+	w.Bucket1 %= conf.NumBuckets
+	w.Bucket2 %= conf.NumBuckets
+	w.Data = make([]byte, conf.DataSize)
+	rand.Read(w.Data)
+	w.GlobalSeqNo = seqNo
+	return w
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureShard(t *testing.T) {
+	conf := testConf()
+	result, err := MeasureShard("bench", "cpu.0", conf, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Writes == 0 || result.Reads == 0 || result.Reads%uint64(conf.ReadBatch) != 0 {
+		t.Fatalf("Benchmark made no progress: %v", result)
+	}
+	if result.WritesPerSecond() <= 0 || result.ReadsPerSecond() <= 0 {
+		t.Fatalf("Benchmark reported no throughput: %v", result)
+	}
+
+	conf.ReadBatch = 0
+	if _, err := MeasureShard("bench", "cpu.0", conf, time.Millisecond); err == nil {
+		t.Fatal("Benchmark without batches should fail.")
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// tokenPeriod is how often the budgets of accounts are renewed.
+const tokenPeriod = time.Hour
+
+var (
+	errNoTokens        = errors.New("frontend issues no tokens")
+	errUnknownAccount  = errors.New("unknown token account")
+	errTokenKeyChanged = errors.New("token key has changed")
+)
+
+// tokens issues the write tokens of a frontend to accounts within their
+// budgets, and recognizes tokens which have already been spent. Tokens are
+// issued with the first of its keys, which clients pin, and tokens of any of
+// them are spent, so operators can replace the key clients are issued with.
+//
+// A token is bound to the key it is signed with, and is good only while that
+// key is configured. The nonces spent with each key are kept in a file of
+// the spent directory, named by its ID, and read back on start, so tokens
+// can't be spent again after a restart. Once a key is no longer configured,
+// none of its tokens are accepted, and its file is removed.
+type tokens struct {
+	accounts map[string]int
+	signers  []*common.TokenSigner
+
+	mu      sync.Mutex
+	spent   []*spentSet    // By signer
+	issued  map[string]int // By account, this period
+	renewed time.Time
+}
+
+// spentSet is the nonces spent with a key, and the file they are appended to.
+type spentSet struct {
+	nonces map[[32]byte]bool
+	file   *os.File
+}
+
+// spentPrefix starts the names of the files of spent nonces.
+const spentPrefix = "spent-"
+
+func newTokens(accounts map[string]int, signers []*common.TokenSigner, dir string) (*tokens, error) {
+	if len(signers) == 0 {
+		return nil, errors.New("no token keys")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	t := &tokens{accounts: accounts, signers: signers}
+	live := make(map[string]bool)
+	t.spent = make([]*spentSet, len(signers))
+	for i, signer := range signers {
+		id := signer.Key().ID()
+		name := spentPrefix + hex.EncodeToString(id[:])
+		set, err := openSpentSet(filepath.Join(dir, name))
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.spent[i] = set
+		live[name] = true
+	}
+	if err := retireSpentSets(dir, live); err != nil {
+		t.close()
+		return nil, err
+	}
+	t.renew()
+	return t, nil
+}
+
+// openSpentSet reads the nonces spent with a key, and opens its file to
+// append those spent next. A nonce cut short as it was written was never
+// accepted, and is dropped.
+func openSpentSet(path string) (*spentSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	whole := len(data) - len(data)%32
+	set := &spentSet{nonces: make(map[[32]byte]bool, whole/32)}
+	for i := 0; i < whole; i += 32 {
+		var nonce [32]byte
+		copy(nonce[:], data[i:])
+		set.nonces[nonce] = true
+	}
+	if set.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	if err = set.file.Truncate(int64(whole)); err == nil {
+		_, err = set.file.Seek(int64(whole), io.SeekStart)
+	}
+	if err != nil {
+		set.file.Close()
+		return nil, err
+	}
+	return set, nil
+}
+
+// retireSpentSets removes the files of spent nonces of keys no longer
+// configured, whose tokens are no longer accepted.
+func retireSpentSets(dir string, live map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if name := file.Name(); strings.HasPrefix(name, spentPrefix) && !live[name] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add marks a nonce spent, once it is kept in the file of the set.
+func (s *spentSet) add(nonce [32]byte) error {
+	if _, err := s.file.Write(nonce[:]); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.nonces[nonce] = true
+	return nil
+}
+
+// issue signs the blinded tokens of an account, if they are blinded for the
+// current key and within its budget.
+func (t *tokens) issue(args *common.IssueTokensArgs, reply *common.IssueTokensReply) error {
+	budget, ok := t.accounts[args.Account]
+	if !ok {
+		return errUnknownAccount
+	}
+	if len(args.Blinded) > common.MaxTokensPerIssue {
+		return fmt.Errorf("%d tokens exceed %d per request", len(args.Blinded), common.MaxTokensPerIssue)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maybeRenew()
+	signer := t.signers[0]
+	reply.Key = signer.Key()
+	if len(args.Blinded) == 0 {
+		return nil
+	}
+	if args.KeyID != signer.Key().ID() {
+		return errTokenKeyChanged
+	}
+	if t.issued[args.Account]+len(args.Blinded) > budget {
+		return fmt.Errorf("account is issued %d tokens per %v", budget, tokenPeriod)
+	}
+	signatures := make([][]byte, len(args.Blinded))
+	for i, blinded := range args.Blinded {
+		sig, err := signer.SignBlinded(blinded)
+		if err != nil {
+			return err
+		}
+		signatures[i] = sig
+	}
+	t.issued[args.Account] += len(args.Blinded)
+	reply.Signatures = signatures
+	return nil
+}
+
+// spend checks a token is signed with a current key and unspent, and marks
+// it spent.
+func (t *tokens) spend(token *common.Token) bool {
+	if token == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maybeRenew()
+	for i, signer := range t.signers {
+		if !signer.Key().Verify(token) {
+			continue
+		}
+		if t.spent[i].nonces[token.Nonce] {
+			return false
+		}
+		// A token whose spending can't be kept is refused, so it is never
+		// accepted twice.
+		return t.spent[i].add(token.Nonce) == nil
+	}
+	return false
+}
+
+// maybeRenew renews the budgets of accounts once their period is over. Must
+// be called with the lock held.
+func (t *tokens) maybeRenew() {
+	if time.Since(t.renewed) >= tokenPeriod {
+		t.renew()
+	}
+}
+
+// close closes the files of spent nonces.
+func (t *tokens) close() {
+	for _, set := range t.spent {
+		if set != nil {
+			set.file.Close()
+		}
+	}
+}
+
+func (t *tokens) renew() {
+	t.issued = make(map[string]int)
+	t.renewed = time.Now()
+}
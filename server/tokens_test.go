@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// issueToken has a frontend issue a token to an account.
+func issueToken(f *Frontend, account string) (*common.Token, string) {
+	current := &common.IssueTokensReply{}
+	f.IssueTokens(&common.IssueTokensArgs{Account: account}, current)
+	if current.Err != "" {
+		return nil, current.Err
+	}
+	blind, err := current.Key.Blind(rand.Reader)
+	if err != nil {
+		return nil, err.Error()
+	}
+	reply := &common.IssueTokensReply{}
+	f.IssueTokens(&common.IssueTokensArgs{Account: account, KeyID: current.Key.ID(), Blinded: [][]byte{blind.Blinded}}, reply)
+	if reply.Err != "" {
+		return nil, reply.Err
+	}
+	token, err := blind.Unblind(reply.Signatures[0])
+	if err != nil {
+		return nil, err.Error()
+	}
+	return token, ""
+}
+
+// writeTokenKeys writes n token keys to PEM files in dir.
+func writeTokenKeys(t *testing.T, dir string, n int) []string {
+	files := make([]string, n)
+	for i := range files {
+		key, err := rsa.GenerateKey(rand.Reader, common.TokenKeyBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = filepath.Join(dir, fmt.Sprintf("token%d.pem", i))
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(files[i], encoded, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestFrontendTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talektokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverConfig := &Config{
+		Config:        testDB(),
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+		TokenAccounts: map[string]int{"alice": 2, "bob": 1},
+		TokenKeyFiles: writeTokenKeys(t, dir, 2),
+		TokenSpentDir: filepath.Join(dir, "spent"),
+	}
+	back := &mockReplica{}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	args := &common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello")}
+	reply := &common.WriteReply{}
+	f.Write(args, reply)
+	if reply.Err != common.ErrTokenRequired.Error() || len(back.calls) != 0 {
+		t.Fatalf("Write without a token should be turned away, got %+v", reply)
+	}
+
+	token, issueErr := issueToken(f, "alice")
+	if issueErr != "" {
+		t.Fatalf("Token was not issued: %v", issueErr)
+	}
+	args.Token = token
+	spent := *args
+	reply = &common.WriteReply{}
+	f.Write(args, reply)
+	if reply.Err != "" || reply.GlobalSeqNo != 1 {
+		t.Fatalf("Write with a token failed: %+v", reply)
+	}
+
+	// A replay of the write in its epoch is dropped as a duplicate, and in
+	// later epochs, a token is good for one write.
+	calls := len(back.calls)
+	duplicate := &common.WriteReply{}
+	f.Write(&spent, duplicate)
+	if duplicate.GlobalSeqNo != 1 || len(back.calls) != calls {
+		t.Fatalf("Duplicate write was made again: %+v", duplicate)
+	}
+	f.writeContents.forget()
+	reply = &common.WriteReply{}
+	f.Write(&spent, reply)
+	if reply.Err != common.ErrTokenRequired.Error() {
+		t.Fatalf("A spent token was accepted: %+v", reply)
+	}
+
+	// Accounts are issued tokens within their budget only.
+	if _, err := issueToken(f, "alice"); err != "" {
+		t.Fatalf("Token within budget was not issued: %v", err)
+	}
+	if _, err := issueToken(f, "alice"); err == "" {
+		t.Fatal("Token beyond the budget was issued.")
+	}
+	if _, err := issueToken(f, "mallory"); err != errUnknownAccount.Error() {
+		t.Fatalf("Token was issued to an unknown account: %v", err)
+	}
+
+	// Tokens of every configured key are accepted, and budgets renewed.
+	previous := f.tokens.signers[1]
+	blind, _ := previous.Key().Blind(rand.Reader)
+	sig, _ := previous.SignBlinded(blind.Blinded)
+	token, _ = blind.Unblind(sig)
+	reply = &common.WriteReply{}
+	f.Write(&common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: []byte("hello"), Token: token}, reply)
+	if reply.Err != "" {
+		t.Fatalf("Token of another configured key was not accepted: %+v", reply)
+	}
+	issueToken(f, "bob")
+	if _, err := issueToken(f, "bob"); err == "" {
+		t.Fatal("Token beyond the budget was issued.")
+	}
+	f.tokens.mu.Lock()
+	f.tokens.renewed = time.Time{}
+	f.tokens.mu.Unlock()
+	if _, err := issueToken(f, "bob"); err != "" {
+		t.Fatalf("Budget was not renewed: %v", err)
+	}
+}
+
+func TestTokensPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talektokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signers := make([]*common.TokenSigner, 2)
+	for i, file := range writeTokenKeys(t, dir, 2) {
+		if signers[i], err = common.LoadTokenSigner(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spentDir := filepath.Join(dir, "spent")
+	spend := func(signer *common.TokenSigner) *common.Token {
+		blind, _ := signer.Key().Blind(rand.Reader)
+		sig, _ := signer.SignBlinded(blind.Blinded)
+		token, _ := blind.Unblind(sig)
+		return token
+	}
+
+	tk, err := newTokens(nil, signers, spentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := spend(signers[0]), spend(signers[1])
+	if !tk.spend(first) || !tk.spend(second) {
+		t.Fatal("Unspent tokens were refused.")
+	}
+	tk.close()
+
+	// Tokens spent before a restart stay spent, and a nonce cut short as it
+	// was written is dropped.
+	file := filepath.Join(spentDir, spentPrefix+fmt.Sprintf("%x", first.KeyID))
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	if tk, err = newTokens(nil, signers, spentDir); err != nil {
+		t.Fatal(err)
+	}
+	if tk.spend(first) || tk.spend(second) {
+		t.Fatal("Tokens spent before a restart were accepted again.")
+	}
+	third := spend(signers[0])
+	if !tk.spend(third) {
+		t.Fatal("Unspent token was refused after a restart.")
+	}
+	tk.close()
+	if info, err := os.Stat(file); err != nil || info.Size() != 64 {
+		t.Fatalf("File of spent nonces should hold 2, got %v, %v", info, err)
+	}
+
+	// Once a key is retired, its tokens are refused and its nonces dropped.
+	if tk, err = newTokens(nil, signers[:1], spentDir); err != nil {
+		t.Fatal(err)
+	}
+	defer tk.close()
+	if tk.spend(spend(signers[1])) {
+		t.Fatal("Token of a retired key was accepted.")
+	}
+	if files, _ := ioutil.ReadDir(spentDir); len(files) != 1 {
+		t.Fatalf("Nonces of the retired key should be dropped, %d files remain", len(files))
+	}
+}
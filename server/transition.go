@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+)
+
+// errTransitionStaged turns away a transition while another is staged or
+// crossing over.
+var errTransitionStaged = errors.New("another transition is in progress")
+
+// generations tracks the common configurations requests are accepted under:
+// that of the generation in use, and through the crossover of a transition,
+// the one before it.
+type generations struct {
+	lock       sync.Mutex
+	generation uint64
+	config     *common.Config
+	previous   *common.Config           // Until the crossover ends, or nil
+	transition *common.ConfigTransition // Staged or crossing over, or nil
+}
+
+func newGenerations(config *common.Config) *generations {
+	return &generations{config: config}
+}
+
+// stage records a transition from the generation in use. Staging the same
+// transition again, as replicas are told of it every epoch, changes nothing.
+func (g *generations) stage(t *common.ConfigTransition) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.transition != nil {
+		if *g.transition == *t {
+			return nil
+		}
+		return errTransitionStaged
+	}
+	if err := t.Validate(g.config, g.generation); err != nil {
+		return err
+	}
+	staged := *t
+	g.transition = &staged
+	return nil
+}
+
+// begin moves to the generations of an epoch as it begins, and reports
+// whether the next generation came into use with it.
+func (g *generations) begin(epoch uint64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	t := g.transition
+	if t == nil {
+		return false
+	}
+	switched := false
+	if g.generation < t.Generation && epoch >= t.Epoch {
+		g.previous = g.config
+		g.config = &t.Next
+		g.generation = t.Generation
+		switched = true
+	}
+	if g.generation == t.Generation && !t.Crossing(epoch) {
+		g.previous = nil
+		g.transition = nil
+	}
+	return switched
+}
+
+// lookup returns the configuration of a generation requests are accepted
+// under, or common.ErrGeneration.
+func (g *generations) lookup(generation uint64) (*common.Config, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if generation == g.generation {
+		return g.config, nil
+	}
+	if g.previous != nil && generation+1 == g.generation {
+		return g.previous, nil
+	}
+	return nil, common.ErrGeneration
+}
+
+// current returns the generation in use, its configuration, and the
+// transition staged or crossing over, if any.
+func (g *generations) current() (uint64, *common.Config, *common.ConfigTransition) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.generation, g.config, g.transition
+}
+
+// limits returns the limits of the args accepted under any generation
+// requests are accepted under, or are about to be.
+func (g *generations) limits() common.ArgsLimits {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	limits := common.NewArgsLimits(g.config)
+	if g.previous != nil {
+		limits.Widen(g.previous)
+	}
+	if g.transition != nil {
+		limits.Widen(&g.transition.Next)
+	}
+	return limits
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// transitionDB is a valid database for transitions, whose next generation
+// has items twice the size.
+func transitionDB() (*common.Config, common.Config) {
+	config := &common.Config{
+		NumBuckets:         64,
+		BucketDepth:        2,
+		DataSize:           64,
+		BloomFalsePositive: 0.05,
+		WriteInterval:      time.Minute,
+		ReadInterval:       time.Minute,
+		MaxLoadFactor:      0.95,
+	}
+	next := *config
+	next.DataSize *= 2
+	return config, next
+}
+
+func TestGenerations(t *testing.T) {
+	config, next := transitionDB()
+	g := newGenerations(config)
+	transition := &common.ConfigTransition{Generation: 1, Epoch: 5, Crossover: 2, Next: next}
+
+	changed := *transition
+	changed.Next.NumBuckets++
+	if g.stage(&changed) == nil {
+		t.Fatal("Transition moving the buckets of topics staged.")
+	}
+	if err := g.stage(transition); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.stage(transition); err != nil {
+		t.Fatalf("Staging the same transition again failed: %v", err)
+	}
+	changed = *transition
+	changed.Crossover++
+	if g.stage(&changed) != errTransitionStaged {
+		t.Fatal("Second transition staged while one is in progress.")
+	}
+
+	for epoch := uint64(1); epoch < transition.Epoch; epoch++ {
+		if g.begin(epoch) {
+			t.Fatalf("Transition began in epoch %d.", epoch)
+		}
+	}
+	if _, err := g.lookup(1); err != common.ErrGeneration {
+		t.Fatal("Next generation accepted before its epoch.")
+	}
+	if !g.begin(5) {
+		t.Fatal("Transition didn't begin in its epoch.")
+	}
+	if conf, err := g.lookup(1); err != nil || conf.DataSize != next.DataSize {
+		t.Fatalf("Next generation not in use: %v", err)
+	}
+	// Both generations are accepted through the crossover.
+	for epoch := uint64(5); epoch < 7; epoch++ {
+		g.begin(epoch)
+		if conf, err := g.lookup(0); err != nil || conf.DataSize != config.DataSize {
+			t.Fatalf("Previous generation not accepted in epoch %d: %v", epoch, err)
+		}
+	}
+	g.begin(7)
+	if _, err := g.lookup(0); err != common.ErrGeneration {
+		t.Fatal("Previous generation accepted after the crossover.")
+	}
+	if generation, _, staged := g.current(); generation != 1 || staged != nil {
+		t.Fatalf("Generation %d with %v staged after the transition", generation, staged)
+	}
+}
+
+// transitionReplica records the generations of what the frontend sends it.
+type transitionReplica struct {
+	mockReplica
+	transitions chan *common.ConfigTransition
+	generations chan uint64
+}
+
+func (m *transitionReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag {
+		m.transitions <- args.Transition
+	}
+	return nil
+}
+
+func (m *transitionReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	m.generations <- args.Generation
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	return nil
+}
+
+func TestFrontendTransition(t *testing.T) {
+	config, next := transitionDB()
+	config.InterestMultiple = 2
+	next.InterestMultiple = 2
+	back := &transitionReplica{transitions: make(chan *common.ConfigTransition, 16), generations: make(chan uint64, 16)}
+	f := NewFrontend("testing", &Config{
+		Config:        config,
+		ReadBatch:     1,
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}, []common.ReplicaInterface{back})
+	defer f.Close()
+
+	transition := &common.ConfigTransition{Generation: 1, Epoch: 2, Crossover: 1, Next: next}
+	reply := &common.TransitionReply{}
+	if f.StageTransition(transition, reply); reply.Err == "" {
+		t.Fatal("Transition staged too soon for clients to learn of it.")
+	}
+	transition.Epoch = 3
+	reply = &common.TransitionReply{}
+	if f.StageTransition(transition, reply); reply.Err != "" {
+		t.Fatal(reply.Err)
+	}
+	updates := &common.GetUpdatesReply{}
+	f.GetUpdates(nil, updates)
+	if updates.Transition == nil || *updates.Transition != *transition || updates.Generation != 0 {
+		t.Fatalf("Transition not announced: %+v", updates)
+	}
+
+	write := func(generation uint64, size uint64) string {
+		reply := &common.WriteReply{}
+		f.Write(&common.WriteArgs{Data: make([]byte, size), Generation: generation}, reply)
+		return reply.Err
+	}
+	if err := write(1, next.DataSize); err != common.ErrGeneration.Error() {
+		t.Fatalf("Write of the next generation accepted early: %q", err)
+	}
+	for epoch := 0; epoch < 3; epoch++ {
+		f.advanceEpoch()
+		if staged := <-back.transitions; staged == nil || *staged != *transition {
+			t.Fatalf("Transition not sent to replicas with epoch %d.", epoch)
+		}
+	}
+
+	// Epoch 3 is of the next generation, and crosses over.
+	f.GetUpdates(nil, updates)
+	if updates.Epoch != 3 || updates.Generation != 1 {
+		t.Fatalf("Generation %d in epoch %d", updates.Generation, updates.Epoch)
+	}
+	conf := &common.Config{}
+	if f.GetConfig(nil, conf); conf.DataSize != next.DataSize {
+		t.Fatalf("Frontend configured with items of %d bytes", conf.DataSize)
+	}
+	if err := write(1, next.DataSize); err != "" {
+		t.Fatalf("Write of the next generation refused: %q", err)
+	}
+	if err := write(0, config.DataSize); err != "" {
+		t.Fatalf("Write of the previous generation refused in the crossover: %q", err)
+	}
+	if err := write(0, next.DataSize); err == "" {
+		t.Fatal("Write of the previous generation accepted with items of the next.")
+	}
+	for _, generation := range []uint64{0, 1} {
+		readReply := &common.ReadReply{}
+		f.Read(&common.EncodedReadArgs{PirArgs: make([][]byte, 1), Generation: generation}, readReply)
+		if readReply.Err != "" {
+			t.Fatalf("Read of generation %d failed: %v", generation, readReply.Err)
+		}
+		if read := <-back.generations; read != generation {
+			t.Fatalf("Read of generation %d made of generation %d", generation, read)
+		}
+	}
+
+	f.advanceEpoch()
+	<-back.transitions
+	if err := write(0, config.DataSize); err != common.ErrGeneration.Error() {
+		t.Fatalf("Write of the previous generation accepted after the crossover: %q", err)
+	}
+	f.advanceEpoch()
+	if staged := <-back.transitions; staged != nil {
+		t.Fatal("Transition still sent to replicas after it ended.")
+	}
+}
+
+func TestReplicaTransition(t *testing.T) {
+	conf := testConf()
+	r := NewReplica("t0", "cpu.0", conf)
+	defer r.Close()
+	next := *conf.Config
+	next.DataSize *= 2
+	next.WriteInterval, next.ReadInterval = time.Second, time.Second
+	transition := &common.ConfigTransition{Generation: 1, Epoch: 1, Crossover: 1, Next: next}
+
+	write := func(args *common.ReplicaWriteArgs) string {
+		reply := &common.ReplicaWriteReply{}
+		if err := r.Write(args, reply); err != nil {
+			return err.Error()
+		}
+		return reply.Err
+	}
+	rowSize := func(generation uint64, epoch uint64) int {
+		reply := &common.BatchReadReply{}
+		r.BatchRead(&common.BatchReadRequest{Args: make([]common.EncodedReadArgs, 1), Generation: generation, Epoch: epoch}, reply)
+		if reply.Err != "" {
+			return -1
+		}
+		return len(reply.Replies[0].Data)
+	}
+	if rowSize(1, 0) != -1 {
+		t.Fatal("Next generation read before its epoch.")
+	}
+	before := rowSize(0, 0)
+
+	// The transition begins with the epoch after the one it is sent with.
+	write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 0, EpochRoot: common.MerkleRoot(nil), Transition: transition})
+	if after := rowSize(1, 1); after != 2*before {
+		t.Fatalf("Rows of the next generation are %d bytes rather than %d", after, 2*before)
+	}
+	if rowSize(0, 1) != before {
+		t.Fatal("Previous generation not read from in the crossover.")
+	}
+	big := common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: make([]byte, next.DataSize), GlobalSeqNo: 1, Generation: 1}
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: big}); err != "" {
+		t.Fatalf("Write of the next generation refused: %q", err)
+	}
+	small := common.WriteArgs{Bucket1: 1, Bucket2: 2, Data: make([]byte, conf.DataSize), GlobalSeqNo: 2}
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: small}); err != "" {
+		t.Fatalf("Write of the previous generation refused in the crossover: %q", err)
+	}
+	big.Generation, big.GlobalSeqNo = 0, 3
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: big}); err == "" {
+		t.Fatal("Write of the previous generation accepted with items of the next.")
+	}
+
+	write(&common.ReplicaWriteArgs{EpochFlag: true, Epoch: 1, Transition: transition})
+	if rowSize(0, 2) != -1 {
+		t.Fatal("Previous generation read from after the crossover.")
+	}
+	small.GlobalSeqNo = 4
+	if err := write(&common.ReplicaWriteArgs{WriteArgs: small}); err != common.ErrGeneration.Error() {
+		t.Fatalf("Write of the previous generation accepted after the crossover: %q", err)
+	}
+}
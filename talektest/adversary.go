@@ -0,0 +1,119 @@
+package talektest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/rpc"
+	"github.com/gorilla/rpc/json"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/server"
+)
+
+// Adversary makes the replica of a trust domain misbehave, so that the
+// detection of clients and the robustness of the protocol can be exercised
+// end to end. It only ever runs in a topology. Zero fields leave that part of
+// the replica honest.
+type Adversary struct {
+	// Fraction of replies to reads whose data is corrupted, from 0 to 1.
+	CorruptFraction float64
+	// Buckets whose writes are withheld: acknowledged to the frontend, but
+	// never stored or committed to by the replica.
+	WithholdBuckets []uint64
+	// Delay added to each batch of reads, and up to how much more is added
+	// at random, skewing the timing of the trust domain.
+	Skew   time.Duration
+	Jitter time.Duration
+	// Seeds the choices of the adversary, so runs can be repeated.
+	Seed int64
+}
+
+// AdversaryStats counts what an adversarial replica has done.
+type AdversaryStats struct {
+	Corrupted uint64 // Replies corrupted
+	Withheld  uint64 // Writes withheld
+	Delayed   uint64 // Batches of reads delayed
+}
+
+// adversarialReplica serves a replica as the "Replica" RPC service, with the
+// writes and reads of the adversary intercepted. Other methods are those of
+// the replica.
+type adversarialReplica struct {
+	*server.Replica
+	adversary Adversary
+	withhold  map[uint64]bool
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats AdversaryStats
+}
+
+func newAdversarialReplica(r *server.Replica, adversary Adversary) *adversarialReplica {
+	a := &adversarialReplica{
+		Replica:   r,
+		adversary: adversary,
+		withhold:  make(map[uint64]bool),
+		rand:      rand.New(rand.NewSource(adversary.Seed)),
+	}
+	for _, b := range adversary.WithholdBuckets {
+		a.withhold[b] = true
+	}
+	return a
+}
+
+// serve replaces the RPC service of a replica server with the adversary.
+func (a *adversarialReplica) serve(r *server.ReplicaServer) {
+	r.Server = rpc.NewServer()
+	r.Server.RegisterCodec(json.NewCodec(), "application/json")
+	r.Server.RegisterTCPService(a, "Replica")
+}
+
+// Write withholds writes to targeted buckets, acknowledging them as applied.
+func (a *adversarialReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if !args.InterestFlag && !args.EpochFlag && (a.withhold[args.Bucket1] || a.withhold[args.Bucket2]) {
+		a.mu.Lock()
+		a.stats.Withheld++
+		a.mu.Unlock()
+		reply.GlobalSeqNo = args.GlobalSeqNo
+		return nil
+	}
+	return a.Replica.Write(args, reply)
+}
+
+// BatchRead answers reads late, and with some replies corrupted.
+func (a *adversarialReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	a.mu.Lock()
+	delay := a.adversary.Skew
+	if a.adversary.Jitter > 0 {
+		delay += time.Duration(a.rand.Int63n(int64(a.adversary.Jitter)))
+	}
+	if delay > 0 {
+		a.stats.Delayed++
+	}
+	a.mu.Unlock()
+	time.Sleep(delay)
+
+	if err := a.Replica.BatchRead(args, reply); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range reply.Replies {
+		data := reply.Replies[i].Data
+		if reply.Replies[i].Err != "" || len(data) == 0 || a.rand.Float64() >= a.adversary.CorruptFraction {
+			continue
+		}
+		data[a.rand.Intn(len(data))] ^= byte(1 + a.rand.Intn(255))
+		a.stats.Corrupted++
+	}
+	return nil
+}
+
+// Stats reports what the adversary has done so far.
+func (a *adversarialReplica) Stats() AdversaryStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
@@ -0,0 +1,124 @@
+package talektest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/libtalek"
+)
+
+func TestAdversaryCorruption(t *testing.T) {
+	config := DefaultConfig()
+	config.VerifyBuckets = true
+	top, err := Start(Options{Config: config, Adversaries: map[int]Adversary{1: {CorruptFraction: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+
+	reader := top.NewClient("reader")
+	if reader == nil {
+		t.Fatal("Could not create client.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	updates := reader.Poll(&handle)
+
+	// Every reply of the corrupt trust domain fails verification, and none
+	// is delivered.
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case msg := <-updates:
+			t.Fatalf("Read %q of a corrupt trust domain", msg)
+		case e := <-reader.Events():
+			if e.Kind != libtalek.EventUnverified {
+				continue
+			}
+			if stats, _ := top.AdversaryStats(1); stats.Corrupted == 0 {
+				t.Fatal("Reads failed to verify with no replies corrupted.")
+			}
+			return
+		case <-timeout:
+			t.Fatal("Corrupt replies were not detected.")
+		}
+	}
+}
+
+func TestAdversaryWithholding(t *testing.T) {
+	withhold := make([]uint64, DefaultConfig().NumBuckets)
+	for i := range withhold {
+		withhold[i] = uint64(i)
+	}
+	top, err := Start(Options{Adversaries: map[int]Adversary{1: {WithholdBuckets: withhold}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+
+	writer := top.NewClient("writer")
+	reader := top.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatal("Could not create clients.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("withheld")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	select {
+	case msg := <-reader.Poll(&handle):
+		t.Fatalf("Read %q withheld by a trust domain", msg)
+	case <-time.After(2 * time.Second):
+	}
+	if stats, _ := top.AdversaryStats(1); stats.Withheld == 0 {
+		t.Fatal("No writes were withheld.")
+	}
+	if _, ok := top.AdversaryStats(0); ok {
+		t.Fatal("Honest trust domain reported as an adversary.")
+	}
+}
+
+func TestAdversarySkew(t *testing.T) {
+	top, err := Start(Options{Adversaries: map[int]Adversary{0: {Skew: 50 * time.Millisecond, Jitter: 50 * time.Millisecond, Seed: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+
+	writer := top.NewClient("writer")
+	reader := top.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatal("Could not create clients.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	// A slow trust domain delays reads, but doesn't lose them.
+	select {
+	case msg := <-reader.Poll(&handle):
+		if string(msg) != "late" {
+			t.Fatalf("Read %q", msg)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Message was not read back from a skewed trust domain.")
+	}
+	if stats, _ := top.AdversaryStats(0); stats.Delayed == 0 {
+		t.Fatal("No reads were delayed.")
+	}
+}
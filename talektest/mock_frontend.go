@@ -0,0 +1,294 @@
+package talektest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/cuckoo"
+	"github.com/privacylab/talek/libtalek"
+)
+
+// MockOptions configure a mock frontend. Zero fields take defaults suited to
+// tests.
+type MockOptions struct {
+	// How many trust domains clients encode reads for. Default 2.
+	TrustDomains int
+	// The common configuration. Default DefaultConfig.
+	Config *common.Config
+	// How often clients write and read. Default 100ms.
+	Interval time.Duration
+	// How long each read and write takes. Default none.
+	Latency time.Duration
+	// How many items are held before the oldest are evicted. Default the
+	// items of the table at its MaxLoadFactor.
+	Capacity int
+}
+
+// MockFrontend answers clients from memory, as a frontend and its replicas
+// would together, but without PIR: it holds the private keys of every trust
+// domain, and computes the reply of each to a read directly from a cuckoo
+// table of the writes it was sent. Applications can point libtalek at it to
+// build against talek without running servers. It implements
+// common.FrontendInterface.
+type MockFrontend struct {
+	Config       *common.Config
+	TrustDomains []*common.TrustDomainConfig // Public records, as given to clients
+
+	private  []*common.TrustDomainConfig
+	interval time.Duration
+	latency  time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	table   *cuckoo.Table
+	data    []byte
+	entries []cuckoo.Item // Held items, oldest first, without data
+	seqNo   uint64
+	clients []*libtalek.Client
+}
+
+var (
+	// errNoCommitments answers GetCommitment, as the mock commits to no epochs.
+	errNoCommitments = errors.New("mock frontend commits to no epochs")
+	// errNoTokens answers IssueTokens, as the mock takes writes without tokens.
+	errNoTokens = errors.New("mock frontend issues no tokens")
+)
+
+// NewMockFrontend creates an empty mock frontend.
+func NewMockFrontend(opts MockOptions) (*MockFrontend, error) {
+	if opts.TrustDomains <= 0 {
+		opts.TrustDomains = 2
+	}
+	if opts.Config == nil {
+		opts.Config = DefaultConfig()
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.Capacity <= 0 {
+		opts.Capacity = int(float64(opts.Config.NumBuckets*opts.Config.BucketDepth) * opts.Config.MaxLoadFactor)
+	}
+	if err := opts.Config.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Config.VerifyBuckets {
+		return nil, errors.New("mock frontend does not commit to buckets")
+	}
+
+	conf := opts.Config
+	m := &MockFrontend{
+		Config:   conf,
+		interval: opts.Interval,
+		latency:  opts.Latency,
+		capacity: opts.Capacity,
+	}
+	m.data = make([]byte, conf.NumBuckets*conf.BucketDepth*conf.DataSize)
+	m.table = cuckoo.NewTable("mock", conf.NumBuckets, conf.BucketDepth, conf.DataSize, m.data, 0)
+	if m.table == nil {
+		return nil, fmt.Errorf("could not create a table of %d buckets", conf.NumBuckets)
+	}
+	strategy, err := common.NewBucketStrategy(conf.BucketStrategy)
+	if err != nil {
+		return nil, err
+	}
+	m.table.SetStrategy(strategy)
+	for i := 0; i < opts.TrustDomains; i++ {
+		td := common.NewTrustDomainConfig(fmt.Sprintf("mock%d", i), "", true, false)
+		m.private = append(m.private, td)
+		m.TrustDomains = append(m.TrustDomains, &common.TrustDomainConfig{
+			Name:          td.Name,
+			IsValid:       true,
+			PublicKey:     td.PublicKey,
+			SignPublicKey: td.SignPublicKey,
+		})
+	}
+	return m, nil
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// ClientConfig is the configuration of clients of the mock.
+func (m *MockFrontend) ClientConfig() libtalek.ClientConfig {
+	return libtalek.ClientConfig{
+		Config:        m.Config,
+		WriteInterval: m.interval,
+		ReadInterval:  m.interval,
+		TrustDomains:  m.TrustDomains,
+	}
+}
+
+// NewClient creates a client of the mock. It is killed when the mock is
+// closed.
+func (m *MockFrontend) NewClient(name string) *libtalek.Client {
+	c := libtalek.NewClient(name, m.ClientConfig(), m)
+	if c == nil {
+		return nil
+	}
+	m.mu.Lock()
+	m.clients = append(m.clients, c)
+	m.mu.Unlock()
+	return c
+}
+
+// Close kills the clients of the mock.
+func (m *MockFrontend) Close() {
+	m.mu.Lock()
+	clients := m.clients
+	m.clients = nil
+	m.mu.Unlock()
+	for _, c := range clients {
+		c.Kill()
+	}
+}
+
+// Len is the number of items the mock holds.
+func (m *MockFrontend) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// GetName exports the name of the mock.
+func (m *MockFrontend) GetName(args *interface{}, reply *string) error {
+	*reply = "mock"
+	return nil
+}
+
+// GetConfig returns the common configuration of the mock.
+func (m *MockFrontend) GetConfig(args *interface{}, reply *common.Config) error {
+	*reply = *m.Config
+	return nil
+}
+
+// Write places an item in the table, evicting the oldest to make room.
+func (m *MockFrontend) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	time.Sleep(m.latency)
+	if common.Expired(args.Deadline) {
+		reply.Err = common.ErrDeadlineExceeded.Error()
+		return nil
+	}
+	if err := args.Validate(m.Config); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seqNo++
+	// Items fill their slot, zero padded.
+	data := make([]byte, m.Config.DataSize)
+	copy(data, args.Data)
+	itm := &cuckoo.Item{ID: m.seqNo, Data: data, Bucket1: args.Bucket1, Bucket2: args.Bucket2}
+	if m.table.Full(itm) {
+		if old := m.table.EvictOldest(itm); old != nil {
+			m.forget(old.ID)
+		}
+	}
+	for len(m.entries) >= m.capacity {
+		m.table.Remove(&m.entries[0])
+		m.entries = m.entries[1:]
+	}
+	ok, evicted := m.table.Insert(itm)
+	if ok {
+		m.entries = append(m.entries, cuckoo.Item{ID: itm.ID, Bucket1: itm.Bucket1, Bucket2: itm.Bucket2})
+	}
+	// An item left without a place is dropped, as the oldest would be.
+	if evicted != nil {
+		m.forget(evicted.ID)
+	}
+	reply.GlobalSeqNo = m.seqNo
+	return nil
+}
+
+// Read answers a read with the combined replies of every trust domain.
+func (m *MockFrontend) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	time.Sleep(m.latency)
+	if common.Expired(args.Deadline) {
+		reply.Err = common.ErrDeadlineExceeded.Error()
+		return nil
+	}
+	if err := args.Validate(m.Config, len(m.private)); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	pad, err := common.NewPad(m.Config.PadAlgorithm)
+	if err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+
+	bucketSize := m.Config.BucketDepth * m.Config.DataSize
+	reply.Data = make([]byte, bucketSize)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, td := range m.private {
+		pir, err := args.Decode(i, td)
+		if err == nil {
+			err = pir.Validate(m.Config)
+		}
+		if err != nil {
+			reply.Data = nil
+			reply.Err = err.Error()
+			reply.FailedDomains = []int{i}
+			return nil
+		}
+		// The reply of a trust domain is the xor of the buckets it was asked
+		// for, padded.
+		part := make([]byte, bucketSize)
+		for b := uint64(0); b < m.Config.NumBuckets; b++ {
+			if pir.RequestVector[b/8]&(1<<(b%8)) == 0 {
+				continue
+			}
+			bucket := m.data[b*bucketSize : (b+1)*bucketSize]
+			for j := range part {
+				part[j] ^= bucket[j]
+			}
+		}
+		if err := pad.Overlay(pir.PadSeed, part); err != nil {
+			reply.Data = nil
+			reply.Err = err.Error()
+			return nil
+		}
+		reply.Combine(part)
+	}
+
+	start := uint64(1)
+	if window := uint64(m.Config.WindowSize()); m.seqNo+1 > window {
+		start = m.seqNo + 1 - window
+	}
+	reply.GlobalSeqNo = common.Range{Start: start, End: m.seqNo + 1}
+	return nil
+}
+
+// GetUpdates provides no interest vector; clients read without one.
+func (m *MockFrontend) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpdatesReply) error {
+	return nil
+}
+
+// GetCommitment fails, as the mock commits to no epochs.
+func (m *MockFrontend) GetCommitment(args *common.GetCommitmentArgs, reply *common.GetCommitmentReply) error {
+	reply.Err = errNoCommitments.Error()
+	return nil
+}
+
+// IssueTokens fails, as the mock takes writes without tokens.
+func (m *MockFrontend) IssueTokens(args *common.IssueTokensArgs, reply *common.IssueTokensReply) error {
+	reply.Err = errNoTokens.Error()
+	return nil
+}
+
+/** PRIVATE METHODS **/
+
+// forget drops the entry of an item removed from the table. Must be called
+// with the lock held.
+func (m *MockFrontend) forget(id uint64) {
+	for i := range m.entries {
+		if m.entries[i].ID == id {
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package talektest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+)
+
+func TestMockFrontendRoundTrip(t *testing.T) {
+	mock, err := NewMockFrontend(MockOptions{Latency: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	writer := mock.NewClient("writer")
+	reader := mock.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatal("Could not create clients.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("hello mock")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	updates := reader.Poll(&handle)
+	select {
+	case msg := <-updates:
+		if string(msg) != "hello mock" {
+			t.Fatalf("Read %q", msg)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Message was not read back.")
+	}
+}
+
+func TestMockFrontendCapacity(t *testing.T) {
+	mock, err := NewMockFrontend(MockOptions{Capacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 50; i++ {
+		reply := common.WriteReply{}
+		args := &common.WriteArgs{Bucket1: i % 64, Bucket2: (i * 7) % 64, Data: []byte{byte(i)}}
+		if err := mock.Write(args, &reply); err != nil || reply.Err != "" {
+			t.Fatalf("Write failed: %v %s", err, reply.Err)
+		}
+		if reply.GlobalSeqNo != i+1 {
+			t.Fatalf("Write %d sequenced as %d", i, reply.GlobalSeqNo)
+		}
+	}
+	if mock.Len() != 10 {
+		t.Fatalf("Mock holds %d items rather than 10", mock.Len())
+	}
+
+	reply := common.WriteReply{}
+	if mock.Write(&common.WriteArgs{Bucket1: 64}, &reply); reply.Err == "" {
+		t.Fatal("Write outside the table was accepted.")
+	}
+}
@@ -0,0 +1,195 @@
+// Package talektest runs a complete talek deployment inside one process: a
+// replica with a Go PIR shard for each trust domain, and a frontend, serving
+// real RPCs over loopback. Applications can then test against talek end to end
+// without external infrastructure.
+package talektest
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/server"
+)
+
+// Options size a topology. Zero fields take defaults suited to tests.
+type Options struct {
+	// How many trust domains, each served by one replica. Default 2.
+	TrustDomains int
+	// The common configuration. Default DefaultConfig.
+	Config *common.Config
+	// How many reads each replica makes at a time. Default 4.
+	ReadBatch int
+	// How often the frontend and clients write and read. Default 100ms.
+	Interval time.Duration
+	// PIR backing of the shards. Default "cpu.0".
+	Backing string
+	// Adversaries the replicas of trust domains, by index, behave as. Others
+	// are honest.
+	Adversaries map[int]Adversary
+}
+
+// DefaultConfig is a database small enough to be read in milliseconds.
+func DefaultConfig() *common.Config {
+	return &common.Config{
+		NumBuckets:         64,
+		BucketDepth:        4,
+		DataSize:           512,
+		BloomFalsePositive: 0.05,
+		WriteInterval:      100 * time.Millisecond,
+		ReadInterval:       100 * time.Millisecond,
+		InterestMultiple:   10,
+		MaxLoadFactor:      0.95,
+		LoadFactorStep:     0.05,
+	}
+}
+
+// Topology is a running in-process deployment.
+type Topology struct {
+	Config       *common.Config
+	TrustDomains []*common.TrustDomainConfig // Public records, as given to clients
+	Replicas     []*server.ReplicaServer
+	Frontend     *server.FrontendServer
+	FrontendAddr string
+
+	interval    time.Duration
+	adversaries map[int]*adversarialReplica
+	listeners   []net.Listener
+	clients     []*libtalek.Client
+	rpcs        []*common.FrontendRPC
+}
+
+// Start runs a topology on loopback ports chosen by the OS. It must be closed
+// once no longer needed.
+func Start(opts Options) (t *Topology, err error) {
+	if opts.TrustDomains <= 0 {
+		opts.TrustDomains = 2
+	}
+	if opts.Config == nil {
+		opts.Config = DefaultConfig()
+	}
+	if opts.ReadBatch <= 0 {
+		opts.ReadBatch = 4
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.Backing == "" {
+		opts.Backing = "cpu.0"
+	}
+
+	t = &Topology{Config: opts.Config, interval: opts.Interval, adversaries: make(map[int]*adversarialReplica)}
+	defer func() {
+		if err != nil {
+			t.Close()
+			t = nil
+		}
+	}()
+
+	for i := 0; i < opts.TrustDomains; i++ {
+		name := fmt.Sprintf("td%d", i)
+		td := common.NewTrustDomainConfig(name, "", true, false)
+		r := server.NewReplicaServer(name, opts.Backing, server.Config{
+			Config:           opts.Config,
+			ReadBatch:        opts.ReadBatch,
+			WriteInterval:    opts.Interval,
+			ReadInterval:     opts.Interval,
+			TrustDomain:      td,
+			TrustDomainIndex: i,
+		})
+		if r.Replica == nil {
+			return t, fmt.Errorf("could not start replica %s", name)
+		}
+		t.Replicas = append(t.Replicas, r)
+		if adversary, ok := opts.Adversaries[i]; ok {
+			a := newAdversarialReplica(r.Replica, adversary)
+			a.serve(r)
+			t.adversaries[i] = a
+		}
+		l, err := r.Run("127.0.0.1:0")
+		if err != nil {
+			return t, err
+		}
+		t.listeners = append(t.listeners, l)
+
+		// Only the public record of the trust domain leaves its replica.
+		t.TrustDomains = append(t.TrustDomains, &common.TrustDomainConfig{
+			Name:          name,
+			Address:       "http://" + l.Addr().String(),
+			IsValid:       true,
+			PublicKey:     td.PublicKey,
+			SignPublicKey: td.SignPublicKey,
+		})
+	}
+
+	t.Frontend = server.NewFrontendServer("frontend", &server.Config{
+		Config:        opts.Config,
+		ReadBatch:     opts.ReadBatch,
+		WriteInterval: opts.Interval,
+		ReadInterval:  opts.Interval,
+		TrustDomain:   common.NewTrustDomainConfig("frontend", "", true, false),
+	}, t.TrustDomains)
+	l, err := t.Frontend.Run("127.0.0.1:0")
+	if err != nil {
+		return t, err
+	}
+	t.listeners = append(t.listeners, l)
+	t.FrontendAddr = "http://" + l.Addr().String()
+	return t, nil
+}
+
+// ClientConfig is the configuration of clients of the topology.
+func (t *Topology) ClientConfig() libtalek.ClientConfig {
+	return libtalek.ClientConfig{
+		Config:        t.Config,
+		WriteInterval: t.interval,
+		ReadInterval:  t.interval,
+		TrustDomains:  t.TrustDomains,
+		FrontendAddr:  t.FrontendAddr,
+	}
+}
+
+// NewClient connects a client to the frontend of the topology. It is killed
+// when the topology is closed.
+func (t *Topology) NewClient(name string) *libtalek.Client {
+	rpc := common.NewFrontendRPC(name, t.FrontendAddr)
+	c := libtalek.NewClient(name, t.ClientConfig(), rpc)
+	if c == nil {
+		rpc.Close()
+		return nil
+	}
+	t.rpcs = append(t.rpcs, rpc)
+	t.clients = append(t.clients, c)
+	return c
+}
+
+// AdversaryStats reports what the adversarial replica of a trust domain has
+// done, and false for an honest one.
+func (t *Topology) AdversaryStats(trustDomain int) (AdversaryStats, bool) {
+	a, ok := t.adversaries[trustDomain]
+	if !ok {
+		return AdversaryStats{}, false
+	}
+	return a.Stats(), true
+}
+
+// Close kills the clients of the topology and stops its servers.
+func (t *Topology) Close() {
+	for _, c := range t.clients {
+		c.Kill()
+	}
+	for _, rpc := range t.rpcs {
+		rpc.Close()
+	}
+	if t.Frontend != nil {
+		t.Frontend.Frontend.Close()
+	}
+	for _, r := range t.Replicas {
+		r.Replica.Close()
+	}
+	for _, l := range t.listeners {
+		l.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package talektest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+)
+
+func TestTopologyRoundTrip(t *testing.T) {
+	top, err := Start(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+	if len(top.Replicas) != 2 || top.FrontendAddr == "" {
+		t.Fatalf("Topology not started: %d replicas at %q", len(top.Replicas), top.FrontendAddr)
+	}
+
+	writer := top.NewClient("writer")
+	reader := top.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatal("Could not create clients.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("hello talek")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	updates := reader.Poll(&handle)
+	select {
+	case msg := <-updates:
+		if string(msg) != "hello talek" {
+			t.Fatalf("Read %q", msg)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Message was not read back.")
+	}
+}
+
+func TestTopologyVerifyBuckets(t *testing.T) {
+	config := DefaultConfig()
+	config.VerifyBuckets = true
+	top, err := Start(Options{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+
+	writer := top.NewClient("writer")
+	reader := top.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatal("Could not create clients.")
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("hello talek")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	// Replies are only delivered once verified against the commitments of
+	// both trust domains.
+	updates := reader.Poll(&handle)
+	select {
+	case msg := <-updates:
+		if string(msg) != "hello talek" {
+			t.Fatalf("Read %q", msg)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Message was not read back.")
+	}
+	for {
+		select {
+		case e := <-reader.Events():
+			if e.Kind == libtalek.EventUnverified {
+				t.Fatalf("Read of honest replicas failed to verify: %v", e)
+			}
+			continue
+		default:
+		}
+		break
+	}
+}
+
+func TestTopologyPlacementHashes(t *testing.T) {
+	// Clients place writes and reads and replicas verify broadcasts by the
+	// placement hash of the common config, so each must round trip.
+	for _, hash := range []uint8{common.PlacementSipHash, common.PlacementHMACSHA256, common.PlacementSipHash48, common.PlacementBLAKE3} {
+		config := DefaultConfig()
+		config.PlacementHash = hash
+		testPlacementRoundTrip(t, config)
+	}
+}
+
+func testPlacementRoundTrip(t *testing.T, config *common.Config) {
+	top, err := Start(Options{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+
+	writer := top.NewClient("writer")
+	reader := top.NewClient("reader")
+	if writer == nil || reader == nil {
+		t.Fatalf("Could not create clients of placement hash %d.", config.PlacementHash)
+	}
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := topic.Handle
+	if err = writer.Publish(topic, []byte("hello talek")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	select {
+	case msg := <-reader.Poll(&handle):
+		if string(msg) != "hello talek" {
+			t.Fatalf("Read %q under placement hash %d", msg, config.PlacementHash)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatalf("Message was not read back under placement hash %d.", config.PlacementHash)
+	}
+}
@@ -0,0 +1,363 @@
+package talektest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/libtalek"
+)
+
+// Profile is a parameterized workload, of cohorts of clients which behave
+// alike. Replaying profiles of how people use messaging, rather than floods
+// at a constant rate, lets performance work target realistic patterns.
+type Profile struct {
+	Name    string
+	Cohorts []Cohort
+	// How long to publish for.
+	Duration time.Duration `json:",string"`
+	// How long to wait for messages to be delivered once publishing stops.
+	Drain time.Duration `json:",string"`
+	// Seeds the schedule of publishes, so runs can be repeated.
+	Seed int64
+}
+
+// Cohort is a group of clients with the same behavior. Each client publishes
+// to its own topic, which the other clients of its group poll.
+type Cohort struct {
+	// Labels the metrics of the cohort.
+	Label   string
+	Clients int
+	// Clients in each group, who read each other's topics. 1 reads nothing.
+	GroupSize int
+	// Label of a cohort whose topics every client of this one also reads.
+	Follows string
+	// Mean messages each client publishes per second. 0 never publishes.
+	Rate float64
+	// Messages published together, as in a burst of chat. Bursts arrive at
+	// Rate / Burst per second.
+	Burst int
+	// Variation of the rate over each period, from 0 (constant) to 1 (idle at
+	// its trough), following a sine as activity does over a day.
+	DiurnalAmplitude float64
+	DiurnalPeriod    time.Duration `json:",string"`
+	// Bytes of each message. At least the 16 bytes of its timestamp and number.
+	MessageSize int
+}
+
+// Profiles are the built in workloads, by name.
+var Profiles = map[string]Profile{
+	// Publishing rising and falling over a day, compressed to a minute.
+	"diurnal": {
+		Name:     "diurnal",
+		Duration: time.Minute,
+		Drain:    10 * time.Second,
+		Cohorts: []Cohort{
+			{Label: "daytime", Clients: 8, GroupSize: 2, Rate: 0.5, Burst: 1, DiurnalAmplitude: 0.9, DiurnalPeriod: time.Minute, MessageSize: 64},
+		},
+	},
+	// Small groups exchanging bursts of messages.
+	"groupchat": {
+		Name:     "groupchat",
+		Duration: 30 * time.Second,
+		Drain:    10 * time.Second,
+		Cohorts: []Cohort{
+			{Label: "chat", Clients: 8, GroupSize: 4, Rate: 0.4, Burst: 4, MessageSize: 128},
+		},
+	},
+	// Many idle clients following topics, and a few publishing to them.
+	"lurkers": {
+		Name:     "lurkers",
+		Duration: 30 * time.Second,
+		Drain:    10 * time.Second,
+		Cohorts: []Cohort{
+			{Label: "posters", Clients: 2, GroupSize: 1, Rate: 0.5, Burst: 1, MessageSize: 256},
+			{Label: "lurkers", Clients: 16, GroupSize: 1, Follows: "posters"},
+		},
+	},
+}
+
+// ProfileFromFile restores a workload profile from JSON.
+func ProfileFromFile(file string) (*Profile, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	profile := new(Profile)
+	if err := json.Unmarshal(dat, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// CohortMetrics are what a cohort achieved during a run.
+type CohortMetrics struct {
+	Profile string
+	Label   string
+	Clients int
+	// Messages published, and those that failed to be.
+	Published     uint64
+	PublishFailed uint64
+	// Messages of the cohort read by the clients expected to read them, and
+	// those never read.
+	Delivered uint64
+	Lost      uint64
+	// From publishing to delivery.
+	LatencyMean time.Duration
+	LatencyP50  time.Duration
+	LatencyP99  time.Duration
+}
+
+// WorkloadReport has the metrics of each cohort of a run.
+type WorkloadReport struct {
+	Profile  string
+	Duration time.Duration
+	Cohorts  []CohortMetrics
+}
+
+// messageHeader is the timestamp and number prefixing each message.
+const messageHeader = 16
+
+// RunWorkload replays a profile through clients made by newClient, such as
+// Topology.NewClient or MockFrontend.NewClient, which own the clients.
+func RunWorkload(profile Profile, newClient func(name string) *libtalek.Client) (*WorkloadReport, error) {
+	runs := make([]*cohortRun, 0, len(profile.Cohorts))
+	for i, c := range profile.Cohorts {
+		if c.Clients <= 0 || c.Rate < 0 || c.DiurnalAmplitude < 0 || c.DiurnalAmplitude > 1 {
+			return nil, fmt.Errorf("cohort %q is not a valid workload", c.Label)
+		}
+		if c.GroupSize <= 0 {
+			c.GroupSize = 1
+		}
+		if c.Burst <= 0 {
+			c.Burst = 1
+		}
+		if c.MessageSize < messageHeader {
+			c.MessageSize = messageHeader
+		}
+		run := &cohortRun{Cohort: c, seed: profile.Seed + int64(i)}
+		for j := 0; j < c.Clients; j++ {
+			client := newClient(fmt.Sprintf("%s-%d", c.Label, j))
+			if client == nil {
+				return nil, fmt.Errorf("could not create client %d of cohort %q", j, c.Label)
+			}
+			topic, err := libtalek.NewTopic()
+			if err != nil {
+				return nil, err
+			}
+			run.clients = append(run.clients, client)
+			run.topics = append(run.topics, topic)
+		}
+		runs = append(runs, run)
+	}
+	byLabel := make(map[string]*cohortRun)
+	for _, run := range runs {
+		byLabel[run.Label] = run
+	}
+	for _, run := range runs {
+		if run.Follows == "" {
+			continue
+		}
+		if byLabel[run.Follows] == nil {
+			return nil, fmt.Errorf("cohort %q follows unknown cohort %q", run.Label, run.Follows)
+		}
+		run.following = byLabel[run.Follows]
+		run.following.followers += len(run.clients)
+	}
+
+	start := time.Now()
+	stop := make(chan struct{})
+	var publishers, readers sync.WaitGroup
+	for _, run := range runs {
+		if err := run.follow(&readers, stop); err != nil {
+			close(stop)
+			readers.Wait()
+			return nil, err
+		}
+	}
+	for _, run := range runs {
+		run.publish(&publishers, start, profile.Duration)
+	}
+	publishers.Wait()
+	time.Sleep(profile.Drain)
+	close(stop)
+	readers.Wait()
+
+	report := &WorkloadReport{Profile: profile.Name, Duration: time.Since(start)}
+	for _, run := range runs {
+		report.Cohorts = append(report.Cohorts, run.metrics(profile.Name))
+	}
+	return report, nil
+}
+
+// cohortRun is the state of a cohort during a run.
+type cohortRun struct {
+	Cohort
+	seed      int64
+	clients   []*libtalek.Client
+	topics    []*libtalek.Topic
+	following *cohortRun
+	followers int // Clients of other cohorts reading every topic of this one
+
+	mu        sync.Mutex
+	published []uint64 // By client
+	failed    uint64
+	delivered uint64
+	latencies []time.Duration
+}
+
+// follow has each client poll the topics of the rest of its group, and of
+// the cohort it follows.
+func (r *cohortRun) follow(wg *sync.WaitGroup, stop chan struct{}) error {
+	for i, client := range r.clients {
+		group := i / r.GroupSize
+		for j := group * r.GroupSize; j < (group+1)*r.GroupSize && j < len(r.topics); j++ {
+			if j == i {
+				continue
+			}
+			if err := r.poll(wg, stop, client, r.topics[j]); err != nil {
+				return err
+			}
+		}
+		if r.following == nil {
+			continue
+		}
+		for _, topic := range r.following.topics {
+			if err := r.following.poll(wg, stop, client, topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// poll reads the messages of a topic of the cohort with client, until stopped.
+// Each reader has its own handle, shared as applications share them.
+func (r *cohortRun) poll(wg *sync.WaitGroup, stop chan struct{}, client *libtalek.Client, topic *libtalek.Topic) error {
+	txt, err := topic.Handle.MarshalText()
+	if err != nil {
+		return err
+	}
+	handle := new(libtalek.Handle)
+	if err = handle.UnmarshalText(txt); err != nil {
+		return err
+	}
+	msgs := client.Poll(handle)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer client.Done(handle)
+		for {
+			select {
+			case msg := <-msgs:
+				r.deliver(msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// publish has each client publish to its topic for duration.
+func (r *cohortRun) publish(wg *sync.WaitGroup, start time.Time, duration time.Duration) {
+	r.published = make([]uint64, len(r.clients))
+	if r.Rate == 0 {
+		return
+	}
+	for i := range r.clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(r.seed*int64(len(r.clients)) + int64(i)))
+			var number uint64
+			for {
+				// Bursts arrive as a Poisson process at the rate of the moment.
+				wait := time.Duration(rnd.ExpFloat64() / r.burstRate(time.Since(start)) * float64(time.Second))
+				if time.Since(start)+wait >= duration {
+					return
+				}
+				time.Sleep(wait)
+				for b := 0; b < r.Burst; b++ {
+					number++
+					msg := make([]byte, r.MessageSize)
+					binary.LittleEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+					binary.LittleEndian.PutUint64(msg[8:], number)
+					err := r.clients[i].Publish(r.topics[i], msg)
+					r.mu.Lock()
+					if err != nil {
+						r.failed++
+					} else {
+						r.published[i]++
+					}
+					r.mu.Unlock()
+				}
+			}
+		}(i)
+	}
+}
+
+// burstRate is the rate of bursts at a time into the run, never quite zero
+// so the wait for the next is bounded.
+func (r *cohortRun) burstRate(elapsed time.Duration) float64 {
+	rate := r.Rate / float64(r.Burst)
+	if r.DiurnalPeriod > 0 {
+		phase := 2 * math.Pi * float64(elapsed) / float64(r.DiurnalPeriod)
+		rate *= 1 + r.DiurnalAmplitude*math.Sin(phase)
+	}
+	return math.Max(rate, r.Rate/1000)
+}
+
+func (r *cohortRun) deliver(msg []byte) {
+	if len(msg) < messageHeader {
+		return
+	}
+	sent := time.Unix(0, int64(binary.LittleEndian.Uint64(msg)))
+	r.mu.Lock()
+	r.delivered++
+	r.latencies = append(r.latencies, time.Since(sent))
+	r.mu.Unlock()
+}
+
+func (r *cohortRun) metrics(profile string) CohortMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := CohortMetrics{
+		Profile:       profile,
+		Label:         r.Label,
+		Clients:       len(r.clients),
+		PublishFailed: r.failed,
+		Delivered:     r.delivered,
+	}
+	// Each message is for the rest of its publisher's group, and followers.
+	var expected uint64
+	for i, published := range r.published {
+		group := i / r.GroupSize
+		members := r.GroupSize
+		if end := len(r.clients); (group+1)*r.GroupSize > end {
+			members = end - group*r.GroupSize
+		}
+		m.Published += published
+		expected += published * uint64(members-1+r.followers)
+	}
+	if expected > r.delivered {
+		m.Lost = expected - r.delivered
+	}
+	if len(r.latencies) > 0 {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		var total time.Duration
+		for _, l := range r.latencies {
+			total += l
+		}
+		m.LatencyMean = total / time.Duration(len(r.latencies))
+		m.LatencyP50 = r.latencies[len(r.latencies)/2]
+		m.LatencyP99 = r.latencies[len(r.latencies)*99/100]
+	}
+	return m
+}
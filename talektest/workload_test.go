@@ -0,0 +1,53 @@
+package talektest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunWorkload(t *testing.T) {
+	mock, err := NewMockFrontend(MockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	profile := Profile{
+		Name:     "test",
+		Duration: 2 * time.Second,
+		Drain:    2 * time.Second,
+		Cohorts: []Cohort{
+			{Label: "chat", Clients: 3, GroupSize: 3, Rate: 2, Burst: 2, DiurnalAmplitude: 0.5, DiurnalPeriod: time.Second, MessageSize: 32},
+			{Label: "lurkers", Clients: 2, Follows: "chat"},
+		},
+	}
+	report, err := RunWorkload(profile, mock.NewClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Cohorts) != 2 {
+		t.Fatalf("Report of %d cohorts rather than 2", len(report.Cohorts))
+	}
+	chat, lurkers := report.Cohorts[0], report.Cohorts[1]
+	if chat.Label != "chat" || chat.Profile != "test" || chat.Clients != 3 {
+		t.Fatalf("Metrics mislabeled: %+v", chat)
+	}
+	if chat.Published == 0 || chat.Delivered == 0 {
+		t.Fatalf("Nothing published or delivered: %+v", chat)
+	}
+	// Each message is for the two other members of its group, and two lurkers.
+	if chat.Delivered+chat.Lost < 4*chat.Published {
+		t.Fatalf("%d delivered and %d lost of %d published", chat.Delivered, chat.Lost, chat.Published)
+	}
+	if chat.LatencyP50 <= 0 || chat.LatencyP99 < chat.LatencyP50 {
+		t.Fatalf("Latencies out of order: %+v", chat)
+	}
+	if lurkers.Published != 0 || lurkers.Delivered != 0 {
+		t.Fatalf("Lurkers published: %+v", lurkers)
+	}
+
+	profile.Cohorts[1].Follows = "nobody"
+	if _, err := RunWorkload(profile, mock.NewClient); err == nil {
+		t.Fatal("Followed an unknown cohort.")
+	}
+}